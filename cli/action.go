@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -102,8 +103,9 @@ func runInteractiveSession(bundle *CommitBundle, args []string, directory string
 		Host:   bundle.Hostname,
 		Path:   "/sockets/" + bundle.ProblemType.Name + "/" + bundle.Commit.Action,
 	}
+	endpoint.RawQuery = url.Values{"ticket": {bundle.Ticket}}.Encode()
 
-	socket, resp, err := websocket.DefaultDialer.Dial(endpoint.String(), nil)
+	socket, resp, err := socketDialer.Dial(endpoint.String(), nil)
 	if err != nil {
 		log.Printf("error dialing: %v", err)
 		if resp != nil && resp.Body != nil {
@@ -122,6 +124,17 @@ func runInteractiveSession(bundle *CommitBundle, args []string, directory string
 		log.Printf("error writing request message: %v", err)
 		return
 	}
+	stop := make(chan struct{})
+	defer close(stop)
+	var lock sync.Mutex
+	go sendHeartbeats(socket, &lock, stop)
+
+	// pass along what the user types if the action reads it
+	interactive := false
+	if action := bundle.ProblemType.Actions[bundle.Commit.Action]; action != nil && action.Interactive {
+		interactive = true
+		go sendStdin(socket, &lock)
+	}
 
 	// start listening for events
 	for {
@@ -145,7 +158,12 @@ func runInteractiveSession(bundle *CommitBundle, args []string, directory string
 
 		case reply.Event != nil:
 			switch reply.Event.Event {
-			case "exec", "stdin", "stdout", "exit", "error":
+			case "stdin":
+				// the terminal already echoed it
+				if !interactive {
+					fmt.Printf("%s", reply.Event.Dump())
+				}
+			case "exec", "stdout", "exit", "error", "queued":
 				fmt.Printf("%s", reply.Event.Dump())
 			case "stderr":
 				fmt.Printf("%s", reply.Event.Dump())
@@ -167,6 +185,30 @@ func runInteractiveSession(bundle *CommitBundle, args []string, directory string
 	}
 }
 
+// sendStdin sends everything read from standard input to the daycare,
+// and tells it when standard input is closed.
+func sendStdin(socket *websocket.Conn, lock *sync.Mutex) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			data := append([]byte{}, buf[:n]...)
+			lock.Lock()
+			werr := socket.WriteJSON(&DaycareRequest{Stdin: data})
+			lock.Unlock()
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			lock.Lock()
+			socket.WriteJSON(&DaycareRequest{CloseStdin: true})
+			lock.Unlock()
+			return
+		}
+	}
+}
+
 var rawMode = false
 
 func dumpOutgoing(msg interface{}) {
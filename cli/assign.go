@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// assignDateFormats are the ways a date may be given to the assign command,
+// interpreted in the local time zone unless it says otherwise.
+var assignDateFormats = []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+
+func CommandAssign(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+
+	if len(args) != 2 {
+		cmd.Help()
+		os.Exit(1)
+	}
+	courseID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || courseID < 1 {
+		log.Fatalf("course ID must be a number, not %q", args[0])
+	}
+
+	// find the problem set
+	problemSets := []*ProblemSet{}
+	params := make(url.Values)
+	params.Add("unique", args[1])
+	mustGetObject("/problem_sets", params, &problemSets)
+	if len(problemSets) != 1 {
+		log.Fatalf("no problem set found with unique ID %q", args[1])
+	}
+
+	bulk := &BulkAssignment{
+		ProblemSetID: problemSets[0].ID,
+		Title:        cmd.Flag("title").Value.String(),
+	}
+	for _, elt := range []struct {
+		flag string
+		when **time.Time
+	}{{"unlock", &bulk.UnlockAt}, {"due", &bulk.DueAt}, {"lock", &bulk.LockAt}} {
+		s := cmd.Flag(elt.flag).Value.String()
+		if s == "" {
+			continue
+		}
+		*elt.when = parseAssignDate(elt.flag, s)
+	}
+
+	result := new(BulkAssignmentResult)
+	mustPostObject(fmt.Sprintf("/courses/%d/bulk_assignments", courseID), nil, bulk, result)
+	fmt.Printf("assigned %s to course %d: %d created, %d updated, %d unchanged\n",
+		problemSets[0].Unique, courseID, result.Created, result.Updated, result.Unchanged)
+}
+
+func parseAssignDate(flag, s string) *time.Time {
+	for _, layout := range assignDateFormats {
+		if when, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return &when
+		}
+	}
+	log.Fatalf("unable to parse --%s date %q; use a format like \"2006-01-02 15:04\"", flag, s)
+	return nil
+}
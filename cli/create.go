@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,16 +21,35 @@ const ProblemConfigName string = "problem.cfg"
 
 type ConfigFile struct {
 	Problem struct {
-		Unique string
-		Note   string
-		Type   string
-		Tag    []string
-		Option []string
+		Unique       string
+		Note         string
+		Type         string
+		Tag          []string
+		Option       []string
+		Prerequisite []string
+		Attempts     int64
+		Minutes      int64
+		Difficulty   int64
 	}
 	Step map[string]*struct {
-		Note   string
-		Type   string
-		Weight float64
+		Note       string
+		Type       string
+		Weight     float64
+		Attempts   int64
+		Diagnostic bool
+	}
+	Hint map[string]*struct {
+		Step    int64
+		Test    string
+		Pattern string
+		After   int64
+		Text    string
+	}
+	Test map[string]*struct {
+		Step     int64
+		Weight   float64
+		Required bool
+		Hidden   bool
 	}
 }
 
@@ -97,6 +117,7 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 			UserID:               signed.UserID,
 			Commit:               signed.Commits[step-1],
 			CommitSignature:      signed.CommitSignatures[step-1],
+			Ticket:               signed.Tickets[step-1],
 		}
 
 		runInteractiveSession(unvalidated, nil, stepDir)
@@ -104,6 +125,7 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 	}
 
 	// validate the commits one at a time
+	signed.ReportCardSignatures = make([]string, len(signed.ProblemSteps))
 	for n := 0; n < len(signed.ProblemSteps); n++ {
 		fmt.Printf("validating solution for step %d\n", n+1)
 		unvalidated := &CommitBundle{
@@ -116,6 +138,7 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 			UserID:               signed.UserID,
 			Commit:               signed.Commits[n],
 			CommitSignature:      signed.CommitSignatures[n],
+			Ticket:               signed.Tickets[n],
 		}
 		validated := mustConfirmCommitBundle(unvalidated, nil)
 		fmt.Println("  finished validating solution")
@@ -135,6 +158,12 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 		signed.ProblemSignature = validated.ProblemSignature
 		signed.Commits[n] = validated.Commit
 		signed.CommitSignatures[n] = validated.CommitSignature
+		signed.ReportCardSignatures[n] = validated.ReportCardSignature
+	}
+
+	// make sure the starter files do not already pass
+	if cmd.Flag("skip-starter-check").Value.String() != "true" {
+		checkStarterFiles(unsigned)
 	}
 
 	fmt.Println("problem and solution confirmed successfully")
@@ -148,6 +177,9 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 		mustPutObject(fmt.Sprintf("/problem_bundles/%d", signed.Problem.ID), nil, signed, final)
 		fmt.Printf("problem %q saved and ready to use\n", final.Problem.Unique)
 	}
+	for _, warning := range final.Warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
 
 	if signed.Problem.ID == 0 {
 		// create a matching problem set
@@ -176,6 +208,50 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 	}
 }
 
+// checkStarterFiles grades the files a student starts each step with and stops
+// if any step passes before the student has done anything. For the first step
+// that is the starter files; for later steps it is the author solution to the
+// previous step plus any starter files added in the new step.
+func checkStarterFiles(unsigned *ProblemBundle) {
+	var commits []*Commit
+	for n, step := range unsigned.ProblemSteps {
+		commit := *unsigned.Commits[n]
+		commit.Note = "starter files checked via grind"
+		commit.Files = make(map[string][]byte)
+		if n > 0 {
+			for name, contents := range unsigned.Commits[n-1].Files {
+				commit.Files[name] = contents
+			}
+		}
+		for name, contents := range step.Files {
+			if step.Whitelist[name] {
+				commit.Files[name] = contents
+			}
+		}
+		if len(commit.Files) == 0 {
+			log.Fatalf("step %d has no starter files for students to edit", n+1)
+		}
+		commits = append(commits, &commit)
+	}
+
+	fmt.Println("checking that the starter files do not pass")
+	failed := false
+	for n, commit := range mustGradeCommits(unsigned, commits) {
+		if commit.ReportCard != nil && commit.ReportCard.Passed && commit.Score == 1.0 {
+			if n == 0 {
+				fmt.Printf("  the starter files for step 1 already pass\n")
+			} else {
+				fmt.Printf("  the solution to step %d already passes step %d\n", n, n+1)
+			}
+			failed = true
+		}
+	}
+	if failed {
+		log.Printf("students would get credit without doing any work")
+		log.Fatalf("please fix the starter files and try again, or use --skip-starter-check if this is intended")
+	}
+}
+
 func findProblemCfg(now time.Time, startDir string) (string, string, int, *Problem, []*ProblemStep, bool) {
 	// find the absolute directory so we can walk up the tree if needed
 	directory, err := filepath.Abs(startDir)
@@ -211,12 +287,15 @@ func findProblemCfg(now time.Time, startDir string) (string, string, int, *Probl
 		log.Fatalf("failed to parse %s: %v", configPath, err)
 	}
 	problem := &Problem{
-		Unique:    cfg.Problem.Unique,
-		Note:      cfg.Problem.Note,
-		Tags:      cfg.Problem.Tag,
-		Options:   cfg.Problem.Option,
-		CreatedAt: now,
-		UpdatedAt: now,
+		Unique:           cfg.Problem.Unique,
+		Note:             cfg.Problem.Note,
+		Tags:             cfg.Problem.Tag,
+		Options:          cfg.Problem.Option,
+		Prerequisites:    cfg.Problem.Prerequisite,
+		EstimatedMinutes: cfg.Problem.Minutes,
+		Difficulty:       cfg.Problem.Difficulty,
+		CreatedAt:        now,
+		UpdatedAt:        now,
 	}
 
 	// create skeleton steps
@@ -228,6 +307,7 @@ func findProblemCfg(now time.Time, startDir string) (string, string, int, *Probl
 			Note:        problem.Note,
 			ProblemType: cfg.Problem.Type,
 			Weight:      1.0,
+			MaxAttempts: cfg.Problem.Attempts,
 			Files:       make(map[string][]byte),
 		})
 		stepN = 1
@@ -248,8 +328,16 @@ func findProblemCfg(now time.Time, startDir string) (string, string, int, *Probl
 				Note:        elt.Note,
 				ProblemType: problemType,
 				Weight:      elt.Weight,
+				MaxAttempts: elt.Attempts,
+				Diagnostic:  elt.Diagnostic,
 				Files:       make(map[string][]byte),
 			}
+			if step.MaxAttempts == 0 {
+				step.MaxAttempts = cfg.Problem.Attempts
+			}
+			if elt.Weight < 0 {
+				log.Fatalf("step %d in %s cannot have a negative weight", i, configPath)
+			}
 			steps = append(steps, step)
 		}
 		if len(steps) != len(cfg.Step) {
@@ -264,9 +352,58 @@ func findProblemCfg(now time.Time, startDir string) (string, string, int, *Probl
 		}
 	}
 
+	// attach test weights and required flags to their steps
+	for name, elt := range cfg.Test {
+		step := elt.Step
+		if step == 0 {
+			step = 1
+		}
+		if step < 1 || step > int64(len(steps)) {
+			log.Fatalf("test %q in %s is for step %d, but there is no such step", name, configPath, step)
+		}
+		if elt.Weight < 0 {
+			log.Fatalf("test %q in %s cannot have a negative weight", name, configPath)
+		}
+		if steps[step-1].Tests == nil {
+			steps[step-1].Tests = make(map[string]*StepTest)
+		}
+		steps[step-1].Tests[name] = &StepTest{Weight: elt.Weight, Required: elt.Required, Hidden: elt.Hidden}
+	}
+
 	return directory, stepDir, stepN, problem, steps, single
 }
 
+// readProblemHints gathers the [hint "N"] sections of problem.cfg.
+// Hints are numbered from 1, and a hint without a step is for step 1.
+func readProblemHints(directory string) []*ProblemHint {
+	var cfg ConfigFile
+	configPath := filepath.Join(directory, ProblemConfigName)
+	if err := gcfg.ReadFileInto(&cfg, configPath); err != nil {
+		log.Fatalf("failed to parse %s: %v", configPath, err)
+	}
+	var hints []*ProblemHint
+	for name, elt := range cfg.Hint {
+		position, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || position < 1 {
+			log.Fatalf("hint %q in %s must be numbered starting at 1", name, configPath)
+		}
+		step := elt.Step
+		if step == 0 {
+			step = 1
+		}
+		hints = append(hints, &ProblemHint{
+			Step:     step,
+			Position: position,
+			Test:     elt.Test,
+			Pattern:  elt.Pattern,
+			After:    elt.After,
+			Text:     elt.Text,
+		})
+	}
+	sort.Slice(hints, func(i, j int) bool { return hints[i].Position < hints[j].Position })
+	return hints
+}
+
 func gatherAuthor(now time.Time, isUpdate bool, action string, startDir string) (*ProblemBundle, string, int) {
 	directory, stepDir, stepN, problem, steps, single := findProblemCfg(now, startDir)
 	if problem == nil {
@@ -302,7 +439,8 @@ func gatherAuthor(now time.Time, isUpdate bool, action string, startDir string)
 
 	// start forming the problem bundle
 	unsigned := &ProblemBundle{
-		Problem: problem,
+		Problem:      problem,
+		ProblemHints: readProblemHints(directory),
 	}
 
 	// check if this is an existing problem
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// deadlineNote describes how long until an assignment is due or locked.
+// It counts from the server's clock, not the local one, since the server
+// decides whether work is on time.
+func deadlineNote(deadline *Deadline) string {
+	if deadline == nil {
+		return ""
+	}
+	now := deadline.ServerTime
+	grace := time.Duration(deadline.GraceMinutes) * time.Minute
+	switch {
+	case deadline.LockAt != nil && now.After(deadline.LockAt.Add(grace)):
+		return "locked"
+	case deadline.DueAt != nil && now.Before(*deadline.DueAt):
+		return "due in " + roughDuration(deadline.DueAt.Sub(now))
+	case deadline.LockAt != nil:
+		return "past due, locks in " + roughDuration(deadline.LockAt.Add(grace).Sub(now))
+	default:
+		return ""
+	}
+}
+
+// roughDuration formats a duration to the nearest minute, or in days and hours
+// when it is more than a day.
+func roughDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	if d >= 24*time.Hour {
+		days := int(d / (24 * time.Hour))
+		hours := int(d%(24*time.Hour)) / int(time.Hour)
+		return fmt.Sprintf("%dd%dh", days, hours)
+	}
+	return strings.TrimSuffix(d.Truncate(time.Minute).String(), "0s")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// feedbackLabel introduces feedback from the outside service so it is never
+// mistaken for the grader or the instructor.
+const feedbackLabel = "Supplementary feedback (generated automatically by an outside service, not by your instructor;\n" +
+	"it does not affect your grade and it may be wrong):"
+
+func CommandFeedback(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+	now := time.Now()
+
+	if len(args) != 0 {
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	_, problem, step, assignment, _, _, _ := gatherStudent(now, ".")
+	commit := new(Commit)
+	mustGetObject(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/commits/last", assignment.ID, problem.ID, step.Step), nil, commit)
+	if commit.Feedback == "" {
+		fmt.Printf("no feedback for your latest attempt at step %d\n", step.Step)
+		fmt.Printf("feedback takes a minute or two to arrive after a failed attempt, and only some courses use it\n")
+		return
+	}
+	fmt.Println(feedbackLabel)
+	fmt.Println()
+	fmt.Println(commit.Feedback)
+}
+
+// printFeedbackPending tells the student when feedback on a failed attempt is on its way.
+func printFeedbackPending(saved *CommitBundle) {
+	if saved.FeedbackPending {
+		fmt.Printf("\nsupplementary feedback on this attempt is being prepared; run \"%s feedback\" in a minute to see it\n", os.Args[0])
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/russross/codegrinder/sdk"
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+func CommandFetchCommit(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+
+	withTests := cmd.Flag("tests").Value.String() == "true"
+	withContainer := cmd.Flag("container").Value.String() == "true"
+
+	// find the commit: either given by ID or the latest one for the current step
+	var commitID int64
+	target := ""
+	switch len(args) {
+	case 0:
+		_, problem, _, _, commit, _, _ := gatherStudent(time.Now(), ".")
+		last := new(Commit)
+		mustGetObject(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/commits/last", commit.AssignmentID, problem.ID, commit.Step), nil, last)
+		commitID = last.ID
+	case 1, 2:
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || id < 1 {
+			log.Fatalf("commit ID must be a positive number, not %q", args[0])
+		}
+		commitID = id
+		if len(args) == 2 {
+			target = args[1]
+		}
+	default:
+		cmd.Help()
+		os.Exit(1)
+	}
+	if target == "" {
+		target = fmt.Sprintf("commit-%d", commitID)
+	}
+	if _, err := os.Stat(target); err == nil {
+		log.Printf("directory %s already exists", target)
+		log.Fatalf("delete it first or give a different directory")
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("error checking if directory %s exists: %v", target, err)
+	}
+
+	commit := new(Commit)
+	mustGetObject(fmt.Sprintf("/commits/%d", commitID), nil, commit)
+	problem := new(Problem)
+	mustGetObject(fmt.Sprintf("/problems/%d", commit.ProblemID), nil, problem)
+
+	files := make(map[string][]byte)
+	var problemType *ProblemType
+	if withTests || withContainer {
+		step := new(ProblemStep)
+		mustGetObject(fmt.Sprintf("/problems/%d/steps/%d", commit.ProblemID, commit.Step), nil, step)
+		problemType = new(ProblemType)
+		mustGetObject(fmt.Sprintf("/problem_types/%s", step.ProblemType), nil, problemType)
+
+		if withTests {
+			// the step files include the tests students are given;
+			// hidden tests stay on the server
+			for name, contents := range step.Files {
+				files[filepath.FromSlash(name)] = contents
+			}
+			files[filepath.Join("doc", "index.html")] = []byte(step.Instructions)
+			for name, contents := range problemType.Files {
+				files[filepath.FromSlash(name)] = contents
+			}
+		}
+	}
+
+	// the commit's own files go on top
+	for name, contents := range commit.Files {
+		files[filepath.FromSlash(name)] = contents
+	}
+
+	if withContainer {
+		if problemType.OS == "windows" {
+			fmt.Printf("warning: %s grades in Windows containers, so no container files were written\n", problemType.Name)
+		} else {
+			for name, contents := range gradingContainerFiles(problemType) {
+				files[name] = contents
+			}
+		}
+	}
+
+	fmt.Printf("unpacking commit %d (%s step %d, saved %s) in %s\n",
+		commit.ID, problem.Unique, commit.Step, commit.CreatedAt.Local().Format("Mon Jan 2 3:04 PM"), target)
+	updateFiles(target, files, nil, false)
+
+	if commit.ReportCard != nil {
+		status := "failed"
+		if commit.ReportCard.Passed {
+			status = "passed"
+		}
+		fmt.Printf("when it was graded it %s with a score of %.0f%%\n", status, commit.Score*100.0)
+	}
+	if withContainer && problemType.OS != "windows" {
+		fmt.Printf("to grade it the way the server does, run this in %s:\n", target)
+		fmt.Printf("    docker compose run --rm grade\n")
+		fmt.Printf("or open the directory in an editor that supports dev containers\n")
+	}
+}
+
+// gradingContainerFiles returns a docker-compose.yml and a dev container
+// definition that run the problem type's grading image the way a daycare
+// does: as the student user, with no network, and with the same limits.
+func gradingContainerFiles(problemType *ProblemType) map[string][]byte {
+	command := []string{"/bin/sh"}
+	if action, exists := problemType.Actions["grade"]; exists {
+		command = strings.Fields(action.Command)
+	}
+	user := fmt.Sprintf("%d:%d", sdk.StudentUID, sdk.StudentUID)
+
+	compose := new(strings.Builder)
+	fmt.Fprintf(compose, "# Runs the grading image for %s the way the CodeGrinder grader does.\n", problemType.Name)
+	fmt.Fprintf(compose, "# Only the tests you were given are here, so your score may differ.\n")
+	fmt.Fprintf(compose, "#\n#   docker compose run --rm grade\n\n")
+	fmt.Fprintf(compose, "services:\n")
+	fmt.Fprintf(compose, "  grade:\n")
+	fmt.Fprintf(compose, "    image: %s\n", yamlQuote(problemType.Image))
+	fmt.Fprintf(compose, "    user: %s\n", yamlQuote(user))
+	fmt.Fprintf(compose, "    network_mode: none\n")
+	fmt.Fprintf(compose, "    working_dir: /home/student\n")
+	fmt.Fprintf(compose, "    volumes:\n")
+	fmt.Fprintf(compose, "      - .:/home/student\n")
+	fmt.Fprintf(compose, "    command: %s\n", yamlQuote(command))
+	if action, exists := problemType.Actions["grade"]; exists {
+		if action.MaxMemory > 0 {
+			fmt.Fprintf(compose, "    mem_limit: %dm\n", action.MaxMemory)
+		}
+		if action.MaxThreads > 0 {
+			fmt.Fprintf(compose, "    pids_limit: %d\n", action.MaxThreads)
+		}
+	}
+
+	devcontainer := map[string]interface{}{
+		"name":            "CodeGrinder " + problemType.Name,
+		"image":           problemType.Image,
+		"containerUser":   user,
+		"workspaceMount":  "source=${localWorkspaceFolder},target=/home/student,type=bind",
+		"workspaceFolder": "/home/student",
+		"runArgs":         []string{"--network=none"},
+	}
+	raw, err := json.MarshalIndent(devcontainer, "", "  ")
+	if err != nil {
+		log.Fatalf("JSON error encoding dev container: %v", err)
+	}
+
+	return map[string][]byte{
+		"docker-compose.yml": []byte(compose.String()),
+		filepath.Join(".devcontainer", "devcontainer.json"): append(raw, '\n'),
+	}
+}
+
+// yamlQuote quotes a value for YAML; JSON is valid YAML.
+func yamlQuote(elt interface{}) string {
+	raw, err := json.Marshal(elt)
+	if err != nil {
+		log.Fatalf("JSON error encoding %v: %v", elt, err)
+	}
+	return string(raw)
+}
@@ -78,6 +78,14 @@ func CommandGet(cmd *cobra.Command, args []string) {
 	if assignment.UserID != user.ID {
 		log.Fatalf("you do not have an assignment with number %d", assignment.ID)
 	}
+	if assignment.Order != nil && len(assignment.Order.Unmet) > 0 {
+		if assignment.Order.Locked {
+			log.Printf("this assignment is locked until you finish: %s", strings.Join(assignment.Order.Unmet, ", "))
+			log.Fatalf("download it again once those problems are done")
+		}
+		log.Printf("it is recommended that you finish these problems first: %s", strings.Join(assignment.Order.Unmet, ", "))
+	}
+	showAnnouncements(assignment)
 	getAssignment(assignment, rootDir, prettyRoot)
 }
 
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	. "github.com/russross/codegrinder/types"
@@ -23,41 +26,25 @@ func CommandGrade(cmd *cobra.Command, args []string) {
 	user := new(User)
 	mustGetObject("/users/me", nil, user)
 
-	_, problem, _, _, commit, dotfile, _ := gatherStudent(now, ".")
-	commit.Action = "grade"
-	commit.Note = "grind grade"
-	unsigned := &CommitBundle{
-		UserID: user.ID,
-		Commit: commit,
-	}
-
-	// send the commit bundle to the server
-	signed := new(CommitBundle)
-	mustPostObject("/commit_bundles/unsigned", nil, unsigned, signed)
-
-	// send it to the daycare for grading
-	if signed.Hostname == "" {
-		log.Fatalf("server was unable to find a suitable daycare, unable to grade")
+	_, problem, step, assignment, commit, dotfile, _ := gatherStudent(now, ".")
+	if step.MaxAttempts > 0 {
+		confirmGradedAttempt(cmd, assignment, problem, step)
 	}
-	fmt.Printf("submitting %s step %d for grading\n", problem.Unique, commit.Step)
-	graded := mustConfirmCommitBundle(signed, nil)
-
-	// save the commit with report card
-	toSave := &CommitBundle{
-		Hostname:        graded.Hostname,
-		UserID:          graded.UserID,
-		Commit:          graded.Commit,
-		CommitSignature: graded.CommitSignature,
-	}
-	saved := new(CommitBundle)
-	mustPostObject("/commit_bundles/signed", nil, toSave, saved)
+	commit.Note = "grind grade"
+	saved := mustSubmitForGrading(user, problem, commit)
 	commit = saved.Commit
+	if step.Diagnostic {
+		fmt.Printf("  step %d is a diagnostic check and does not count toward your grade\n", commit.Step)
+	}
 
 	if commit.ReportCard != nil && commit.ReportCard.Passed && commit.Score == 1.0 {
 		if nextStep(".", dotfile.Problems[problem.Unique], problem, commit, make(map[string]*ProblemType)) {
 			// save the updated dotfile with new step number
 			saveDotFile(dotfile)
 		}
+		if saved.SurveyRequested {
+			offerSurvey(commit)
+		}
 	} else {
 		// solution failed
 		fmt.Printf("  solution for step %d failed\n", commit.Step)
@@ -69,5 +56,159 @@ func CommandGrade(cmd *cobra.Command, args []string) {
 		if err := commit.DumpTranscript(os.Stdout); err != nil {
 			log.Fatalf("failed to dump transcript: %v", err)
 		}
+		printHints(saved.Hints)
+		printExplanations(assignment, problem, step)
+		printFeedbackPending(saved)
+	}
+}
+
+func CommandCheck(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+	now := time.Now()
+
+	if len(args) != 0 {
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	// get the user ID
+	user := new(User)
+	mustGetObject("/users/me", nil, user)
+
+	_, problem, step, assignment, commit, _, _ := gatherStudent(now, ".")
+	commit.Note = "grind check"
+	commit.Practice = true
+	saved := mustSubmitForGrading(user, problem, commit)
+	commit = saved.Commit
+
+	if commit.ReportCard != nil && commit.ReportCard.Passed && commit.Score == 1.0 {
+		fmt.Printf("  solution for step %d passed the practice check\n", commit.Step)
+		fmt.Printf("  this does not count; use \"%s grade\" to submit it for credit\n", os.Args[0])
+		return
+	}
+
+	fmt.Printf("  solution for step %d failed the practice check\n", commit.Step)
+	if commit.ReportCard != nil {
+		fmt.Printf("  ReportCard: %s\n", commit.ReportCard.Note)
+	}
+	if err := commit.DumpTranscript(os.Stdout); err != nil {
+		log.Fatalf("failed to dump transcript: %v", err)
+	}
+	printHints(saved.Hints)
+	printExplanations(assignment, problem, step)
+	printFeedbackPending(saved)
+}
+
+// confirmGradedAttempt warns the student when a step has a limited number of
+// graded attempts, and asks before using one unless --yes was given.
+func confirmGradedAttempt(cmd *cobra.Command, assignment *Assignment, problem *Problem, step *ProblemStep) {
+	attempts := new(StepAttempts)
+	mustGetObject(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/attempts", assignment.ID, problem.ID, step.Step), nil, attempts)
+	if attempts.Remaining <= 0 {
+		log.Fatalf("you have used all %d graded attempt%s for step %d", attempts.MaxAttempts, plural(int(attempts.MaxAttempts)), step.Step)
+	}
+	fmt.Printf("step %d allows %d graded attempt%s, and you have %d remaining\n",
+		step.Step, attempts.MaxAttempts, plural(int(attempts.MaxAttempts)), attempts.Remaining)
+	if cmd.Flag("yes").Value.String() == "true" {
+		return
+	}
+	fmt.Printf("submit for grading? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		fmt.Println("not submitted")
+		os.Exit(1)
+	}
+}
+
+// mustSubmitForGrading sends a commit to a daycare for grading,
+// saves the graded commit, and returns the bundle saved by the server.
+// If the files have not changed since the last graded attempt at the step,
+// the server sends back that result instead.
+func mustSubmitForGrading(user *User, problem *Problem, commit *Commit) *CommitBundle {
+	commit.Action = "grade"
+	unsigned := &CommitBundle{
+		UserID:     user.ID,
+		Commit:     commit,
+		AllowReuse: true,
+	}
+
+	// send the commit bundle to the server
+	signed := new(CommitBundle)
+	mustPostObject("/commit_bundles/unsigned", nil, unsigned, signed)
+
+	saved := signed
+	if signed.Reused {
+		// nothing changed since the last graded attempt, so the server sent its result
+		fmt.Printf("your files for %s step %d are the same as your last graded submission\n", problem.Unique, commit.Step)
+		fmt.Printf("  showing the result from %s instead of grading them again\n", signed.Commit.UpdatedAt.Local().Format("Jan 2 3:04 PM"))
+	} else {
+		// send it to the daycare for grading
+		if signed.Hostname == "" {
+			log.Fatalf("server was unable to find a suitable daycare, unable to grade")
+		}
+		if commit.Practice {
+			fmt.Printf("submitting %s step %d for a practice check\n", problem.Unique, commit.Step)
+		} else {
+			fmt.Printf("submitting %s step %d for grading\n", problem.Unique, commit.Step)
+		}
+		graded := mustConfirmCommitBundle(signed, nil)
+
+		// save the commit with report card
+		toSave := &CommitBundle{
+			Hostname:            graded.Hostname,
+			UserID:              graded.UserID,
+			Commit:              graded.Commit,
+			CommitSignature:     graded.CommitSignature,
+			ReportCardSignature: graded.ReportCardSignature,
+		}
+		saved = new(CommitBundle)
+		mustPostObject("/commit_bundles/signed", nil, toSave, saved)
+	}
+	if saved.AttemptsRemaining != nil && !commit.Practice {
+		fmt.Printf("  %d graded attempt%s remaining for step %d\n", *saved.AttemptsRemaining, plural(int(*saved.AttemptsRemaining)), commit.Step)
+	}
+	if d := saved.Deadline; d != nil && d.DueAt != nil && d.DueAt.Sub(d.ServerTime) < 24*time.Hour {
+		if note := deadlineNote(d); note != "" {
+			fmt.Printf("  assignment is %s (by the server's clock)\n", note)
+		}
+	}
+	return saved
+}
+
+// offerSurvey asks the student about a problem they just finished.
+// Every question can be skipped, and skipping them all sends nothing.
+func offerSurvey(commit *Commit) {
+	in := bufio.NewReader(os.Stdin)
+	ask := func(prompt string) string {
+		fmt.Print(prompt)
+		answer, _ := in.ReadString('\n')
+		return strings.TrimSpace(answer)
+	}
+	askNumber := func(prompt string, max int64) int64 {
+		for {
+			answer := ask(prompt)
+			if answer == "" {
+				return 0
+			}
+			if n, err := strconv.ParseInt(answer, 10, 64); err == nil && n > 0 && n <= max {
+				return n
+			}
+			fmt.Printf("please enter a number from 1 to %d, or press enter to skip\n", max)
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("please help improve this problem by answering a short survey")
+	fmt.Println("(press enter to skip any question)")
+	survey := &ProblemSurvey{
+		Difficulty: askNumber(fmt.Sprintf("how difficult was it, from 1 (easy) to %d (hard)? ", MaxSurveyDifficulty), MaxSurveyDifficulty),
+		Minutes:    askNumber("about how many minutes did you spend on it? ", MaxSurveyMinutes),
+		Comments:   ask("any other comments? "),
+	}
+	if survey.Difficulty == 0 && survey.Minutes == 0 && survey.Comments == "" {
+		return
 	}
+	mustPostObject(fmt.Sprintf("/assignments/%d/problems/%d/survey", commit.AssignmentID, commit.ProblemID), nil, survey, nil)
+	fmt.Println("thank you for your feedback")
 }
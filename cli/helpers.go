@@ -7,8 +7,11 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -124,41 +127,46 @@ func updateFiles(directory string, files map[string][]byte, oldFiles map[string]
 	}
 }
 
+// showAnnouncements prints any unread course announcements attached to the
+// assignments and marks them as read so each one is only shown once.
+func showAnnouncements(assignments ...*Assignment) {
+	seen := make(map[int64]bool)
+	for _, asst := range assignments {
+		for _, elt := range asst.Announcements {
+			if seen[elt.ID] {
+				continue
+			}
+			seen[elt.ID] = true
+			fmt.Printf("announcement posted %s:\n", elt.CreatedAt.Format("Mon Jan 2 3:04 PM"))
+			for _, line := range strings.Split(elt.Message, "\n") {
+				fmt.Printf("    %s\n", line)
+			}
+			fmt.Println()
+			mustPostObject(fmt.Sprintf("/announcements/%d/read", elt.ID), nil, nil, nil)
+		}
+	}
+}
+
 func gatherStudent(now time.Time, startDir string) (*ProblemType, *Problem, *ProblemStep, *Assignment, *Commit, *DotFileInfo, string) {
 	// find the .grind file containing the problem set info
-	dotfile, problemSetDir, problemDir := findDotFile(startDir)
+	dotfile, info, problemDir := findProblem(startDir)
 
 	// get the assignment
 	assignment := new(Assignment)
 	mustGetObject(fmt.Sprintf("/assignments/%d", dotfile.AssignmentID), nil, assignment)
+	showAnnouncements(assignment)
 
 	// get the problem
-	unique := ""
-	if len(dotfile.Problems) == 1 {
-		// only one problem? files should be in dotfile directory
-		for u := range dotfile.Problems {
-			unique = u
-		}
-		problemDir = problemSetDir
-	} else {
-		// use the subdirectory name to identify the problem
-		if problemDir == "" {
-			log.Printf("you must identify the problem within this problem set")
-			log.Printf("  either run this from with the problem directory, or")
-			log.Fatalf("  identify it as a parameter in the command")
-		}
-		_, unique = filepath.Split(problemDir)
-	}
-	info := dotfile.Problems[unique]
-	if info == nil {
-		log.Fatalf("unable to recognize the problem based on the directory name of %q", unique)
-	}
 	problem := new(Problem)
 	mustGetObject(fmt.Sprintf("/problems/%d", info.ID), nil, problem)
 
 	step := new(ProblemStep)
 	mustGetObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, info.Step), nil, step)
 
+	// let the server know the student is working on this step;
+	// a server too old to track activity answers 404, which is fine
+	doRequest(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/activity", assignment.ID, problem.ID, step.Step), nil, "POST", nil, nil, true)
+
 	problemType := new(ProblemType)
 	mustGetObject(fmt.Sprintf("/problem_types/%s", step.ProblemType), nil, problemType)
 
@@ -211,6 +219,35 @@ func gatherStudent(now time.Time, startDir string) (*ProblemType, *Problem, *Pro
 	return problemType, problem, step, assignment, commit, dotfile, problemDir
 }
 
+// findProblem finds the problem being worked on in startDir,
+// returning the problem set's dot file, the problem's entry in it,
+// and the problem's directory.
+func findProblem(startDir string) (*DotFileInfo, *ProblemInfo, string) {
+	dotfile, problemSetDir, problemDir := findDotFile(startDir)
+
+	unique := ""
+	if len(dotfile.Problems) == 1 {
+		// only one problem? files should be in dotfile directory
+		for u := range dotfile.Problems {
+			unique = u
+		}
+		problemDir = problemSetDir
+	} else {
+		// use the subdirectory name to identify the problem
+		if problemDir == "" {
+			log.Printf("you must identify the problem within this problem set")
+			log.Printf("  either run this from with the problem directory, or")
+			log.Fatalf("  identify it as a parameter in the command")
+		}
+		_, unique = filepath.Split(problemDir)
+	}
+	info := dotfile.Problems[unique]
+	if info == nil {
+		log.Fatalf("unable to recognize the problem based on the directory name of %q", unique)
+	}
+	return dotfile, info, problemDir
+}
+
 func findDotFile(startDir string) (dotfile *DotFileInfo, problemSetDir, problemDir string) {
 	abs := false
 	problemSetDir, problemDir = startDir, ""
@@ -269,11 +306,40 @@ func saveDotFile(dotfile *DotFileInfo) {
 	}
 }
 
+// sendHeartbeats tells the daycare the student is still waiting until stop is closed.
+// It holds lock while writing, so any other goroutine writing to the socket must hold it too.
+func sendHeartbeats(socket *websocket.Conn, lock *sync.Mutex, stop <-chan struct{}) {
+	ticker := time.NewTicker(DaycareHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			lock.Lock()
+			err := socket.WriteJSON(&DaycareRequest{Heartbeat: true})
+			lock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// socketDialer connects to daycares, asking for compressed messages
+// since report cards and event streams can be large.
+var socketDialer = &websocket.Dialer{
+	Proxy:             http.ProxyFromEnvironment,
+	HandshakeTimeout:  45 * time.Second,
+	EnableCompression: true,
+}
+
 func mustConfirmCommitBundle(bundle *CommitBundle, args []string) *CommitBundle {
 	// create a websocket connection to the server
 	headers := make(http.Header)
-	url := "wss://" + bundle.Hostname + "/sockets/" + bundle.ProblemType.Name + "/" + bundle.Commit.Action
-	socket, resp, err := websocket.DefaultDialer.Dial(url, headers)
+	url := "wss://" + bundle.Hostname + "/sockets/" + bundle.ProblemType.Name + "/" + bundle.Commit.Action +
+		"?ticket=" + url.QueryEscape(bundle.Ticket)
+	socket, resp, err := socketDialer.Dial(url, headers)
 	if err != nil {
 		log.Printf("error dialing %s: %v", url, err)
 		if resp != nil && resp.Body != nil {
@@ -289,6 +355,9 @@ func mustConfirmCommitBundle(bundle *CommitBundle, args []string) *CommitBundle
 	if err := socket.WriteJSON(req); err != nil {
 		log.Fatalf("error writing request message: %v", err)
 	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go sendHeartbeats(socket, new(sync.Mutex), stop)
 
 	// start listening for events
 	for {
@@ -307,7 +376,10 @@ func mustConfirmCommitBundle(bundle *CommitBundle, args []string) *CommitBundle
 			return reply.CommitBundle
 
 		case reply.Event != nil:
-			// ignore the streamed data
+			// ignore the streamed data, but let the student know if they are waiting in line
+			if reply.Event.Event == "queued" {
+				log.Print(strings.TrimSpace(reply.Event.Dump()))
+			}
 
 		default:
 			log.Fatalf("unexpected reply from server")
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+func CommandHints(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+	now := time.Now()
+
+	if len(args) != 0 {
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	_, problem, step, assignment, _, _, _ := gatherStudent(now, ".")
+	hints := []*ProblemHint{}
+	mustGetObject(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/hints", assignment.ID, problem.ID, step.Step), nil, &hints)
+	if len(hints) == 0 {
+		fmt.Printf("no hints yet for step %d\n", step.Step)
+		return
+	}
+	for i, hint := range hints {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Hint %d: %s\n", i+1, hint.Text)
+	}
+}
+
+// printHints shows any hints revealed by a failed attempt.
+func printHints(hints []*ProblemHint) {
+	for _, hint := range hints {
+		fmt.Printf("\nHint: %s\n", hint.Text)
+	}
+	if len(hints) > 0 {
+		fmt.Printf("(use \"%s hints\" to see every hint you have been given for this step)\n", os.Args[0])
+	}
+}
+
+// maxExplanations is how many explanations of past failures are shown after an attempt.
+const maxExplanations = 3
+
+// printExplanations shows what instructors have said about earlier commits
+// that failed the same way as the student's latest attempt.
+func printExplanations(assignment *Assignment, problem *Problem, step *ProblemStep) {
+	explanations := []*PastExplanation{}
+	mustGetObject(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/explanations", assignment.ID, problem.ID, step.Step), nil, &explanations)
+	if len(explanations) == 0 {
+		return
+	}
+	fmt.Printf("\nOther students have failed this step the same way. Your instructors explained:\n")
+	for i, elt := range explanations {
+		if i == maxExplanations {
+			break
+		}
+		fmt.Printf("\n  * %s\n", strings.ReplaceAll(elt.Explanation, "\n", "\n    "))
+	}
+}
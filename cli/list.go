@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
 	. "github.com/russross/codegrinder/types"
 	"github.com/spf13/cobra"
@@ -26,6 +28,22 @@ func CommandList(cmd *cobra.Command, args []string) {
 		log.Printf("no assignments found")
 		log.Fatalf("you must start each assignment through Canvas before you can access it here")
 	}
+	showAnnouncements(assignments...)
+
+	// within each course, list assignments in the recommended order
+	courseRank := make(map[int64]int)
+	for _, asst := range assignments {
+		if _, present := courseRank[asst.CourseID]; !present {
+			courseRank[asst.CourseID] = len(courseRank)
+		}
+	}
+	sort.SliceStable(assignments, func(i, j int) bool {
+		a, b := assignments[i], assignments[j]
+		if a.CourseID != b.CourseID {
+			return courseRank[a.CourseID] < courseRank[b.CourseID]
+		}
+		return a.Order != nil && b.Order != nil && a.Order.Position < b.Order.Position
+	})
 
 	var course *Course
 
@@ -55,8 +73,26 @@ func CommandList(cmd *cobra.Command, args []string) {
 		// fetch the problem
 		problemSet := new(ProblemSet)
 		mustGetObject(fmt.Sprintf("/problem_sets/%d", asst.ProblemSetID), nil, problemSet)
-		fmt.Printf("id:%-*d %-*s %3.0f%% (%s/%s)\n", longestID, asst.ID, longestName, asst.CanvasTitle, asst.Score*100.0, courseDirectory(course.Label), problemSet.Unique)
+		note := ""
+		if s := deadlineNote(asst.Deadline); s != "" {
+			note = " [" + s + "]"
+		}
+		if s := orderNote(asst.Order); s != "" {
+			note += " [" + s + "]"
+		}
+		fmt.Printf("id:%-*d %-*s %3.0f%% (%s/%s)%s\n", longestID, asst.ID, longestName, asst.CanvasTitle, asst.Score*100.0, courseDirectory(course.Label), problemSet.Unique, note)
+	}
+}
+
+// orderNote describes the problems a student should finish before starting an assignment.
+func orderNote(order *AssignmentOrder) string {
+	if order == nil || len(order.Unmet) == 0 {
+		return ""
+	}
+	if order.Locked {
+		return "locked until you finish " + strings.Join(order.Unmet, ", ")
 	}
+	return "recommended after " + strings.Join(order.Unmet, ", ")
 }
 
 func dashes(n int) string {
@@ -13,9 +13,11 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/blang/semver"
+	"github.com/russross/codegrinder/sdk"
 	. "github.com/russross/codegrinder/types"
 	"github.com/spf13/cobra"
 )
@@ -113,8 +115,52 @@ func main() {
 		Short: "save your work and submit it for grading",
 		Run:   CommandGrade,
 	}
+	cmdGrade.Flags().BoolP("yes", "y", false, "do not ask before using one of a limited number of graded attempts")
 	cmdGrind.AddCommand(cmdGrade)
 
+	cmdCheck := &cobra.Command{
+		Use:   "check",
+		Short: "save your work and run a practice check that does not count",
+		Long: "Your code is graded the same way as with the grade command,\n" +
+			"but the result is not recorded in your score or sent to Canvas.\n" +
+			"Your instructor must enable practice checks for the assignment.",
+		Run: CommandCheck,
+	}
+	cmdGrind.AddCommand(cmdCheck)
+
+	cmdTest := &cobra.Command{
+		Use:   "test",
+		Short: "run the tests you are given on your own computer using Docker",
+		Long: "Your code is tested in the same container image the server grades\n" +
+			"with, but only with the tests you are given, so the score may differ\n" +
+			"from what grade reports. Nothing is saved or sent to the server.\n\n" +
+			"Docker must be installed and running. Once a step has been tested\n" +
+			"while connected, it can be tested again without a network connection.",
+		Run: CommandTest,
+	}
+	cmdTest.Flags().Bool("json", false, "print the report card as JSON")
+	cmdGrind.AddCommand(cmdTest)
+
+	cmdHints := &cobra.Command{
+		Use:   "hints",
+		Short: "show the hints you have been given for the current step",
+		Long: "Some problems give hints to students who keep failing a step\n" +
+			"the same way. New hints are shown when you grade your work;\n" +
+			"this shows them again.",
+		Run: CommandHints,
+	}
+	cmdGrind.AddCommand(cmdHints)
+
+	cmdFeedback := &cobra.Command{
+		Use:   "feedback",
+		Short: "show supplementary feedback on your latest attempt at the current step",
+		Long: "In courses that use it, a failed attempt is sent (without your name)\n" +
+			"to an outside service that suggests what to look at. The suggestions\n" +
+			"are not from your instructor and do not affect your grade.",
+		Run: CommandFeedback,
+	}
+	cmdGrind.AddCommand(cmdFeedback)
+
 	cmdAction := &cobra.Command{
 		Use:   "action <action name>",
 		Short: "save your work and run an action on the server",
@@ -142,6 +188,24 @@ func main() {
 	}
 	cmdGrind.AddCommand(cmdReset)
 
+	cmdFetchCommit := &cobra.Command{
+		Use:   "fetch-commit [<commit id> [directory]]",
+		Short: "download the files from one of your commits to reproduce its grading",
+		Long: fmt.Sprintf("Downloads the files saved in a commit into a new directory\n"+
+			"(commit-<id> by default) without touching your assignment directory.\n"+
+			"With no commit ID, it uses your latest commit for the step in the\n"+
+			"current directory.\n\n"+
+			"With --tests, the step's starter files and the tests you are given\n"+
+			"are included, too. With --container, a docker-compose.yml and a\n"+
+			"dev container definition are added that run the same image the\n"+
+			"server grades with, so you can see how the grader sees your code.\n\n"+
+			"   Example: '%s fetch-commit 12345 --tests --container'\n", os.Args[0]),
+		Run: CommandFetchCommit,
+	}
+	cmdFetchCommit.Flags().Bool("tests", false, "include the starter files and the tests you are given")
+	cmdFetchCommit.Flags().Bool("container", false, "include docker-compose and dev container files for the grading image")
+	cmdGrind.AddCommand(cmdFetchCommit)
+
 	if isInstructor {
 		cmdCreate := &cobra.Command{
 			Use:   "create [filename]",
@@ -156,8 +220,24 @@ func main() {
 		}
 		cmdCreate.Flags().BoolP("update", "u", false, "update an existing problem/problem set")
 		cmdCreate.Flags().StringP("action", "a", "", "run interactive action for problem step")
+		cmdCreate.Flags().BoolP("skip-starter-check", "", false, "do not check that the starter files fail each step")
 		cmdGrind.AddCommand(cmdCreate)
 
+		cmdMatrix := &cobra.Command{
+			Use:   "matrix <solution directory>...",
+			Short: "grade alternate solutions against every step of a problem (authors only)",
+			Long: fmt.Sprintf("Run in a problem directory and give one or more directories holding\n"+
+				"alternate solutions (common mistakes, edge cases, etc.). Each one is\n"+
+				"graded against every step along with the author solution, and the\n"+
+				"scores are printed as a matrix so you can check that the tests tell\n"+
+				"them apart before publishing the problem.\n\n"+
+				"Files in a solution directory replace the author solution files for\n"+
+				"every step; use subdirectories named 1, 2, etc. for per-step files.\n\n"+
+				"   Example: '%s matrix ../wrong-off-by-one ../empty-input'\n", os.Args[0]),
+			Run: CommandMatrix,
+		}
+		cmdGrind.AddCommand(cmdMatrix)
+
 		cmdStudent := &cobra.Command{
 			Use:   "student <search terms>",
 			Short: "download a student assignment (instructors only)",
@@ -165,6 +245,35 @@ func main() {
 		}
 		cmdGrind.AddCommand(cmdStudent)
 
+		cmdAssign := &cobra.Command{
+			Use:   "assign <course id> <problem set unique ID>",
+			Short: "assign a problem set to everyone in a course (instructors only)",
+			Long: fmt.Sprintf("Creates an assignment of the problem set for every user enrolled\n"+
+				"in the course, for courses that are not run through an LMS.\n"+
+				"Run it again to change the title or dates.\n"+
+				"Dates are in local time, like \"2006-01-02 15:04\".\n\n"+
+				"   Example: '%s assign 12 cs1400-loops --due \"2024-09-20 23:59\"'\n", os.Args[0]),
+			Run: CommandAssign,
+		}
+		cmdAssign.Flags().String("title", "", "title of the assignment (default is the problem set note)")
+		cmdAssign.Flags().String("unlock", "", "when the assignment opens")
+		cmdAssign.Flags().String("due", "", "when the assignment is due")
+		cmdAssign.Flags().String("lock", "", "when the assignment closes")
+		cmdGrind.AddCommand(cmdAssign)
+
+		cmdShell := &cobra.Command{
+			Use:   "shell [<commit id>]",
+			Short: "open a shell in a grading container with a student's code (instructors only)",
+			Long: fmt.Sprintf("Opens an interactive shell in a container set up exactly as it is for\n"+
+				"grading: the commit's files, the step's tests, and the problem type's\n"+
+				"files, with no network and a time limit. With no commit ID, it uses the\n"+
+				"latest commit for the step in the current directory, e.g., one downloaded\n"+
+				"with '%s student'.\n\n"+
+				"   Example: '%s shell 12345'\n", os.Args[0], os.Args[0]),
+			Run: CommandShell,
+		}
+		cmdGrind.AddCommand(cmdShell)
+
 		cmdSolve := &cobra.Command{
 			Use:   "solve",
 			Short: "save the solution for the current problem step (authors only)",
@@ -182,10 +291,16 @@ func main() {
 		cmdType := &cobra.Command{
 			Use:   "type [<problem type>]",
 			Short: "download files (Makefile, etc.) for a problem type (authors only)",
-			Run:   CommandType,
+			Long: fmt.Sprintf("Downloads the files for a problem type into the current directory.\n\n"+
+				"Administrators can also add or replace a problem type by giving a\n"+
+				"directory with a %s manifest and a %s subdirectory,\n"+
+				"as described in the sdk package.\n\n"+
+				"   Example: '%s type --register ./haskellunittest'\n", sdk.ManifestFile, sdk.FilesDir, os.Args[0]),
+			Run: CommandType,
 		}
 		cmdType.Flags().BoolP("remove", "r", false, "remove problem type files")
 		cmdType.Flags().BoolP("list", "l", false, "list known problem types and then quit")
+		cmdType.Flags().String("register", "", "add or replace a problem type from a directory (administrators only)")
 		cmdGrind.AddCommand(cmdType)
 	}
 
@@ -269,7 +384,11 @@ func doRequest(path string, params url.Values, method string, upload interface{}
 	}
 
 	// set the headers
-	req.Header.Add("Cookie", Config.Cookie)
+	req.Header.Set("User-Agent", userAgent())
+	// send the session as a token, not a cookie, so requests are not subject to CSRF checks
+	if i := strings.Index(Config.Cookie, "="); i >= 0 {
+		req.Header.Add("Authorization", "CodeGrinder "+Config.Cookie[i+1:])
+	}
 	if download != nil {
 		req.Header.Add("Accept", "application/json")
 		req.Header.Add("Accept-Encoding", "gzip")
@@ -310,11 +429,16 @@ func doRequest(path string, params url.Values, method string, upload interface{}
 	if notfoundokay && resp.StatusCode == http.StatusNotFound {
 		return false
 	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		dumpBody(resp)
+		os.Exit(1)
+	}
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("unexpected status from %s: %s", url, resp.Status)
 		dumpBody(resp)
 		log.Fatalf("giving up")
 	}
+	warnDeprecated(method, path, resp)
 
 	// parse the result if any
 	if download != nil {
@@ -345,6 +469,25 @@ func doRequest(path string, params url.Values, method string, upload interface{}
 	return false
 }
 
+// warnedDeprecated records endpoints already warned about, so each is mentioned once.
+var warnedDeprecated = make(map[string]bool)
+
+// warnDeprecated tells the user when the server says an endpoint is going away,
+// which means this version of grind needs to be updated.
+func warnDeprecated(method, path string, resp *http.Response) {
+	if resp.Header.Get("Deprecation") == "" || warnedDeprecated[method+" "+path] {
+		return
+	}
+	warnedDeprecated[method+" "+path] = true
+	msg := fmt.Sprintf("warning: the server has deprecated %s %s", method, path)
+	if sunset := resp.Header.Get("Sunset"); sunset != "" {
+		if when, err := http.ParseTime(sunset); err == nil {
+			msg += fmt.Sprintf(" and will stop supporting it on %s", when.Format("2006-01-02"))
+		}
+	}
+	log.Printf("%s; please update grind", msg)
+}
+
 func courseDirectory(label string) string {
 	re := regexp.MustCompile(`^([A-Za-z]+[- ]*\d+\w*)\b`)
 	groups := re.FindStringSubmatch(label)
@@ -364,6 +507,12 @@ func hasInstructorFile() bool {
 }
 
 func mustLoadConfig(cmd *cobra.Command) {
+	mustLoadConfigFile()
+	checkVersion()
+}
+
+// mustLoadConfigFile reads the user's config file without contacting the server.
+func mustLoadConfigFile() {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		log.Fatalf("unable to find home directory: %v", err)
@@ -382,8 +531,6 @@ func mustLoadConfig(cmd *cobra.Command) {
 	if Config.apiDump {
 		Config.apiReport = true
 	}
-
-	checkVersion()
 }
 
 func mustWriteConfig() {
@@ -414,6 +561,11 @@ func plural(n int) string {
 	return "s"
 }
 
+// userAgent identifies grind and its version to the server, which records it on each commit.
+func userAgent() string {
+	return fmt.Sprintf("grind/%s (%s/%s)", CurrentVersion.Version, runtime.GOOS, runtime.GOARCH)
+}
+
 func checkVersion() {
 	server := new(Version)
 	mustGetObject("/version", nil, server)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+func CommandMatrix(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+	if len(args) == 0 {
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	// resolve the solution directories before gathering the problem
+	var dirs []string
+	for _, arg := range args {
+		dir, err := filepath.Abs(arg)
+		if err != nil {
+			log.Fatalf("error finding directory %s: %v", arg, err)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Fatalf("%s is not a directory", arg)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	now := time.Now()
+	unsigned, _, _ := gatherAuthor(now, false, "grade", ".")
+
+	user := new(User)
+	mustGetObject("/users/me", nil, user)
+	unsigned.UserID = user.ID
+
+	// the author solution is always the first row
+	names := []string{"(author solution)"}
+	candidates := [][]*Commit{unsigned.Commits}
+	for i, dir := range dirs {
+		names = append(names, args[i])
+		candidates = append(candidates, gatherMatrixCommits(unsigned, dir))
+	}
+
+	scores := make([][]float64, len(candidates))
+	for i, commits := range candidates {
+		fmt.Printf("grading %s\n", names[i])
+		for _, commit := range mustGradeCommits(unsigned, commits) {
+			scores[i] = append(scores[i], commit.Score)
+		}
+	}
+
+	// print the matrix
+	width := 0
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	fmt.Println()
+	fmt.Printf("%-*s", width, "")
+	for n := range unsigned.ProblemSteps {
+		fmt.Printf("  step %-3d", n+1)
+	}
+	fmt.Println()
+	for i, name := range names {
+		fmt.Printf("%-*s", width, name)
+		for _, score := range scores[i] {
+			fmt.Printf("  %7.1f%%", score*100.0)
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+
+	// point out rows that suggest the tests are not doing their job
+	for n, score := range scores[0] {
+		if score != 1.0 {
+			fmt.Printf("warning: the author solution does not pass step %d\n", n+1)
+		}
+	}
+	for i := 1; i < len(names); i++ {
+		for n, score := range scores[i] {
+			if score == 1.0 {
+				fmt.Printf("warning: %s passes step %d; the tests may not catch it\n", names[i], n+1)
+			}
+		}
+	}
+}
+
+// gatherMatrixCommits builds a commit for each step using the files in dir
+// in place of the author solution files. If dir has a subdirectory for a step
+// (named 1, 2, etc.), the files for that step come from there instead.
+// Files that are not part of the author solution are left unchanged.
+func gatherMatrixCommits(bundle *ProblemBundle, dir string) []*Commit {
+	var commits []*Commit
+	for n, original := range bundle.Commits {
+		commit := *original
+		commit.Note = fmt.Sprintf("alternate solution %s tested via grind", filepath.Base(dir))
+		commit.Files = make(map[string][]byte)
+		for name, contents := range original.Files {
+			commit.Files[name] = contents
+		}
+
+		stepDir := dir
+		if info, err := os.Stat(filepath.Join(dir, strconv.Itoa(n+1))); err == nil && info.IsDir() {
+			stepDir = filepath.Join(dir, strconv.Itoa(n+1))
+		}
+		entries, err := ioutil.ReadDir(stepDir)
+		if err != nil {
+			log.Fatalf("error reading %s: %v", stepDir, err)
+		}
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			name := entry.Name()
+			if !bundle.ProblemSteps[n].Whitelist[name] {
+				if !strings.HasPrefix(name, ".") {
+					fmt.Printf("  skipping %s for step %d because students cannot change it\n", filepath.Join(stepDir, name), n+1)
+				}
+				continue
+			}
+			contents, err := ioutil.ReadFile(filepath.Join(stepDir, name))
+			if err != nil {
+				log.Fatalf("error reading %s: %v", name, err)
+			}
+			commit.Files[name] = contents
+		}
+		commits = append(commits, &commit)
+	}
+	return commits
+}
+
+// mustGradeCommits grades one commit for each step of an unconfirmed problem
+// and returns the graded commits. The problem bundle is not changed.
+func mustGradeCommits(unsigned *ProblemBundle, commits []*Commit) []*Commit {
+	request := *unsigned
+	request.Commits = commits
+	signed := new(ProblemBundle)
+	mustPostObject("/problem_bundles/unconfirmed", nil, &request, signed)
+	if signed.Hostname == "" {
+		log.Fatalf("server was unable to find a suitable daycare, unable to grade")
+	}
+
+	var graded []*Commit
+	for n := range signed.ProblemSteps {
+		unvalidated := &CommitBundle{
+			ProblemType:          signed.ProblemTypes[signed.ProblemSteps[n].ProblemType],
+			ProblemTypeSignature: signed.ProblemTypeSignatures[signed.ProblemSteps[n].ProblemType],
+			Problem:              signed.Problem,
+			ProblemSteps:         signed.ProblemSteps,
+			ProblemSignature:     signed.ProblemSignature,
+			Hostname:             signed.Hostname,
+			UserID:               signed.UserID,
+			Commit:               signed.Commits[n],
+			CommitSignature:      signed.CommitSignatures[n],
+			Ticket:               signed.Tickets[n],
+		}
+		validated := mustConfirmCommitBundle(unvalidated, nil)
+		graded = append(graded, validated.Commit)
+	}
+	return graded
+}
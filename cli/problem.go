@@ -69,20 +69,31 @@ func CommandProblem(cmd *cobra.Command, args []string) {
 			}
 
 			// report on the problem
-			if psp.Weight == 1.0 {
-				fmt.Printf("  * %s (%s)\n", problem.Note, problem.Unique)
-			} else {
-				fmt.Printf("  * %s (%s, weight %.2f)\n", problem.Note, problem.Unique, psp.Weight)
+			fmt.Printf("  * %s (%s", problem.Note, problem.Unique)
+			if psp.Weight != 1.0 {
+				fmt.Printf(", weight %.2f", psp.Weight)
 			}
+			if problem.EstimatedMinutes > 0 {
+				fmt.Printf(", about %d minute%s", problem.EstimatedMinutes, plural(int(problem.EstimatedMinutes)))
+			}
+			if problem.Difficulty > 0 {
+				fmt.Printf(", difficulty %d/%d", problem.Difficulty, MaxSurveyDifficulty)
+			}
+			fmt.Println(")")
 
 			// print the steps
 			for i, step := range steps {
 				fmt.Printf("    %d. %s",
 					i+1,
 					strings.Replace(step.Note, "\n", "\n       ", -1))
-				if step.Weight != 1.0 {
+				if step.Diagnostic {
+					fmt.Printf(" (diagnostic, not scored)")
+				} else if step.Weight != 1.0 {
 					fmt.Printf(" (weight %.2f)", step.Weight)
 				}
+				if step.MaxAttempts > 0 {
+					fmt.Printf(" (%d attempt%s)", step.MaxAttempts, plural(int(step.MaxAttempts)))
+				}
 				fmt.Println()
 			}
 		}
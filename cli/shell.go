@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+func CommandShell(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+	now := time.Now()
+
+	// find the commit: either given by ID or the latest one for the current step
+	var commitID int64
+	switch len(args) {
+	case 0:
+		_, problem, _, _, commit, _, _ := gatherStudent(now, ".")
+		last := new(Commit)
+		mustGetObject(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/commits/last", commit.AssignmentID, problem.ID, commit.Step), nil, last)
+		commitID = last.ID
+	case 1:
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || id < 1 {
+			log.Fatalf("commit ID must be a positive number, not %q", args[0])
+		}
+		commitID = id
+	default:
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	bundle := new(CommitBundle)
+	mustPostObject(fmt.Sprintf("/commits/%d/shell", commitID), nil, nil, bundle)
+	fmt.Printf("opening a shell for commit %d (%s step %d) on %s\n",
+		commitID, bundle.Problem.Unique, bundle.Commit.Step, bundle.Hostname)
+	fmt.Printf("the container has no network and closes on its own; type 'exit' or press Ctrl-D when finished\n")
+	runInteractiveSession(bundle, nil, ".")
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/russross/codegrinder/sdk"
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// localTestCache is what grind test keeps from the server about a step,
+// so it can run again without a connection.
+type localTestCache struct {
+	ProblemType *ProblemType `json:"problemType"`
+	Problem     *Problem     `json:"problem"`
+	Step        *ProblemStep `json:"step"`
+}
+
+// serverCheckTimeout is how long grind test waits to see if the server is there.
+const serverCheckTimeout = 5 * time.Second
+
+func CommandTest(cmd *cobra.Command, args []string) {
+	mustLoadConfigFile()
+	now := time.Now()
+	asJSON := cmd.Flag("json").Value.String() == "true"
+
+	if len(args) != 0 {
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	// use the server if it is there, or what we saved last time if not
+	var cache *localTestCache
+	var problemDir string
+	online := serverReachable()
+	if online {
+		checkVersion()
+		problemType, problem, step, _, _, _, dir := gatherStudent(now, ".")
+		cache = &localTestCache{ProblemType: problemType, Problem: problem, Step: step}
+		problemDir = dir
+		saveLocalTestCache(cache)
+	} else {
+		_, info, dir := findProblem(".")
+		cache = loadLocalTestCache(info.ID, info.Step)
+		problemDir = dir
+		fmt.Printf("cannot reach %s, using the problem details saved the last time\n", Config.Host)
+	}
+
+	problemType, step := cache.ProblemType, cache.Step
+	if problemType.OS == "windows" {
+		log.Fatalf("%s grades in Windows containers, which grind test cannot run", problemType.Name)
+	}
+	action := problemType.Actions["grade"]
+	if action == nil {
+		log.Fatalf("problem type %s has no grade action", problemType.Name)
+	}
+	if err := sdk.Validate(problemType); err != nil {
+		log.Fatalf("grind test cannot run this problem type: %v", err)
+	}
+	mustHaveImage(problemType.Image, online)
+
+	// work on a copy so nothing the tests write ends up in the student's files
+	work, err := ioutil.TempDir("", "grind-test-")
+	if err != nil {
+		log.Fatalf("error creating a working directory: %v", err)
+	}
+	defer os.RemoveAll(work)
+	files := copyProblemFiles(problemDir, work)
+
+	fmt.Printf("testing %s step %d locally with %s\n", cache.Problem.Unique, step.Step, problemType.Image)
+	fmt.Printf("only the tests you were given are run; grind grade may find more\n")
+	container := startTestContainer(problemType.Image, action, work)
+	defer exec.Command("docker", "rm", "-f", container).Run()
+
+	start := time.Now()
+	deadline := start.Add(time.Duration(action.MaxCPU*2) * time.Second)
+	var rc *ReportCard
+	if action.Parser == sdk.ParserInOut {
+		rc = NewReportCard()
+		runLocalInOut(rc, container, action.Command, files, start, deadline)
+		rc.AddTime(time.Since(start))
+	} else if status, err := execInTestContainer(container, strings.Fields(action.Command), deadline, nil); err != nil {
+		rc = NewReportCard()
+		rc.LogAndFailf("%q exec error: %v", action.Command, err)
+	} else if rc, err = sdk.ReadReportCard(action.Parser, work, status, start); err != nil {
+		log.Fatalf("error reading test results: %v", err)
+	}
+
+	// score it the way the daycare does
+	score := sdk.Score(rc, step.Tests)
+
+	if asJSON {
+		raw, err := json.MarshalIndent(rc, "", "    ")
+		if err != nil {
+			log.Fatalf("JSON error encoding report card: %v", err)
+		}
+		fmt.Printf("%s\n", raw)
+	} else {
+		printReportCard(rc)
+	}
+	if rc.Passed && score == 1.0 {
+		fmt.Printf("  solution for step %d passed the tests you were given\n", step.Step)
+		fmt.Printf("  use \"%s grade\" to submit it for credit\n", os.Args[0])
+		return
+	}
+	fmt.Printf("  solution for step %d failed with a score of %.0f%%\n", step.Step, score*100.0)
+	os.Exit(1)
+}
+
+// serverReachable reports whether the server answers quickly.
+func serverReachable() bool {
+	client := &http.Client{Timeout: serverCheckTimeout}
+	resp, err := client.Get(fmt.Sprintf("https://%s/version", Config.Host))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// localTestCachePath is where the details of a step are kept for grind test.
+func localTestCachePath(problemID, step int64) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Fatalf("unable to find a cache directory: %v", err)
+	}
+	return filepath.Join(dir, "codegrinder", Config.Host, fmt.Sprintf("problem-%d-step-%d.json", problemID, step))
+}
+
+func saveLocalTestCache(cache *localTestCache) {
+	// the files are already in the problem directory
+	problemType, step := *cache.ProblemType, *cache.Step
+	problemType.Files = nil
+	step.Files, step.Solution, step.Instructions, step.Localized = nil, nil, "", nil
+	elt := &localTestCache{ProblemType: &problemType, Problem: cache.Problem, Step: &step}
+
+	name := localTestCachePath(cache.Problem.ID, step.Step)
+	raw, err := json.MarshalIndent(elt, "", "    ")
+	if err != nil {
+		log.Fatalf("JSON error encoding %s: %v", name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		log.Fatalf("error creating directory %s: %v", filepath.Dir(name), err)
+	}
+	if err := ioutil.WriteFile(name, append(raw, '\n'), 0600); err != nil {
+		log.Fatalf("error saving file %s: %v", name, err)
+	}
+}
+
+func loadLocalTestCache(problemID, step int64) *localTestCache {
+	name := localTestCachePath(problemID, step)
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.Printf("cannot reach %s, and this step has not been tested here before", Config.Host)
+		log.Fatalf("run %s test once while connected so it can be tested offline after that", os.Args[0])
+	}
+	cache := new(localTestCache)
+	if err := json.Unmarshal(raw, cache); err != nil {
+		log.Fatalf("error parsing %s: %v", name, err)
+	}
+	return cache
+}
+
+// mustHaveImage pulls the grading image when online, falling back on a
+// copy that was pulled before if the pull fails.
+func mustHaveImage(image string, online bool) {
+	have := exec.Command("docker", "image", "inspect", image).Run() == nil
+	if online {
+		fmt.Printf("pulling %s\n", image)
+		pull := exec.Command("docker", "pull", "--quiet", image)
+		pull.Stderr = os.Stderr
+		if err := pull.Run(); err == nil {
+			return
+		} else if !have {
+			log.Fatalf("unable to pull %s: %v (is docker installed and running?)", image, err)
+		}
+		fmt.Printf("unable to pull %s, using the copy pulled before\n", image)
+		return
+	}
+	if !have {
+		log.Fatalf("the grading image %s has not been pulled yet, so it cannot be used offline", image)
+	}
+}
+
+// copyProblemFiles copies the files in the problem directory to dst,
+// skipping hidden files, and returns their contents keyed by slash-separated name.
+func copyProblemFiles(src, dst string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		if rel != "." && strings.HasPrefix(filepath.Base(rel), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = contents
+		return ioutil.WriteFile(filepath.Join(dst, rel), contents, info.Mode().Perm()|0666)
+	})
+	if err != nil {
+		log.Fatalf("error copying problem files: %v", err)
+	}
+
+	// the container runs as the student user, which must be able to write here
+	if err := os.Chmod(dst, 0777); err != nil {
+		log.Fatalf("error setting permissions on %s: %v", dst, err)
+	}
+	filepath.Walk(dst, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(name, 0777)
+		}
+		return nil
+	})
+	return files
+}
+
+// startTestContainer starts a container from the grading image with the
+// same user, network, and limits a daycare uses, returning its ID.
+func startTestContainer(image string, action *ProblemTypeAction, work string) string {
+	lifetime := action.MaxCPU*2 + 30
+	args := []string{
+		"run", "-d", "--rm",
+		"--user", fmt.Sprintf("%d:%d", sdk.StudentUID, sdk.StudentUID),
+		"--net=none",
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+		"--ulimit", "core=0:0",
+		"--volume", work + ":/home/student",
+		"--workdir", "/home/student",
+	}
+	if action.MaxMemory > 0 {
+		mem := fmt.Sprintf("%dm", action.MaxMemory)
+		args = append(args, "--memory", mem, "--memory-swap", mem)
+	}
+	if action.MaxThreads > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(action.MaxThreads, 10))
+	}
+	if action.MaxCPU > 0 {
+		args = append(args, "--ulimit", fmt.Sprintf("cpu=%d", action.MaxCPU))
+	}
+	if action.MaxFileSize > 0 {
+		args = append(args, "--ulimit", fmt.Sprintf("fsize=%d", action.MaxFileSize*1024*1024))
+	}
+	args = append(args, image, "/bin/sleep", strconv.FormatInt(lifetime, 10)+"s")
+
+	out, err := exec.Command("docker", args...).Output()
+	if err != nil {
+		log.Fatalf("error starting a container from %s: %v", image, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// execInTestContainer runs a command in the container, echoing its output
+// and also copying standard output to stdout if it is not nil.
+// It returns the exit status.
+func execInTestContainer(container string, command []string, deadline time.Time, stdout io.Writer) (int, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	fmt.Printf("$ %s\n", strings.Join(command, " "))
+	args := append([]string{"exec", container}, command...)
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	if stdout != nil {
+		cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+	} else {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return 0, fmt.Errorf("time limit exceeded")
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// runLocalInOut runs the inout parser's test cases the way the daycare does.
+func runLocalInOut(rc *ReportCard, container, command string, files map[string][]byte, start, deadline time.Time) {
+	names := InOutTestNames(files)
+	if len(names) == 0 {
+		rc.LogAndFailf("No test cases found in %s", InOutTestDir)
+		return
+	}
+
+	shared := DefaultInOutNormalization()
+	if contents, present := files[path.Join(InOutTestDir, InOutNormalizeFile)]; present {
+		if err := shared.Parse(string(contents)); err != nil {
+			rc.LogAndFailf("%s/%s: %v", InOutTestDir, InOutNormalizeFile, err)
+			return
+		}
+	}
+
+	passed := 0
+	for _, name := range names {
+		input := path.Join(InOutTestDir, name+".in")
+		expected, present := files[path.Join(InOutTestDir, name+".out")]
+		if !present {
+			rc.LogAndFailf("test case %s has no expected output", name)
+			continue
+		}
+		norm := shared.Clone()
+		if contents, present := files[path.Join(InOutTestDir, name+".normalize")]; present {
+			if err := norm.Parse(string(contents)); err != nil {
+				rc.LogAndFailf("%s/%s.normalize: %v", InOutTestDir, name, err)
+				continue
+			}
+		}
+
+		var stdout bytes.Buffer
+		status, err := execInTestContainer(container, []string{"sh", "-c", command + " < '" + input + "'"}, deadline, &stdout)
+		switch {
+		case err != nil:
+			rc.LogAndFailf("Error running test case %s: %v", name, err)
+			return
+		case status > 127:
+			rc.AddFailedResult(name, fmt.Sprintf("crashed with exit status %d\n", status), input)
+		case status != 0:
+			rc.AddFailedResult(name, fmt.Sprintf("exited with status %d\n", status), input)
+		default:
+			if report := norm.Diff(expected, stdout.Bytes()); report != "" {
+				rc.AddFailedResult(name, report, input)
+			} else {
+				rc.AddPassedResult(name, "")
+				passed++
+			}
+		}
+	}
+
+	note := fmt.Sprintf("Passed %d/%d tests in %v", passed, len(names), time.Since(start))
+	if rc.Note != "" {
+		note += ", " + rc.Note
+	}
+	rc.Note = note
+	rc.Passed = rc.Passed && passed == len(names)
+}
+
+// printReportCard lists the results in a report card with the details of
+// any that did not pass.
+func printReportCard(rc *ReportCard) {
+	fmt.Printf("\n  ReportCard: %s\n", rc.Note)
+	for _, result := range rc.Results {
+		fmt.Printf("  %-7s %s\n", result.Outcome, result.Name)
+		if result.Outcome != "passed" && result.Details != "" {
+			for _, line := range strings.Split(strings.TrimRight(result.Details, "\n"), "\n") {
+				fmt.Printf("            %s\n", line)
+			}
+		}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/russross/codegrinder/sdk"
 	. "github.com/russross/codegrinder/types"
 	"github.com/spf13/cobra"
 )
@@ -17,6 +19,15 @@ func CommandType(cmd *cobra.Command, args []string) {
 
 	remove := cmd.Flag("remove").Value.String() == "true"
 	list := cmd.Flag("list").Value.String() == "true"
+	register := cmd.Flag("register").Value.String()
+
+	if register != "" {
+		if len(args) != 0 || remove || list {
+			fmt.Println("warning: for a register request, other options will be ignored")
+		}
+		registerProblemType(register)
+		return
+	}
 
 	if list {
 		if len(args) != 0 || remove {
@@ -89,3 +100,28 @@ func CommandType(cmd *cobra.Command, args []string) {
 		updateFiles(directory, files, nil, true)
 	}
 }
+
+// registerProblemType uploads a problem type described by a directory
+// laid out as sdk.LoadProblemType expects.
+func registerProblemType(dir string) {
+	problemType, err := sdk.LoadProblemType(dir)
+	if err != nil {
+		log.Fatalf("error loading problem type from %s: %v", dir, err)
+	}
+	if err := sdk.Validate(problemType); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	saved := new(ProblemType)
+	mustPutObject(fmt.Sprintf("/problem_types/%s", problemType.Name), nil, problemType, saved)
+
+	var actions []string
+	for action := range saved.Actions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	fmt.Printf("registered problem type %s using image %s\n", saved.Name, saved.Image)
+	fmt.Printf("    actions: %s\n", strings.Join(actions, ", "))
+	fmt.Printf("    files: %d\n", len(saved.Files))
+	fmt.Printf("daycares must list %s in their problemTypes config and have the image before it can be graded\n", saved.Name)
+}
@@ -0,0 +1,128 @@
+//go:build integration
+
+package integration
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// These tests need the TA and daycare from setup/integration to be running:
+//
+//	docker compose -f setup/integration/docker-compose.yml up --build
+//	go test -tags integration ./integration
+//
+// CODEGRINDER_TA and CODEGRINDER_DB override where the TA and its database are.
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+const addTests = `import unittest
+from add import add
+
+class TestAdd(unittest.TestCase):
+    def test_small(self):
+        self.assertEqual(add(2, 3), 5)
+
+    def test_negative(self):
+        self.assertEqual(add(-2, -3), -5)
+`
+
+// TestLaunchGradePassback launches a student from the fake LMS, submits a
+// wrong and then a correct solution, and checks that each grade is posted
+// back to the LMS with a valid signature.
+func TestLaunchGradePassback(t *testing.T) {
+	ta := getenv("CODEGRINDER_TA", "https://ta.codegrinder.test")
+	dbPath := getenv("CODEGRINDER_DB", "../setup/integration/run/db/codegrinder.db")
+
+	// seed a one-step problem with a unique name so the test can be rerun
+	unique := fmt.Sprintf("integration-add-%d", time.Now().UnixNano())
+	problem, err := SeedProblemSet(dbPath, &Problem{
+		Unique:  unique,
+		Note:    "integration test: add two numbers",
+		Tags:    []string{},
+		Options: []string{},
+	}, []*ProblemStep{{
+		Step:         1,
+		ProblemType:  "python3unittest",
+		Note:         "add",
+		Instructions: "<p>Write add(a, b).</p>",
+		Weight:       1.0,
+		Files: map[string][]byte{
+			"add.py":            []byte("def add(a, b):\n    pass\n"),
+			"tests/test_add.py": []byte(addTests),
+		},
+		Whitelist: map[string]bool{"add.py": true},
+	}})
+	if err != nil {
+		t.Fatalf("seeding problem: %v", err)
+	}
+
+	// the TA runs in a container, so it reaches the fake LMS through the host
+	lms, err := NewFakeLMS("0.0.0.0:0", "integration", "integration-lti-secret")
+	if err != nil {
+		t.Fatalf("starting fake LMS: %v", err)
+	}
+	defer lms.Close()
+	_, port, _ := net.SplitHostPort(lms.server.Listener.Addr().String())
+	lms.PublicURL = "http://host.docker.internal:" + port
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	launch := &Launch{
+		UserID:     "student-" + id,
+		Name:       "Integration Student",
+		Email:      "student-" + id + "@codegrinder.test",
+		Roles:      "Student",
+		CourseID:   "course-" + id,
+		CourseName: "Integration Course",
+		LinkID:     "link-" + id,
+		LinkTitle:  "Add two numbers",
+		SourcedID:  "sourced-" + id,
+		Points:     10,
+	}
+	student := NewStudent(ta, true)
+	if err := student.LaunchFrom(lms, unique, launch); err != nil {
+		t.Fatalf("launching: %v", err)
+	}
+
+	for _, attempt := range []struct {
+		source string
+		score  float64
+	}{
+		{"def add(a, b):\n    return a - b\n", 0.0},
+		{"def add(a, b):\n    return a + b\n", 1.0},
+	} {
+		start := time.Now()
+		commit, err := student.Submit(problem.ID, 1, map[string][]byte{"add.py": []byte(attempt.source)})
+		if err != nil {
+			t.Fatalf("submitting: %v", err)
+		}
+		if commit.ReportCard == nil {
+			t.Fatalf("commit came back without a report card")
+		}
+		if commit.Score != attempt.score {
+			t.Errorf("commit scored %v, expected %v: %s", commit.Score, attempt.score, commit.ReportCard.Note)
+		}
+
+		outcome, err := lms.WaitForOutcome(launch.SourcedID, start, time.Minute)
+		if err != nil {
+			t.Fatalf("waiting for grade passback: %v", err)
+		}
+		if !outcome.Verified {
+			t.Errorf("grade passback signature did not verify")
+		}
+		if outcome.Score != attempt.score {
+			t.Errorf("LMS received score %v, expected %v", outcome.Score, attempt.score)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Package integration drives a running CodeGrinder installation the way an LMS
+// and a student would, so a change can be checked from LTI launch through
+// grading to grade passback without a real Canvas instance.
+//
+// It contains a fake LMS that issues signed launches and records the grades
+// posted back to it, helpers to seed a problem set into the TA's database,
+// and a Student that logs in, submits, and waits for grades. See
+// setup/integration for a TA and daycare to run it against.
+package integration
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome is a grade the TA posted back to the fake LMS.
+type Outcome struct {
+	SourcedID string
+	Score     float64
+	Text      string
+	Time      time.Time
+
+	// Verified is set if the request carried a valid OAuth signature and body hash.
+	Verified bool
+}
+
+// FakeLMS plays the part of Canvas: it signs LTI launches with the shared
+// secret and accepts grade passback requests.
+type FakeLMS struct {
+	// ConsumerKey and Secret must match the ltiSecret of the TA.
+	ConsumerKey string
+	Secret      string
+
+	// PublicURL is the address the TA should use to reach this server,
+	// if it differs from the listening address (e.g., when the TA runs in a container).
+	PublicURL string
+
+	server *httptest.Server
+
+	sync.Mutex
+	outcomes []*Outcome
+	posted   chan struct{}
+}
+
+// NewFakeLMS starts a fake LMS listening on the given address
+// (use "127.0.0.1:0" for any free port). Call Close when finished.
+func NewFakeLMS(listen, consumerKey, secret string) (*FakeLMS, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	lms := &FakeLMS{
+		ConsumerKey: consumerKey,
+		Secret:      secret,
+		posted:      make(chan struct{}, 1),
+	}
+	lms.server = httptest.NewUnstartedServer(http.HandlerFunc(lms.serveOutcome))
+	lms.server.Listener.Close()
+	lms.server.Listener = listener
+	lms.server.Start()
+	return lms, nil
+}
+
+// Close shuts down the server.
+func (lms *FakeLMS) Close() {
+	lms.server.Close()
+}
+
+// OutcomeURL is the grade passback URL given to the TA in launches.
+func (lms *FakeLMS) OutcomeURL() string {
+	base := lms.PublicURL
+	if base == "" {
+		base = lms.server.URL
+	}
+	return strings.TrimSuffix(base, "/") + "/outcomes"
+}
+
+// Launch describes one student (or instructor) following a CodeGrinder link in a course.
+type Launch struct {
+	UserID     string // opaque user ID, unique per user
+	Name       string
+	Email      string
+	Roles      string // e.g., "Student" or "Instructor"
+	CourseID   string // opaque context ID, unique per course
+	CourseName string
+	LinkID     string // opaque resource link ID, unique per assignment
+	LinkTitle  string
+	SourcedID  string // grade passback ID, unique per assignment and user; empty for no grade
+	Points     float64
+}
+
+// Form returns the signed form for a launch to the given URL.
+func (lms *FakeLMS) Form(launchURL string, launch *Launch) url.Values {
+	now := time.Now()
+	form := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			form.Set(key, value)
+		}
+	}
+	set("lti_message_type", "basic-lti-launch-request")
+	set("lti_version", "LTI-1p0")
+	set("user_id", launch.UserID)
+	set("lis_person_name_full", launch.Name)
+	set("lis_person_contact_email_primary", launch.Email)
+	set("roles", launch.Roles)
+	set("context_id", launch.CourseID)
+	set("context_title", launch.CourseName)
+	set("context_label", launch.CourseName)
+	set("resource_link_id", launch.LinkID)
+	set("resource_link_title", launch.LinkTitle)
+	set("custom_canvas_assignment_title", launch.LinkTitle)
+	set("tool_consumer_instance_guid", "codegrinder-fake-lms")
+	set("tool_consumer_info_product_family_code", "canvas")
+	set("launch_presentation_document_target", "iframe")
+	if launch.SourcedID != "" {
+		set("lis_result_sourcedid", launch.SourcedID)
+		set("lis_outcome_service_url", lms.OutcomeURL())
+		set("ext_outcome_data_values_accepted", "text")
+	}
+	if launch.Points > 0 {
+		set("custom_canvas_assignment_points_possible", strconv.FormatFloat(launch.Points, 'f', -1, 64))
+	}
+	set("oauth_version", "1.0")
+	set("oauth_signature_method", "HMAC-SHA1")
+	set("oauth_timestamp", strconv.FormatInt(now.Unix(), 10))
+	set("oauth_nonce", strconv.FormatInt(now.UnixNano(), 10))
+	set("oauth_consumer_key", lms.ConsumerKey)
+	form.Set("oauth_signature", oauthSignature("POST", launchURL, form, lms.Secret))
+	return form
+}
+
+// Outcomes returns the grades posted so far, oldest first.
+func (lms *FakeLMS) Outcomes() []*Outcome {
+	lms.Lock()
+	defer lms.Unlock()
+	return append([]*Outcome(nil), lms.outcomes...)
+}
+
+// WaitForOutcome waits for a grade to be posted for the given sourced ID
+// after the given time and returns the first one.
+func (lms *FakeLMS) WaitForOutcome(sourcedID string, after time.Time, timeout time.Duration) (*Outcome, error) {
+	deadline := time.After(timeout)
+	for {
+		for _, outcome := range lms.Outcomes() {
+			if outcome.SourcedID == sourcedID && !outcome.Time.Before(after) {
+				return outcome, nil
+			}
+		}
+		select {
+		case <-lms.posted:
+		case <-time.After(time.Second):
+		case <-deadline:
+			return nil, fmt.Errorf("no grade posted for %s within %v", sourcedID, timeout)
+		}
+	}
+}
+
+// outcomeRequest is the part of a replaceResult request that the fake LMS reads.
+type outcomeRequest struct {
+	SourcedID string `xml:"imsx_POXBody>replaceResultRequest>resultRecord>sourcedGUID>sourcedId"`
+	Score     string `xml:"imsx_POXBody>replaceResultRequest>resultRecord>result>resultScore>textString"`
+	Text      string `xml:"imsx_POXBody>replaceResultRequest>resultRecord>result>resultData>text"`
+}
+
+func (lms *FakeLMS) serveOutcome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/outcomes" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := new(outcomeRequest)
+	if err := xml.Unmarshal(body, req); err != nil {
+		http.Error(w, "malformed outcome request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	score, err := strconv.ParseFloat(req.Score, 64)
+	if err != nil {
+		http.Error(w, "malformed score: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lms.Lock()
+	lms.outcomes = append(lms.outcomes, &Outcome{
+		SourcedID: req.SourcedID,
+		Score:     score,
+		Text:      req.Text,
+		Time:      time.Now(),
+		Verified:  lms.verifyOutcome(r.Header.Get("Authorization"), body),
+	})
+	lms.Unlock()
+	select {
+	case lms.posted <- struct{}{}:
+	default:
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<imsx_POXEnvelopeResponse xmlns="http://www.imsglobal.org/services/ltiv1p1/xsd/imsoms_v1p0">`+
+		`<imsx_POXHeader><imsx_POXResponseHeaderInfo><imsx_version>V1.0</imsx_version>`+
+		`<imsx_statusInfo><imsx_codeMajor>success</imsx_codeMajor></imsx_statusInfo>`+
+		`</imsx_POXResponseHeaderInfo></imsx_POXHeader>`+
+		`<imsx_POXBody><replaceResultResponse/></imsx_POXBody></imsx_POXEnvelopeResponse>`)
+}
+
+// verifyOutcome checks the OAuth header of a grade passback request.
+func (lms *FakeLMS) verifyOutcome(header string, body []byte) bool {
+	if !strings.HasPrefix(header, "OAuth ") {
+		return false
+	}
+	params := url.Values{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, "OAuth "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return false
+		}
+		value, err := url.PathUnescape(strings.Trim(kv[1], `"`))
+		if err != nil {
+			return false
+		}
+		if kv[0] != "realm" {
+			params.Set(kv[0], value)
+		}
+	}
+	sum := sha1.Sum(body)
+	if params.Get("oauth_body_hash") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return false
+	}
+	expected := params.Get("oauth_signature")
+	params.Del("oauth_signature")
+	return expected != "" && oauthSignature("POST", lms.OutcomeURL(), params, lms.Secret) == expected
+}
+
+// oauthSignature computes an OAuth 1.0 HMAC-SHA1 signature the way the TA does.
+func oauthSignature(method, target string, params url.Values, secret string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if key != "oauth_signature" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		for _, value := range params[key] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(oauthEscape(key) + "=" + oauthEscape(value))
+		}
+	}
+
+	s := oauthEscape(strings.ToUpper(method)) + "&" + oauthEscape(u.String()) + "&" + oauthEscape(buf.String())
+	mac := hmac.New(sha1.New, []byte(oauthEscape(secret)+"&"))
+	mac.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func oauthEscape(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' || b == '.' || b == '_' || b == '~' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
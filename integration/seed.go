@@ -0,0 +1,66 @@
+package integration
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// SeedProblemSet writes a problem and a problem set holding only that problem
+// straight into a TA database, the way grind create would after confirming
+// the problem with a daycare. The problem types must already be installed.
+// It returns the problem with its ID filled in.
+func SeedProblemSet(dbPath string, problem *Problem, steps []*ProblemStep) (*Problem, error) {
+	meddler.Default = meddler.SQLite
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=10000&_foreign_keys=ON")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	problem.ID = 0
+	problem.CreatedAt = now
+	problem.UpdatedAt = now
+	if err := problem.Normalize(now, steps); err != nil {
+		return nil, fmt.Errorf("problem %s: %v", problem.Unique, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := meddler.Insert(tx, "problems", problem); err != nil {
+		return nil, fmt.Errorf("inserting problem %s: %v", problem.Unique, err)
+	}
+	for _, step := range steps {
+		step.ProblemID = problem.ID
+		if step.Solution == nil {
+			step.Solution = map[string][]byte{}
+		}
+		if err := meddler.Insert(tx, "problem_steps", step); err != nil {
+			return nil, fmt.Errorf("inserting step %d of %s: %v", step.Step, problem.Unique, err)
+		}
+	}
+	set := &ProblemSet{
+		Unique:    problem.Unique,
+		Note:      problem.Note,
+		Tags:      []string{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := meddler.Insert(tx, "problem_sets", set); err != nil {
+		return nil, fmt.Errorf("inserting problem set %s: %v", set.Unique, err)
+	}
+	setProblem := &ProblemSetProblem{ProblemSetID: set.ID, ProblemID: problem.ID, Weight: 1.0}
+	if err := meddler.Insert(tx, "problem_set_problems", setProblem); err != nil {
+		return nil, fmt.Errorf("adding problem %s to its set: %v", problem.Unique, err)
+	}
+	return problem, tx.Commit()
+}
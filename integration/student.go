@@ -0,0 +1,221 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/russross/codegrinder/types"
+)
+
+// Student uses the TA the way a student's browser and grind client do.
+type Student struct {
+	// TA is the base URL of the TA, e.g., "https://ta.codegrinder.test"
+	TA string
+
+	// DaycareURL maps a daycare hostname to the base websocket URL to reach it.
+	// By default it is wss://hostname.
+	DaycareURL func(hostname string) string
+
+	// Client is used for all requests. It must trust the TA's certificate.
+	Client *http.Client
+
+	// set by LaunchFrom
+	AssignmentID int64
+	session      string
+}
+
+// NewStudent returns a student that talks to the given TA.
+// If insecure is set, TLS certificates are not checked.
+func NewStudent(ta string, insecure bool) *Student {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &Student{
+		TA: strings.TrimSuffix(ta, "/"),
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Minute,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// LaunchFrom follows the LTI link for a problem set from the fake LMS
+// and logs in with the session key the TA hands out.
+func (s *Student) LaunchFrom(lms *FakeLMS, problemSet string, launch *Launch) error {
+	launchURL := s.TA + "/lti/problem_sets/cli/" + url.PathEscape(problemSet)
+	form := lms.Form(launchURL, launch)
+	req, err := http.NewRequest("POST", launchURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		return fmt.Errorf("launch returned %s: %s", resp.Status, body)
+	}
+
+	// the TA redirects to the console with an assignment ID and a session key
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("launch redirected to a bad location: %v", err)
+	}
+	if s.AssignmentID, err = strconv.ParseInt(location.Query().Get("assignment"), 10, 64); err != nil {
+		return fmt.Errorf("launch redirect has no assignment: %s", location)
+	}
+	key := location.Query().Get("session")
+	if key == "" {
+		return fmt.Errorf("launch redirect has no session key: %s", location)
+	}
+
+	result := make(map[string]string)
+	if err := s.Do("GET", "/users/session?key="+url.QueryEscape(key), nil, &result); err != nil {
+		return err
+	}
+	cookie := result["cookie"]
+	i := strings.Index(cookie, "=")
+	if i < 0 {
+		return fmt.Errorf("login returned a malformed session %q", cookie)
+	}
+	s.session = cookie[i+1:]
+	return nil
+}
+
+// Do sends a request to the TA, encoding upload (if any) as JSON
+// and decoding the response into download (if any).
+func (s *Student) Do(method, path string, upload, download interface{}) error {
+	var body *bytes.Reader
+	if upload != nil {
+		raw, err := json.Marshal(upload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, s.TA+path, body)
+	if err != nil {
+		return err
+	}
+	if upload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.session != "" {
+		req.Header.Set("Authorization", "CodeGrinder "+s.session)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if download != nil {
+		if err := json.NewDecoder(resp.Body).Decode(download); err != nil {
+			return fmt.Errorf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return nil
+}
+
+// Submit sends files for a step of a problem to be graded and saves the result,
+// as grind grade does. It returns the saved commit with its report card.
+// The TA posts the grade to the LMS after this returns.
+func (s *Student) Submit(problemID, step int64, files map[string][]byte) (*Commit, error) {
+	user := new(User)
+	if err := s.Do("GET", "/users/me", nil, user); err != nil {
+		return nil, err
+	}
+	unsigned := &CommitBundle{
+		UserID: user.ID,
+		Commit: &Commit{
+			AssignmentID: s.AssignmentID,
+			ProblemID:    problemID,
+			Step:         step,
+			Action:       "grade",
+			Files:        files,
+		},
+	}
+	signed := new(CommitBundle)
+	if err := s.Do("POST", "/commit_bundles/unsigned", unsigned, signed); err != nil {
+		return nil, err
+	}
+	if signed.Hostname == "" {
+		return nil, fmt.Errorf("no daycare is available to grade %s", signed.ProblemType.Name)
+	}
+
+	graded, err := s.grade(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	toSave := &CommitBundle{
+		Hostname:            graded.Hostname,
+		UserID:              graded.UserID,
+		Commit:              graded.Commit,
+		CommitSignature:     graded.CommitSignature,
+		ReportCardSignature: graded.ReportCardSignature,
+	}
+	saved := new(CommitBundle)
+	if err := s.Do("POST", "/commit_bundles/signed", toSave, saved); err != nil {
+		return nil, err
+	}
+	return saved.Commit, nil
+}
+
+// grade runs a signed commit bundle on its daycare and returns the graded bundle.
+func (s *Student) grade(bundle *CommitBundle) (*CommitBundle, error) {
+	base := "wss://" + bundle.Hostname
+	if s.DaycareURL != nil {
+		base = s.DaycareURL(bundle.Hostname)
+	}
+	target := base + "/sockets/" + bundle.ProblemType.Name + "/" + bundle.Commit.Action +
+		"?ticket=" + url.QueryEscape(bundle.Ticket)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	if transport, ok := s.Client.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+	socket, _, err := dialer.Dial(target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %v", target, err)
+	}
+	defer socket.Close()
+
+	if err := socket.WriteJSON(&DaycareRequest{CommitBundle: bundle}); err != nil {
+		return nil, err
+	}
+	for {
+		reply := new(DaycareResponse)
+		if err := socket.ReadJSON(reply); err != nil {
+			return nil, fmt.Errorf("reading from daycare: %v", err)
+		}
+		switch {
+		case reply.Error != "":
+			return nil, fmt.Errorf("daycare error: %s", reply.Error)
+		case reply.CommitBundle != nil:
+			return reply.CommitBundle, nil
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package sdk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ImageManifest says how to build the container image for a problem type.
+// Manifests are JSON files named for the problem type, such as
+// python3unittest.json, and several can share a build context.
+type ImageManifest struct {
+	Context    string            `json:"context"`              // build context directory, relative to the manifest: default the manifest's directory
+	Dockerfile string            `json:"dockerfile,omitempty"` // Dockerfile, relative to the context: default "Dockerfile"
+	Args       map[string]string `json:"args,omitempty"`       // build arguments: { "PYTHON_VERSION": "3.12" }
+	Platform   string            `json:"platform,omitempty"`   // platform to build for: default the build host's
+}
+
+// imageTagPrefix marks the tags given to images built from a manifest.
+const imageTagPrefix = "cg-"
+
+// imageTagDigestLen is how many hex digits of the digest go in a tag.
+const imageTagDigestLen = 16
+
+// LoadImageManifest reads a manifest, filling in the defaults and making
+// Context an absolute path.
+func LoadImageManifest(filename string) (*ImageManifest, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(ImageManifest)
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	if !filepath.IsAbs(manifest.Context) {
+		manifest.Context = filepath.Join(filepath.Dir(filename), manifest.Context)
+	}
+	if manifest.Context, err = filepath.Abs(manifest.Context); err != nil {
+		return nil, err
+	}
+	if manifest.Dockerfile == "" {
+		manifest.Dockerfile = "Dockerfile"
+	}
+	if filepath.IsAbs(manifest.Dockerfile) || strings.HasPrefix(filepath.Clean(manifest.Dockerfile), "..") {
+		return nil, fmt.Errorf("%s: dockerfile must be inside the context", filename)
+	}
+	if info, err := os.Stat(filepath.Join(manifest.Context, manifest.Dockerfile)); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	} else if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: %s is not a file", filename, manifest.Dockerfile)
+	}
+	return manifest, nil
+}
+
+// Digest returns a sha256 digest in hex of everything that goes into a build:
+// the files in the context (their names, whether they are executable, and
+// their contents), the Dockerfile name, the build arguments, and the platform.
+// Base images pulled during the build are not included, so a manifest is
+// rebuilt under the same digest only when asked to.
+func (manifest *ImageManifest) Digest() (string, error) {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "dockerfile %q\n", filepath.ToSlash(filepath.Clean(manifest.Dockerfile)))
+	fmt.Fprintf(sum, "platform %q\n", manifest.Platform)
+	var keys []string
+	for key := range manifest.Args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(sum, "arg %q %q\n", key, manifest.Args[key])
+	}
+
+	// filepath.Walk visits files in lexical order, so the digest is stable
+	err := filepath.Walk(manifest.Context, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(manifest.Context, name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		fmt.Fprintf(sum, "file %q %v %d\n", filepath.ToSlash(rel), info.Mode()&0111 != 0, info.Size())
+		fp, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = io.Copy(sum, fp)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// ImageRepository returns an image reference without its tag or digest.
+func ImageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// ImageTag returns the reference for an image built from a manifest with
+// the given digest, in the same repository as image.
+func ImageTag(image, digest string) string {
+	if len(digest) > imageTagDigestLen {
+		digest = digest[:imageTagDigestLen]
+	}
+	return ImageRepository(image) + ":" + imageTagPrefix + digest
+}
@@ -0,0 +1,111 @@
+package sdk
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Report collects test results inside a grading container and writes them
+// as xUnit XML for the xunit parser. A harness written in Go can use it in
+// place of a language's own xUnit reporter:
+//
+//	report := sdk.NewReport("tests")
+//	report.Pass("compiles", elapsed)
+//	report.Fail("Sorter -> empty input", "expected [], got nil", elapsed)
+//	if err := report.WriteFile("."); err != nil { ... }
+//	os.Exit(report.ExitStatus())
+type Report struct {
+	suite XUnitSuite
+}
+
+// NewReport starts a report with one test suite.
+func NewReport(suite string) *Report {
+	return &Report{suite: XUnitSuite{Name: suite}}
+}
+
+// add records a test case. A name of the form "Class -> test" is split so
+// the parser puts it back together the same way.
+func (r *Report) add(name string, elapsed time.Duration) *XUnitCase {
+	elt := &XUnitCase{Name: name, Status: "run", Time: elapsed.Seconds()}
+	if class, test, found := strings.Cut(name, " -> "); found {
+		elt.ClassName, elt.Name = class, test
+	}
+	r.suite.Cases = append(r.suite.Cases, elt)
+	r.suite.Tests++
+	r.suite.Time += elt.Time
+	return elt
+}
+
+// Pass records a test that passed.
+func (r *Report) Pass(name string, elapsed time.Duration) {
+	r.add(name, elapsed)
+}
+
+// Fail records a test that failed. The details are shown to the student in a
+// monospace font. If they start with a location like tests/name.ext:42 or
+// hold a Python traceback, that becomes the result's context.
+func (r *Report) Fail(name, details string, elapsed time.Duration) {
+	r.add(name, elapsed).Failure = &XUnitFailure{Type: "failure", Body: details}
+	r.suite.Failures++
+}
+
+// Error records a test that could not be run to completion, such as one
+// that crashed or ran out of time.
+func (r *Report) Error(name, details string, elapsed time.Duration) {
+	r.add(name, elapsed).Error = &XUnitError{Type: "error", Body: details}
+	r.suite.Errors++
+}
+
+// Skip records a test that was not run. It counts as not passing.
+func (r *Report) Skip(name, reason string) {
+	elt := r.add(name, 0)
+	elt.Status = "notrun"
+	elt.Skipped = &XUnitSkipped{Type: "skipped", Body: reason}
+	r.suite.Skipped++
+}
+
+// Passed reports whether every test recorded so far passed.
+func (r *Report) Passed() bool {
+	return r.suite.Tests > 0 && r.suite.Failures+r.suite.Errors+r.suite.Skipped == 0
+}
+
+// ExitStatus is the status a harness should exit with: zero if every test passed.
+func (r *Report) ExitStatus() int {
+	if r.Passed() {
+		return 0
+	}
+	return 1
+}
+
+// Marshal returns the report as xUnit XML.
+func (r *Report) Marshal() ([]byte, error) {
+	program := &XUnitProgram{
+		Name:     r.suite.Name,
+		Tests:    r.suite.Tests,
+		Failures: r.suite.Failures,
+		Skipped:  r.suite.Skipped,
+		Errors:   r.suite.Errors,
+		Time:     r.suite.Time,
+		Suites:   []*XUnitSuite{&r.suite},
+	}
+	raw, err := xml.MarshalIndent(program, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(raw, '\n')...), nil
+}
+
+// WriteFile writes the report to TestDetailFile in the given directory,
+// which is normally the current directory of the action's command.
+func (r *Report) WriteFile(dir string) error {
+	raw, err := r.Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, TestDetailFile), raw, 0644)
+}
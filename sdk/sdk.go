@@ -0,0 +1,277 @@
+// Package sdk is the contract between CodeGrinder and the container images
+// that grade problems, for anyone building a problem type of their own.
+//
+// A problem type is a container image plus a set of actions, each a command
+// run in the student's directory inside that image. The daycare starts a
+// container as StudentUID with no network and the action's limits, copies the
+// problem type's files, the step's files, and the student's files into
+// StudentHome, and runs the command. What it prints is streamed back as
+// events, and the action's parser turns the results into a ReportCard.
+//
+// This package has the constants, validation, and parsers the daycare itself
+// uses, along with a Report type for harnesses written in Go. README.md in
+// this directory describes the same contract for harnesses in any language.
+package sdk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// ContractVersion is bumped whenever a change to the contract could break
+// an existing problem type. Additions that existing types can ignore do not
+// change it.
+const ContractVersion = 1
+
+const (
+	// StudentUID is the user and group ID commands run as in Linux containers.
+	StudentUID = 1001
+
+	// StudentHome is the working directory in Linux containers.
+	StudentHome = "/home/student/"
+
+	// WindowsStudentUser is the user commands run as in Windows containers,
+	// whose images must provide WindowsStudentHome.
+	WindowsStudentUser = "ContainerUser"
+	WindowsStudentHome = "C:/home/student/"
+
+	// ManifestFile describes a problem type in a directory loaded by LoadProblemType.
+	// The problem type's files are in the FilesDir subdirectory next to it.
+	ManifestFile = "problemtype.json"
+	FilesDir     = "files"
+)
+
+// The parsers that turn the results of an action into a ReportCard.
+const (
+	ParserExitStatus = ""      // passes if the command exits with status zero
+	ParserXUnit      = "xunit" // reads xUnit XML from TestDetailFile
+	ParserCheck      = "check" // reads Check XML from TestDetailFile
+	ParserInOut      = "inout" // runs the command once per test case in InOutTestDir and compares the output
+)
+
+// Parsers lists the parsers a problem type action can use.
+var Parsers = []string{ParserExitStatus, ParserXUnit, ParserCheck, ParserInOut}
+
+// Limits are the bounds on a single action. Problems can override them with
+// options of the form maxCPU=30.
+type Limits struct {
+	MaxCPU      int64 `json:"maxCPU"`      // seconds of CPU time; the wall clock limit is twice this
+	MaxSession  int64 `json:"maxSession"`  // seconds an interactive session may last
+	MaxTimeout  int64 `json:"maxTimeout"`  // seconds an interactive session may sit idle
+	MaxFD       int64 `json:"maxFD"`       // open file descriptors
+	MaxFileSize int64 `json:"maxFileSize"` // megabytes in any one file written
+	MaxMemory   int64 `json:"maxMemory"`   // megabytes of memory, with no swap; zero for no limit
+	MaxThreads  int64 `json:"maxThreads"`  // processes and threads
+}
+
+// ActionLimits returns the limits of a problem type action.
+func ActionLimits(action *ProblemTypeAction) Limits {
+	return Limits{
+		MaxCPU:      action.MaxCPU,
+		MaxSession:  action.MaxSession,
+		MaxTimeout:  action.MaxTimeout,
+		MaxFD:       action.MaxFD,
+		MaxFileSize: action.MaxFileSize,
+		MaxMemory:   action.MaxMemory,
+		MaxThreads:  action.MaxThreads,
+	}
+}
+
+// Validate checks that every limit is set. Only maxMemory may be zero.
+func (l Limits) Validate() error {
+	if l.MaxMemory < 0 {
+		return fmt.Errorf("maxMemory must not be negative")
+	}
+	for _, elt := range []struct {
+		name  string
+		value int64
+	}{
+		{"maxCPU", l.MaxCPU},
+		{"maxSession", l.MaxSession},
+		{"maxTimeout", l.MaxTimeout},
+		{"maxFD", l.MaxFD},
+		{"maxFileSize", l.MaxFileSize},
+		{"maxThreads", l.MaxThreads},
+	} {
+		if elt.value < 1 {
+			return fmt.Errorf("%s must be at least 1", elt.name)
+		}
+	}
+	return nil
+}
+
+var problemTypeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+var actionNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// Validate checks that a problem type keeps to the contract:
+// it has a grade action, its parsers are known, its limits are set,
+// and its files stay inside the student directory.
+func Validate(problemType *ProblemType) error {
+	if !problemTypeNamePattern.MatchString(problemType.Name) {
+		return fmt.Errorf("problem type name %q must be lower case letters, digits, dashes, and underscores", problemType.Name)
+	}
+	if strings.TrimSpace(problemType.Image) == "" || strings.ContainsAny(problemType.Image, " \t\n") {
+		return fmt.Errorf("problem type %s must name a container image", problemType.Name)
+	}
+	if problemType.OS != "linux" && problemType.OS != "windows" {
+		return fmt.Errorf("problem type %s has OS %q; it must be linux or windows", problemType.Name, problemType.OS)
+	}
+	for _, label := range problemType.Labels {
+		if strings.TrimSpace(label) == "" || strings.ContainsAny(label, ", \t\n") {
+			return fmt.Errorf("problem type %s has an invalid label %q", problemType.Name, label)
+		}
+	}
+	if _, present := problemType.Actions["grade"]; !present {
+		return fmt.Errorf("problem type %s must have a grade action", problemType.Name)
+	}
+	for name, action := range problemType.Actions {
+		if action == nil {
+			return fmt.Errorf("problem type %s action %s is empty", problemType.Name, name)
+		}
+		if !actionNamePattern.MatchString(name) {
+			return fmt.Errorf("problem type %s action name %q must be lower case letters, digits, dashes, and underscores", problemType.Name, name)
+		}
+		if action.Action != "" && action.Action != name {
+			return fmt.Errorf("problem type %s action %s is named %q", problemType.Name, name, action.Action)
+		}
+		if action.ProblemType != "" && action.ProblemType != problemType.Name {
+			return fmt.Errorf("problem type %s action %s belongs to problem type %q", problemType.Name, name, action.ProblemType)
+		}
+		if strings.TrimSpace(action.Command) == "" {
+			return fmt.Errorf("problem type %s action %s has no command", problemType.Name, name)
+		}
+		known := false
+		for _, parser := range Parsers {
+			known = known || action.Parser == parser
+		}
+		if !known {
+			return fmt.Errorf("problem type %s action %s uses unknown parser %q", problemType.Name, name, action.Parser)
+		}
+		if action.Interactive && action.Parser != ParserExitStatus {
+			return fmt.Errorf("problem type %s action %s is interactive, so it cannot use a parser", problemType.Name, name)
+		}
+		if action.Parser == ParserInOut && problemType.OS == "windows" {
+			return fmt.Errorf("problem type %s action %s: the inout parser needs a Linux shell", problemType.Name, name)
+		}
+		if err := ActionLimits(action).Validate(); err != nil {
+			return fmt.Errorf("problem type %s action %s: %v", problemType.Name, name, err)
+		}
+	}
+	for name := range problemType.Files {
+		if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "\\") {
+			return fmt.Errorf("problem type %s file name %q must be a clean, relative, slash-separated path", problemType.Name, name)
+		}
+	}
+	return nil
+}
+
+// LoadProblemType reads a problem type from a directory holding ManifestFile
+// and a FilesDir subdirectory with the files to copy into each container.
+// The manifest is the JSON form of types.ProblemType without the files.
+// The actions are filled in with their names, and OS defaults to linux.
+func LoadProblemType(dir string) (*ProblemType, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	problemType := new(ProblemType)
+	if err := json.Unmarshal(raw, problemType); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filepath.Join(dir, ManifestFile), err)
+	}
+	if problemType.OS == "" {
+		problemType.OS = "linux"
+	}
+	if problemType.Labels == nil {
+		problemType.Labels = []string{}
+	}
+	for name, action := range problemType.Actions {
+		if action == nil {
+			return nil, fmt.Errorf("action %s in %s is empty", name, filepath.Join(dir, ManifestFile))
+		}
+		action.ProblemType = problemType.Name
+		action.Action = name
+	}
+
+	problemType.Files = make(map[string][]byte)
+	files := filepath.Join(dir, FilesDir)
+	if info, err := os.Stat(files); err == nil && info.IsDir() {
+		err := filepath.Walk(files, func(name string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(files, name)
+			if err != nil {
+				return err
+			}
+			contents, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			problemType.Files[filepath.ToSlash(rel)] = contents
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return problemType, nil
+}
+
+// ReadReportCard builds the report card for an action that has finished,
+// given the student directory it ran in and its exit status. It handles the
+// parsers that read results from files after a single run; the inout parser
+// runs the command once per test case, so it is driven by InOutTestNames and
+// InOutNormalization instead.
+func ReadReportCard(parser, dir string, status int, start time.Time) (*ReportCard, error) {
+	rc := NewReportCard()
+	switch parser {
+	case ParserXUnit, ParserCheck:
+		if status > 127 {
+			rc.LogAndFailf("Crashed with exit status %d while running unit tests", status)
+			break
+		}
+		rc.Passed = status == 0
+		contents, err := os.ReadFile(filepath.Join(dir, TestDetailFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if parser == ParserXUnit {
+			ParseXUnit(rc, contents, start)
+		} else {
+			ParseCheckXML(rc, contents, start)
+		}
+	case ParserExitStatus:
+		if status != 0 {
+			rc.LogAndFailf("failed with exit status %d", status)
+		}
+	default:
+		return nil, fmt.Errorf("the %s parser cannot read results from a directory", parser)
+	}
+	rc.AddTime(time.Since(start))
+	return rc, nil
+}
+
+// Score is the score for a step on a scale of 0.0 to 1.0. A report card that
+// passed gets full credit; otherwise the results are weighed by the step's
+// test weights (which may be nil), and a failed required test scores zero.
+func Score(rc *ReportCard, tests map[string]*StepTest) float64 {
+	if rc.Passed {
+		return 1.0
+	}
+	passed, total, requiredFailed := rc.WeighResults(tests)
+	if total == 0 || requiredFailed {
+		return 0.0
+	}
+	return passed / total
+}
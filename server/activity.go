@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// activityPingInterval is the shortest time between stored pings for a step.
+// Clients may ping more often; the extras carry no information since
+// time on task is measured between pings that are activeGap apart at most.
+const activityPingInterval = time.Minute
+
+// ActivityPing records that a student was working on a step.
+type ActivityPing struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// TimeSharingSettings records that an instructor let the students in a course
+// see their own time on task.
+type TimeSharingSettings struct {
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	EnabledBy int64     `json:"enabledBy" meddler:"enabled_by"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// StepTime estimates how long one student worked on one step.
+// Activity pings and saves both count as signs of work.
+type StepTime struct {
+	AssignmentID  int64     `json:"assignmentID"`
+	UserID        int64     `json:"userID"`
+	ProblemID     int64     `json:"problemID"`
+	Step          int64     `json:"step"`
+	ActiveMinutes float64   `json:"activeMinutes"`
+	Pings         int       `json:"pings"`
+	Saves         int       `json:"saves"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+}
+
+// StepTimeSummary gathers the time students in a course spent on a step.
+type StepTimeSummary struct {
+	ProblemID           int64   `json:"problemID"`
+	Step                int64   `json:"step"`
+	Students            int     `json:"students"`
+	MedianActiveMinutes float64 `json:"medianActiveMinutes"`
+	MeanActiveMinutes   float64 `json:"meanActiveMinutes"`
+}
+
+// CourseTimeOnTask is the time on task report for a course.
+type CourseTimeOnTask struct {
+	Steps    []*StepTimeSummary `json:"steps"`
+	Students []*StepTime        `json:"students"`
+}
+
+// loadStepTimes measures time on task for each step of the assignments that
+// match the conditions in where, which is added to a query on assignments.
+func loadStepTimes(tx *sql.Tx, where string, args []interface{}) ([]*StepTime, error) {
+	type activity struct {
+		AssignmentID int64     `meddler:"assignment_id"`
+		UserID       int64     `meddler:"user_id"`
+		ProblemID    int64     `meddler:"problem_id"`
+		Step         int64     `meddler:"step"`
+		Ping         bool      `meddler:"ping"`
+		CreatedAt    time.Time `meddler:"created_at,localtime"`
+	}
+	list := []*activity{}
+	if err := meddler.QueryAll(tx, &list, `SELECT assignments.id AS assignment_id, assignments.user_id, `+
+		`activity.problem_id, activity.step, activity.ping, activity.created_at FROM `+
+		`(SELECT assignment_id, problem_id, step, 1 AS ping, created_at FROM activity_pings `+
+		`UNION ALL SELECT assignment_id, problem_id, step, 0 AS ping, created_at FROM commit_hashes) AS activity `+
+		`JOIN assignments ON activity.assignment_id = assignments.id`+where+
+		` ORDER BY assignments.id, activity.problem_id, activity.step, activity.created_at`, args...); err != nil {
+		return nil, err
+	}
+
+	times := []*StepTime{}
+	for start := 0; start < len(list); {
+		first := list[start]
+		elt := &StepTime{
+			AssignmentID: first.AssignmentID,
+			UserID:       first.UserID,
+			ProblemID:    first.ProblemID,
+			Step:         first.Step,
+			FirstSeen:    first.CreatedAt,
+		}
+		var seen []time.Time
+		end := start
+		for ; end < len(list) && list[end].AssignmentID == first.AssignmentID &&
+			list[end].ProblemID == first.ProblemID && list[end].Step == first.Step; end++ {
+			if list[end].Ping {
+				elt.Pings++
+			} else {
+				elt.Saves++
+			}
+			seen = append(seen, list[end].CreatedAt)
+		}
+		elt.LastSeen = seen[len(seen)-1]
+		elt.ActiveMinutes = activeMinutes(seen)
+		times = append(times, elt)
+		start = end
+	}
+	return times, nil
+}
+
+// PostAssignmentProblemStepActivity handles requests to
+// /assignments/:assignment_id/problems/:problem_id/steps/:step/activity,
+// recording that the student is working on the step.
+// Clients send these pings every few minutes while the student is active.
+func PostAssignmentProblemStepActivity(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	stepN, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if err := meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE id = ? AND user_id = ?`, assignmentID, currentUser.ID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM problem_steps JOIN problem_set_problems ON problem_steps.problem_id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = ? AND problem_steps.problem_id = ? AND problem_steps.step = ?`,
+		assignment.ProblemSetID, problemID, stepN).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	now := time.Now()
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM activity_pings WHERE assignment_id = ? AND problem_id = ? AND step = ? AND created_at > ?`,
+		assignment.ID, problemID, stepN, now.Add(-activityPingInterval)).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	ping := &ActivityPing{
+		AssignmentID: assignment.ID,
+		ProblemID:    problemID,
+		Step:         stepN,
+		CreatedAt:    now,
+	}
+	if err := meddler.Insert(tx, "activity_pings", ping); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// GetCourseTimeOnTask handles requests to /courses/:course_id/time_on_task,
+// returning how long each student worked on each step and the median and mean for each step.
+// Instructors' own assignments are left out.
+//
+// If parameter problem_id=<...> present, only that problem is reported.
+// If parameter section_id=<...> present, only students in that section are reported.
+func GetCourseTimeOnTask(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	scope, scopeArgs, ok := sectionWhere(w, r, tx, courseID, currentUser)
+	if !ok {
+		return
+	}
+
+	where := ` WHERE assignments.course_id = ? AND NOT assignments.instructor`
+	args := []interface{}{courseID}
+	if s := r.FormValue("problem_id"); s != "" {
+		problemID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_id: %v", err)
+			return
+		}
+		where += ` AND activity.problem_id = ?`
+		args = append(args, problemID)
+	}
+	times, err := loadStepTimes(tx, where+scope, append(args, scopeArgs...))
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	type key struct{ problemID, step int64 }
+	byStep := make(map[key][]float64)
+	for _, elt := range times {
+		k := key{elt.ProblemID, elt.Step}
+		byStep[k] = append(byStep[k], elt.ActiveMinutes)
+	}
+	report := &CourseTimeOnTask{Steps: []*StepTimeSummary{}, Students: times}
+	for k, minutes := range byStep {
+		total := 0.0
+		for _, m := range minutes {
+			total += m
+		}
+		report.Steps = append(report.Steps, &StepTimeSummary{
+			ProblemID:           k.problemID,
+			Step:                k.step,
+			Students:            len(minutes),
+			MeanActiveMinutes:   total / float64(len(minutes)),
+			MedianActiveMinutes: median(minutes),
+		})
+	}
+	sort.Slice(report.Steps, func(i, j int) bool {
+		a, b := report.Steps[i], report.Steps[j]
+		if a.ProblemID != b.ProblemID {
+			return a.ProblemID < b.ProblemID
+		}
+		return a.Step < b.Step
+	})
+	render.JSON(http.StatusOK, report)
+}
+
+// GetAssignmentTimeOnTask handles requests to /assignments/:assignment_id/time_on_task,
+// returning how long the student has worked on each step of the assignment.
+// Students can only see their own time, and only if the course shares it with them.
+func GetAssignmentTimeOnTask(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, assignment.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			if assignment.UserID != currentUser.ID {
+				loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+				return
+			}
+			var count int
+			if err := tx.QueryRow(`SELECT COUNT(1) FROM time_sharing_settings WHERE course_id = ?`, assignment.CourseID).Scan(&count); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			if count == 0 {
+				loggedHTTPErrorf(w, http.StatusForbidden, "time on task is not shared with students in course %d", assignment.CourseID)
+				return
+			}
+		}
+	}
+
+	times, err := loadStepTimes(tx, ` WHERE assignments.id = ?`, []interface{}{assignment.ID})
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, times)
+}
+
+// GetCourseTimeSharing handles requests to /courses/:course_id/time_sharing,
+// returning the settings if the course shares time on task with its students.
+func GetCourseTimeSharing(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	settings := new(TimeSharingSettings)
+	if err := meddler.QueryRow(tx, settings, `SELECT * FROM time_sharing_settings WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, settings)
+}
+
+// PutCourseTimeSharing handles requests to /courses/:course_id/time_sharing,
+// letting the students in the course see their own time on task.
+func PutCourseTimeSharing(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	settings := new(TimeSharingSettings)
+	if err := meddler.QueryRow(tx, settings, `SELECT * FROM time_sharing_settings WHERE course_id = ?`, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		settings = &TimeSharingSettings{
+			CourseID:  courseID,
+			EnabledBy: currentUser.ID,
+			CreatedAt: time.Now(),
+		}
+		if err := meddler.Insert(tx, "time_sharing_settings", settings); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		log.Printf("user %d (%s) shared time on task with the students in course %d", currentUser.ID, currentUser.Email, courseID)
+	}
+	render.JSON(http.StatusOK, settings)
+}
+
+// DeleteCourseTimeSharing handles requests to /courses/:course_id/time_sharing,
+// hiding time on task from the students in the course again.
+func DeleteCourseTimeSharing(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM time_sharing_settings WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) stopped sharing time on task with the students in course %d", currentUser.ID, currentUser.Email, courseID)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// unreadAnnouncements returns the announcements for a course that the user has not read yet
+// and that have not expired, oldest first.
+func unreadAnnouncements(tx *sql.Tx, courseID, userID int64, now time.Time) ([]*Announcement, error) {
+	announcements := []*Announcement{}
+	err := meddler.QueryAll(tx, &announcements, `SELECT * FROM announcements `+
+		`WHERE course_id = ? AND (expires_at IS NULL OR expires_at > ?) `+
+		`AND id NOT IN (SELECT announcement_id FROM announcement_reads WHERE user_id = ?) `+
+		`ORDER BY created_at, id`, courseID, now, userID)
+	return announcements, err
+}
+
+// attachAnnouncements fills in the unread announcements for each assignment's course.
+func attachAnnouncements(tx *sql.Tx, userID int64, assignments ...*Assignment) error {
+	now := time.Now()
+	byCourse := make(map[int64][]*Announcement)
+	for _, assignment := range assignments {
+		list, present := byCourse[assignment.CourseID]
+		if !present {
+			var err error
+			if list, err = unreadAnnouncements(tx, assignment.CourseID, userID, now); err != nil {
+				return err
+			}
+			byCourse[assignment.CourseID] = list
+		}
+		assignment.Announcements = list
+	}
+	return nil
+}
+
+// loadAnnouncementCourse parses the course ID and checks that the current user belongs to the course.
+// It reports whether the user is an instructor for the course (admins always are).
+func loadAnnouncementCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) (courseID int64, isInstructor bool, ok bool) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return 0, false, false
+	}
+	if currentUser.Admin {
+		return courseID, true, true
+	}
+	if isInstructor, err = isCourseInstructor(tx, courseID, currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return 0, false, false
+	}
+	if isInstructor {
+		return courseID, true, true
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM assignments WHERE course_id = ? AND user_id = ?`, courseID, currentUser.ID).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return 0, false, false
+	}
+	if count == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+		return 0, false, false
+	}
+	return courseID, false, true
+}
+
+// GetCourseAnnouncements handles requests to /courses/:course_id/announcements,
+// returning the announcements for a course, newest first, marked with whether the current user has read them.
+// Instructors also see expired announcements and how many students have read each one.
+func GetCourseAnnouncements(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, isInstructor, ok := loadAnnouncementCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	where := ` WHERE course_id = ?`
+	args := []interface{}{courseID}
+	if !isInstructor {
+		where += ` AND (expires_at IS NULL OR expires_at > ?)`
+		args = append(args, time.Now())
+	}
+	announcements := []*Announcement{}
+	if err := meddler.QueryAll(tx, &announcements, `SELECT * FROM announcements`+where+` ORDER BY created_at DESC, id DESC`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// note which ones have been read, and by how many
+	rows, err := tx.Query(`SELECT announcement_reads.announcement_id, COUNT(1), SUM(announcement_reads.user_id = ?) `+
+		`FROM announcement_reads JOIN announcements ON announcement_reads.announcement_id = announcements.id `+
+		`WHERE announcements.course_id = ? GROUP BY announcement_reads.announcement_id`, currentUser.ID, courseID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	counts, read := make(map[int64]int64), make(map[int64]bool)
+	for rows.Next() {
+		var id, count, mine int64
+		if err := rows.Scan(&id, &count, &mine); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		counts[id], read[id] = count, mine > 0
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, elt := range announcements {
+		elt.Read = read[elt.ID]
+		if isInstructor {
+			elt.ReadCount = counts[elt.ID]
+		}
+	}
+	render.JSON(http.StatusOK, announcements)
+}
+
+// PostCourseAnnouncement handles requests to /courses/:course_id/announcements,
+// posting a new announcement to every student in the course.
+// Only instructors of the course can post announcements.
+func PostCourseAnnouncement(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, announcement Announcement, render render.Render) {
+	courseID, isInstructor, ok := loadAnnouncementCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	if !isInstructor {
+		loggedHTTPErrorf(w, http.StatusForbidden, "only an instructor of the course can post announcements")
+		return
+	}
+	announcement.Message = strings.TrimSpace(announcement.Message)
+	if announcement.Message == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "announcement must include a message")
+		return
+	}
+
+	announcement.ID = 0
+	announcement.CourseID = courseID
+	announcement.UserID = currentUser.ID
+	announcement.Read = false
+	announcement.ReadCount = 0
+	announcement.CreatedAt = time.Now()
+	if err := meddler.Insert(tx, "announcements", &announcement); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &announcement)
+}
+
+// loadAnnouncement loads an announcement by ID.
+func loadAnnouncement(w http.ResponseWriter, tx *sql.Tx, params martini.Params) *Announcement {
+	announcementID, err := parseID(w, "announcement_id", params["announcement_id"])
+	if err != nil {
+		return nil
+	}
+	announcement := new(Announcement)
+	if err := meddler.QueryRow(tx, announcement, `SELECT * FROM announcements WHERE id = ?`, announcementID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil
+	}
+	return announcement
+}
+
+// DeleteAnnouncement handles requests to /announcements/:announcement_id,
+// removing an announcement. Only instructors of the course can remove announcements.
+func DeleteAnnouncement(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	announcement := loadAnnouncement(w, tx, params)
+	if announcement == nil {
+		return
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, announcement.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusForbidden, "only an instructor of the course can remove announcements")
+			return
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM announcements WHERE id = ?`, announcement.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// PostAnnouncementRead handles requests to /announcements/:announcement_id/read,
+// marking an announcement as read by the current user.
+func PostAnnouncementRead(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	announcement := loadAnnouncement(w, tx, params)
+	if announcement == nil {
+		return
+	}
+
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO announcement_reads (announcement_id, user_id, read_at) VALUES (?, ?, ?)`,
+		announcement.ID, currentUser.ID, time.Now()); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
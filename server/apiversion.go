@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// API versioning policy:
+//
+//   - /api/v2/... is the stable API. Unprefixed paths are the same API, so
+//     existing grind and Thonny releases keep working unchanged.
+//   - /api/v3/... serves the same handlers, minus anything deprecated.
+//   - An endpoint is retired by listing it in apiDeprecations. Requests made
+//     through v2 keep working until the sunset date but carry Deprecation,
+//     Sunset, and Link headers naming the replacement; through v3 it is gone.
+//
+// Every response says which version served it in the API-Version header.
+const (
+	apiVersion2 = "2"
+	apiVersion3 = "3"
+)
+
+// apiDeprecation describes an endpoint that is on its way out.
+type apiDeprecation struct {
+	Method     string
+	Path       string // a route pattern, as passed to the router
+	Deprecated time.Time
+	Sunset     time.Time
+	Successor  string
+}
+
+var apiDeprecations = []apiDeprecation{
+	{
+		Method:     "GET",
+		Path:       "/v2/version",
+		Deprecated: time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC),
+		Sunset:     time.Date(2027, time.June, 1, 0, 0, 0, 0, time.UTC),
+		Successor:  "/api/v3/version",
+	},
+}
+
+// splitAPIVersion removes an /api/vN prefix from a request path,
+// returning the version and the path the router should see.
+func splitAPIVersion(path string) (version, rest string, ok bool) {
+	for _, v := range []string{apiVersion2, apiVersion3} {
+		prefix := "/api/v" + v
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			rest = strings.TrimPrefix(path, prefix)
+			if rest == "" {
+				rest = "/"
+			}
+			return v, rest, true
+		}
+	}
+	return apiVersion2, path, false
+}
+
+// matchRoutePattern reports whether a path matches a route pattern,
+// where a segment starting with a colon matches any one segment.
+func matchRoutePattern(pattern, path string) bool {
+	want := strings.Split(strings.Trim(pattern, "/"), "/")
+	have := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(have) {
+		return false
+	}
+	for i := range want {
+		if !strings.HasPrefix(want[i], ":") && want[i] != have[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// findAPIDeprecation returns the deprecation entry for a request, if any.
+func findAPIDeprecation(method, path string) *apiDeprecation {
+	for i := range apiDeprecations {
+		elt := &apiDeprecations[i]
+		if elt.Method == method && matchRoutePattern(elt.Path, path) {
+			return elt
+		}
+	}
+	return nil
+}
+
+// apiVersioning returns martini middleware that applies the versioning policy.
+// It must run before the router, since it rewrites the request path.
+func apiVersioning() martini.Handler {
+	return func(w http.ResponseWriter, r *http.Request, c martini.Context) {
+		version, path, prefixed := splitAPIVersion(r.URL.Path)
+		if prefixed {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+		}
+		w.Header().Set("API-Version", version)
+
+		if dep := findAPIDeprecation(r.Method, r.URL.Path); dep != nil {
+			if version != apiVersion2 {
+				loggedHTTPErrorf(w, http.StatusGone, "%s %s is not part of API version %s; use %s", r.Method, path, version, dep.Successor)
+				return
+			}
+			h := w.Header()
+			h.Set("Deprecation", fmt.Sprintf("@%d", dep.Deprecated.Unix()))
+			h.Set("Sunset", dep.Sunset.Format(http.TimeFormat))
+			h.Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, dep.Successor))
+			if time.Now().After(dep.Sunset) {
+				loggedHTTPErrorf(w, http.StatusGone, "%s %s was retired on %s; use %s", r.Method, path, dep.Sunset.Format("2006-01-02"), dep.Successor)
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// archiveCommitInfo is the metadata recorded alongside each commit in an archive.
+type archiveCommitInfo struct {
+	CommitID     int64       `json:"commitID"`
+	AssignmentID int64       `json:"assignmentID"`
+	UserID       int64       `json:"userID"`
+	UserName     string      `json:"userName"`
+	UserEmail    string      `json:"userEmail"`
+	CanvasTitle  string      `json:"canvasTitle"`
+	Problem      string      `json:"problem"`
+	Step         int64       `json:"step"`
+	Action       string      `json:"action"`
+	Note         string      `json:"note"`
+	Score        float64     `json:"score"`
+	ReportCard   *ReportCard `json:"reportCard"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	UpdatedAt    time.Time   `json:"updatedAt"`
+}
+
+// GetAssignmentArchive handles requests to /assignments/:assignment_id/archive,
+// returning a zip file containing the student's commits for the assignment.
+//
+// By default only the final commit (the highest step reached) for each problem is included.
+// If parameter all=true is present, the commit for every step is included.
+func GetAssignmentArchive(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	all := false
+	if s := r.FormValue("all"); s != "" {
+		if all, err = strconv.ParseBool(s); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing all value as boolean: %v", err)
+			return
+		}
+	}
+
+	assignment := new(Assignment)
+	if currentUser.Admin {
+		err = meddler.Load(tx, "assignments", assignment, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, assignment.CourseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-assignment-%d.zip", courseDirectoryName(course), assignment.ID)
+	writeArchive(w, tx, filename, []*Assignment{assignment}, all)
+}
+
+// GetCourseArchive handles requests to /courses/:course_id/archive,
+// returning a zip file containing the commits of every student in the course.
+// Only administrators and instructors of the course may request it.
+//
+// By default only the final commit for each problem is included.
+// If parameter all=true is present, the commit for every step is included.
+func GetCourseArchive(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	all := false
+	if s := r.FormValue("all"); s != "" {
+		if all, err = strconv.ParseBool(s); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing all value as boolean: %v", err)
+			return
+		}
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return
+		}
+	}
+
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments `+
+		`WHERE course_id = ? AND NOT instructor AND problem_set_id IS NOT NULL `+
+		`ORDER BY user_id, id`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-course-%d.zip", courseDirectoryName(course), course.ID)
+	writeArchive(w, tx, filename, assignments, all)
+}
+
+// isCourseInstructor reports whether the given user has an instructor assignment in the given course.
+func isCourseInstructor(tx *sql.Tx, courseID, userID int64) (bool, error) {
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM assignments WHERE course_id = ? AND user_id = ? AND instructor`,
+		courseID, userID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// courseDirectoryName gives a file-system friendly name for a course.
+func courseDirectoryName(course *Course) string {
+	if course.Label != "" {
+		return safeArchiveName(course.Label)
+	}
+	return fmt.Sprintf("course-%d", course.ID)
+}
+
+// safeArchiveName replaces anything other than letters, digits, dashes, dots, and
+// underscores so the result can be used as a single path element in a zip file.
+func safeArchiveName(s string) string {
+	out := []byte(s)
+	for i, b := range out {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' || b == '.' || b == '_') {
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
+
+// writeArchive streams a zip file with one directory per assignment and one
+// subdirectory per problem step. Each step directory holds the commit files
+// and a commit.json file with the ReportCard and related metadata.
+func writeArchive(w http.ResponseWriter, tx *sql.Tx, filename string, assignments []*Assignment, all bool) {
+	// gather everything before writing so errors can still be reported
+	type entry struct {
+		dir    string
+		info   *archiveCommitInfo
+		commit *Commit
+	}
+	var entries []*entry
+	users := make(map[int64]*User)
+	problems := make(map[int64]*Problem)
+	for _, asst := range assignments {
+		user, ok := users[asst.UserID]
+		if !ok {
+			user = new(User)
+			if err := meddler.Load(tx, "users", user, asst.UserID); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading user %d: %v", asst.UserID, err)
+				return
+			}
+			users[asst.UserID] = user
+		}
+
+		commits := []*Commit{}
+		if err := meddler.QueryAll(tx, &commits, `SELECT * FROM commits WHERE assignment_id = ? ORDER BY problem_id, step`, asst.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := loadCommitBlobs(commits...); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+
+		// keep only the highest step for each problem unless all steps were requested
+		if !all {
+			final := make(map[int64]*Commit)
+			for _, commit := range commits {
+				if prev := final[commit.ProblemID]; prev == nil || commit.Step > prev.Step {
+					final[commit.ProblemID] = commit
+				}
+			}
+			commits = commits[:0]
+			for _, commit := range final {
+				commits = append(commits, commit)
+			}
+			sort.Slice(commits, func(i, j int) bool { return commits[i].ProblemID < commits[j].ProblemID })
+		}
+
+		userDir := safeArchiveName(user.CanvasLogin)
+		if userDir == "" {
+			userDir = fmt.Sprintf("user-%d", user.ID)
+		}
+		asstDir := path.Join(userDir, fmt.Sprintf("assignment-%d", asst.ID))
+		for _, commit := range commits {
+			problem, ok := problems[commit.ProblemID]
+			if !ok {
+				problem = new(Problem)
+				if err := meddler.Load(tx, "problems", problem, commit.ProblemID); err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading problem %d: %v", commit.ProblemID, err)
+					return
+				}
+				problems[commit.ProblemID] = problem
+			}
+			entries = append(entries, &entry{
+				dir: path.Join(asstDir, safeArchiveName(problem.Unique), fmt.Sprintf("step-%d", commit.Step)),
+				info: &archiveCommitInfo{
+					CommitID:     commit.ID,
+					AssignmentID: asst.ID,
+					UserID:       user.ID,
+					UserName:     user.Name,
+					UserEmail:    user.Email,
+					CanvasTitle:  asst.CanvasTitle,
+					Problem:      problem.Unique,
+					Step:         commit.Step,
+					Action:       commit.Action,
+					Note:         commit.Note,
+					Score:        commit.Score,
+					ReportCard:   commit.ReportCard,
+					CreatedAt:    commit.CreatedAt,
+					UpdatedAt:    commit.UpdatedAt,
+				},
+				commit: commit,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// errors past this point cannot be reported to the client
+	z := zip.NewWriter(w)
+	for _, elt := range entries {
+		names := []string{}
+		for name := range elt.commit.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// a stored name must not climb out of its step directory
+			clean := path.Clean(name)
+			if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+				loggedErrorf("skipping file %q in commit %d: not a relative path", name, elt.commit.ID)
+				continue
+			}
+			f, err := z.CreateHeader(&zip.FileHeader{
+				Name:     path.Join(elt.dir, "files", clean),
+				Method:   zip.Deflate,
+				Modified: elt.commit.UpdatedAt,
+			})
+			if err != nil {
+				loggedErrorf("error adding %s to archive: %v", name, err)
+				return
+			}
+			if _, err := f.Write(elt.commit.Files[name]); err != nil {
+				loggedErrorf("error writing %s to archive: %v", name, err)
+				return
+			}
+		}
+
+		raw, err := json.MarshalIndent(elt.info, "", "    ")
+		if err != nil {
+			loggedErrorf("json error encoding commit %d: %v", elt.commit.ID, err)
+			return
+		}
+		f, err := z.CreateHeader(&zip.FileHeader{
+			Name:     path.Join(elt.dir, "commit.json"),
+			Method:   zip.Deflate,
+			Modified: elt.commit.UpdatedAt,
+		})
+		if err != nil {
+			loggedErrorf("error adding commit.json to archive: %v", err)
+			return
+		}
+		if _, err := f.Write(append(raw, '\n')); err != nil {
+			loggedErrorf("error writing commit.json to archive: %v", err)
+			return
+		}
+	}
+	if err := z.Close(); err != nil {
+		loggedErrorf("error closing archive: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// countStepAttempts counts the graded attempts at a step. Practice checks are never counted.
+func countStepAttempts(tx *sql.Tx, assignmentID, problemID, step int64) (int64, error) {
+	var count int64
+	err := tx.QueryRow(`SELECT COUNT(1) FROM step_scores WHERE assignment_id = ? AND problem_id = ? AND step = ?`,
+		assignmentID, problemID, step).Scan(&count)
+	return count, err
+}
+
+// GetAssignmentProblemStepAttempts handles requests to
+// /assignments/:assignment_id/problems/:problem_id/steps/:step/attempts,
+// returning the number of graded attempts used and remaining for the step.
+func GetAssignmentProblemStepAttempts(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	stepN, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if currentUser.Admin {
+		err = meddler.Load(tx, "assignments", assignment, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	step := new(ProblemStep)
+	if err := meddler.QueryRow(tx, step, `SELECT problem_steps.* FROM problem_steps JOIN problem_set_problems ON problem_steps.problem_id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = ? AND problem_steps.problem_id = ? AND problem_steps.step = ?`,
+		assignment.ProblemSetID, problemID, stepN); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	used, err := countStepAttempts(tx, assignment.ID, problemID, stepN)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	attempts := &StepAttempts{
+		MaxAttempts: step.MaxAttempts,
+		Used:        used,
+	}
+	if step.MaxAttempts > used {
+		attempts.Remaining = step.MaxAttempts - used
+	}
+	render.JSON(http.StatusOK, attempts)
+}
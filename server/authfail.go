@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/martini-contrib/render"
+)
+
+const (
+	// failures allowed before backing off, per address and per account.
+	// Addresses get more room since a whole campus can share one.
+	authAddressFailures = 20
+	authAccountFailures = 5
+
+	// authBackoffBase is the wait after the first failure beyond the allowance.
+	// It doubles with each further failure up to authBackoffMax.
+	authBackoffBase = time.Second
+	authBackoffMax  = 15 * time.Minute
+
+	// authFailureForget is how long an address or account must go
+	// without failing before its count starts over.
+	authFailureForget = time.Hour
+
+	// authFailureHistory is the number of recent failures kept for administrators.
+	authFailureHistory = 500
+)
+
+// AuthFailure is a failed attempt to authenticate.
+type AuthFailure struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Address string    `json:"address"`
+	Account string    `json:"account,omitempty"`
+	Reason  string    `json:"reason"`
+}
+
+// AuthBlock is an address or account that must wait before trying again.
+type AuthBlock struct {
+	Key      string    `json:"key"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+type authThrottle struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// authGuard tracks authentication failures on this TA instance.
+type authGuard struct {
+	sync.Mutex
+	throttles map[string]*authThrottle
+	recent    []*AuthFailure
+}
+
+var authFailures = authGuard{throttles: make(map[string]*authThrottle)}
+
+func authKeys(address, account string) []string {
+	keys := []string{"address " + address}
+	if account != "" {
+		keys = append(keys, "account "+account)
+	}
+	return keys
+}
+
+// wait returns how long the address and account must wait before trying again.
+func (g *authGuard) wait(now time.Time, address, account string) time.Duration {
+	g.Lock()
+	defer g.Unlock()
+	var wait time.Duration
+	for _, key := range authKeys(address, account) {
+		if t := g.throttles[key]; t != nil && t.until.After(now) && t.until.Sub(now) > wait {
+			wait = t.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// fail records a failure and backs off the address and account if they are over their allowance.
+func (g *authGuard) fail(failure *AuthFailure) {
+	g.Lock()
+	defer g.Unlock()
+	now := failure.Time
+
+	// forget old failures
+	for key, t := range g.throttles {
+		if now.Sub(t.last) > authFailureForget {
+			delete(g.throttles, key)
+		}
+	}
+
+	for _, key := range authKeys(failure.Address, failure.Account) {
+		t := g.throttles[key]
+		if t == nil {
+			t = new(authThrottle)
+			g.throttles[key] = t
+		}
+		t.failures++
+		t.last = now
+		allowed := authAddressFailures
+		if strings.HasPrefix(key, "account ") {
+			allowed = authAccountFailures
+		}
+		if over := t.failures - allowed; over > 0 {
+			backoff := authBackoffMax
+			if over < 32 {
+				backoff = time.Duration(math.Min(float64(authBackoffBase)*math.Pow(2, float64(over-1)), float64(authBackoffMax)))
+			}
+			t.until = now.Add(backoff)
+		}
+	}
+
+	g.recent = append(g.recent, failure)
+	if len(g.recent) > authFailureHistory {
+		g.recent = g.recent[len(g.recent)-authFailureHistory:]
+	}
+}
+
+// throttleAuth turns away an authentication attempt from an address or account
+// that has failed too often recently. It reports whether the request was rejected.
+func throttleAuth(w http.ResponseWriter, r *http.Request, account string) bool {
+	wait := authFailures.wait(time.Now(), clientIP(r), account)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(wait.Seconds()))))
+	loggedHTTPErrorf(w, http.StatusTooManyRequests, "too many failed attempts to log in; try again in %v", wait.Round(time.Second))
+	return true
+}
+
+// recordAuthFailure notes a failed authentication attempt of the given kind.
+// The account must be one whose identity has been verified, never a name
+// taken from the rejected request, or anyone could lock that account out.
+func recordAuthFailure(r *http.Request, kind, account, reason string) {
+	authFailures.fail(&AuthFailure{
+		Time:    time.Now(),
+		Kind:    kind,
+		Address: clientIP(r),
+		Account: account,
+		Reason:  reason,
+	})
+}
+
+// GetAuthFailures handles requests to /auth_failures,
+// returning recent authentication failures on this TA instance, newest first,
+// and the addresses and accounts that are currently backed off.
+func GetAuthFailures(w http.ResponseWriter, render render.Render) {
+	now := time.Now()
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	recent := make([]*AuthFailure, 0, len(authFailures.recent))
+	for i := len(authFailures.recent) - 1; i >= 0; i-- {
+		recent = append(recent, authFailures.recent[i])
+	}
+	blocked := []*AuthBlock{}
+	for key, t := range authFailures.throttles {
+		if t.until.After(now) {
+			blocked = append(blocked, &AuthBlock{Key: key, Failures: t.failures, Until: t.until})
+		}
+	}
+	sort.Slice(blocked, func(i, j int) bool { return blocked[i].Until.After(blocked[j].Until) })
+
+	render.JSON(http.StatusOK, map[string]interface{}{
+		"recent":  recent,
+		"blocked": blocked,
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// notYetOpenProblems is a subquery listing problems that are hidden from a student
+// because an availability window for the problem has not opened yet. Windows for
+// any course and windows for a course the student has an assignment in both count.
+// Its parameters are the current time and the student's user ID.
+const notYetOpenProblems = `SELECT problem_id FROM availability_windows ` +
+	`WHERE problem_id IS NOT NULL AND open_at IS NOT NULL AND open_at > ? ` +
+	`AND (course_id IS NULL OR course_id IN (SELECT course_id FROM assignments WHERE user_id = ?))`
+
+// closedAvailabilityWindow returns the first availability window that applies to
+// a launch of the given problem set in the given course and is not open right now,
+// or nil if the launch is allowed.
+func closedAvailabilityWindow(tx *sql.Tx, problemSetID, courseID int64, now time.Time) (*AvailabilityWindow, error) {
+	windows := []*AvailabilityWindow{}
+	if err := meddler.QueryAll(tx, &windows, `SELECT * FROM availability_windows `+
+		`WHERE (course_id IS NULL OR course_id = ?) `+
+		`AND (problem_id IS NULL OR problem_id IN (SELECT problem_id FROM problem_set_problems WHERE problem_set_id = ?)) `+
+		`ORDER BY id`, courseID, problemSetID); err != nil {
+		return nil, err
+	}
+	for _, window := range windows {
+		if !window.IsOpen(now) {
+			return window, nil
+		}
+	}
+	return nil, nil
+}
+
+// describeWindow gives a human-readable description of an availability window.
+func describeWindow(window *AvailabilityWindow) string {
+	const layout = "Mon Jan 2 2006 at 3:04pm MST"
+	var parts []string
+	if window.OpenAt != nil {
+		parts = append(parts, "opens "+window.OpenAt.Format(layout))
+	}
+	if window.CloseAt != nil {
+		parts = append(parts, "closes "+window.CloseAt.Format(layout))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// GetAvailabilityWindows handles requests to /availability_windows,
+// returning a list of all availability windows.
+//
+// If parameter problem_id=<...> present, results will be filtered by matching problem.
+// If parameter course_id=<...> present, results will be filtered by matching course.
+func GetAvailabilityWindows(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := ""
+	args := []interface{}{}
+	for _, field := range []string{"problem_id", "course_id"} {
+		if s := r.FormValue(field); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s: %v", field, err)
+				return
+			}
+			where, args = addWhereEq(where, args, field, id)
+		}
+	}
+
+	windows := []*AvailabilityWindow{}
+	if err := meddler.QueryAll(tx, &windows, `SELECT * FROM availability_windows`+where+` ORDER BY id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, windows)
+}
+
+// PostAvailabilityWindow handles requests to /availability_windows,
+// creating a new availability window for a problem, a course, or a problem in a course.
+func PostAvailabilityWindow(w http.ResponseWriter, tx *sql.Tx, window AvailabilityWindow, render render.Render) {
+	now := time.Now()
+
+	if window.ProblemID == 0 && window.CourseID == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "availability window must be for a problem, a course, or both")
+		return
+	}
+	if window.OpenAt == nil && window.CloseAt == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "availability window must have an open time, a close time, or both")
+		return
+	}
+	if window.OpenAt != nil && window.CloseAt != nil && !window.OpenAt.Before(*window.CloseAt) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "availability window must open before it closes")
+		return
+	}
+	if window.ProblemID != 0 {
+		problem := new(Problem)
+		if err := meddler.Load(tx, "problems", problem, window.ProblemID); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+	}
+	if window.CourseID != 0 {
+		course := new(Course)
+		if err := meddler.Load(tx, "courses", course, window.CourseID); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+	}
+
+	window.ID = 0
+	window.CreatedAt = now
+	window.UpdatedAt = now
+	if err := meddler.Insert(tx, "availability_windows", &window); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &window)
+}
+
+// DeleteAvailabilityWindow handles requests to /availability_windows/:window_id,
+// deleting the given availability window.
+func DeleteAvailabilityWindow(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+	windowID, err := parseID(w, "window_id", params["window_id"])
+	if err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM availability_windows WHERE id = ?`, windowID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Backups are gzipped tar files holding a snapshot of the database,
+// the config file, the problem type files under $CODEGRINDERROOT/files,
+// every blob in the main blob store, and every blob in each residency store.
+// Encrypted backups wrap the tar file in a series of AES-GCM sealed chunks
+// keyed from a passphrase given in the environment.
+const (
+	backupPassphraseEnv = "CODEGRINDER_BACKUP_PASSPHRASE"
+	backupMagic         = "CGBACKUP1"
+	backupChunkSize     = 1 << 20
+	backupDBName        = "codegrinder.db"
+	backupConfigName    = "config.json"
+	backupFilesDir      = "files"
+	backupBlobsDir      = "blobs"
+	backupResidencyDir  = "residency"
+)
+
+// backupCommand handles "codegrinder backup".
+// With -every, it keeps running and makes a new backup at each interval,
+// deleting the oldest backups in the directory beyond the -keep count.
+func backupCommand(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "output file (default: a timestamped file in -dir)")
+	dir := flags.String("dir", filepath.Join(root, "backups"), "directory for timestamped backups")
+	encrypt := flags.Bool("encrypt", false, "encrypt the backup with the passphrase in $"+backupPassphraseEnv)
+	every := flags.Duration("every", 0, "keep running and make a backup at this interval")
+	keep := flags.Int("keep", 0, "when making timestamped backups, keep only this many of the newest")
+	flags.Parse(args)
+
+	passphrase := ""
+	if *encrypt {
+		if passphrase = os.Getenv(backupPassphraseEnv); passphrase == "" {
+			log.Fatalf("encrypted backups need a passphrase in $%s", backupPassphraseEnv)
+		}
+	}
+	if *every > 0 && *output != "" {
+		log.Fatalf("-every makes timestamped backups and cannot be used with -o")
+	}
+	store, err := setupBlobStore()
+	if err != nil {
+		log.Fatalf("setting up blob store: %v", err)
+	}
+	blobStore = store
+
+	for {
+		filename := *output
+		if filename == "" {
+			if err := os.MkdirAll(*dir, 0700); err != nil {
+				log.Fatalf("creating backup directory: %v", err)
+			}
+			suffix := ".tar.gz"
+			if *encrypt {
+				suffix += ".enc"
+			}
+			filename = filepath.Join(*dir, "codegrinder-"+time.Now().Format("20060102-150405")+suffix)
+		}
+
+		start := time.Now()
+		if err := writeBackup(filename, passphrase); err != nil {
+			os.Remove(filename)
+			if *every == 0 {
+				log.Fatalf("backup failed: %v", err)
+			}
+			log.Printf("backup failed: %v", err)
+		} else {
+			log.Printf("backup written to %s in %v", filename, time.Since(start).Round(time.Millisecond))
+		}
+
+		if *output == "" && *keep > 0 {
+			if err := pruneBackups(*dir, *keep); err != nil {
+				log.Printf("error removing old backups: %v", err)
+			}
+		}
+
+		if *every == 0 {
+			return
+		}
+		time.Sleep(time.Until(start.Add(*every)))
+	}
+}
+
+// writeBackup writes a complete backup to the given file.
+func writeBackup(filename, passphrase string) error {
+	// snapshot the database so the backup is consistent even while the TA is running
+	tmp, err := ioutil.TempDir(filepath.Dir(Config.SQLite3Path), "backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	snapshot := filepath.Join(tmp, backupDBName)
+	db, err := sql.Open("sqlite3", Config.SQLite3Path+"?mode=ro&_busy_timeout=10000")
+	if err != nil {
+		return fmt.Errorf("opening database: %v", err)
+	}
+	_, err = db.Exec(`VACUUM INTO ?`, snapshot)
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("making database snapshot: %v", err)
+	}
+
+	fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var out io.WriteCloser = nopWriteCloser{fp}
+	if passphrase != "" {
+		if out, err = newBackupEncrypter(fp, passphrase); err != nil {
+			return err
+		}
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	if err := addFileToTar(tw, snapshot, backupDBName); err != nil {
+		return err
+	}
+	if err := addFileToTar(tw, filepath.Join(root, backupConfigName), backupConfigName); err != nil {
+		return err
+	}
+	if err := addDirToTar(tw, filepath.Join(root, backupFilesDir), backupFilesDir); err != nil {
+		return err
+	}
+	if blobStore != nil {
+		if err := addBlobStoreToTar(tw, blobStore, backupBlobsDir); err != nil {
+			return fmt.Errorf("backing up blob store: %v", err)
+		}
+	}
+	for name, store := range residencyStores {
+		if err := addBlobStoreToTar(tw, store, backupResidencyDir+"/"+name); err != nil {
+			return fmt.Errorf("backing up residency store %q: %v", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+func addFileToTar(tw *tar.Writer, path, name string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fp)
+	return err
+}
+
+// addDirToTar adds every regular file under dir to the tar file, with paths under prefix.
+// It does nothing if dir does not exist.
+func addDirToTar(tw *tar.Writer, dir, prefix string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return addFileToTar(tw, path, prefix+"/"+filepath.ToSlash(rel))
+	})
+}
+
+// addBlobStoreToTar adds every blob in a store to the tar file, with paths under prefix.
+func addBlobStoreToTar(tw *tar.Writer, store BlobStore, prefix string) error {
+	keys, err := store.List()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		data, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    prefix + "/" + key,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBackups deletes all but the newest keep backups in dir.
+func pruneBackups(dir string, keep int) error {
+	names, err := filepath.Glob(filepath.Join(dir, "codegrinder-*.tar.gz*"))
+	if err != nil {
+		return err
+	}
+	// timestamped names sort in date order
+	sort.Strings(names)
+	for len(names) > keep {
+		log.Printf("removing old backup %s", names[0])
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// restoreCommand handles "codegrinder restore <file>".
+// It refuses to overwrite an existing database or config file unless -force is given.
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite the existing database, config file, problem type files, and blob store")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: codegrinder restore [-force] <backup file>")
+	}
+	filename := flags.Arg(0)
+
+	fp, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("opening backup: %v", err)
+	}
+	defer fp.Close()
+
+	// detect an encrypted backup by its header
+	in := bufio.NewReader(fp)
+	var src io.Reader = in
+	if magic, err := in.Peek(len(backupMagic)); err == nil && string(magic) == backupMagic {
+		passphrase := os.Getenv(backupPassphraseEnv)
+		if passphrase == "" {
+			log.Fatalf("backup is encrypted: the passphrase must be in $%s", backupPassphraseEnv)
+		}
+		if src, err = newBackupDecrypter(in, passphrase); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		log.Fatalf("reading backup: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	// unpack into a staging directory first so a bad backup does not leave a partial restore
+	staging, err := ioutil.TempDir(root, "restore-")
+	if err != nil {
+		log.Fatalf("creating staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("reading backup: %v", err)
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			log.Fatalf("backup contains illegal path %q", header.Name)
+		}
+		path := filepath.Join(staging, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Fatalf("%v", err)
+		}
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(header.Mode).Perm())
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			log.Fatalf("extracting %s: %v", header.Name, err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, backupDBName)); err != nil {
+		log.Fatalf("backup does not contain a database")
+	}
+
+	// the restored config file decides where the database and blobs go
+	dbPath := filepath.Join(root, "db", "codegrinder.db")
+	configFile := filepath.Join(root, backupConfigName)
+	var cfg struct {
+		SQLite3Path string `json:"sqlite3Path"`
+		BlobStoreConfig
+		ResidencyStores map[string]BlobStoreConfig `json:"residencyStores"`
+	}
+	if raw, err := ioutil.ReadFile(filepath.Join(staging, backupConfigName)); err == nil {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			log.Fatalf("parsing config file from backup: %v", err)
+		}
+		if cfg.SQLite3Path != "" {
+			dbPath = cfg.SQLite3Path
+		}
+	}
+	if cfg.BlobDir == "" {
+		cfg.BlobDir = filepath.Join(root, "blobs")
+	}
+
+	// find a configured store for every set of blobs in the backup
+	type restoredStore struct {
+		staged string
+		cfg    BlobStoreConfig
+		store  BlobStore
+		label  string
+	}
+	stores := []*restoredStore{}
+	if _, err := os.Stat(filepath.Join(staging, backupBlobsDir)); err == nil {
+		stores = append(stores, &restoredStore{staged: filepath.Join(staging, backupBlobsDir), cfg: cfg.BlobStoreConfig, label: "blob store"})
+	}
+	residencies, _ := ioutil.ReadDir(filepath.Join(staging, backupResidencyDir))
+	for _, info := range residencies {
+		stores = append(stores, &restoredStore{
+			staged: filepath.Join(staging, backupResidencyDir, info.Name()),
+			cfg:    cfg.ResidencyStores[info.Name()],
+			label:  fmt.Sprintf("residency store %q", info.Name()),
+		})
+	}
+	for _, elt := range stores {
+		store, err := newBlobStore(elt.cfg)
+		if err != nil {
+			log.Fatalf("restoring %s: %v", elt.label, err)
+		}
+		if store == nil {
+			log.Fatalf("the backup holds blobs for the %s, but the restored config file does not configure it", elt.label)
+		}
+		elt.store = store
+	}
+
+	if !*force {
+		paths := []string{dbPath, configFile, filepath.Join(root, backupFilesDir)}
+		for _, elt := range stores {
+			if elt.cfg.BlobStore == "disk" {
+				paths = append(paths, elt.cfg.BlobDir)
+			}
+		}
+		for _, path := range paths {
+			if _, err := os.Stat(path); err == nil {
+				log.Fatalf("%s already exists; use -force to overwrite it", path)
+			}
+		}
+	}
+
+	// move everything into place
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		os.Remove(dbPath + suffix)
+	}
+	if err := os.Rename(filepath.Join(staging, backupDBName), dbPath); err != nil {
+		log.Fatalf("restoring database: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(staging, backupConfigName)); err == nil {
+		if err := os.Rename(filepath.Join(staging, backupConfigName), configFile); err != nil {
+			log.Fatalf("restoring config file: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, backupFilesDir)); err == nil {
+		if err := replaceDir(filepath.Join(staging, backupFilesDir), filepath.Join(root, backupFilesDir)); err != nil {
+			log.Fatalf("restoring problem type files: %v", err)
+		}
+	}
+	for _, elt := range stores {
+		if elt.cfg.BlobStore == "disk" {
+			if err := replaceDir(elt.staged, elt.cfg.BlobDir); err != nil {
+				log.Fatalf("restoring %s: %v", elt.label, err)
+			}
+			continue
+		}
+
+		// other stores are filled by uploading each blob
+		count := 0
+		err := filepath.Walk(elt.staged, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(elt.staged, path)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			count++
+			return elt.store.Put(filepath.ToSlash(rel), bytes.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:]))
+		})
+		if err != nil {
+			log.Fatalf("restoring %s: %v", elt.label, err)
+		}
+		log.Printf("uploaded %d blobs to the %s", count, elt.label)
+	}
+	log.Printf("restored %s to %s", filename, root)
+}
+
+// replaceDir moves a staged directory into place, replacing whatever is there.
+func replaceDir(staged, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return os.Rename(staged, dir)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// backupKey derives the encryption key for a backup from the passphrase.
+func backupKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupNonce gives the nonce for a chunk. Each chunk is sealed with the chunk
+// number as its nonce and a final-chunk flag as additional data, so chunks
+// cannot be reordered or the backup truncated without detection.
+func backupNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+var backupFinalChunk = []byte("final")
+
+type backupEncrypter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+}
+
+func newBackupEncrypter(w io.Writer, passphrase string) (*backupEncrypter, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(backupMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &backupEncrypter{w: w, aead: aead}, nil
+}
+
+func (e *backupEncrypter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := backupChunkSize - len(e.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		if len(e.buf) == backupChunkSize {
+			if err := e.flush(nil); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (e *backupEncrypter) flush(additional []byte) error {
+	sealed := e.aead.Seal(nil, backupNonce(e.aead, e.chunk), e.buf, additional)
+	e.chunk++
+	e.buf = e.buf[:0]
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := e.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *backupEncrypter) Close() error {
+	return e.flush(backupFinalChunk)
+}
+
+type backupDecrypter struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64
+	done  bool
+}
+
+func newBackupDecrypter(r io.Reader, passphrase string) (*backupDecrypter, error) {
+	header := make([]byte, len(backupMagic)+16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading backup header: %v", err)
+	}
+	aead, err := backupKey(passphrase, header[len(backupMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &backupDecrypter{r: r, aead: aead}, nil
+}
+
+func (d *backupDecrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		var size [4]byte
+		if _, err := io.ReadFull(d.r, size[:]); err != nil {
+			return 0, errors.New("encrypted backup is truncated")
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(d.r, sealed); err != nil {
+			return 0, errors.New("encrypted backup is truncated")
+		}
+		nonce := backupNonce(d.aead, d.chunk)
+		d.chunk++
+		plain, err := d.aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			if plain, err = d.aead.Open(nil, nonce, sealed, backupFinalChunk); err != nil {
+				return 0, errors.New("unable to decrypt backup: wrong passphrase or corrupted file")
+			}
+			d.done = true
+		}
+		d.buf = plain
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Problem options that ban parts of the language, each taking a comma-separated list:
+//
+//	ban-identifier=sorted,sort     names of functions, methods, types, and variables
+//	ban-import=itertools           modules, packages, crates, or headers
+//	ban-construct=while,lambda     keywords
+//
+// Banned names are only found in code, not in comments or string literals.
+// An imported name is banned along with everything inside it, so banning
+// collections also bans collections.abc.
+const (
+	banIdentifier = "ban-identifier"
+	banImport     = "ban-import"
+	banConstruct  = "ban-construct"
+)
+
+// maxBannedUses is how many uses of one banned name are listed in the report card.
+const maxBannedUses = 10
+
+// sourceLanguage describes enough of a language's syntax to find the code
+// outside its comments and string literals, and to find what it imports.
+type sourceLanguage struct {
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string // characters that open a string or character literal
+	rawQuotes     string // quotes with no escapes inside
+	tripleQuotes  bool   // python's """ and ''' strings
+	lifetimes     bool   // rust, where ' does not always open a literal
+
+	// imports find the names a file imports: the first group of each import
+	// match is a name, and the first group of each importBlock match holds a
+	// list whose names are found by importEntry
+	imports       []*regexp.Regexp
+	importBlock   *regexp.Regexp
+	importEntry   *regexp.Regexp
+	quotedImports bool   // whether imported names are written as string literals
+	separator     string // between the parts of an imported name
+}
+
+var (
+	cLanguage = &sourceLanguage{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+		imports:       []*regexp.Regexp{regexp.MustCompile(`(?m)^[ \t]*#[ \t]*include[ \t]*[<"]([^>"\n]+)[>"]`)},
+		quotedImports: true,
+		separator:     "/",
+	}
+	goLanguage = &sourceLanguage{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+		rawQuotes:     "`",
+		imports:       []*regexp.Regexp{regexp.MustCompile(`\bimport[ \t]+(?:[\w.]+[ \t]+)?"([^"\n]+)"`)},
+		importBlock:   regexp.MustCompile(`\bimport[ \t]*\(([^)]*)\)`),
+		importEntry:   regexp.MustCompile(`"([^"\n]+)"`),
+		quotedImports: true,
+		separator:     "/",
+	}
+	rustLanguage = &sourceLanguage{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+		lifetimes:     true,
+		imports: []*regexp.Regexp{
+			regexp.MustCompile(`\buse[ \t\n]+(?:::)?(\w+(?:::\w+)*)`),
+			regexp.MustCompile(`\bextern[ \t\n]+crate[ \t\n]+(\w+)`),
+		},
+		separator: "::",
+	}
+	pythonLanguage = &sourceLanguage{
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		tripleQuotes: true,
+		imports:      []*regexp.Regexp{regexp.MustCompile(`(?m)^[ \t]*from[ \t]+([\w.]+)[ \t]+import\b`)},
+		importBlock:  regexp.MustCompile(`(?m)^[ \t]*import[ \t]+([^\n;]+)`),
+		importEntry:  regexp.MustCompile(`(?:^|,)[ \t]*([\w.]+)`),
+		separator:    ".",
+	}
+	typescriptLanguage = &sourceLanguage{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'`",
+		imports: []*regexp.Regexp{
+			regexp.MustCompile(`\bfrom[ \t\n]*["']([^"'\n]+)["']`),
+			regexp.MustCompile(`\bimport[ \t\n]*\(?[ \t\n]*["']([^"'\n]+)["']`),
+			regexp.MustCompile(`\brequire[ \t\n]*\([ \t\n]*["']([^"'\n]+)["']`),
+		},
+		quotedImports: true,
+		separator:     "/",
+	}
+	sqlLanguage = &sourceLanguage{
+		lineComments:  []string{"--"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+	}
+	prologLanguage = &sourceLanguage{
+		lineComments:  []string{"%"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        `"'`,
+	}
+	standardMLLanguage = &sourceLanguage{
+		blockComments: [][2]string{{"(*", "*)"}},
+		quotes:        `"`,
+	}
+)
+
+// sourceLanguages maps file extensions to languages. Files of any other kind are not checked.
+var sourceLanguages = map[string]*sourceLanguage{
+	".c":   cLanguage,
+	".h":   cLanguage,
+	".cc":  cLanguage,
+	".cpp": cLanguage,
+	".cxx": cLanguage,
+	".hh":  cLanguage,
+	".hpp": cLanguage,
+	".go":  goLanguage,
+	".rs":  rustLanguage,
+	".py":  pythonLanguage,
+	".ts":  typescriptLanguage,
+	".tsx": typescriptLanguage,
+	".js":  typescriptLanguage,
+	".mjs": typescriptLanguage,
+	".sql": sqlLanguage,
+	".pl":  prologLanguage,
+	".sml": standardMLLanguage,
+}
+
+// importSpans returns the start and end of each name imported by code, which has had its comments scrubbed.
+func (lang *sourceLanguage) importSpans(code []byte) [][2]int {
+	var spans [][2]int
+	for _, re := range lang.imports {
+		for _, loc := range re.FindAllSubmatchIndex(code, -1) {
+			spans = append(spans, [2]int{loc[2], loc[3]})
+		}
+	}
+	if lang.importBlock != nil {
+		for _, block := range lang.importBlock.FindAllSubmatchIndex(code, -1) {
+			for _, loc := range lang.importEntry.FindAllSubmatchIndex(code[block[2]:block[3]], -1) {
+				spans = append(spans, [2]int{block[2] + loc[2], block[2] + loc[3]})
+			}
+		}
+	}
+	return spans
+}
+
+var sourceIdentifier = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// scrub returns two copies of src: one with the comments blanked out, and one
+// with the string literals blanked out as well. Blanked text is replaced by
+// spaces, keeping newlines, so offsets and line numbers are unchanged.
+func (lang *sourceLanguage) scrub(src []byte) (code, bare []byte) {
+	code = append([]byte(nil), src...)
+	bare = append([]byte(nil), src...)
+	blank := func(dst []byte, start, end int) {
+		for i := start; i < end && i < len(dst); i++ {
+			if dst[i] != '\n' {
+				dst[i] = ' '
+			}
+		}
+	}
+
+	for i := 0; i < len(src); {
+		rest := src[i:]
+
+		// comments
+		end := -1
+		for _, prefix := range lang.lineComments {
+			if bytes.HasPrefix(rest, []byte(prefix)) {
+				if end = bytes.IndexByte(rest, '\n'); end < 0 {
+					end = len(rest)
+				}
+				break
+			}
+		}
+		for _, pair := range lang.blockComments {
+			if end < 0 && bytes.HasPrefix(rest, []byte(pair[0])) {
+				if end = bytes.Index(rest[len(pair[0]):], []byte(pair[1])); end < 0 {
+					end = len(rest)
+				} else {
+					end += len(pair[0]) + len(pair[1])
+				}
+			}
+		}
+		if end >= 0 {
+			blank(code, i, i+end)
+			blank(bare, i, i+end)
+			i += end
+			continue
+		}
+
+		// string literals, keeping the quotes
+		c := rest[0]
+		switch {
+		case lang.tripleQuotes && (bytes.HasPrefix(rest, []byte(`"""`)) || bytes.HasPrefix(rest, []byte(`'''`))):
+			end = 3 + closingQuote(rest[3:], rest[:3], true)
+			blank(bare, i+3, i+end-3)
+		case strings.IndexByte(lang.rawQuotes, c) >= 0:
+			end = 1 + closingQuote(rest[1:], rest[:1], false)
+			blank(bare, i+1, i+end-1)
+		case strings.IndexByte(lang.quotes, c) >= 0:
+			if c == '\'' && lang.lifetimes && !isCharLiteral(rest) {
+				i++
+				continue
+			}
+			end = 1 + closingQuote(rest[1:], rest[:1], true)
+			blank(bare, i+1, i+end-1)
+		default:
+			i++
+			continue
+		}
+		i += end
+	}
+	return code, bare
+}
+
+// closingQuote returns the length of a literal's contents and closing quote.
+// An unterminated literal runs to the end of the line, or for triple-quoted
+// strings to the end of the file.
+func closingQuote(rest, quote []byte, escapes bool) int {
+	for i := 0; i < len(rest); i++ {
+		switch {
+		case escapes && rest[i] == '\\':
+			i++
+		case rest[i] == '\n' && len(quote) == 1 && quote[0] != '`':
+			return i
+		case bytes.HasPrefix(rest[i:], quote):
+			return i + len(quote)
+		}
+	}
+	return len(rest)
+}
+
+var rustCharLiteral = regexp.MustCompile(`^'(?:[^\\'\n]|\\.[^'\n]{0,7})'`)
+
+// isCharLiteral reports whether a ' in rust starts a character literal and not a lifetime.
+func isCharLiteral(rest []byte) bool {
+	return rustCharLiteral.Match(rest)
+}
+
+// bannedUse is one place where a student's file uses something a problem bans.
+type bannedUse struct {
+	kind string
+	name string
+	file string
+	line int
+	text string
+}
+
+// findBannedUses checks the files a student submitted against the bans in the problem options.
+func findBannedUses(problem *Problem, files map[string][]byte) []*bannedUse {
+	bans := make(map[string]map[string]bool)
+	if problem != nil {
+		for _, option := range problem.Options {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			kind := strings.TrimSpace(parts[0])
+			if kind != banIdentifier && kind != banImport && kind != banConstruct {
+				continue
+			}
+			for _, name := range strings.Split(parts[1], ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					if bans[kind] == nil {
+						bans[kind] = make(map[string]bool)
+					}
+					bans[kind][name] = true
+				}
+			}
+		}
+	}
+	if len(bans) == 0 {
+		return nil
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var uses []*bannedUse
+	for _, name := range names {
+		lang := sourceLanguages[strings.ToLower(filepath.Ext(name))]
+		if lang == nil {
+			continue
+		}
+		src := files[name]
+		code, bare := lang.scrub(src)
+		lines := bytes.Split(src, []byte("\n"))
+		add := func(kind, banned string, offset int) {
+			line := bytes.Count(src[:offset], []byte("\n"))
+			text := strings.TrimSpace(string(lines[line]))
+			if len(text) > maxSearchLineLength {
+				text = text[:maxSearchLineLength]
+			}
+			uses = append(uses, &bannedUse{kind: kind, name: banned, file: name, line: line + 1, text: text})
+		}
+
+		for _, loc := range sourceIdentifier.FindAllIndex(bare, -1) {
+			word := string(bare[loc[0]:loc[1]])
+			if bans[banIdentifier][word] {
+				add(banIdentifier, word, loc[0])
+			}
+			if bans[banConstruct][word] {
+				add(banConstruct, word, loc[0])
+			}
+		}
+		for _, span := range lang.importSpans(code) {
+			if !lang.quotedImports && bare[span[0]] == ' ' {
+				// the import statement is inside a string
+				continue
+			}
+			imported := string(code[span[0]:span[1]])
+			for banned := range bans[banImport] {
+				if imported == banned || strings.HasPrefix(imported, banned+lang.separator) {
+					add(banImport, banned, span[0])
+				}
+			}
+		}
+	}
+
+	// a line can import the same thing more than once, so keep one use per line
+	sort.SliceStable(uses, func(i, j int) bool {
+		a, b := uses[i], uses[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.file != b.file {
+			return a.file < b.file
+		}
+		return a.line < b.line
+	})
+	var unique []*bannedUse
+	for i, elt := range uses {
+		if i > 0 {
+			prev := uses[i-1]
+			if prev.kind == elt.kind && prev.name == elt.name && prev.file == elt.file && prev.line == elt.line {
+				continue
+			}
+		}
+		unique = append(unique, elt)
+	}
+	return unique
+}
+
+// checkBannedUses looks for banned names in the files the student submitted.
+// If it finds any, it reports them in the report card and the transcript,
+// and returns true so the caller can skip running the action.
+func checkBannedUses(n *Nanny, problem *Problem, files map[string][]byte) bool {
+	uses := findBannedUses(problem, files)
+	if len(uses) == 0 {
+		return false
+	}
+
+	for start := 0; start < len(uses); {
+		end := start + 1
+		for end < len(uses) && uses[end].kind == uses[start].kind && uses[end].name == uses[start].name {
+			end++
+		}
+		first := uses[start]
+		what := strings.TrimPrefix(first.kind, "ban-")
+		var details strings.Builder
+		for i, elt := range uses[start:end] {
+			if i == maxBannedUses {
+				fmt.Fprintf(&details, "...and %d more\n", end-start-maxBannedUses)
+				break
+			}
+			fmt.Fprintf(&details, "%s:%d: %s\n", elt.file, elt.line, elt.text)
+		}
+		n.ReportCard.AddBannedResult(fmt.Sprintf("banned %s %s", what, first.name), details.String(), fmt.Sprintf("%s:%d", first.file, first.line))
+		n.ReportCard.Failf("uses banned %s %s", what, first.name)
+		n.Events <- &EventMessage{
+			Time:  time.Now(),
+			Event: "error",
+			Error: fmt.Sprintf("%s:%d: %s is not allowed in this problem", first.file, first.line, first.name),
+		}
+		start = end
+	}
+	return true
+}
+
+// submittedFiles returns the files a student wrote or changed, leaving out
+// the files supplied by the problem step and problem type.
+func submittedFiles(files, instructorFiles map[string][]byte) map[string][]byte {
+	submitted := make(map[string][]byte)
+	for name, contents := range files {
+		if original, present := instructorFiles[name]; !present || !bytes.Equal(original, contents) {
+			submitted[name] = contents
+		}
+	}
+	return submitted
+}
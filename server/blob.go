@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// BlobStore holds large, immutable blobs outside the database.
+// Keys are slash-separated paths; blobs are never modified once written.
+// Put reads the blob from body, which holds size bytes whose SHA-256 is sum (in hex).
+// List returns the keys of every blob in the store, for backups.
+type BlobStore interface {
+	Put(key string, body io.Reader, size int64, sum string) error
+	Get(key string) ([]byte, error)
+	List() ([]string, error)
+}
+
+// blobStore is where commit files, transcripts, and problem step files are kept.
+// If nil, they stay in the database.
+var blobStore BlobStore
+
+// BlobStoreConfig describes a blob store. The main store is described by the
+// top-level config parameters of the same names.
+type BlobStoreConfig struct {
+	BlobStore   string `json:"blobStore"`   // "disk" or "s3"
+	BlobDir     string `json:"blobDir"`     // directory for a disk blob store
+	S3Endpoint  string `json:"s3Endpoint"`  // URL of the S3-compatible service for an s3 blob store
+	S3Region    string `json:"s3Region"`    // region for an s3 blob store: default "us-east-1"
+	S3Bucket    string `json:"s3Bucket"`    // bucket for an s3 blob store
+	S3AccessKey string `json:"s3AccessKey"` // access key ID for an s3 blob store
+	S3SecretKey string `json:"s3SecretKey"` // secret access key for an s3 blob store
+}
+
+// setupBlobStore creates the blob store selected in the config file,
+// and the blob stores that courses can be assigned to for data residency.
+func setupBlobStore() (BlobStore, error) {
+	stores := make(map[string]BlobStore)
+	for name, cfg := range Config.ResidencyStores {
+		if !residencyNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("residency store name %q must be lower-case letters, digits, and dashes", name)
+		}
+		if cfg.BlobStore == "" {
+			return nil, fmt.Errorf("residency store %q must set blobStore", name)
+		}
+		store, err := newBlobStore(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("residency store %q: %v", name, err)
+		}
+		stores[name] = store
+	}
+	residencyStores = stores
+
+	return newBlobStore(BlobStoreConfig{
+		BlobStore:   Config.BlobStore,
+		BlobDir:     Config.BlobDir,
+		S3Endpoint:  Config.S3Endpoint,
+		S3Region:    Config.S3Region,
+		S3Bucket:    Config.S3Bucket,
+		S3AccessKey: Config.S3AccessKey,
+		S3SecretKey: Config.S3SecretKey,
+	})
+}
+
+// newBlobStore creates a blob store. It returns nil if no kind of store is given.
+func newBlobStore(cfg BlobStoreConfig) (BlobStore, error) {
+	switch cfg.BlobStore {
+	case "":
+		return nil, nil
+	case "disk":
+		if cfg.BlobDir == "" {
+			return nil, fmt.Errorf("disk blob store requires blobDir")
+		}
+		return &diskBlobStore{dir: cfg.BlobDir}, nil
+	case "s3":
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+			return nil, fmt.Errorf("s3 blob store requires s3Endpoint, s3Bucket, s3AccessKey, and s3SecretKey")
+		}
+		return &s3BlobStore{
+			endpoint:  strings.TrimSuffix(cfg.S3Endpoint, "/"),
+			region:    cfg.S3Region,
+			bucket:    cfg.S3Bucket,
+			accessKey: cfg.S3AccessKey,
+			secretKey: cfg.S3SecretKey,
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown blob store %q: must be disk or s3", cfg.BlobStore)
+	}
+}
+
+// storeCommitBlobs moves a commit's files and its transcript (the artifact of
+// grading it) into the blob store and returns a copy of the commit ready to be
+// saved in the database, with only references to the blobs.
+// Blobs are named by the hash of their contents, so identical submissions share a blob.
+// Blobs from a course with a data residency go to that residency's store instead.
+func storeCommitBlobs(tx *sql.Tx, courseID int64, commit *Commit) (*Commit, error) {
+	residency, err := courseResidency(tx, courseID)
+	if err != nil {
+		return nil, err
+	}
+	store := blobStore
+	if residency != "" {
+		store = residencyStores[residency]
+		if store == nil {
+			return nil, fmt.Errorf("course %d keeps its files in residency store %q, which is not configured", courseID, residency)
+		}
+	}
+	if store == nil {
+		return commit, nil
+	}
+
+	saved := *commit
+	key, err := putFilesBlob(store, "commits", commit.Files)
+	if err != nil {
+		return nil, fmt.Errorf("storing commit files: %v", err)
+	}
+	saved.Files = map[string][]byte{}
+	saved.FilesBlob = residencyKey(residency, key)
+
+	if len(commit.Transcript) > 0 {
+		key, err := putJSONBlob(store, "transcripts", commit.Transcript)
+		if err != nil {
+			return nil, fmt.Errorf("storing commit transcript: %v", err)
+		}
+		saved.Transcript = []*EventMessage{}
+		saved.TranscriptBlob = residencyKey(residency, key)
+	}
+	return &saved, nil
+}
+
+// storeStepFiles moves the files of a problem step (its tests and other
+// fixtures) into the blob store and returns a copy of the step ready to be
+// saved in the database. Problems are shared between courses, so they always
+// go in the main store.
+func storeStepFiles(step *ProblemStep) (*ProblemStep, error) {
+	if blobStore == nil {
+		return step, nil
+	}
+	key, err := putFilesBlob(blobStore, "fixtures", step.Files)
+	if err != nil {
+		return nil, fmt.Errorf("storing files for step %d: %v", step.Step, err)
+	}
+	saved := *step
+	saved.Files = map[string][]byte{}
+	saved.FilesBlob = key
+	return &saved, nil
+}
+
+// putJSONBlob saves a value encoded as JSON in a store under the given prefix,
+// returning its key.
+func putJSONBlob(store BlobStore, prefix string, value interface{}) (string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	sum := hex.EncodeToString(hash[:])
+	key := prefix + "/" + sum
+	if err := store.Put(key, bytes.NewReader(raw), int64(len(raw)), sum); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// putFilesBlob saves a set of files in a store under the given prefix,
+// returning its key. The files are encoded as JSON into a temporary file,
+// hashing along the way, and streamed from there into the store, so a large
+// upload is never held in memory a second time in encoded form.
+// The blob is the same as putJSONBlob would save.
+func putFilesBlob(store BlobStore, prefix string, files map[string][]byte) (string, error) {
+	spool, err := ioutil.TempFile("", "codegrinder-files-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	hash := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(spool, hash))
+	if err := writeFilesJSON(out, files); err != nil {
+		return "", err
+	}
+	if err := out.Flush(); err != nil {
+		return "", err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	key := prefix + "/" + sum
+	if err := store.Put(key, spool, size, sum); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// writeFilesJSON writes a set of files as JSON, producing the same bytes as
+// json.Marshal but encoding the contents as it goes rather than all at once.
+func writeFilesJSON(w io.Writer, files map[string][]byte) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+	for i, name := range names {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		quoted, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(quoted, ':')); err != nil {
+			return err
+		}
+		if files[name] == nil {
+			if _, err := io.WriteString(w, "null"); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.WriteString(w, `"`); err != nil {
+			return err
+		}
+		enc := base64.NewEncoder(base64.StdEncoding, w)
+		if _, err := enc.Write(files[name]); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `"`); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}")
+	return err
+}
+
+// getJSONBlob loads a blob saved by putJSONBlob, given the key saved with it.
+func getJSONBlob(key string, value interface{}) error {
+	store, inner, err := blobStoreFor(key)
+	if err != nil {
+		return err
+	}
+	raw, err := store.Get(inner)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, value)
+}
+
+// loadCommitBlobs fills in the files and transcripts of commits that keep them in the blob store.
+func loadCommitBlobs(commits ...*Commit) error {
+	for _, commit := range commits {
+		if commit.FilesBlob != "" {
+			files := make(map[string][]byte)
+			if err := getJSONBlob(commit.FilesBlob, &files); err != nil {
+				return fmt.Errorf("loading files for commit %d: %v", commit.ID, err)
+			}
+			commit.Files = files
+		}
+		if commit.TranscriptBlob != "" {
+			transcript := []*EventMessage{}
+			if err := getJSONBlob(commit.TranscriptBlob, &transcript); err != nil {
+				return fmt.Errorf("loading transcript for commit %d: %v", commit.ID, err)
+			}
+			commit.Transcript = transcript
+		}
+	}
+	return nil
+}
+
+// loadStepFiles fills in the files of problem steps that keep them in the blob store.
+func loadStepFiles(steps ...*ProblemStep) error {
+	for _, step := range steps {
+		if step.FilesBlob == "" {
+			continue
+		}
+		files := make(map[string][]byte)
+		if err := getJSONBlob(step.FilesBlob, &files); err != nil {
+			return fmt.Errorf("loading files for problem %d step %d: %v", step.ProblemID, step.Step, err)
+		}
+		step.Files = files
+	}
+	return nil
+}
+
+// diskBlobStore keeps blobs as files under a local directory.
+type diskBlobStore struct {
+	dir string
+}
+
+func (s *diskBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *diskBlobStore) Put(key string, body io.Reader, size int64, sum string) error {
+	path := s.path(key)
+	if _, err := os.Stat(path); err == nil {
+		// blobs are immutable, so it is already there
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it so readers never see a partial blob
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".blob-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if n, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	} else if n != size {
+		tmp.Close()
+		return fmt.Errorf("blob %s: expected %d bytes, got %d", key, size, n)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *diskBlobStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+func (s *diskBlobStore) List() ([]string, error) {
+	keys := []string{}
+	if _, err := os.Stat(s.dir); os.IsNotExist(err) {
+		return keys, nil
+	}
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".blob-") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+// s3BlobStore keeps blobs in an S3-compatible object store,
+// using path-style URLs and AWS signature version 4.
+type s3BlobStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3BlobStore) Put(key string, body io.Reader, size int64, sum string) error {
+	res, err := s.do("PUT", key, nil, body, size, sum)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// emptySHA256 is the hash of an empty payload, as signed for requests without a body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *s3BlobStore) Get(key string) ([]byte, error) {
+	res, err := s.do("GET", key, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// List pages through the bucket with ListObjectsV2.
+func (s *s3BlobStore) List() ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do("GET", "", query, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing bucket %s: %v", s.bucket, err)
+		}
+		for _, elt := range page.Contents {
+			keys = append(keys, elt.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3BlobStore) do(method, key string, query url.Values, body io.Reader, size int64, payload string) (*http.Response, error) {
+	u, err := url.Parse(s.endpoint + "/" + s.bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, payload, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, res.Status, msg)
+	}
+	return res, nil
+}
+
+// sign adds AWS signature version 4 headers to a request for the S3 service.
+// payload is the hex SHA-256 of the request body.
+func (s *s3BlobStore) sign(req *http.Request, payload string, now time.Time) {
+	region := s.region
+	if region == "" {
+		region = "us-east-1"
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	signV4(req, "s3", region, s.accessKey, s.secretKey, payload, now)
+}
+
+// signV4 adds an AWS signature version 4 Authorization header to a request.
+// Host, X-Amz-Date, and every header already set on the request are signed.
+// The path is used as it is escaped in the URL, which is what S3 expects.
+// payload is the hex SHA-256 of the request body.
+func signV4(req *http.Request, service, region, accessKey, secretKey, payload string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	params := []string{}
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(params)
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// awsEscape percent-encodes everything but the unreserved characters of RFC 3986,
+// as signature version 4 requires for query parameters.
+func awsEscape(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+)
+
+// defaultMaxRequestSize is the largest request body accepted when neither the
+// config file nor defaultRequestSizes gives a limit for the route.
+const defaultMaxRequestSize = 1 << 20
+
+// defaultRequestSizes are the larger limits for routes that upload student or
+// problem files. Entries in maxRequestSizes in the config file take precedence.
+var defaultRequestSizes = map[string]int64{
+	"POST /commit_bundles/unsigned":            32 << 20,
+	"POST /commit_bundles/signed":              32 << 20,
+	"POST /commit_bundles/daycare":             32 << 20,
+	"POST /problem_bundles/unconfirmed":        64 << 20,
+	"POST /problem_bundles/confirmed":          64 << 20,
+	"PUT /problem_bundles/:problem_id":         64 << 20,
+	"POST /problem_set_bundles":                8 << 20,
+	"PUT /problem_set_bundles/:problem_set_id": 8 << 20,
+}
+
+// errRequestTooLarge is returned when reading past the end of a request's limit.
+var errRequestTooLarge = errors.New("request body is too large")
+
+// RequestTooLarge is the body of a 413 response.
+type RequestTooLarge struct {
+	Error string `json:"error"`
+	Limit int64  `json:"limit"`
+}
+
+// requestLimit is the size limit that applies to the current request,
+// mapped so that gunzip can apply it to the decompressed body as well.
+type requestLimit int64
+
+// requestSizeLimit finds the limit for a request by its method and route pattern.
+func requestSizeLimit(method, path string) int64 {
+	for _, sizes := range []map[string]int64{Config.MaxRequestSizes, defaultRequestSizes} {
+		for route, size := range sizes {
+			routeMethod, pattern, _ := strings.Cut(route, " ")
+			if strings.EqualFold(routeMethod, method) && matchRoutePattern(pattern, path) {
+				return size
+			}
+		}
+	}
+	return Config.MaxRequestSize
+}
+
+// limitedBody reads a request body, failing with errRequestTooLarge
+// once more than the limit has been read. It does not respond to the client;
+// bindWithinLimit and gunzip send the 413 when they see the error.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func newLimitedBody(body io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{body: body, remaining: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errRequestTooLarge
+	}
+	// read one byte past the limit to tell a body of exactly the limit from a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	if int64(n) > b.remaining || err == errRequestTooLarge {
+		// the second case is a decompressed body whose compressed form was too large
+		b.exceeded = true
+		return 0, errRequestTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// writeRequestTooLarge sends a 413 response that gives the limit.
+func writeRequestTooLarge(w http.ResponseWriter, limit int64) {
+	msg := fmt.Sprintf("request body is larger than the limit of %d bytes", limit)
+	log.Print(logPrefix() + msg)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(&RequestTooLarge{
+		Error: msg,
+		Limit: limit,
+	})
+}
+
+// limitRequestSize returns martini middleware that enforces request size limits.
+// A declared Content-Length over the limit is refused before anything is read.
+// It must run after apiVersioning so it sees the route path.
+func limitRequestSize() martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		limit := requestSizeLimit(r.Method, r.URL.Path)
+		if r.ContentLength > limit {
+			writeRequestTooLarge(w, limit)
+			return
+		}
+		if r.Body != nil {
+			r.Body = newLimitedBody(r.Body, limit)
+		}
+		c.Map(requestLimit(limit))
+		c.Next()
+	}
+}
+
+// bindJSON is binding.Json with the request size limit enforced.
+func bindJSON(obj interface{}) martini.Handler {
+	return bindWithinLimit(binding.Json(obj))
+}
+
+// bindWithinLimit runs a binding handler and sends a 413 response if the body
+// was cut off at its size limit. Handlers stop running once a response is
+// written, so the half-read body is never acted on.
+func bindWithinLimit(bind martini.Handler) martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request, limit requestLimit) {
+		body := r.Body
+		if _, err := c.Invoke(bind); err != nil {
+			panic(err)
+		}
+		if limited, ok := body.(*limitedBody); ok && limited.exceeded {
+			writeRequestTooLarge(w, int64(limit))
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// brotliWriter compresses a stream in the brotli format (RFC 7932).
+// It finds repeated strings with a hash chain and gives each meta-block its
+// own prefix codes. It does not use the static dictionary, context modeling,
+// or block splitting, which keeps it small at some cost in ratio.
+type brotliWriter struct {
+	w       io.Writer
+	out     []byte
+	bits    uint64
+	nbits   uint
+	started bool
+	closed  bool
+	window  []byte // recent input already encoded, which later blocks may copy from
+	pending []byte // input not yet encoded
+}
+
+const (
+	// brotliWindowBits gives a 64K window, the smallest the format allows
+	// and plenty for API responses.
+	brotliWindowBits  = 16
+	brotliMaxDistance = 1<<brotliWindowBits - 16
+
+	// brotliBlockSize is the most input put in one meta-block.
+	brotliBlockSize = 1 << 16
+
+	brotliMinMatch  = 4
+	brotliMaxMatch  = 1 << 12
+	brotliHashBits  = 15
+	brotliMaxChain  = 32
+	brotliMaxLength = 15
+)
+
+// insert and copy length codes: the base value and number of extra bits for each
+var (
+	brotliInsertBase  = [24]int{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	brotliInsertExtra = [24]uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	brotliCopyBase    = [24]int{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	brotliCopyExtra   = [24]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// brotliCodeLengthOrder is the order code length code lengths are sent in.
+var brotliCodeLengthOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// brotliCodeLengthLengths is the fixed code for code length code lengths 0-5,
+// as {bits, count} with the bits in stream order.
+var brotliCodeLengthLengths = [6][2]uint{{0, 2}, {7, 4}, {3, 3}, {2, 2}, {1, 2}, {15, 4}}
+
+var errBrotliClosed = errors.New("brotli: write to closed writer")
+
+func newBrotliWriter(w io.Writer) *brotliWriter {
+	return &brotliWriter{w: w}
+}
+
+func (b *brotliWriter) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, errBrotliClosed
+	}
+	b.pending = append(b.pending, p...)
+	if len(b.pending) < brotliBlockSize {
+		return len(p), nil
+	}
+	for len(b.pending) >= brotliBlockSize {
+		b.encode(b.pending[:brotliBlockSize])
+		b.pending = b.pending[brotliBlockSize:]
+	}
+	b.pending = append([]byte(nil), b.pending...)
+	return len(p), b.emit()
+}
+
+// Flush encodes everything written so far and ends it on a byte boundary,
+// so a reader can decode it without waiting for more.
+func (b *brotliWriter) Flush() error {
+	if b.closed {
+		return errBrotliClosed
+	}
+	b.encodePending()
+
+	// an empty metadata block pads the stream to a byte boundary
+	b.writeBits(1, 0) // ISLAST
+	b.writeBits(2, 3) // MNIBBLES: metadata
+	b.writeBits(1, 0) // reserved
+	b.writeBits(2, 0) // MSKIPBYTES
+	b.align()
+	return b.emit()
+}
+
+// Close encodes the rest of the input and ends the stream.
+// It does not close the underlying writer.
+func (b *brotliWriter) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.encodePending()
+	b.writeBits(1, 1) // ISLAST
+	b.writeBits(1, 1) // ISLASTEMPTY
+	b.align()
+	b.closed = true
+	return b.emit()
+}
+
+func (b *brotliWriter) encodePending() {
+	if !b.started {
+		b.writeBits(1, 0) // WBITS = 16
+		b.started = true
+	}
+	if len(b.pending) > 0 {
+		b.encode(b.pending)
+		b.pending = nil
+	}
+}
+
+func (b *brotliWriter) writeBits(n uint, value uint64) {
+	b.bits |= value << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.out = append(b.out, byte(b.bits))
+		b.bits >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *brotliWriter) align() {
+	if b.nbits > 0 {
+		b.out = append(b.out, byte(b.bits))
+		b.bits, b.nbits = 0, 0
+	}
+}
+
+// emit passes the whole bytes produced so far on to the underlying writer.
+func (b *brotliWriter) emit() error {
+	if len(b.out) == 0 {
+		return nil
+	}
+	_, err := b.w.Write(b.out)
+	b.out = b.out[:0]
+	return err
+}
+
+// brotliCommand inserts literals and then copies from earlier output.
+// The last command in a meta-block may only insert, with copy zero.
+type brotliCommand struct {
+	insert, copy, distance int
+}
+
+// encode writes one compressed meta-block holding block.
+func (b *brotliWriter) encode(block []byte) {
+	if !b.started {
+		b.writeBits(1, 0) // WBITS = 16
+		b.started = true
+	}
+	data := make([]byte, 0, len(b.window)+len(block))
+	data = append(append(data, b.window...), block...)
+	start := len(b.window)
+	commands := brotliCommands(data, start)
+
+	// gather the symbols to build the prefix codes
+	literalFreqs := make([]int, 256)
+	commandFreqs := make([]int, 704)
+	distanceFreqs := make([]int, 64)
+	pos := start
+	for _, cmd := range commands {
+		for _, ch := range data[pos : pos+cmd.insert] {
+			literalFreqs[ch]++
+		}
+		insertCode, copyCode := brotliLengthCodes(cmd)
+		commandFreqs[brotliCommandSymbol(insertCode, copyCode)]++
+		if cmd.copy > 0 {
+			symbol, _, _ := brotliDistanceCode(cmd.distance)
+			distanceFreqs[symbol]++
+		}
+		pos += cmd.insert + cmd.copy
+	}
+
+	// meta-block header
+	n := len(block)
+	nibbles := 4
+	for (n-1)>>(4*nibbles) != 0 {
+		nibbles++
+	}
+	b.writeBits(1, 0) // ISLAST
+	b.writeBits(2, uint64(nibbles-4))
+	b.writeBits(uint(4*nibbles), uint64(n-1))
+	b.writeBits(1, 0) // ISUNCOMPRESSED
+	b.writeBits(1, 0) // one literal block type
+	b.writeBits(1, 0) // one insert and copy block type
+	b.writeBits(1, 0) // one distance block type
+	b.writeBits(2, 0) // NPOSTFIX
+	b.writeBits(4, 0) // NDIRECT
+	b.writeBits(2, 0) // context mode for the literal block type
+	b.writeBits(1, 0) // one literal prefix code
+	b.writeBits(1, 0) // one distance prefix code
+	literalLengths, literalCodes := b.writePrefixCode(literalFreqs, 8)
+	commandLengths, commandCodes := b.writePrefixCode(commandFreqs, 10)
+	distanceLengths, distanceCodes := b.writePrefixCode(distanceFreqs, 6)
+
+	pos = start
+	for _, cmd := range commands {
+		insertCode, copyCode := brotliLengthCodes(cmd)
+		symbol := brotliCommandSymbol(insertCode, copyCode)
+		b.writeBits(uint(commandLengths[symbol]), uint64(commandCodes[symbol]))
+		b.writeBits(brotliInsertExtra[insertCode], uint64(cmd.insert-brotliInsertBase[insertCode]))
+		if cmd.copy > 0 {
+			b.writeBits(brotliCopyExtra[copyCode], uint64(cmd.copy-brotliCopyBase[copyCode]))
+		}
+		for _, ch := range data[pos : pos+cmd.insert] {
+			b.writeBits(uint(literalLengths[ch]), uint64(literalCodes[ch]))
+		}
+		if cmd.copy > 0 {
+			symbol, extraBits, extra := brotliDistanceCode(cmd.distance)
+			b.writeBits(uint(distanceLengths[symbol]), uint64(distanceCodes[symbol]))
+			b.writeBits(extraBits, uint64(extra))
+		}
+		pos += cmd.insert + cmd.copy
+	}
+
+	if len(data) > brotliMaxDistance {
+		data = data[len(data)-brotliMaxDistance:]
+	}
+	b.window = append([]byte(nil), data...)
+}
+
+// brotliCommands splits data[start:] into commands, copying from anywhere
+// in data that is within the window.
+func brotliCommands(data []byte, start int) []brotliCommand {
+	head := make([]int32, 1<<brotliHashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(data))
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(data[i:]) * 0x1e35a7bd) >> (32 - brotliHashBits)
+	}
+	add := func(i int) {
+		if i+brotliMinMatch <= len(data) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	for i := 0; i < start; i++ {
+		add(i)
+	}
+
+	var commands []brotliCommand
+	literals := start
+	for i := start; i < len(data); {
+		best, distance := 0, 0
+		if i+brotliMinMatch <= len(data) {
+			limit := len(data) - i
+			if limit > brotliMaxMatch {
+				limit = brotliMaxMatch
+			}
+			for j, chain := head[hash(i)], 0; j >= 0 && i-int(j) <= brotliMaxDistance && chain < brotliMaxChain; j, chain = prev[j], chain+1 {
+				n := 0
+				for n < limit && data[int(j)+n] == data[i+n] {
+					n++
+				}
+				if n > best {
+					best, distance = n, i-int(j)
+				}
+			}
+		}
+		if best < brotliMinMatch {
+			add(i)
+			i++
+			continue
+		}
+		commands = append(commands, brotliCommand{insert: i - literals, copy: best, distance: distance})
+		for k := i; k < i+best; k++ {
+			add(k)
+		}
+		i += best
+		literals = i
+	}
+	if literals < len(data) {
+		commands = append(commands, brotliCommand{insert: len(data) - literals})
+	}
+	return commands
+}
+
+// brotliLengthCodes finds the insert and copy length codes for a command.
+func brotliLengthCodes(cmd brotliCommand) (int, int) {
+	insertCode := len(brotliInsertBase) - 1
+	for brotliInsertBase[insertCode] > cmd.insert {
+		insertCode--
+	}
+	copyCode := 0
+	if cmd.copy > 0 {
+		copyCode = len(brotliCopyBase) - 1
+		for brotliCopyBase[copyCode] > cmd.copy {
+			copyCode--
+		}
+	}
+	return insertCode, copyCode
+}
+
+// brotliCommandSymbol combines insert and copy length codes into one
+// symbol. Every command gives its distance explicitly.
+func brotliCommandSymbol(insertCode, copyCode int) int {
+	var cell int
+	switch {
+	case insertCode < 8 && copyCode < 8:
+		cell = 128
+	case insertCode < 8 && copyCode < 16:
+		cell = 192
+	case insertCode < 16 && copyCode < 8:
+		cell = 256
+	case insertCode < 16 && copyCode < 16:
+		cell = 320
+	case insertCode < 8:
+		cell = 384
+	case copyCode < 8:
+		cell = 448
+	case insertCode < 16:
+		cell = 512
+	case copyCode < 16:
+		cell = 576
+	default:
+		cell = 640
+	}
+	return cell + (insertCode&7)<<3 + copyCode&7
+}
+
+// brotliDistanceCode gives the distance symbol and its extra bits for
+// a distance, with no postfix bits and no direct distance codes.
+func brotliDistanceCode(distance int) (symbol int, extraBits uint, extra uint32) {
+	x := uint32(distance + 3)
+	extraBits = uint(bits.Len32(x)) - 2
+	high := (x >> extraBits) & 1
+	return 16 + int(2*(extraBits-1)+uint(high)), extraBits, x - (2+high)<<extraBits
+}
+
+// writePrefixCode chooses a prefix code for symbol frequencies, writes it,
+// and returns the length and bit-reversed code of each symbol.
+func (b *brotliWriter) writePrefixCode(freqs []int, alphabetBits uint) ([]uint8, []uint16) {
+	var used []int
+	for symbol, freq := range freqs {
+		if freq > 0 {
+			used = append(used, symbol)
+		}
+	}
+	if len(used) == 0 {
+		// the code is never used, but one must be given
+		used = []int{0}
+	}
+
+	lengths := make([]uint8, len(freqs))
+	codes := make([]uint16, len(freqs))
+	if len(used) <= 2 {
+		// a simple prefix code: one symbol takes no bits, two take one bit each
+		b.writeBits(2, 1)
+		b.writeBits(2, uint64(len(used)-1))
+		for _, symbol := range used {
+			b.writeBits(alphabetBits, uint64(symbol))
+		}
+		if len(used) == 2 {
+			lengths[used[0]], lengths[used[1]] = 1, 1
+			codes[used[1]] = 1
+		}
+		return lengths, codes
+	}
+	lengths = brotliCodeLengths(freqs, brotliMaxLength)
+	codes = brotliCanonicalCodes(lengths)
+
+	// run-length code the lengths through the last used symbol, using 17
+	// for runs of zeros; consecutive 17s would combine, so a plain zero
+	// separates them
+	type codeLength struct {
+		symbol int
+		extra  uint64
+	}
+	var sequence []codeLength
+	last := used[len(used)-1]
+	for i := 0; i <= last; {
+		if lengths[i] != 0 {
+			sequence = append(sequence, codeLength{symbol: int(lengths[i])})
+			i++
+			continue
+		}
+		run := 0
+		for lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		for run > 0 {
+			if run < 3 {
+				sequence = append(sequence, codeLength{symbol: 0})
+				run--
+				continue
+			}
+			n := run
+			if n > 10 {
+				n = 10
+			}
+			sequence = append(sequence, codeLength{symbol: 17, extra: uint64(n - 3)})
+			run -= n
+			if run > 0 {
+				sequence = append(sequence, codeLength{symbol: 0})
+				run--
+			}
+		}
+	}
+
+	// the code for the code lengths
+	clFreqs := make([]int, 18)
+	for _, elt := range sequence {
+		clFreqs[elt.symbol]++
+	}
+	clLengths := brotliCodeLengths(clFreqs, 5)
+	clUsed, lone := 0, 0
+	for symbol, freq := range clFreqs {
+		if freq > 0 {
+			clUsed, lone = clUsed+1, symbol
+		}
+	}
+	if clUsed == 1 {
+		// a lone symbol takes no bits, but is sent with a nonzero length
+		clLengths[lone] = 1
+	}
+	clCodes := brotliCanonicalCodes(clLengths)
+	count := len(brotliCodeLengthOrder)
+	if clUsed > 1 {
+		// the reader stops once the code is complete
+		for clLengths[brotliCodeLengthOrder[count-1]] == 0 {
+			count--
+		}
+	}
+	b.writeBits(2, 0) // HSKIP
+	for _, symbol := range brotliCodeLengthOrder[:count] {
+		elt := brotliCodeLengthLengths[clLengths[symbol]]
+		b.writeBits(elt[1], uint64(elt[0]))
+	}
+	for _, elt := range sequence {
+		if clUsed > 1 {
+			b.writeBits(uint(clLengths[elt.symbol]), uint64(clCodes[elt.symbol]))
+		}
+		if elt.symbol == 17 {
+			b.writeBits(3, elt.extra)
+		}
+	}
+	return lengths, codes
+}
+
+// brotliCodeLengths finds optimal prefix code lengths no longer than limit
+// for the symbols with nonzero frequencies, using the package-merge algorithm.
+// Fewer than two symbols get no lengths.
+func brotliCodeLengths(freqs []int, limit int) []uint8 {
+	type node struct {
+		weight      int
+		symbol      int
+		left, right *node
+	}
+	lengths := make([]uint8, len(freqs))
+	var leaves []*node
+	for symbol, freq := range freqs {
+		if freq > 0 {
+			leaves = append(leaves, &node{weight: freq, symbol: symbol})
+		}
+	}
+	if len(leaves) < 2 {
+		return lengths
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return leaves[i].weight < leaves[j].weight })
+
+	list := leaves
+	for level := 1; level < limit; level++ {
+		merged := make([]*node, 0, len(leaves)+len(list)/2)
+		i := 0
+		for k := 0; k+1 < len(list); k += 2 {
+			pkg := &node{weight: list[k].weight + list[k+1].weight, symbol: -1, left: list[k], right: list[k+1]}
+			for i < len(leaves) && leaves[i].weight <= pkg.weight {
+				merged = append(merged, leaves[i])
+				i++
+			}
+			merged = append(merged, pkg)
+		}
+		list = append(merged, leaves[i:]...)
+	}
+
+	// each time a symbol appears in the chosen items adds one to its length
+	var count func(*node)
+	count = func(n *node) {
+		if n.symbol >= 0 {
+			lengths[n.symbol]++
+			return
+		}
+		count(n.left)
+		count(n.right)
+	}
+	for _, n := range list[:2*len(leaves)-2] {
+		count(n)
+	}
+	return lengths
+}
+
+// brotliCanonicalCodes assigns canonical codes for code lengths,
+// bit-reversed so they can be written least significant bit first.
+func brotliCanonicalCodes(lengths []uint8) []uint16 {
+	var counts [brotliMaxLength + 1]int
+	for _, length := range lengths {
+		if length > 0 {
+			counts[length]++
+		}
+	}
+	var next [brotliMaxLength + 1]int
+	code := 0
+	for length := 1; length <= brotliMaxLength; length++ {
+		code = (code + counts[length-1]) << 1
+		next[length] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for symbol, length := range lengths {
+		if length > 0 {
+			codes[symbol] = bits.Reverse16(uint16(next[length])) >> (16 - length)
+			next[length]++
+		}
+	}
+	return codes
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Roles given to assignments created in bulk, matching what an LMS sends in an LTI launch.
+const (
+	bulkRoleInstructor = "Instructor"
+	bulkRoleTA         = "urn:lti:role:ims/lis/TeachingAssistant"
+	bulkRoleLearner    = "Learner"
+)
+
+// bulkLtiID is the stand-in for an LTI resource link ID that ties together the
+// assignments of one problem set in one course created without an LMS.
+func bulkLtiID(courseID, problemSetID int64) string {
+	return fmt.Sprintf("local-%d-%d", courseID, problemSetID)
+}
+
+// sameTime reports whether two optional times are the same.
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+// PostCourseBulkAssignment handles requests to /courses/:course_id/bulk_assignments,
+// creating an assignment of a problem set for every user enrolled in the course:
+// everyone with an assignment in the course already and every member of its sections.
+// Instructors and section TAs get instructor assignments. This is for courses that
+// are not run through an LMS, so students do not need an LTI launch to start, and
+// no grades are posted anywhere. Only instructors (not TAs) can do this.
+func PostCourseBulkAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, bulk BulkAssignment, render render.Render) {
+	now := time.Now()
+	courseID, ok := loadLeadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	problemSet := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", problemSet, bulk.ProblemSetID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	bulk.Title = strings.TrimSpace(bulk.Title)
+	if bulk.Title == "" {
+		bulk.Title = problemSet.Note
+	}
+	if bulk.UnlockAt != nil && bulk.DueAt != nil && bulk.DueAt.Before(*bulk.UnlockAt) ||
+		bulk.UnlockAt != nil && bulk.LockAt != nil && bulk.LockAt.Before(*bulk.UnlockAt) ||
+		bulk.DueAt != nil && bulk.LockAt != nil && bulk.LockAt.Before(*bulk.DueAt) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "dates must be in order: unlock, then due, then lock")
+		return
+	}
+	for _, when := range []*time.Time{bulk.UnlockAt, bulk.DueAt, bulk.LockAt} {
+		if when != nil {
+			*when = when.Local()
+		}
+	}
+
+	// find everyone in the course and the role each one gets
+	type enrolled struct {
+		UserID     int64 `meddler:"user_id"`
+		Instructor bool  `meddler:"instructor"`
+		TA         bool  `meddler:"ta"`
+	}
+	users := []*enrolled{}
+	if err := meddler.QueryAll(tx, &users, `SELECT user_id, MAX(instructor) AS instructor, MAX(ta) AS ta FROM (`+
+		`SELECT user_id, instructor, 0 AS ta FROM assignments WHERE course_id = ? `+
+		`UNION ALL SELECT section_members.user_id, 0 AS instructor, section_members.role = 'ta' AS ta `+
+		`FROM section_members JOIN sections ON section_members.section_id = sections.id WHERE sections.course_id = ?) `+
+		`GROUP BY user_id ORDER BY user_id`, courseID, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	result := &BulkAssignmentResult{
+		LtiID:       bulkLtiID(courseID, problemSet.ID),
+		Assignments: []*Assignment{},
+	}
+	for _, user := range users {
+		roles := bulkRoleLearner
+		switch {
+		case user.Instructor:
+			roles = bulkRoleInstructor
+		case user.TA:
+			roles = bulkRoleTA
+		}
+
+		asst := new(Assignment)
+		err := meddler.QueryRow(tx, asst, `SELECT * FROM assignments WHERE user_id = ? AND lti_id = ?`, user.UserID, result.LtiID)
+		switch {
+		case err == sql.ErrNoRows:
+			// a canary may give this student a candidate version of the problem set
+			version, err := canaryProblemSet(tx, problemSet, &Course{ID: courseID}, &User{ID: user.UserID}, result.LtiID)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			asst = &Assignment{
+				CourseID:     courseID,
+				ProblemSetID: version.ID,
+				UserID:       user.UserID,
+				Roles:        roles,
+				Instructor:   user.Instructor || user.TA,
+				RawScores:    map[string][]float64{},
+				LtiID:        result.LtiID,
+				CanvasTitle:  bulk.Title,
+				UnlockAt:     bulk.UnlockAt,
+				DueAt:        bulk.DueAt,
+				LockAt:       bulk.LockAt,
+				CreatedAt:    now,
+				UpdatedAt:    now,
+			}
+			if err := meddler.Insert(tx, "assignments", asst); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			result.Created++
+
+		case err != nil:
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+
+		case asst.CanvasTitle == bulk.Title && sameTime(asst.UnlockAt, bulk.UnlockAt) &&
+			sameTime(asst.DueAt, bulk.DueAt) && sameTime(asst.LockAt, bulk.LockAt):
+			result.Unchanged++
+
+		default:
+			dueChanged := !sameTime(asst.DueAt, bulk.DueAt)
+			asst.CanvasTitle = bulk.Title
+			asst.UnlockAt = bulk.UnlockAt
+			asst.DueAt = bulk.DueAt
+			asst.LockAt = bulk.LockAt
+			asst.UpdatedAt = now
+			if err := meddler.Update(tx, "assignments", asst); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			if dueChanged {
+				if err := rescoreAfterDueChange(tx, asst, now); err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+					return
+				}
+			}
+			result.Updated++
+		}
+		result.Assignments = append(result.Assignments, asst)
+	}
+
+	log.Printf("user %d (%s) assigned problem set %d (%s) in course %d: %d created, %d updated, %d unchanged",
+		currentUser.ID, currentUser.Email, problemSet.ID, problemSet.Unique, courseID, result.Created, result.Updated, result.Unchanged)
+	render.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// CanaryMetrics compares how students are doing on the current and candidate
+// versions of a problem set since the canary started.
+type CanaryMetrics struct {
+	Canary    *ProblemSetCanary     `json:"canary"`
+	Current   *CanaryVersionMetrics `json:"current"`
+	Candidate *CanaryVersionMetrics `json:"candidate"`
+}
+
+// CanaryVersionMetrics summarizes student assignments on one version of a problem set.
+type CanaryVersionMetrics struct {
+	ProblemSetID  int64   `json:"problemSetID"`
+	Assignments   int64   `json:"assignments"`
+	Completed     int64   `json:"completed"`
+	AverageScore  float64 `json:"averageScore"`
+	GradedCommits int64   `json:"gradedCommits"`
+	PassedCommits int64   `json:"passedCommits"`
+	PassRate      float64 `json:"passRate"`
+}
+
+// canaryProblemSet decides which version of a problem set a launch should get.
+// Assignments that already exist keep the version they started with;
+// new assignments get the candidate if the canary has been promoted,
+// if the user is a student in one of the canary sections, or if the user falls
+// within the canary percentage.
+func canaryProblemSet(tx *sql.Tx, problemSet *ProblemSet, course *Course, user *User, ltiID string) (*ProblemSet, error) {
+	canary := new(ProblemSetCanary)
+	if err := meddler.QueryRow(tx, canary, `SELECT * FROM problem_set_canaries WHERE problem_set_id = ?`, problemSet.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return problemSet, nil
+		}
+		return nil, err
+	}
+
+	useCandidate := false
+	var existing int64
+	err := tx.QueryRow(`SELECT problem_set_id FROM assignments WHERE course_id = ? AND lti_id = ? AND user_id = ?`,
+		course.ID, ltiID, user.ID).Scan(&existing)
+	switch {
+	case err != nil && err != sql.ErrNoRows:
+		return nil, err
+	case err == nil:
+		useCandidate = existing == canary.CandidateProblemSetID
+	case canary.Promoted:
+		useCandidate = true
+	default:
+		for _, id := range canary.SectionIDs {
+			var count int
+			if err := tx.QueryRow(`SELECT COUNT(1) FROM section_members JOIN sections ON section_members.section_id = sections.id `+
+				`WHERE sections.id = ? AND sections.course_id = ? AND section_members.user_id = ? AND section_members.role = 'student'`,
+				id, course.ID, user.ID).Scan(&count); err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				useCandidate = true
+			}
+		}
+
+		// bucket users consistently so a relaunch always lands in the same place
+		h := fnv.New32a()
+		h.Write([]byte(strconv.FormatInt(canary.ID, 10) + ":" + strconv.FormatInt(user.ID, 10)))
+		if int64(h.Sum32()%100) < canary.Percent {
+			useCandidate = true
+		}
+	}
+	if !useCandidate {
+		return problemSet, nil
+	}
+
+	candidate := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", candidate, canary.CandidateProblemSetID); err != nil {
+		return nil, err
+	}
+	if err == sql.ErrNoRows {
+		log.Printf("canary %d: new assignment for user %d (%s) gets problem set %s instead of %s",
+			canary.ID, user.ID, user.Email, candidate.Unique, problemSet.Unique)
+	}
+	return candidate, nil
+}
+
+// GetProblemSetCanaries handles requests to /problem_set_canaries,
+// returning a list of all canaries.
+func GetProblemSetCanaries(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	canaries := []*ProblemSetCanary{}
+	if err := meddler.QueryAll(tx, &canaries, `SELECT * FROM problem_set_canaries ORDER BY id`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, canaries)
+}
+
+// PostProblemSetCanary handles requests to /problem_set_canaries,
+// starting a canary for a problem set or updating the existing one.
+func PostProblemSetCanary(w http.ResponseWriter, tx *sql.Tx, canary ProblemSetCanary, render render.Render) {
+	now := time.Now()
+
+	if canary.ProblemSetID == canary.CandidateProblemSetID {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "candidate problem set must be different from the current problem set")
+		return
+	}
+	if canary.Percent < 0 || canary.Percent > 100 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "canary percent must be between 0 and 100, not %d", canary.Percent)
+		return
+	}
+	for _, id := range []int64{canary.ProblemSetID, canary.CandidateProblemSetID} {
+		set := new(ProblemSet)
+		if err := meddler.Load(tx, "problem_sets", set, id); err != nil {
+			if err == sql.ErrNoRows {
+				loggedHTTPErrorf(w, http.StatusBadRequest, "problem set %d not found", id)
+				return
+			}
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	if canary.SectionIDs == nil {
+		canary.SectionIDs = []int64{}
+	}
+	for _, id := range canary.SectionIDs {
+		section := new(Section)
+		if err := meddler.Load(tx, "sections", section, id); err != nil {
+			if err == sql.ErrNoRows {
+				loggedHTTPErrorf(w, http.StatusBadRequest, "section %d not found", id)
+				return
+			}
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	old := new(ProblemSetCanary)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM problem_set_canaries WHERE problem_set_id = ?`, canary.ProblemSetID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		canary.ID = 0
+		canary.CreatedAt = now
+	} else {
+		canary.ID = old.ID
+		canary.CreatedAt = old.CreatedAt
+	}
+	canary.Promoted = false
+	canary.UpdatedAt = now
+
+	if err := meddler.Save(tx, "problem_set_canaries", &canary); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &canary)
+}
+
+// GetProblemSetCanaryMetrics handles requests to /problem_set_canaries/:canary_id/metrics,
+// comparing scores and pass rates of assignments started since the canary was created.
+func GetProblemSetCanaryMetrics(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	canaryID, err := parseID(w, "canary_id", params["canary_id"])
+	if err != nil {
+		return
+	}
+
+	canary := new(ProblemSetCanary)
+	if err := meddler.Load(tx, "problem_set_canaries", canary, canaryID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	metrics := &CanaryMetrics{Canary: canary}
+	for _, elt := range []struct {
+		id  int64
+		out **CanaryVersionMetrics
+	}{
+		{canary.ProblemSetID, &metrics.Current},
+		{canary.CandidateProblemSetID, &metrics.Candidate},
+	} {
+		m := &CanaryVersionMetrics{ProblemSetID: elt.id}
+		if err := tx.QueryRow(`SELECT COUNT(1), COALESCE(SUM(score >= 1.0), 0), COALESCE(AVG(score), 0.0) `+
+			`FROM assignments WHERE problem_set_id = ? AND NOT instructor AND created_at >= ?`,
+			elt.id, canary.CreatedAt).Scan(&m.Assignments, &m.Completed, &m.AverageScore); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := tx.QueryRow(`SELECT COUNT(1), COALESCE(SUM(commits.score >= 1.0), 0) `+
+			`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+			`WHERE assignments.problem_set_id = ? AND NOT assignments.instructor AND assignments.created_at >= ? `+
+			`AND commits.action = 'grade'`,
+			elt.id, canary.CreatedAt).Scan(&m.GradedCommits, &m.PassedCommits); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if m.GradedCommits > 0 {
+			m.PassRate = float64(m.PassedCommits) / float64(m.GradedCommits)
+		}
+		*elt.out = m
+	}
+
+	render.JSON(http.StatusOK, metrics)
+}
+
+// PostProblemSetCanaryPromote handles requests to /problem_set_canaries/:canary_id/promote,
+// sending every new launch to the candidate problem set.
+// Assignments already started on the current version are left alone.
+func PostProblemSetCanaryPromote(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	canaryID, err := parseID(w, "canary_id", params["canary_id"])
+	if err != nil {
+		return
+	}
+
+	canary := new(ProblemSetCanary)
+	if err := meddler.Load(tx, "problem_set_canaries", canary, canaryID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	canary.Promoted = true
+	canary.Percent = 100
+	canary.UpdatedAt = time.Now()
+	if err := meddler.Save(tx, "problem_set_canaries", canary); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, canary)
+}
+
+// DeleteProblemSetCanary handles requests to /problem_set_canaries/:canary_id,
+// ending a canary. New launches go back to the current problem set.
+func DeleteProblemSetCanary(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+	canaryID, err := parseID(w, "canary_id", params["canary_id"])
+	if err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM problem_set_canaries WHERE id = ?`, canaryID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	"github.com/russross/meddler"
+)
+
+// Clients that submit commits, as recorded on each commit.
+const (
+	clientWeb     = "web"
+	clientGrind   = "grind"
+	clientThonny  = "thonny"
+	clientUnknown = "unknown"
+)
+
+// clientVersionWindow is how far back the client version report looks by default.
+const clientVersionWindow = 30 * 24 * time.Hour
+
+// parseClient works out which client submitted a request from its User-Agent.
+// grind sends "grind/<version>", and editor plugins send "<name>/<version>" the same way.
+// Browsers are all reported as the web client. grind releases that predate the
+// User-Agent only identify as Go's HTTP client, so their version is unknown.
+func parseClient(userAgent string) (client, version string) {
+	userAgent = strings.TrimSpace(userAgent)
+	switch {
+	case userAgent == "":
+		return clientUnknown, ""
+	case strings.HasPrefix(userAgent, "Mozilla/"):
+		return clientWeb, ""
+	case strings.HasPrefix(userAgent, "Go-http-client/"):
+		return clientGrind, ""
+	}
+
+	// the first product token names the client
+	product := strings.Fields(userAgent)[0]
+	name, version, _ := strings.Cut(product, "/")
+	name = strings.ToLower(name)
+	switch {
+	case name == "grind":
+		client = clientGrind
+	case strings.Contains(name, "thonny"):
+		client = clientThonny
+	default:
+		client = name
+	}
+	if len(client) > 64 {
+		client = client[:64]
+	}
+	if len(version) > 32 {
+		version = version[:32]
+	}
+	return client, version
+}
+
+// ClientVersion counts the commits and users seen from one version of a client.
+type ClientVersion struct {
+	Client   string    `json:"client" meddler:"client"`
+	Version  string    `json:"version" meddler:"client_version"`
+	Commits  int64     `json:"commits" meddler:"commits"`
+	Users    int64     `json:"users" meddler:"users"`
+	LastSeen time.Time `json:"lastSeen" meddler:"-"`
+}
+
+// GetClientVersions handles requests to /client_versions,
+// returning how many commits and users each client version accounted for
+// since the given time (RFC 3339, default 30 days ago), most used first.
+func GetClientVersions(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	since := time.Now().Add(-clientVersionWindow)
+	if s := r.FormValue("since"); s != "" {
+		when, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing since: %v", err)
+			return
+		}
+		since = when.Local()
+	}
+
+	versions := []*ClientVersion{}
+	if err := meddler.QueryAll(tx, &versions, `SELECT COALESCE(commits.client, ?) AS client, COALESCE(commits.client_version, '') AS client_version, `+
+		`COUNT(1) AS commits, COUNT(DISTINCT assignments.user_id) AS users `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`WHERE commits.updated_at >= ? `+
+		`GROUP BY 1, 2 ORDER BY commits DESC, client, client_version`, clientUnknown, since); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// sqlite loses the column type of MAX(updated_at), so look each one up
+	for _, elt := range versions {
+		if err := tx.QueryRow(`SELECT updated_at FROM commits WHERE COALESCE(client, ?) = ? AND COALESCE(client_version, '') = ? `+
+			`ORDER BY updated_at DESC LIMIT 1`, clientUnknown, elt.Client, elt.Version).Scan(&elt.LastSeen); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	render.JSON(http.StatusOK, versions)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// CommitChainReport is the result of verifying the commit hash chain for an assignment.
+type CommitChainReport struct {
+	AssignmentID int64    `json:"assignmentID"`
+	Links        int      `json:"links"`
+	Commits      int      `json:"commits"`
+	Valid        bool     `json:"valid"`
+	Problems     []string `json:"problems,omitempty"`
+}
+
+// recordCommitHash appends a link to the hash chain for the commit's assignment.
+// It must be called after the commit has been saved so the commit ID is known.
+func recordCommitHash(tx *sql.Tx, commit *Commit, now time.Time) error {
+	previous := ""
+	err := tx.QueryRow(`SELECT hash FROM commit_hashes WHERE assignment_id = ? ORDER BY id DESC LIMIT 1`, commit.AssignmentID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	link := &CommitHash{
+		AssignmentID: commit.AssignmentID,
+		CommitID:     commit.ID,
+		ProblemID:    commit.ProblemID,
+		Step:         commit.Step,
+		Hash:         commit.ComputeHash(previous),
+		PreviousHash: previous,
+		CreatedAt:    now,
+	}
+	return meddler.Insert(tx, "commit_hashes", link)
+}
+
+// GetAssignmentCommitChain handles requests to /assignments/:assignment_id/commit_chain,
+// verifying that the hash chain for the assignment is intact and that the current
+// version of every commit matches the most recent link recorded for it.
+func GetAssignmentCommitChain(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if currentUser.Admin {
+		err = meddler.Load(tx, "assignments", assignment, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	links := []*CommitHash{}
+	if err := meddler.QueryAll(tx, &links, `SELECT * FROM commit_hashes WHERE assignment_id = ? ORDER BY id`, assignment.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	commits := []*Commit{}
+	if err := meddler.QueryAll(tx, &commits, `SELECT * FROM commits WHERE assignment_id = ? ORDER BY id`, assignment.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadCommitBlobs(commits...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	report := &CommitChainReport{
+		AssignmentID: assignment.ID,
+		Links:        len(links),
+		Commits:      len(commits),
+	}
+
+	// walk the chain, making sure each link points at the one before it
+	latest := make(map[int64]*CommitHash)
+	previous := ""
+	for _, link := range links {
+		if link.PreviousHash != previous {
+			report.Problems = append(report.Problems,
+				fmt.Sprintf("link %d for commit %d does not follow the link before it", link.ID, link.CommitID))
+		}
+		previous = link.Hash
+		latest[link.CommitID] = link
+	}
+
+	// check the current contents of each commit against its most recent link
+	for _, commit := range commits {
+		link := latest[commit.ID]
+		if link == nil {
+			report.Problems = append(report.Problems,
+				fmt.Sprintf("commit %d (problem %d step %d) has no recorded hash", commit.ID, commit.ProblemID, commit.Step))
+			continue
+		}
+		if commit.ComputeHash(link.PreviousHash) != link.Hash {
+			report.Problems = append(report.Problems,
+				fmt.Sprintf("commit %d (problem %d step %d) does not match its recorded hash", commit.ID, commit.ProblemID, commit.Step))
+		}
+	}
+	report.Valid = len(report.Problems) == 0
+
+	render.JSON(http.StatusOK, report)
+}
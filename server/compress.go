@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// minCompressSize is the smallest response worth compressing, when the size is known up front.
+const minCompressSize = 1024
+
+// precompressedTypes are content types that gain nothing from being compressed again.
+var precompressedTypes = []string{
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"font/woff",
+	"font/woff2",
+}
+
+// compressEncodings are the content codings offered, most preferred first.
+var compressEncodings = []string{"br", "gzip"}
+
+// chooseEncoding picks the content coding for a response from the client's
+// Accept-Encoding header, or returns "" to send it uncompressed. An entry
+// naming a coding overrides "*", and q=0 refuses a coding.
+func chooseEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64)
+	for _, elt := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(elt), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if n, err := strconv.ParseFloat(q, 64); err == nil {
+				weight = n
+			}
+		}
+		weights[coding] = weight
+	}
+	best, bestWeight := "", 0.0
+	for _, coding := range compressEncodings {
+		weight, ok := weights[coding]
+		if !ok {
+			weight = weights["*"]
+		}
+		if weight > bestWeight {
+			best, bestWeight = coding, weight
+		}
+	}
+	return best
+}
+
+// compressor is the part of gzip.Writer and brotliWriter a response needs.
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// compressResponseWriter compresses a response unless, once the headers are
+// final, it turns out to be small, empty, or already compressed.
+type compressResponseWriter struct {
+	martini.ResponseWriter
+	encoding string
+	cw       compressor
+	decided  bool
+}
+
+func (w *compressResponseWriter) decide(status int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	h := w.Header()
+	if status == http.StatusNoContent || status == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n < minCompressSize {
+		return
+	}
+	contentType := strings.ToLower(h.Get("Content-Type"))
+	for _, elt := range precompressedTypes {
+		if strings.HasPrefix(contentType, elt) {
+			return
+		}
+	}
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	if w.encoding == "br" {
+		w.cw = newBrotliWriter(w.ResponseWriter)
+	} else {
+		w.cw = gzip.NewWriter(w.ResponseWriter)
+	}
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	w.decide(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.cw != nil {
+		return w.cw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressResponseWriter) Flush() {
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// compressResponses returns martini middleware that compresses responses
+// with brotli or gzip for clients that accept them.
+func compressResponses() martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" {
+			return
+		}
+		encoding := chooseEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			return
+		}
+		crw := &compressResponseWriter{ResponseWriter: w.(martini.ResponseWriter), encoding: encoding}
+		c.MapTo(crw, (*http.ResponseWriter)(nil))
+		c.Next()
+		if crw.cw != nil {
+			crw.cw.Close()
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestChooseEncoding(t *testing.T) {
+	cases := []struct {
+		accept, want string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0", ""},
+		{"*;q=0, gzip", "gzip"},
+		{"gzip, *;q=0", "gzip"},
+		{"GZIP;q=0.8, *;q=0.1", "gzip"},
+		{"br;q=0, *", "gzip"},
+	}
+	for _, c := range cases {
+		if got := chooseEncoding(c.accept); got != c.want {
+			t.Errorf("chooseEncoding(%q) = %q, want %q", c.accept, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// csrfCookieName holds a copy of the CSRF token that scripts on our pages can read
+	// and send back in the csrfHeader.
+	csrfCookieName = "codegrinder_csrf"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// csrfToken returns the token a browser must send with requests that change anything.
+// It is derived from the session, so it changes whenever the student logs in again.
+func csrfToken(session *CookieSession) string {
+	mac := hmac.New(sha256.New, []byte(Config.SessionSecret))
+	mac.Write([]byte("csrf\n"))
+	mac.Write([]byte(strconv.FormatInt(session.UserID, 10) + "\n"))
+	mac.Write([]byte(session.ExpiresAt.UTC().Format(time.RFC3339Nano)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// fromBrowser reports whether a request came from a web browser. Browsers send
+// Origin with requests that change anything, and newer ones add Sec-Fetch-Site to
+// every request. Other clients send neither.
+func fromBrowser(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != ""
+}
+
+// rejectCSRF turns away a request that would change something using a session
+// the browser supplied on its own, unless it includes the CSRF token.
+// Sessions given in the Authorization header, as grind does, cannot be forged
+// by another site and are not checked. Neither are requests that do not come
+// from a browser, so older clients that send the session as a cookie keep working.
+// It reports whether the request was rejected.
+func rejectCSRF(w http.ResponseWriter, r *http.Request, session *CookieSession) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" || session.fromHeader || !fromBrowser(r) {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" || !hmac.Equal([]byte(token), []byte(csrfToken(session))) {
+		loggedHTTPErrorf(w, http.StatusForbidden, "missing or invalid %s header", csrfHeader)
+		return true
+	}
+	return false
+}
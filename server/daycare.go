@@ -6,24 +6,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"os"
 	"os/exec"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-martini/martini"
 	"github.com/gorilla/websocket"
+	"github.com/russross/codegrinder/sdk"
 	. "github.com/russross/codegrinder/types"
 )
 
 // containerEngine defines the command-line executable to use for container management.
 const containerEngine = "docker"
 
-// studentUID defines the static user and group ID to be used inside containers.
-const studentUID = 1001
-
 type limits struct {
 	maxCPU      int64
 	maxSession  int64
@@ -32,6 +34,9 @@ type limits struct {
 	maxFileSize int64
 	maxMemory   int64
 	maxThreads  int64
+
+	// cpuset lists the cores the container is pinned to, if any
+	cpuset string
 }
 
 func newLimits(t *ProblemTypeAction) *limits {
@@ -75,7 +80,15 @@ func (l *limits) override(options []string) {
 	}
 }
 
-var containerLimiter chan struct{}
+// socketUpgrader accepts grading sockets. Clients that offer permessage-deflate get it,
+// which shrinks the event streams and report cards considerably.
+// Sockets are authorized by the ticket, not the origin, so any origin is accepted.
+var socketUpgrader = websocket.Upgrader{
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+	CheckOrigin:       func(r *http.Request) bool { return true },
+}
 
 // SocketProblemTypeAction handles a request to /sockets/:problem_type/:action
 // It expects a websocket connection, which will receive a series of DaycareRequest objects
@@ -88,19 +101,34 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	// CORS header for browser-based requests if the TA is a different host than the daycare
 	w.Header().Set("Access-Control-Allow-Origin", "https://"+Config.TAHostname)
 
+	// only accept connections the TA has issued a ticket for
+	ticket, err := parseSocketTicket(r.FormValue("ticket"), now)
+	if err == nil {
+		err = ticket.check(params["problem_type"], params["action"])
+	}
+	if err == nil && !usedTickets.claim(ticket, now) {
+		err = fmt.Errorf("ticket has already been used")
+	}
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusForbidden, "grading socket refused: %v", err)
+		return
+	}
+
 	// get a websocket
-	socket, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	socket, err := socketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "websocket error: %v", err)
+		// the upgrader has already sent an error response
+		loggedErrorf("websocket error: %v", err)
 		return
 	}
 	defer func() {
 		socket.WriteControl(websocket.CloseMessage, nil, time.Now().Add(5*time.Second))
 		socket.Close()
 	}()
+	var job *jobLog
 	logAndTransmitErrorf := func(format string, args ...interface{}) {
 		msg := fmt.Sprintf(format, args...)
-		log.Print(msg)
+		job.logf("%s", msg)
 		res := &DaycareResponse{Error: msg}
 		if err := socket.WriteJSON(res); err != nil {
 			// what can we do? we already logged the error
@@ -113,6 +141,7 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		logAndTransmitErrorf("error reading first request message: %v", err)
 		return
 	}
+	client := watchClient(socket)
 
 	// sanity check
 	if req.CommitBundle == nil {
@@ -173,6 +202,9 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	r.ParseForm()
 	args := []string{}
 	for key, vals := range r.Form {
+		if key == "ticket" {
+			continue
+		}
 		if len(vals) == 1 {
 			args = append(args, key+"="+vals[0])
 		}
@@ -202,12 +234,26 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	}
 	req.CommitBundle.CommitSignature = ""
 
+	// keep a log of this job for the TA
+	job = newJobLog(commit, problemType.Name, params["action"])
+	defer job.report()
+
 	// host must match
 	if req.CommitBundle.Hostname != Config.Hostname {
 		logAndTransmitErrorf("commit is signed for host %s, this is %s", req.CommitBundle.Hostname, Config.Hostname)
 		return
 	}
 
+	// the commit must be the one the socket was opened for
+	if err := ticket.checkBundle(req.CommitBundle); err != nil {
+		logAndTransmitErrorf("%v", err)
+		return
+	}
+	if problemType.OS != Config.OS {
+		logAndTransmitErrorf("problem type %s needs %s containers, but this daycare runs %s containers", problemType.Name, problemType.OS, Config.OS)
+		return
+	}
+
 	// commit must be recent
 	age := time.Since(commit.UpdatedAt)
 	if age < 0 {
@@ -238,37 +284,116 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		return
 	}
 	if step.ProblemType != problemType.Name {
-		logAndTransmitErrorf("step number %d in the problem has problem type %q but the commit bundle included problem type %q", step.ProblemType, problemType)
+		logAndTransmitErrorf("step number %d in the problem has problem type %q but the commit bundle included problem type %q", step.Step, step.ProblemType, problemType.Name)
 		return
 	}
 
 	// collect the files from the problem step, commit, and problem type
 	files := make(map[string][]byte)
+	instructorFiles := make(map[string][]byte)
 	for name, contents := range step.Files {
 		files[name] = contents
+		instructorFiles[name] = contents
 	}
 	for name, contents := range commit.Files {
 		files[name] = contents
 	}
 	for name, contents := range req.CommitBundle.ProblemType.Files {
 		files[name] = contents
+		instructorFiles[name] = contents
 	}
 
-	// limit the number of concurrent containers
-	containerLimiter <- struct{}{}
-	defer func() {
-		<-containerLimiter
-	}()
+	submitted := submittedFiles(files, instructorFiles)
+
+	// refuse new work while the container engine is down
+	if !engine.Healthy() {
+		logAndTransmitErrorf("the grader on %s is restarting; please try again in a minute", Config.Hostname)
+		return
+	}
+
+	// get any secrets the grader needs from the TA
+	secrets, err := fetchProblemSecrets(problemType.Name, problem.ID)
+	if err != nil {
+		logAndTransmitErrorf("error fetching problem secrets: %v", err)
+		return
+	}
+
+	// wait for a free slot, which limits the number of concurrent containers,
+	// and keep the student posted so they do not give up and try again
+	slot, release := jobQueue.acquire(problemType.Name, step.Diagnostic, func(position int, wait time.Duration) bool {
+		event := &EventMessage{
+			Time:          time.Now(),
+			Event:         "queued",
+			QueuePosition: position,
+			QueueSeconds:  int64(wait.Round(time.Second).Seconds()),
+		}
+		return socket.WriteJSON(&DaycareResponse{Event: event}) == nil
+	})
+	if slot == nil {
+		job.logf("client went away while waiting for a container slot")
+		return
+	}
+	defer release()
 
 	// launch a nanny process
 	nannyName := fmt.Sprintf("nanny-%d", req.CommitBundle.UserID)
 	limits := newLimits(action)
-	limits.override(problem.Options)
-	n, err := NewNanny(req.CommitBundle.ProblemType, problem, action.Action, args, limits, nannyName)
+	if action.Action != "shell" {
+		// an instructor's shell keeps its own time limit
+		limits.override(problem.Options)
+	}
+	generation := engine.Generation()
+	n, err := NewNanny(req.CommitBundle.ProblemType, problem, action.Action, args, limits.inSlot(slot), nannyName)
 	if err != nil {
 		logAndTransmitErrorf("error creating container: %v", err)
 		return
 	}
+	redactions := newRedactions(secrets, n.home(), problem, instructorFiles)
+	seed := rand.Int63()
+	n.Secrets = secrets
+	n.Env = gradingEnv(seed)
+	n.Redactions = redactions
+	n.Job = job
+	if action.Interactive {
+		n.Stdin = client.stdin
+	}
+
+	// note everything needed to run this job again later
+	var record *GradingRecord
+	if commit.Action == "grade" {
+		record = newGradingRecord(req.CommitBundle, action, args, limits.inSlot(slot), seed, secrets, files, instructorFiles)
+	}
+
+	// list the job for administrators while it runs
+	session := &GradingSession{
+		Hostname:     Config.Hostname,
+		Name:         nannyName,
+		UserID:       req.CommitBundle.UserID,
+		AssignmentID: commit.AssignmentID,
+		ProblemID:    commit.ProblemID,
+		Unique:       problem.Unique,
+		Step:         commit.Step,
+		ProblemType:  problemType.Name,
+		Action:       action.Action,
+		StartedAt:    n.Start,
+	}
+	activeSessions.setNanny(session, n)
+	activeSessions.add(session)
+	defer activeSessions.remove(session)
+
+	// nobody is waiting for anything but a grade once the client is gone
+	if commit.Action != "grade" {
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		go stopAbandoned(client, session, stopWatching)
+	}
+	stopTripwires := make(chan struct{})
+	defer close(stopTripwires)
+	go watchTripwires(session, stopTripwires)
+	job.event("created", "container %s (%s) from image %s", nannyName, n.ID, problemType.Image)
+	job.event("limits", "slot=%d, cpuset=%q, cpu=%d, fd=%d, file=%d, mem=%d, threads=%d",
+		slot.index, slot.cpuset, limits.maxCPU, limits.maxFD, limits.maxFileSize, limits.inSlot(slot).maxMemory, limits.maxThreads)
+	events := n.Events
 
 	// shutdown the container when finished
 	defer func() {
@@ -281,7 +406,7 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	eventListenerClosed := make(chan struct{})
 	go func() {
 		count, overflow, discarded := 0, 0, 0
-		for event := range n.Events {
+		for event := range events {
 			if count > TranscriptDataLimit {
 				overflow += len(event.StreamData)
 			} else {
@@ -335,38 +460,66 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		eventListenerClosed <- struct{}{}
 	}()
 
-	// copy the files to the container
-	if err = n.PutFiles(files, 0666); err != nil {
-		n.ReportCard.LogAndFailf("uploading files: %v", err)
-		return
-	}
-
-	// run the action
-	cmd := strings.Fields(action.Command)
-	switch {
-	case action.Parser == "xunit":
-		runAndParseXUnit(n, cmd)
-
-	case action.Parser == "check":
-		runAndParseCheckXML(n, cmd)
-
-	case action.Parser != "":
-		n.ReportCard.LogAndFailf("unknown parser %q for problem type %s action %s",
-			action.Parser, action.ProblemType, action.Action)
-		return
+	// copy the files to the container and run the action,
+	// starting over in a new container if a container engine restart killed this one
+	for attempt := 1; ; attempt++ {
+		ok := false
+		if action.Action != "shell" && checkBannedUses(n, problem, submitted) {
+			job.logf("submission uses banned names, skipping %s", action.Action)
+			ok = true
+		} else if err = n.PutFiles(files, 0666); err != nil {
+			n.ReportCard.LogAndFailf("uploading files: %v", err)
+		} else if action.Action != "shell" && checkRequirements(n, problem, submitted) {
+			job.logf("submission is missing required constructs, skipping %s", action.Action)
+			ok = true
+		} else {
+			job.event("started", "running %s (attempt %d)", action.Command, attempt)
+			ok = runAction(n, action)
+		}
+		if reason := n.WasKilled(); reason != "" {
+			logAndTransmitErrorf("%s was %s; please try again", action.Action, reason)
+			return
+		}
+		lost := engine.Generation() != generation
+		if !lost && (!ok || !n.ReportCard.Passed) {
+			// the failure may be the daemon going away, so check now
+			lost = engine.LostSince(generation)
+		}
+		if !lost || attempt > maxEngineRetries {
+			if !ok {
+				return
+			}
+			break
+		}
 
-	default:
-		_, _, _, status, err := n.Exec(cmd)
-		if err != nil {
-			n.ReportCard.LogAndFailf("%q exec error: %v", strings.Join(cmd, " "), err)
+		job.event("killed", "container %s was lost when the container engine restarted", nannyName)
+		job.logf("starting over in a new container")
+		events <- &EventMessage{Time: time.Now(), Event: "error", Error: "the grader restarted while running your code; starting over"}
+		n.Shutdown("container engine restarted")
+		if !engine.WaitHealthy(engineRecoveryTimeout) {
+			logAndTransmitErrorf("the grader on %s did not come back in time; please try again later", Config.Hostname)
+			return
 		}
-		if status != 0 {
-			err := fmt.Errorf("%q failed with exit status %d", strings.Join(cmd, " "), status)
-			n.ReportCard.LogAndFailf("%v", err)
+		generation = engine.Generation()
+		next, err := NewNanny(req.CommitBundle.ProblemType, problem, action.Action, args, limits.inSlot(slot), nannyName)
+		if err != nil {
+			logAndTransmitErrorf("error creating container: %v", err)
+			return
 		}
+		next.Secrets = secrets
+		next.Env = n.Env
+		next.Stdin = n.Stdin
+		next.Redactions = redactions
+		next.Events = events
+		next.Job = job
+		activeSessions.setNanny(session, next)
+		job.event("created", "container %s (%s) from image %s", nannyName, next.ID, problemType.Image)
+		n = next
 	}
+	reportUsage(n, commit, problemType.Name, action.Action)
 
 	commit.ReportCard = n.ReportCard
+	redactions.reportCard(commit.ReportCard)
 
 	// download any files?
 	for _, option := range problem.Options {
@@ -376,63 +529,117 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		}
 		files, err := n.GetFiles(strings.Split(parts[1], ","))
 		if err != nil {
-			log.Printf("error trying to download files from container: %v", err)
+			job.logf("error trying to download files from container: %v", err)
 		} else if len(files) > 0 {
 			n.Events <- &EventMessage{Event: "files", Files: files}
 		}
 	}
 
 	// wait for listener to finish
-	close(n.Events)
+	close(events)
 	<-eventListenerClosed
+	redactions.transcript(commit.Transcript)
 
 	// send the final commit back to the client
 	if commit.Action == "grade" {
-		// compute the score for this step on a scale of 0.0 to 1.0
-		if commit.ReportCard.Passed {
-			// award full credit for this step
-			commit.Score = 1.0
-		} else if len(commit.ReportCard.Results) == 0 {
-			// no results? fail...
-			commit.Score = 0.0
-		} else {
-			// compute partial credit for this step
-			passed := 0
-			for _, elt := range commit.ReportCard.Results {
-				if elt.Outcome == "passed" {
-					passed++
-				}
-			}
-			commit.Score = float64(passed) / float64(len(commit.ReportCard.Results))
-		}
+		commit.Score = sdk.Score(commit.ReportCard, step.Tests)
 		commit.UpdatedAt = now
+		record.report(commit.ReportCard, commit.Score)
 		req.CommitBundle.CommitSignature = commit.ComputeSignature(Config.DaycareSecret, req.CommitBundle.ProblemTypeSignature, req.CommitBundle.ProblemSignature, req.CommitBundle.Hostname, req.CommitBundle.UserID)
+		req.CommitBundle.ReportCardSignature = commit.SignReportCard(daycareKey, req.CommitBundle.ProblemTypeSignature, req.CommitBundle.ProblemSignature, req.CommitBundle.Hostname, req.CommitBundle.UserID)
 
+		// if the student went away, save the grade for them
 		res := &DaycareResponse{CommitBundle: req.CommitBundle}
-		if err := socket.WriteJSON(res); err != nil {
-			logAndTransmitErrorf("error writing final commit JSON: %v", err)
-			return
+		if err := socket.WriteJSON(res); err != nil || client.abandoned(time.Now()) {
+			job.logf("client for %s went away, saving the graded commit with the TA", nannyName)
+			saveAbandonedGrade(req.CommitBundle)
+			if err != nil {
+				return
+			}
+		}
+
+		// grade it again with the candidate image (if any) after the student has their result
+		if image := Config.ShadowImages[problemType.Name]; image != "" {
+			go shadowGrade(req.CommitBundle, image, files, submitted, secrets, action, args, limits)
 		}
 	}
-	log.Printf("handler for %s finished", nannyName)
+	job.logf("handler for %s finished", nannyName)
+}
+
+// runAction runs the command for an action in the container and parses the results
+// into the nanny's ReportCard. It returns false if the action could not be run at all.
+func runAction(n *Nanny, action *ProblemTypeAction) bool {
+	cmd := strings.Fields(action.Command)
+	switch {
+	case action.Parser == "xunit":
+		runAndParseXUnit(n, cmd)
+
+	case action.Parser == "check":
+		runAndParseCheckXML(n, cmd)
+
+	case action.Parser == "inout":
+		runAndDiffInOut(n, action.Command)
+
+	case action.Parser != "":
+		n.ReportCard.LogAndFailf("unknown parser %q for problem type %s action %s",
+			action.Parser, action.ProblemType, action.Action)
+		return false
+
+	default:
+		_, _, _, status, err := n.Exec(cmd)
+		if err != nil {
+			n.ReportCard.LogAndFailf("%q exec error: %v", strings.Join(cmd, " "), err)
+		}
+		if status != 0 {
+			err := fmt.Errorf("%q failed with exit status %d", strings.Join(cmd, " "), status)
+			n.ReportCard.LogAndFailf("%v", err)
+		}
+	}
+	return true
 }
 
 type Nanny struct {
 	Name       string
 	Start      time.Time
+	Deadline   time.Time
 	ID         string
 	ReportCard *ReportCard
 	Input      chan string
 	Events     chan *EventMessage
 	Transcript []*EventMessage
 	Closed     bool
+	Killed     string
 	Files      map[string][]byte
+
+	// Uploaded holds the files most recently copied into the container
+	Uploaded map[string][]byte
+
+	// closing guards Closed and Killed, since the container can be killed at any time
+	closing sync.Mutex
+
+	// OS is the operating system the container runs
+	OS string
+
+	// Secrets are environment variables set for every command run in the container.
+	Secrets map[string]string
+
+	// Env holds other environment variables for every command, such as the job's seed.
+	Env map[string]string
+
+	// Stdin is relayed to commands run for an interactive action, if set
+	Stdin <-chan []byte
+
+	// Redactions are removed from all output and files taken from the container.
+	Redactions *redactions
+
+	// Job records the container's lifecycle events for the TA, if set
+	Job *jobLog
 }
 
 func NewNanny(problemType *ProblemType, problem *Problem, action string, args []string, limits *limits, name string) (*Nanny, error) {
 	disk := limits.maxFileSize * 1024 * 1024
 	timeLimit := limits.maxCPU * 2
-	userAndGroup := fmt.Sprintf("%d:%d", studentUID, studentUID)
+	userAndGroup := fmt.Sprintf("%d:%d", sdk.StudentUID, sdk.StudentUID)
 	memStr := fmt.Sprintf("%dm", limits.maxMemory)
 
 	// construct the 'docker run' command arguments
@@ -462,12 +669,43 @@ func NewNanny(problemType *ProblemType, problem *Problem, action string, args []
 		"--ulimit", fmt.Sprintf("fsize=%d", disk),
 	}
 
-	// main command just sleeps; this acts as a timeout mechanism for the whole container
-	cmdArgs = append(cmdArgs, problemType.Image, "/bin/sleep", strconv.FormatInt(timeLimit, 10)+"s")
+	// keep the container on the cores of its slot
+	if limits.cpuset != "" {
+		cmdArgs = append(cmdArgs, "--cpuset-cpus", limits.cpuset)
+	}
+
+	// label the container so the reaper can find it if this job crashes
+	labels := nannyLabels(name, problemType, problem, action, time.Now())
+	cmdArgs = append(cmdArgs, labels...)
+
+	// main command just sleeps; this acts as a timeout mechanism for the whole container.
+	// it outlasts the time limit so a command that runs too long can be stopped gently first
+	lifetime := timeLimit + int64((terminationGrace + 2*terminationWait).Seconds())
+	cmdArgs = append(cmdArgs, problemType.Image, "/bin/sleep", strconv.FormatInt(lifetime, 10)+"s")
+
+	if problemType.OS == "windows" {
+		// windows containers do not support the linux-specific uid, capability, and ulimit controls,
+		// so they rely on process isolation with memory and process count limits
+		cmdArgs = []string{
+			"run",
+			"-d",
+			"--name", name,
+			"--hostname", name,
+			"--user", sdk.WindowsStudentUser,
+			"--network", "none",
+			"--isolation", "process",
+			"--memory", memStr,
+		}
+		cmdArgs = append(cmdArgs, labels...)
+		cmdArgs = append(cmdArgs,
+			problemType.Image,
+			"powershell", "-NoProfile", "-Command", fmt.Sprintf("Start-Sleep -Seconds %d", lifetime),
+		)
+	}
 
-	log.Printf("new container %s; action %s on %s (%s); params cpu=%d, fd=%d, file=%d, mem=%d, threads=%d",
+	log.Printf("new container %s; action %s on %s (%s); params cpu=%d, fd=%d, file=%d, mem=%d, threads=%d, cpuset=%q",
 		name, action, problem.Unique, problemType.Name,
-		limits.maxCPU, limits.maxFD, limits.maxFileSize, limits.maxMemory, limits.maxThreads)
+		limits.maxCPU, limits.maxFD, limits.maxFileSize, limits.maxMemory, limits.maxThreads, limits.cpuset)
 
 	// execute the command.
 	cmd := exec.Command(containerEngine, cmdArgs...)
@@ -490,30 +728,77 @@ func NewNanny(problemType *ProblemType, problem *Problem, action string, args []
 	}
 
 	containerID := strings.TrimSpace(string(output))
+	activeNannies.add(containerID)
 
+	now := time.Now()
 	return &Nanny{
 		Name:       name,
-		Start:      time.Now(),
+		Start:      now,
+		Deadline:   now.Add(time.Duration(timeLimit) * time.Second),
 		ID:         containerID,
 		ReportCard: NewReportCard(),
 		Input:      make(chan string),
 		Events:     make(chan *EventMessage),
+		OS:         problemType.OS,
 	}, nil
 }
 
+// home returns the student's working directory inside the container.
+func (n *Nanny) home() string {
+	if n.OS == "windows" {
+		return sdk.WindowsStudentHome
+	}
+	return sdk.StudentHome
+}
+
+// redact removes secret values, container paths, and other redactions from data.
+func (n *Nanny) redact(data []byte) []byte {
+	return n.Redactions.apply(data)
+}
+
+// user returns the user that student commands run as inside the container.
+func (n *Nanny) user() string {
+	if n.OS == "windows" {
+		return sdk.WindowsStudentUser
+	}
+	return strconv.Itoa(sdk.StudentUID)
+}
+
 func (n *Nanny) Shutdown(msg string) error {
+	n.closing.Lock()
+	defer n.closing.Unlock()
 	if n.Closed {
 		return nil
 	}
 	n.Closed = true
+	defer activeNannies.remove(n.ID)
 
 	// shut down the container
 	if err := removeContainer(n.ID); err != nil {
+		n.Job.event("removed", "%s: %v", msg, err)
 		return fmt.Errorf("Nanny.Shutdown: %v", err)
 	}
+	n.Job.event("removed", "%s", msg)
 	return nil
 }
 
+// Kill shuts down the container of a job that is still running.
+func (n *Nanny) Kill(msg string) error {
+	n.closing.Lock()
+	if !n.Closed {
+		n.Killed = msg
+	}
+	n.closing.Unlock()
+	return n.Shutdown(msg)
+}
+
+// WasKilled returns the reason the container was shut down by Kill, if it was.
+func (n *Nanny) WasKilled() string {
+	n.closing.Lock()
+	defer n.closing.Unlock()
+	return n.Killed
+}
+
 // removeContainer forcefully stops and removes a container by its ID or name.
 func removeContainer(id string) error {
 	cmd := exec.Command(containerEngine, "rm", "-f", id)
@@ -537,18 +822,19 @@ func (n *Nanny) PutFiles(files map[string][]byte, mode int64) error {
 	writer := tar.NewWriter(buf)
 	dirs := make(map[string]bool)
 	for name, contents := range files {
-		dir := filepath.Dir(name)
+		// tar file names always use forward slashes, regardless of the host OS
+		dir := path.Dir(name)
 		if dir != "" && dir != "." && !dirs[dir] {
 			dirs[dir] = true
 			header := &tar.Header{
 				Name:       dir,
 				Mode:       0777,
-				Uid:        studentUID,
-				Gid:        studentUID,
+				Uid:        sdk.StudentUID,
+				Gid:        sdk.StudentUID,
 				ModTime:    nowish,
 				Typeflag:   tar.TypeDir,
-				Uname:      strconv.Itoa(studentUID),
-				Gname:      strconv.Itoa(studentUID),
+				Uname:      strconv.Itoa(sdk.StudentUID),
+				Gname:      strconv.Itoa(sdk.StudentUID),
 				AccessTime: nowish,
 				ChangeTime: nowish,
 			}
@@ -559,13 +845,13 @@ func (n *Nanny) PutFiles(files map[string][]byte, mode int64) error {
 		header := &tar.Header{
 			Name:       name,
 			Mode:       mode,
-			Uid:        studentUID,
-			Gid:        studentUID,
+			Uid:        sdk.StudentUID,
+			Gid:        sdk.StudentUID,
 			Size:       int64(len(contents)),
 			ModTime:    nowish,
 			Typeflag:   tar.TypeReg,
-			Uname:      strconv.Itoa(studentUID),
-			Gname:      strconv.Itoa(studentUID),
+			Uname:      strconv.Itoa(sdk.StudentUID),
+			Gname:      strconv.Itoa(sdk.StudentUID),
 			AccessTime: nowish,
 			ChangeTime: nowish,
 		}
@@ -580,14 +866,15 @@ func (n *Nanny) PutFiles(files map[string][]byte, mode int64) error {
 		return fmt.Errorf("closing tar file: %v", err)
 	}
 
-	// use 'docker cp' to copy the tarball into the /home/student directory.
+	// use 'docker cp' to copy the tarball into the student's home directory.
 	// pipe the tar buffer to the command's stdin.
-	cmd := exec.Command(containerEngine, "cp", "-", n.ID+":/home/student/")
+	cmd := exec.Command(containerEngine, "cp", "-", n.ID+":"+n.home())
 	cmd.Stdin = buf
 
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("container cp failed: %v\nOutput: %s", err, string(output))
 	}
+	n.Uploaded = files
 	return nil
 }
 
@@ -606,8 +893,8 @@ func (n *Nanny) GetFiles(filenames []string) (map[string][]byte, error) {
 			return nil, fmt.Errorf("cannot fetch files, container is closed")
 		}
 
-		// use 'docker cp' to get the /home/student directory as a tar stream
-		cmd := exec.Command(containerEngine, "cp", n.ID+":/home/student/.", "-")
+		// use 'docker cp' to get the student's home directory as a tar stream
+		cmd := exec.Command(containerEngine, "cp", n.ID+":"+n.home()+".", "-")
 		var tarFile bytes.Buffer
 		cmd.Stdout = &tarFile
 
@@ -637,8 +924,13 @@ func (n *Nanny) GetFiles(filenames []string) (map[string][]byte, error) {
 			if err != nil {
 				return nil, fmt.Errorf("error reading %q from tar file: %v", header.Name, err)
 			}
-			name := filepath.Clean(header.Name)
-			n.Files[name] = contents
+			// normalize names and line endings so files from windows containers
+			// look the same as those from linux containers
+			name := path.Clean(strings.ReplaceAll(header.Name, "\\", "/"))
+			if n.OS == "windows" && utf8.Valid(contents) {
+				contents = bytes.ReplaceAll(contents, []byte("\r\n"), []byte("\n"))
+			}
+			n.Files[name] = n.redact(contents)
 		}
 	}
 
@@ -647,7 +939,7 @@ func (n *Nanny) GetFiles(filenames []string) (map[string][]byte, error) {
 	badpattern := ""
 	for name, contents := range n.Files {
 		for _, pattern := range filenames {
-			matched, err := filepath.Match(pattern, name)
+			matched, err := path.Match(pattern, name)
 			if err != nil {
 				badpattern = pattern
 			} else if matched {
@@ -681,6 +973,70 @@ func (ew *eventWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// crlfWriter is a helper type that implements io.Writer. It converts CRLF
+// line endings to LF before passing output along. A CR at the end of one write
+// is held back until the next write shows whether it is part of a CRLF pair.
+type crlfWriter struct {
+	w         io.Writer
+	pendingCR bool
+}
+
+func (cw *crlfWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+1)
+	if cw.pendingCR && (len(p) == 0 || p[0] != '\n') {
+		buf = append(buf, '\r')
+	}
+	cw.pendingCR = false
+	for i, b := range p {
+		if b == '\r' {
+			if i+1 == len(p) {
+				cw.pendingCR = true
+				continue
+			}
+			if p[i+1] == '\n' {
+				continue
+			}
+		}
+		buf = append(buf, b)
+	}
+	if len(buf) > 0 {
+		if _, err := cw.w.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes out a CR that was held back at the end of the output.
+func (cw *crlfWriter) Flush() {
+	if cw.pendingCR {
+		cw.pendingCR = false
+		cw.w.Write([]byte{'\r'})
+	}
+}
+
+// relayStdin copies the client's input to a running command and records it,
+// until the client closes stdin or finished is closed.
+func (n *Nanny) relayStdin(pipe io.WriteCloser, finished <-chan struct{}, relayed chan<- struct{}) {
+	defer close(relayed)
+	defer pipe.Close()
+	for {
+		select {
+		case <-finished:
+			return
+		case data, ok := <-n.Stdin:
+			if !ok {
+				n.Events <- &EventMessage{Time: time.Now(), Event: "stdinclosed"}
+				return
+			}
+			n.Events <- &EventMessage{Time: time.Now(), Event: "stdin", StreamData: data}
+			if _, err := pipe.Write(data); err != nil {
+				return
+			}
+		}
+	}
+}
+
 // Exec runs a command inside the container and captures its output
 func (n *Nanny) Exec(cmd []string) (stdout, stderr, script *bytes.Buffer, status int, err error) {
 	n.Events <- &EventMessage{
@@ -690,22 +1046,102 @@ func (n *Nanny) Exec(cmd []string) (stdout, stderr, script *bytes.Buffer, status
 	}
 
 	// construct the 'docker exec' command arguments.
-	execCmdArgs := []string{"exec", "--user", strconv.Itoa(studentUID), n.ID}
+	execCmdArgs := []string{"exec", "--user", n.user()}
+	for name, value := range n.Env {
+		execCmdArgs = append(execCmdArgs, "--env", name+"="+value)
+	}
+	if n.Stdin != nil {
+		execCmdArgs = append(execCmdArgs, "--interactive")
+	}
+
+	// pass secrets by name only so their values come from the environment
+	// of the container engine command and never appear in its arguments
+	var env []string
+	for name, value := range n.Secrets {
+		execCmdArgs = append(execCmdArgs, "--env", name)
+		env = append(env, name+"="+value)
+	}
+	execCmdArgs = append(execCmdArgs, n.ID)
 	execCmdArgs = append(execCmdArgs, cmd...)
 	command := exec.Command(containerEngine, execCmdArgs...)
+	if len(env) > 0 {
+		command.Env = append(os.Environ(), env...)
+	}
 
 	// buffers to capture the full output for return.
 	var stdoutBuf, stderrBuf, scriptBuf bytes.Buffer
 
 	// create writers that send events over the channel AND write to local buffers.
-	stdoutWriter := io.MultiWriter(&stdoutBuf, &scriptBuf, &eventWriter{event: "stdout", events: n.Events})
-	stderrWriter := io.MultiWriter(&stderrBuf, &scriptBuf, &eventWriter{event: "stderr", events: n.Events})
+	var stdoutWriter, stderrWriter io.Writer
+	stdoutWriter = io.MultiWriter(&stdoutBuf, &scriptBuf, &eventWriter{event: "stdout", events: n.Events})
+	stderrWriter = io.MultiWriter(&stderrBuf, &scriptBuf, &eventWriter{event: "stderr", events: n.Events})
+	flush := func() {}
+	if n.OS == "windows" {
+		stdoutCRLF := &crlfWriter{w: stdoutWriter}
+		stderrCRLF := &crlfWriter{w: stderrWriter}
+		stdoutWriter, stderrWriter = stdoutCRLF, stderrCRLF
+		flush = func() {
+			stdoutCRLF.Flush()
+			stderrCRLF.Flush()
+		}
+	}
+	if !n.Redactions.empty() {
+		stdoutRedacter := newRedactWriter(stdoutWriter, n.Redactions)
+		stderrRedacter := newRedactWriter(stderrWriter, n.Redactions)
+		stdoutWriter, stderrWriter = stdoutRedacter, stderrRedacter
+		flushNext := flush
+		flush = func() {
+			stdoutRedacter.Flush()
+			stderrRedacter.Flush()
+			flushNext()
+		}
+	}
 
 	command.Stdout = stdoutWriter
 	command.Stderr = stderrWriter
+	var stdinPipe io.WriteCloser
+	if n.Stdin != nil {
+		if stdinPipe, err = command.StdinPipe(); err != nil {
+			return &stdoutBuf, &stderrBuf, &scriptBuf, -1, fmt.Errorf("exec command failed: %v", err)
+		}
+	}
 
-	// start the command
-	err = command.Run()
+	// start the command, stopping it if it runs past the time limit
+	if err = command.Start(); err != nil {
+		return &stdoutBuf, &stderrBuf, &scriptBuf, -1, fmt.Errorf("exec command failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+	if stdinPipe != nil {
+		finished := make(chan struct{})
+		relayed := make(chan struct{})
+		go n.relayStdin(stdinPipe, finished, relayed)
+		defer func() {
+			close(finished)
+			<-relayed
+		}()
+	}
+	timer := time.NewTimer(time.Until(n.Deadline))
+	defer timer.Stop()
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-timer.C:
+		timedOut = true
+		err = n.terminate(command, done)
+	}
+
+	// pass along any output that was held back before reporting the end of the command
+	flush()
+	if timedOut {
+		n.Events <- &EventMessage{
+			Time:  time.Now(),
+			Event: "error",
+			Error: fmt.Sprintf("%s was stopped after reaching the time limit of %v", cmd[0], n.Deadline.Sub(n.Start)),
+		}
+	}
 
 	exitCode := 0
 	if err != nil {
@@ -718,6 +1154,9 @@ func (n *Nanny) Exec(cmd []string) (stdout, stderr, script *bytes.Buffer, status
 		}
 	}
 
+	if exitCode == 128+9 && !timedOut {
+		n.Job.event("killed", "%s exited with SIGKILL, probably from a resource limit", cmd[0])
+	}
 	n.Events <- &EventMessage{
 		Time:       time.Now(),
 		Event:      "exit",
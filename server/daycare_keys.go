@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// DaycareKey is the public key a daycare signs its report cards with.
+// The TA only accepts grades from daycares whose keys an administrator has
+// registered, so knowing the shared daycare secret is not enough to post a
+// passing result.
+type DaycareKey struct {
+	Hostname  string    `json:"hostname" meddler:"hostname"`
+	PublicKey string    `json:"publicKey" meddler:"public_key"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// daycareKey is the private key this daycare signs report cards with.
+var daycareKey ed25519.PrivateKey
+
+// loadDaycareKey reads a daycare's private key, creating a new one if the file does not exist.
+// The file holds the base64-encoded key seed.
+func loadDaycareKey(filename string) (ed25519.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(key.Seed()) + "\n"
+		if err := ioutil.WriteFile(filename, []byte(encoded), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("created a new daycare key in %s", filename)
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(raw)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not hold a daycare key", filename)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// encodePublicKey gives the form of a public key that administrators register.
+func encodePublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// daycarePublicKey returns the registered key for a daycare host.
+func daycarePublicKey(tx *sql.Tx, hostname string) (string, error) {
+	key := new(DaycareKey)
+	if err := meddler.QueryRow(tx, key, `SELECT * FROM daycare_keys WHERE hostname = ?`, hostname); err == sql.ErrNoRows {
+		return "", fmt.Errorf("no key is registered for daycare %s", hostname)
+	} else if err != nil {
+		return "", err
+	}
+	return key.PublicKey, nil
+}
+
+// verifyReportCard checks that a graded commit was signed by the daycare that graded it.
+func verifyReportCard(tx *sql.Tx, commit *Commit, signature, problemTypeSignature, problemSignature, hostname string, userID int64) error {
+	if signature == "" {
+		return fmt.Errorf("report card is not signed by daycare %s", hostname)
+	}
+	encoded, err := daycarePublicKey(tx, hostname)
+	if err != nil {
+		return err
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("registered key for daycare %s is malformed: %v", hostname, err)
+	}
+	if !commit.VerifyReportCard(ed25519.PublicKey(publicKey), signature, problemTypeSignature, problemSignature, hostname, userID) {
+		return fmt.Errorf("report card signature does not match the registered key for daycare %s", hostname)
+	}
+	return nil
+}
+
+// daycareKeysCommand handles "codegrinder daycare-keys", which shows a
+// daycare's own key or manages the keys the TA accepts.
+func daycareKeysCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: codegrinder daycare-keys show|list|add|remove")
+	}
+	flags := flag.NewFlagSet("daycare-keys "+args[0], flag.ExitOnError)
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "show":
+		// run on the daycare
+		key, err := loadDaycareKey(Config.DaycareKey)
+		if err != nil {
+			log.Fatalf("loading daycare key: %v", err)
+		}
+		fmt.Printf("%s %s\n", Config.Hostname, encodePublicKey(key))
+		return
+	case "list", "add", "remove":
+		// run on the TA
+	default:
+		log.Fatalf("unknown daycare-keys command %q: expected show, list, add, or remove", args[0])
+	}
+
+	db := setupDB(Config.SQLite3Path)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	switch args[0] {
+	case "list":
+		keys := []*DaycareKey{}
+		if err := meddler.QueryAll(tx, &keys, `SELECT * FROM daycare_keys ORDER BY hostname`); err != nil {
+			log.Fatalf("db error: %v", err)
+		}
+		for _, key := range keys {
+			fmt.Printf("%s %s  added %s\n", key.Hostname, key.PublicKey, key.CreatedAt.Format("2006-01-02 15:04"))
+		}
+		return
+	case "add":
+		if flags.NArg() != 2 {
+			log.Fatalf("usage: codegrinder daycare-keys add <hostname> <public key>")
+		}
+		raw, err := base64.StdEncoding.DecodeString(flags.Arg(1))
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			log.Fatalf("%q is not a daycare public key; run \"codegrinder daycare-keys show\" on the daycare to get it", flags.Arg(1))
+		}
+		key := &DaycareKey{Hostname: flags.Arg(0), PublicKey: flags.Arg(1), CreatedAt: time.Now()}
+		if _, err := tx.Exec(`DELETE FROM daycare_keys WHERE hostname = ?`, key.Hostname); err != nil {
+			log.Fatalf("db error: %v", err)
+		}
+		if err := meddler.Insert(tx, "daycare_keys", key); err != nil {
+			log.Fatalf("db error: %v", err)
+		}
+		log.Printf("registered key for daycare %s", key.Hostname)
+	case "remove":
+		if flags.NArg() != 1 {
+			log.Fatalf("usage: codegrinder daycare-keys remove <hostname>")
+		}
+		res, err := tx.Exec(`DELETE FROM daycare_keys WHERE hostname = ?`, flags.Arg(0))
+		if err != nil {
+			log.Fatalf("db error: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Fatalf("no key is registered for daycare %s", flags.Arg(0))
+		}
+		log.Printf("removed key for daycare %s; it can no longer register or post grades", flags.Arg(0))
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+}
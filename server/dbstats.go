@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/mattn/go-sqlite3"
+)
+
+// instrumentedDriverName is the sqlite driver with query timing added.
+const instrumentedDriverName = "sqlite3_instrumented"
+
+// maxLoggedQueryLength is how much of a slow query's text is logged.
+const maxLoggedQueryLength = 400
+
+var (
+	dbQueriesCounter      = expvar.NewInt("dbQueries")
+	dbSlowQueriesCounter  = expvar.NewInt("dbSlowQueries")
+	dbQuerySecondsCounter = expvar.NewFloat("dbQuerySeconds")
+	dbQueriesByRoute      = expvar.NewMap("dbQueriesByRoute")
+	dbSecondsByRoute      = expvar.NewMap("dbQuerySecondsByRoute")
+	dbRowsByRoute         = expvar.NewMap("dbQueryRowsByRoute")
+)
+
+func init() {
+	sql.Register(instrumentedDriverName, &instrumentedDriver{Driver: &sqlite3.SQLiteDriver{}})
+}
+
+// requestID identifies a request in the logs. It is sent back in the X-Request-ID header.
+type requestID string
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID is martini middleware that assigns each request an ID,
+// keeping the one a proxy in front of us assigned if there is one.
+func withRequestID(c martini.Context, w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID.MatchString(id) {
+		raw := make([]byte, 8)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			log.Printf("error generating request ID: %v", err)
+		}
+		id = hex.EncodeToString(raw)
+	}
+	w.Header().Set("X-Request-ID", id)
+	c.Map(requestID(id))
+}
+
+// queryLabel names the request whose transaction is running, so queries can be
+// attributed to it. The TA runs one transaction at a time (see withTx), so
+// whatever holds the database holds the label; queries made outside a request
+// are counted as background work.
+var queryLabel struct {
+	sync.Mutex
+	route, id string
+}
+
+func setQueryLabel(route string, id requestID) {
+	queryLabel.Lock()
+	queryLabel.route, queryLabel.id = route, string(id)
+	queryLabel.Unlock()
+}
+
+func clearQueryLabel() {
+	setQueryLabel("", "")
+}
+
+// recordQuery adds a finished query to the metrics and logs it if it was slow.
+func recordQuery(query string, elapsed time.Duration, rows int64) {
+	queryLabel.Lock()
+	route, id := queryLabel.route, queryLabel.id
+	queryLabel.Unlock()
+	if route == "" {
+		route = "background"
+	}
+
+	seconds := elapsed.Seconds()
+	dbQueriesCounter.Add(1)
+	dbQuerySecondsCounter.Add(seconds)
+	dbQueriesByRoute.Add(route, 1)
+	dbSecondsByRoute.AddFloat(route, seconds)
+	dbRowsByRoute.Add(route, rows)
+
+	if Config.SlowQueryMillis <= 0 || elapsed < time.Duration(Config.SlowQueryMillis)*time.Millisecond {
+		return
+	}
+	dbSlowQueriesCounter.Add(1)
+	text := strings.Join(strings.Fields(query), " ")
+	if len(text) > maxLoggedQueryLength {
+		text = text[:maxLoggedQueryLength] + "..."
+	}
+	if id != "" {
+		route += " [" + id + "]"
+	}
+	log.Printf("slow query took %v and returned %d rows in %s: %s", elapsed.Round(time.Millisecond), rows, route, text)
+}
+
+// instrumentedDriver wraps the sqlite driver to time every query and statement.
+// A query's time runs until its rows are closed, since sqlite does much of
+// the work while the rows are being read.
+type instrumentedDriver struct {
+	driver.Driver
+}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{SQLiteConn: conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type instrumentedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	var rows int64
+	if err == nil {
+		rows, _ = result.RowsAffected()
+	}
+	recordQuery(query, time.Since(start), rows)
+	return result, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		recordQuery(query, time.Since(start), 0)
+		return nil, err
+	}
+	return &instrumentedRows{SQLiteRows: rows.(*sqlite3.SQLiteRows), query: query, start: start}, nil
+}
+
+type instrumentedRows struct {
+	*sqlite3.SQLiteRows
+	query  string
+	start  time.Time
+	count  int64
+	closed bool
+}
+
+func (r *instrumentedRows) Next(dest []driver.Value) error {
+	err := r.SQLiteRows.Next(dest)
+	if err == nil {
+		r.count++
+	}
+	return err
+}
+
+func (r *instrumentedRows) Close() error {
+	if !r.closed {
+		r.closed = true
+		recordQuery(r.query, time.Since(r.start), r.count)
+	}
+	return r.SQLiteRows.Close()
+}
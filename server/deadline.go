@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+)
+
+// clockCheckInterval is how often the server clock is compared against the NTP server.
+const clockCheckInterval = time.Hour
+
+// assignmentLockAt returns the lock date that applies to a student's assignment, or nil if there is none:
+//   - if there is no course-wide lock at (attached to an instructor), the student lock at is
+//     ignored on the assumption that the deadline was lifted course wide
+//   - else if the student has a lock at, it applies
+//   - else the course-wide lock at applies, on the assumption that a deadline was imposed
+//     after the student started work
+func assignmentLockAt(tx *sql.Tx, assignment *Assignment) (*time.Time, error) {
+	var courseWideLockAt time.Time
+	err := tx.QueryRow(`SELECT lock_at FROM assignments WHERE instructor AND lti_id = ? AND lock_at IS NOT NULL ORDER BY lock_at DESC LIMIT 1`,
+		assignment.LtiID).Scan(&courseWideLockAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if assignment.LockAt != nil {
+		return assignment.LockAt, nil
+	}
+	return &courseWideLockAt, nil
+}
+
+// newDeadline describes an assignment's deadlines as of now and signs it.
+func newDeadline(tx *sql.Tx, assignment *Assignment, now time.Time) (*Deadline, error) {
+	lockAt, err := assignmentLockAt(tx, assignment)
+	if err != nil {
+		return nil, err
+	}
+	grace, err := deadlineGrace(tx, assignment)
+	if err != nil {
+		return nil, err
+	}
+	deadline := &Deadline{
+		AssignmentID: assignment.ID,
+		ServerTime:   now,
+		DueAt:        assignment.DueAt,
+		LockAt:       lockAt,
+		GraceMinutes: int64(grace / time.Minute),
+	}
+	deadline.Signature = deadline.ComputeSignature(Config.SessionSecret)
+	return deadline, nil
+}
+
+// attachDeadlines fills in the signed deadline for each assignment.
+func attachDeadlines(tx *sql.Tx, assignments ...*Assignment) error {
+	now := time.Now()
+	for _, assignment := range assignments {
+		deadline, err := newDeadline(tx, assignment, now)
+		if err != nil {
+			return err
+		}
+		assignment.Deadline = deadline
+	}
+	return nil
+}
+
+// DeadlineCheck reports whether a deadline was issued by this server.
+type DeadlineCheck struct {
+	Valid bool `json:"valid"`
+}
+
+// PostDeadlineCheck handles requests to /deadline_checks,
+// confirming whether a deadline (as returned with an assignment or a commit)
+// was issued by this server and has not been altered.
+func PostDeadlineCheck(deadline Deadline, render render.Render) {
+	expected := deadline.ComputeSignature(Config.SessionSecret)
+	valid := hmac.Equal([]byte(expected), []byte(deadline.Signature))
+	render.JSON(http.StatusOK, &DeadlineCheck{Valid: valid})
+}
+
+// ntpEpochOffset is the number of seconds from the NTP epoch (1900) to the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// ntpTime decodes a 64-bit NTP timestamp.
+func ntpTime(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(seconds, (fraction*1e9)>>32)
+}
+
+// ntpOffset asks an NTP server how far the local clock is from its own, using
+// a single SNTP exchange. A positive offset means the local clock is behind.
+func ntpOffset(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return 0, err
+	}
+
+	// version 3, client mode
+	request := make([]byte, 48)
+	request[0] = 0x1b
+	sent := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 48)
+	n, err := conn.Read(response)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 {
+		return 0, fmt.Errorf("short NTP response of %d bytes", n)
+	}
+	if mode := response[0] & 0x07; mode != 4 {
+		return 0, fmt.Errorf("NTP response has mode %d, expected 4 (server)", mode)
+	}
+	if stratum := response[1]; stratum == 0 {
+		return 0, fmt.Errorf("NTP server sent a kiss-of-death response")
+	}
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// runClockCheck periodically compares the server clock against the configured
+// NTP server and logs a warning when it has drifted too far.
+// Deadlines are enforced by the server clock, so drift shows up as disputes.
+func runClockCheck() {
+	maxDrift := time.Duration(Config.MaxClockDrift) * time.Second
+	for {
+		offset, err := ntpOffset(Config.NTPServer)
+		if err != nil {
+			log.Printf("clock check: error querying NTP server %s: %v", Config.NTPServer, err)
+		} else if offset > maxDrift || offset < -maxDrift {
+			log.Printf("clock check: WARNING: server clock is off by %v compared to %s (more than %v allowed)",
+				offset.Round(time.Millisecond), Config.NTPServer, maxDrift)
+		}
+		time.Sleep(clockCheckInterval)
+	}
+}
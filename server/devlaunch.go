@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// devLaunchPage is the form for building a launch, and devLaunchPost is the
+// self-submitting form that delivers a signed launch the way Canvas does.
+var devLaunchPage = template.Must(template.New("devLaunch").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>CodeGrinder LTI launch simulator</title></head>
+<body>
+<h1>LTI launch simulator</h1>
+<p>Development mode only. Launches are signed with this server's LTI secret.</p>
+<form method="POST" action="/dev/lti">
+<table>
+{{range .}}<tr><td><label for="{{.Name}}">{{.Label}}</label></td><td><input id="{{.Name}}" name="{{.Name}}" value="{{.Value}}" size="60"></td></tr>
+{{end}}</table>
+<p><button type="submit">Launch</button></p>
+</form>
+</body>
+</html>
+`))
+
+var devLaunchPost = template.Must(template.New("devLaunchPost").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Launching</title></head>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.URL}}">
+{{range $key, $values := .Form}}{{range $values}}<input type="hidden" name="{{$key}}" value="{{.}}">
+{{end}}{{end}}<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// devLaunchField is one adjustable launch parameter.
+type devLaunchField struct {
+	Name  string
+	Label string
+	Value string
+}
+
+func devLaunchFields() []*devLaunchField {
+	return []*devLaunchField{
+		{"ui", "UI (cli or web)", "cli"},
+		{"problem_set", "Problem set unique ID", ""},
+		{"lis_person_name_full", "Name", "Dev Student"},
+		{"lis_person_contact_email_primary", "Email", "student@example.com"},
+		{"user_id", "User ID", "dev-student"},
+		{"roles", "Roles", "Learner"},
+		{"context_id", "Course ID", "dev-course"},
+		{"context_title", "Course title", "Development Course"},
+		{"context_label", "Course label", "DEV-1000"},
+		{"resource_link_id", "Assignment link ID", "dev-assignment"},
+		{"resource_link_title", "Assignment title", "Development Assignment"},
+		{"lis_result_sourcedid", "Grade ID (empty for no grade)", "dev-grade"},
+		{"custom_canvas_assignment_points_possible", "Points possible", "10"},
+		{"lis_outcome_service_url", "Grade passback URL (default: log it here)", ""},
+		{"custom_canvas_assignment_due_at", "Due at (" + canvasDateFormat + ")", ""},
+	}
+}
+
+// GetDevLaunch handles requests to /dev/lti,
+// returning a form to build an LTI launch. Query parameters fill in the defaults.
+func GetDevLaunch(w http.ResponseWriter, r *http.Request) {
+	fields := devLaunchFields()
+	for _, field := range fields {
+		if val := r.URL.Query().Get(field.Name); val != "" {
+			field.Value = val
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := devLaunchPage.Execute(w, fields); err != nil {
+		log.Printf("error rendering launch simulator: %v", err)
+	}
+}
+
+// PostDevLaunch handles requests to /dev/lti,
+// signing a launch with the given parameters and handing it to the browser to submit.
+func PostDevLaunch(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "parsing form: %v", err)
+		return
+	}
+	ui := r.PostForm.Get("ui")
+	if ui != "cli" && ui != "web" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "UI type must be cli or web, not %q", ui)
+		return
+	}
+	unique := r.PostForm.Get("problem_set")
+	if unique == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem set unique ID is required")
+		return
+	}
+	if points := r.PostForm.Get("custom_canvas_assignment_points_possible"); points != "" {
+		if _, err := strconv.ParseFloat(points, 64); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "points possible must be a number, not %q", points)
+			return
+		}
+	}
+
+	// the launch goes to this server at the address the browser used,
+	// signed for the URL that checkOAuthSignature will reconstruct
+	target := getMyURL(r)
+	target.Path = "/lti/problem_sets/" + ui + "/" + url.PathEscape(unique)
+
+	now := time.Now()
+	form := url.Values{}
+	for _, field := range devLaunchFields() {
+		if field.Name == "ui" || field.Name == "problem_set" {
+			continue
+		}
+		if val := strings.TrimSpace(r.PostForm.Get(field.Name)); val != "" {
+			form.Set(field.Name, val)
+		}
+	}
+	if form.Get("lis_outcome_service_url") == "" {
+		// getMyURL assumes https, but a development server may not use TLS
+		outcomes := getMyURL(r)
+		if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") == "" {
+			outcomes.Scheme = "http"
+		}
+		outcomes.Path = "/dev/outcomes"
+		form.Set("lis_outcome_service_url", outcomes.String())
+	}
+	form.Set("ext_outcome_data_values_accepted", "text")
+	form.Set("lti_message_type", "basic-lti-launch-request")
+	form.Set("lti_version", "LTI-1p0")
+	form.Set("tool_consumer_info_product_family_code", "canvas")
+	form.Set("tool_consumer_instance_name", "CodeGrinder launch simulator")
+	form.Set("oauth_version", "1.0")
+	form.Set("oauth_signature_method", "HMAC-SHA1")
+	form.Set("oauth_timestamp", strconv.FormatInt(now.Unix(), 10))
+	form.Set("oauth_nonce", strconv.FormatInt(now.UnixNano(), 36))
+	form.Set("oauth_consumer_key", "codegrinder-dev")
+	form.Set("oauth_callback", "about:blank")
+	form.Set("oauth_signature", computeOAuthSignature("POST", target.String(), form, Config.LTISecret))
+
+	log.Printf("launch simulator: %s as %s (%s)", target.Path, form.Get("lis_person_contact_email_primary"), form.Get("roles"))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := devLaunchPost.Execute(w, struct {
+		URL  string
+		Form url.Values
+	}{URL: target.Path, Form: form})
+	if err != nil {
+		log.Printf("error rendering launch simulator: %v", err)
+	}
+}
+
+// PostDevOutcome handles requests to /dev/outcomes,
+// the default grade passback URL for simulated launches. It logs the grade and accepts it.
+func PostDevOutcome(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "reading grade: %v", err)
+		return
+	}
+	var grade GradeResponse
+	if err := xml.Unmarshal(body, &grade); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "parsing grade: %v", err)
+		return
+	}
+	log.Printf("launch simulator: grade %s for %s", grade.Score, grade.SourcedID)
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<imsx_POXEnvelopeResponse xmlns="http://www.imsglobal.org/services/ltiv1p1/xsd/imsoms_v1p0">
+  <imsx_POXHeader><imsx_POXResponseHeaderInfo><imsx_version>V1.0</imsx_version>
+    <imsx_statusInfo><imsx_codeMajor>success</imsx_codeMajor><imsx_severity>status</imsx_severity></imsx_statusInfo>
+  </imsx_POXResponseHeaderInfo></imsx_POXHeader>
+  <imsx_POXBody><replaceResultResponse/></imsx_POXBody>
+</imsx_POXEnvelopeResponse>
+`)
+}
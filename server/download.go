@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// signedDownloadLifetime is how long a signed download URL can be used.
+const signedDownloadLifetime = 10 * time.Minute
+
+// DownloadURL is a short-lived link that can be fetched without logging in.
+type DownloadURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// signDownload computes the signature for a download path and its query parameters.
+// It uses the session secret, which is never shared outside of the TA.
+func signDownload(path string, v url.Values) string {
+	mac := hmac.New(sha256.New, []byte(Config.SessionSecret))
+	mac.Write([]byte("download\x00" + path + "\x00"))
+	mac.Write(encode(v))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newDownloadURL creates a signed URL for the given path, usable by the given user until it expires.
+func newDownloadURL(path string, v url.Values, userID int64) *DownloadURL {
+	expires := time.Now().Add(signedDownloadLifetime).Round(time.Second)
+	v.Set("user_id", strconv.FormatInt(userID, 10))
+	v.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	v.Set("signature", signDownload(path, v))
+	return &DownloadURL{
+		URL:       fmt.Sprintf("https://%s%s?%s", Config.Hostname, path, v.Encode()),
+		ExpiresAt: expires,
+	}
+}
+
+// checkDownloadURL verifies the signature and expiration of a signed download request
+// and loads the user it was issued to. It reports an error to the client if it fails.
+func checkDownloadURL(w http.ResponseWriter, r *http.Request, tx *sql.Tx) *User {
+	v := make(url.Values)
+	for key, vals := range r.URL.Query() {
+		if key != "signature" {
+			v[key] = vals
+		}
+	}
+	sig := signDownload(r.URL.Path, v)
+	if !hmac.Equal([]byte(sig), []byte(r.URL.Query().Get("signature"))) {
+		loggedHTTPErrorf(w, http.StatusForbidden, "download signature mismatch")
+		return nil
+	}
+	expires, err := strconv.ParseInt(v.Get("expires"), 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		loggedHTTPErrorf(w, http.StatusForbidden, "download link has expired")
+		return nil
+	}
+	userID, err := parseID(w, "user_id", v.Get("user_id"))
+	if err != nil {
+		return nil
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, userID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil
+	}
+	return user
+}
+
+// loadDownloadStep loads an assignment the user can access and a step of one of its problems,
+// hiding problems that are not open yet from students.
+func loadDownloadStep(w http.ResponseWriter, tx *sql.Tx, params martini.Params, user *User) (*Assignment, *ProblemStep) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return nil, nil
+	}
+	step, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return nil, nil
+	}
+	assignment := loadDownloadAssignment(w, tx, params, user)
+	if assignment == nil {
+		return nil, nil
+	}
+
+	problemStep := new(ProblemStep)
+	query := `SELECT problem_steps.* FROM problem_steps JOIN problem_set_problems ON problem_steps.problem_id = problem_set_problems.problem_id ` +
+		`WHERE problem_set_problems.problem_set_id = ? AND problem_steps.problem_id = ? AND problem_steps.step = ?`
+	args := []interface{}{assignment.ProblemSetID, problemID, step}
+	if !user.Admin && !user.Author {
+		query += ` AND problem_steps.problem_id NOT IN (` + notYetOpenProblems + `)`
+		args = append(args, time.Now(), user.ID)
+	}
+	if err := meddler.QueryRow(tx, problemStep, query, args...); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, nil
+	}
+	if err := loadStepFiles(problemStep); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return nil, nil
+	}
+	return assignment, problemStep
+}
+
+// PostAssignmentProblemStepDownloadURL handles requests to
+// /assignments/:assignment_id/problems/:problem_id/steps/:step/download_url,
+// returning a signed URL for a zip file of the step's files.
+func PostAssignmentProblemStepDownloadURL(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment, step := loadDownloadStep(w, tx, params, currentUser)
+	if step == nil {
+		return
+	}
+	path := fmt.Sprintf("/downloads/assignments/%d/problems/%d/steps/%d", assignment.ID, step.ProblemID, step.Step)
+	render.JSON(http.StatusOK, newDownloadURL(path, make(url.Values), currentUser.ID))
+}
+
+// GetDownloadAssignmentProblemStep handles signed requests to
+// /downloads/assignments/:assignment_id/problems/:problem_id/steps/:step,
+// returning a zip file of the step's files.
+func GetDownloadAssignmentProblemStep(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params) {
+	user := checkDownloadURL(w, r, tx)
+	if user == nil {
+		return
+	}
+	_, step := loadDownloadStep(w, tx, params, user)
+	if step == nil {
+		return
+	}
+
+	names := []string{}
+	for name := range step.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="problem-%d-step-%d.zip"`, step.ProblemID, step.Step))
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		out, err := zw.Create(name)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error writing %s to step download: %v", name, err)
+			return
+		}
+		if _, err := out.Write(step.Files[name]); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error writing %s to step download: %v", name, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error finishing step download: %v", err)
+	}
+}
+
+// loadDownloadAssignment loads an assignment the user can access (any assignment for admins).
+func loadDownloadAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, user *User) *Assignment {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return nil
+	}
+
+	assignment := new(Assignment)
+	if user.Admin {
+		err = meddler.Load(tx, "assignments", assignment, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, user.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil
+	}
+	return assignment
+}
+
+// PostAssignmentArchiveDownloadURL handles requests to /assignments/:assignment_id/archive/download_url,
+// returning a signed URL for the assignment archive.
+//
+// If parameter all=true is present, the archive will include the commit for every step.
+func PostAssignmentArchiveDownloadURL(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment := loadDownloadAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+	v := make(url.Values)
+	if s := r.FormValue("all"); s != "" {
+		all, err := strconv.ParseBool(s)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing all value as boolean: %v", err)
+			return
+		}
+		v.Set("all", strconv.FormatBool(all))
+	}
+	path := fmt.Sprintf("/downloads/assignments/%d/archive", assignment.ID)
+	render.JSON(http.StatusOK, newDownloadURL(path, v, currentUser.ID))
+}
+
+// GetDownloadAssignmentArchive handles signed requests to /downloads/assignments/:assignment_id/archive,
+// returning the same zip file as /assignments/:assignment_id/archive.
+func GetDownloadAssignmentArchive(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params) {
+	user := checkDownloadURL(w, r, tx)
+	if user == nil {
+		return
+	}
+	assignment := loadDownloadAssignment(w, tx, params, user)
+	if assignment == nil {
+		return
+	}
+	all := r.URL.Query().Get("all") == "true"
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, assignment.CourseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-assignment-%d.zip", courseDirectoryName(course), assignment.ID)
+	writeArchive(w, tx, filename, []*Assignment{assignment}, all)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// engineCheckInterval is how often the daycare checks an unreachable container engine.
+	engineCheckInterval = 2 * time.Second
+
+	// engineCheckTimeout bounds a single check of the container engine.
+	engineCheckTimeout = 10 * time.Second
+
+	// engineRecoveryTimeout is how long a job whose container vanished waits
+	// for the container engine to come back before giving up.
+	engineRecoveryTimeout = 2 * time.Minute
+
+	// maxEngineRetries is how many times a job is started over after losing its container.
+	maxEngineRetries = 2
+)
+
+// engineMonitor tracks whether the daycare can reach the container engine daemon.
+// While the daemon is down the daycare stops registering with the TA,
+// so the TA stops sending it work until the daemon is back.
+type engineMonitor struct {
+	sync.Mutex
+	healthy bool
+
+	// generation counts the times the daemon has been lost. A container
+	// started in an earlier generation may have been killed by a restart.
+	generation int64
+
+	// recovered is closed when the daemon becomes reachable again
+	recovered chan struct{}
+}
+
+var engine = engineMonitor{recovered: make(chan struct{})}
+
+// Healthy reports whether the container engine was reachable at the last check.
+func (m *engineMonitor) Healthy() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.healthy
+}
+
+// Generation returns the number of times the daemon has been lost so far.
+func (m *engineMonitor) Generation() int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.generation
+}
+
+// lost records that the daemon cannot be reached.
+func (m *engineMonitor) lost(reason string) {
+	m.Lock()
+	defer m.Unlock()
+	if !m.healthy {
+		return
+	}
+	log.Printf("container engine lost: %s; no longer accepting jobs", reason)
+	m.healthy = false
+	m.generation++
+	m.recovered = make(chan struct{})
+}
+
+// restored records that the daemon can be reached again.
+func (m *engineMonitor) restored() {
+	m.Lock()
+	defer m.Unlock()
+	if m.healthy {
+		return
+	}
+	log.Printf("container engine is available; accepting jobs")
+	m.healthy = true
+	close(m.recovered)
+}
+
+// check pings the daemon now and records the result.
+func (m *engineMonitor) check() bool {
+	if err := pingContainerEngine(); err != nil {
+		m.lost(err.Error())
+		return false
+	}
+	m.restored()
+	return true
+}
+
+// LostSince reports whether the daemon has been lost since the given generation.
+// It checks the daemon first so a restart that just happened is not missed.
+func (m *engineMonitor) LostSince(generation int64) bool {
+	m.check()
+	return m.Generation() != generation
+}
+
+// WaitHealthy waits up to the given time for the daemon to be reachable.
+func (m *engineMonitor) WaitHealthy(timeout time.Duration) bool {
+	m.Lock()
+	healthy, recovered := m.healthy, m.recovered
+	m.Unlock()
+	if healthy {
+		return true
+	}
+	select {
+	case <-recovered:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// pingContainerEngine asks the daemon for its version.
+func pingContainerEngine() error {
+	ctx, cancel := context.WithTimeout(context.Background(), engineCheckTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, containerEngine, "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s version: %v: %s", containerEngine, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runEngineMonitor watches the container engine daemon. While it is reachable,
+// an event stream is held open so a restart is noticed as soon as the stream drops,
+// even if the daemon comes back before the next check.
+// It never returns.
+func runEngineMonitor() {
+	for {
+		if !engine.check() {
+			time.Sleep(engineCheckInterval)
+			continue
+		}
+
+		start := time.Now()
+		err := exec.Command(containerEngine, "events", "--filter", "type=daemon").Run()
+		if time.Since(start) < engineCheckInterval && engine.check() {
+			// the event stream is not usable, so settle for polling
+			time.Sleep(engineCheckInterval)
+			continue
+		}
+		engine.lost(fmt.Sprintf("event stream closed: %v", err))
+		time.Sleep(engineCheckInterval)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// activeGap is the longest pause between saves or activity pings that still
+// counts as working. Autosaves and pings arrive every few minutes while a
+// student is busy, so anything longer is treated as a break.
+const activeGap = 15 * time.Minute
+
+// underestimateFactor and underestimateSample decide when a problem is flagged:
+// the median student must take this many times the estimate, measured over
+// at least this many students who finished it.
+const (
+	underestimateFactor = 1.5
+	underestimateSample = 5
+)
+
+// ProblemEstimate compares an author's estimates for a problem with
+// the time students actually spent on it and what they reported in the survey.
+// Only students who passed every step are measured.
+type ProblemEstimate struct {
+	ProblemID            int64   `json:"problemID"`
+	Unique               string  `json:"unique"`
+	Note                 string  `json:"note"`
+	EstimatedMinutes     int64   `json:"estimatedMinutes"`
+	Difficulty           int64   `json:"difficulty"`
+	Students             int     `json:"students"`
+	MedianActiveMinutes  float64 `json:"medianActiveMinutes"`
+	MeanActiveMinutes    float64 `json:"meanActiveMinutes"`
+	SurveyResponses      int     `json:"surveyResponses"`
+	SurveyMedianMinutes  float64 `json:"surveyMedianMinutes"`
+	SurveyMeanDifficulty float64 `json:"surveyMeanDifficulty"`
+	EstimateRatio        float64 `json:"estimateRatio,omitempty"`
+	Underestimated       bool    `json:"underestimated"`
+}
+
+// activeMinutes adds up the time between consecutive saves, skipping breaks.
+// The times must be sorted.
+func activeMinutes(times []time.Time) float64 {
+	var total time.Duration
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap > 0 && gap <= activeGap {
+			total += gap
+		}
+	}
+	return total.Minutes()
+}
+
+// median returns the middle value of a list, or zero if it is empty.
+// The list is sorted in place.
+func median(list []float64) float64 {
+	if len(list) == 0 {
+		return 0.0
+	}
+	sort.Float64s(list)
+	n := len(list)
+	if n%2 == 1 {
+		return list[n/2]
+	}
+	return (list[n/2-1] + list[n/2]) / 2.0
+}
+
+// GetProblemEstimates handles requests to /problem_estimates,
+// returning a comparison of estimated and measured time for each problem with an estimate,
+// with underestimated problems first.
+//
+// If parameter problem_id=<...> present, only that problem is reported, with or without an estimate.
+// If parameter course_id=<...> present, only students in that course are measured.
+func GetProblemEstimates(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := ` WHERE problems.estimated_minutes > 0`
+	args := []interface{}{}
+	if s := r.FormValue("problem_id"); s != "" {
+		problemID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_id: %v", err)
+			return
+		}
+		where = ` WHERE problems.id = ?`
+		args = append(args, problemID)
+	}
+	courseFilter := ``
+	var courseArgs []interface{}
+	if s := r.FormValue("course_id"); s != "" {
+		courseID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing course_id: %v", err)
+			return
+		}
+		courseFilter = ` AND assignments.course_id = ?`
+		courseArgs = append(courseArgs, courseID)
+	}
+
+	problems := []*Problem{}
+	if err := meddler.QueryAll(tx, &problems, `SELECT * FROM problems`+where+` ORDER BY unique_id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	report := []*ProblemEstimate{}
+	for _, problem := range problems {
+		elt := &ProblemEstimate{
+			ProblemID:        problem.ID,
+			Unique:           problem.Unique,
+			Note:             problem.Note,
+			EstimatedMinutes: problem.EstimatedMinutes,
+			Difficulty:       problem.Difficulty,
+		}
+
+		// measure students who passed the final step by their saves and activity pings
+		type save struct {
+			AssignmentID int64     `meddler:"assignment_id"`
+			CreatedAt    time.Time `meddler:"created_at,localtime"`
+		}
+		saves := []*save{}
+		if err := meddler.QueryAll(tx, &saves, `SELECT activity.assignment_id, activity.created_at FROM `+
+			`(SELECT assignment_id, problem_id, created_at FROM commit_hashes `+
+			`UNION ALL SELECT assignment_id, problem_id, created_at FROM activity_pings) AS activity `+
+			`JOIN assignments ON activity.assignment_id = assignments.id `+
+			`WHERE activity.problem_id = ? AND NOT assignments.instructor`+courseFilter+` `+
+			`AND activity.assignment_id IN (SELECT assignment_id FROM step_scores `+
+			`WHERE problem_id = ? AND score >= 1.0 AND step = (SELECT MAX(step) FROM problem_steps WHERE problem_id = ?)) `+
+			`ORDER BY activity.assignment_id, activity.created_at`,
+			append(append([]interface{}{problem.ID}, courseArgs...), problem.ID, problem.ID)...); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		var measured []float64
+		var total float64
+		for start := 0; start < len(saves); {
+			end := start
+			var times []time.Time
+			for end < len(saves) && saves[end].AssignmentID == saves[start].AssignmentID {
+				times = append(times, saves[end].CreatedAt)
+				end++
+			}
+			minutes := activeMinutes(times)
+			measured = append(measured, minutes)
+			total += minutes
+			start = end
+		}
+		elt.Students = len(measured)
+		if elt.Students > 0 {
+			elt.MeanActiveMinutes = total / float64(elt.Students)
+			elt.MedianActiveMinutes = median(measured)
+		}
+
+		// compare with what students reported
+		surveys := []*ProblemSurvey{}
+		if err := meddler.QueryAll(tx, &surveys, `SELECT problem_surveys.* FROM problem_surveys `+
+			`JOIN assignments ON problem_surveys.assignment_id = assignments.id `+
+			`WHERE problem_surveys.problem_id = ?`+courseFilter,
+			append([]interface{}{problem.ID}, courseArgs...)...); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		elt.SurveyResponses = len(surveys)
+		var reported []float64
+		var difficulties, difficultyTotal int64
+		for _, survey := range surveys {
+			if survey.Minutes > 0 {
+				reported = append(reported, float64(survey.Minutes))
+			}
+			if survey.Difficulty > 0 {
+				difficulties++
+				difficultyTotal += survey.Difficulty
+			}
+		}
+		elt.SurveyMedianMinutes = median(reported)
+		if difficulties > 0 {
+			elt.SurveyMeanDifficulty = float64(difficultyTotal) / float64(difficulties)
+		}
+
+		if problem.EstimatedMinutes > 0 && elt.Students > 0 {
+			elt.EstimateRatio = elt.MedianActiveMinutes / float64(problem.EstimatedMinutes)
+			elt.Underestimated = elt.Students >= underestimateSample && elt.EstimateRatio >= underestimateFactor
+		}
+		report = append(report, elt)
+	}
+
+	sort.SliceStable(report, func(i, j int) bool {
+		if report[i].Underestimated != report[j].Underestimated {
+			return report[i].Underestimated
+		}
+		return report[i].EstimateRatio > report[j].EstimateRatio
+	})
+	render.JSON(http.StatusOK, report)
+}
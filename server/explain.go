@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// FailureExplanation is an explanation of a failure, written by an instructor or TA
+// while looking at one student's commit and shared with every later student whose
+// commit fails the same way. Students only see explanations an instructor approved.
+type FailureExplanation struct {
+	ID          int64      `json:"id" meddler:"id,pk"`
+	CourseID    int64      `json:"courseID" meddler:"course_id"`
+	ProblemID   int64      `json:"problemID" meddler:"problem_id"`
+	Step        int64      `json:"step" meddler:"step"`
+	Signature   string     `json:"signature" meddler:"signature"`
+	Explanation string     `json:"explanation" meddler:"explanation"`
+	AuthorID    int64      `json:"authorID" meddler:"author_id"`
+	ApprovedBy  int64      `json:"approvedBy,omitempty" meddler:"approved_by,zeroisnull"`
+	ApprovedAt  *time.Time `json:"approvedAt,omitempty" meddler:"approved_at,localtime"`
+	CreatedAt   time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt   time.Time  `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// maxSignatureLength caps the length of an error signature.
+const maxSignatureLength = 200
+
+// errorLinePattern finds the line of output that names the error, such as a
+// Python exception or a compiler diagnostic.
+var errorLinePattern = regexp.MustCompile(`(?m)^(?:[\w.]*(?:Error|Exception)\b.*|.*\berror(?:\[E\d+\])?: .*)$`)
+
+// signatureNoise matches the parts of an error line that vary from one student
+// to the next: paths, line numbers, quoted names, and other numbers.
+var signatureNoise = []struct {
+	re   *regexp.Regexp
+	with string
+}{
+	{regexp.MustCompile(`(?:[\w.-]*/)+[\w.-]+`), "<path>"},
+	{regexp.MustCompile(`'[^']*'|"[^"]*"|‘[^’]*’`), "<name>"},
+	{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b|\b\d+(?:\.\d+)?\b`), "<n>"},
+	{regexp.MustCompile(`\s+`), " "},
+}
+
+// failureSignatures lists the ways a failed commit failed: one "test:" signature
+// for each test that did not pass, then an "error:" signature for the first error
+// in the output, normalized so the same mistake gives the same signature.
+func failureSignatures(commit *Commit) []string {
+	rc := commit.ReportCard
+	if rc == nil || rc.Passed {
+		return nil
+	}
+	var signatures []string
+	seen := make(map[string]bool)
+	add := func(sig string) {
+		if len(sig) > maxSignatureLength {
+			sig = sig[:maxSignatureLength]
+		}
+		if !seen[sig] {
+			seen[sig] = true
+			signatures = append(signatures, sig)
+		}
+	}
+	for _, result := range rc.Results {
+		if result.Outcome == "failed" || result.Outcome == "error" {
+			add("test:" + result.Name)
+		}
+	}
+
+	var output strings.Builder
+	for _, event := range commit.Transcript {
+		if event.Event == "stdout" || event.Event == "stderr" {
+			output.Write(event.StreamData)
+		}
+	}
+	for _, result := range rc.Results {
+		if result.Outcome == "error" {
+			output.WriteString("\n" + result.Details)
+		}
+	}
+	if line := errorLinePattern.FindString(output.String()); line != "" {
+		for _, elt := range signatureNoise {
+			line = elt.re.ReplaceAllString(line, elt.with)
+		}
+		add("error:" + strings.TrimSpace(line))
+	}
+	return signatures
+}
+
+// isCourseLeadInstructor checks if the user has the Instructor role in the course,
+// as opposed to being a TA.
+func isCourseLeadInstructor(tx *sql.Tx, courseID, userID int64) (bool, error) {
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments WHERE course_id = ? AND user_id = ? AND instructor`,
+		courseID, userID); err != nil {
+		return false, err
+	}
+	for _, asst := range assignments {
+		for _, role := range strings.Split(asst.Roles, ",") {
+			if role == "Instructor" || role == "urn:lti:role:ims/lis/Instructor" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// PostCommitExplanation handles requests to /commits/:commit_id/explanations,
+// attaching an explanation to one of the ways the commit failed. The signature
+// defaults to the first one for the commit. Instructors and TAs for the course can
+// add them; explanations by instructors are approved at once, others wait for one.
+// The student's name and email are removed from the explanation.
+func PostCommitExplanation(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, explanation FailureExplanation, render render.Render) {
+	now := time.Now()
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return
+	}
+	commit := new(Commit)
+	if err := meddler.Load(tx, "commits", commit, commitID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := loadCommitBlobs(commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, commit.AssignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	lead := currentUser.Admin
+	if !lead {
+		isInstructor, err := isCourseInstructor(tx, assignment.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, assignment.CourseID)
+			return
+		}
+		if lead, err = isCourseLeadInstructor(tx, assignment.CourseID, currentUser.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	signatures := failureSignatures(commit)
+	if len(signatures) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "commit %d did not fail, so there is nothing to explain", commitID)
+		return
+	}
+	if explanation.Signature == "" {
+		explanation.Signature = signatures[0]
+	}
+	found := false
+	for _, sig := range signatures {
+		found = found || sig == explanation.Signature
+	}
+	if !found {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "commit %d did not fail with %q; its signatures are: %s",
+			commitID, explanation.Signature, strings.Join(signatures, "; "))
+		return
+	}
+	student := new(User)
+	if err := meddler.Load(tx, "users", student, assignment.UserID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	explanation.Explanation = strings.TrimSpace(identityRedactor(student).Replace(explanation.Explanation))
+	if explanation.Explanation == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "explanation must not be empty")
+		return
+	}
+
+	explanation.ID = 0
+	explanation.CourseID = assignment.CourseID
+	explanation.ProblemID = commit.ProblemID
+	explanation.Step = commit.Step
+	explanation.AuthorID = currentUser.ID
+	explanation.ApprovedBy = 0
+	explanation.ApprovedAt = nil
+	if lead {
+		explanation.ApprovedBy = currentUser.ID
+		explanation.ApprovedAt = &now
+	}
+	explanation.CreatedAt = now
+	explanation.UpdatedAt = now
+	if err := meddler.Insert(tx, "failure_explanations", &explanation); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) explained %q for problem %d step %d (explanation %d)",
+		currentUser.ID, currentUser.Email, explanation.Signature, explanation.ProblemID, explanation.Step, explanation.ID)
+	render.JSON(http.StatusOK, &explanation)
+}
+
+// GetCourseExplanations handles requests to /courses/:course_id/explanations,
+// returning the explanations written in the course. Pass approved=false to
+// see only those waiting for approval.
+func GetCourseExplanations(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	where := ` WHERE course_id = ?`
+	switch r.FormValue("approved") {
+	case "":
+	case "true":
+		where += ` AND approved_at IS NOT NULL`
+	case "false":
+		where += ` AND approved_at IS NULL`
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "approved must be true or false")
+		return
+	}
+	explanations := []*FailureExplanation{}
+	if err := meddler.QueryAll(tx, &explanations, `SELECT * FROM failure_explanations`+where+` ORDER BY problem_id, step, signature, id`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, explanations)
+}
+
+// loadExplanation loads an explanation and checks that the current user
+// is allowed to change it: an admin, or an instructor for its course.
+// If lead is true, a TA is not enough.
+func loadExplanation(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, lead bool) *FailureExplanation {
+	explanationID, err := parseID(w, "explanation_id", params["explanation_id"])
+	if err != nil {
+		return nil
+	}
+	explanation := new(FailureExplanation)
+	if err := meddler.Load(tx, "failure_explanations", explanation, explanationID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil
+	}
+	if currentUser.Admin {
+		return explanation
+	}
+	check := isCourseInstructor
+	if lead {
+		check = isCourseLeadInstructor
+	}
+	allowed, err := check(tx, explanation.CourseID, currentUser.ID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return nil
+	}
+	if !allowed {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) cannot change explanations for course %d", currentUser.ID, currentUser.Email, explanation.CourseID)
+		return nil
+	}
+	return explanation
+}
+
+// PostExplanationApproval handles requests to /explanations/:explanation_id/approval,
+// approving an explanation so students can see it. Only instructors, not TAs, can approve.
+func PostExplanationApproval(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	explanation := loadExplanation(w, tx, params, currentUser, true)
+	if explanation == nil {
+		return
+	}
+	if explanation.ApprovedAt == nil {
+		now := time.Now()
+		explanation.ApprovedBy = currentUser.ID
+		explanation.ApprovedAt = &now
+		explanation.UpdatedAt = now
+		if err := meddler.Update(tx, "failure_explanations", explanation); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	render.JSON(http.StatusOK, explanation)
+}
+
+// DeleteExplanation handles requests to /explanations/:explanation_id,
+// removing an explanation. Instructors and TAs for the course can remove one.
+func DeleteExplanation(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	explanation := loadExplanation(w, tx, params, currentUser, false)
+	if explanation == nil {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM failure_explanations WHERE id = ?`, explanation.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+}
+
+// GetAssignmentProblemStepExplanations handles requests to
+// /assignments/:assignment_id/problems/:problem_id/steps/:step/explanations,
+// returning approved explanations from any course for the ways the student's
+// latest commit for the step failed, most specific first.
+func GetAssignmentProblemStepExplanations(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	stepN, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if currentUser.Admin {
+		err = meddler.Load(tx, "assignments", assignment, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	explanations := []*PastExplanation{}
+	commit := new(Commit)
+	if err := meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = ? AND problem_id = ? AND step = ?`,
+		assignment.ID, problemID, stepN); err != nil {
+		if err == sql.ErrNoRows {
+			render.JSON(http.StatusOK, explanations)
+			return
+		}
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadCommitBlobs(commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	for _, sig := range failureSignatures(commit) {
+		matches := []*PastExplanation{}
+		if err := meddler.QueryAll(tx, &matches, `SELECT signature, explanation FROM failure_explanations `+
+			`WHERE problem_id = ? AND step = ? AND signature = ? AND approved_at IS NOT NULL ORDER BY approved_at`,
+			problemID, stepN, sig); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		explanations = append(explanations, matches...)
+	}
+	render.JSON(http.StatusOK, explanations)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// FeedbackProvider is an outside service that suggests what a student might
+// look at in a failing submission. Its answer is shown to the student next to
+// the report card, labeled as supplementary; it never affects the grade.
+type FeedbackProvider interface {
+	Feedback(req *FeedbackRequest) (string, error)
+}
+
+// feedbackProvider is the service selected in the config file. If nil, no feedback is requested.
+var feedbackProvider FeedbackProvider
+
+// setupFeedbackProvider creates the feedback provider selected in the config file.
+func setupFeedbackProvider() (FeedbackProvider, error) {
+	switch Config.FeedbackProvider {
+	case "":
+		return nil, nil
+	case "http":
+		if Config.FeedbackURL == "" {
+			return nil, fmt.Errorf("http feedback provider requires feedbackURL")
+		}
+		return &httpFeedbackProvider{
+			url:    Config.FeedbackURL,
+			token:  Config.FeedbackToken,
+			client: &http.Client{Timeout: feedbackTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown feedback provider %q: must be http", Config.FeedbackProvider)
+	}
+}
+
+// feedbackTimeout bounds a single request to the feedback provider.
+const feedbackTimeout = 2 * time.Minute
+
+// maxFeedbackLength caps the feedback kept from a provider, in bytes.
+const maxFeedbackLength = 16 * 1024
+
+// maxFeedbackRequests is how many feedback requests may be in flight at once.
+const maxFeedbackRequests = 4
+
+// FeedbackRequest is everything a provider is told about a failing submission.
+// It never identifies the student: names and email addresses are replaced in
+// the files and output, and no IDs are included.
+type FeedbackRequest struct {
+	Problem      string            `json:"problem"`
+	Step         int64             `json:"step"`
+	Instructions string            `json:"instructions"`
+	Files        map[string]string `json:"files"`
+	ReportCard   *ReportCard       `json:"reportCard"`
+	Output       string            `json:"output"`
+}
+
+// httpFeedbackProvider posts the request as JSON and expects {"feedback": "..."} back.
+type httpFeedbackProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (p *httpFeedbackProvider) Feedback(req *FeedbackRequest) (string, error) {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequest("POST", p.url, bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4*maxFeedbackLength))
+	if err != nil {
+		return "", fmt.Errorf("reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("feedback provider returned %s", resp.Status)
+	}
+	var result struct {
+		Feedback string `json:"feedback"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("parsing response: %v", err)
+	}
+	return result.Feedback, nil
+}
+
+// FeedbackSettings records that an instructor opted a course in to feedback.
+// A course without settings never sends anything to the provider.
+type FeedbackSettings struct {
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	EnabledBy int64     `json:"enabledBy" meddler:"enabled_by"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// FeedbackRecord is the audit log entry for one request to the feedback provider.
+type FeedbackRecord struct {
+	ID           int64            `json:"id" meddler:"id,pk"`
+	CourseID     int64            `json:"courseID" meddler:"course_id"`
+	AssignmentID int64            `json:"assignmentID" meddler:"assignment_id"`
+	CommitID     int64            `json:"commitID" meddler:"commit_id"`
+	ProblemID    int64            `json:"problemID" meddler:"problem_id"`
+	Step         int64            `json:"step" meddler:"step"`
+	Provider     string           `json:"provider" meddler:"provider"`
+	Request      *FeedbackRequest `json:"request" meddler:"request,json"`
+	Feedback     string           `json:"feedback,omitempty" meddler:"feedback,zeroisnull"`
+	Error        string           `json:"error,omitempty" meddler:"error,zeroisnull"`
+	CreatedAt    time.Time        `json:"createdAt" meddler:"created_at,localtime"`
+	FinishedAt   *time.Time       `json:"finishedAt,omitempty" meddler:"finished_at,localtime"`
+}
+
+// feedbackQueue sends requests to the provider outside of any request
+// transaction, so it keeps its own handle to the database.
+type feedbackQueue struct {
+	db       *sql.DB
+	mutex    *sync.Mutex
+	inFlight chan struct{}
+}
+
+var feedbackRequests feedbackQueue
+
+// feedbackEnabled reports whether a course has opted in to feedback.
+func feedbackEnabled(tx *sql.Tx, courseID int64) (bool, error) {
+	if feedbackProvider == nil {
+		return false, nil
+	}
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(1) FROM feedback_settings WHERE course_id = ?`, courseID).Scan(&count)
+	return count > 0, err
+}
+
+// identityRedactor replaces a student's name, email address, and logins with [student].
+func identityRedactor(student *User) *strings.Replacer {
+	var identity []string
+	for _, elt := range []string{student.Name, student.Email, student.LtiID, student.CanvasLogin} {
+		if len(strings.TrimSpace(elt)) >= 3 {
+			identity = append(identity, elt, "[student]")
+		}
+	}
+	if at := strings.Index(student.Email, "@"); at >= 3 {
+		identity = append(identity, student.Email[:at], "[student]")
+	}
+	return strings.NewReplacer(identity...)
+}
+
+// newFeedbackRequest gathers a failing commit for the provider, removing the student's identity.
+func newFeedbackRequest(problem *Problem, step *ProblemStep, commit *Commit, student *User) *FeedbackRequest {
+	redact := identityRedactor(student)
+
+	req := &FeedbackRequest{
+		Problem:      problem.Unique,
+		Step:         commit.Step,
+		Instructions: step.Instructions,
+		Files:        make(map[string]string),
+		ReportCard:   commit.ReportCard,
+	}
+	for name, contents := range commit.Files {
+		if utf8.Valid(contents) {
+			req.Files[name] = redact.Replace(string(contents))
+		}
+	}
+	var output bytes.Buffer
+	if err := commit.DumpTranscript(&output); err == nil {
+		req.Output = redact.Replace(output.String())
+	}
+	return req
+}
+
+// queueFeedback asks the provider about a failing commit in the background,
+// logging the request and attaching the answer to the commit if it has not changed since.
+func (q *feedbackQueue) queueFeedback(record *FeedbackRecord, updatedAt time.Time) {
+	if q.db == nil || feedbackProvider == nil {
+		return
+	}
+	go func() {
+		q.inFlight <- struct{}{}
+		defer func() { <-q.inFlight }()
+
+		feedback, err := feedbackProvider.Feedback(record.Request)
+		now := time.Now()
+		record.FinishedAt = &now
+		if err != nil {
+			record.Error = err.Error()
+			log.Printf("feedback request for commit %d failed: %v", record.CommitID, err)
+		} else {
+			if len(feedback) > maxFeedbackLength {
+				feedback = feedback[:maxFeedbackLength]
+			}
+			record.Feedback = strings.ToValidUTF8(strings.TrimSpace(feedback), "")
+		}
+
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		tx, err := q.db.Begin()
+		if err != nil {
+			log.Printf("db error saving feedback for commit %d: %v", record.CommitID, err)
+			return
+		}
+		defer tx.Rollback()
+		if err := meddler.Insert(tx, "feedback_records", record); err != nil {
+			log.Printf("db error saving feedback for commit %d: %v", record.CommitID, err)
+			return
+		}
+		if record.Feedback != "" {
+			if _, err := tx.Exec(`UPDATE commits SET feedback = ? WHERE id = ? AND updated_at = ?`,
+				record.Feedback, record.CommitID, updatedAt.UTC()); err != nil {
+				log.Printf("db error saving feedback for commit %d: %v", record.CommitID, err)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("db error saving feedback for commit %d: %v", record.CommitID, err)
+		}
+	}()
+}
+
+// requestFeedback queues a feedback request for a failing commit if its course has opted in.
+// It reports whether a request was queued.
+func requestFeedback(tx *sql.Tx, assignment *Assignment, problem *Problem, step *ProblemStep, commit *Commit, now time.Time) (bool, error) {
+	if commit.ReportCard == nil || commit.ReportCard.Passed || commit.ID == 0 {
+		return false, nil
+	}
+	enabled, err := feedbackEnabled(tx, assignment.CourseID)
+	if err != nil || !enabled {
+		return false, err
+	}
+	student := new(User)
+	if err := meddler.Load(tx, "users", student, assignment.UserID); err != nil {
+		return false, err
+	}
+	record := &FeedbackRecord{
+		CourseID:     assignment.CourseID,
+		AssignmentID: assignment.ID,
+		CommitID:     commit.ID,
+		ProblemID:    commit.ProblemID,
+		Step:         commit.Step,
+		Provider:     Config.FeedbackProvider,
+		Request:      newFeedbackRequest(problem, step, commit, student),
+		CreatedAt:    now,
+	}
+	feedbackRequests.queueFeedback(record, commit.UpdatedAt)
+	return true, nil
+}
+
+// loadInstructorCourse parses the course ID and checks that the current user
+// is an instructor for the course (or an admin).
+func loadInstructorCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) (int64, bool) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return 0, false
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return 0, false
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return 0, false
+		}
+	}
+	return courseID, true
+}
+
+// loadLeadInstructorCourse is like loadInstructorCourse, but turns away TAs.
+func loadLeadInstructorCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) (int64, bool) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return 0, false
+	}
+	if !currentUser.Admin {
+		lead, err := isCourseLeadInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return 0, false
+		}
+		if !lead {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return 0, false
+		}
+	}
+	return courseID, true
+}
+
+// GetCourseFeedbackSettings handles requests to /courses/:course_id/feedback_settings,
+// returning the settings if the course has opted in to feedback.
+func GetCourseFeedbackSettings(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	settings := new(FeedbackSettings)
+	if err := meddler.QueryRow(tx, settings, `SELECT * FROM feedback_settings WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, settings)
+}
+
+// PutCourseFeedbackSettings handles requests to /courses/:course_id/feedback_settings,
+// opting the course in to feedback. From then on, failing graded submissions
+// in the course are sent to the feedback provider.
+func PutCourseFeedbackSettings(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	if feedbackProvider == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "no feedback provider is configured on this server")
+		return
+	}
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	settings := new(FeedbackSettings)
+	if err := meddler.QueryRow(tx, settings, `SELECT * FROM feedback_settings WHERE course_id = ?`, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		settings = &FeedbackSettings{
+			CourseID:  courseID,
+			EnabledBy: currentUser.ID,
+			CreatedAt: time.Now(),
+		}
+		if err := meddler.Insert(tx, "feedback_settings", settings); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		log.Printf("user %d (%s) opted course %d (%s) in to %s feedback", currentUser.ID, currentUser.Email, courseID, course.Name, Config.FeedbackProvider)
+	}
+	render.JSON(http.StatusOK, settings)
+}
+
+// DeleteCourseFeedbackSettings handles requests to /courses/:course_id/feedback_settings,
+// opting the course out of feedback. Requests already sent still finish.
+func DeleteCourseFeedbackSettings(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM feedback_settings WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) opted course %d out of feedback", currentUser.ID, currentUser.Email, courseID)
+}
+
+// GetCourseFeedbackRecords handles requests to /courses/:course_id/feedback_records,
+// returning the audit log of everything sent to the feedback provider for the course
+// and what came back, newest first.
+func GetCourseFeedbackRecords(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	records := []*FeedbackRecord{}
+	if err := meddler.QueryAll(tx, &records, `SELECT * FROM feedback_records WHERE course_id = ? ORDER BY created_at DESC`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, records)
+}
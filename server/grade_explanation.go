@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// GradeExplanation records how an assignment's score was worked out each
+// time a new score was saved to be posted to the LMS, so any grade the LMS
+// holds can be traced back to the step scores behind it. ScorePolicy says
+// which attempt counted for each step, Explanation has the weighted
+// average of the steps and problems, and GradePolicy (if the course has
+// one) turned ComputedScore into Score. Reason says what caused the new
+// score, and PostedAt is set once the LMS accepts it.
+type GradeExplanation struct {
+	ID            int64             `json:"id" meddler:"id,pk"`
+	AssignmentID  int64             `json:"assignmentID" meddler:"assignment_id"`
+	Reason        string            `json:"reason" meddler:"reason"`
+	ScorePolicy   string            `json:"scorePolicy" meddler:"score_policy"`
+	Explanation   *ScoreExplanation `json:"explanation" meddler:"explanation,json"`
+	ComputedScore float64           `json:"computedScore" meddler:"computed_score"`
+	GradePolicy   *GradePolicy      `json:"gradePolicy,omitempty" meddler:"grade_policy,json"`
+	Score         float64           `json:"score" meddler:"score"`
+	CreatedAt     time.Time         `json:"createdAt" meddler:"created_at,localtime"`
+	PostedAt      *time.Time        `json:"postedAt,omitempty" meddler:"posted_at,localtime"`
+}
+
+// maxGradeExplanations is the number of explanations kept for each assignment.
+const maxGradeExplanations = 50
+
+// explainAssignmentScore works out an assignment's score from its score history,
+// applying its score policy, the step and problem weights, and its course's grade policy.
+// The raw scores of the assignment are updated in memory, but nothing is saved.
+// If no step carries any weight, the explanation is returned along with ErrNothingToScore.
+func explainAssignmentScore(tx *sql.Tx, assignment *Assignment) (*GradeExplanation, error) {
+	explanation := &GradeExplanation{AssignmentID: assignment.ID}
+	policy, err := getScorePolicy(tx, assignment)
+	if err != nil {
+		return nil, err
+	}
+	explanation.ScorePolicy = policy
+	if err := applyScorePolicy(tx, assignment); err != nil {
+		return nil, err
+	}
+
+	majorWeights, minorWeights, err := GetProblemWeights(tx, assignment)
+	if err != nil {
+		return nil, err
+	}
+	explanation.Explanation, err = assignment.ExplainScore(majorWeights, minorWeights)
+	if err == ErrNothingToScore {
+		return explanation, err
+	} else if err != nil {
+		return nil, err
+	}
+	explanation.ComputedScore = explanation.Explanation.Score
+	explanation.Score = explanation.ComputedScore
+
+	gradePolicy := new(GradePolicy)
+	if err := meddler.QueryRow(tx, gradePolicy, `SELECT * FROM grade_policies WHERE course_id = ?`, assignment.CourseID); err == nil {
+		explanation.GradePolicy = gradePolicy
+		explanation.Score = gradePolicy.Apply(explanation.ComputedScore)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	return explanation, nil
+}
+
+// recordGradeExplanation saves an explanation for a new score, dropping the oldest
+// ones for the assignment beyond maxGradeExplanations.
+func recordGradeExplanation(tx *sql.Tx, explanation *GradeExplanation, reason string, now time.Time) error {
+	explanation.ID = 0
+	explanation.Reason = reason
+	explanation.CreatedAt = now
+	explanation.PostedAt = nil
+	if err := meddler.Insert(tx, "grade_explanations", explanation); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM grade_explanations WHERE assignment_id = ? AND id NOT IN `+
+		`(SELECT id FROM grade_explanations WHERE assignment_id = ? ORDER BY id DESC LIMIT ?)`,
+		explanation.AssignmentID, explanation.AssignmentID, maxGradeExplanations)
+	return err
+}
+
+// GetAssignmentGradeExplanations handles requests to /assignments/:assignment_id/grade_explanations,
+// returning how each recent score for the assignment was worked out, newest first.
+// Students can see their own, and instructors can see those of their students.
+func GetAssignmentGradeExplanations(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment := loadDownloadAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+	explanations := []*GradeExplanation{}
+	if err := meddler.QueryAll(tx, &explanations, `SELECT * FROM grade_explanations WHERE assignment_id = ? ORDER BY id DESC`, assignment.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, explanations)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// GradePolicy controls how assignment scores in a course are rounded before
+// they are stored, reported through the API, and posted to the LMS.
+// DecimalPlaces counts places in the score as a percentage, so 0 turns
+// 0.6667 into 0.67 and 1 turns it into 0.667. Scores below MinimumScore
+// (a fraction between 0 and 1) are raised to it.
+type GradePolicy struct {
+	CourseID      int64     `json:"courseID" meddler:"course_id"`
+	DecimalPlaces int       `json:"decimalPlaces" meddler:"decimal_places"`
+	Rounding      string    `json:"rounding" meddler:"rounding"`
+	MinimumScore  float64   `json:"minimumScore" meddler:"minimum_score"`
+	CreatedAt     time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt     time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// maxGradeDecimalPlaces keeps rounding within the precision used when posting grades.
+const maxGradeDecimalPlaces = 3
+
+// Apply rounds a score according to the policy.
+func (policy *GradePolicy) Apply(score float64) float64 {
+	scale := 100.0 * math.Pow(10, float64(policy.DecimalPlaces))
+
+	// allow for values like 0.29 * 100 coming out as 28.999999999999996
+	const epsilon = 1e-9
+	switch policy.Rounding {
+	case "floor":
+		score = math.Floor(score*scale+epsilon) / scale
+	case "ceiling":
+		score = math.Ceil(score*scale-epsilon) / scale
+	default:
+		score = math.Round(score*scale) / scale
+	}
+	if score < policy.MinimumScore {
+		score = policy.MinimumScore
+	}
+	return math.Min(score, 1.0)
+}
+
+// applyGradePolicy rounds a score using the course's grade policy, if it has one.
+func applyGradePolicy(tx *sql.Tx, courseID int64, score float64) (float64, error) {
+	policy := new(GradePolicy)
+	if err := meddler.QueryRow(tx, policy, `SELECT * FROM grade_policies WHERE course_id = ?`, courseID); err != nil {
+		if err == sql.ErrNoRows {
+			return score, nil
+		}
+		return 0, err
+	}
+	return policy.Apply(score), nil
+}
+
+// rescoreCourse recomputes the score of every graded student assignment in a course,
+// e.g., after its grade policy changes. The nightly grade sync posts any scores that change.
+func rescoreCourse(tx *sql.Tx, courseID int64, now time.Time) error {
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments WHERE course_id = ? AND NOT instructor AND score IS NOT NULL`, courseID); err != nil {
+		return err
+	}
+	for _, assignment := range assignments {
+		if _, err := rescoreAssignment(tx, assignment, "grade policy", now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadGradePolicyCourse parses the course ID and checks that the current user
+// is an instructor for the course (or an admin).
+func loadGradePolicyCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) (int64, bool) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return 0, false
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return 0, false
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return 0, false
+		}
+	}
+	return courseID, true
+}
+
+// GetCourseGradePolicy handles requests to /courses/:course_id/grade_policy,
+// returning the grade rounding policy for the course.
+func GetCourseGradePolicy(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadGradePolicyCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	policy := new(GradePolicy)
+	if err := meddler.QueryRow(tx, policy, `SELECT * FROM grade_policies WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, policy)
+}
+
+// PutCourseGradePolicy handles requests to /courses/:course_id/grade_policy,
+// setting the grade rounding policy for the course and rescoring its assignments.
+//
+// Rounding is one of round (the default), floor, or ceiling.
+func PutCourseGradePolicy(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, policy GradePolicy, render render.Render) {
+	now := time.Now()
+
+	courseID, ok := loadGradePolicyCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	if policy.DecimalPlaces < 0 || policy.DecimalPlaces > maxGradeDecimalPlaces {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "decimal places must be between 0 and %d", maxGradeDecimalPlaces)
+		return
+	}
+	switch policy.Rounding {
+	case "":
+		policy.Rounding = "round"
+	case "round", "floor", "ceiling":
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "rounding must be round, floor, or ceiling, not %q", policy.Rounding)
+		return
+	}
+	if policy.MinimumScore < 0.0 || policy.MinimumScore > 1.0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "minimum score must be between 0 and 1")
+		return
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	old := new(GradePolicy)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM grade_policies WHERE course_id = ?`, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		policy.CreatedAt = now
+	} else {
+		policy.CreatedAt = old.CreatedAt
+	}
+	policy.CourseID = courseID
+	policy.UpdatedAt = now
+
+	if _, err := tx.Exec(`DELETE FROM grade_policies WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "grade_policies", &policy); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := rescoreCourse(tx, courseID, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error rescoring course: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &policy)
+}
+
+// DeleteCourseGradePolicy handles requests to /courses/:course_id/grade_policy,
+// removing the grade rounding policy for the course and rescoring its assignments.
+func DeleteCourseGradePolicy(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	courseID, ok := loadGradePolicyCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM grade_policies WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := rescoreCourse(tx, courseID, time.Now()); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error rescoring course: %v", err)
+	}
+}
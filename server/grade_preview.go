@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+)
+
+// GradePreview shows what grade would be posted to the LMS for an
+// assignment and how it was computed, without posting anything.
+// ComputedScore is the score before the course's grade policy rounds it,
+// and Score is what would be posted. StoredScore is the score saved with
+// the assignment now, and PostedScore is the last one the LMS acknowledged.
+type GradePreview struct {
+	AssignmentID  int64             `json:"assignmentID"`
+	UserID        int64             `json:"userID"`
+	ScorePolicy   string            `json:"scorePolicy"`
+	Explanation   *ScoreExplanation `json:"explanation"`
+	ComputedScore float64           `json:"computedScore"`
+	Score         float64           `json:"score"`
+	StoredScore   float64           `json:"storedScore"`
+	PostedScore   *float64          `json:"postedScore"`
+	PostedAt      *time.Time        `json:"postedAt"`
+	WouldPost     bool              `json:"wouldPost"`
+	Note          string            `json:"note"`
+}
+
+// GetAssignmentGradePreview handles requests to /assignments/:assignment_id/grade_preview,
+// computing the grade that would be posted for the assignment the same way grading does,
+// with every step of the math, but without saving or posting it.
+func GetAssignmentGradePreview(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+
+	preview := &GradePreview{
+		AssignmentID: assignment.ID,
+		UserID:       assignment.UserID,
+		StoredScore:  assignment.Score,
+	}
+
+	// this only changes the copy in memory, which is never saved
+	explanation, err := explainAssignmentScore(tx, assignment)
+	nothingToScore := err == ErrNothingToScore
+	if err != nil && !nothingToScore {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	preview.ScorePolicy = explanation.ScorePolicy
+	preview.Explanation = explanation.Explanation
+	preview.ComputedScore = explanation.ComputedScore
+	preview.Score = explanation.Score
+
+	// the last score the LMS accepted
+	var posted float64
+	var postedAt time.Time
+	err = tx.QueryRow(`SELECT score, posted_at FROM grade_postings WHERE assignment_id = ?`, assignment.ID).Scan(&posted, &postedAt)
+	if err == nil {
+		preview.PostedScore, preview.PostedAt = &posted, &postedAt
+	} else if err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// explain what saveGrade would do with it
+	switch {
+	case assignment.GradeID == "":
+		preview.Note = "no grade is posted because the LMS did not give this assignment a grade ID (instructors do not get grades)"
+	case assignment.OutcomeURL == "":
+		preview.Note = "no grade is posted because the LMS did not give this assignment an outcome URL"
+	case nothingToScore:
+		preview.Note = "no grade is posted because no step of the assignment carries any weight"
+	default:
+		preview.WouldPost = true
+		preview.Note = fmt.Sprintf("%.5f would be posted", preview.Score)
+		if preview.PostedScore == nil {
+			preview.Note += "; the LMS has not acknowledged a grade yet"
+		} else if diff := *preview.PostedScore - preview.Score; diff > gradeSyncTolerance || diff < -gradeSyncTolerance {
+			preview.Note += fmt.Sprintf("; the LMS last acknowledged %.5f", *preview.PostedScore)
+		}
+		if diff := preview.StoredScore - preview.Score; diff > gradeSyncTolerance || diff < -gradeSyncTolerance {
+			preview.Note += fmt.Sprintf("; the stored score of %.5f is out of date and will be updated the next time the student is graded", preview.StoredScore)
+		}
+	}
+
+	render.JSON(http.StatusOK, preview)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// gradeSyncHour is the local hour when the nightly grade reconciliation runs.
+const gradeSyncHour = 3
+
+// gradeSyncWindow limits reconciliation to assignments that are undated or
+// were due recently. Grades for courses that have wrapped up are left alone.
+const gradeSyncWindow = 30 * 24 * time.Hour
+
+// gradeSyncTolerance is how far a posted score can be from the computed score
+// and still match. Scores are posted with five decimal places.
+const gradeSyncTolerance = 0.000005
+
+// GradeDiscrepancy is an assignment whose computed score does not match
+// the last score the LMS acknowledged.
+type GradeDiscrepancy struct {
+	AssignmentID int64      `json:"assignmentID" meddler:"assignment_id"`
+	CourseID     int64      `json:"courseID" meddler:"course_id"`
+	UserID       int64      `json:"userID" meddler:"user_id"`
+	CanvasTitle  string     `json:"canvasTitle" meddler:"canvas_title"`
+	DueAt        *time.Time `json:"dueAt" meddler:"due_at,localtime"`
+	Score        float64    `json:"score" meddler:"score"`
+	PostedScore  *float64   `json:"postedScore" meddler:"posted_score"`
+	PostedAt     *time.Time `json:"postedAt" meddler:"posted_at,localtime"`
+	Error        string     `json:"error,omitempty" meddler:"-"`
+}
+
+// GradeSyncRun records one pass of the grade reconciliation job.
+type GradeSyncRun struct {
+	ID            int64               `json:"id" meddler:"id,pk"`
+	Checked       int                 `json:"checked" meddler:"checked"`
+	Reposted      int                 `json:"reposted" meddler:"reposted"`
+	Failed        int                 `json:"failed" meddler:"failed"`
+	Discrepancies []*GradeDiscrepancy `json:"discrepancies" meddler:"discrepancies,json"`
+	StartedAt     time.Time           `json:"startedAt" meddler:"started_at,localtime"`
+	FinishedAt    *time.Time          `json:"finishedAt" meddler:"finished_at,localtime"`
+}
+
+// gradeSync records which scores the LMS has acknowledged.
+// Grades are posted outside of any request transaction, so it
+// keeps its own handle to the database.
+type gradeSync struct {
+	db    *sql.DB
+	mutex *sync.Mutex
+}
+
+var gradeSyncs gradeSync
+
+// acknowledge records that the LMS accepted the current score for an assignment.
+func (g *gradeSync) acknowledge(asst *Assignment) {
+	if g.db == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	tx, err := g.db.Begin()
+	if err != nil {
+		log.Printf("db error recording grade posted for assignment %d: %v", asst.ID, err)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO grade_postings (assignment_id, score, posted_at) VALUES (?, ?, ?)`,
+		asst.ID, asst.Score, now); err != nil {
+		log.Printf("db error recording grade posted for assignment %d: %v", asst.ID, err)
+		return
+	}
+
+	// mark the explanation of the posted score
+	if _, err := tx.Exec(`UPDATE grade_explanations SET posted_at = ? WHERE id = `+
+		`(SELECT id FROM grade_explanations WHERE assignment_id = ? AND ABS(score - ?) <= ? ORDER BY id DESC LIMIT 1)`,
+		now, asst.ID, asst.Score, gradeSyncTolerance); err != nil {
+		log.Printf("db error recording grade posted for assignment %d: %v", asst.ID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("db error recording grade posted for assignment %d: %v", asst.ID, err)
+	}
+}
+
+// gradeSyncCandidates is the FROM and WHERE clause selecting assignments
+// that post grades to the LMS and fall within the reconciliation window.
+const gradeSyncCandidates = ` FROM assignments LEFT JOIN grade_postings ON assignments.id = grade_postings.assignment_id ` +
+	`WHERE assignments.grade_id IS NOT NULL AND assignments.outcome_url <> '' ` +
+	`AND (assignments.due_at IS NULL OR assignments.due_at > ?)`
+
+// findGradeDiscrepancies lists assignments whose computed score differs from the
+// last acknowledged score, along with the number of assignments checked.
+// Assignments with no score and nothing posted are not discrepancies.
+func findGradeDiscrepancies(tx *sql.Tx, now time.Time, courseID int64) ([]*GradeDiscrepancy, int, error) {
+	where := gradeSyncCandidates
+	args := []interface{}{now.Add(-gradeSyncWindow)}
+	if courseID > 0 {
+		where += ` AND assignments.course_id = ?`
+		args = append(args, courseID)
+	}
+
+	var checked int
+	if err := tx.QueryRow(`SELECT COUNT(1)`+where, args...).Scan(&checked); err != nil {
+		return nil, 0, err
+	}
+
+	discrepancies := []*GradeDiscrepancy{}
+	if err := meddler.QueryAll(tx, &discrepancies, `SELECT assignments.id AS assignment_id, assignments.course_id, assignments.user_id, `+
+		`assignments.canvas_title, assignments.due_at, COALESCE(assignments.score, 0) AS score, `+
+		`grade_postings.score AS posted_score, grade_postings.posted_at`+where+
+		` AND NOT (grade_postings.score IS NULL AND assignments.score IS NULL) `+
+		`AND (grade_postings.score IS NULL OR ABS(grade_postings.score - COALESCE(assignments.score, 0)) > ?) `+
+		`ORDER BY assignments.due_at IS NULL, assignments.due_at, assignments.id`,
+		append(args, gradeSyncTolerance)...); err != nil {
+		return nil, 0, err
+	}
+	return discrepancies, checked, nil
+}
+
+// runGradeSyncJobs reconciles grades with the LMS once a night,
+// so a transient LMS outage never leaves a stale grade behind.
+// It never returns.
+func runGradeSyncJobs(db *sql.DB, dbMutex *sync.Mutex) {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), gradeSyncHour, 0, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		time.Sleep(next.Sub(now))
+
+		if err := runGradeSync(db, dbMutex); err != nil {
+			log.Printf("grade sync error: %v", err)
+		}
+	}
+}
+
+// runGradeSync re-posts every grade that does not match what the LMS last acknowledged.
+// Grades are posted without holding the database lock.
+func runGradeSync(db *sql.DB, dbMutex *sync.Mutex) error {
+	dbMutex.Lock()
+	run, assignments, err := startGradeSync(db, time.Now())
+	dbMutex.Unlock()
+	if err != nil || run == nil {
+		return err
+	}
+
+	for i, asst := range assignments {
+		if err := saveGrade(asst, "", nil); err != nil {
+			run.Discrepancies[i].Error = err.Error()
+			run.Failed++
+		} else {
+			run.Reposted++
+		}
+	}
+	finished := time.Now()
+	run.FinishedAt = &finished
+	log.Printf("grade sync checked %d assignments: %d reposted, %d failed", run.Checked, run.Reposted, run.Failed)
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := meddler.Update(tx, "grade_sync_runs", run); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// startGradeSync records the start of a reconciliation run and loads the assignments to re-post.
+// It returns a nil run if another TA instance is running the job or already ran it tonight.
+func startGradeSync(db *sql.DB, now time.Time) (*GradeSyncRun, []*Assignment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	isLeader, err := acquireLease(tx, "grade_sync", now)
+	if err != nil || !isLeader {
+		return nil, nil, err
+	}
+	var recent int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM grade_sync_runs WHERE started_at > ?`, now.Add(-12*time.Hour)).Scan(&recent); err != nil {
+		return nil, nil, err
+	}
+	if recent > 0 {
+		return nil, nil, nil
+	}
+
+	discrepancies, checked, err := findGradeDiscrepancies(tx, now, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var assignments []*Assignment
+	for _, elt := range discrepancies {
+		asst := new(Assignment)
+		if err := meddler.Load(tx, "assignments", asst, elt.AssignmentID); err != nil {
+			return nil, nil, err
+		}
+		assignments = append(assignments, asst)
+	}
+
+	run := &GradeSyncRun{
+		Checked:       checked,
+		Discrepancies: discrepancies,
+		StartedAt:     now,
+	}
+	if err := meddler.Insert(tx, "grade_sync_runs", run); err != nil {
+		return nil, nil, err
+	}
+	return run, assignments, tx.Commit()
+}
+
+// GetGradeSyncReport handles requests to /grade_sync/report,
+// returning the assignments whose grades currently differ from what the LMS acknowledged.
+//
+// If parameter course_id=<...> present, results will be filtered by matching course.
+func GetGradeSyncReport(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	var courseID int64
+	if s := r.FormValue("course_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing course_id: %v", err)
+			return
+		}
+		courseID = id
+	}
+
+	discrepancies, _, err := findGradeDiscrepancies(tx, time.Now(), courseID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, discrepancies)
+}
+
+// GetGradeSyncRuns handles requests to /grade_sync/runs,
+// returning the most recent reconciliation runs, newest first.
+func GetGradeSyncRuns(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	runs := []*GradeSyncRun{}
+	if err := meddler.QueryAll(tx, &runs, `SELECT * FROM grade_sync_runs ORDER BY started_at DESC LIMIT 30`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, runs)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// GradeTarget is one place in the LMS that an assignment's grade is posted to.
+// A course cross-listed in more than one LMS shell gives a student a
+// different lis_result_sourcedid in each, so every one seen in a launch is
+// kept and each gets a copy of the grade. Status is pending until the
+// first post, then posted or failed, with Error saying why it failed.
+type GradeTarget struct {
+	ID                 int64      `json:"id" meddler:"id,pk"`
+	AssignmentID       int64      `json:"assignmentID" meddler:"assignment_id"`
+	GradeID            string     `json:"gradeID" meddler:"grade_id"`
+	OutcomeURL         string     `json:"outcomeURL" meddler:"outcome_url"`
+	OutcomeExtAccepted string     `json:"-" meddler:"outcome_ext_accepted"`
+	ConsumerKey        string     `json:"-" meddler:"consumer_key"`
+	Status             string     `json:"status" meddler:"status"`
+	Error              string     `json:"error,omitempty" meddler:"error"`
+	PostedScore        *float64   `json:"postedScore" meddler:"posted_score"`
+	PostedAt           *time.Time `json:"postedAt" meddler:"posted_at,localtime"`
+	AttemptedAt        *time.Time `json:"attemptedAt" meddler:"attempted_at,localtime"`
+	CreatedAt          time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	LaunchedAt         time.Time  `json:"launchedAt" meddler:"launched_at,localtime"`
+}
+
+const (
+	gradeTargetPending = "pending"
+	gradeTargetPosted  = "posted"
+	gradeTargetFailed  = "failed"
+)
+
+// holds reports whether the LMS has already accepted a score at this target.
+func (target *GradeTarget) holds(score float64) bool {
+	if target.Status != gradeTargetPosted || target.PostedScore == nil {
+		return false
+	}
+	diff := *target.PostedScore - score
+	return diff <= gradeSyncTolerance && diff >= -gradeSyncTolerance
+}
+
+// recordGradeTarget notes the grade target from an assignment's latest launch.
+// It reports whether the target is new to the assignment.
+func recordGradeTarget(tx *sql.Tx, asst *Assignment, now time.Time) (bool, error) {
+	if asst.GradeID == "" || asst.OutcomeURL == "" {
+		return false, nil
+	}
+	target := new(GradeTarget)
+	err := meddler.QueryRow(tx, target, `SELECT * FROM grade_targets WHERE assignment_id = ? AND grade_id = ?`, asst.ID, asst.GradeID)
+	if err == sql.ErrNoRows {
+		target = &GradeTarget{
+			AssignmentID: asst.ID,
+			GradeID:      asst.GradeID,
+			Status:       gradeTargetPending,
+			CreatedAt:    now,
+		}
+	} else if err != nil {
+		return false, err
+	}
+	isNew := target.ID < 1
+	target.OutcomeURL = asst.OutcomeURL
+	target.OutcomeExtAccepted = asst.OutcomeExtAccepted
+	target.ConsumerKey = asst.ConsumerKey
+	target.LaunchedAt = now
+	if err := meddler.Save(tx, "grade_targets", target); err != nil {
+		return false, err
+	}
+	return isNew, nil
+}
+
+// targets loads the places an assignment's grade is posted to.
+// An assignment that has not been launched since targets were tracked
+// gets a single untracked target (with ID 0) from its latest launch.
+func (g *gradeSync) targets(asst *Assignment) ([]*GradeTarget, error) {
+	targets := []*GradeTarget{}
+	if g.db != nil {
+		g.mutex.Lock()
+		err := meddler.QueryAll(g.db, &targets, `SELECT * FROM grade_targets WHERE assignment_id = ? ORDER BY id`, asst.ID)
+		g.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(targets) == 0 && asst.GradeID != "" && asst.OutcomeURL != "" {
+		targets = append(targets, &GradeTarget{
+			AssignmentID:       asst.ID,
+			GradeID:            asst.GradeID,
+			OutcomeURL:         asst.OutcomeURL,
+			OutcomeExtAccepted: asst.OutcomeExtAccepted,
+			ConsumerKey:        asst.ConsumerKey,
+			Status:             gradeTargetPending,
+		})
+	}
+	return targets, nil
+}
+
+// targetAttempted records the outcome of posting a score to a grade target.
+func (g *gradeSync) targetAttempted(target *GradeTarget, score float64, postErr error) {
+	now := time.Now()
+	target.AttemptedAt = &now
+	if postErr == nil {
+		target.Status = gradeTargetPosted
+		target.Error = ""
+		target.PostedScore = &score
+		target.PostedAt = &now
+	} else {
+		target.Status = gradeTargetFailed
+		target.Error = postErr.Error()
+	}
+	if g.db == nil || target.ID < 1 {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if err := meddler.Update(g.db, "grade_targets", target); err != nil {
+		log.Printf("db error recording grade post to target %d for assignment %d: %v", target.ID, target.AssignmentID, err)
+	}
+}
+
+// GetAssignmentGradeTargets handles requests to /assignments/:assignment_id/grade_targets,
+// returning every place the assignment's grade is posted to and how the last post to each went.
+func GetAssignmentGradeTargets(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+	targets := []*GradeTarget{}
+	if err := meddler.QueryAll(tx, &targets, `SELECT * FROM grade_targets WHERE assignment_id = ? ORDER BY id`, assignment.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, targets)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// defaultContentSecurityPolicy allows the pages in www to load their own scripts and
+// styles (including inline ones) and to open sockets to the daycares.
+// Deployments with other needs can replace it with contentSecurityPolicy.
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: https:; " +
+	"connect-src 'self' https: wss:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'"
+
+// cookieSameSite returns the SameSite setting for cookies set by the TA.
+// Pages embedded in an LMS iframe are a cross-site context, so by default
+// cookies are sent there too; the CSRF token guards against misuse.
+func cookieSameSite() http.SameSite {
+	switch strings.ToLower(Config.CookieSameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "lax":
+		return http.SameSiteLaxMode
+	default:
+		return http.SameSiteNoneMode
+	}
+}
+
+// securityHeaders returns martini middleware that adds security headers to every TA response.
+// Framing is limited to our own pages plus the configured LMS origins.
+// X-Frame-Options cannot name other origins, so it is only sent when there are none.
+func securityHeaders(useTLS bool) martini.Handler {
+	switch strings.ToLower(Config.CookieSameSite) {
+	case "", "none", "lax", "strict":
+	default:
+		log.Fatalf("cookieSameSite must be none, lax, or strict, not %q", Config.CookieSameSite)
+	}
+	for _, origin := range Config.LMSOrigins {
+		if !strings.HasPrefix(origin, "https://") || strings.ContainsAny(origin, " ;") {
+			log.Fatalf("lmsOrigins entry %q must be an https:// origin", origin)
+		}
+	}
+	if len(Config.LMSOrigins) == 0 {
+		log.Printf("no lmsOrigins in the config file; pages cannot be embedded in an LMS")
+	}
+
+	policy := Config.ContentSecurityPolicy
+	if policy == "" {
+		policy = defaultContentSecurityPolicy
+	}
+	policy = strings.TrimSuffix(strings.TrimSpace(policy), ";") + "; frame-ancestors " +
+		strings.Join(append([]string{"'self'"}, Config.LMSOrigins...), " ")
+
+	return func(w http.ResponseWriter) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", policy)
+		if len(Config.LMSOrigins) == 0 {
+			h.Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if useTLS && Config.HSTSMaxAge > 0 {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", Config.HSTSMaxAge))
+		}
+	}
+}
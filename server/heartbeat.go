@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/russross/codegrinder/types"
+)
+
+// abandonGrace is how long a client can go without being heard from
+// before its session is considered abandoned.
+const abandonGrace = 3 * DaycareHeartbeatInterval
+
+// clientWatch follows the messages a client sends after its first request
+// to notice when the student has gone away, e.g., by closing the terminal.
+type clientWatch struct {
+	sync.Mutex
+	lastSeen   time.Time
+	heartbeats bool
+	closed     bool
+
+	// stdin carries what the client types for interactive actions.
+	// It is closed when the client closes stdin or goes away.
+	stdin       chan []byte
+	stdinClosed bool
+}
+
+// clientStdinBuffer is the number of stdin messages held for an action
+// that is not reading them; more are dropped.
+const clientStdinBuffer = 256
+
+// watchClient starts reading the rest of the messages from a client.
+// Nothing else may read from the socket after this is called.
+func watchClient(socket *websocket.Conn) *clientWatch {
+	c := &clientWatch{lastSeen: time.Now(), stdin: make(chan []byte, clientStdinBuffer)}
+	go func() {
+		for {
+			req := new(DaycareRequest)
+			if err := socket.ReadJSON(req); err != nil {
+				// the grace period starts when the connection drops
+				c.Lock()
+				c.closed = true
+				c.lastSeen = time.Now()
+				c.closeStdin()
+				c.Unlock()
+				return
+			}
+			c.Lock()
+			c.lastSeen = time.Now()
+			if req.Heartbeat {
+				c.heartbeats = true
+			}
+			if len(req.Stdin) > 0 && !c.stdinClosed {
+				select {
+				case c.stdin <- req.Stdin:
+				default:
+					log.Printf("dropping stdin from a client whose action is not reading it")
+				}
+			}
+			if req.CloseStdin {
+				c.closeStdin()
+			}
+			c.Unlock()
+		}
+	}()
+	return c
+}
+
+// closeStdin closes the stdin channel if it is still open. The lock must be held.
+func (c *clientWatch) closeStdin() {
+	if !c.stdinClosed {
+		c.stdinClosed = true
+		close(c.stdin)
+	}
+}
+
+// abandoned reports whether the client has gone away for longer than the grace period.
+// Clients that never send heartbeats only count as gone once the connection closes.
+func (c *clientWatch) abandoned(now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	if !c.closed && !c.heartbeats {
+		return false
+	}
+	return now.Sub(c.lastSeen) > abandonGrace
+}
+
+// stopAbandoned stops a session's container if its client goes away, until stop is closed.
+func stopAbandoned(client *clientWatch, session *GradingSession, stop <-chan struct{}) {
+	ticker := time.NewTicker(DaycareHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if client.abandoned(now) {
+				activeSessions.stop(session, "stopped because the client went away")
+				return
+			}
+		}
+	}
+}
+
+// saveAbandonedGrade asks the TA to save a graded commit
+// when the client that asked for it is no longer there to do so.
+func saveAbandonedGrade(bundle *CommitBundle) {
+	toSave := &CommitBundle{
+		Hostname:            bundle.Hostname,
+		UserID:              bundle.UserID,
+		Commit:              bundle.Commit,
+		CommitSignature:     bundle.CommitSignature,
+		ReportCardSignature: bundle.ReportCardSignature,
+	}
+	go func() {
+		if err := postToTA("/commit_bundles/daycare", toSave, nil); err != nil {
+			log.Printf("error saving graded commit for user %d: %v", bundle.UserID, err)
+		}
+	}()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// HintProgress tracks how often a student's graded commits have triggered a hint
+// and when the hint was revealed to them.
+type HintProgress struct {
+	ID           int64      `json:"id" meddler:"id,pk"`
+	AssignmentID int64      `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64      `json:"problemID" meddler:"problem_id"`
+	Step         int64      `json:"step" meddler:"step"`
+	Position     int64      `json:"position" meddler:"position"`
+	Failures     int64      `json:"failures" meddler:"failures"`
+	RevealedAt   *time.Time `json:"revealedAt,omitempty" meddler:"revealed_at,localtime"`
+	CreatedAt    time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt    time.Time  `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// checkProblemHints cleans up the hints in a problem bundle and makes sure
+// each one refers to a real step, has a usable trigger, and has something to say.
+func checkProblemHints(hints []*ProblemHint, steps []*ProblemStep) error {
+	seen := make(map[[2]int64]bool)
+	for _, hint := range hints {
+		hint.Test = strings.TrimSpace(hint.Test)
+		hint.Text = strings.TrimSpace(hint.Text)
+		if hint.Step < 1 || hint.Step > int64(len(steps)) {
+			return fmt.Errorf("hint %d is for step %d, but the problem has %d step(s)", hint.Position, hint.Step, len(steps))
+		}
+		if hint.Position < 1 {
+			return fmt.Errorf("hint for step %d has position %d; positions start at 1", hint.Step, hint.Position)
+		}
+		key := [2]int64{hint.Step, hint.Position}
+		if seen[key] {
+			return fmt.Errorf("step %d has more than one hint %d", hint.Step, hint.Position)
+		}
+		seen[key] = true
+		if hint.Test == "" && hint.Pattern == "" {
+			return fmt.Errorf("hint %d for step %d needs a test name, a pattern, or both", hint.Position, hint.Step)
+		}
+		if hint.Pattern != "" {
+			if _, err := regexp.Compile(hint.Pattern); err != nil {
+				return fmt.Errorf("hint %d for step %d has a bad pattern: %v", hint.Position, hint.Step, err)
+			}
+		}
+		if hint.Text == "" {
+			return fmt.Errorf("hint %d for step %d is empty", hint.Position, hint.Step)
+		}
+		if hint.After < 1 {
+			hint.After = 1
+		}
+	}
+	return nil
+}
+
+// saveProblemHints replaces the hints for a problem.
+// Student progress is keyed by step and position, so it survives an update.
+func saveProblemHints(tx *sql.Tx, problemID int64, hints []*ProblemHint) error {
+	if _, err := tx.Exec(`DELETE FROM problem_hints WHERE problem_id = ?`, problemID); err != nil {
+		return err
+	}
+	for _, hint := range hints {
+		hint.ProblemID = problemID
+		if err := meddler.Insert(tx, "problem_hints", hint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hintTriggered reports whether a failed commit matches a hint's trigger.
+// The pattern is matched against the report card and the output of every command.
+func hintTriggered(hint *ProblemHint, commit *Commit) bool {
+	rc := commit.ReportCard
+	if hint.Test != "" {
+		found := false
+		for _, result := range rc.Results {
+			if result.Name == hint.Test && (result.Outcome == "failed" || result.Outcome == "error") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if hint.Pattern != "" {
+		re, err := regexp.Compile(hint.Pattern)
+		if err != nil {
+			return false
+		}
+		var text strings.Builder
+		fmt.Fprintln(&text, rc.Note)
+		for _, result := range rc.Results {
+			if result.Outcome != "passed" {
+				fmt.Fprintln(&text, result.Details)
+			}
+		}
+		for _, event := range commit.Transcript {
+			switch event.Event {
+			case "stdout", "stderr":
+				text.Write(event.StreamData)
+			case "error":
+				fmt.Fprintln(&text, event.Error)
+			}
+		}
+		if !re.MatchString(text.String()) {
+			return false
+		}
+	}
+	return true
+}
+
+// revealHints records which hints a failed commit triggered and returns the hint
+// revealed as a result, if any. Hints are revealed one at a time in order, so a
+// student who keeps failing the same way gets more help with each attempt.
+func revealHints(tx *sql.Tx, commit *Commit, now time.Time) ([]*ProblemHint, error) {
+	rc := commit.ReportCard
+	if rc == nil || rc.Passed {
+		return nil, nil
+	}
+	hints := []*ProblemHint{}
+	if err := meddler.QueryAll(tx, &hints, `SELECT * FROM problem_hints WHERE problem_id = ? AND step = ? ORDER BY position`,
+		commit.ProblemID, commit.Step); err != nil {
+		return nil, err
+	}
+
+	var revealed []*ProblemHint
+	for _, hint := range hints {
+		if !hintTriggered(hint, commit) {
+			continue
+		}
+		progress := new(HintProgress)
+		err := meddler.QueryRow(tx, progress, `SELECT * FROM hint_progress WHERE assignment_id = ? AND problem_id = ? AND step = ? AND position = ?`,
+			commit.AssignmentID, hint.ProblemID, hint.Step, hint.Position)
+		if err == sql.ErrNoRows {
+			progress = &HintProgress{
+				AssignmentID: commit.AssignmentID,
+				ProblemID:    hint.ProblemID,
+				Step:         hint.Step,
+				Position:     hint.Position,
+				CreatedAt:    now,
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		progress.Failures++
+		progress.UpdatedAt = now
+		if progress.RevealedAt == nil && progress.Failures >= hint.After && len(revealed) == 0 {
+			progress.RevealedAt = &now
+			revealed = append(revealed, hint)
+		}
+		if err := meddler.Save(tx, "hint_progress", progress); err != nil {
+			return nil, err
+		}
+	}
+	return revealed, nil
+}
+
+// GetAssignmentProblemStepHints handles requests to
+// /assignments/:assignment_id/problems/:problem_id/steps/:step/hints,
+// returning the hints already revealed to the student for the step.
+func GetAssignmentProblemStepHints(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	stepN, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if currentUser.Admin {
+		err = meddler.Load(tx, "assignments", assignment, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	hints := []*ProblemHint{}
+	if err := meddler.QueryAll(tx, &hints, `SELECT problem_hints.* FROM problem_hints JOIN hint_progress `+
+		`ON problem_hints.problem_id = hint_progress.problem_id AND problem_hints.step = hint_progress.step AND problem_hints.position = hint_progress.position `+
+		`WHERE hint_progress.assignment_id = ? AND hint_progress.problem_id = ? AND hint_progress.step = ? AND hint_progress.revealed_at IS NOT NULL `+
+		`ORDER BY problem_hints.position`, assignment.ID, problemID, stepN); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, hints)
+}
+
+// HintUsage summarizes how a hint has been used by the students in a course.
+type HintUsage struct {
+	ProblemID int64  `json:"problemID" meddler:"problem_id"`
+	Unique    string `json:"unique" meddler:"unique_id"`
+	Step      int64  `json:"step" meddler:"step"`
+	Position  int64  `json:"position" meddler:"position"`
+	Text      string `json:"text" meddler:"hint"`
+	Triggered int64  `json:"triggered" meddler:"triggered"` // students whose commits triggered it
+	Revealed  int64  `json:"revealed" meddler:"revealed"`   // students who were shown it
+	Failures  int64  `json:"failures" meddler:"failures"`   // failed commits that triggered it
+}
+
+// GetCourseHintUsage handles requests to /courses/:course_id/hint_usage,
+// returning a summary of how often each hint was triggered and revealed in the course,
+// optionally filtered by problem_id and section_id. Only administrators and instructors of the course may request it.
+func GetCourseHintUsage(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return
+		}
+	}
+
+	where := ` WHERE assignments.course_id = ?`
+	args := []interface{}{courseID}
+	if s := r.FormValue("problem_id"); s != "" {
+		problemID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_id: %v", err)
+			return
+		}
+		where += ` AND hint_progress.problem_id = ?`
+		args = append(args, problemID)
+	}
+	scope, scopeArgs, ok := sectionWhere(w, r, tx, courseID, currentUser)
+	if !ok {
+		return
+	}
+	where += scope
+	args = append(args, scopeArgs...)
+
+	usage := []*HintUsage{}
+	if err := meddler.QueryAll(tx, &usage, `SELECT problem_hints.problem_id, problems.unique_id, problem_hints.step, problem_hints.position, problem_hints.hint, `+
+		`COUNT(1) AS triggered, COUNT(hint_progress.revealed_at) AS revealed, SUM(hint_progress.failures) AS failures `+
+		`FROM hint_progress JOIN assignments ON hint_progress.assignment_id = assignments.id `+
+		`JOIN problem_hints ON problem_hints.problem_id = hint_progress.problem_id AND problem_hints.step = hint_progress.step AND problem_hints.position = hint_progress.position `+
+		`JOIN problems ON problem_hints.problem_id = problems.id`+where+
+		` GROUP BY problem_hints.problem_id, problem_hints.step, problem_hints.position `+
+		`ORDER BY problems.unique_id, problem_hints.step, problem_hints.position`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newHTTPServer returns the server for whichever roles are running, with
+// explicit limits instead of the net/http defaults, which never time out
+// idle or half-sent requests. When a class opens an assignment at once,
+// each LMS iframe brings a burst of short-lived connections, and those
+// defaults let abandoned ones pile up.
+//
+// There is no overall read or write timeout: grading sockets and archive
+// downloads legitimately run for minutes, and a deadline set before a socket
+// is hijacked stays on the connection. Request bodies are bounded by size instead.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(Config.ReadHeaderTimeout) * time.Second,
+		IdleTimeout:       time.Duration(Config.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    Config.MaxHeaderBytes,
+		ErrorLog: log.New(&filterWriter{
+			dst: log.Default().Writer(),
+		}, "", log.Lshortfile),
+	}
+}
+
+// enableHTTP2 turns on HTTP/2 for a TLS server, so a browser can send its
+// API calls and preflights over one connection instead of opening several.
+// It must be called after the server's TLSConfig is set.
+func enableHTTP2(server *http.Server) error {
+	return http2.ConfigureServer(server, &http2.Server{
+		MaxConcurrentStreams: Config.MaxConcurrentStreams,
+		IdleTimeout:          server.IdleTimeout,
+	})
+}
+
+// listen opens a listener for each address in the config file's listen list.
+// An address is host:port or unix:/path/to/socket. An IPv4 or IPv6 literal
+// host listens on that family only, so "0.0.0.0:443" and "[::]:443" can both
+// be listed; a name or empty host listens on every family the system offers.
+func listen(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := listenOne(addr)
+		if err != nil {
+			for _, elt := range listeners {
+				elt.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func listenOne(addr string) (net.Listener, error) {
+	if path, found := strings.CutPrefix(addr, "unix:"); found {
+		// clear out a socket left behind by an earlier run
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("listening on %s: %v", addr, err)
+		}
+		if err := os.Chmod(path, 0660); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("setting permissions on %s: %v", path, err)
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen address %q must be host:port or unix:/path", addr)
+	}
+	network := "tcp"
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			network = "tcp4"
+		} else {
+			network = "tcp6"
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", addr, err)
+	}
+	return l, nil
+}
+
+// shutdownTimeout is how long requests and grading jobs in progress
+// get to finish when the server is told to stop.
+const shutdownTimeout = 30 * time.Second
+
+// openListeners returns the sockets systemd passed us if the service was
+// socket activated. Otherwise it opens the addresses in the config file,
+// or defaultAddr if none are listed.
+func openListeners(defaultAddr string) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	if len(Config.Listen) == 0 {
+		Config.Listen = []string{defaultAddr}
+	}
+	return listen(Config.Listen)
+}
+
+// serve runs the server on every listener, with TLS if useTLS is set,
+// and tells systemd it is ready. It returns when any listener fails, or
+// after a graceful shutdown on SIGTERM or SIGINT: new connections are
+// refused, and open requests and grading jobs get shutdownTimeout to finish.
+func serve(server *http.Server, listeners []net.Listener, useTLS bool) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("accepting connections on %s", l.Addr())
+		go func(l net.Listener) {
+			if useTLS {
+				errs <- server.ServeTLS(l, "", "")
+			} else {
+				errs <- server.Serve(l)
+			}
+		}(l)
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("error notifying systemd: %v", err)
+	}
+	if interval := systemdWatchdogInterval(); interval > 0 {
+		go runSystemdWatchdog(interval)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Printf("received %v, shutting down", sig)
+	}
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Printf("error notifying systemd: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	// grading sockets are hijacked, so Shutdown does not wait for them
+	for jobQueue.busy() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("giving up on %d grading jobs still running", jobQueue.busy())
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/russross/codegrinder/sdk"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// ImageBuild records a container image built for a problem type from its manifest.
+// Digest is the manifest's content digest and Image is the tag it was built under.
+type ImageBuild struct {
+	ProblemType string    `json:"problemType" meddler:"problem_type"`
+	Digest      string    `json:"digest" meddler:"digest"`
+	Image       string    `json:"image" meddler:"image"`
+	ImageID     string    `json:"imageID" meddler:"image_id"`
+	Pushed      bool      `json:"pushed" meddler:"pushed"`
+	BuiltAt     time.Time `json:"builtAt" meddler:"built_at,localtime"`
+}
+
+// ProblemConfirmation records the image each problem type of a problem was
+// using when that version of the problem was confirmed. Digest is empty if the
+// image was not built by "codegrinder images build".
+type ProblemConfirmation struct {
+	ID               int64     `json:"id" meddler:"id,pk"`
+	ProblemID        int64     `json:"problemID" meddler:"problem_id"`
+	ProblemUpdatedAt time.Time `json:"problemUpdatedAt" meddler:"problem_updated_at,localtime"`
+	ProblemType      string    `json:"problemType" meddler:"problem_type"`
+	Image            string    `json:"image" meddler:"image"`
+	Digest           string    `json:"digest" meddler:"digest"`
+	UserID           int64     `json:"userID" meddler:"user_id"`
+	ConfirmedAt      time.Time `json:"confirmedAt" meddler:"confirmed_at,localtime"`
+}
+
+// imagesCommand handles "codegrinder images build" and "codegrinder images list".
+func imagesCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: codegrinder images build|list [options] [problem type...]")
+	}
+	switch args[0] {
+	case "build":
+		imagesBuildCommand(args[1:])
+	case "list":
+		imagesListCommand(args[1:])
+	default:
+		log.Fatalf("unknown images command %q: expected build or list", args[0])
+	}
+}
+
+// imagesBuildCommand builds the image for each problem type that has a
+// manifest, tags it with the manifest's content digest, and points the
+// problem type at the new tag. A tag that is already present is not built again
+// unless -force is given.
+func imagesBuildCommand(args []string) {
+	flags := flag.NewFlagSet("images build", flag.ExitOnError)
+	dir := flags.String("manifests", Config.ImageManifests, "directory of per-problem-type image manifests")
+	push := flags.Bool("push", false, "push each image to its registry after building it")
+	force := flags.Bool("force", false, "build images even if the tag is already present, pulling base images again")
+	dryRun := flags.Bool("n", false, "show what would be built without building anything")
+	flags.Parse(args)
+
+	manifests, err := imageManifests(*dir, flags.Args())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	db := setupDB(Config.SQLite3Path)
+	defer db.Close()
+
+	// built keeps one build per tag, since problem types often share an image
+	built := make(map[string]*ImageBuild)
+	failed := 0
+	var names []string
+	for name := range manifests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		manifest := manifests[name]
+		build, err := buildProblemTypeImage(db, name, manifest, built, *push, *force, *dryRun)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			failed++
+			continue
+		}
+		if build != nil {
+			built[build.Image] = build
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d images failed", failed, len(manifests))
+	}
+}
+
+// imageManifests loads the manifests in a directory, or only those for the named problem types.
+func imageManifests(dir string, names []string) (map[string]*sdk.ImageManifest, error) {
+	if len(names) == 0 {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			names = append(names, strings.TrimSuffix(filepath.Base(match), ".json"))
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no image manifests found in %s", dir)
+		}
+	}
+	manifests := make(map[string]*sdk.ImageManifest)
+	for _, name := range names {
+		manifest, err := sdk.LoadImageManifest(filepath.Join(dir, name+".json"))
+		if err != nil {
+			return nil, err
+		}
+		manifests[name] = manifest
+	}
+	return manifests, nil
+}
+
+// buildProblemTypeImage builds (or reuses) the image for one problem type,
+// records it, and points the problem type at it. It returns nil for a dry run.
+func buildProblemTypeImage(db *sql.DB, name string, manifest *sdk.ImageManifest, built map[string]*ImageBuild, push, force, dryRun bool) (*ImageBuild, error) {
+	var current string
+	if err := db.QueryRow(`SELECT image FROM problem_types WHERE name = ?`, name).Scan(&current); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no such problem type; register it before building its image")
+		}
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	digest, err := manifest.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("computing digest of %s: %v", manifest.Context, err)
+	}
+	tag := sdk.ImageTag(current, digest)
+
+	build := built[tag]
+	switch {
+	case build != nil:
+		log.Printf("%s: using %s, built above", name, tag)
+	case dryRun:
+		state := "would build"
+		if !force && exec.Command(containerEngine, "image", "inspect", tag).Run() == nil {
+			state = "already built"
+		}
+		log.Printf("%s: %s %s from %s (currently %s)", name, state, tag, manifest.Context, current)
+		return nil, nil
+	default:
+		if !force && exec.Command(containerEngine, "image", "inspect", tag).Run() == nil {
+			log.Printf("%s: %s is already built", name, tag)
+		} else {
+			log.Printf("%s: building %s from %s", name, tag, manifest.Context)
+			args := []string{"build", "--pull", "--file", filepath.Join(manifest.Context, manifest.Dockerfile), "--tag", tag}
+			if force {
+				args = append(args, "--no-cache")
+			}
+			if manifest.Platform != "" {
+				args = append(args, "--platform", manifest.Platform)
+			}
+			for key, value := range manifest.Args {
+				args = append(args, "--build-arg", key+"="+value)
+			}
+			args = append(args, manifest.Context)
+			cmd := exec.Command(containerEngine, args...)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return nil, fmt.Errorf("build failed: %v", err)
+			}
+		}
+		id, err := exec.Command(containerEngine, "image", "inspect", "--format", "{{.Id}}", tag).Output()
+		if err != nil {
+			return nil, fmt.Errorf("inspecting %s: %v", tag, err)
+		}
+		build = &ImageBuild{Digest: digest, Image: tag, ImageID: strings.TrimSpace(string(id))}
+		if push {
+			log.Printf("%s: pushing %s", name, tag)
+			cmd := exec.Command(containerEngine, "push", tag)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return nil, fmt.Errorf("push failed: %v", err)
+			}
+			build.Pushed = true
+		}
+	}
+
+	// record the build and switch the problem type to it
+	elt := *build
+	elt.ProblemType = name
+	elt.BuiltAt = time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM image_builds WHERE problem_type = ? AND digest = ?`, name, digest); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if err := meddler.Insert(tx, "image_builds", &elt); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if _, err := tx.Exec(`UPDATE problem_types SET image = ? WHERE name = ?`, tag, name); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if current != tag {
+		log.Printf("%s: image changed from %s to %s; daycares must pull it before grading", name, current, tag)
+	}
+	return build, nil
+}
+
+// imagesListCommand prints the images built for each problem type, marking
+// the one each problem type uses now.
+func imagesListCommand(args []string) {
+	flags := flag.NewFlagSet("images list", flag.ExitOnError)
+	flags.Parse(args)
+
+	db := setupDB(Config.SQLite3Path)
+	defer db.Close()
+
+	where, params := "", []interface{}{}
+	if len(flags.Args()) > 0 {
+		where = ` WHERE problem_types.name IN (?` + strings.Repeat(`, ?`, len(flags.Args())-1) + `)`
+		for _, name := range flags.Args() {
+			params = append(params, name)
+		}
+	}
+	rows, err := db.Query(`SELECT problem_types.name, problem_types.image, `+
+		`COALESCE(image_builds.image, ''), COALESCE(image_builds.digest, ''), COALESCE(image_builds.built_at, '') `+
+		`FROM problem_types LEFT JOIN image_builds ON problem_types.name = image_builds.problem_type`+where+
+		` ORDER BY problem_types.name, image_builds.built_at DESC`, params...)
+	if err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	defer rows.Close()
+	prev := ""
+	for rows.Next() {
+		var name, current, image, digest, builtAt string
+		if err := rows.Scan(&name, &current, &image, &digest, &builtAt); err != nil {
+			log.Fatalf("db error: %v", err)
+		}
+		if name != prev {
+			fmt.Printf("%s: %s\n", name, current)
+			prev = name
+		}
+		if image == "" {
+			fmt.Printf("    (no builds)\n")
+			continue
+		}
+		mark := " "
+		if image == current {
+			mark = "*"
+		}
+		fmt.Printf("  %s %s  digest %s  built %s\n", mark, image, digest, builtAt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+}
+
+// recordProblemConfirmation notes the image each of a problem's problem types
+// was using when this version of the problem was confirmed.
+func recordProblemConfirmation(tx *sql.Tx, problem *Problem, problemTypes map[string]*ProblemType, userID int64, now time.Time) error {
+	for name, problemType := range problemTypes {
+		image := problemType.Image
+		digest := ""
+		err := tx.QueryRow(`SELECT digest FROM image_builds WHERE problem_type = ? AND image = ? ORDER BY built_at DESC LIMIT 1`, name, image).Scan(&digest)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		confirmation := &ProblemConfirmation{
+			ProblemID:        problem.ID,
+			ProblemUpdatedAt: problem.UpdatedAt,
+			ProblemType:      name,
+			Image:            image,
+			Digest:           digest,
+			UserID:           userID,
+			ConfirmedAt:      now,
+		}
+		if err := meddler.Insert(tx, "problem_confirmations", confirmation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetProblemConfirmations handles requests to /problems/:problem_id/confirmations,
+// returning the image each version of a problem was confirmed against, newest first.
+func GetProblemConfirmations(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	confirmations := []*ProblemConfirmation{}
+	if err := meddler.QueryAll(tx, &confirmations, `SELECT * FROM problem_confirmations WHERE problem_id = ? ORDER BY confirmed_at DESC, problem_type`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, confirmations)
+}
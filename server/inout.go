@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// runAndDiffInOut runs command once for each test case in the files copied
+// into the container and records the results in the report card.
+func runAndDiffInOut(n *Nanny, command string) {
+	names := InOutTestNames(n.Uploaded)
+	if len(names) == 0 {
+		n.ReportCard.LogAndFailf("No test cases found in %s", InOutTestDir)
+		return
+	}
+
+	shared := DefaultInOutNormalization()
+	if contents, present := n.Uploaded[path.Join(InOutTestDir, InOutNormalizeFile)]; present {
+		if err := shared.Parse(string(contents)); err != nil {
+			n.ReportCard.LogAndFailf("%s/%s: %v", InOutTestDir, InOutNormalizeFile, err)
+			return
+		}
+	}
+
+	passed := 0
+	for _, name := range names {
+		input := path.Join(InOutTestDir, name+".in")
+		expected, present := n.Uploaded[path.Join(InOutTestDir, name+".out")]
+		if !present {
+			n.ReportCard.LogAndFailf("test case %s has no expected output", name)
+			continue
+		}
+		norm := shared.Clone()
+		if contents, present := n.Uploaded[path.Join(InOutTestDir, name+".normalize")]; present {
+			if err := norm.Parse(string(contents)); err != nil {
+				n.ReportCard.LogAndFailf("%s/%s.normalize: %v", InOutTestDir, name, err)
+				continue
+			}
+		}
+
+		cmd := []string{"sh", "-c", command + " < '" + input + "'"}
+		if n.OS == "windows" {
+			cmd = []string{"cmd", "/c", command + ` < "` + strings.ReplaceAll(input, "/", `\`) + `"`}
+		}
+		stdout, _, _, status, err := n.Exec(cmd)
+		switch {
+		case err != nil:
+			n.ReportCard.LogAndFailf("Error running test case %s: %v", name, err)
+			return
+		case status > 127:
+			n.ReportCard.AddFailedResult(name, fmt.Sprintf("crashed with exit status %d\n", status), input)
+		case status != 0:
+			n.ReportCard.AddFailedResult(name, fmt.Sprintf("exited with status %d\n", status), input)
+		default:
+			// the output has been redacted, so the expected output must be too
+			if report := norm.Diff(n.redact(expected), stdout.Bytes()); report != "" {
+				n.ReportCard.AddFailedResult(name, report, input)
+			} else {
+				n.ReportCard.AddPassedResult(name, "")
+				passed++
+			}
+		}
+		if n.WasKilled() != "" || time.Now().After(n.Deadline) {
+			break
+		}
+	}
+
+	note := fmt.Sprintf("Passed %d/%d tests in %v", passed, len(names), time.Since(n.Start))
+	if n.ReportCard.Note != "" {
+		note += ", " + n.ReportCard.Note
+	}
+	n.ReportCard.Note = note
+	n.ReportCard.Passed = n.ReportCard.Passed && passed == len(names)
+}
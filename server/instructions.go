@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-martini/martini"
+	. "github.com/russross/codegrinder/types"
+	"golang.org/x/net/html"
+)
+
+// instructionsPolicy keeps the browser from running anything that slipped
+// into the instructions. Images are inlined as data URIs, so nothing else needs to load.
+const instructionsPolicy = "default-src 'none'; img-src data:; style-src 'unsafe-inline'"
+
+// requestLocale picks the locale for instructions: a locale=<...> parameter
+// if present, then the locale the LMS gave for the user, then the browser's
+// first choice.
+func requestLocale(r *http.Request, currentUser *User) string {
+	if locale := r.FormValue("locale"); locale != "" {
+		return locale
+	}
+	if currentUser.Locale != "" {
+		return currentUser.Locale
+	}
+	first := strings.Split(r.Header.Get("Accept-Language"), ",")[0]
+	return strings.TrimSpace(strings.Split(first, ";")[0])
+}
+
+// cleanInstructions parses stored instructions, sanitizes them again (older
+// instructions were stored before they were sanitized), and points links to
+// doc files at prefix.
+func cleanInstructions(instructions, prefix string) (*html.Node, error) {
+	doc, err := html.Parse(strings.NewReader(instructions))
+	if err != nil {
+		return nil, err
+	}
+	SanitizeHTML(doc)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			for i, a := range n.Attr {
+				if _, ok := AttachmentName(a.Val); a.Key == "href" && ok {
+					n.Attr[i].Val = prefix + a.Val
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return doc, nil
+}
+
+// GetProblemStepInstructions handles requests to /problems/:problem_id/steps/:step/instructions,
+// returning the instructions for a step as an html page that can be linked
+// to from the LMS. Links to files in the doc directory are served from
+// /problems/:problem_id/steps/:step/attachments/.
+//
+// If parameter locale=<...> present, the translation for that locale is returned if there is one.
+func GetProblemStepInstructions(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
+	problemStep, ok := loadProblemStep(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	problemStep.Localize(requestLocale(r, currentUser))
+
+	doc, err := cleanInstructions(problemStep.Instructions, "attachments/")
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error parsing instructions: %v", err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error rendering instructions: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", instructionsPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// GetProblemStepAttachment handles requests to /problems/:problem_id/steps/:step/attachments/**,
+// returning a file from the step's doc directory.
+// Anything that a browser might run is sent as a download instead of being displayed.
+func GetProblemStepAttachment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	problemStep, ok := loadProblemStep(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	name, ok := AttachmentName(params["_1"])
+	if !ok {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "invalid attachment name %q", params["_1"])
+		return
+	}
+	contents, present := problemStep.Files[filepath.Join("doc", filepath.FromSlash(name))]
+	if !present {
+		loggedHTTPErrorf(w, http.StatusNotFound, "attachment %q not found", name)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	switch {
+	case contentType == "":
+		contentType = "application/octet-stream"
+		fallthrough
+	case !inlineAttachment(contentType):
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", instructionsPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(contents)
+}
+
+// inlineAttachment reports whether a type of attachment is safe to show in the browser.
+func inlineAttachment(contentType string) bool {
+	base, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case base == "image/svg+xml":
+		return false
+	case strings.HasPrefix(base, "image/"), base == "application/pdf", base == "text/plain", base == "text/csv":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Kinds of suspicious patterns found by the integrity analysis.
+const (
+	integrityJump = "jump" // a step went from 0% to 100% in one attempt, soon after the last one
+	integrityTwin = "twin" // near-identical files submitted within seconds of another student's
+)
+
+// Review states of an integrity flag.
+const (
+	integrityOpen      = "open"
+	integrityDismissed = "dismissed"
+	integrityConfirmed = "confirmed"
+)
+
+var integrityStatuses = []string{integrityOpen, integrityDismissed, integrityConfirmed}
+
+// Defaults for the time windows used by the integrity analysis.
+const (
+	defaultJumpMinutes = 5
+	defaultTwinSeconds = 60
+)
+
+// IntegrityFlag is an entry in a course's academic-integrity review queue.
+// A flag is only a reason to look at the student's work; it is never acted on
+// automatically. For twin flags, the other fields name the earlier submission.
+type IntegrityFlag struct {
+	ID                int64      `json:"id" meddler:"id,pk"`
+	CourseID          int64      `json:"courseID" meddler:"course_id"`
+	Kind              string     `json:"kind" meddler:"kind"`
+	AssignmentID      int64      `json:"assignmentID" meddler:"assignment_id"`
+	UserID            int64      `json:"userID" meddler:"user_id"`
+	ProblemID         int64      `json:"problemID" meddler:"problem_id"`
+	Step              int64      `json:"step" meddler:"step"`
+	CommitID          int64      `json:"commitID,omitempty" meddler:"commit_id,zeroisnull"`
+	OtherAssignmentID int64      `json:"otherAssignmentID,omitempty" meddler:"other_assignment_id"`
+	OtherUserID       int64      `json:"otherUserID,omitempty" meddler:"other_user_id,zeroisnull"`
+	OtherCommitID     int64      `json:"otherCommitID,omitempty" meddler:"other_commit_id,zeroisnull"`
+	Detail            string     `json:"detail" meddler:"detail"`
+	Status            string     `json:"status" meddler:"status"`
+	Note              string     `json:"note,omitempty" meddler:"note"`
+	ReviewedBy        int64      `json:"reviewedBy,omitempty" meddler:"reviewed_by,zeroisnull"`
+	ReviewedAt        *time.Time `json:"reviewedAt,omitempty" meddler:"reviewed_at,localtime"`
+	CreatedAt         time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt         time.Time  `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// scoreEvent is one graded attempt at a step, as recorded in step_scores.
+type scoreEvent struct {
+	AssignmentID int64     `meddler:"assignment_id"`
+	UserID       int64     `meddler:"user_id"`
+	ProblemID    int64     `meddler:"problem_id"`
+	Step         int64     `meddler:"step"`
+	Score        float64   `meddler:"score"`
+	CreatedAt    time.Time `meddler:"created_at,localtime"`
+}
+
+// findScoreJumps looks for graded attempts that scored 100% right after an
+// attempt that scored 0%, with less than window between them. The first attempt
+// at a step counts as a jump from 0% if it came soon after the student passed
+// the step before it.
+func findScoreJumps(tx *sql.Tx, courseID, problemID int64, window time.Duration) ([]*IntegrityFlag, error) {
+	where := ` WHERE assignments.course_id = ? AND NOT assignments.instructor`
+	args := []interface{}{courseID}
+	if problemID > 0 {
+		where += ` AND step_scores.problem_id = ?`
+		args = append(args, problemID)
+	}
+	events := []*scoreEvent{}
+	if err := meddler.QueryAll(tx, &events, `SELECT step_scores.assignment_id, assignments.user_id, step_scores.problem_id, `+
+		`step_scores.step, step_scores.score, step_scores.created_at `+
+		`FROM step_scores JOIN assignments ON step_scores.assignment_id = assignments.id`+where+
+		` ORDER BY step_scores.assignment_id, step_scores.problem_id, step_scores.step, step_scores.created_at, step_scores.id`, args...); err != nil {
+		return nil, err
+	}
+
+	type key struct{ assignmentID, problemID, step int64 }
+	passed := make(map[key]time.Time)
+	var flags []*IntegrityFlag
+	var previous *scoreEvent
+	for _, event := range events {
+		here := key{event.AssignmentID, event.ProblemID, event.Step}
+		if event.Score >= 1.0 {
+			if _, present := passed[here]; !present {
+				passed[here] = event.CreatedAt
+			}
+		}
+
+		// find the attempt this one followed
+		var from time.Time
+		fromScore := 0.0
+		if previous != nil && previous.AssignmentID == here.assignmentID && previous.ProblemID == here.problemID && previous.Step == here.step {
+			from, fromScore = previous.CreatedAt, previous.Score
+		} else if when, present := passed[key{event.AssignmentID, event.ProblemID, event.Step - 1}]; present {
+			from = when
+		}
+		previous = event
+
+		if from.IsZero() || fromScore > 0.0 || event.Score < 1.0 {
+			continue
+		}
+		elapsed := event.CreatedAt.Sub(from)
+		if elapsed < 0 || elapsed > window {
+			continue
+		}
+		flags = append(flags, &IntegrityFlag{
+			CourseID:     courseID,
+			Kind:         integrityJump,
+			AssignmentID: event.AssignmentID,
+			UserID:       event.UserID,
+			ProblemID:    event.ProblemID,
+			Step:         event.Step,
+			Detail: fmt.Sprintf("step %d went from 0%% to 100%% in one attempt, %v after the previous graded attempt",
+				event.Step, elapsed.Round(time.Second)),
+		})
+	}
+	return flags, nil
+}
+
+// submissionFingerprint summarizes the files a student changed from the
+// starter files for a step, ignoring all whitespace. It returns an empty
+// string if the student did not change anything.
+func submissionFingerprint(step *ProblemStep, files map[string][]byte) string {
+	squash := func(contents []byte) string {
+		return strings.Join(strings.Fields(string(contents)), "")
+	}
+	var names []string
+	for name, contents := range files {
+		if starter, present := step.Files[name]; present && squash(starter) == squash(contents) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\x00", name, squash(files[name]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// findTwinSubmissions looks for students whose latest graded files at a step
+// match another student's, apart from whitespace, and were graded less than
+// window after the other student's. Only the latest commit at each step is
+// kept, so earlier twins that have since been changed are not found.
+func findTwinSubmissions(tx *sql.Tx, courseID, problemID int64, window time.Duration) ([]*IntegrityFlag, error) {
+	where := ` WHERE assignments.course_id = ? AND NOT assignments.instructor AND commits.action = 'grade' AND NOT commits.practice`
+	args := []interface{}{courseID}
+	if problemID > 0 {
+		where += ` AND commits.problem_id = ?`
+		args = append(args, problemID)
+	}
+	commits := []*Commit{}
+	if err := meddler.QueryAll(tx, &commits, `SELECT commits.* FROM commits `+
+		`JOIN assignments ON commits.assignment_id = assignments.id`+where+
+		` ORDER BY commits.updated_at, commits.id`, args...); err != nil {
+		return nil, err
+	}
+	if err := loadCommitBlobs(commits...); err != nil {
+		return nil, err
+	}
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments WHERE course_id = ? AND NOT instructor`, courseID); err != nil {
+		return nil, err
+	}
+	owners := make(map[int64]int64)
+	for _, assignment := range assignments {
+		owners[assignment.ID] = assignment.UserID
+	}
+
+	// group the commits by step and fingerprint, oldest first
+	type group struct {
+		problemID, step int64
+		fingerprint     string
+	}
+	steps := make(map[[2]int64]*ProblemStep)
+	groups := make(map[group][]*Commit)
+	for _, commit := range commits {
+		at := [2]int64{commit.ProblemID, commit.Step}
+		step, present := steps[at]
+		if !present {
+			step = new(ProblemStep)
+			if err := meddler.QueryRow(tx, step, `SELECT * FROM problem_steps WHERE problem_id = ? AND step = ?`, commit.ProblemID, commit.Step); err != nil {
+				return nil, err
+			}
+			if err := loadStepFiles(step); err != nil {
+				return nil, err
+			}
+			steps[at] = step
+		}
+		if fingerprint := submissionFingerprint(step, commit.Files); fingerprint != "" {
+			g := group{commit.ProblemID, commit.Step, fingerprint}
+			groups[g] = append(groups[g], commit)
+		}
+	}
+
+	var flags []*IntegrityFlag
+	for _, twins := range groups {
+		for i, later := range twins {
+			for _, earlier := range twins[:i] {
+				elapsed := later.UpdatedAt.Sub(earlier.UpdatedAt)
+				if elapsed > window || owners[earlier.AssignmentID] == owners[later.AssignmentID] {
+					continue
+				}
+				flags = append(flags, &IntegrityFlag{
+					CourseID:          courseID,
+					Kind:              integrityTwin,
+					AssignmentID:      later.AssignmentID,
+					UserID:            owners[later.AssignmentID],
+					ProblemID:         later.ProblemID,
+					Step:              later.Step,
+					CommitID:          later.ID,
+					OtherAssignmentID: earlier.AssignmentID,
+					OtherUserID:       owners[earlier.AssignmentID],
+					OtherCommitID:     earlier.ID,
+					Detail: fmt.Sprintf("step %d was graded %v after a near-identical submission from another student",
+						later.Step, elapsed.Round(time.Second)),
+				})
+			}
+		}
+	}
+	return flags, nil
+}
+
+// parseWindow reads a positive whole number of units from a form value,
+// falling back to the default if it is missing.
+func parseWindow(w http.ResponseWriter, r *http.Request, field string, fallback int64, unit time.Duration) (time.Duration, bool) {
+	n := fallback
+	if s := r.FormValue(field); s != "" {
+		var err error
+		if n, err = strconv.ParseInt(s, 10, 64); err != nil || n <= 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "%s must be a positive whole number", field)
+			return 0, false
+		}
+	}
+	return time.Duration(n) * unit, true
+}
+
+// PostCourseIntegrityAnalysis handles requests to /courses/:course_id/integrity_analysis,
+// looking for suspicious patterns in the course's graded work and adding any
+// new ones to the review queue. It returns everything it found, including
+// flags that were already in the queue, with their current review status.
+// jump_minutes and twin_seconds set the time windows; problem_id limits the
+// analysis to one problem.
+func PostCourseIntegrityAnalysis(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	jumpWindow, ok := parseWindow(w, r, "jump_minutes", defaultJumpMinutes, time.Minute)
+	if !ok {
+		return
+	}
+	twinWindow, ok := parseWindow(w, r, "twin_seconds", defaultTwinSeconds, time.Second)
+	if !ok {
+		return
+	}
+	var problemID int64
+	if s := r.FormValue("problem_id"); s != "" {
+		var err error
+		if problemID, err = parseID(w, "problem_id", s); err != nil {
+			return
+		}
+	}
+
+	jumps, err := findScoreJumps(tx, courseID, problemID, jumpWindow)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	twins, err := findTwinSubmissions(tx, courseID, problemID, twinWindow)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error comparing submissions: %v", err)
+		return
+	}
+
+	now := time.Now()
+	found := []*IntegrityFlag{}
+	added := 0
+	for _, flag := range append(jumps, twins...) {
+		existing := new(IntegrityFlag)
+		err := meddler.QueryRow(tx, existing, `SELECT * FROM integrity_flags `+
+			`WHERE kind = ? AND assignment_id = ? AND problem_id = ? AND step = ? AND other_assignment_id = ?`,
+			flag.Kind, flag.AssignmentID, flag.ProblemID, flag.Step, flag.OtherAssignmentID)
+		if err == nil {
+			found = append(found, existing)
+			continue
+		}
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+
+		if flag.CommitID == 0 {
+			commit := new(Commit)
+			err := meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = ? AND problem_id = ? AND step = ?`,
+				flag.AssignmentID, flag.ProblemID, flag.Step)
+			if err != nil && err != sql.ErrNoRows {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			flag.CommitID = commit.ID
+		}
+		flag.Status = integrityOpen
+		flag.CreatedAt = now
+		flag.UpdatedAt = now
+		if err := meddler.Insert(tx, "integrity_flags", flag); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		found = append(found, flag)
+		added++
+	}
+	if added > 0 {
+		log.Printf("integrity analysis by %s (%d) added %d flags to the review queue for course %d",
+			currentUser.Name, currentUser.ID, added, courseID)
+	}
+	render.JSON(http.StatusOK, found)
+}
+
+// GetCourseIntegrityFlags handles requests to /courses/:course_id/integrity_flags,
+// returning the course's review queue, oldest first. Pass status to see only
+// flags that are open, dismissed, or confirmed.
+func GetCourseIntegrityFlags(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	where := ` WHERE course_id = ?`
+	args := []interface{}{courseID}
+	if status := r.FormValue("status"); status != "" {
+		if !validIntegrityStatus(status) {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "unknown status %q; must be one of %s", status, strings.Join(integrityStatuses, ", "))
+			return
+		}
+		where += ` AND status = ?`
+		args = append(args, status)
+	}
+	flags := []*IntegrityFlag{}
+	if err := meddler.QueryAll(tx, &flags, `SELECT * FROM integrity_flags`+where+` ORDER BY created_at, id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, flags)
+}
+
+func validIntegrityStatus(status string) bool {
+	for _, elt := range integrityStatuses {
+		if elt == status {
+			return true
+		}
+	}
+	return false
+}
+
+// PutIntegrityFlag handles requests to /integrity_flags/:flag_id,
+// recording the outcome of a review. Only the status and note are changed.
+// Only instructors, not TAs, can review flags.
+func PutIntegrityFlag(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, review IntegrityFlag, render render.Render) {
+	flagID, err := parseID(w, "flag_id", params["flag_id"])
+	if err != nil {
+		return
+	}
+	flag := new(IntegrityFlag)
+	if err := meddler.Load(tx, "integrity_flags", flag, flagID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !currentUser.Admin {
+		allowed, err := isCourseLeadInstructor(tx, flag.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !allowed {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) cannot review integrity flags for course %d", currentUser.ID, currentUser.Email, flag.CourseID)
+			return
+		}
+	}
+	if !validIntegrityStatus(review.Status) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "unknown status %q; must be one of %s", review.Status, strings.Join(integrityStatuses, ", "))
+		return
+	}
+
+	now := time.Now()
+	flag.Status = review.Status
+	flag.Note = strings.TrimSpace(review.Note)
+	if flag.Status == integrityOpen {
+		flag.ReviewedBy = 0
+		flag.ReviewedAt = nil
+	} else {
+		flag.ReviewedBy = currentUser.ID
+		flag.ReviewedAt = &now
+	}
+	flag.UpdatedAt = now
+	if err := meddler.Update(tx, "integrity_flags", flag); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("%s (%d) marked integrity flag %d for user %d as %s", currentUser.Name, currentUser.ID, flag.ID, flag.UserID, flag.Status)
+	render.JSON(http.StatusOK, flag)
+}
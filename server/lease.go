@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// leaseDuration is how long a lease is held without being renewed.
+// Singleton jobs renew their lease every time they run, so it must be
+// comfortably longer than singletonJobInterval.
+const leaseDuration = 3 * time.Minute
+const singletonJobInterval = time.Minute
+
+// instanceName identifies this TA instance when holding leases.
+var instanceName string
+
+func init() {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	instanceName = fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// acquireLease tries to take or renew the named lease for this instance.
+// It reports whether this instance holds the lease afterward.
+// Only one of several TA instances sharing a database holds a given lease at a time,
+// so the lease holder acts as the leader for the job the lease protects.
+func acquireLease(tx *sql.Tx, name string, now time.Time) (bool, error) {
+	expires := now.Add(leaseDuration)
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO leases (name, holder, expires_at) VALUES (?, ?, ?)`,
+		name, instanceName, expires); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`UPDATE leases SET holder = ?, expires_at = ? WHERE name = ? AND (holder = ? OR expires_at < ?)`,
+		instanceName, expires, name, instanceName, now)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// runSingletonJobs periodically runs background jobs that should only run on
+// one TA instance at a time, using a lease to elect which instance runs them.
+// It never returns.
+func runSingletonJobs(db *sql.DB, dbMutex *sync.Mutex) {
+	leader := false
+	for {
+		time.Sleep(singletonJobInterval)
+
+		dbMutex.Lock()
+		isLeader, err := runCleanupJob(db)
+		dbMutex.Unlock()
+
+		if err != nil {
+			log.Printf("singleton job error: %v", err)
+			continue
+		}
+		if isLeader != leader {
+			if isLeader {
+				log.Printf("instance %s is now running singleton jobs", instanceName)
+			} else {
+				log.Printf("instance %s is no longer running singleton jobs", instanceName)
+			}
+			leader = isLeader
+		}
+	}
+}
+
+// runCleanupJob removes expired login records and daycare registrations
+// if this instance holds the cleanup lease.
+func runCleanupJob(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	isLeader, err := acquireLease(tx, "cleanup", time.Now())
+	if err != nil {
+		return false, err
+	}
+	if isLeader {
+		loginRecords.Lock()
+		err = loginRecords.expire(tx)
+		loginRecords.Unlock()
+		if err != nil {
+			return true, err
+		}
+		if err := daycareRegistrations.Expire(tx); err != nil {
+			return true, err
+		}
+	}
+	return isLeader, tx.Commit()
+}
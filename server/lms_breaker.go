@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// lmsSlotWait is how long a request waits for one of a host's slots
+	// before it is parked in the retry queue instead.
+	lmsSlotWait = 10 * time.Second
+
+	// lmsBreakerFailures is the number of failures in a row that opens a host's circuit.
+	lmsBreakerFailures = 5
+
+	// lmsBreakerCooldown is how long an open circuit turns requests away
+	// before a single trial request is let through.
+	lmsBreakerCooldown = time.Minute
+
+	// maxGradeParkTime is how long a grade post waits for an LMS host to recover
+	// before it is left for the nightly grade sync.
+	maxGradeParkTime = 12 * time.Hour
+)
+
+// lmsUnavailableError means a request to an LMS was not sent because the host
+// is failing or busy. The caller should try again after RetryAt.
+type lmsUnavailableError struct {
+	Host    string
+	Reason  string
+	RetryAt time.Time
+}
+
+func (e *lmsUnavailableError) Error() string {
+	return fmt.Sprintf("LMS host %s is %s, not sending until %s", e.Host, e.Reason, e.RetryAt.Format(time.Kitchen))
+}
+
+// lmsHost limits and watches the requests sent to one LMS host.
+// After lmsBreakerFailures failures in a row its circuit opens, and requests
+// are turned away until the cooldown passes. Then one trial request is sent,
+// and the circuit closes again if it succeeds.
+type lmsHost struct {
+	slots     chan struct{}
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// lmsHosts holds the state of every LMS host that grades have been posted to.
+type lmsHosts struct {
+	sync.Mutex
+	hosts  map[string]*lmsHost
+	client *http.Client
+}
+
+var lmsRequests = lmsHosts{hosts: make(map[string]*lmsHost)}
+
+// get returns the state for a host, creating it if needed. The lock must be held.
+func (l *lmsHosts) get(host string) *lmsHost {
+	h := l.hosts[host]
+	if h == nil {
+		h = &lmsHost{slots: make(chan struct{}, Config.LMSConcurrency)}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// admit checks the host's circuit before a request is sent.
+func (l *lmsHosts) admit(host string, now time.Time) (*lmsHost, error) {
+	l.Lock()
+	defer l.Unlock()
+	h := l.get(host)
+	if now.Before(h.openUntil) {
+		return nil, &lmsUnavailableError{Host: host, Reason: "failing", RetryAt: h.openUntil}
+	}
+	if h.failures >= lmsBreakerFailures {
+		// the cooldown has passed, so let one request through to test the host
+		if h.trial {
+			return nil, &lmsUnavailableError{Host: host, Reason: "being tested", RetryAt: now.Add(lmsBreakerCooldown)}
+		}
+		h.trial = true
+	}
+	return h, nil
+}
+
+// record notes the outcome of a request, opening or closing the host's circuit.
+func (l *lmsHosts) record(host string, h *lmsHost, ok bool, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	h.trial = false
+	if ok {
+		if h.failures >= lmsBreakerFailures {
+			log.Printf("LMS host %s is answering again, resuming grade posts", host)
+		}
+		h.failures = 0
+		h.openUntil = time.Time{}
+		return
+	}
+	h.failures++
+	if h.failures >= lmsBreakerFailures {
+		if h.failures == lmsBreakerFailures {
+			log.Printf("LMS host %s failed %d times in a row, holding grade posts for %v", host, h.failures, lmsBreakerCooldown)
+		}
+		h.openUntil = now.Add(lmsBreakerCooldown)
+	}
+}
+
+// Do sends a request to an LMS, holding one of the host's slots while it runs.
+// If the host's circuit is open or its slots stay busy, the request is not sent
+// and an *lmsUnavailableError is returned. Server errors, rate limiting, and
+// requests that fail or time out count against the host.
+func (l *lmsHosts) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	h, err := l.admit(host, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	case <-time.After(lmsSlotWait):
+		l.Lock()
+		h.trial = false
+		l.Unlock()
+		return nil, &lmsUnavailableError{Host: host, Reason: "busy", RetryAt: time.Now().Add(lmsSlotWait)}
+	}
+	defer func() { <-h.slots }()
+
+	resp, err := l.client.Do(req)
+	ok := err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests
+	l.record(host, h, ok, time.Now())
+	return resp, err
+}
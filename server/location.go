@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// OffSiteCommit summarizes a commit that was submitted from outside the allowed networks.
+type OffSiteCommit struct {
+	CommitID     int64     `json:"commitID" meddler:"commit_id"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	CanvasTitle  string    `json:"canvasTitle" meddler:"canvas_title"`
+	UserID       int64     `json:"userID" meddler:"user_id"`
+	UserName     string    `json:"userName" meddler:"user_name"`
+	UserEmail    string    `json:"userEmail" meddler:"user_email"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	RemoteAddr   string    `json:"remoteAddr" meddler:"remote_addr,zeroisnull"`
+	UserAgent    string    `json:"userAgent" meddler:"user_agent,zeroisnull"`
+	UpdatedAt    time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// trustedProxies are the networks whose X-Forwarded-For header is believed.
+var trustedProxies []*net.IPNet
+
+// setupTrustedProxies parses the trustedProxies list from the config file.
+// A bare address is taken as a network holding only that address.
+func setupTrustedProxies() {
+	trustedProxies = nil
+	for _, elt := range Config.TrustedProxies {
+		elt = strings.TrimSpace(elt)
+		if !strings.Contains(elt, "/") {
+			ip := net.ParseIP(elt)
+			if ip == nil {
+				log.Fatalf("trustedProxies entry %q is not an address or network", elt)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(elt)
+		if err != nil {
+			log.Fatalf("trustedProxies entry %q: %v", elt, err)
+		}
+		trustedProxies = append(trustedProxies, ipnet)
+	}
+}
+
+// isTrustedProxy reports whether an address belongs to one of the trusted proxies.
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP gives the address of the client that made the request.
+// X-Forwarded-For is only believed when the connection comes from a trusted
+// proxy, and then the nearest address in it that is not a trusted proxy is used,
+// since anything further back could have been supplied by the client.
+func clientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !isTrustedProxy(addr) {
+		return addr
+	}
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == "" {
+			continue
+		}
+		addr = hops[i]
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// isOffSite reports whether a submission from the given address falls outside
+// the IP allowlist for the assignment. Assignments without an allowlist are never off site.
+func isOffSite(tx *sql.Tx, assignment *Assignment, addr string) (bool, error) {
+	allowlist := new(IPAllowlist)
+	if err := meddler.QueryRow(tx, allowlist, `SELECT * FROM ip_allowlists WHERE lti_id = ?`, assignment.LtiID); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return true, nil
+	}
+	for _, network := range allowlist.Networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			// networks are validated when saved, so this should not happen
+			loggedErrorf("invalid network %q in IP allowlist %d: %v", network, allowlist.ID, err)
+			continue
+		}
+		if ipnet.Contains(ip) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// loadInstructorAssignment loads an assignment and confirms that the current user
+// is an administrator or an instructor for the course it belongs to.
+func loadInstructorAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) *Assignment {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return nil
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, assignment.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return nil
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, assignment.CourseID)
+			return nil
+		}
+	}
+	return assignment
+}
+
+// GetAssignmentIPAllowlist handles requests to /assignments/:assignment_id/ip_allowlist,
+// returning the IP allowlist that applies to the assignment.
+func GetAssignmentIPAllowlist(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+
+	allowlist := new(IPAllowlist)
+	if err := meddler.QueryRow(tx, allowlist, `SELECT * FROM ip_allowlists WHERE lti_id = ?`, assignment.LtiID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, allowlist)
+}
+
+// PutAssignmentIPAllowlist handles requests to /assignments/:assignment_id/ip_allowlist,
+// setting the list of networks (in CIDR notation) that submissions are expected to come from.
+// The allowlist applies to every student working on the same Canvas assignment.
+func PutAssignmentIPAllowlist(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, allowlist IPAllowlist, render render.Render) {
+	now := time.Now()
+
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+	if len(allowlist.Networks) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "IP allowlist must include at least one network")
+		return
+	}
+	for i, network := range allowlist.Networks {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "invalid network %q: %v", network, err)
+			return
+		}
+		allowlist.Networks[i] = ipnet.String()
+	}
+
+	old := new(IPAllowlist)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM ip_allowlists WHERE lti_id = ?`, assignment.LtiID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		allowlist.ID = 0
+		allowlist.CreatedAt = now
+	} else {
+		allowlist.ID = old.ID
+		allowlist.CreatedAt = old.CreatedAt
+	}
+	allowlist.CourseID = assignment.CourseID
+	allowlist.LtiID = assignment.LtiID
+	allowlist.UpdatedAt = now
+
+	if err := meddler.Save(tx, "ip_allowlists", &allowlist); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &allowlist)
+}
+
+// DeleteAssignmentIPAllowlist handles requests to /assignments/:assignment_id/ip_allowlist,
+// removing any location restrictions from the assignment.
+func DeleteAssignmentIPAllowlist(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM ip_allowlists WHERE lti_id = ?`, assignment.LtiID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// GetCourseOffSiteCommits handles requests to /courses/:course_id/off_site_commits,
+// returning a summary of every student commit that was flagged as submitted from
+// outside the allowed networks, optionally filtered by section_id.
+// Only administrators and instructors of the course may request it.
+func GetCourseOffSiteCommits(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return
+		}
+	}
+
+	where, args, ok := sectionWhere(w, r, tx, courseID, currentUser)
+	if !ok {
+		return
+	}
+
+	commits := []*OffSiteCommit{}
+	if err := meddler.QueryAll(tx, &commits, `SELECT commits.id AS commit_id, commits.assignment_id, assignments.canvas_title, `+
+		`users.id AS user_id, users.name AS user_name, users.email AS user_email, `+
+		`commits.problem_id, commits.step, commits.remote_addr, commits.user_agent, commits.updated_at `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`JOIN users ON assignments.user_id = users.id `+
+		`WHERE assignments.course_id = ? AND commits.off_site`+where+
+		` ORDER BY commits.updated_at`, append([]interface{}{courseID}, args...)...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, commits)
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sort"
@@ -133,7 +134,15 @@ type LTICartridge struct {
 }
 
 // GetConfigXML handles /lti/config.xml requests, returning an XML file to configure the LMS to use this tool.
-func GetConfigXML(w http.ResponseWriter) {
+//
+// If parameter theme=<...> present, the tool takes its name and icon from that named theme,
+// so each department can install the tool under its own branding.
+func GetConfigXML(w http.ResponseWriter, r *http.Request) {
+	theme, present := namedTheme(r.URL.Query().Get("theme"))
+	if !present {
+		loggedHTTPErrorf(w, http.StatusNotFound, "no theme named %q", r.URL.Query().Get("theme"))
+		return
+	}
 	c := &LTIConfig{
 		Namespace:      "http://www.imsglobal.org/xsd/imslticc_v1p0",
 		NamespaceBLTI:  "http://www.imsglobal.org/xsd/imsbasiclti_v1p0",
@@ -144,8 +153,9 @@ func GetConfigXML(w http.ResponseWriter) {
 			" http://www.imsglobal.org/xsd/imsbasiclti_v1p0 http://www.imsglobal.org/xsd/lti/ltiv1p0/imsbasiclti_v1p0.xsd" +
 			" http://www.imsglobal.org/xsd/imslticm_v1p0 http://www.imsglobal.org/xsd/lti/ltiv1p0/imslticm_v1p0.xsd" +
 			" http://www.imsglobal.org/xsd/imslticp_v1p0 http://www.imsglobal.org/xsd/lti/ltiv1p0/imslticp_v1p0.xsd",
-		Title:       Config.ToolName,
+		Title:       theme.Title,
 		Description: Config.ToolDescription,
+		Icon:        theme.LogoURL,
 		Extensions: LTIConfigExtensions{
 			Platform: "canvas.instructure.com",
 			Extensions: []LTIConfigExtension{
@@ -237,9 +247,15 @@ func getMyURL(r *http.Request) *url.URL {
 
 func checkOAuthSignature(w http.ResponseWriter, r *http.Request) {
 	// make sure this is a signed request
+	// the user named in an unsigned launch is not known to be genuine,
+	// so failures only count against the address, not that user's account
 	r.ParseForm()
+	if throttleAuth(w, r, "") {
+		return
+	}
 	expected := r.Form.Get("oauth_signature")
 	if expected == "" {
+		recordAuthFailure(r, "lti", "", "missing oauth_signature")
 		loggedHTTPErrorf(w, http.StatusUnauthorized, "Missing oauth_signature form field")
 		return
 	}
@@ -260,6 +276,7 @@ func checkOAuthSignature(w http.ResponseWriter, r *http.Request) {
 			context += " lis_person_contact_email_primary=" + val
 		}
 		log.Printf("failed LTI signature on request:%s", context)
+		recordAuthFailure(r, "lti", "", "signature mismatch:"+context)
 		loggedHTTPErrorf(w, http.StatusUnauthorized, "Signature mismatch. This is usually due to an error in the external app setup for CodeGrinder in Canvas. Got %s but expected %s", sig, expected)
 	}
 }
@@ -392,6 +409,26 @@ func LtiProblemSet(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTIR
 	asst := new(Assignment)
 
 	if unique != bootstrapAssignmentName {
+		// a canary may send this launch to a candidate version of the problem set
+		if problemSet, err = canaryProblemSet(tx, problemSet, course, user, form.ResourceLinkID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+
+		// students cannot launch outside the availability window
+		launcher := &Assignment{Roles: form.Roles}
+		if !user.Admin && !user.Author && !launcher.IsInstructorRole() {
+			window, err := closedAvailabilityWindow(tx, problemSet.ID, course.ID, now)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			if window != nil {
+				loggedHTTPErrorf(w, http.StatusForbidden, "This assignment is not available right now: it %s.", describeWindow(window))
+				return
+			}
+		}
+
 		if asst, err = getUpdateAssignment(tx, &form, now, course, problemSet, user); err != nil {
 			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 			return
@@ -403,7 +440,15 @@ func LtiProblemSet(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTIR
 	session.Save(w)
 
 	// redirect to the console
-	key := loginRecords.Insert(user.ID)
+	key, err := loginRecords.Insert(tx, user.ID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if ui == "web" && !webUIFrontendInstalled() {
+		http.Redirect(w, r, webUIAssignmentURL(asst.ID, key), http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, fmt.Sprintf("/%s/?assignment=%d&session=%s", ui, asst.ID, key), http.StatusSeeOther)
 }
 
@@ -466,7 +511,8 @@ func getUpdateUser(tx *sql.Tx, form *LTIRequest, now time.Time) (*User, error) {
 		user.LtiID != form.UserID ||
 		user.ImageURL != form.UserImage ||
 		user.CanvasLogin != form.CanvasUserLoginID ||
-		user.CanvasID != form.CanvasUserID
+		user.CanvasID != form.CanvasUserID ||
+		(form.LaunchPresentationLocale != "" && user.Locale != NormalizeLocale(form.LaunchPresentationLocale))
 
 	// make any changes
 	user.Name = form.PersonNameFull
@@ -475,6 +521,9 @@ func getUpdateUser(tx *sql.Tx, form *LTIRequest, now time.Time) (*User, error) {
 	user.ImageURL = form.UserImage
 	user.CanvasLogin = form.CanvasUserLoginID
 	user.CanvasID = form.CanvasUserID
+	if form.LaunchPresentationLocale != "" {
+		user.Locale = NormalizeLocale(form.LaunchPresentationLocale)
+	}
 	if user.ID > 0 && changed {
 		// if something changed, note the update time
 		log.Printf("user %d (%s) updated because of new LTI request", user.ID, user.Email)
@@ -594,6 +643,15 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 		dateMismatch(asst.DueAt, form.CanvasAssignmentDueAt) ||
 		dateMismatch(asst.LockAt, form.CanvasAssignmentLockAt)
 
+	dueChanged := asst.ID > 0 && dateMismatch(asst.DueAt, form.CanvasAssignmentDueAt)
+
+	// note the user's standing in the course before this launch
+	knownAssignments, instructorAssignments, oldRoles, err := courseRoles(tx, course.ID, user.ID)
+	if err != nil {
+		log.Printf("db error loading roles for user %d in course %d: %v", user.ID, course.ID, err)
+		return nil, err
+	}
+
 	// make any changes
 	asst.CourseID = course.ID
 	asst.ProblemSetID = problemSetID
@@ -610,6 +668,9 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 		if !user.Author {
 			log.Printf("user %d (%s) reported as instructor by LTI request, but not marked as author in user record", user.ID, user.Email)
 		}
+	} else if asst.Instructor {
+		log.Printf("user %d (%s) no longer reported as instructor for course %d (%s)", user.ID, user.Email, course.ID, course.Name)
+		asst.Instructor = false
 	}
 
 	if form.PersonSourcedID != "" {
@@ -672,10 +733,109 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 		}
 	}
 
+	// a change of role in the course changes what the user can see
+	if knownAssignments > 0 && (instructorAssignments > 0) != asst.Instructor {
+		if err := recordRoleChange(tx, asst, user, oldRoles, instructorAssignments, now); err != nil {
+			log.Printf("db error recording role change for user %d in course %d: %v", user.ID, course.ID, err)
+			return nil, err
+		}
+	}
+
+	// a launch from another LMS shell adds a place to post the grade
+	newTarget, err := recordGradeTarget(tx, asst, now)
+	if err != nil {
+		log.Printf("db error recording grade target for assignment %d: %v", asst.ID, err)
+		return nil, err
+	}
+	if newTarget && !asst.Instructor && len(asst.RawScores) > 0 {
+		// the grade is not fully posted until the new target has it too
+		if _, err := tx.Exec(`DELETE FROM grade_postings WHERE assignment_id = ?`, asst.ID); err != nil {
+			log.Printf("db error resetting grade posting for assignment %d: %v", asst.ID, err)
+			return nil, err
+		}
+		go saveGradeWithRetries(asst, "")
+	}
+
+	if dueChanged {
+		if err := rescoreAfterDueChange(tx, asst, now); err != nil {
+			return nil, err
+		}
+	}
+
 	return asst, nil
 }
 
-func saveGrade(asst *Assignment, text string) error {
+// rescoreAfterDueChange rescores an assignment whose due date changed,
+// since a new due date can change which attempts count.
+func rescoreAfterDueChange(tx *sql.Tx, asst *Assignment, now time.Time) error {
+	if asst.Instructor || len(asst.RawScores) == 0 {
+		return nil
+	}
+	policy, err := getScorePolicy(tx, asst)
+	if err != nil {
+		log.Printf("db error loading score policy for assignment %d: %v", asst.ID, err)
+		return err
+	}
+	if policy == ScoreBeforeDeadline {
+		changed, err := rescoreAssignment(tx, asst, "due date", now)
+		if err != nil {
+			log.Printf("error rescoring assignment %d after due date change: %v", asst.ID, err)
+			return err
+		}
+		if changed {
+			go saveGradeWithRetries(asst, "")
+		}
+	}
+	return nil
+}
+
+// saveGradeWithRetries posts a grade to the LMS, retrying with backoff if it fails.
+// While the LMS host's circuit is open the grade is parked until it closes,
+// which does not count as a try.
+// It is meant to run in its own goroutine.
+func saveGradeWithRetries(asst *Assignment, msg string) {
+	// a report goes to every target once; a bare score only goes where it is not already
+	var posted map[int64]bool
+	if msg != "" {
+		posted = make(map[int64]bool)
+	}
+
+	// try up to 10 times before giving up
+	tries := 10
+	minSleepTime := 10 * time.Second
+	maxSleepTime := 5 * time.Minute
+	sleepTime := minSleepTime
+	parkedSince := time.Now()
+	for i := 0; i < tries; i++ {
+		err := saveGrade(asst, msg, posted)
+		if err == nil {
+			return
+		}
+		if unavailable, ok := err.(*lmsUnavailableError); ok && time.Since(parkedSince) < maxGradeParkTime {
+			// wait for the host to recover without using up a try
+			time.Sleep(time.Until(unavailable.RetryAt) + time.Duration(rand.Int63n(int64(lmsSlotWait))))
+			i--
+			continue
+		}
+		log.Printf("error posting grade back to LMS (attempt %d/%d): %v", i+1, tries, err)
+		if i+1 < 10 {
+			log.Printf("  will try again in %v", sleepTime)
+			time.Sleep(sleepTime)
+			sleepTime *= 2
+			if sleepTime > maxSleepTime {
+				sleepTime = maxSleepTime
+			}
+		} else {
+			log.Printf("  giving up")
+		}
+	}
+}
+
+// saveGrade posts an assignment's score to each of its grade targets in the LMS.
+// Targets listed in posted are skipped, and those that accept the grade are added to it.
+// If posted is nil, targets that already hold the score are skipped instead.
+// The score is acknowledged once every target has accepted it.
+func saveGrade(asst *Assignment, text string, posted map[int64]bool) error {
 	if asst.GradeID == "" {
 		// instructors do not get grades
 		//log.Printf("cannot post grade for assignment %d user %d because no grade ID is present", asst.ID, asst.UserID)
@@ -685,13 +845,49 @@ func saveGrade(asst *Assignment, text string) error {
 		log.Printf("cannot post grade for assignment %d user %d because no outcome URL is present", asst.ID, asst.UserID)
 		return nil
 	}
+	targets, err := gradeSyncs.targets(asst)
+	if err != nil {
+		log.Printf("db error loading grade targets for assignment %d: %v", asst.ID, err)
+		return err
+	}
 
+	var failed, unavailable error
+	for _, target := range targets {
+		if posted != nil && posted[target.ID] || posted == nil && target.holds(asst.Score) {
+			continue
+		}
+		err := postGrade(asst, target, text)
+		if _, ok := err.(*lmsUnavailableError); ok {
+			unavailable = err
+			continue
+		}
+		gradeSyncs.targetAttempted(target, asst.Score, err)
+		if err != nil {
+			failed = err
+			continue
+		}
+		if posted != nil {
+			posted[target.ID] = true
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	if unavailable != nil {
+		return unavailable
+	}
+	gradeSyncs.acknowledge(asst)
+	return nil
+}
+
+// postGrade posts an assignment's score to one grade target.
+func postGrade(asst *Assignment, target *GradeTarget, text string) error {
 	// report back using lti
-	outcomeURL := asst.OutcomeURL
+	outcomeURL := target.OutcomeURL
 	gradeURL := ""
 	gradeText := ""
 
-	if strings.Contains(asst.OutcomeExtAccepted, "text") {
+	if strings.Contains(target.OutcomeExtAccepted, "text") {
 		//outcomeURL = asst.OutcomeExtURL
 		gradeText = text
 	}
@@ -700,7 +896,7 @@ func saveGrade(asst *Assignment, text string) error {
 		Namespace: "http://www.imsglobal.org/services/ltiv1p1/xsd/imsoms_v1p0",
 		Version:   "V1.0",
 		Message:   "Grade from CodeGrinder",
-		SourcedID: asst.GradeID,
+		SourcedID: target.GradeID,
 		URL:       gradeURL,
 		Text:      gradeText,
 		Language:  "en",
@@ -715,7 +911,7 @@ func saveGrade(asst *Assignment, text string) error {
 	result := []byte(fmt.Sprintf("%s%s\n", xml.Header, raw))
 
 	// sign the request
-	auth := signXMLRequest(asst.ConsumerKey, "POST", outcomeURL, result, Config.LTISecret)
+	auth := signXMLRequest(target.ConsumerKey, "POST", outcomeURL, result, Config.LTISecret)
 
 	// POST the grade
 	req, err := http.NewRequest("POST", outcomeURL, bytes.NewReader(result))
@@ -725,17 +921,20 @@ func saveGrade(asst *Assignment, text string) error {
 	}
 	req.Header.Set("Authorization", auth)
 	req.Header.Set("Content-Type", "application/xml")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := lmsRequests.Do(req)
+	if _, ok := err.(*lmsUnavailableError); ok {
+		return err
+	}
 	if err != nil {
 		log.Printf("error sending grade request: %v", err)
+		health.gradePosted(false)
 		return err
 	}
 	resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		log.Printf("assignment %q grade of %0.5f posted for user %d", asst.CanvasTitle, asst.Score, asst.UserID)
-	} else {
+	health.gradePosted(resp.StatusCode == http.StatusOK)
+	if resp.StatusCode != http.StatusOK {
 		return loggedErrorf("result status %d (%s) when posting grade for user %d", resp.StatusCode, resp.Status, asst.UserID)
 	}
-
+	log.Printf("assignment %q grade of %0.5f posted for user %d", asst.CanvasTitle, asst.Score, asst.UserID)
 	return nil
 }
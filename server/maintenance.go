@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// defaultMaintenanceRetry is the wait suggested to clients when maintenance has no expected end,
+// or has run past it.
+const defaultMaintenanceRetry = 5 * time.Minute
+
+// Maintenance puts the TA in read-only mode, e.g., while migrations run.
+// Requests that only read keep working, while anything that would change
+// the database is turned away with the message and a time to try again.
+// Administrators are not affected.
+type Maintenance struct {
+	ID        int64      `json:"id" meddler:"id,pk"`
+	Message   string     `json:"message" meddler:"message"`
+	RetryAt   *time.Time `json:"retryAt,omitempty" meddler:"retry_at,localtime"`
+	UserID    int64      `json:"userID" meddler:"user_id"`
+	CreatedAt time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// currentMaintenance returns the active maintenance window, or nil if there is none.
+func currentMaintenance(tx *sql.Tx) (*Maintenance, error) {
+	maintenance := new(Maintenance)
+	if err := meddler.QueryRow(tx, maintenance, `SELECT * FROM maintenance ORDER BY id DESC LIMIT 1`); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return maintenance, nil
+}
+
+// rejectDuringMaintenance turns away a request that would change the database
+// while maintenance is underway. It reports whether the request was rejected.
+func rejectDuringMaintenance(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || currentUser.Admin {
+		return false
+	}
+	maintenance, err := currentMaintenance(tx)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return true
+	}
+	if maintenance == nil {
+		return false
+	}
+
+	now := time.Now()
+	wait := defaultMaintenanceRetry
+	retry := "in a few minutes"
+	if maintenance.RetryAt != nil && maintenance.RetryAt.After(now) {
+		wait = maintenance.RetryAt.Sub(now)
+		retry = "after " + maintenance.RetryAt.Format("Mon Jan 2 3:04 PM MST")
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(wait.Seconds())+1))
+	loggedHTTPErrorf(w, http.StatusServiceUnavailable, "CodeGrinder is down for maintenance: %s\nYour work was not saved. Please try again %s.",
+		maintenance.Message, retry)
+	return true
+}
+
+// GetMaintenance handles requests to /maintenance,
+// returning the active maintenance window. No login is required.
+func GetMaintenance(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	maintenance, err := currentMaintenance(tx)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if maintenance == nil {
+		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+		return
+	}
+	render.JSON(http.StatusOK, maintenance)
+}
+
+// PutMaintenance handles requests to /maintenance,
+// starting read-only maintenance mode or updating its message and expected end.
+func PutMaintenance(w http.ResponseWriter, tx *sql.Tx, currentUser *User, maintenance Maintenance, render render.Render) {
+	now := time.Now()
+
+	maintenance.Message = strings.TrimSpace(maintenance.Message)
+	if maintenance.Message == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "maintenance must include a message for students")
+		return
+	}
+	if maintenance.RetryAt != nil && !maintenance.RetryAt.After(now) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "retry time must be in the future")
+		return
+	}
+
+	maintenance.ID = 0
+	maintenance.UserID = currentUser.ID
+	maintenance.CreatedAt = now
+	if old, err := currentMaintenance(tx); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	} else if old != nil {
+		maintenance.CreatedAt = old.CreatedAt
+	}
+	if _, err := tx.Exec(`DELETE FROM maintenance`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "maintenance", &maintenance); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) started maintenance mode: %s", currentUser.ID, currentUser.Email, maintenance.Message)
+	render.JSON(http.StatusOK, &maintenance)
+}
+
+// DeleteMaintenance handles requests to /maintenance,
+// ending maintenance mode.
+func DeleteMaintenance(w http.ResponseWriter, tx *sql.Tx, currentUser *User) {
+	if _, err := tx.Exec(`DELETE FROM maintenance`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) ended maintenance mode", currentUser.ID, currentUser.Email)
+}
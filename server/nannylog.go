@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+const (
+	// nannyLogLineLimit is the number of daycare log lines kept for one job.
+	nannyLogLineLimit = 500
+
+	// nannyLogHistory is the number of jobs returned when fetching the logs for a commit.
+	nannyLogHistory = 20
+)
+
+// NannyEvent is one step in the life of a nanny container:
+// created, limits, started, killed, or removed.
+type NannyEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// NannyLog is the daycare's record of a single grading job, reported to the TA
+// when the job ends so a hung or failed job can be investigated later.
+type NannyLog struct {
+	ID           int64         `json:"id" meddler:"id,pk"`
+	Hostname     string        `json:"hostname" meddler:"hostname"`
+	CommitID     int64         `json:"commitID" meddler:"commit_id"`
+	AssignmentID int64         `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64         `json:"problemID" meddler:"problem_id"`
+	Step         int64         `json:"step" meddler:"step"`
+	ProblemType  string        `json:"problemType" meddler:"problem_type"`
+	Action       string        `json:"action" meddler:"action"`
+	Events       []*NannyEvent `json:"events" meddler:"events,json"`
+	Log          string        `json:"log" meddler:"log"`
+	CreatedAt    time.Time     `json:"createdAt" meddler:"created_at,localtime"`
+	Signature    string        `json:"signature,omitempty" meddler:"-"`
+}
+
+func (entry *NannyLog) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", entry.Hostname)
+	v.Add("commit_id", strconv.FormatInt(entry.CommitID, 10))
+	v.Add("assignment_id", strconv.FormatInt(entry.AssignmentID, 10))
+	v.Add("problem_id", strconv.FormatInt(entry.ProblemID, 10))
+	v.Add("step", strconv.FormatInt(entry.Step, 10))
+	v.Add("problem_type", entry.ProblemType)
+	v.Add("action", entry.Action)
+	for _, event := range entry.Events {
+		v.Add("event", fmt.Sprintf("%s %s %s", event.Time.UTC().Format(time.RFC3339Nano), event.Event, event.Detail))
+	}
+	v.Add("log", entry.Log)
+	v.Add("created_at", entry.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// jobLog collects the nanny events and log lines for one job on a daycare.
+// A nil *jobLog discards everything, so shadow grading can share the nanny code.
+type jobLog struct {
+	sync.Mutex
+	entry   *NannyLog
+	lines   []string
+	dropped int
+}
+
+func newJobLog(commit *Commit, problemType, action string) *jobLog {
+	return &jobLog{
+		entry: &NannyLog{
+			Hostname:     Config.Hostname,
+			CommitID:     commit.ID,
+			AssignmentID: commit.AssignmentID,
+			ProblemID:    commit.ProblemID,
+			Step:         commit.Step,
+			ProblemType:  problemType,
+			Action:       action,
+			Events:       []*NannyEvent{},
+		},
+	}
+}
+
+// event records a lifecycle event and logs it.
+func (j *jobLog) event(event, format string, args ...interface{}) {
+	if j == nil {
+		return
+	}
+	detail := fmt.Sprintf(format, args...)
+	j.logf("nanny %s: %s", event, detail)
+	j.Lock()
+	defer j.Unlock()
+	j.entry.Events = append(j.entry.Events, &NannyEvent{Time: time.Now(), Event: event, Detail: detail})
+}
+
+// logf writes to the daycare log and keeps a copy with the job.
+func (j *jobLog) logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	if len(j.lines) >= nannyLogLineLimit {
+		j.dropped++
+		return
+	}
+	j.lines = append(j.lines, time.Now().Format("15:04:05.000 ")+msg)
+}
+
+// report signs the collected log and sends it to the TA.
+func (j *jobLog) report() {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	entry := j.entry
+	lines := j.lines
+	if j.dropped > 0 {
+		lines = append(lines, fmt.Sprintf("(%d more lines not kept)", j.dropped))
+	}
+	entry.Log = strings.Join(lines, "\n")
+	entry.CreatedAt = time.Now()
+	entry.Signature = entry.ComputeSignature(Config.DaycareSecret)
+
+	go func() {
+		if err := postToTA("/nanny_logs", entry, nil); err != nil {
+			log.Printf("error posting nanny log: %v", err)
+		}
+	}()
+}
+
+// PostNannyLog handles requests to /nanny_logs,
+// recording the log of a grading job reported by a daycare.
+func PostNannyLog(w http.ResponseWriter, tx *sql.Tx, entry NannyLog) {
+	sig := entry.ComputeSignature(Config.DaycareSecret)
+	if sig != entry.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "nanny log signature mismatch: computed %s but found %s", sig, entry.Signature)
+		return
+	}
+	drift := time.Since(entry.CreatedAt)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "nanny log is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+
+	entry.ID = 0
+	entry.CreatedAt = time.Now()
+	if entry.Events == nil {
+		entry.Events = []*NannyEvent{}
+	}
+	if err := meddler.Insert(tx, "nanny_logs", &entry); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// GetCommitNannyLogs handles requests to /commits/:commit_id/nanny_logs,
+// returning the daycare logs of the most recent jobs run for the commit's step, newest first.
+func GetCommitNannyLogs(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return
+	}
+
+	var assignmentID, problemID, step int64
+	if err := tx.QueryRow(`SELECT assignment_id, problem_id, step FROM commits WHERE id = ?`, commitID).
+		Scan(&assignmentID, &problemID, &step); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	entries := []*NannyLog{}
+	if err := meddler.QueryAll(tx, &entries, `SELECT * FROM nanny_logs `+
+		`WHERE commit_id = ? OR (assignment_id = ? AND problem_id = ? AND step = ?) `+
+		`ORDER BY id DESC LIMIT ?`, commitID, assignmentID, problemID, step, nannyLogHistory); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// newOutboundTransport returns a transport for requests to the LMS that goes
+// through the proxy named in the config file (or the usual environment
+// variables if none is named) and trusts the extra CAs listed there as well
+// as the system's own.
+func newOutboundTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if Config.OutboundProxy != "" {
+		proxy, err := url.Parse(Config.OutboundProxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing outboundProxy: %v", err)
+		}
+		if proxy.Scheme != "http" && proxy.Scheme != "https" {
+			return nil, fmt.Errorf("outboundProxy must be an http or https URL, not %q", Config.OutboundProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if len(Config.OutboundCAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, name := range Config.OutboundCAFiles {
+			pem, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("loading outbound CA: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no PEM certificates found in outbound CA file %s", name)
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/go-martini/martini"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+	"golang.org/x/net/html"
+)
+
+// packetPage lays out a problem for printing: each step starts on a new
+// page with its instructions followed by the starter files it hands out.
+var packetPage = template.Must(template.New("packet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Problem.Note}}</title>
+<style>
+body { font-family: Georgia, serif; max-width: 48em; margin: 2em auto; line-height: 1.4; }
+header { border-bottom: 2px solid {{.Theme.AccentColor}}; margin-bottom: 1em; }
+header p { margin: 0.2em 0; font-size: 90%; }
+section.step + section.step { break-before: page; page-break-before: always; }
+h2.step { font-size: 110%; text-transform: uppercase; letter-spacing: 0.05em; }
+pre { font-family: "DejaVu Sans Mono", Consolas, monospace; font-size: 9pt; white-space: pre-wrap; border: 1px solid #999; padding: 0.5em; }
+pre, figure { break-inside: avoid; page-break-inside: avoid; }
+h3.file { font-family: "DejaVu Sans Mono", Consolas, monospace; font-size: 100%; }
+img { max-width: 100%; }
+@page { margin: 2cm; }
+@media print { body { margin: 0; max-width: none; } a { color: inherit; text-decoration: none; } }
+</style>
+</head>
+<body>
+<header>
+<p>{{.Theme.Title}}</p>
+<h1>{{.Problem.Note}}</h1>
+<p>{{.Problem.Unique}}{{if .Assignment}} &middot; {{.Assignment}}{{end}}</p>
+</header>
+{{range .Steps}}<section class="step">
+{{if $.Numbered}}<h2 class="step">Step {{.Step}}: {{.Note}}</h2>
+{{end}}{{.Instructions}}
+{{range .Files}}<h3 class="file">{{.Name}}</h3>
+<pre>{{.Contents}}</pre>
+{{end}}</section>
+{{end}}</body>
+</html>
+`))
+
+type packetFile struct {
+	Name     string
+	Contents string
+}
+
+type packetStep struct {
+	Step         int64
+	Note         string
+	Instructions template.HTML
+	Files        []*packetFile
+}
+
+// GetProblemPacket handles requests to /problems/:problem_id/packet,
+// returning a page with the instructions and starter files for every step
+// of a problem, laid out for printing (or saving as a PDF from the browser).
+// Each step lists the files students edit that it adds or changes.
+//
+// If parameter step=<...> present, only that step is included, with all of its starter files.
+// If parameter locale=<...> present, instructions are translated as in GetProblemSteps.
+func GetProblemPacket(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
+	problemSteps, ok := loadProblemSteps(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemSteps[0].ProblemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	only := int64(0)
+	if s := r.FormValue("step"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 || n > int64(len(problemSteps)) {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "step must be between 1 and %d", len(problemSteps))
+			return
+		}
+		only = n
+	}
+
+	locale := requestLocale(r, currentUser)
+	previous := make(map[string][]byte)
+	var steps []*packetStep
+	for _, step := range problemSteps {
+		step.Localize(locale)
+		elt := &packetStep{Step: step.Step, Note: step.Note}
+
+		// starter files are the ones students edit, shown when a step first hands them out or changes them
+		var names []string
+		for name := range step.Whitelist {
+			contents, present := step.Files[name]
+			changed := only != 0 || !bytes.Equal(contents, previous[name])
+			if present && changed && filepath.Dir(filepath.FromSlash(name)) == "." && utf8.Valid(contents) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			elt.Files = append(elt.Files, &packetFile{Name: name, Contents: string(step.Files[name])})
+			previous[name] = step.Files[name]
+		}
+
+		if only != 0 && step.Step != only {
+			continue
+		}
+		prefix := fmt.Sprintf("steps/%d/attachments/", step.Step)
+		doc, err := cleanInstructions(step.Instructions, prefix)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error parsing instructions for step %d: %v", step.Step, err)
+			return
+		}
+		body, err := renderBody(doc)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error rendering instructions for step %d: %v", step.Step, err)
+			return
+		}
+		elt.Instructions = template.HTML(body)
+		steps = append(steps, elt)
+	}
+
+	// name the assignment if the student has one for this problem,
+	// and use the theme of its course
+	assignment := ""
+	theme := defaultTheme()
+	if !currentUser.Admin && !currentUser.Author {
+		var courseID int64
+		if err := tx.QueryRow(`SELECT assignments.canvas_title, assignments.course_id FROM assignments `+
+			`JOIN problem_set_problems ON assignments.problem_set_id = problem_set_problems.problem_set_id `+
+			`WHERE assignments.user_id = ? AND problem_set_problems.problem_id = ? `+
+			`ORDER BY assignments.updated_at DESC LIMIT 1`, currentUser.ID, problem.ID).Scan(&assignment, &courseID); err != nil && err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if courseID > 0 {
+			t, err := courseTheme(tx, courseID)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			theme = t
+		}
+	}
+
+	var buf bytes.Buffer
+	data := map[string]interface{}{
+		"Problem":    problem,
+		"Assignment": assignment,
+		"Theme":      theme,
+		"Steps":      steps,
+		"Numbered":   len(problemSteps) > 1,
+	}
+	if err := packetPage.Execute(&buf, data); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error rendering packet: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", instructionsPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// renderBody renders the contents of the body element of a parsed html document.
+func renderBody(doc *html.Node) (string, error) {
+	var body *html.Node
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "body" {
+			body = n
+			return
+		}
+		for c := n.FirstChild; c != nil && body == nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(doc)
+	if body == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&buf, c); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// PrerequisiteLocks records that an instructor turned on prerequisite locking
+// for a course. Without it, prerequisites only suggest an order.
+type PrerequisiteLocks struct {
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	EnabledBy int64     `json:"enabledBy" meddler:"enabled_by"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// PrerequisiteNode is one problem in the prerequisite graph.
+// Prerequisites are the IDs of the problems it depends on, and Position
+// is its place in a recommended order, counting from 1.
+type PrerequisiteNode struct {
+	ProblemID     int64   `json:"problemID"`
+	Unique        string  `json:"unique"`
+	Note          string  `json:"note"`
+	Prerequisites []int64 `json:"prerequisites"`
+	Position      int     `json:"position"`
+}
+
+// loadPrerequisiteMap returns the prerequisites of every problem that has any, keyed by unique ID.
+func loadPrerequisiteMap(tx *sql.Tx) (map[string][]string, error) {
+	problems := []*Problem{}
+	if err := meddler.QueryAll(tx, &problems, `SELECT * FROM problems WHERE prerequisites NOT IN ('[]', 'null')`); err != nil {
+		return nil, err
+	}
+	graph := make(map[string][]string)
+	for _, problem := range problems {
+		graph[problem.Unique] = problem.Prerequisites
+	}
+	return graph, nil
+}
+
+// checkPrerequisites makes sure that the prerequisites of a problem exist
+// and that none of them leads back to the problem.
+func checkPrerequisites(tx *sql.Tx, problem *Problem) error {
+	if len(problem.Prerequisites) == 0 {
+		return nil
+	}
+	for _, unique := range problem.Prerequisites {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM problems WHERE unique_id = ?`, unique).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("prerequisite %q is not a known problem", unique)
+		}
+	}
+
+	graph, err := loadPrerequisiteMap(tx)
+	if err != nil {
+		return err
+	}
+	graph[problem.Unique] = problem.Prerequisites
+	visited := make(map[string]bool)
+	var visit func(unique string, path []string) error
+	visit = func(unique string, path []string) error {
+		for _, elt := range graph[unique] {
+			if elt == problem.Unique {
+				return fmt.Errorf("prerequisites form a cycle: %s", strings.Join(append(path, elt), " -> "))
+			}
+			if !visited[elt] {
+				visited[elt] = true
+				if err := visit(elt, append(path, elt)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return visit(problem.Unique, []string{problem.Unique})
+}
+
+// orderByPrerequisites sorts items so that each comes after the items it depends on.
+// Among items that are ready at the same time, the original order is kept.
+// Items caught in a cycle are left at the end in their original order.
+func orderByPrerequisites(n int, dependsOn func(i, j int) bool) []int {
+	placed := make([]bool, n)
+	var order []int
+	for len(order) < n {
+		progress := false
+		for i := 0; i < n; i++ {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for j := 0; j < n && ready; j++ {
+				if j != i && !placed[j] && dependsOn(i, j) {
+					ready = false
+				}
+			}
+			if ready {
+				placed[i] = true
+				order = append(order, i)
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			for i := 0; i < n; i++ {
+				if !placed[i] {
+					placed[i] = true
+					order = append(order, i)
+				}
+			}
+		}
+	}
+	return order
+}
+
+// queryUniqueSet runs a query that returns problem unique IDs and gathers them into a set.
+func queryUniqueSet(tx *sql.Tx, query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := make(map[string]bool)
+	for rows.Next() {
+		var unique string
+		if err := rows.Scan(&unique); err != nil {
+			return nil, err
+		}
+		set[unique] = true
+	}
+	return set, rows.Err()
+}
+
+// prerequisitesLocked reports whether a course locks assignments with unmet prerequisites.
+func prerequisitesLocked(tx *sql.Tx, courseID int64) (bool, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(1) FROM prerequisite_locks WHERE course_id = ?`, courseID).Scan(&count)
+	return count > 0, err
+}
+
+// attachOrders fills in the recommended order of each assignment among the
+// assignments its owner has in the same course, along with any prerequisites
+// the owner has not finished yet. Only prerequisites assigned somewhere in the
+// course count, so a problem is never locked waiting for one nobody can work on.
+func attachOrders(tx *sql.Tx, assignments ...*Assignment) error {
+	type key struct{ courseID, userID int64 }
+	orders := make(map[int64]*AssignmentOrder)
+	done := make(map[key]bool)
+	for _, assignment := range assignments {
+		k := key{assignment.CourseID, assignment.UserID}
+		if done[k] {
+			assignment.Order = orders[assignment.ID]
+			continue
+		}
+		done[k] = true
+
+		// every assignment the owner has in the course, with its problems
+		list := []*Assignment{}
+		if err := meddler.QueryAll(tx, &list, `SELECT * FROM assignments WHERE course_id = ? AND user_id = ? ORDER BY due_at IS NULL, due_at, id`,
+			assignment.CourseID, assignment.UserID); err != nil {
+			return err
+		}
+		contents := make([]map[string]bool, len(list))
+		needs := make([][]string, len(list))
+		for i, elt := range list {
+			problems := []*Problem{}
+			if err := meddler.QueryAll(tx, &problems, `SELECT problems.* FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+				`WHERE problem_set_problems.problem_set_id = ?`, elt.ProblemSetID); err != nil {
+				return err
+			}
+			contents[i] = make(map[string]bool)
+			for _, problem := range problems {
+				contents[i][problem.Unique] = true
+			}
+			seen := make(map[string]bool)
+			for _, problem := range problems {
+				for _, unique := range problem.Prerequisites {
+					if !contents[i][unique] && !seen[unique] {
+						seen[unique] = true
+						needs[i] = append(needs[i], unique)
+					}
+				}
+			}
+			sort.Strings(needs[i])
+		}
+
+		// what is assigned in the course, and what the owner has finished
+		assigned, err := queryUniqueSet(tx, `SELECT DISTINCT problems.unique_id FROM problems `+
+			`JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+			`JOIN assignments ON problem_set_problems.problem_set_id = assignments.problem_set_id `+
+			`WHERE assignments.course_id = ?`, assignment.CourseID)
+		if err != nil {
+			return err
+		}
+		finished, err := queryUniqueSet(tx, `SELECT DISTINCT problems.unique_id FROM step_scores `+
+			`JOIN assignments ON step_scores.assignment_id = assignments.id `+
+			`JOIN problems ON step_scores.problem_id = problems.id `+
+			`WHERE assignments.course_id = ? AND assignments.user_id = ? AND step_scores.score >= 1.0 `+
+			`AND step_scores.step = (SELECT MAX(step) FROM problem_steps WHERE problem_id = step_scores.problem_id)`,
+			assignment.CourseID, assignment.UserID)
+		if err != nil {
+			return err
+		}
+		locks, err := prerequisitesLocked(tx, assignment.CourseID)
+		if err != nil {
+			return err
+		}
+
+		order := orderByPrerequisites(len(list), func(i, j int) bool {
+			for _, unique := range needs[i] {
+				if contents[j][unique] {
+					return true
+				}
+			}
+			return false
+		})
+		for position, i := range order {
+			elt := &AssignmentOrder{Position: position + 1}
+			for _, unique := range needs[i] {
+				if !assigned[unique] {
+					continue
+				}
+				elt.Prerequisites = append(elt.Prerequisites, unique)
+				if !finished[unique] {
+					elt.Unmet = append(elt.Unmet, unique)
+				}
+			}
+			elt.Locked = locks && !list[i].Instructor && len(elt.Unmet) > 0
+			orders[list[i].ID] = elt
+		}
+		assignment.Order = orders[assignment.ID]
+	}
+	return nil
+}
+
+// GetPrerequisiteGraph handles requests to /prerequisite_graph,
+// returning the problems with prerequisites, the problems they depend on,
+// and a recommended order for working through them.
+//
+// If parameter problem_set_id=<...> present, the graph starts from the problems in that problem set.
+// If parameter course_id=<...> present, the graph starts from the problems assigned in that course.
+func GetPrerequisiteGraph(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	start := []*Problem{}
+	var err error
+	switch {
+	case r.FormValue("problem_set_id") != "":
+		problemSetID, perr := strconv.ParseInt(r.FormValue("problem_set_id"), 10, 64)
+		if perr != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_set_id: %v", perr)
+			return
+		}
+		err = meddler.QueryAll(tx, &start, `SELECT problems.* FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+			`WHERE problem_set_problems.problem_set_id = ?`, problemSetID)
+	case r.FormValue("course_id") != "":
+		courseID, perr := strconv.ParseInt(r.FormValue("course_id"), 10, 64)
+		if perr != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing course_id: %v", perr)
+			return
+		}
+		err = meddler.QueryAll(tx, &start, `SELECT DISTINCT problems.* FROM problems `+
+			`JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+			`JOIN assignments ON problem_set_problems.problem_set_id = assignments.problem_set_id `+
+			`WHERE assignments.course_id = ?`, courseID)
+	default:
+		err = meddler.QueryAll(tx, &start, `SELECT * FROM problems WHERE prerequisites NOT IN ('[]', 'null')`)
+	}
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// follow prerequisites to pull in every problem they lead to
+	byUnique := make(map[string]*Problem)
+	var problems []*Problem
+	queue := start
+	for len(queue) > 0 {
+		problem := queue[0]
+		queue = queue[1:]
+		if byUnique[problem.Unique] != nil {
+			continue
+		}
+		byUnique[problem.Unique] = problem
+		problems = append(problems, problem)
+		for _, unique := range problem.Prerequisites {
+			if byUnique[unique] != nil {
+				continue
+			}
+			elt := new(Problem)
+			if err := meddler.QueryRow(tx, elt, `SELECT * FROM problems WHERE unique_id = ?`, unique); err != nil {
+				if err == sql.ErrNoRows {
+					log.Printf("problem %s has unknown prerequisite %s", problem.Unique, unique)
+					continue
+				}
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			queue = append(queue, elt)
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Unique < problems[j].Unique })
+
+	dependsOn := func(i, j int) bool {
+		for _, unique := range problems[i].Prerequisites {
+			if unique == problems[j].Unique {
+				return true
+			}
+		}
+		return false
+	}
+	nodes := make([]*PrerequisiteNode, len(problems))
+	for position, i := range orderByPrerequisites(len(problems), dependsOn) {
+		problem := problems[i]
+		node := &PrerequisiteNode{
+			ProblemID:     problem.ID,
+			Unique:        problem.Unique,
+			Note:          problem.Note,
+			Prerequisites: []int64{},
+			Position:      position + 1,
+		}
+		for _, unique := range problem.Prerequisites {
+			if elt := byUnique[unique]; elt != nil {
+				node.Prerequisites = append(node.Prerequisites, elt.ID)
+			}
+		}
+		nodes[position] = node
+	}
+	render.JSON(http.StatusOK, nodes)
+}
+
+// GetCoursePrerequisiteLocks handles requests to /courses/:course_id/prerequisite_locks,
+// returning the settings if the course locks assignments with unmet prerequisites.
+func GetCoursePrerequisiteLocks(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	settings := new(PrerequisiteLocks)
+	if err := meddler.QueryRow(tx, settings, `SELECT * FROM prerequisite_locks WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, settings)
+}
+
+// PutCoursePrerequisiteLocks handles requests to /courses/:course_id/prerequisite_locks,
+// locking assignments in the course until their prerequisites are finished.
+// Only instructors (not TAs) can change this.
+func PutCoursePrerequisiteLocks(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadLeadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	settings := new(PrerequisiteLocks)
+	if err := meddler.QueryRow(tx, settings, `SELECT * FROM prerequisite_locks WHERE course_id = ?`, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		settings = &PrerequisiteLocks{
+			CourseID:  courseID,
+			EnabledBy: currentUser.ID,
+			CreatedAt: time.Now(),
+		}
+		if err := meddler.Insert(tx, "prerequisite_locks", settings); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		log.Printf("user %d (%s) turned on prerequisite locks for course %d", currentUser.ID, currentUser.Email, courseID)
+	}
+	render.JSON(http.StatusOK, settings)
+}
+
+// DeleteCoursePrerequisiteLocks handles requests to /courses/:course_id/prerequisite_locks,
+// going back to only recommending an order.
+func DeleteCoursePrerequisiteLocks(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	courseID, ok := loadLeadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM prerequisite_locks WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) turned off prerequisite locks for course %d", currentUser.ID, currentUser.Email, courseID)
+}
@@ -3,13 +3,16 @@ package main
 import (
 	"database/sql"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
+	"github.com/russross/codegrinder/sdk"
 	. "github.com/russross/codegrinder/types"
 	"github.com/russross/meddler"
 )
@@ -100,6 +103,111 @@ func getProblemType(tx *sql.Tx, name string) (*ProblemType, error) {
 	return problemType, nil
 }
 
+// PutProblemType handles a request to /problem_types/:name,
+// creating or replacing a problem type. The problem type must keep to the
+// contract checked by sdk.Validate. Its actions are replaced by the ones given,
+// and its files are written to the files directory, replacing any that were there.
+// Daycares must still list the problem type in their config and have its image.
+func PutProblemType(w http.ResponseWriter, tx *sql.Tx, params martini.Params, problemType ProblemType, render render.Render) {
+	name := params["name"]
+	if problemType.Name == "" {
+		problemType.Name = name
+	}
+	if problemType.Name != name {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem type name %q does not match URL name %q", problemType.Name, name)
+		return
+	}
+	if problemType.OS == "" {
+		problemType.OS = "linux"
+	}
+	if problemType.Labels == nil {
+		problemType.Labels = []string{}
+	}
+	for action, elt := range problemType.Actions {
+		if elt != nil {
+			elt.ProblemType = name
+			elt.Action = action
+		}
+	}
+	if err := sdk.Validate(&problemType); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM problem_types WHERE name = ?`, name).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count == 0 {
+		if err := meddler.Insert(tx, "problem_types", &problemType); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	} else {
+		if _, err := tx.Exec(`UPDATE problem_types SET image = ?, os = ?, labels = ? WHERE name = ?`,
+			problemType.Image, problemType.OS, string(mustMarshal(problemType.Labels)), name); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM problem_type_actions WHERE problem_type = ?`, name); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, action := range problemType.Actions {
+		if err := meddler.Insert(tx, "problem_type_actions", action); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	if err := writeProblemTypeFiles(name, problemType.Files); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error saving files for problem type %s: %v", name, err)
+		return
+	}
+	log.Printf("problem type %s saved with image %s and %d files", name, problemType.Image, len(problemType.Files))
+
+	saved, err := getProblemType(tx, name)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error loading problem type %s: %v", name, err)
+		return
+	}
+	render.JSON(http.StatusOK, saved)
+}
+
+// writeProblemTypeFiles replaces the files directory for a problem type.
+// The new files are written next to the old ones and swapped into place.
+func writeProblemTypeFiles(name string, files map[string][]byte) error {
+	dir := filepath.Join(root, "files", name)
+	fresh, stale := dir+".new", dir+".old"
+	if err := os.RemoveAll(fresh); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(stale); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fresh, 0755); err != nil {
+		return err
+	}
+	for relpath, contents := range files {
+		path := filepath.Join(fresh, filepath.FromSlash(relpath))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(dir, stale); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(fresh, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(stale)
+}
+
 // GetProblems handles a request to /problems,
 // returning a list of all problems.
 //
@@ -131,6 +239,8 @@ func GetProblems(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser
 		err = meddler.QueryAll(tx, &problems, `SELECT * FROM problems`+where+` ORDER BY id`, args...)
 	} else {
 		where, args = addWhereEq(where, args, "user_id", currentUser.ID)
+		where += ` AND problems.id NOT IN (` + notYetOpenProblems + `)`
+		args = append(args, time.Now(), currentUser.ID)
 		err = meddler.QueryAll(tx, &problems, `SELECT problems.* FROM problems JOIN user_problems ON problems.id = problem_id`+where+` ORDER BY id`, args...)
 	}
 
@@ -157,8 +267,8 @@ func GetProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, curren
 	} else {
 		err = meddler.QueryRow(tx, problem, `SELECT problems.* `+
 			`FROM problems JOIN user_problems ON problems.id = problem_id `+
-			`WHERE user_id = ? AND problem_id = ?`,
-			currentUser.ID, problemID)
+			`WHERE user_id = ? AND problem_id = ? AND problem_id NOT IN (`+notYetOpenProblems+`)`,
+			currentUser.ID, problemID, time.Now(), currentUser.ID)
 	}
 
 	if err != nil {
@@ -188,10 +298,64 @@ func DeleteProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, ren
 
 // GetProblemSteps handles a request to /problems/:problem_id/steps,
 // returning a list of all steps for a problem.
+//
+// If parameter locale=<...> present, it chooses which translation of the instructions to return.
+// Otherwise the user's locale from the LMS is used.
 func GetProblemSteps(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	problemSteps, ok := loadProblemSteps(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	locale := requestLocale(r, currentUser)
+	for _, elt := range problemSteps {
+		elt.Localize(locale)
+		sanitizeStepInstructions(elt)
+		if !currentUser.Admin && !currentUser.Author {
+			elt.Solution = nil
+			elt.Tests = visibleStepTests(elt.Tests)
+			elt.Localized = nil
+		}
+	}
+
+	render.JSON(http.StatusOK, problemSteps)
+}
+
+// GetProblemStep handles a request to /problems/:problem_id/steps/:step,
+// returning a single problem step.
+// Instructions are translated as in GetProblemSteps.
+func GetProblemStep(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	problemStep, ok := loadProblemStep(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	problemStep.Localize(requestLocale(r, currentUser))
+	sanitizeStepInstructions(problemStep)
+	if !currentUser.Admin && !currentUser.Author {
+		problemStep.Solution = nil
+		problemStep.Tests = visibleStepTests(problemStep.Tests)
+		problemStep.Localized = nil
+	}
+	render.JSON(http.StatusOK, problemStep)
+}
+
+// sanitizeStepInstructions sanitizes a step's instructions and translations
+// before they are sent to API clients, which do not get the script-blocking
+// policy that the instructions page sends.
+func sanitizeStepInstructions(step *ProblemStep) {
+	step.Instructions = SanitizeInstructions(step.Instructions)
+	for locale, instructions := range step.Localized {
+		step.Localized[locale] = SanitizeInstructions(instructions)
+	}
+}
+
+// loadProblemSteps loads all steps of the problem named in the request parameters,
+// with the same access rules as loadProblemStep.
+func loadProblemSteps(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) ([]*ProblemStep, bool) {
 	problemID, err := parseID(w, "problem_id", params["problem_id"])
 	if err != nil {
-		return
+		return nil, false
 	}
 
 	problemSteps := []*ProblemStep{}
@@ -203,39 +367,38 @@ func GetProblemSteps(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params
 		err = meddler.QueryAll(tx, &problemSteps, `SELECT problem_steps.* `+
 			`FROM problem_steps JOIN user_problems ON problem_steps.problem_id = user_problems.problem_id `+
 			`WHERE user_problems.user_id = ? AND user_problems.problem_id = ? `+
+			`AND user_problems.problem_id NOT IN (`+notYetOpenProblems+`) `+
 			`ORDER BY step`,
-			currentUser.ID, problemID)
+			currentUser.ID, problemID, time.Now(), currentUser.ID)
 	}
 
 	if err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-		return
+		return nil, false
 	}
 
 	if len(problemSteps) == 0 {
 		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
-		return
+		return nil, false
 	}
-
-	if !currentUser.Admin && !currentUser.Author {
-		for _, elt := range problemSteps {
-			elt.Solution = nil
-		}
+	if err := loadStepFiles(problemSteps...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return nil, false
 	}
-
-	render.JSON(http.StatusOK, problemSteps)
+	return problemSteps, true
 }
 
-// GetProblemStep handles a request to /problems/:problem_id/steps/:step,
-// returning a single problem step.
-func GetProblemStep(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+// loadProblemStep loads the problem step named in the request parameters,
+// as long as the current user is an author or the problem is assigned to them and open.
+// On failure it reports the error and returns false.
+func loadProblemStep(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) (*ProblemStep, bool) {
 	problemID, err := parseID(w, "problem_id", params["problem_id"])
 	if err != nil {
-		return
+		return nil, false
 	}
 	step, err := parseID(w, "step", params["step"])
 	if err != nil {
-		return
+		return nil, false
 	}
 
 	problemStep := new(ProblemStep)
@@ -245,19 +408,20 @@ func GetProblemStep(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cu
 	} else {
 		err = meddler.QueryRow(tx, problemStep, `SELECT problem_steps.* `+
 			`FROM problem_steps JOIN user_problems ON problem_steps.problem_id = user_problems.problem_id `+
-			`WHERE user_problems.user_id = ? AND problem_steps.problem_id = ? AND problem_steps.step = ?`,
-			currentUser.ID, problemID, step)
+			`WHERE user_problems.user_id = ? AND problem_steps.problem_id = ? AND problem_steps.step = ? `+
+			`AND problem_steps.problem_id NOT IN (`+notYetOpenProblems+`)`,
+			currentUser.ID, problemID, step, time.Now(), currentUser.ID)
 	}
 
 	if err != nil {
 		loggedHTTPDBNotFoundError(w, err)
-		return
+		return nil, false
 	}
-
-	if !currentUser.Admin && !currentUser.Author {
-		problemStep.Solution = nil
+	if err := loadStepFiles(problemStep); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return nil, false
 	}
-	render.JSON(http.StatusOK, problemStep)
+	return problemStep, true
 }
 
 // GetProblemSets handles a request to /problem_sets,
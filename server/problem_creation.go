@@ -95,6 +95,8 @@ func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params,
 
 func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle *ProblemBundle, render render.Render) {
 	now := time.Now()
+	bundle.Warnings = nil
+	bundle.Tickets = nil
 
 	// clean up basic fields and do some checks
 	problem, steps := bundle.Problem, bundle.ProblemSteps
@@ -103,6 +105,11 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 		return
 	}
 
+	if err := checkProblemHints(bundle.ProblemHints, steps); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
 	// note: unique constraint will be checked by the database
 
 	// make sure the set of problem types included matches the list of steps
@@ -153,6 +160,10 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 		loggedHTTPErrorf(w, http.StatusBadRequest, "problem must have exactly one commit signature for each commit")
 		return
 	}
+	if len(bundle.ReportCardSignatures) != len(bundle.Commits) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem must have exactly one report card signature for each commit")
+		return
+	}
 	if bundle.UserID != currentUser.ID {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "user ID in problem bundle must match current user ID")
 		return
@@ -164,6 +175,10 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 			loggedHTTPErrorf(w, http.StatusBadRequest, "commit for step %d has a bad signature", commit.Step)
 			return
 		}
+		if err := verifyReportCard(tx, commit, bundle.ReportCardSignatures[i], bundle.ProblemTypeSignatures[steps[i].ProblemType], bundle.ProblemSignature, bundle.Hostname, bundle.UserID); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "commit for step %d: %v", commit.Step, err)
+			return
+		}
 
 		if commit.Step != steps[i].Step || commit.Step != int64(i+1) {
 			loggedHTTPErrorf(w, http.StatusBadRequest, "commit for step %d says it is for step %d", steps[i].Step, commit.Step)
@@ -178,6 +193,7 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 
 		// keep a copy of the solution
 		steps[i].Solution = commit.Files
+		bundle.Warnings = append(bundle.Warnings, steps[i].ScoringWarnings(commit.ReportCard)...)
 	}
 
 	isUpdate, oldStepCount := false, 0
@@ -196,8 +212,13 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 	}
 
 	// insert/update all the new steps
-	for _, step := range steps {
-		step.ProblemID = problem.ID
+	for _, elt := range steps {
+		elt.ProblemID = problem.ID
+		step, err := storeStepFiles(elt)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
 
 		if step.Step > int64(oldStepCount) {
 			// insert a new record
@@ -223,20 +244,40 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 				loggedHTTPErrorf(w, http.StatusInternalServerError, "json encoding error for step.Solution: %v", err)
 				return
 			}
+			testsJSON, err := json.Marshal(step.Tests)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "json encoding error for step.Tests: %v", err)
+				return
+			}
+			localizedJSON, err := json.Marshal(step.Localized)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "json encoding error for step.Localized: %v", err)
+				return
+			}
 			result, err := tx.Exec(`UPDATE problem_steps SET `+
 				`problem_type=?, `+
 				`note=?, `+
 				`instructions=?, `+
+				`localized_instructions=?, `+
 				`weight=?, `+
+				`max_attempts=?, `+
+				`diagnostic=?, `+
+				`tests=?, `+
 				`files=?, `+
+				`files_blob=?, `+
 				`whitelist=?, `+
 				`solution=? `+
 				`WHERE problem_id=? AND step=?`,
 				step.ProblemType,
 				step.Note,
 				step.Instructions,
+				localizedJSON,
 				step.Weight,
+				step.MaxAttempts,
+				step.Diagnostic,
+				testsJSON,
 				filesJSON,
+				sql.NullString{String: step.FilesBlob, Valid: step.FilesBlob != ""},
 				whitelistJSON,
 				solutionJSON,
 				step.ProblemID,
@@ -265,6 +306,16 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 		}
 	}
 
+	if err := saveProblemHints(tx, problem.ID, bundle.ProblemHints); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error saving hints: %v", err)
+		return
+	}
+
+	if err := recordProblemConfirmation(tx, problem, bundle.ProblemTypes, currentUser.ID, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error recording confirmation: %v", err)
+		return
+	}
+
 	if isUpdate {
 		log.Printf("problem %s (%d) with %d step(s) updated", problem.Unique, problem.ID, len(steps))
 	} else {
@@ -345,6 +396,14 @@ func PostProblemBundleUnconfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser
 		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
 		return
 	}
+	if err := checkProblemHints(bundle.ProblemHints, bundle.ProblemSteps); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err := checkPrerequisites(tx, bundle.Problem); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
 
 	// if this is an update to an existing problem, we need to check that some things match
 	if bundle.Problem.ID != 0 {
@@ -390,23 +449,17 @@ func PostProblemBundleUnconfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser
 	bundle.ProblemSignature = bundle.Problem.ComputeSignature(Config.DaycareSecret, bundle.ProblemSteps)
 
 	// assign a daycare host
-	host, err := daycareRegistrations.Assign(typeSet)
+	host, err := daycareRegistrations.Assign(tx, bundle.ProblemTypes)
 	if err != nil {
-		names := ""
-		for name := range typeSet {
-			if names != "" {
-				names += ", "
-			}
-			names += name
-		}
-		loggedHTTPErrorf(w, http.StatusInternalServerError,
-			"failed to find daycare for problem type(s) %s: %v", names, err)
+		loggedHTTPErrorf(w, http.StatusServiceUnavailable, "failed to find a daycare for this problem: %v", err)
 		return
 	}
 	bundle.Hostname = host
 
 	// check the commits
 	bundle.CommitSignatures = nil
+	bundle.ReportCardSignatures = nil
+	bundle.Tickets = nil
 
 	for n, commit := range bundle.Commits {
 		commit.ID = 0
@@ -431,6 +484,19 @@ func PostProblemBundleUnconfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser
 		// set timestamps and compute signature
 		sig := commit.ComputeSignature(Config.DaycareSecret, bundle.ProblemTypeSignatures[problemType.Name], bundle.ProblemSignature, bundle.Hostname, bundle.UserID)
 		bundle.CommitSignatures = append(bundle.CommitSignatures, sig)
+
+		// the daycare will not open a grading socket without a ticket
+		ticket, err := issueSocketTicket(&CommitBundle{
+			ProblemType: problemType,
+			Hostname:    bundle.Hostname,
+			UserID:      bundle.UserID,
+			Commit:      commit,
+		}, now.Add(problemTicketLifetime))
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error issuing socket ticket: %v", err)
+			return
+		}
+		bundle.Tickets = append(bundle.Tickets, ticket)
 	}
 
 	render.JSON(http.StatusOK, &bundle)
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// maxCommonFailures is how many of the most common failures are listed per step.
+const maxCommonFailures = 10
+
+// ProblemUsage summarizes how students in every course using a problem have done on it.
+type ProblemUsage struct {
+	ProblemID int64                 `json:"problemID"`
+	Unique    string                `json:"unique"`
+	Note      string                `json:"note"`
+	Students  int64                 `json:"students"`
+	Passed    int64                 `json:"passed"`
+	PassRate  float64               `json:"passRate"`
+	Courses   []*ProblemCourseUsage `json:"courses"`
+	Steps     []*ProblemStepUsage   `json:"steps"`
+}
+
+// ProblemCourseUsage is the part of a ProblemUsage report for one course.
+// A student has passed once they have passed the final step.
+type ProblemCourseUsage struct {
+	CourseID int64   `json:"courseID" meddler:"course_id"`
+	Name     string  `json:"name" meddler:"name"`
+	Label    string  `json:"label" meddler:"lti_label"`
+	Students int64   `json:"students" meddler:"students"`
+	Passed   int64   `json:"passed" meddler:"passed"`
+	Attempts int64   `json:"attempts" meddler:"attempts"`
+	PassRate float64 `json:"passRate" meddler:"-"`
+}
+
+// ProblemStepUsage is the part of a ProblemUsage report for one step, across all courses.
+// Labels counts the failure labels of students whose latest commit failed,
+// and CommonFailures lists the failure signatures those commits share most often.
+type ProblemStepUsage struct {
+	Step           int64            `json:"step" meddler:"step"`
+	Students       int64            `json:"students" meddler:"students"`
+	Passed         int64            `json:"passed" meddler:"passed"`
+	Attempts       int64            `json:"attempts" meddler:"-"`
+	PassRate       float64          `json:"passRate" meddler:"-"`
+	Labels         map[string]int64 `json:"labels" meddler:"-"`
+	CommonFailures []*FailureCount  `json:"commonFailures" meddler:"-"`
+}
+
+// FailureCount is the number of students whose latest commit failed with a given signature.
+type FailureCount struct {
+	Signature string `json:"signature"`
+	Students  int64  `json:"students"`
+}
+
+// GetProblemUsage handles requests to /problems/:problem_id/usage,
+// returning pass rates and common failures for a problem across every course that uses it.
+// Instructor and practice commits are not counted.
+func GetProblemUsage(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	var lastStep int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(step), 0) FROM problem_steps WHERE problem_id = ?`, problemID).Scan(&lastStep); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	usage := &ProblemUsage{
+		ProblemID: problem.ID,
+		Unique:    problem.Unique,
+		Note:      problem.Note,
+		Courses:   []*ProblemCourseUsage{},
+		Steps:     []*ProblemStepUsage{},
+	}
+
+	// per course
+	if err := meddler.QueryAll(tx, &usage.Courses, `SELECT courses.id AS course_id, courses.name, courses.lti_label, `+
+		`COUNT(DISTINCT commits.assignment_id) AS students, `+
+		`COUNT(DISTINCT CASE WHEN commits.step = ? AND commits.score >= 1.0 THEN commits.assignment_id END) AS passed, `+
+		`(SELECT COUNT(1) FROM grading_records JOIN assignments AS graded ON grading_records.assignment_id = graded.id `+
+		`WHERE grading_records.problem_id = ? AND grading_records.action = 'grade' AND graded.course_id = courses.id AND NOT graded.instructor) AS attempts `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`JOIN courses ON assignments.course_id = courses.id `+
+		`WHERE commits.problem_id = ? AND NOT assignments.instructor AND NOT commits.practice `+
+		`GROUP BY courses.id ORDER BY courses.name`, lastStep, problemID, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, course := range usage.Courses {
+		if course.Students > 0 {
+			course.PassRate = float64(course.Passed) / float64(course.Students)
+		}
+		usage.Students += course.Students
+		usage.Passed += course.Passed
+	}
+	if usage.Students > 0 {
+		usage.PassRate = float64(usage.Passed) / float64(usage.Students)
+	}
+
+	// per step
+	if err := meddler.QueryAll(tx, &usage.Steps, `SELECT commits.step, COUNT(1) AS students, `+
+		`COALESCE(SUM(commits.score >= 1.0), 0) AS passed `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`WHERE commits.problem_id = ? AND NOT assignments.instructor AND NOT commits.practice `+
+		`GROUP BY commits.step ORDER BY commits.step`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	steps := make(map[int64]*ProblemStepUsage)
+	for _, step := range usage.Steps {
+		if step.Students > 0 {
+			step.PassRate = float64(step.Passed) / float64(step.Students)
+		}
+		step.Labels = make(map[string]int64)
+		step.CommonFailures = []*FailureCount{}
+		steps[step.Step] = step
+	}
+
+	rows, err := tx.Query(`SELECT grading_records.step, COUNT(1) FROM grading_records `+
+		`JOIN assignments ON grading_records.assignment_id = assignments.id `+
+		`WHERE grading_records.problem_id = ? AND grading_records.action = 'grade' AND NOT assignments.instructor `+
+		`GROUP BY grading_records.step`, problemID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for rows.Next() {
+		var stepN, attempts int64
+		if err := rows.Scan(&stepN, &attempts); err != nil {
+			rows.Close()
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if step, present := steps[stepN]; present {
+			step.Attempts = attempts
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// gather the failures from each student's latest failed commit
+	failed := []*Commit{}
+	if err := meddler.QueryAll(tx, &failed, `SELECT commits.id, commits.step, commits.transcript, commits.transcript_blob, commits.report_card, commits.failure_label `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`WHERE commits.problem_id = ? AND commits.failure_label IS NOT NULL AND NOT assignments.instructor AND NOT commits.practice`,
+		problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadCommitBlobs(failed...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	counts := make(map[int64]map[string]int64)
+	for _, commit := range failed {
+		step, present := steps[commit.Step]
+		if !present {
+			continue
+		}
+		step.Labels[commit.FailureLabel]++
+		if counts[commit.Step] == nil {
+			counts[commit.Step] = make(map[string]int64)
+		}
+		for _, sig := range failureSignatures(commit) {
+			counts[commit.Step][sig]++
+		}
+	}
+	for stepN, sigs := range counts {
+		step := steps[stepN]
+		for sig, n := range sigs {
+			step.CommonFailures = append(step.CommonFailures, &FailureCount{Signature: sig, Students: n})
+		}
+		sort.Slice(step.CommonFailures, func(i, j int) bool {
+			a, b := step.CommonFailures[i], step.CommonFailures[j]
+			if a.Students != b.Students {
+				return a.Students > b.Students
+			}
+			return a.Signature < b.Signature
+		})
+		if len(step.CommonFailures) > maxCommonFailures {
+			step.CommonFailures = step.CommonFailures[:maxCommonFailures]
+		}
+	}
+
+	render.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// queueUpdateInterval is how often a waiting student is told where they are in line.
+	queueUpdateInterval = 5 * time.Second
+
+	// queueHistory is the number of recent jobs per problem type used to estimate waits.
+	queueHistory = 20
+
+	// defaultJobDuration is the estimate for a problem type with no recent jobs.
+	defaultJobDuration = 30 * time.Second
+
+	// diagnosticRecheckInterval is how often a diagnostic job waiting behind
+	// scored jobs checks whether it can have a slot.
+	diagnosticRecheckInterval = time.Second
+)
+
+// queueEntry is one job waiting for or holding a container slot.
+type queueEntry struct {
+	problemType string
+	diagnostic  bool
+	started     time.Time
+}
+
+// gradingQueue tracks the jobs on this daycare in the order they arrived,
+// along with how long recent jobs took, so waiting students can be told
+// roughly how long they will wait. Jobs for diagnostic steps, which never
+// count toward a score, wait until no scored job is waiting.
+type gradingQueue struct {
+	sync.Mutex
+	waiting   []*queueEntry
+	running   map[*queueEntry]bool
+	durations map[string][]time.Duration
+}
+
+var jobQueue = gradingQueue{
+	running:   make(map[*queueEntry]bool),
+	durations: make(map[string][]time.Duration),
+}
+
+// expected returns the average time of recent jobs of a problem type.
+// The lock must be held.
+func (q *gradingQueue) expected(problemType string) time.Duration {
+	list := q.durations[problemType]
+	if len(list) == 0 {
+		return defaultJobDuration
+	}
+	var total time.Duration
+	for _, elt := range list {
+		total += elt
+	}
+	return total / time.Duration(len(list))
+}
+
+// position returns the place in line of a waiting job (starting at 1)
+// and an estimate of how long until it gets a slot.
+func (q *gradingQueue) position(entry *queueEntry, now time.Time) (int, time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	// the work left on running jobs and on jobs ahead in line is shared among the slots
+	var work time.Duration
+	for elt := range q.running {
+		if left := q.expected(elt.problemType) - now.Sub(elt.started); left > 0 {
+			work += left
+		}
+	}
+	position := 1
+	ahead := true
+	for _, elt := range q.waiting {
+		if elt == entry {
+			ahead = false
+			continue
+		}
+		if (ahead && elt.diagnostic == entry.diagnostic) || (entry.diagnostic && !elt.diagnostic) {
+			work += q.expected(elt.problemType)
+			position++
+		}
+	}
+	return position, work / time.Duration(cap(containerSlots))
+}
+
+// scoredWaiting reports whether any job that is not diagnostic is waiting for a slot.
+func (q *gradingQueue) scoredWaiting() bool {
+	q.Lock()
+	defer q.Unlock()
+	for _, elt := range q.waiting {
+		if !elt.diagnostic {
+			return true
+		}
+	}
+	return false
+}
+
+// remove takes a job out of line.
+// The lock must be held.
+func (q *gradingQueue) remove(entry *queueEntry) {
+	for i, elt := range q.waiting {
+		if elt == entry {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// busy returns the number of jobs waiting for or holding a container slot.
+func (q *gradingQueue) busy() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.waiting) + len(q.running)
+}
+
+// acquire waits for a container slot. While it waits, report is called periodically
+// with the job's place in line and estimated wait; if it returns false, acquire gives up
+// and returns nil. Otherwise, the caller must call release when the job is finished.
+// A diagnostic job does not take a slot while a scored job is waiting for one.
+func (q *gradingQueue) acquire(problemType string, diagnostic bool, report func(position int, wait time.Duration) bool) (s *slot, release func()) {
+	entry := &queueEntry{problemType: problemType, diagnostic: diagnostic}
+	q.Lock()
+	q.waiting = append(q.waiting, entry)
+	q.Unlock()
+
+	// a diagnostic job stays off the slots channel until the scored jobs are served
+	slots := func() chan *slot {
+		if diagnostic && q.scoredWaiting() {
+			return nil
+		}
+		return containerSlots
+	}
+
+	// only report if the job actually has to wait
+	select {
+	case s = <-slots():
+	default:
+		interval := queueUpdateInterval
+		if diagnostic {
+			interval = diagnosticRecheckInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var reported time.Time
+		for s == nil {
+			if now := time.Now(); report != nil && now.Sub(reported) >= queueUpdateInterval {
+				reported = now
+				if !report(q.position(entry, now)) {
+					q.Lock()
+					q.remove(entry)
+					q.Unlock()
+					return nil, nil
+				}
+			}
+			select {
+			case s = <-slots():
+			case <-ticker.C:
+			}
+		}
+	}
+
+	q.Lock()
+	q.remove(entry)
+	entry.started = time.Now()
+	q.running[entry] = true
+	q.Unlock()
+
+	return s, func() {
+		q.Lock()
+		delete(q.running, entry)
+		list := append(q.durations[problemType], time.Since(entry.started))
+		if len(list) > queueHistory {
+			list = list[len(list)-queueHistory:]
+		}
+		q.durations[problemType] = list
+		q.Unlock()
+		containerSlots <- s
+	}
+}
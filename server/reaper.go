@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// reaperInterval is how often the daycare looks for abandoned nanny containers.
+const reaperInterval = 5 * time.Minute
+
+// Labels attached to every nanny container.
+const (
+	nannyLabel          = "codegrinder.nanny"
+	nannyDaycareLabel   = "codegrinder.daycare"
+	nannyProblemLabel   = "codegrinder.problem"
+	nannyTypeLabel      = "codegrinder.problem-type"
+	nannyActionLabel    = "codegrinder.action"
+	nannyStartedAtLabel = "codegrinder.started-at"
+)
+
+// nannyLabels returns the container engine arguments that label a nanny container with its job.
+func nannyLabels(name string, problemType *ProblemType, problem *Problem, action string, now time.Time) []string {
+	return []string{
+		"--label", nannyLabel + "=" + name,
+		"--label", nannyDaycareLabel + "=" + Config.Hostname,
+		"--label", nannyProblemLabel + "=" + problem.Unique,
+		"--label", nannyTypeLabel + "=" + problemType.Name,
+		"--label", nannyActionLabel + "=" + action,
+		"--label", nannyStartedAtLabel + "=" + strconv.FormatInt(now.Unix(), 10),
+	}
+}
+
+// nannySet is the set of containers owned by jobs running on this daycare.
+type nannySet struct {
+	sync.Mutex
+	ids map[string]bool
+}
+
+var activeNannies = nannySet{ids: make(map[string]bool)}
+
+func (s *nannySet) add(id string) {
+	s.Lock()
+	defer s.Unlock()
+	s.ids[id] = true
+}
+
+func (s *nannySet) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.ids, id)
+}
+
+func (s *nannySet) contains(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.ids[id]
+}
+
+// runContainerReaper periodically removes nanny containers left behind by
+// crashed jobs, so they do not pile up until the host runs out of space.
+// It never returns.
+func runContainerReaper() {
+	maxAge := time.Duration(Config.ReapAfter) * time.Minute
+	for {
+		time.Sleep(reaperInterval)
+		if !engine.Healthy() {
+			continue
+		}
+		if err := reapContainers(time.Now(), maxAge); err != nil {
+			log.Printf("container reaper: %v", err)
+		}
+	}
+}
+
+// reapContainers removes every nanny container from this daycare that is older than
+// maxAge and is not owned by a running job.
+func reapContainers(now time.Time, maxAge time.Duration) error {
+	output, err := exec.Command(containerEngine, "ps", "--all", "--no-trunc",
+		"--filter", "label="+nannyDaycareLabel+"="+Config.Hostname,
+		"--format", `{{.ID}}	{{.Label "`+nannyStartedAtLabel+`"}}	{{.Label "`+nannyLabel+`"}}`).Output()
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 || activeNannies.contains(fields[0]) {
+			continue
+		}
+		started, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			log.Printf("container reaper: container %s has a bad start time %q", fields[0], fields[1])
+			continue
+		}
+		age := now.Sub(time.Unix(started, 0))
+		if age < maxAge {
+			continue
+		}
+		if err := removeContainer(fields[0]); err != nil {
+			log.Printf("container reaper: %v", err)
+			continue
+		}
+		log.Printf("container reaper: removed %s (%s) after %v", fields[2], fields[0], age.Round(time.Minute))
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("container reaper: removed %d abandoned container(s)", removed)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+const (
+	redactedSecret  = "[secret]"
+	redactedFixture = "[hidden]"
+	redactedPattern = "[redacted]"
+
+	// hiddenLineMin is the shortest line of a hidden fixture file that is redacted.
+	// Shorter lines (closing braces, blank lines, and the like) are too common to hide.
+	hiddenLineMin = 12
+)
+
+// redaction is a literal string to replace in grader output.
+type redaction struct {
+	text        []byte
+	replacement []byte
+}
+
+// redactions are removed from grader output before it reaches the client,
+// the transcript, or the report card:
+//
+//   - the values of problem secrets
+//   - the student's home directory in the container, so paths are shown relative to it
+//   - the lines of hidden fixture files named by hidden=file1,file2 problem options
+//   - matches of regular expressions given by redact=pattern problem options
+//
+// A nil *redactions removes nothing.
+type redactions struct {
+	literals []redaction
+	patterns []*regexp.Regexp
+}
+
+// newRedactions collects the redactions for a job. The problem and files
+// may be nil when there is nothing problem-specific to hide.
+func newRedactions(secrets map[string]string, home string, problem *Problem, files map[string][]byte) *redactions {
+	r := new(redactions)
+	add := func(text, replacement string) {
+		if text != "" {
+			r.literals = append(r.literals, redaction{text: []byte(text), replacement: []byte(replacement)})
+		}
+	}
+	for _, value := range secrets {
+		add(value, redactedSecret)
+	}
+	add(home, "")
+	if strings.Contains(home, "/") && strings.Contains(home, ":") {
+		// windows tools may report the same directory with backslashes
+		add(strings.ReplaceAll(home, "/", "\\"), "")
+	}
+
+	if problem != nil {
+		for _, option := range problem.Options {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch strings.TrimSpace(parts[0]) {
+			case "hidden":
+				for _, name := range strings.Split(parts[1], ",") {
+					contents, present := files[strings.TrimSpace(name)]
+					if !present {
+						log.Printf("problem %s: hidden file %q not found", problem.Unique, name)
+						continue
+					}
+					for _, line := range strings.Split(string(contents), "\n") {
+						if line = strings.TrimSpace(line); len(line) >= hiddenLineMin {
+							add(line, redactedFixture)
+						}
+					}
+				}
+			case "redact":
+				re, err := regexp.Compile(parts[1])
+				if err != nil {
+					log.Printf("problem %s: bad redact pattern %q: %v", problem.Unique, parts[1], err)
+					continue
+				}
+				r.patterns = append(r.patterns, re)
+			}
+		}
+	}
+
+	// replace longer strings first in case one contains another
+	sort.SliceStable(r.literals, func(i, j int) bool { return len(r.literals[i].text) > len(r.literals[j].text) })
+	return r
+}
+
+// partial returns the length of the longest tail of data that could be
+// the start of a literal redaction completed by the next write.
+func (r *redactions) partial(data []byte) int {
+	if r == nil || len(r.literals) == 0 {
+		return 0
+	}
+	start := len(data) - (len(r.literals[0].text) - 1)
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < len(data); i++ {
+		tail := data[i:]
+		for _, elt := range r.literals {
+			if len(elt.text) > len(tail) && elt.text[0] == tail[0] && bytes.HasPrefix(elt.text, tail) {
+				return len(tail)
+			}
+		}
+	}
+	return 0
+}
+
+func (r *redactions) empty() bool {
+	return r == nil || (len(r.literals) == 0 && len(r.patterns) == 0)
+}
+
+// apply returns data with all redactions made.
+func (r *redactions) apply(data []byte) []byte {
+	if r.empty() {
+		return data
+	}
+	for _, elt := range r.literals {
+		data = bytes.ReplaceAll(data, elt.text, elt.replacement)
+	}
+	for _, re := range r.patterns {
+		data = re.ReplaceAll(data, []byte(redactedPattern))
+	}
+	return data
+}
+
+func (r *redactions) applyString(s string) string {
+	if r.empty() {
+		return s
+	}
+	return string(r.apply([]byte(s)))
+}
+
+// reportCard redacts the messages in a report card.
+func (r *redactions) reportCard(rc *ReportCard) {
+	if r.empty() || rc == nil {
+		return
+	}
+	rc.Note = r.applyString(rc.Note)
+	for _, result := range rc.Results {
+		result.Name = r.applyString(result.Name)
+		result.Details = r.applyString(result.Details)
+		result.Context = r.applyString(result.Context)
+	}
+}
+
+// transcript redacts the stream data in a transcript once more. Output is
+// redacted as it is produced, but a pattern match split across two writes
+// can only be caught once the pieces have been merged.
+func (r *redactions) transcript(events []*EventMessage) {
+	if r.empty() {
+		return
+	}
+	for _, event := range events {
+		if len(event.StreamData) > 0 {
+			event.StreamData = r.apply(event.StreamData)
+		}
+	}
+}
+
+// redactWriter is a helper type that implements io.Writer. It makes the
+// redactions before passing output along. Output that could be the start of
+// a literal split across writes is held back until the next write or Flush,
+// so an interactive prompt is only delayed if it looks like a redaction.
+type redactWriter struct {
+	w       io.Writer
+	r       *redactions
+	pending []byte
+}
+
+func newRedactWriter(w io.Writer, r *redactions) *redactWriter {
+	return &redactWriter{w: w, r: r}
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	if rw.r.empty() {
+		return rw.w.Write(p)
+	}
+	rw.pending = rw.r.apply(append(rw.pending, p...))
+	keep := rw.r.partial(rw.pending)
+	if len(rw.pending) > keep {
+		out := rw.pending[:len(rw.pending)-keep]
+		if _, err := rw.w.Write(out); err != nil {
+			return 0, err
+		}
+		rw.pending = append([]byte(nil), rw.pending[len(rw.pending)-keep:]...)
+	}
+	return len(p), nil
+}
+
+// Flush writes out any output that was held back.
+func (rw *redactWriter) Flush() {
+	if len(rw.pending) > 0 {
+		rw.w.Write(rw.pending)
+		rw.pending = nil
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal client for the Redis protocol (RESP), supporting
+// just enough to run simple commands over a single shared connection.
+type redisClient struct {
+	sync.Mutex
+	address  string
+	password string
+	conn     net.Conn
+	reader   *bufio.Reader
+	lastUsed time.Time
+}
+
+// redisIdempotent lists the commands that are safe to send twice.
+// Others, like GETDEL, are not retried after a connection error, since the
+// first attempt may already have reached the server.
+var redisIdempotent = map[string]bool{
+	"PING":   true,
+	"GET":    true,
+	"EXISTS": true,
+	"TTL":    true,
+}
+
+// redisIdleCheck is how long a connection can sit unused before it is checked
+// with a PING ahead of a command that cannot be retried.
+const redisIdleCheck = 30 * time.Second
+
+// redisError is an error reply from the Redis server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisClient(address, password string) *redisClient {
+	return &redisClient{address: address, password: password}
+}
+
+// Do sends a command and returns the reply, which will be a string, an int64,
+// nil, or a []interface{} of those. A connection error causes a single
+// reconnect attempt for idempotent commands. Other commands are sent over
+// a connection that has just been checked, and their errors are returned.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	retry := redisIdempotent[strings.ToUpper(args[0])]
+	if !retry && c.conn != nil && time.Since(c.lastUsed) > redisIdleCheck {
+		// replace a stale connection before sending something that cannot be repeated
+		if _, err := c.retried([]string{"PING"}); err != nil {
+			return nil, err
+		}
+	}
+	if retry {
+		return c.retried(args)
+	}
+	reply, err := c.do(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.close()
+	}
+	return reply, err
+}
+
+// retried sends a command, trying once more on a fresh connection if the first attempt fails.
+// The lock must be held.
+func (c *redisClient) retried(args []string) (interface{}, error) {
+	reply, err := c.do(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// the connection may have gone stale, so try once more with a fresh one
+		c.close()
+		reply, err = c.do(args)
+	}
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) do(args []string) (interface{}, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+		if c.password != "" {
+			if _, err := c.roundTrip([]string{"AUTH", c.password}); err != nil {
+				c.close()
+				return nil, err
+			}
+		}
+	}
+	return c.roundTrip(args)
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.lastUsed = time.Now()
+	c.conn.SetDeadline(c.lastUsed.Add(5 * time.Second))
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+	}
+}
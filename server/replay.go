@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/russross/codegrinder/sdk"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+const (
+	// gradingSeedVar is set to the job's seed for every command run in the container.
+	// Graders that shuffle or generate test inputs should seed from it so a replay
+	// sees the same inputs.
+	gradingSeedVar = "CODEGRINDER_SEED"
+
+	// gradingRecordHistory is the number of records returned by a listing.
+	gradingRecordHistory = 100
+
+	// replayTimeout bounds the wait for a daycare to replay a job.
+	replayTimeout = 10 * time.Minute
+)
+
+// GradingRecord has everything needed to run a grading job again exactly as it first ran:
+// the image digest, the files put in the container, the limits, arguments,
+// environment, and seed. Secrets are listed by name only; a replay uses their current values.
+// The report card is the one the student received.
+type GradingRecord struct {
+	ID              int64                `json:"id" meddler:"id,pk"`
+	Hostname        string               `json:"hostname" meddler:"hostname"`
+	CommitID        int64                `json:"commitID" meddler:"commit_id"`
+	AssignmentID    int64                `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID       int64                `json:"problemID" meddler:"problem_id"`
+	Unique          string               `json:"unique" meddler:"unique_id"`
+	Step            int64                `json:"step" meddler:"step"`
+	ProblemType     string               `json:"problemType" meddler:"problem_type"`
+	OS              string               `json:"os" meddler:"os"`
+	Action          string               `json:"action" meddler:"action"`
+	ActionSpec      *ProblemTypeAction   `json:"actionSpec" meddler:"action_spec,json"`
+	Image           string               `json:"image" meddler:"image"`
+	ImageDigest     string               `json:"imageDigest" meddler:"image_digest"`
+	Seed            int64                `json:"seed" meddler:"seed"`
+	Args            []string             `json:"args" meddler:"args,json"`
+	Env             map[string]string    `json:"env" meddler:"env,json"`
+	SecretNames     []string             `json:"secretNames" meddler:"secret_names,json"`
+	Options         []string             `json:"options" meddler:"options,json"`
+	Tests           map[string]*StepTest `json:"tests,omitempty" meddler:"tests,json"`
+	Files           map[string]string    `json:"files" meddler:"files,json"`
+	InstructorFiles map[string]string    `json:"instructorFiles" meddler:"instructor_files,json"`
+	ReportCard      *ReportCard          `json:"reportCard" meddler:"report_card,json"`
+	Score           float64              `json:"score" meddler:"score"`
+	CreatedAt       time.Time            `json:"createdAt" meddler:"created_at,localtime"`
+
+	// Residency names the residency store holding the files, if the course had one.
+	Residency string `json:"-" meddler:"residency,zeroisnull"`
+
+	// Contents holds the files named in Files and InstructorFiles, keyed by hash.
+	// It is only filled in when a record is sent between the TA and a daycare.
+	Contents  map[string][]byte `json:"contents,omitempty" meddler:"-"`
+	Signature string            `json:"signature,omitempty" meddler:"-"`
+}
+
+func (record *GradingRecord) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", record.Hostname)
+	v.Add("commit_id", strconv.FormatInt(record.CommitID, 10))
+	v.Add("assignment_id", strconv.FormatInt(record.AssignmentID, 10))
+	v.Add("problem_id", strconv.FormatInt(record.ProblemID, 10))
+	v.Add("unique", record.Unique)
+	v.Add("step", strconv.FormatInt(record.Step, 10))
+	v.Add("problem_type", record.ProblemType)
+	v.Add("os", record.OS)
+	v.Add("action", record.Action)
+	if raw, err := json.Marshal(record.ActionSpec); err == nil {
+		v.Add("action_spec", string(raw))
+	}
+	v.Add("image", record.Image)
+	v.Add("image_digest", record.ImageDigest)
+	v.Add("seed", strconv.FormatInt(record.Seed, 10))
+	for _, elt := range record.Args {
+		v.Add("arg", elt)
+	}
+	for name, value := range record.Env {
+		v.Add("env-"+name, value)
+	}
+	for _, elt := range record.SecretNames {
+		v.Add("secret_name", elt)
+	}
+	for _, elt := range record.Options {
+		v.Add("option", elt)
+	}
+	if len(record.Tests) > 0 {
+		if raw, err := json.Marshal(record.Tests); err == nil {
+			v.Add("tests", string(raw))
+		}
+	}
+	for name, hash := range record.Files {
+		v.Add("file-"+name, hash)
+	}
+	for name, hash := range record.InstructorFiles {
+		v.Add("instructor_file-"+name, hash)
+	}
+	for hash, contents := range record.Contents {
+		sum := sha256.Sum256(contents)
+		v.Add("contents-"+hash, hex.EncodeToString(sum[:]))
+	}
+	if raw, err := json.Marshal(record.ReportCard); err == nil {
+		v.Add("report_card", string(raw))
+	}
+	v.Add("score", strconv.FormatFloat(record.Score, 'g', -1, 64))
+	v.Add("created_at", record.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// gradingEnv returns the environment that makes a job repeatable for a seed.
+func gradingEnv(seed int64) map[string]string {
+	return map[string]string{
+		gradingSeedVar:   strconv.FormatInt(seed, 10),
+		"PYTHONHASHSEED": strconv.FormatInt(seed%(1<<32), 10),
+	}
+}
+
+// hashFiles returns the hash of each file and adds the contents to a set keyed by hash.
+func hashFiles(files map[string][]byte, contents map[string][]byte) map[string]string {
+	hashes := make(map[string]string)
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		hashes[name] = hash
+		contents[hash] = data
+	}
+	return hashes
+}
+
+// unhashFiles looks up the contents of a set of hashed files.
+func unhashFiles(hashes map[string]string, contents map[string][]byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for name, hash := range hashes {
+		data, present := contents[hash]
+		if !present {
+			return nil, fmt.Errorf("contents of %s (%s) are missing", name, hash)
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// imageDigest finds the immutable name of the image a tag refers to right now,
+// preferring a registry digest so the image can be pulled again later.
+func imageDigest(image string) string {
+	output, err := exec.Command(containerEngine, "image", "inspect", "--format", `{{join .RepoDigests " "}}|{{.Id}}`, image).Output()
+	if err != nil {
+		log.Printf("error finding the digest of image %s: %v", image, err)
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(output)), "|", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	repo := image
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	for _, elt := range strings.Fields(parts[0]) {
+		if strings.HasPrefix(elt, repo+"@") {
+			return elt
+		}
+	}
+	return parts[1]
+}
+
+// newGradingRecord describes a grading job on this daycare before it runs.
+func newGradingRecord(bundle *CommitBundle, action *ProblemTypeAction, args []string, limits *limits, seed int64, secrets map[string]string, files, instructorFiles map[string][]byte) *GradingRecord {
+	// record the limits the container actually gets, not the problem type defaults
+	spec := *action
+	spec.MaxCPU = limits.maxCPU
+	spec.MaxSession = limits.maxSession
+	spec.MaxTimeout = limits.maxTimeout
+	spec.MaxFD = limits.maxFD
+	spec.MaxFileSize = limits.maxFileSize
+	spec.MaxMemory = limits.maxMemory
+	spec.MaxThreads = limits.maxThreads
+
+	secretNames := []string{}
+	for name := range secrets {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+	sortedArgs := append([]string{}, args...)
+	sort.Strings(sortedArgs)
+
+	contents := make(map[string][]byte)
+	record := &GradingRecord{
+		Hostname:        Config.Hostname,
+		CommitID:        bundle.Commit.ID,
+		AssignmentID:    bundle.Commit.AssignmentID,
+		ProblemID:       bundle.Commit.ProblemID,
+		Unique:          bundle.Problem.Unique,
+		Step:            bundle.Commit.Step,
+		ProblemType:     bundle.ProblemType.Name,
+		OS:              bundle.ProblemType.OS,
+		Action:          action.Action,
+		ActionSpec:      &spec,
+		Image:           bundle.ProblemType.Image,
+		ImageDigest:     imageDigest(bundle.ProblemType.Image),
+		Seed:            seed,
+		Args:            sortedArgs,
+		Env:             gradingEnv(seed),
+		SecretNames:     secretNames,
+		Options:         bundle.Problem.Options,
+		Tests:           bundle.ProblemSteps[bundle.Commit.Step-1].Tests,
+		Files:           hashFiles(files, contents),
+		InstructorFiles: hashFiles(instructorFiles, contents),
+		Contents:        contents,
+	}
+	if record.Options == nil {
+		record.Options = []string{}
+	}
+	return record
+}
+
+// report signs a finished record and sends it to the TA.
+func (record *GradingRecord) report(reportCard *ReportCard, score float64) {
+	record.ReportCard = reportCard
+	record.Score = score
+	record.CreatedAt = time.Now()
+	record.Signature = record.ComputeSignature(Config.DaycareSecret)
+	go func() {
+		if err := postToTA("/grading_records", record, nil); err != nil {
+			log.Printf("error posting grading record: %v", err)
+		}
+	}()
+}
+
+// gradingFilesStore returns the blob store for the files of grading records
+// from a residency, or nil if they are kept in the database.
+func gradingFilesStore(residency string) (BlobStore, error) {
+	if residency == "" {
+		return blobStore, nil
+	}
+	store := residencyStores[residency]
+	if store == nil {
+		return nil, fmt.Errorf("grading files are in residency store %q, which is not configured", residency)
+	}
+	return store, nil
+}
+
+// storeGradingFiles saves file contents by hash, in the blob store if there is one.
+// Files from a course with a data residency go to that residency's store.
+// Contents already saved are not written again.
+func storeGradingFiles(tx *sql.Tx, residency string, contents map[string][]byte) error {
+	store, err := gradingFilesStore(residency)
+	if err != nil {
+		return err
+	}
+	for hash, data := range contents {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != hash {
+			return fmt.Errorf("file contents do not match hash %s", hash)
+		}
+		if store != nil {
+			if err := store.Put("files/"+hash, bytes.NewReader(data), int64(len(data)), hash); err != nil {
+				return fmt.Errorf("storing file %s: %v", hash, err)
+			}
+			continue
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO grading_files (hash, contents) VALUES (?, ?)`, hash, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadGradingFiles fills in the contents of the files a record names.
+func loadGradingFiles(tx *sql.Tx, record *GradingRecord) error {
+	store, err := gradingFilesStore(record.Residency)
+	if err != nil {
+		return err
+	}
+	record.Contents = make(map[string][]byte)
+	for _, hashes := range []map[string]string{record.Files, record.InstructorFiles} {
+		for _, hash := range hashes {
+			if _, present := record.Contents[hash]; present {
+				continue
+			}
+			var data []byte
+			var err error
+			if store != nil {
+				data, err = store.Get("files/" + hash)
+			} else {
+				err = tx.QueryRow(`SELECT contents FROM grading_files WHERE hash = ?`, hash).Scan(&data)
+			}
+			if err != nil {
+				return fmt.Errorf("loading file %s for grading record %d: %v", hash, record.ID, err)
+			}
+			record.Contents[hash] = data
+		}
+	}
+	return nil
+}
+
+// PostGradingRecord handles requests to /grading_records,
+// saving the record of a grading job reported by a daycare.
+func PostGradingRecord(w http.ResponseWriter, tx *sql.Tx, record GradingRecord) {
+	sig := record.ComputeSignature(Config.DaycareSecret)
+	if sig != record.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grading record signature mismatch: computed %s but found %s", sig, record.Signature)
+		return
+	}
+	drift := time.Since(record.CreatedAt)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grading record is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+	if _, err := unhashFiles(record.Files, record.Contents); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grading record: %v", err)
+		return
+	}
+	if _, err := unhashFiles(record.InstructorFiles, record.Contents); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grading record: %v", err)
+		return
+	}
+
+	var courseID int64
+	if err := tx.QueryRow(`SELECT course_id FROM assignments WHERE id = ?`, record.AssignmentID).Scan(&courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	residency, err := courseResidency(tx, courseID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := storeGradingFiles(tx, residency, record.Contents); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	record.Residency = residency
+	record.ID = 0
+	record.CreatedAt = time.Now()
+	if err := meddler.Insert(tx, "grading_records", &record); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// GetGradingRecords handles requests to /grading_records,
+// returning the most recent grading records, newest first.
+//
+// Parameters assignment_id, problem_id, and step can be used to restrict the list.
+func GetGradingRecords(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where, args := "", []interface{}{}
+	for _, field := range []string{"assignment_id", "problem_id", "step"} {
+		if val := r.FormValue(field); val != "" {
+			id, err := parseID(w, field, val)
+			if err != nil {
+				return
+			}
+			where, args = addWhereEq(where, args, field, id)
+		}
+	}
+	args = append(args, gradingRecordHistory)
+
+	records := []*GradingRecord{}
+	if err := meddler.QueryAll(tx, &records, `SELECT * FROM grading_records`+where+` ORDER BY id DESC LIMIT ?`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, records)
+}
+
+// GradingReplay is sent by the TA to a daycare to run a recorded job again.
+type GradingReplay struct {
+	Hostname  string         `json:"hostname"`
+	Record    *GradingRecord `json:"record"`
+	Time      time.Time      `json:"time"`
+	Signature string         `json:"signature,omitempty"`
+}
+
+func (replay *GradingReplay) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", replay.Hostname)
+	if replay.Record != nil {
+		v.Add("record", replay.Record.ComputeSignature(secret))
+	}
+	v.Add("time", replay.Time.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// GradingReplayResult is the outcome of replaying a recorded job,
+// alongside the outcome the student originally received.
+type GradingReplayResult struct {
+	RecordID           int64           `json:"recordID"`
+	Hostname           string          `json:"hostname"`
+	ImageDigest        string          `json:"imageDigest"`
+	ReportCard         *ReportCard     `json:"reportCard"`
+	Score              float64         `json:"score"`
+	Transcript         []*EventMessage `json:"transcript"`
+	OriginalReportCard *ReportCard     `json:"originalReportCard"`
+	OriginalScore      float64         `json:"originalScore"`
+	Identical          bool            `json:"identical"`
+	Differences        []string        `json:"differences"`
+	Notes              []string        `json:"notes,omitempty"`
+}
+
+// PostDaycareReplay handles requests to /daycare_replays on a daycare,
+// running a recorded job again and returning the result.
+func PostDaycareReplay(w http.ResponseWriter, replay GradingReplay) {
+	sig := replay.ComputeSignature(Config.DaycareSecret)
+	if sig != replay.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "replay signature mismatch: computed %s but found %s", sig, replay.Signature)
+		return
+	}
+	if replay.Hostname != Config.Hostname {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "replay is signed for host %s, this is %s", replay.Hostname, Config.Hostname)
+		return
+	}
+	drift := time.Since(replay.Time)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "replay is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+	record := replay.Record
+	if record == nil || record.ActionSpec == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "replay must include the grading record and its action")
+		return
+	}
+	files, err := unhashFiles(record.Files, record.Contents)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "replay: %v", err)
+		return
+	}
+	instructorFiles, err := unhashFiles(record.InstructorFiles, record.Contents)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "replay: %v", err)
+		return
+	}
+	if !engine.Healthy() {
+		loggedHTTPErrorf(w, http.StatusServiceUnavailable, "the container engine on %s is not available", Config.Hostname)
+		return
+	}
+
+	result := &GradingReplayResult{
+		RecordID:    record.ID,
+		Hostname:    Config.Hostname,
+		ImageDigest: record.ImageDigest,
+	}
+	secrets, err := fetchProblemSecrets(record.ProblemType, record.ProblemID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadGateway, "error fetching problem secrets: %v", err)
+		return
+	}
+	for _, name := range record.SecretNames {
+		if _, present := secrets[name]; !present {
+			result.Notes = append(result.Notes, fmt.Sprintf("secret %s no longer exists", name))
+		}
+	}
+	if len(secrets) != len(record.SecretNames) {
+		result.Notes = append(result.Notes, "the problem's secrets have changed since the original job")
+	}
+
+	// run the recorded image by digest, falling back on the tag for old records
+	image := record.ImageDigest
+	if image == "" {
+		image = record.Image
+		result.ImageDigest = imageDigest(image)
+		result.Notes = append(result.Notes, fmt.Sprintf("no image digest was recorded, so %s was used", image))
+	}
+	problemType := &ProblemType{Name: record.ProblemType, Image: image, OS: record.OS}
+	problem := &Problem{ID: record.ProblemID, Unique: record.Unique, Options: record.Options}
+
+	slot, release := jobQueue.acquire(record.ProblemType, false, nil)
+	defer release()
+	n, err := NewNanny(problemType, problem, record.Action, record.Args, newLimits(record.ActionSpec).inSlot(slot), fmt.Sprintf("replay-%d", record.ID))
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error creating container: %v", err)
+		return
+	}
+	redactions := newRedactions(secrets, n.home(), problem, instructorFiles)
+	n.Secrets = secrets
+	n.Env = record.Env
+	n.Redactions = redactions
+	defer func() {
+		if err := n.Shutdown("replay finished"); err != nil {
+			log.Printf("replay nanny shutdown error: %v", err)
+		}
+	}()
+
+	// keep the transcript, which is useful when the results differ
+	eventListenerClosed := make(chan struct{})
+	go func() {
+		for event := range n.Events {
+			if len(result.Transcript) < TranscriptEventCountLimit {
+				result.Transcript = append(result.Transcript, event)
+			}
+		}
+		eventListenerClosed <- struct{}{}
+	}()
+	submitted := submittedFiles(files, instructorFiles)
+	if checkBannedUses(n, problem, submitted) {
+		// nothing to run, as in the original job
+	} else if err := n.PutFiles(files, 0666); err != nil {
+		n.ReportCard.LogAndFailf("uploading files: %v", err)
+	} else if checkRequirements(n, problem, submitted) {
+		// likewise
+	} else {
+		runAction(n, record.ActionSpec)
+	}
+	close(n.Events)
+	<-eventListenerClosed
+
+	redactions.reportCard(n.ReportCard)
+	redactions.transcript(result.Transcript)
+	result.ReportCard = n.ReportCard
+	result.Score = sdk.Score(n.ReportCard, record.Tests)
+	log.Printf("replayed grading record %d (%s step %d) with score %0.5f", record.ID, record.Unique, record.Step, result.Score)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("error encoding replay result: %v", err)
+	}
+}
+
+// diffReportCards lists the ways two report cards differ, ignoring how long grading took.
+func diffReportCards(original, replayed *ReportCard) []string {
+	if original == nil {
+		original = NewReportCard()
+	}
+	if replayed == nil {
+		replayed = NewReportCard()
+	}
+	diffs := []string{}
+	if original.Passed != replayed.Passed {
+		diffs = append(diffs, fmt.Sprintf("passed: %v became %v", original.Passed, replayed.Passed))
+	}
+	if original.Note != replayed.Note {
+		diffs = append(diffs, fmt.Sprintf("note: %q became %q", original.Note, replayed.Note))
+	}
+	if len(original.Results) != len(replayed.Results) {
+		diffs = append(diffs, fmt.Sprintf("number of results: %d became %d", len(original.Results), len(replayed.Results)))
+	}
+	for i := 0; i < len(original.Results) || i < len(replayed.Results); i++ {
+		switch {
+		case i >= len(replayed.Results):
+			diffs = append(diffs, fmt.Sprintf("result %d (%s): missing from the replay", i+1, original.Results[i].Name))
+		case i >= len(original.Results):
+			diffs = append(diffs, fmt.Sprintf("result %d (%s): only in the replay", i+1, replayed.Results[i].Name))
+		default:
+			a, b := original.Results[i], replayed.Results[i]
+			if a.Name != b.Name {
+				diffs = append(diffs, fmt.Sprintf("result %d: name %q became %q", i+1, a.Name, b.Name))
+			}
+			if a.Outcome != b.Outcome {
+				diffs = append(diffs, fmt.Sprintf("result %d (%s): outcome %s became %s", i+1, b.Name, a.Outcome, b.Outcome))
+			}
+			if a.Details != b.Details {
+				diffs = append(diffs, fmt.Sprintf("result %d (%s): details differ", i+1, b.Name))
+			}
+			if a.Context != b.Context {
+				diffs = append(diffs, fmt.Sprintf("result %d (%s): context %q became %q", i+1, b.Name, a.Context, b.Context))
+			}
+		}
+	}
+	return diffs
+}
+
+// PostGradingRecordReplay handles requests to /grading_records/:record_id/replay,
+// running a recorded job again on a daycare and comparing the new report card
+// with the one the student received. The original daycare is used if it is still
+// registered; otherwise any daycare that can run the problem type is used.
+func PostGradingRecordReplay(w http.ResponseWriter, tx *sql.Tx, currentUser *User, params martini.Params, render render.Render) {
+	recordID, err := parseID(w, "record_id", params["record_id"])
+	if err != nil {
+		return
+	}
+	record := new(GradingRecord)
+	if err := meddler.Load(tx, "grading_records", record, recordID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := loadGradingFiles(tx, record); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	// find a daycare that can run it
+	problemType, err := getProblemType(tx, record.ProblemType)
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	problemType.OS = record.OS
+	if err := daycareRegistrations.Expire(tx); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	daycares, err := daycareRegistrations.List(tx)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	hostname := record.Hostname
+	if reg := daycares[hostname]; reg == nil || !reg.canRun(problemType) {
+		hostname, err = daycareRegistrations.Assign(tx, map[string]*ProblemType{problemType.Name: problemType})
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusServiceUnavailable, "no daycare can replay this job: %v", err)
+			return
+		}
+	}
+
+	replay := &GradingReplay{
+		Hostname: hostname,
+		Record:   record,
+		Time:     time.Now(),
+	}
+	replay.Signature = replay.ComputeSignature(Config.DaycareSecret)
+	log.Printf("user %d (%s) is replaying grading record %d on %s", currentUser.ID, currentUser.Email, record.ID, hostname)
+	result := new(GradingReplayResult)
+	if err := postToHostTimeout(hostname, "/daycare_replays", replay, result, replayTimeout); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadGateway, "replaying grading record on %s: %v", hostname, err)
+		return
+	}
+
+	result.OriginalReportCard = record.ReportCard
+	result.OriginalScore = record.Score
+	result.Differences = diffReportCards(record.ReportCard, result.ReportCard)
+	if result.Score != record.Score {
+		result.Differences = append(result.Differences, fmt.Sprintf("score: %0.5f became %0.5f", record.Score, result.Score))
+	}
+	if hostname != record.Hostname {
+		result.Notes = append(result.Notes, fmt.Sprintf("originally graded on %s", record.Hostname))
+	}
+	result.Identical = len(result.Differences) == 0
+	render.JSON(http.StatusOK, result)
+}
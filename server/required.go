@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Problem options that require parts of a solution, each taking a comma-separated list:
+//
+//	require-recursion=fib,Tree.walk   functions or methods that must call themselves (* for any)
+//	require-function=main,helper      functions that must be defined
+//	require-class=Stack               classes (types in Go) that must be defined
+//	require-method=Stack.push         methods that a class must define
+//
+// Requirements are checked against the syntax tree of the files the student
+// submitted, so a name in a comment or string does not count. Go and Python
+// files can be checked; for other languages the requirements are ignored.
+const (
+	requireRecursion = "require-recursion"
+	requireFunction  = "require-function"
+	requireClass     = "require-class"
+	requireMethod    = "require-method"
+)
+
+// outlineTimeout is how long parsing the student's Python files in the container may take.
+const outlineTimeout = 20 * time.Second
+
+// sourceOutline lists what a set of source files defines. Functions are keyed
+// by name, and methods by class.method, with true for those that call themselves.
+type sourceOutline struct {
+	Functions map[string]bool `json:"functions"`
+	Classes   []string        `json:"classes"`
+}
+
+func (outline *sourceOutline) merge(other *sourceOutline) {
+	for name, recursive := range other.Functions {
+		outline.Functions[name] = outline.Functions[name] || recursive
+	}
+	outline.Classes = append(outline.Classes, other.Classes...)
+}
+
+func (outline *sourceOutline) hasClass(name string) bool {
+	for _, elt := range outline.Classes {
+		if elt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// outlineGo parses Go source files.
+func outlineGo(files map[string][]byte) (*sourceOutline, error) {
+	outline := &sourceOutline{Functions: make(map[string]bool)}
+	fset := token.NewFileSet()
+	for name, contents := range files {
+		file, err := parser.ParseFile(fset, name, contents, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if spec, ok := spec.(*ast.TypeSpec); ok {
+						outline.Classes = append(outline.Classes, spec.Name.Name)
+					}
+				}
+
+			case *ast.FuncDecl:
+				if decl.Recv == nil || len(decl.Recv.List) == 0 {
+					outline.Functions[decl.Name.Name] = outline.Functions[decl.Name.Name] || callsFunction(decl.Body, decl.Name.Name)
+					continue
+				}
+				recv := decl.Recv.List[0]
+				receiver := ""
+				if len(recv.Names) > 0 {
+					receiver = recv.Names[0].Name
+				}
+				key := goReceiverType(recv.Type) + "." + decl.Name.Name
+				outline.Functions[key] = outline.Functions[key] || callsMethod(decl.Body, receiver, decl.Name.Name)
+			}
+		}
+	}
+	return outline, nil
+}
+
+// goReceiverType returns the name of a method's receiver type, without pointers or type parameters.
+func goReceiverType(expr ast.Expr) string {
+	for {
+		switch elt := expr.(type) {
+		case *ast.StarExpr:
+			expr = elt.X
+		case *ast.IndexExpr:
+			expr = elt.X
+		case *ast.IndexListExpr:
+			expr = elt.X
+		case *ast.ParenExpr:
+			expr = elt.X
+		case *ast.Ident:
+			return elt.Name
+		default:
+			return ""
+		}
+	}
+}
+
+func callsFunction(body *ast.BlockStmt, name string) bool {
+	found := false
+	if body != nil {
+		ast.Inspect(body, func(node ast.Node) bool {
+			if call, ok := node.(*ast.CallExpr); ok {
+				if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == name {
+					found = true
+				}
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+func callsMethod(body *ast.BlockStmt, receiver, name string) bool {
+	found := false
+	if body != nil && receiver != "" && receiver != "_" {
+		ast.Inspect(body, func(node ast.Node) bool {
+			if call, ok := node.(*ast.CallExpr); ok {
+				if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == name {
+					if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == receiver {
+						found = true
+					}
+				}
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// pythonOutlineScript prints the outline of the Python files named on its
+// command line. It only parses the files, so none of the student's code runs.
+// Methods count as recursive when they call themselves through self or cls.
+const pythonOutlineScript = `
+import ast, json, sys
+
+functions, classes = {}, []
+
+def calls_self(node, name, method):
+    for sub in ast.walk(node):
+        if isinstance(sub, ast.Call):
+            f = sub.func
+            if not method and isinstance(f, ast.Name) and f.id == name:
+                return True
+            if method and isinstance(f, ast.Attribute) and f.attr == name and isinstance(f.value, ast.Name) and f.value.id in ('self', 'cls'):
+                return True
+    return False
+
+def visit(nodes, cls):
+    for node in nodes:
+        if isinstance(node, (ast.FunctionDef, ast.AsyncFunctionDef)):
+            key = cls + '.' + node.name if cls else node.name
+            functions[key] = functions.get(key, False) or calls_self(node, node.name, cls is not None)
+            visit(node.body, None)
+        elif isinstance(node, ast.ClassDef):
+            classes.append(node.name)
+            visit(node.body, node.name)
+        elif isinstance(node, ast.stmt):
+            visit(ast.iter_child_nodes(node), cls)
+
+for path in sys.argv[1:]:
+    with open(path, encoding='utf-8') as fp:
+        visit(ast.parse(fp.read(), path).body, None)
+json.dump({'functions': functions, 'classes': classes}, sys.stdout)
+`
+
+// outlinePython parses Python files that have already been copied into the container.
+// It uses the container's own Python, which knows the syntax of the version the tests use.
+func outlinePython(n *Nanny, names []string) (*sourceOutline, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), outlineTimeout)
+	defer cancel()
+	args := []string{"exec", "--user", n.user(), n.ID, "python3", "-I", "-c", pythonOutlineScript}
+	for _, name := range names {
+		args = append(args, n.home()+name)
+	}
+	output, err := exec.CommandContext(ctx, containerEngine, args...).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && len(exit.Stderr) > 0 {
+			return nil, fmt.Errorf("parsing python files: %s", strings.TrimSpace(string(exit.Stderr)))
+		}
+		return nil, fmt.Errorf("parsing python files: %v", err)
+	}
+	outline := new(sourceOutline)
+	if err := json.Unmarshal(output, outline); err != nil {
+		return nil, fmt.Errorf("parsing python outline: %v", err)
+	}
+	if outline.Functions == nil {
+		outline.Functions = make(map[string]bool)
+	}
+	return outline, nil
+}
+
+// outlineFiles builds the outline of the Go and Python files among the files the
+// student submitted. It returns nil if there are none.
+func outlineFiles(n *Nanny, files map[string][]byte) (*sourceOutline, error) {
+	goFiles := make(map[string][]byte)
+	var pythonFiles []string
+	for name, contents := range files {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".go":
+			goFiles[name] = contents
+		case ".py":
+			pythonFiles = append(pythonFiles, name)
+		}
+	}
+	if len(goFiles) == 0 && (len(pythonFiles) == 0 || n.OS == "windows") {
+		return nil, nil
+	}
+
+	outline := &sourceOutline{Functions: make(map[string]bool)}
+	if len(goFiles) > 0 {
+		elt, err := outlineGo(goFiles)
+		if err != nil {
+			return nil, err
+		}
+		outline.merge(elt)
+	}
+	if len(pythonFiles) > 0 && n.OS != "windows" {
+		sort.Strings(pythonFiles)
+		elt, err := outlinePython(n, pythonFiles)
+		if err != nil {
+			return nil, err
+		}
+		outline.merge(elt)
+	}
+	return outline, nil
+}
+
+// missingRequirements returns a description of each requirement in the problem
+// options that the outline does not meet.
+func missingRequirements(problem *Problem, outline *sourceOutline) []string {
+	var missing []string
+	for _, option := range problem.Options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		kind := strings.TrimSpace(parts[0])
+		for _, name := range strings.Split(parts[1], ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			switch kind {
+			case requireRecursion:
+				if name == "*" {
+					found := false
+					for _, recursive := range outline.Functions {
+						found = found || recursive
+					}
+					if !found {
+						missing = append(missing, "recursion")
+					}
+				} else if recursive, present := outline.Functions[name]; !present {
+					missing = append(missing, fmt.Sprintf("recursive function %s", name))
+				} else if !recursive {
+					missing = append(missing, fmt.Sprintf("recursion in %s", name))
+				}
+			case requireFunction:
+				if _, present := outline.Functions[name]; !present {
+					missing = append(missing, fmt.Sprintf("function %s", name))
+				}
+			case requireClass:
+				if !outline.hasClass(name) {
+					missing = append(missing, fmt.Sprintf("class %s", name))
+				}
+			case requireMethod:
+				if _, present := outline.Functions[name]; !present {
+					missing = append(missing, fmt.Sprintf("method %s", name))
+				}
+			}
+		}
+	}
+	return missing
+}
+
+// checkRequirements checks the files the student submitted against the
+// requirements in the problem options. The files must already be in the container.
+// If any requirement is not met, it reports them in the report card and
+// the transcript and returns true so the caller can skip running the action.
+// Files that cannot be parsed are left for the action to report on.
+func checkRequirements(n *Nanny, problem *Problem, files map[string][]byte) bool {
+	required := false
+	for _, option := range problem.Options {
+		switch strings.TrimSpace(strings.SplitN(option, "=", 2)[0]) {
+		case requireRecursion, requireFunction, requireClass, requireMethod:
+			required = true
+		}
+	}
+	if !required {
+		return false
+	}
+
+	outline, err := outlineFiles(n, files)
+	if err != nil {
+		log.Printf("problem %s: skipping required construct checks: %v", problem.Unique, err)
+		return false
+	}
+	if outline == nil {
+		return false
+	}
+
+	missing := missingRequirements(problem, outline)
+	for _, elt := range missing {
+		n.ReportCard.AddMissingResult("required "+elt, fmt.Sprintf("this problem requires %s, but the code does not have it\n", elt), "")
+		n.ReportCard.Failf("missing %s", elt)
+		n.Events <- &EventMessage{
+			Time:  time.Now(),
+			Event: "error",
+			Error: fmt.Sprintf("this problem requires %s", elt),
+		}
+	}
+	return len(missing) > 0
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Limits on the research export API.
+const (
+	researchPageSize        = 1000
+	researchMaxPageSize     = 5000
+	researchRequestsAllowed = 30 // per token per researchWindow
+	researchWindow          = time.Minute
+)
+
+// ResearchToken lets an outside researcher use the export API.
+// Only a hash of the token is kept; the token itself is shown once, when it is created.
+type ResearchToken struct {
+	ID         int64      `json:"id" meddler:"id,pk"`
+	Name       string     `json:"name" meddler:"name"`
+	TokenHash  string     `json:"-" meddler:"token_hash"`
+	Token      string     `json:"token,omitempty" meddler:"-"`
+	CreatedBy  int64      `json:"createdBy" meddler:"created_by"`
+	CreatedAt  time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" meddler:"last_used_at,localtime"`
+}
+
+// ResearchConsent records that an instructor agreed to share a course's
+// anonymized submission data through the export API.
+type ResearchConsent struct {
+	CourseID  int64     `json:"courseID" meddler:"course_id,pk"`
+	ConsentBy int64     `json:"consentBy" meddler:"consent_by"`
+	ConsentAt time.Time `json:"consentAt" meddler:"consent_at,localtime"`
+}
+
+// ResearchRecord is one graded or checked attempt, stripped of code and anything
+// that identifies the student. Student is a pseudonym that is stable for one
+// token but cannot be matched up between tokens.
+type ResearchRecord struct {
+	ID        int64     `json:"id" meddler:"id"`
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	Student   string    `json:"student" meddler:"-"`
+	UserID    int64     `json:"-" meddler:"user_id"`
+	ProblemID int64     `json:"problemID" meddler:"problem_id"`
+	Unique    string    `json:"unique" meddler:"unique_id"`
+	Step      int64     `json:"step" meddler:"step"`
+	Action    string    `json:"action" meddler:"action"`
+	Attempt   int64     `json:"attempt" meddler:"attempt"`
+	Score     float64   `json:"score" meddler:"score"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// ResearchExport is one page of the export. Pass Next as after to get the next page;
+// it is omitted on the last page.
+type ResearchExport struct {
+	Records []*ResearchRecord `json:"records"`
+	Next    int64             `json:"next,omitempty"`
+}
+
+func hashResearchToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// researchPseudonym names a student for one token without revealing who they are.
+func researchPseudonym(tokenID, userID int64) string {
+	mac := hmac.New(sha256.New, []byte(Config.SessionSecret))
+	fmt.Fprintf(mac, "research\x00%d\x00%d", tokenID, userID)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// researchThrottle counts requests for each token in fixed windows.
+type researchThrottle struct {
+	sync.Mutex
+	windows map[int64]*researchUse
+}
+
+type researchUse struct {
+	start    time.Time
+	requests int
+}
+
+var researchRequests = &researchThrottle{windows: make(map[int64]*researchUse)}
+
+// wait reports how long a token must wait before its next request is allowed,
+// counting this request if it is.
+func (t *researchThrottle) wait(now time.Time, tokenID int64) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	use := t.windows[tokenID]
+	if use == nil || now.Sub(use.start) >= researchWindow {
+		use = &researchUse{start: now}
+		t.windows[tokenID] = use
+	}
+	if use.requests >= researchRequestsAllowed {
+		return use.start.Add(researchWindow).Sub(now)
+	}
+	use.requests++
+	return 0
+}
+
+// withResearchToken is martini middleware that requires a research token in the
+// Authorization header and maps it to the request context (requires withTx).
+func withResearchToken(c martini.Context, w http.ResponseWriter, r *http.Request, tx *sql.Tx) {
+	if throttleAuth(w, r, "") {
+		return
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "a research token is required in the Authorization header")
+		return
+	}
+	token := new(ResearchToken)
+	if err := meddler.QueryRow(tx, token, `SELECT * FROM research_tokens WHERE token_hash = ?`,
+		hashResearchToken(strings.TrimPrefix(header, "Bearer "))); err != nil {
+		if err == sql.ErrNoRows {
+			recordAuthFailure(r, "research", "", "unknown research token")
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "unknown research token")
+			return
+		}
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	now := time.Now()
+	if wait := researchRequests.wait(now, token.ID); wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(wait.Seconds()))))
+		loggedHTTPErrorf(w, http.StatusTooManyRequests, "research token %d (%s) is limited to %d requests per %v; try again in %v",
+			token.ID, token.Name, researchRequestsAllowed, researchWindow, wait.Round(time.Second))
+		return
+	}
+	token.LastUsedAt = &now
+	if _, err := tx.Exec(`UPDATE research_tokens SET last_used_at = ? WHERE id = ?`, now, token.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	c.Map(token)
+}
+
+// GetResearchExport handles requests to /research/attempts,
+// returning a page of anonymized attempts from courses whose instructors consented.
+// The page starts after the record ID given by after and holds up to limit records.
+func GetResearchExport(w http.ResponseWriter, r *http.Request, tx *sql.Tx, token *ResearchToken, render render.Render) {
+	var after int64
+	if s := r.FormValue("after"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing after: %q", s)
+			return
+		}
+		after = n
+	}
+	limit := int64(researchPageSize)
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 || n > researchMaxPageSize {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "limit must be between 1 and %d", researchMaxPageSize)
+			return
+		}
+		limit = n
+	}
+
+	export := &ResearchExport{Records: []*ResearchRecord{}}
+	if err := meddler.QueryAll(tx, &export.Records, `SELECT grading_records.id, assignments.course_id, assignments.user_id, `+
+		`grading_records.problem_id, grading_records.unique_id, grading_records.step, grading_records.action, `+
+		`(SELECT COUNT(1) FROM grading_records AS earlier WHERE earlier.assignment_id = grading_records.assignment_id `+
+		`AND earlier.problem_id = grading_records.problem_id AND earlier.step = grading_records.step `+
+		`AND earlier.action = grading_records.action AND earlier.id <= grading_records.id) AS attempt, `+
+		`grading_records.score, grading_records.created_at `+
+		`FROM grading_records JOIN assignments ON grading_records.assignment_id = assignments.id `+
+		`JOIN research_consents ON assignments.course_id = research_consents.course_id `+
+		`WHERE grading_records.id > ? AND NOT assignments.instructor `+
+		`ORDER BY grading_records.id LIMIT ?`, after, limit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, record := range export.Records {
+		record.Student = researchPseudonym(token.ID, record.UserID)
+	}
+	if int64(len(export.Records)) == limit {
+		export.Next = export.Records[len(export.Records)-1].ID
+	}
+	render.JSON(http.StatusOK, export)
+}
+
+// GetResearchTokens handles requests to /research_tokens,
+// returning every research token (without the tokens themselves).
+func GetResearchTokens(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	tokens := []*ResearchToken{}
+	if err := meddler.QueryAll(tx, &tokens, `SELECT * FROM research_tokens ORDER BY created_at`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, tokens)
+}
+
+// PostResearchToken handles requests to /research_tokens,
+// creating a token for a researcher. The response is the only place the token appears.
+func PostResearchToken(w http.ResponseWriter, tx *sql.Tx, currentUser *User, token ResearchToken, render render.Render) {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "research token needs a name saying who it is for")
+		return
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating token: %v", err)
+		return
+	}
+	token.ID = 0
+	token.Token = base64.RawURLEncoding.EncodeToString(raw)
+	token.TokenHash = hashResearchToken(token.Token)
+	token.CreatedBy = currentUser.ID
+	token.CreatedAt = time.Now()
+	token.LastUsedAt = nil
+	if err := meddler.Insert(tx, "research_tokens", &token); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) created research token %d (%s)", currentUser.ID, currentUser.Email, token.ID, token.Name)
+	render.JSON(http.StatusOK, &token)
+}
+
+// DeleteResearchToken handles requests to /research_tokens/:token_id,
+// revoking a research token.
+func DeleteResearchToken(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	tokenID, err := parseID(w, "token_id", params["token_id"])
+	if err != nil {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM research_tokens WHERE id = ?`, tokenID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) revoked research token %d", currentUser.ID, currentUser.Email, tokenID)
+}
+
+// GetCourseResearchConsent handles requests to /courses/:course_id/research_consent,
+// returning the consent record if the course's data is shared with researchers.
+func GetCourseResearchConsent(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	consent := new(ResearchConsent)
+	if err := meddler.Load(tx, "research_consents", consent, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, consent)
+}
+
+// PutCourseResearchConsent handles requests to /courses/:course_id/research_consent,
+// sharing the course's anonymized attempts through the export API.
+// Only an instructor (not a TA) can give consent, and it covers past attempts too.
+func PutCourseResearchConsent(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadLeadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	consent := new(ResearchConsent)
+	if err := meddler.Load(tx, "research_consents", consent, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		consent = &ResearchConsent{
+			CourseID:  courseID,
+			ConsentBy: currentUser.ID,
+			ConsentAt: time.Now(),
+		}
+		if err := meddler.Insert(tx, "research_consents", consent); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		log.Printf("user %d (%s) consented to research export for course %d", currentUser.ID, currentUser.Email, courseID)
+	}
+	render.JSON(http.StatusOK, consent)
+}
+
+// DeleteCourseResearchConsent handles requests to /courses/:course_id/research_consent,
+// withdrawing consent. The course's attempts are left out of every export from then on.
+func DeleteCourseResearchConsent(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	courseID, ok := loadLeadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM research_consents WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) withdrew research consent for course %d", currentUser.ID, currentUser.Email, courseID)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// CommitReset keeps the files a student discarded by resetting a step,
+// so resetting never loses work that was saved to the server.
+type CommitReset struct {
+	ID           int64             `json:"id" meddler:"id,pk"`
+	AssignmentID int64             `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64             `json:"problemID" meddler:"problem_id"`
+	Step         int64             `json:"step" meddler:"step"`
+	CommitID     int64             `json:"commitID" meddler:"commit_id"`
+	UserID       int64             `json:"userID" meddler:"user_id"`
+	Files        map[string][]byte `json:"files" meddler:"files,json"`
+	FilesBlob    string            `json:"-" meddler:"files_blob,zeroisnull"`
+	CreatedAt    time.Time         `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// PostAssignmentReset handles requests to /assignments/:assignment_id/reset,
+// putting the student files for the current step of a problem back to how they
+// were at the start of the step. The discarded files are kept in commit_resets,
+// and scores already earned are not affected.
+// Students can reset their own assignments, and instructors can reset them on a student's behalf.
+//
+// Parameter problem_id selects the problem, and is required if the problem set has more than one problem.
+// Returns the new commit for the step.
+func PostAssignmentReset(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	now := time.Now()
+
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if assignment.UserID != currentUser.ID && !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, assignment.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusForbidden, "only the student or an instructor of the course can reset an assignment")
+			return
+		}
+	}
+
+	// find the problem
+	var problemID int64
+	if s := r.FormValue("problem_id"); s != "" {
+		if problemID, err = parseID(w, "problem_id", s); err != nil {
+			return
+		}
+	} else {
+		problemIDs := []int64{}
+		rows, err := tx.Query(`SELECT problem_id FROM problem_set_problems WHERE problem_set_id = ?`, assignment.ProblemSetID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			problemIDs = append(problemIDs, id)
+		}
+		rows.Close()
+		if len(problemIDs) != 1 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "problem set has %d problems, so problem_id must be given", len(problemIDs))
+			return
+		}
+		problemID = problemIDs[0]
+	}
+
+	// the current step is the one with the latest commit
+	current := new(Commit)
+	if err := meddler.QueryRow(tx, current, `SELECT * FROM commits WHERE assignment_id = ? AND problem_id = ? ORDER BY step DESC LIMIT 1`,
+		assignment.ID, problemID); err != nil {
+		if err == sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "no work has been saved for problem %d, so there is nothing to reset", problemID)
+			return
+		}
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadCommitBlobs(current); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	step := new(ProblemStep)
+	if err := meddler.QueryRow(tx, step, `SELECT * FROM problem_steps WHERE problem_id = ? AND step = ?`, problemID, current.Step); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := loadStepFiles(step); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	files, err := stepStarterFiles(tx, assignment.ID, step)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	// keep the files being discarded
+	discarded, err := storeCommitBlobs(tx, assignment.CourseID, current)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	reset := &CommitReset{
+		AssignmentID: assignment.ID,
+		ProblemID:    problemID,
+		Step:         current.Step,
+		CommitID:     current.ID,
+		UserID:       currentUser.ID,
+		Files:        discarded.Files,
+		FilesBlob:    discarded.FilesBlob,
+		CreatedAt:    now,
+	}
+	if err := meddler.Insert(tx, "commit_resets", reset); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	commit := &Commit{
+		ID:           current.ID,
+		AssignmentID: assignment.ID,
+		ProblemID:    problemID,
+		Step:         current.Step,
+		Note:         fmt.Sprintf("reset to the start of step %d", current.Step),
+		Files:        files,
+		Transcript:   []*EventMessage{},
+		RemoteAddr:   clientIP(r),
+		UserAgent:    r.UserAgent(),
+		CreatedAt:    current.CreatedAt,
+		UpdatedAt:    now,
+	}
+	if err := commit.Normalize(now, step.Whitelist); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	saved, err := storeCommitBlobs(tx, assignment.CourseID, commit)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if err := meddler.Save(tx, "commits", saved); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordCommitHash(tx, commit, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error recording commit hash: %v", err)
+		return
+	}
+	if err := updateAssignmentSummary(tx, commit.AssignmentID, commit.ProblemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error updating assignment summary: %v", err)
+		return
+	}
+	if err := indexCommitFiles(tx, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error indexing commit files: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) reset assignment %d problem %d to the start of step %d",
+		currentUser.ID, currentUser.Email, assignment.ID, problemID, current.Step)
+
+	render.JSON(http.StatusOK, commit)
+}
+
+// stepStarterFiles returns the files a student starts a step with:
+// the files from the end of the latest earlier step plus the new step's files.
+func stepStarterFiles(tx *sql.Tx, assignmentID int64, step *ProblemStep) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	previous := new(Commit)
+	if err := meddler.QueryRow(tx, previous, `SELECT * FROM commits WHERE assignment_id = ? AND problem_id = ? AND step < ? ORDER BY step DESC LIMIT 1`,
+		assignmentID, step.ProblemID, step.Step); err != nil {
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("db error loading commit before step %d: %v", step.Step, err)
+		}
+	} else {
+		if err := loadCommitBlobs(previous); err != nil {
+			return nil, err
+		}
+		for name, contents := range previous.Files {
+			files[name] = contents
+		}
+	}
+	for name, contents := range step.Files {
+		files[name] = contents
+	}
+	return files, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// CourseResidency records that a course's files must be kept in one of
+// the residency stores named in the config file, for institutions that require
+// student data to stay in particular infrastructure.
+type CourseResidency struct {
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	Residency string    `json:"residency" meddler:"residency"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// residencyStores are the blob stores named in the config file that courses can be assigned to.
+var residencyStores map[string]BlobStore
+
+// residencyNamePattern limits residency store names to what can safely prefix a blob key.
+var residencyNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// courseResidency returns the residency store a course is assigned to,
+// or an empty string if its files go in the main blob store.
+func courseResidency(tx *sql.Tx, courseID int64) (string, error) {
+	residency := ""
+	err := tx.QueryRow(`SELECT residency FROM course_residencies WHERE course_id = ?`, courseID).Scan(&residency)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return residency, nil
+}
+
+// residencyKey records which store a blob was written to as part of its key,
+// so it can be found again without knowing the course it belongs to.
+// Blobs in the main store keep their plain keys.
+func residencyKey(residency, key string) string {
+	if residency == "" {
+		return key
+	}
+	return residency + ":" + key
+}
+
+// blobStoreFor finds the store holding a blob from the key saved with it,
+// returning the store and the key within that store.
+func blobStoreFor(key string) (BlobStore, string, error) {
+	if residency, inner, found := strings.Cut(key, ":"); found {
+		store := residencyStores[residency]
+		if store == nil {
+			return nil, "", fmt.Errorf("files are in residency store %q, which is not configured", residency)
+		}
+		return store, inner, nil
+	}
+	if blobStore == nil {
+		return nil, "", fmt.Errorf("files are in the blob store, but no blob store is configured")
+	}
+	return blobStore, key, nil
+}
+
+// GetCourseResidency handles requests to /courses/:course_id/residency,
+// returning the residency store the course is assigned to.
+func GetCourseResidency(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	residency := new(CourseResidency)
+	if err := meddler.QueryRow(tx, residency, `SELECT * FROM course_residencies WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, residency)
+}
+
+// PutCourseResidency handles requests to /courses/:course_id/residency,
+// assigning the course to a residency store. Only files saved from now on
+// go to the new store; files already saved stay where they are and can
+// still be read.
+func PutCourseResidency(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, residency CourseResidency, render render.Render) {
+	now := time.Now()
+
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	if _, present := residencyStores[residency.Residency]; !present {
+		names := []string{}
+		for name := range residencyStores {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "no residency stores are configured")
+		} else {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "unknown residency store %q; must be one of %s", residency.Residency, strings.Join(names, ", "))
+		}
+		return
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	old := new(CourseResidency)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM course_residencies WHERE course_id = ?`, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		residency.CreatedAt = now
+	} else {
+		residency.CreatedAt = old.CreatedAt
+	}
+	residency.CourseID = courseID
+	residency.UpdatedAt = now
+
+	if _, err := tx.Exec(`DELETE FROM course_residencies WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "course_residencies", &residency); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("%s (%d) assigned course %d (%s) to residency store %q", currentUser.Name, currentUser.ID, course.ID, course.Name, residency.Residency)
+	render.JSON(http.StatusOK, &residency)
+}
+
+// DeleteCourseResidency handles requests to /courses/:course_id/residency,
+// sending the course's files to the main blob store from now on.
+func DeleteCourseResidency(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM course_residencies WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
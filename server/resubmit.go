@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// reusableGrading checks whether a graded submission matches the last graded
+// attempt at the same step closely enough to reuse its result. Students tend
+// to resubmit the same files over and over as a deadline approaches, and
+// grading them again only ties up daycares. The earlier result is only reused
+// if the problem has not changed since it was graded. It returns nil if the
+// submission should be graded normally.
+func reusableGrading(tx *sql.Tx, problem *Problem, commit, previous *Commit) (*Commit, error) {
+	if commit.Action != "grade" || commit.Practice {
+		return nil, nil
+	}
+	if previous == nil || previous.ID == 0 || previous.Action != "grade" || previous.Practice || previous.ReportCard == nil {
+		return nil, nil
+	}
+	if previous.UpdatedAt.Before(problem.UpdatedAt) {
+		return nil, nil
+	}
+	if err := loadCommitBlobs(previous); err != nil {
+		return nil, err
+	}
+	if !sameSubmission(previous.Files, commit.Files) {
+		return nil, nil
+	}
+	return previous, nil
+}
+
+// sameSubmission reports whether two sets of student files differ only in
+// trailing whitespace on lines or blank lines at the end of files.
+func sameSubmission(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, contents := range a {
+		other, present := b[name]
+		if !present || !bytes.Equal(trimSubmission(contents), trimSubmission(other)) {
+			return false
+		}
+	}
+	return true
+}
+
+func trimSubmission(contents []byte) []byte {
+	lines := strings.Split(strings.Replace(string(contents), "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
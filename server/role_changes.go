@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// RoleChange records an LTI launch that made a user an instructor in a
+// course or took it away, e.g., when a TA is moved back to being a student.
+// Instructor access to a course comes from a user's instructor assignments,
+// so a demotion clears the flag on all of them and drops the user from any
+// sections they were a TA for. RevokedAssignments and RevokedSections count
+// what was taken away.
+type RoleChange struct {
+	ID                 int64     `json:"id" meddler:"id,pk"`
+	UserID             int64     `json:"userID" meddler:"user_id"`
+	CourseID           int64     `json:"courseID" meddler:"course_id"`
+	AssignmentID       int64     `json:"assignmentID" meddler:"assignment_id"`
+	Change             string    `json:"change" meddler:"change"`
+	OldRoles           string    `json:"oldRoles" meddler:"old_roles"`
+	NewRoles           string    `json:"newRoles" meddler:"new_roles"`
+	RevokedAssignments int64     `json:"revokedAssignments" meddler:"revoked_assignments"`
+	RevokedSections    int64     `json:"revokedSections" meddler:"revoked_sections"`
+	CreatedAt          time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+const (
+	rolePromoted = "promoted"
+	roleDemoted  = "demoted"
+)
+
+// courseRoles counts a user's assignments in a course and how many of them are
+// instructor assignments, and gives the LTI roles from the most recent launch.
+func courseRoles(tx *sql.Tx, courseID, userID int64) (assignments, instructorAssignments int64, roles string, err error) {
+	var latest sql.NullString
+	err = tx.QueryRow(`SELECT COUNT(1), COALESCE(SUM(instructor), 0), `+
+		`(SELECT roles FROM assignments WHERE course_id = ? AND user_id = ? ORDER BY updated_at DESC LIMIT 1) `+
+		`FROM assignments WHERE course_id = ? AND user_id = ?`,
+		courseID, userID, courseID, userID).Scan(&assignments, &instructorAssignments, &latest)
+	return assignments, instructorAssignments, latest.String, err
+}
+
+// recordRoleChange notes that a launch changed whether a user is an instructor in a course.
+// A demotion revokes the user's instructor access to the course before it is recorded;
+// instructorAssignments is the number of instructor assignments the user had before the launch.
+func recordRoleChange(tx *sql.Tx, asst *Assignment, user *User, oldRoles string, instructorAssignments int64, now time.Time) error {
+	change := &RoleChange{
+		UserID:       user.ID,
+		CourseID:     asst.CourseID,
+		AssignmentID: asst.ID,
+		Change:       rolePromoted,
+		OldRoles:     oldRoles,
+		NewRoles:     asst.Roles,
+		CreatedAt:    now,
+	}
+	if !asst.Instructor {
+		change.Change = roleDemoted
+		change.RevokedAssignments = instructorAssignments
+		if _, err := tx.Exec(`UPDATE assignments SET instructor = 0, updated_at = ? WHERE course_id = ? AND user_id = ? AND instructor`,
+			now, asst.CourseID, user.ID); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM section_members WHERE user_id = ? AND role = 'ta' `+
+			`AND section_id IN (SELECT id FROM sections WHERE course_id = ?)`, user.ID, asst.CourseID)
+		if err != nil {
+			return err
+		}
+		if change.RevokedSections, err = res.RowsAffected(); err != nil {
+			return err
+		}
+	}
+	if err := meddler.Insert(tx, "role_changes", change); err != nil {
+		return err
+	}
+
+	log.Printf("user %d (%s) %s in course %d: roles changed from %q to %q",
+		user.ID, user.Email, change.Change, asst.CourseID, oldRoles, asst.Roles)
+	if change.Change == roleDemoted {
+		log.Printf("  revoked instructor access on %d assignment(s) and TA membership in %d section(s)",
+			change.RevokedAssignments, change.RevokedSections)
+		if user.Author || user.Admin {
+			log.Printf("  user %d (%s) is still marked as author/admin in user record; an administrator must remove that by hand", user.ID, user.Email)
+		}
+	}
+	return nil
+}
+
+// GetCourseRoleChanges handles requests to /courses/:course_id/role_changes,
+// returning every launch that made someone an instructor in the course or took it away, newest first.
+func GetCourseRoleChanges(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	changes := []*RoleChange{}
+	if err := meddler.QueryAll(tx, &changes, `SELECT * FROM role_changes WHERE course_id = ? ORDER BY created_at DESC, id DESC`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, changes)
+}
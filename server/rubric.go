@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// buildStepRubric summarizes how a step is scored without naming its hidden tests.
+func buildStepRubric(step *ProblemStep) *StepRubric {
+	rubric := &StepRubric{
+		ProblemID:   step.ProblemID,
+		Step:        step.Step,
+		Weight:      step.Weight,
+		MaxAttempts: step.MaxAttempts,
+		Diagnostic:  step.Diagnostic,
+		Tests:       []*RubricTest{},
+	}
+	for name, test := range step.Tests {
+		weight := test.Weight
+		if weight == 0 {
+			weight = 1.0
+		}
+		style := styleTestPattern.MatchString(name)
+		if style {
+			rubric.StyleWeight += weight
+		}
+		if test.Hidden {
+			rubric.HiddenTests++
+			rubric.HiddenWeight += weight
+			if test.Required {
+				rubric.HiddenRequired++
+			}
+			continue
+		}
+		rubric.Tests = append(rubric.Tests, &RubricTest{
+			Name:     name,
+			Weight:   weight,
+			Required: test.Required,
+			Style:    style,
+		})
+	}
+	sort.Slice(rubric.Tests, func(i, j int) bool { return rubric.Tests[i].Name < rubric.Tests[j].Name })
+	return rubric
+}
+
+// visibleStepTests returns the tests of a step that students may see.
+func visibleStepTests(tests map[string]*StepTest) map[string]*StepTest {
+	if tests == nil {
+		return nil
+	}
+	visible := make(map[string]*StepTest)
+	for name, test := range tests {
+		if !test.Hidden {
+			visible[name] = test
+		}
+	}
+	return visible
+}
+
+// GetAssignmentProblemStepRubric handles requests to
+// /assignments/:assignment_id/problems/:problem_id/steps/:step/rubric,
+// returning how the step will be scored.
+func GetAssignmentProblemStepRubric(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	stepN, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if currentUser.Admin {
+		err = meddler.Load(tx, "assignments", assignment, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	step := new(ProblemStep)
+	if err := meddler.QueryRow(tx, step, `SELECT problem_steps.* FROM problem_steps JOIN problem_set_problems ON problem_steps.problem_id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = ? AND problem_steps.problem_id = ? AND problem_steps.step = ?`,
+		assignment.ProblemSetID, problemID, stepN); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	render.JSON(http.StatusOK, buildStepRubric(step))
+}
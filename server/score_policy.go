@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// StepScore is one graded attempt at a step. The commits table only keeps
+// the latest commit for each step, so scores are kept here to let a
+// score policy choose among every attempt.
+type StepScore struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	Score        float64   `json:"score" meddler:"score"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// recordStepScore adds a graded attempt to the score history.
+func recordStepScore(tx *sql.Tx, commit *Commit, score float64, now time.Time) error {
+	elt := &StepScore{
+		AssignmentID: commit.AssignmentID,
+		ProblemID:    commit.ProblemID,
+		Step:         commit.Step,
+		Score:        score,
+		CreatedAt:    now,
+	}
+	return meddler.Insert(tx, "step_scores", elt)
+}
+
+// bestStepScores returns the best score recorded for each step of a problem,
+// regardless of score policy.
+func bestStepScores(tx *sql.Tx, assignmentID, problemID int64) (map[int64]float64, error) {
+	rows, err := tx.Query(`SELECT step, MAX(score) FROM step_scores WHERE assignment_id = ? AND problem_id = ? GROUP BY step`,
+		assignmentID, problemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	best := make(map[int64]float64)
+	for rows.Next() {
+		var step int64
+		var score float64
+		if err := rows.Scan(&step, &score); err != nil {
+			return nil, err
+		}
+		best[step] = score
+	}
+	return best, rows.Err()
+}
+
+// getScorePolicy returns the score policy for an assignment.
+func getScorePolicy(tx *sql.Tx, assignment *Assignment) (string, error) {
+	var policy string
+	if err := tx.QueryRow(`SELECT policy FROM score_policies WHERE lti_id = ?`, assignment.LtiID).Scan(&policy); err != nil {
+		if err == sql.ErrNoRows {
+			return ScoreLatest, nil
+		}
+		return "", err
+	}
+	return policy, nil
+}
+
+// practiceAllowed reports whether students can submit practice checks for an assignment.
+func practiceAllowed(tx *sql.Tx, assignment *Assignment) (bool, error) {
+	var practice bool
+	if err := tx.QueryRow(`SELECT practice FROM score_policies WHERE lti_id = ?`, assignment.LtiID).Scan(&practice); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return practice, nil
+}
+
+// maxGraceMinutes caps the grace period an assignment can be given.
+const maxGraceMinutes = 24 * 60
+
+// deadlineGrace returns how long past its due and lock dates an assignment still
+// treats work as on time: its own grace period if its policy sets one,
+// or the site-wide default.
+func deadlineGrace(tx *sql.Tx, assignment *Assignment) (time.Duration, error) {
+	var minutes sql.NullInt64
+	if err := tx.QueryRow(`SELECT grace_minutes FROM score_policies WHERE lti_id = ?`, assignment.LtiID).Scan(&minutes); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if minutes.Valid {
+		return time.Duration(minutes.Int64) * time.Minute, nil
+	}
+	return time.Duration(Config.GraceMinutes) * time.Minute, nil
+}
+
+// applyScorePolicy sets the raw scores of an assignment from its score history
+// according to its score policy. Steps with no recorded history keep their raw score.
+func applyScorePolicy(tx *sql.Tx, assignment *Assignment) error {
+	policy, err := getScorePolicy(tx, assignment)
+	if err != nil {
+		return err
+	}
+	grace, err := deadlineGrace(tx, assignment)
+	if err != nil {
+		return err
+	}
+
+	type stepScore struct {
+		Unique    string    `meddler:"unique_id"`
+		Step      int64     `meddler:"step"`
+		Score     float64   `meddler:"score"`
+		CreatedAt time.Time `meddler:"created_at,localtime"`
+	}
+	history := []*stepScore{}
+	if err := meddler.QueryAll(tx, &history, `SELECT problems.unique_id, step_scores.step, step_scores.score, step_scores.created_at `+
+		`FROM step_scores JOIN problems ON step_scores.problem_id = problems.id `+
+		`WHERE step_scores.assignment_id = ? ORDER BY step_scores.created_at, step_scores.id`, assignment.ID); err != nil {
+		return err
+	}
+
+	type key struct {
+		unique string
+		step   int64
+	}
+	scores := make(map[key]float64)
+	for _, elt := range history {
+		k := key{elt.Unique, elt.Step}
+		switch {
+		case policy == ScoreBest:
+			if elt.Score > scores[k] {
+				scores[k] = elt.Score
+			}
+		case policy == ScoreBeforeDeadline && assignment.DueAt != nil && elt.CreatedAt.After(assignment.DueAt.Add(grace)):
+			// late attempts do not count, but the step still has a score
+			if _, present := scores[k]; !present {
+				scores[k] = 0.0
+			}
+		default:
+			scores[k] = elt.Score
+		}
+	}
+
+	if assignment.RawScores == nil {
+		assignment.RawScores = map[string][]float64{}
+	}
+	for k, score := range scores {
+		assignment.SetMinorScore(k.unique, int(k.step-1), score)
+	}
+	return nil
+}
+
+// rescoreAssignment recomputes the raw scores and overall score of an assignment
+// using its score policy and its course's grade policy, and saves it if anything changed.
+// It reports whether the overall score changed, in which case an explanation of the
+// new score is recorded with the given reason.
+func rescoreAssignment(tx *sql.Tx, assignment *Assignment, reason string, now time.Time) (bool, error) {
+	oldRaw := make(map[string][]float64)
+	for unique, scores := range assignment.RawScores {
+		oldRaw[unique] = append([]float64(nil), scores...)
+	}
+	explanation, err := explainAssignmentScore(tx, assignment)
+	score := assignment.Score
+	if err == ErrNothingToScore {
+		// keep the score it has; there is nothing new to post
+	} else if err != nil {
+		return false, err
+	} else {
+		score = explanation.Score
+	}
+
+	changed := score != assignment.Score
+	if !changed && reflect.DeepEqual(oldRaw, assignment.RawScores) {
+		return false, nil
+	}
+	assignment.Score = score
+	assignment.UpdatedAt = now
+	if err := meddler.Save(tx, "assignments", assignment); err != nil {
+		return false, err
+	}
+	if changed {
+		if err := recordGradeExplanation(tx, explanation, reason, now); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+// rescoreScorePolicy rescores every student working on the same Canvas assignment
+// after its score policy changes, and posts the scores that changed to the LMS.
+func rescoreScorePolicy(tx *sql.Tx, ltiID string, now time.Time) error {
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments WHERE lti_id = ? AND NOT instructor AND score IS NOT NULL`, ltiID); err != nil {
+		return err
+	}
+	for _, assignment := range assignments {
+		changed, err := rescoreAssignment(tx, assignment, "score policy", now)
+		if err != nil {
+			return err
+		}
+		if changed {
+			go saveGradeWithRetries(assignment, "")
+		}
+	}
+	return nil
+}
+
+// GetAssignmentScorePolicy handles requests to /assignments/:assignment_id/score_policy,
+// returning the score policy that applies to the assignment.
+func GetAssignmentScorePolicy(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+
+	policy := new(ScorePolicy)
+	if err := meddler.QueryRow(tx, policy, `SELECT * FROM score_policies WHERE lti_id = ?`, assignment.LtiID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, policy)
+}
+
+// PutAssignmentScorePolicy handles requests to /assignments/:assignment_id/score_policy,
+// setting which attempt counts for each step: the latest, the best, or the last one before the due date,
+// whether students can submit practice checks, and how many minutes of grace the deadlines get.
+// Every student working on the same Canvas assignment is rescored, and changed grades are posted to the LMS.
+func PutAssignmentScorePolicy(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, policy ScorePolicy, render render.Render) {
+	now := time.Now()
+
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+	switch policy.Policy {
+	case "":
+		policy.Policy = ScoreLatest
+	case ScoreLatest, ScoreBest, ScoreBeforeDeadline:
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "score policy must be %s, %s, or %s, not %q", ScoreLatest, ScoreBest, ScoreBeforeDeadline, policy.Policy)
+		return
+	}
+	if policy.GraceMinutes != nil && (*policy.GraceMinutes < 0 || *policy.GraceMinutes > maxGraceMinutes) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grace period must be between 0 and %d minutes", maxGraceMinutes)
+		return
+	}
+
+	old := new(ScorePolicy)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM score_policies WHERE lti_id = ?`, assignment.LtiID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		policy.ID = 0
+		policy.CreatedAt = now
+	} else {
+		policy.ID = old.ID
+		policy.CreatedAt = old.CreatedAt
+	}
+	policy.CourseID = assignment.CourseID
+	policy.LtiID = assignment.LtiID
+	policy.UpdatedAt = now
+
+	if err := meddler.Save(tx, "score_policies", &policy); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := rescoreScorePolicy(tx, assignment.LtiID, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error rescoring assignments: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &policy)
+}
+
+// DeleteAssignmentScorePolicy handles requests to /assignments/:assignment_id/score_policy,
+// returning the assignment to scoring the latest attempt at each step with no practice checks
+// and the site's default grace period.
+func DeleteAssignmentScorePolicy(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	assignment := loadInstructorAssignment(w, tx, params, currentUser)
+	if assignment == nil {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM score_policies WHERE lti_id = ?`, assignment.LtiID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := rescoreScorePolicy(tx, assignment.LtiID, time.Now()); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error rescoring assignments: %v", err)
+	}
+}
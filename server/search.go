@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+const (
+	// maxIndexedFileSize is the largest submitted file kept in the search index.
+	maxIndexedFileSize = 256 << 10
+
+	// maxSearchCandidates caps the files a search reads after the index narrows them down.
+	maxSearchCandidates = 2000
+
+	// maxSearchMatches caps the matching lines a search returns.
+	maxSearchMatches = 500
+
+	// maxSearchLineLength is how much of a matching line is returned.
+	maxSearchLineLength = 200
+)
+
+// searchWord finds the words the full-text index knows about.
+var searchWord = regexp.MustCompile(`[A-Za-z0-9_]+`)
+
+// SearchMatch is one line of a submitted file that matched a search.
+type SearchMatch struct {
+	CommitID     int64     `json:"commitID" meddler:"commit_id"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	CanvasTitle  string    `json:"canvasTitle" meddler:"canvas_title"`
+	UserID       int64     `json:"userID" meddler:"user_id"`
+	UserName     string    `json:"userName" meddler:"user_name"`
+	UserEmail    string    `json:"userEmail" meddler:"user_email"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	File         string    `json:"file" meddler:"file_name"`
+	Line         int       `json:"line" meddler:"-"`
+	Text         string    `json:"text" meddler:"-"`
+	URL          string    `json:"url" meddler:"-"`
+	UpdatedAt    time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+	Contents     string    `json:"-" meddler:"contents"`
+}
+
+// indexCommitFiles replaces the search index entries for a commit with its current files.
+// Binary and very large files are left out.
+func indexCommitFiles(tx *sql.Tx, commit *Commit) error {
+	if _, err := tx.Exec(`DELETE FROM submission_files WHERE commit_id = ?`, commit.ID); err != nil {
+		return err
+	}
+	for name, contents := range commit.Files {
+		if len(contents) > maxIndexedFileSize || bytes.IndexByte(contents, 0) >= 0 || !utf8.Valid(contents) {
+			continue
+		}
+		result, err := tx.Exec(`INSERT INTO submission_files (commit_id, name) VALUES (?, ?)`, commit.ID, name)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO submission_search (docid, contents) VALUES (?, ?)`, id, string(contents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildSearchIndexCommand indexes the files of every commit from scratch,
+// for commits saved before the index existed or after restoring a backup.
+func rebuildSearchIndexCommand(args []string) {
+	flags := flag.NewFlagSet("rebuild-search-index", flag.ExitOnError)
+	flags.Parse(args)
+
+	var err error
+	if blobStore, err = setupBlobStore(); err != nil {
+		log.Fatalf("setting up blob store: %v", err)
+	}
+	db := setupDB(Config.SQLite3Path)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	var ids []int64
+	rows, err := tx.Query(`SELECT id FROM commits ORDER BY id`)
+	if err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Fatalf("db error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM submission_files`); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	for _, id := range ids {
+		commit := new(Commit)
+		if err := meddler.Load(tx, "commits", commit, id); err != nil {
+			log.Fatalf("db error loading commit %d: %v", id, err)
+		}
+		if err := loadCommitBlobs(commit); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := indexCommitFiles(tx, commit); err != nil {
+			log.Fatalf("db error indexing commit %d: %v", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	log.Printf("indexed the files of %d commits", len(ids))
+}
+
+// GetCourseSearch handles requests to /courses/:course_id/search,
+// returning each line of a student's latest submitted files that contains the text in q,
+// ignoring case. Results can be filtered by problem_id and section_id.
+//
+// The index works on whole words, so a match must start at the beginning of a word:
+// "eval(" finds eval(x) but "val(" does not. Candidate files are found from the
+// words in q and then checked for the exact text. q must contain at least one letter or digit.
+func GetCourseSearch(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return
+		}
+	}
+
+	q := r.FormValue("q")
+	words := searchWord.FindAllString(q, -1)
+	if len(words) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "search text q must contain at least one letter or digit")
+		return
+	}
+	needle := strings.ToLower(q)
+
+	// the words must appear together as a phrase; the last may be the start of a longer word
+	match := `"` + strings.Join(words, " ") + `*"`
+
+	where := ` WHERE submission_search MATCH ? AND assignments.course_id = ? AND NOT assignments.instructor`
+	args := []interface{}{match, courseID}
+	if s := r.FormValue("problem_id"); s != "" {
+		problemID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_id: %v", err)
+			return
+		}
+		where += ` AND commits.problem_id = ?`
+		args = append(args, problemID)
+	}
+	scope, scopeArgs, ok := sectionWhere(w, r, tx, courseID, currentUser)
+	if !ok {
+		return
+	}
+	where += scope
+	args = append(args, scopeArgs...)
+
+	candidates := []*SearchMatch{}
+	if err := meddler.QueryAll(tx, &candidates, `SELECT commits.id AS commit_id, commits.assignment_id, assignments.canvas_title, `+
+		`assignments.user_id, users.name AS user_name, users.email AS user_email, commits.problem_id, commits.step, `+
+		`submission_files.name AS file_name, commits.updated_at, submission_search.contents `+
+		`FROM submission_search JOIN submission_files ON submission_search.docid = submission_files.id `+
+		`JOIN commits ON submission_files.commit_id = commits.id `+
+		`JOIN assignments ON commits.assignment_id = assignments.id `+
+		`JOIN users ON assignments.user_id = users.id`+where+
+		` LIMIT ?`, append(args, maxSearchCandidates)...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.UserName != b.UserName {
+			return a.UserName < b.UserName
+		}
+		if a.CommitID != b.CommitID {
+			return a.CommitID < b.CommitID
+		}
+		return a.File < b.File
+	})
+
+	matches := []*SearchMatch{}
+	truncated := len(candidates) >= maxSearchCandidates
+	for _, elt := range candidates {
+		for i, line := range strings.Split(elt.Contents, "\n") {
+			if !strings.Contains(strings.ToLower(line), needle) {
+				continue
+			}
+			if len(matches) >= maxSearchMatches {
+				truncated = true
+				break
+			}
+			match := *elt
+			match.Contents = ""
+			match.Line = i + 1
+			match.Text = strings.TrimSpace(line)
+			if len(match.Text) > maxSearchLineLength {
+				match.Text = match.Text[:maxSearchLineLength]
+			}
+			match.URL = fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/commits/last", elt.AssignmentID, elt.ProblemID, elt.Step)
+			matches = append(matches, &match)
+		}
+	}
+	if truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+	render.JSON(http.StatusOK, matches)
+}
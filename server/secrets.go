@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// ProblemSecret is an environment variable set in the container when grading
+// problems of a given problem type. A secret with a ProblemID applies only to
+// that problem and overrides a secret of the same name for the whole problem type.
+// Values are encrypted in the database (see encryptSecret) and are only ever sent to daycares,
+// never to clients.
+type ProblemSecret struct {
+	ID             int64     `json:"id" meddler:"id,pk"`
+	ProblemType    string    `json:"problemType" meddler:"problem_type"`
+	ProblemID      int64     `json:"problemID,omitempty" meddler:"problem_id,zeroisnull"`
+	Name           string    `json:"name" meddler:"name"`
+	Value          string    `json:"value,omitempty" meddler:"-"`
+	EncryptedValue string    `json:"-" meddler:"encrypted_value"`
+	CreatedAt      time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt      time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secret values are stored with envelope encryption: each value is sealed with
+// its own random data key, and the data key is sealed with a master key.
+// The stored form is
+//
+//	v2:<master key ID>:<sealed data key>:<sealed value>
+//
+// Values stored before envelope encryption have no prefix and are sealed
+// directly with the key derived from the daycare secret.
+const envelopePrefix = "v2:"
+
+// legacyMasterKeyID names the master key derived from the daycare secret,
+// which is used when no master keys are configured.
+const legacyMasterKeyID = "daycare"
+
+// masterKeys returns the master keys available for decrypting secrets by ID,
+// and the ID of the key used to encrypt new values.
+func masterKeys() (map[string][]byte, string, error) {
+	legacy := sha256.Sum256([]byte("codegrinder problem secrets\x00" + Config.DaycareSecret))
+	keys := map[string][]byte{legacyMasterKeyID: legacy[:]}
+	for id, spec := range Config.MasterKeys {
+		if id == legacyMasterKeyID || strings.Contains(id, ":") {
+			return nil, "", fmt.Errorf("master key ID %q is not allowed", id)
+		}
+
+		// a key can be kept out of the config file in a file written by a key management agent
+		encoded := spec
+		if strings.HasPrefix(spec, "file:") {
+			raw, err := ioutil.ReadFile(strings.TrimPrefix(spec, "file:"))
+			if err != nil {
+				return nil, "", fmt.Errorf("loading master key %q: %v", id, err)
+			}
+			encoded = strings.TrimSpace(string(raw))
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, "", fmt.Errorf("master key %q must be 32 bytes encoded in base64", id)
+		}
+		keys[id] = key
+	}
+
+	current := Config.MasterKey
+	if current == "" {
+		current = legacyMasterKeyID
+	}
+	if keys[current] == nil {
+		return nil, "", fmt.Errorf("master key %q is not in masterKeys", current)
+	}
+	return keys, current, nil
+}
+
+func seal(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func unseal(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted secret is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func encryptSecret(value string) (string, error) {
+	keys, current, err := masterKeys()
+	if err != nil {
+		return "", err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	sealedKey, err := seal(keys[current], dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedValue, err := seal(dataKey, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return envelopePrefix + current + ":" +
+		base64.StdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.StdEncoding.EncodeToString(sealedValue), nil
+}
+
+func decryptSecret(encrypted string) (string, error) {
+	keys, _, err := masterKeys()
+	if err != nil {
+		return "", err
+	}
+
+	// values from before envelope encryption
+	if !strings.HasPrefix(encrypted, envelopePrefix) {
+		sealed, err := base64.StdEncoding.DecodeString(encrypted)
+		if err != nil {
+			return "", err
+		}
+		plain, err := unseal(keys[legacyMasterKeyID], sealed)
+		if err != nil {
+			return "", fmt.Errorf("unable to decrypt secret: %v", err)
+		}
+		return string(plain), nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(encrypted, envelopePrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("encrypted secret is malformed")
+	}
+	masterKey := keys[parts[0]]
+	if masterKey == nil {
+		return "", fmt.Errorf("secret was encrypted with master key %q, which is not configured", parts[0])
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	sealedValue, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := unseal(masterKey, sealedKey)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt data key: %v", err)
+	}
+	plain, err := unseal(dataKey, sealedValue)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt secret: %v", err)
+	}
+	return string(plain), nil
+}
+
+// rotateSecretsCommand re-encrypts every stored secret with the current master key.
+// Once it finishes, older master keys can be removed from the config file.
+func rotateSecretsCommand(args []string) {
+	flags := flag.NewFlagSet("rotate-secrets", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "report the secrets that would be re-encrypted without changing them")
+	flags.Parse(args)
+
+	_, current, err := masterKeys()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	db := setupDB(Config.SQLite3Path)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	secrets := []*ProblemSecret{}
+	if err := meddler.QueryAll(tx, &secrets, `SELECT * FROM problem_secrets ORDER BY id`); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	rotated := 0
+	for _, secret := range secrets {
+		if strings.HasPrefix(secret.EncryptedValue, envelopePrefix+current+":") {
+			continue
+		}
+		value, err := decryptSecret(secret.EncryptedValue)
+		if err != nil {
+			log.Fatalf("secret %d (%s): %v", secret.ID, secret.Name, err)
+		}
+		if secret.EncryptedValue, err = encryptSecret(value); err != nil {
+			log.Fatalf("secret %d (%s): %v", secret.ID, secret.Name, err)
+		}
+		if !*dryRun {
+			if _, err := tx.Exec(`UPDATE problem_secrets SET encrypted_value = ? WHERE id = ?`, secret.EncryptedValue, secret.ID); err != nil {
+				log.Fatalf("db error: %v", err)
+			}
+		}
+		rotated++
+	}
+
+	if *dryRun {
+		log.Printf("%d of %d secret(s) would be re-encrypted with master key %q", rotated, len(secrets), current)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	log.Printf("re-encrypted %d of %d secret(s) with master key %q", rotated, len(secrets), current)
+}
+
+// GetProblemSecrets handles requests to /problem_secrets,
+// returning a list of secrets without their values.
+//
+// Parameters problem_type and problem_id can be used to restrict the list.
+func GetProblemSecrets(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where, args := "", []interface{}{}
+	if problemType := r.FormValue("problem_type"); problemType != "" {
+		where, args = addWhereEq(where, args, "problem_type", problemType)
+	}
+	if problemID := r.FormValue("problem_id"); problemID != "" {
+		id, err := parseID(w, "problem_id", problemID)
+		if err != nil {
+			return
+		}
+		where, args = addWhereEq(where, args, "problem_id", id)
+	}
+
+	secrets := []*ProblemSecret{}
+	if err := meddler.QueryAll(tx, &secrets, `SELECT * FROM problem_secrets`+where+` ORDER BY problem_type, problem_id, name`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, secrets)
+}
+
+// PostProblemSecret handles requests to /problem_secrets,
+// setting a secret or replacing the value of an existing one with the same scope and name.
+func PostProblemSecret(w http.ResponseWriter, tx *sql.Tx, secret ProblemSecret, render render.Render) {
+	now := time.Now()
+
+	if !secretNamePattern.MatchString(secret.Name) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "secret name %q is not a valid environment variable name", secret.Name)
+		return
+	}
+	if _, err := getProblemType(tx, secret.ProblemType); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem type %q not found", secret.ProblemType)
+		return
+	}
+	if secret.ProblemID != 0 {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM problem_steps WHERE problem_id = ? AND problem_type = ?`,
+			secret.ProblemID, secret.ProblemType).Scan(&count); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if count == 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "problem %d has no steps of problem type %s", secret.ProblemID, secret.ProblemType)
+			return
+		}
+	}
+	encrypted, err := encryptSecret(secret.Value)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "encrypting secret: %v", err)
+		return
+	}
+	secret.EncryptedValue = encrypted
+
+	old := new(ProblemSecret)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM problem_secrets WHERE problem_type = ? AND COALESCE(problem_id, 0) = ? AND name = ?`,
+		secret.ProblemType, secret.ProblemID, secret.Name); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		secret.ID = 0
+		secret.CreatedAt = now
+	} else {
+		secret.ID = old.ID
+		secret.CreatedAt = old.CreatedAt
+	}
+	secret.UpdatedAt = now
+
+	if err := meddler.Save(tx, "problem_secrets", &secret); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	secret.Value = ""
+	render.JSON(http.StatusOK, &secret)
+}
+
+// DeleteProblemSecret handles requests to /problem_secrets/:secret_id,
+// deleting the given secret.
+func DeleteProblemSecret(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+	secretID, err := parseID(w, "secret_id", params["secret_id"])
+	if err != nil {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM problem_secrets WHERE id = ?`, secretID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// ProblemSecretRequest is sent by a daycare to ask the TA for the secrets
+// it needs to grade a problem.
+type ProblemSecretRequest struct {
+	Hostname    string    `json:"hostname"`
+	ProblemType string    `json:"problemType"`
+	ProblemID   int64     `json:"problemID"`
+	Time        time.Time `json:"time"`
+	Signature   string    `json:"signature,omitempty"`
+}
+
+func (req *ProblemSecretRequest) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", req.Hostname)
+	v.Add("problem_type", req.ProblemType)
+	v.Add("problem_id", strconv.FormatInt(req.ProblemID, 10))
+	v.Add("time", req.Time.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// PostProblemSecretRequest handles requests to /problem_secrets/fetch,
+// returning the decrypted secrets for a problem to a daycare as a map of names to values.
+func PostProblemSecretRequest(w http.ResponseWriter, tx *sql.Tx, req ProblemSecretRequest, render render.Render) {
+	sig := req.ComputeSignature(Config.DaycareSecret)
+	if sig != req.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "secret request signature mismatch: computed %s but found %s", sig, req.Signature)
+		return
+	}
+	drift := time.Since(req.Time)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "secret request is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+
+	// problem-specific secrets sort last so they override the problem type defaults
+	secrets := []*ProblemSecret{}
+	if err := meddler.QueryAll(tx, &secrets, `SELECT * FROM problem_secrets WHERE problem_type = ? AND (problem_id IS NULL OR problem_id = ?) `+
+		`ORDER BY problem_id IS NOT NULL`, req.ProblemType, req.ProblemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	values := make(map[string]string)
+	for _, secret := range secrets {
+		value, err := decryptSecret(secret.EncryptedValue)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "secret %d: %v", secret.ID, err)
+			return
+		}
+		values[secret.Name] = value
+	}
+	render.JSON(http.StatusOK, values)
+}
+
+// fetchProblemSecrets asks the TA for the secrets to inject when grading a problem.
+func fetchProblemSecrets(problemType string, problemID int64) (map[string]string, error) {
+	req := &ProblemSecretRequest{
+		Hostname:    Config.Hostname,
+		ProblemType: problemType,
+		ProblemID:   problemID,
+		Time:        time.Now(),
+	}
+	req.Signature = req.ComputeSignature(Config.DaycareSecret)
+
+	secrets := make(map[string]string)
+	if err := postToTA("/problem_secrets/fetch", req, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Section is a group of students within a course, with the TAs responsible for them.
+// A TA who belongs to any section in a course only sees the students in their
+// own sections; instructors and TAs without a section see the whole course.
+type Section struct {
+	ID        int64            `json:"id" meddler:"id,pk"`
+	CourseID  int64            `json:"courseID" meddler:"course_id"`
+	Name      string           `json:"name" meddler:"name"`
+	Members   []*SectionMember `json:"members,omitempty" meddler:"-"`
+	CreatedAt time.Time        `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt time.Time        `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// SectionMember is a TA or student in a section. Role is ta or student.
+type SectionMember struct {
+	SectionID int64     `json:"sectionID" meddler:"section_id"`
+	UserID    int64     `json:"userID" meddler:"user_id"`
+	Role      string    `json:"role" meddler:"role"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// isSectionTA checks if the user is a TA for any section in the course.
+func isSectionTA(tx *sql.Tx, courseID, userID int64) (bool, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(1) FROM section_members JOIN sections ON section_members.section_id = sections.id `+
+		`WHERE sections.course_id = ? AND section_members.user_id = ? AND section_members.role = 'ta'`,
+		courseID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// sectionWhere gives extra conditions for a query on a course's assignments,
+// limiting it to the students of a section TA and, if the request names a
+// section_id, to the students of that section. It reports an error to the
+// client and returns false if the section_id is bad.
+func sectionWhere(w http.ResponseWriter, r *http.Request, tx *sql.Tx, courseID int64, currentUser *User) (string, []interface{}, bool) {
+	where, args := "", []interface{}{}
+	if !currentUser.Admin {
+		isTA, err := isSectionTA(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return "", nil, false
+		}
+		if isTA {
+			where += ` AND assignments.user_id IN (SELECT students.user_id FROM section_members AS tas ` +
+				`JOIN sections ON tas.section_id = sections.id ` +
+				`JOIN section_members AS students ON tas.section_id = students.section_id ` +
+				`WHERE sections.course_id = ? AND tas.user_id = ? AND tas.role = 'ta' AND students.role = 'student')`
+			args = append(args, courseID, currentUser.ID)
+		}
+	}
+	if s := r.FormValue("section_id"); s != "" {
+		sectionID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing section_id: %v", err)
+			return "", nil, false
+		}
+		where += ` AND assignments.user_id IN (SELECT section_members.user_id FROM section_members ` +
+			`JOIN sections ON section_members.section_id = sections.id ` +
+			`WHERE sections.id = ? AND sections.course_id = ? AND section_members.role = 'student')`
+		args = append(args, sectionID, courseID)
+	}
+	return where, args, true
+}
+
+// loadSection loads a section and checks that the current user can manage it:
+// an admin or an instructor (not a TA) for its course.
+func loadSection(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) *Section {
+	sectionID, err := parseID(w, "section_id", params["section_id"])
+	if err != nil {
+		return nil
+	}
+	section := new(Section)
+	if err := meddler.Load(tx, "sections", section, sectionID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil
+	}
+	if !currentUser.Admin {
+		lead, err := isCourseLeadInstructor(tx, section.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return nil
+		}
+		if !lead {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, section.CourseID)
+			return nil
+		}
+	}
+	return section
+}
+
+// GetCourseSections handles requests to /courses/:course_id/sections,
+// returning the sections in a course with their members.
+// Instructors and TAs for the course can see them.
+func GetCourseSections(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	sections := []*Section{}
+	if err := meddler.QueryAll(tx, &sections, `SELECT * FROM sections WHERE course_id = ? ORDER BY name`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, section := range sections {
+		section.Members = []*SectionMember{}
+		if err := meddler.QueryAll(tx, &section.Members, `SELECT * FROM section_members WHERE section_id = ? ORDER BY role, user_id`, section.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	render.JSON(http.StatusOK, sections)
+}
+
+// PostCourseSection handles requests to /courses/:course_id/sections,
+// creating a new, empty section. Only instructors (not TAs) can create one.
+func PostCourseSection(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, section Section, render render.Render) {
+	now := time.Now()
+	courseID, ok := loadLeadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	section.Name = strings.TrimSpace(section.Name)
+	if section.Name == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "section name must not be empty")
+		return
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM sections WHERE course_id = ? AND name = ?`, courseID, section.Name).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count > 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "course %d already has a section named %q", courseID, section.Name)
+		return
+	}
+
+	section.ID = 0
+	section.CourseID = courseID
+	section.Members = nil
+	section.CreatedAt = now
+	section.UpdatedAt = now
+	if err := meddler.Insert(tx, "sections", &section); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &section)
+}
+
+// DeleteSection handles requests to /sections/:section_id,
+// removing a section and its list of members.
+func DeleteSection(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	section := loadSection(w, tx, params, currentUser)
+	if section == nil {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM sections WHERE id = ?`, section.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+}
+
+// PutSectionMember handles requests to /sections/:section_id/members/:user_id,
+// adding a user to a section or changing their role in it.
+// The user must already belong to the course.
+func PutSectionMember(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, member SectionMember, render render.Render) {
+	section := loadSection(w, tx, params, currentUser)
+	if section == nil {
+		return
+	}
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	if member.Role != "ta" && member.Role != "student" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "role must be ta or student, not %q", member.Role)
+		return
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM assignments WHERE course_id = ? AND user_id = ?`, section.CourseID, userID).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "user %d is not in course %d", userID, section.CourseID)
+		return
+	}
+
+	member.SectionID = section.ID
+	member.UserID = userID
+	member.CreatedAt = time.Now()
+	if _, err := tx.Exec(`DELETE FROM section_members WHERE section_id = ? AND user_id = ?`, section.ID, userID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "section_members", &member); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) added user %d to section %d (%s) of course %d as %s",
+		currentUser.ID, currentUser.Email, userID, section.ID, section.Name, section.CourseID, member.Role)
+	render.JSON(http.StatusOK, &member)
+}
+
+// DeleteSectionMember handles requests to /sections/:section_id/members/:user_id,
+// removing a user from a section.
+func DeleteSectionMember(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	section := loadSection(w, tx, params, currentUser)
+	if section == nil {
+		return
+	}
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM section_members WHERE section_id = ? AND user_id = ?`, section.ID, userID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+}
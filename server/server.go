@@ -29,9 +29,7 @@ import (
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/binding"
-	mgzip "github.com/martini-contrib/gzip"
 	"github.com/martini-contrib/render"
-	_ "github.com/mattn/go-sqlite3"
 	. "github.com/russross/codegrinder/types"
 	"github.com/russross/meddler"
 	"golang.org/x/crypto/acme"
@@ -56,17 +54,84 @@ var Config struct {
 	Capacity     int      `json:"capacity"`     // Maximum number of concurrent containers on this daycare: 1
 	ProblemTypes []string `json:"problemTypes"` // List of problem types this daycare host supports: [ "python3unittest", "gotest", ... ]
 
+	// daycare-only optional parameters
+	ShadowImages map[string]string `json:"shadowImages"` // Candidate images to shadow grade with by problem type: { "python3unittest": "codegrinder/python3:next" }
+	Labels       []string          `json:"labels"`       // Capabilities of this host that some problem types require: [ "gpu", ... ]
+	OS           string            `json:"os"`           // Operating system of the containers this host runs, linux or windows: "linux"
+	ReapAfter    int               `json:"reapAfter"`    // Minutes before a nanny container no job owns is removed: default 30
+	CPUsPerSlot  int               `json:"cpusPerSlot"`  // CPU cores each concurrent container is pinned to: default 0 (not pinned)
+	SlotMemory   int64             `json:"slotMemory"`   // Memory budget in megabytes for each concurrent container: default 0 (problem type limit only)
+	DaycareKey   string            `json:"daycareKey"`   // File holding the key this host signs grading results with, created if missing: default "$CODEGRINDERROOT/daycare.key"
+
+	// connection parameters where the default is usually sufficient
+	ReadHeaderTimeout    int      `json:"readHeaderTimeout"`    // seconds a client has to send its request headers: default 10
+	IdleTimeout          int      `json:"idleTimeout"`          // seconds an idle keep-alive connection is held open: default 120
+	MaxHeaderBytes       int      `json:"maxHeaderBytes"`       // largest block of request headers in bytes: default 65536
+	MaxConcurrentStreams uint32   `json:"maxConcurrentStreams"` // HTTP/2 requests one connection may have in flight: default 250
+	Listen               []string `json:"listen"`               // addresses to accept connections on, host:port or unix:/path: default [ ":https" ] with tls, [ ":8080" ] without
+
 	// ta-only parameters where the default is usually sufficient
-	ToolName        string      `json:"toolName"`        // LTI human readable name: default "CodeGrinder"
-	ToolID          string      `json:"toolID"`          // LTI unique ID: default "codegrinder"
-	ToolDescription string      `json:"toolDescription"` // LTI description: default "Programming exercises with grading"
-	AcmeCache       string      `json:"acmeDir"`         // Full path of Acme cache file: default "$CODEGRINDERROOT/acme"
-	SQLite3Path     string      `json:"sqlite3Path"`     // path to the sqlite database file: default "$CODEGRINDERROOT/db/codegrinder.db"
-	SessionsExpire  []time.Time `json:"sessionsExpire"`  // times/dates when sessions should expire (year is ignored)
+	ToolName        string            `json:"toolName"`        // LTI human readable name: default "CodeGrinder"
+	ToolID          string            `json:"toolID"`          // LTI unique ID: default "codegrinder"
+	ToolDescription string            `json:"toolDescription"` // LTI description: default "Programming exercises with grading"
+	AcmeCache       string            `json:"acmeDir"`         // Full path of Acme cache file: default "$CODEGRINDERROOT/acme"
+	SQLite3Path     string            `json:"sqlite3Path"`     // path to the sqlite database file: default "$CODEGRINDERROOT/db/codegrinder.db"
+	StaticDir       string            `json:"staticDir"`       // directory of static files served alongside those built into the binary, such as grind downloads: default "$CODEGRINDERROOT/www"
+	StaticFromDisk  bool              `json:"staticFromDisk"`  // serve every static file from staticDir, ignoring the built-in copies, so edits show up without rebuilding: default false
+	ImageManifests  string            `json:"imageManifests"`  // directory of per-problem-type image manifests for "codegrinder images build": default "$CODEGRINDERROOT/containers/manifests"
+	SessionsExpire  []time.Time       `json:"sessionsExpire"`  // times/dates when sessions should expire (year is ignored)
+	GraceMinutes    int               `json:"graceMinutes"`    // minutes past a due or lock date that work still counts as on time, to absorb clock skew: default 0
+	NTPServer       string            `json:"ntpServer"`       // host[:port] of an NTP server to check the server clock against: default none
+	MaxClockDrift   int               `json:"maxClockDrift"`   // seconds the server clock may be off from ntpServer before a warning is logged: default 1
+	SharedState     bool              `json:"sharedState"`     // keep login keys and daycare registrations in the database so several TA instances can run behind a load balancer: default false
+	RedisAddress    string            `json:"redisAddress"`    // host:port of a redis server to hold login keys instead of memory or the database: default none
+	RedisPassword   string            `json:"redisPassword"`   // password for the redis server: default none
+	BlobStore       string            `json:"blobStore"`       // where to keep commit files, transcripts, and problem step files instead of the database, "disk" or "s3": default none
+	BlobDir         string            `json:"blobDir"`         // directory for the disk blob store: default "$CODEGRINDERROOT/blobs"
+	S3Endpoint      string            `json:"s3Endpoint"`      // URL of the S3-compatible service for the s3 blob store: "https://s3.us-west-2.amazonaws.com"
+	S3Region        string            `json:"s3Region"`        // region for the s3 blob store: default "us-east-1"
+	S3Bucket        string            `json:"s3Bucket"`        // bucket for the s3 blob store
+	S3AccessKey     string            `json:"s3AccessKey"`     // access key ID for the s3 blob store
+	S3SecretKey     string            `json:"s3SecretKey"`     // secret access key for the s3 blob store
+	MasterKeys      map[string]string `json:"masterKeys"`      // keys that encrypt stored secrets by ID, base64 or "file:/path": { "2024": "..." }
+	MasterKey       string            `json:"masterKey"`       // ID of the master key used for new secrets: default derived from daycareSecret
+	SlowQueryMillis int               `json:"slowQueryMillis"` // log database queries that take longer than this many milliseconds, 0 to log none: default 100
+	MaxRequestSize  int64             `json:"maxRequestSize"`  // largest request body in bytes (after decompression) for routes without their own limit: default 1048576
+	MaxRequestSizes map[string]int64  `json:"maxRequestSizes"` // per-route request body limits in bytes: { "POST /commit_bundles/unsigned": 33554432 }
+	LMSConcurrency  int               `json:"lmsConcurrency"`  // grade posts in flight to one LMS host at a time: default 4
+	LMSTimeout      int               `json:"lmsTimeout"`      // seconds an LMS has to answer a grade post: default 30
+	OutboundProxy   string            `json:"outboundProxy"`   // URL of the proxy for requests to the LMS: default from HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+	OutboundCAFiles []string          `json:"outboundCAFiles"` // PEM files of CAs to trust for requests to the LMS, besides the system's: [ "/etc/ssl/campus-ca.pem" ]
+
+	// ta-only security parameters
+	LMSOrigins            []string `json:"lmsOrigins"`            // origins allowed to embed our pages in an iframe: [ "https://canvas.example.edu" ]
+	CookieSameSite        string   `json:"cookieSameSite"`        // SameSite setting for cookies, none, lax, or strict: default "none" so LMS iframes work
+	HSTSMaxAge            int      `json:"hstsMaxAge"`            // seconds browsers should insist on https, 0 to not send HSTS: default 31536000
+	ContentSecurityPolicy string   `json:"contentSecurityPolicy"` // replaces the default Content-Security-Policy (frame-ancestors is added from lmsOrigins)
+	TrustedProxies        []string `json:"trustedProxies"`        // addresses or networks of proxies whose X-Forwarded-For header is believed: [ "10.0.0.0/8" ]
+
+	// ta-only data residency parameters
+	ResidencyStores map[string]BlobStoreConfig `json:"residencyStores"` // more blob stores that courses can be assigned to, keeping their files apart: { "eu": { "blobStore": "s3", "s3Endpoint": "https://s3.eu-central-1.amazonaws.com", ... } }
+
+	// ta-only theme parameters
+	Themes map[string]Theme `json:"themes"` // branding for student-facing pages that courses can pick by name, with "" for the default: { "math": { "title": "Math CodeGrinder", "logoURL": "https://...", "accentColor": "#004b87", "footerLinks": [ { "text": "Help", "url": "https://..." } ] } }
+
+	// ta-only standby parameters
+	StandbyOf       string `json:"standbyOf"`       // hostname of the primary TA; serve read-only from a replica at sqlite3Path and queue submissions until the primary returns: default none
+	StandbyQueueDir string `json:"standbyQueueDir"` // directory where a standby keeps queued submissions: default "$CODEGRINDERROOT/standby"
+
+	// ta-only feedback parameters
+	FeedbackProvider string `json:"feedbackProvider"` // outside service asked about failing submissions in courses that opt in, "http": default none
+	FeedbackURL      string `json:"feedbackURL"`      // endpoint for the http feedback provider, which is sent JSON and returns {"feedback": "..."}
+	FeedbackToken    string `json:"feedbackToken"`    // bearer token for the http feedback provider
+
+	// development parameters
+	DevMode bool `json:"devMode"` // serve development helpers such as the LTI launch simulator at /dev/lti; never set on a public server: default false
 }
 var root string
 
 const daycareRegistrationInterval = 10 * time.Second
+const tlsAddress = ":https"
 const nonTLSAddress = ":8080"
 
 // filter for TLS logs to ignore failed handshakes
@@ -102,8 +167,20 @@ func main() {
 	flag.BoolVar(&use_tls, "tls", true, "Use TLS (https/wss) with automatic certificates")
 	flag.Parse()
 
-	if !ta && !daycare {
-		log.Fatalf("must run at least one role (ta/daycare)")
+	// commands other than serving
+	command := flag.Arg(0)
+	switch command {
+	case "":
+		if !ta && !daycare {
+			log.Fatalf("must run at least one role (ta/daycare)")
+		}
+	case "restore":
+		restoreCommand(flag.Args()[1:])
+		return
+	case "backup", "rotate-secrets", "rebuild-summaries", "rebuild-search-index", "images", "daycare-keys":
+		// needs the config file, handled below
+	default:
+		log.Fatalf("unknown command %q: expected backup, restore, rotate-secrets, rebuild-summaries, rebuild-search-index, images, or daycare-keys", command)
 	}
 
 	// set config defaults
@@ -112,6 +189,23 @@ func main() {
 	Config.ToolDescription = "Programming exercises with grading"
 	Config.AcmeCache = filepath.Join(root, "acme")
 	Config.SQLite3Path = filepath.Join(root, "db", "codegrinder.db")
+	Config.BlobDir = filepath.Join(root, "blobs")
+	Config.StaticDir = filepath.Join(root, "www")
+	Config.ImageManifests = filepath.Join(root, "containers", "manifests")
+	Config.StandbyQueueDir = filepath.Join(root, "standby")
+	Config.DaycareKey = filepath.Join(root, "daycare.key")
+	Config.OS = "linux"
+	Config.ReapAfter = 30
+	Config.HSTSMaxAge = 365 * 24 * 60 * 60
+	Config.MaxClockDrift = 1
+	Config.MaxRequestSize = defaultMaxRequestSize
+	Config.SlowQueryMillis = 100
+	Config.LMSConcurrency = 4
+	Config.LMSTimeout = 30
+	Config.ReadHeaderTimeout = 10
+	Config.IdleTimeout = 120
+	Config.MaxHeaderBytes = 64 << 10
+	Config.MaxConcurrentStreams = 250
 	Config.SessionsExpire = []time.Time{
 		time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local),
 		time.Date(2020, 7, 1, 0, 0, 0, 0, time.Local),
@@ -127,6 +221,31 @@ func main() {
 	Config.SessionSecret = unBase64(Config.SessionSecret)
 	Config.DaycareSecret = unBase64(Config.DaycareSecret)
 
+	if command == "backup" {
+		backupCommand(flag.Args()[1:])
+		return
+	}
+	if command == "rotate-secrets" {
+		rotateSecretsCommand(flag.Args()[1:])
+		return
+	}
+	if command == "rebuild-summaries" {
+		rebuildSummariesCommand(flag.Args()[1:])
+		return
+	}
+	if command == "rebuild-search-index" {
+		rebuildSearchIndexCommand(flag.Args()[1:])
+		return
+	}
+	if command == "images" {
+		imagesCommand(flag.Args()[1:])
+		return
+	}
+	if command == "daycare-keys" {
+		daycareKeysCommand(flag.Args()[1:])
+		return
+	}
+
 	if Config.Hostname == "" {
 		log.Fatalf("cannot run with no hostname in the config file")
 	}
@@ -134,6 +253,9 @@ func main() {
 		log.Fatalf("cannot run with no daycareSecret in the config file")
 	}
 	// Config.AcmeEmail is optional
+	if Config.ReadHeaderTimeout < 0 || Config.IdleTimeout < 0 || Config.MaxHeaderBytes < 0 {
+		log.Fatalf("readHeaderTimeout, idleTimeout, and maxHeaderBytes cannot be negative")
+	}
 
 	// set up martini
 	r := martini.NewRouter()
@@ -173,9 +295,6 @@ func main() {
 		// initialize random number generator
 		rand.Seed(time.Now().UnixNano())
 
-		// init the container limiter channel
-		containerLimiter = make(chan struct{}, Config.Capacity)
-
 		// make sure relevant fields included in config file
 		if Config.TAHostname == "" {
 			Config.TAHostname = Config.Hostname
@@ -186,8 +305,38 @@ func main() {
 		if Config.Capacity <= 0 {
 			log.Fatalf("Daycare capacity must be greater than zero")
 		}
+		if Config.OS != "linux" && Config.OS != "windows" {
+			log.Fatalf("Daycare os must be linux or windows, not %q", Config.OS)
+		}
+		if Config.OS == "windows" && Config.CPUsPerSlot > 0 {
+			log.Fatalf("Daycare cpusPerSlot is not supported for windows containers")
+		}
+
+		// divide the host into slots, one per concurrent container
+		slots, err := newSlots(Config.Capacity, Config.CPUsPerSlot, Config.SlotMemory, runtime.NumCPU())
+		if err != nil {
+			log.Fatalf("Daycare %v", err)
+		}
+		containerSlots = slots
+
+		// results are signed with this host's own key, which the TA must know
+		if daycareKey, err = loadDaycareKey(Config.DaycareKey); err != nil {
+			log.Fatalf("Daycare key: %v", err)
+		}
+		log.Printf("daycare public key is %s", encodePublicKey(daycareKey))
 
 		r.Get("/sockets/:problem_type/:action", SocketProblemTypeAction)
+		r.Post("/daycare_sessions", bindJSON(SessionRequest{}), PostDaycareSessions)
+		r.Post("/daycare_replays", bindJSON(GradingReplay{}), PostDaycareReplay)
+
+		// watch for container engine restarts
+		go runEngineMonitor()
+
+		// clean up containers left behind by crashed jobs
+		if Config.ReapAfter <= 0 {
+			log.Fatalf("Daycare reapAfter must be greater than zero")
+		}
+		go runContainerReaper()
 
 		// register with the TA periodically
 		go func() {
@@ -199,13 +348,26 @@ func main() {
 			client := &http.Client{Timeout: time.Second * 5}
 
 			for {
+				// stay out of the dispatcher until the container engine is reachable
+				if !engine.Healthy() {
+					if status != "paused" {
+						log.Printf("container engine is unavailable, pausing daycare registration")
+					}
+					status = "paused"
+					time.Sleep(engineCheckInterval)
+					continue
+				}
+
 				start := time.Now()
 				reg := DaycareRegistration{
 					Hostname:     Config.Hostname,
 					ProblemTypes: Config.ProblemTypes,
+					OS:           Config.OS,
+					Labels:       Config.Labels,
 					Capacity:     Config.Capacity,
 					Time:         time.Now(),
 					Version:      CurrentVersion.Version,
+					PublicKey:    encodePublicKey(daycareKey),
 				}
 				reg.Signature = reg.ComputeSignature(Config.DaycareSecret)
 				raw, err := json.MarshalIndent(&reg, "", "    ")
@@ -268,6 +430,31 @@ func main() {
 		if Config.SQLite3Path == "" {
 			log.Fatalf("cannot run TA role with no sqlite3Path in the config file")
 		}
+		if _, _, err := masterKeys(); err != nil {
+			log.Fatalf("cannot run TA role: %v", err)
+		}
+		if Config.GraceMinutes < 0 {
+			log.Fatalf("graceMinutes cannot be negative")
+		}
+		if Config.MaxRequestSize <= 0 {
+			log.Fatalf("maxRequestSize must be positive")
+		}
+		if Config.LMSConcurrency <= 0 || Config.LMSTimeout <= 0 {
+			log.Fatalf("lmsConcurrency and lmsTimeout must be positive")
+		}
+		if standbyMode() && Config.StandbyOf == Config.Hostname {
+			log.Fatalf("standbyOf must name the primary TA, not this one")
+		}
+		for name, theme := range Config.Themes {
+			if err := theme.Validate(); err != nil {
+				log.Fatalf("themes entry %q: %v", name, err)
+			}
+		}
+		for route, size := range Config.MaxRequestSizes {
+			if method, pattern, ok := strings.Cut(route, " "); !ok || method == "" || !strings.HasPrefix(pattern, "/") || size <= 0 {
+				log.Fatalf("maxRequestSizes entry %q: %d must be \"METHOD /route/pattern\" with a positive size", route, size)
+			}
+		}
 
 		// skipMiddleware wraps a martini.Handler, skipping it if the request path
 		// starts with the given prefix.
@@ -282,19 +469,88 @@ func main() {
 				}
 			}
 		}
-		m.Use(skipMiddleware("/sockets/", mgzip.All()))
-		m.Use(martini.Static(filepath.Join(root, "www"), martini.StaticOptions{SkipLogging: true}))
+		m.Use(withRequestID)
+		m.Use(apiVersioning())
+		if standbyMode() {
+			log.Printf("standby mode: serving read-only and queuing submissions for %s", Config.StandbyOf)
+			m.Use(rejectOnStandby())
+		}
+		m.Use(limitRequestSize())
+		setupTrustedProxies()
+		m.Use(securityHeaders(use_tls))
+		m.Use(skipMiddleware("/sockets/", compressResponses()))
+		staticRoot = staticFiles()
+		m.Use(serveStatic(staticRoot))
+		r.NotFound(staticFallback(staticRoot))
 		m.Use(render.Renderer(render.Options{IndentJSON: false}))
 
 		// set up the database
 		db := setupDB(Config.SQLite3Path)
 		var dbMutex sync.Mutex
 
+		// set up storage for commit files
+		store, err := setupBlobStore()
+		if err != nil {
+			log.Fatalf("setting up blob store: %v", err)
+		}
+		blobStore = store
+
+		// set up the outside feedback service, if any
+		provider, err := setupFeedbackProvider()
+		if err != nil {
+			log.Fatalf("setting up feedback provider: %v", err)
+		}
+		feedbackProvider = provider
+		feedbackRequests.db = db
+		feedbackRequests.mutex = &dbMutex
+		feedbackRequests.inFlight = make(chan struct{}, maxFeedbackRequests)
+
+		// limit and watch the requests that post grades to the LMS
+		transport, err := newOutboundTransport()
+		if err != nil {
+			log.Fatalf("setting up requests to the LMS: %v", err)
+		}
+		lmsRequests.client = &http.Client{Transport: transport, Timeout: time.Duration(Config.LMSTimeout) * time.Second}
+
+		// reconcile grades with the LMS every night
+		gradeSyncs.db = db
+		gradeSyncs.mutex = &dbMutex
+		if !standbyMode() {
+			go runGradeSyncJobs(db, &dbMutex)
+		}
+
+		// deadlines are enforced by this clock, so keep an eye on it
+		if Config.NTPServer != "" {
+			go runClockCheck()
+		}
+
+		// share state with other TA instances through the database
+		if Config.SharedState {
+			loginRecords.shared = true
+			daycareRegistrations.shared = true
+			if !standbyMode() {
+				go runSingletonJobs(db, &dbMutex)
+			}
+		}
+
+		// a standby sends what it queued to the primary once it is back
+		if standbyMode() {
+			go runStandbyReplay()
+		}
+		if Config.RedisAddress != "" {
+			loginRecords.redis = newRedisClient(Config.RedisAddress, Config.RedisPassword)
+			if _, err := loginRecords.redis.Do("PING"); err != nil {
+				log.Fatalf("unable to reach redis server at %s: %v", Config.RedisAddress, err)
+			}
+		}
+
 		// martini service: wrap handler in a transaction
-		withTx := func(c martini.Context, r *http.Request, w http.ResponseWriter) {
+		withTx := func(c martini.Context, r *http.Request, w http.ResponseWriter, route martini.Route, id requestID) {
 			// start a transaction
 			dbMutex.Lock()
 			defer dbMutex.Unlock()
+			setQueryLabel(route.Method()+" "+route.Pattern(), id)
+			defer clearQueryLabel()
 
 			start := time.Now()
 			defer func() {
@@ -308,7 +564,7 @@ func main() {
 					default:
 						elapsed -= elapsed % (100 * time.Millisecond)
 					}
-					log.Printf("transaction took %v, req was %s", elapsed, r.RequestURI)
+					log.Printf("transaction took %v, req was %s [%s]", elapsed, r.RequestURI, id)
 				}
 			}()
 			tx, err := db.Begin()
@@ -341,22 +597,38 @@ func main() {
 
 		// martini service: to require an active logged-in session
 		auth := func(w http.ResponseWriter, r *http.Request) {
-			_, err := GetSession(r)
+			session, err := GetSession(r)
 			if err != nil {
+				if throttleAuth(w, r, "") {
+					return
+				}
+				if err == errSessionForged {
+					recordAuthFailure(r, "session", "", err.Error())
+				}
 				loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication failed: try logging in again")
 				log.Printf("%v", err)
 				return
 			}
+			rejectCSRF(w, r, session)
 		}
 
 		// martini service: include the current logged-in user (requires withTx)
 		withCurrentUser := func(c martini.Context, w http.ResponseWriter, r *http.Request, tx *sql.Tx) {
 			session, err := GetSession(r)
 			if err != nil {
+				if throttleAuth(w, r, "") {
+					return
+				}
+				if err == errSessionForged {
+					recordAuthFailure(r, "session", "", err.Error())
+				}
 				loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication failed: try logging in again")
 				log.Printf("%v", err)
 				return
 			}
+			if rejectCSRF(w, r, session) {
+				return
+			}
 
 			// load the user record
 			userID := session.UserID
@@ -372,6 +644,11 @@ func main() {
 				return
 			}
 
+			// only administrators can make changes during maintenance
+			if rejectDuringMaintenance(w, r, tx, user) {
+				return
+			}
+
 			// map the current user to the request context
 			c.Map(user)
 		}
@@ -396,20 +673,26 @@ func main() {
 		}
 
 		// martini middleware: decompress incoming requests
-		gunzip := func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		gunzip := func(c martini.Context, w http.ResponseWriter, r *http.Request, limit requestLimit) {
 			if r.Header.Get("Content-Encoding") != "gzip" {
 				return
 			}
 
 			r.Header.Del("Content-Encoding")
 			body := r.Body
-			var err error
-			r.Body, err = gzip.NewReader(body)
+			gz, err := gzip.NewReader(body)
 			defer body.Close()
 			if err != nil {
+				if err == errRequestTooLarge {
+					writeRequestTooLarge(w, int64(limit))
+					return
+				}
 				loggedHTTPErrorf(w, http.StatusBadRequest, "gzip error in request: %v", err)
 				return
 			}
+
+			// the limit applies to the decompressed body, too
+			r.Body = newLimitedBody(gz, int64(limit))
 			c.Next()
 		}
 
@@ -421,21 +704,57 @@ func main() {
 			render.JSON(http.StatusOK, &CurrentVersion)
 		})
 
+		// public service status
+		r.Get("/status", counter, withTx, GetStatus)
+
+		// read-only maintenance mode
+		r.Get("/maintenance", counter, withTx, GetMaintenance)
+		r.Put("/maintenance", counter, withTx, withCurrentUser, administratorOnly, gunzip, bindJSON(Maintenance{}), PutMaintenance)
+		r.Delete("/maintenance", counter, withTx, withCurrentUser, administratorOnly, DeleteMaintenance)
+
 		// daycare registration
-		r.Get("/daycare_registrations",
-			func(w http.ResponseWriter, render render.Render) {
-				daycareRegistrations.Expire()
-				render.JSON(http.StatusOK, daycareRegistrations.daycares)
+		r.Get("/daycare_registrations", withTx,
+			func(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+				if err := daycareRegistrations.Expire(tx); err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+					return
+				}
+				list, err := daycareRegistrations.List(tx)
+				if err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+					return
+				}
+				render.JSON(http.StatusOK, list)
 			})
-		r.Post("/daycare_registrations", gunzip, binding.Json(DaycareRegistration{}),
-			func(w http.ResponseWriter, reg DaycareRegistration) {
-				daycareRegistrations.Expire()
-				if err := daycareRegistrations.Insert(&reg); err != nil {
+		r.Post("/daycare_registrations", gunzip, bindJSON(DaycareRegistration{}), withTx,
+			func(w http.ResponseWriter, tx *sql.Tx, reg DaycareRegistration) {
+				if err := daycareRegistrations.Expire(tx); err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+					return
+				}
+				if err := daycareRegistrations.Insert(tx, &reg); err != nil {
 					loggedHTTPErrorf(w, http.StatusBadRequest, "bad daycare registration: %v", err)
 					return
 				}
 			})
 
+		// shadow grading
+		r.Post("/shadow_grades", counter, gunzip, bindJSON(ShadowGrade{}), withTx, PostShadowGrade)
+		r.Get("/shadow_grades/drift", counter, withTx, withCurrentUser, administratorOnly, GetShadowGradeDrift)
+
+		// grading usage
+		r.Post("/grading_usage", counter, gunzip, bindJSON(GradingUsage{}), withTx, PostGradingUsage)
+		r.Get("/grading_usage/report", counter, withTx, withCurrentUser, administratorOnly, GetGradingUsageReport)
+		r.Post("/nanny_logs", counter, gunzip, bindJSON(NannyLog{}), withTx, PostNannyLog)
+		r.Post("/grading_records", counter, gunzip, bindJSON(GradingRecord{}), withTx, PostGradingRecord)
+		r.Get("/grading_records", counter, withTx, withCurrentUser, administratorOnly, GetGradingRecords)
+		r.Post("/grading_records/:record_id/replay", counter, withTx, withCurrentUser, administratorOnly, PostGradingRecordReplay)
+		r.Post("/container_alerts", counter, gunzip, bindJSON(ContainerAlert{}), withTx, PostContainerAlert)
+
+		// grade sync with the LMS
+		r.Get("/grade_sync/report", counter, withTx, withCurrentUser, administratorOnly, GetGradeSyncReport)
+		r.Get("/grade_sync/runs", counter, withTx, withCurrentUser, administratorOnly, GetGradeSyncRuns)
+
 		// stats
 		r.Get("/stats", withTx, withCurrentUser, authorOnly, func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -453,27 +772,47 @@ func main() {
 
 		// LTI
 		r.Get("/lti/config.xml", counter, GetConfigXML)
+		r.Get("/themes", counter, GetThemes)
 		//r.Post("/lti/problem_sets", counter, gunzip, binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSets)
-		r.Post("/lti/problem_sets/:ui/:unique", counter, gunzip, binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSet)
+		r.Post("/lti/problem_sets/:ui/:unique", counter, gunzip, bindWithinLimit(binding.Bind(LTIRequest{})), checkOAuthSignature, withTx, LtiProblemSet)
+		if Config.DevMode {
+			log.Printf("development mode: anyone can sign LTI launches at /dev/lti")
+			r.Get("/dev/lti", counter, GetDevLaunch)
+			r.Post("/dev/lti", counter, PostDevLaunch)
+			r.Post("/dev/outcomes", counter, PostDevOutcome)
+		}
+
+		// built-in pages for a deployment with no web frontend
+		r.Get("/ui/assignments", counter, withTx, withCurrentUser, GetWebUIAssignments)
+		r.Get("/ui/assignments/:assignment_id", counter, withTx, withCurrentUser, GetWebUIAssignment)
+		r.Get("/ui/problem_sets", counter, withTx, withCurrentUser, GetWebUIProblemSets)
 
 		// problem bundles--for problem creation only
-		r.Post("/problem_bundles/unconfirmed", counter, withTx, withCurrentUser, authorOnly, gunzip, binding.Json(ProblemBundle{}), PostProblemBundleUnconfirmed)
-		r.Post("/problem_bundles/confirmed", counter, withTx, withCurrentUser, authorOnly, gunzip, binding.Json(ProblemBundle{}), PostProblemBundleConfirmed)
-		r.Put("/problem_bundles/:problem_id", counter, withTx, withCurrentUser, authorOnly, gunzip, binding.Json(ProblemBundle{}), PutProblemBundle)
+		r.Post("/problem_bundles/unconfirmed", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(ProblemBundle{}), PostProblemBundleUnconfirmed)
+		r.Post("/problem_bundles/confirmed", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(ProblemBundle{}), PostProblemBundleConfirmed)
+		r.Put("/problem_bundles/:problem_id", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(ProblemBundle{}), PutProblemBundle)
 
 		// problem set bundles--for problem set creation only
-		r.Post("/problem_set_bundles", counter, withTx, withCurrentUser, authorOnly, gunzip, binding.Json(ProblemSetBundle{}), PostProblemSetBundle)
-		r.Put("/problem_set_bundles/:problem_set_id", counter, withTx, withCurrentUser, authorOnly, gunzip, binding.Json(ProblemSetBundle{}), PutProblemSetBundle)
+		r.Post("/problem_set_bundles", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(ProblemSetBundle{}), PostProblemSetBundle)
+		r.Put("/problem_set_bundles/:problem_set_id", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(ProblemSetBundle{}), PutProblemSetBundle)
 
 		// problem types
 		r.Get("/problem_types", counter, auth, withTx, GetProblemTypes)
 		r.Get("/problem_types/:name", counter, auth, withTx, GetProblemType)
+		r.Put("/problem_types/:name", counter, withTx, withCurrentUser, administratorOnly, gunzip, bindJSON(ProblemType{}), PutProblemType)
 
 		// problems
 		r.Get("/problems", counter, withTx, withCurrentUser, GetProblems)
 		r.Get("/problems/:problem_id", counter, withTx, withCurrentUser, GetProblem)
 		r.Get("/problems/:problem_id/steps", counter, withTx, withCurrentUser, GetProblemSteps)
 		r.Get("/problems/:problem_id/steps/:step", counter, withTx, withCurrentUser, GetProblemStep)
+		r.Get("/problems/:problem_id/steps/:step/instructions", counter, withTx, withCurrentUser, GetProblemStepInstructions)
+		r.Get("/problems/:problem_id/steps/:step/attachments/**", counter, withTx, withCurrentUser, GetProblemStepAttachment)
+		r.Get("/problems/:problem_id/packet", counter, withTx, withCurrentUser, GetProblemPacket)
+		r.Get("/problems/:problem_id/usage", counter, withTx, withCurrentUser, authorOnly, GetProblemUsage)
+		r.Get("/problems/:problem_id/confirmations", counter, withTx, withCurrentUser, authorOnly, GetProblemConfirmations)
+		r.Put("/problems/:problem_id/step_weights", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(StepWeights{}), PutProblemStepWeights)
+		r.Get("/prerequisite_graph", counter, withTx, withCurrentUser, authorOnly, GetPrerequisiteGraph)
 		r.Delete("/problems/:problem_id", counter, withTx, withCurrentUser, administratorOnly, DeleteProblem)
 
 		// problem sets
@@ -482,15 +821,87 @@ func main() {
 		r.Get("/problem_sets/:problem_set_id/problems", counter, withTx, withCurrentUser, GetProblemSetProblems)
 		r.Delete("/problem_sets/:problem_set_id", counter, withTx, withCurrentUser, administratorOnly, DeleteProblemSet)
 
+		// availability windows
+		r.Get("/availability_windows", counter, withTx, withCurrentUser, authorOnly, GetAvailabilityWindows)
+		r.Post("/availability_windows", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(AvailabilityWindow{}), PostAvailabilityWindow)
+		r.Delete("/availability_windows/:window_id", counter, withTx, withCurrentUser, authorOnly, DeleteAvailabilityWindow)
+
+		// problem secrets
+		r.Get("/problem_secrets", counter, withTx, withCurrentUser, authorOnly, GetProblemSecrets)
+		r.Post("/problem_secrets", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(ProblemSecret{}), PostProblemSecret)
+		r.Delete("/problem_secrets/:secret_id", counter, withTx, withCurrentUser, authorOnly, DeleteProblemSecret)
+		r.Post("/problem_secrets/fetch", counter, gunzip, bindJSON(ProblemSecretRequest{}), withTx, PostProblemSecretRequest)
+
+		// problem set canaries
+		r.Get("/problem_set_canaries", counter, withTx, withCurrentUser, authorOnly, GetProblemSetCanaries)
+		r.Post("/problem_set_canaries", counter, withTx, withCurrentUser, authorOnly, gunzip, bindJSON(ProblemSetCanary{}), PostProblemSetCanary)
+		r.Get("/problem_set_canaries/:canary_id/metrics", counter, withTx, withCurrentUser, authorOnly, GetProblemSetCanaryMetrics)
+		r.Post("/problem_set_canaries/:canary_id/promote", counter, withTx, withCurrentUser, authorOnly, PostProblemSetCanaryPromote)
+		r.Delete("/problem_set_canaries/:canary_id", counter, withTx, withCurrentUser, authorOnly, DeleteProblemSetCanary)
+
 		// courses
 		r.Get("/courses", counter, withTx, withCurrentUser, GetCourses)
 		r.Get("/courses/:course_id", counter, withTx, withCurrentUser, GetCourse)
+		r.Get("/courses/:course_id/archive", counter, withTx, withCurrentUser, GetCourseArchive)
+		r.Get("/courses/:course_id/quota", counter, withTx, withCurrentUser, administratorOnly, GetCourseQuota)
+		r.Put("/courses/:course_id/quota", counter, withTx, withCurrentUser, administratorOnly, gunzip, bindJSON(CourseQuota{}), PutCourseQuota)
+		r.Delete("/courses/:course_id/quota", counter, withTx, withCurrentUser, administratorOnly, DeleteCourseQuota)
+		r.Get("/courses/:course_id/residency", counter, withTx, withCurrentUser, administratorOnly, GetCourseResidency)
+		r.Put("/courses/:course_id/residency", counter, withTx, withCurrentUser, administratorOnly, gunzip, bindJSON(CourseResidency{}), PutCourseResidency)
+		r.Delete("/courses/:course_id/residency", counter, withTx, withCurrentUser, administratorOnly, DeleteCourseResidency)
+		r.Get("/courses/:course_id/announcements", counter, withTx, withCurrentUser, GetCourseAnnouncements)
+		r.Post("/courses/:course_id/announcements", counter, withTx, withCurrentUser, gunzip, bindJSON(Announcement{}), PostCourseAnnouncement)
+		r.Delete("/announcements/:announcement_id", counter, withTx, withCurrentUser, DeleteAnnouncement)
+		r.Post("/announcements/:announcement_id/read", counter, withTx, withCurrentUser, PostAnnouncementRead)
+		r.Get("/courses/:course_id/theme", counter, withTx, withCurrentUser, GetCourseTheme)
+		r.Put("/courses/:course_id/theme", counter, withTx, withCurrentUser, gunzip, bindJSON(CourseTheme{}), PutCourseTheme)
+		r.Delete("/courses/:course_id/theme", counter, withTx, withCurrentUser, DeleteCourseTheme)
+		r.Get("/courses/:course_id/grade_policy", counter, withTx, withCurrentUser, GetCourseGradePolicy)
+		r.Put("/courses/:course_id/grade_policy", counter, withTx, withCurrentUser, gunzip, bindJSON(GradePolicy{}), PutCourseGradePolicy)
+		r.Delete("/courses/:course_id/grade_policy", counter, withTx, withCurrentUser, DeleteCourseGradePolicy)
+		r.Get("/courses/:course_id/off_site_commits", counter, withTx, withCurrentUser, GetCourseOffSiteCommits)
+		r.Get("/courses/:course_id/failed_commits", counter, withTx, withCurrentUser, GetCourseFailedCommits)
+		r.Get("/courses/:course_id/hint_usage", counter, withTx, withCurrentUser, GetCourseHintUsage)
+		r.Get("/courses/:course_id/summaries", counter, withTx, withCurrentUser, GetCourseSummaries)
+		r.Get("/courses/:course_id/search", counter, withTx, withCurrentUser, GetCourseSearch)
+		r.Get("/courses/:course_id/feedback_settings", counter, withTx, withCurrentUser, GetCourseFeedbackSettings)
+		r.Put("/courses/:course_id/feedback_settings", counter, withTx, withCurrentUser, PutCourseFeedbackSettings)
+		r.Delete("/courses/:course_id/feedback_settings", counter, withTx, withCurrentUser, DeleteCourseFeedbackSettings)
+		r.Get("/courses/:course_id/feedback_records", counter, withTx, withCurrentUser, GetCourseFeedbackRecords)
+		r.Get("/courses/:course_id/role_changes", counter, withTx, withCurrentUser, GetCourseRoleChanges)
+		r.Get("/courses/:course_id/time_on_task", counter, withTx, withCurrentUser, GetCourseTimeOnTask)
+		r.Get("/courses/:course_id/time_sharing", counter, withTx, withCurrentUser, GetCourseTimeSharing)
+		r.Put("/courses/:course_id/time_sharing", counter, withTx, withCurrentUser, PutCourseTimeSharing)
+		r.Delete("/courses/:course_id/time_sharing", counter, withTx, withCurrentUser, DeleteCourseTimeSharing)
+		r.Get("/courses/:course_id/prerequisite_locks", counter, withTx, withCurrentUser, GetCoursePrerequisiteLocks)
+		r.Put("/courses/:course_id/prerequisite_locks", counter, withTx, withCurrentUser, PutCoursePrerequisiteLocks)
+		r.Delete("/courses/:course_id/prerequisite_locks", counter, withTx, withCurrentUser, DeleteCoursePrerequisiteLocks)
+		r.Get("/courses/:course_id/showcase", counter, withTx, withCurrentUser, GetCourseShowcase)
+		r.Post("/courses/:course_id/showcase", counter, withTx, withCurrentUser, gunzip, bindJSON(ShowcaseEntry{}), PostCourseShowcase)
+		r.Get("/courses/:course_id/showcase_candidates", counter, withTx, withCurrentUser, GetCourseShowcaseCandidates)
+		r.Delete("/showcase/:showcase_id", counter, withTx, withCurrentUser, DeleteShowcaseEntry)
+		r.Get("/courses/:course_id/sections", counter, withTx, withCurrentUser, GetCourseSections)
+		r.Post("/courses/:course_id/sections", counter, withTx, withCurrentUser, gunzip, bindJSON(Section{}), PostCourseSection)
+		r.Post("/courses/:course_id/bulk_assignments", counter, withTx, withCurrentUser, gunzip, bindJSON(BulkAssignment{}), PostCourseBulkAssignment)
+		r.Delete("/sections/:section_id", counter, withTx, withCurrentUser, DeleteSection)
+		r.Put("/sections/:section_id/members/:user_id", counter, withTx, withCurrentUser, gunzip, bindJSON(SectionMember{}), PutSectionMember)
+		r.Delete("/sections/:section_id/members/:user_id", counter, withTx, withCurrentUser, DeleteSectionMember)
+		r.Get("/courses/:course_id/research_consent", counter, withTx, withCurrentUser, GetCourseResearchConsent)
+		r.Put("/courses/:course_id/research_consent", counter, withTx, withCurrentUser, PutCourseResearchConsent)
+		r.Delete("/courses/:course_id/research_consent", counter, withTx, withCurrentUser, DeleteCourseResearchConsent)
+		r.Get("/courses/:course_id/explanations", counter, withTx, withCurrentUser, GetCourseExplanations)
+		r.Post("/commits/:commit_id/explanations", counter, withTx, withCurrentUser, bindJSON(FailureExplanation{}), PostCommitExplanation)
+		r.Post("/explanations/:explanation_id/approval", counter, withTx, withCurrentUser, PostExplanationApproval)
+		r.Delete("/explanations/:explanation_id", counter, withTx, withCurrentUser, DeleteExplanation)
+		r.Post("/courses/:course_id/integrity_analysis", counter, withTx, withCurrentUser, PostCourseIntegrityAnalysis)
+		r.Get("/courses/:course_id/integrity_flags", counter, withTx, withCurrentUser, GetCourseIntegrityFlags)
+		r.Put("/integrity_flags/:flag_id", counter, withTx, withCurrentUser, gunzip, bindJSON(IntegrityFlag{}), PutIntegrityFlag)
 		r.Delete("/courses/:course_id", counter, withTx, withCurrentUser, administratorOnly, DeleteCourse)
 
 		// users
 		r.Get("/users", counter, withTx, withCurrentUser, GetUsers)
 		r.Get("/users/me", counter, withTx, withCurrentUser, GetUserMe)
-		r.Get("/users/session", counter, GetUserSession)
+		r.Get("/users/session", counter, withTx, GetUserSession)
 		r.Get("/users/:user_id", counter, withTx, withCurrentUser, GetUser)
 		r.Get("/courses/:course_id/users", counter, withTx, withCurrentUser, GetCourseUsers)
 		r.Delete("/users/:user_id", counter, withTx, withCurrentUser, administratorOnly, DeleteUser)
@@ -500,16 +911,75 @@ func main() {
 		r.Get("/courses/:course_id/users/:user_id/assignments", counter, withTx, withCurrentUser, GetCourseUserAssignments)
 		r.Get("/assignments", counter, withTx, withCurrentUser, GetAssignments)
 		r.Get("/assignments/:assignment_id", counter, withTx, withCurrentUser, GetAssignment)
+		r.Get("/assignments/:assignment_id/time_on_task", counter, withTx, withCurrentUser, GetAssignmentTimeOnTask)
+		r.Get("/assignments/:assignment_id/archive", counter, withTx, withCurrentUser, GetAssignmentArchive)
+		r.Get("/assignments/:assignment_id/commit_chain", counter, withTx, withCurrentUser, GetAssignmentCommitChain)
+		r.Get("/assignments/:assignment_id/ip_allowlist", counter, withTx, withCurrentUser, GetAssignmentIPAllowlist)
+		r.Put("/assignments/:assignment_id/ip_allowlist", counter, withTx, withCurrentUser, gunzip, bindJSON(IPAllowlist{}), PutAssignmentIPAllowlist)
+		r.Delete("/assignments/:assignment_id/ip_allowlist", counter, withTx, withCurrentUser, DeleteAssignmentIPAllowlist)
+		r.Get("/assignments/:assignment_id/score_policy", counter, withTx, withCurrentUser, GetAssignmentScorePolicy)
+		r.Put("/assignments/:assignment_id/score_policy", counter, withTx, withCurrentUser, gunzip, bindJSON(ScorePolicy{}), PutAssignmentScorePolicy)
+		r.Delete("/assignments/:assignment_id/score_policy", counter, withTx, withCurrentUser, DeleteAssignmentScorePolicy)
+		r.Get("/assignments/:assignment_id/grade_preview", counter, withTx, withCurrentUser, GetAssignmentGradePreview)
+		r.Get("/assignments/:assignment_id/grade_explanations", counter, withTx, withCurrentUser, GetAssignmentGradeExplanations)
+		r.Get("/assignments/:assignment_id/grade_targets", counter, withTx, withCurrentUser, GetAssignmentGradeTargets)
+		r.Post("/assignments/:assignment_id/reset", counter, withTx, withCurrentUser, PostAssignmentReset)
+		r.Get("/assignments/:assignment_id/step_unlocks", counter, withTx, withCurrentUser, GetAssignmentStepUnlocks)
+		r.Post("/assignments/:assignment_id/step_unlocks", counter, withTx, withCurrentUser, gunzip, bindJSON(StepUnlock{}), PostAssignmentStepUnlock)
 		r.Delete("/assignments/:assignment_id", counter, withTx, withCurrentUser, administratorOnly, DeleteAssignment)
 
+		// signed download URLs
+		r.Post("/assignments/:assignment_id/archive/download_url", counter, withTx, withCurrentUser, PostAssignmentArchiveDownloadURL)
+		r.Post("/assignments/:assignment_id/problems/:problem_id/steps/:step/download_url", counter, withTx, withCurrentUser, PostAssignmentProblemStepDownloadURL)
+		r.Get("/downloads/assignments/:assignment_id/archive", counter, withTx, GetDownloadAssignmentArchive)
+		r.Get("/downloads/assignments/:assignment_id/problems/:problem_id/steps/:step", counter, withTx, GetDownloadAssignmentProblemStep)
+
 		// commits
 		r.Get("/assignments/:assignment_id/problems/:problem_id/commits/last", counter, withTx, withCurrentUser, GetAssignmentProblemCommitLast)
 		r.Get("/assignments/:assignment_id/problems/:problem_id/steps/:step/commits/last", counter, withTx, withCurrentUser, GetAssignmentProblemStepCommitLast)
+		r.Get("/assignments/:assignment_id/problems/:problem_id/steps/:step/attempts", counter, withTx, withCurrentUser, GetAssignmentProblemStepAttempts)
+		r.Get("/assignments/:assignment_id/problems/:problem_id/steps/:step/rubric", counter, withTx, withCurrentUser, GetAssignmentProblemStepRubric)
+		r.Post("/assignments/:assignment_id/problems/:problem_id/steps/:step/activity", counter, withTx, withCurrentUser, PostAssignmentProblemStepActivity)
+		r.Get("/assignments/:assignment_id/problems/:problem_id/steps/:step/hints", counter, withTx, withCurrentUser, GetAssignmentProblemStepHints)
+		r.Get("/assignments/:assignment_id/problems/:problem_id/steps/:step/explanations", counter, withTx, withCurrentUser, GetAssignmentProblemStepExplanations)
+		r.Post("/assignments/:assignment_id/problems/:problem_id/survey", counter, withTx, withCurrentUser, gunzip, bindJSON(ProblemSurvey{}), PostAssignmentProblemSurvey)
+		r.Get("/assignments/:assignment_id/problems/:problem_id/showcase_consent", counter, withTx, withCurrentUser, GetAssignmentProblemShowcaseConsent)
+		r.Put("/assignments/:assignment_id/problems/:problem_id/showcase_consent", counter, withTx, withCurrentUser, PutAssignmentProblemShowcaseConsent)
+		r.Delete("/assignments/:assignment_id/problems/:problem_id/showcase_consent", counter, withTx, withCurrentUser, DeleteAssignmentProblemShowcaseConsent)
+		r.Get("/problems/:problem_id/survey_results", counter, withTx, withCurrentUser, authorOnly, GetProblemSurveyResults)
+		r.Get("/problem_estimates", counter, withTx, withCurrentUser, authorOnly, GetProblemEstimates)
+		r.Get("/commits/:commit_id", counter, withTx, withCurrentUser, GetCommit)
 		r.Delete("/commits/:commit_id", counter, withTx, withCurrentUser, administratorOnly, DeleteCommit)
+		r.Get("/commits/:commit_id/nanny_logs", counter, withTx, withCurrentUser, administratorOnly, GetCommitNannyLogs)
+		r.Post("/commits/:commit_id/shell", counter, withTx, withCurrentUser, PostCommitShell)
+		r.Get("/container_alerts", counter, withTx, withCurrentUser, administratorOnly, GetContainerAlerts)
+		r.Get("/grading_sessions", counter, withTx, withCurrentUser, administratorOnly, GetGradingSessions)
+		r.Delete("/grading_sessions/:hostname/:container_id", counter, withTx, withCurrentUser, administratorOnly, DeleteGradingSession)
+
+		// client version routes
+		r.Get("/client_versions", counter, withTx, withCurrentUser, administratorOnly, GetClientVersions)
+
+		// auth failure routes
+		r.Get("/auth_failures", counter, withTx, withCurrentUser, administratorOnly, GetAuthFailures)
+
+		// research export routes
+		r.Get("/research_tokens", counter, withTx, withCurrentUser, administratorOnly, GetResearchTokens)
+		r.Post("/research_tokens", counter, withTx, withCurrentUser, administratorOnly, gunzip, bindJSON(ResearchToken{}), PostResearchToken)
+		r.Delete("/research_tokens/:token_id", counter, withTx, withCurrentUser, administratorOnly, DeleteResearchToken)
+		r.Get("/research/attempts", counter, withTx, withResearchToken, GetResearchExport)
+
+		// deadline routes
+		r.Post("/deadline_checks", counter, gunzip, bindJSON(Deadline{}), PostDeadlineCheck)
 
 		// commit bundles
-		r.Post("/commit_bundles/unsigned", counter, withTx, withCurrentUser, gunzip, binding.Json(CommitBundle{}), PostCommitBundlesUnsigned)
-		r.Post("/commit_bundles/signed", counter, withTx, withCurrentUser, gunzip, binding.Json(CommitBundle{}), PostCommitBundlesSigned)
+		if standbyMode() {
+			r.Post("/commit_bundles/unsigned", counter, withTx, withCurrentUser, gunzip, bindJSON(CommitBundle{}), PostCommitBundlesStandbyQueue)
+		} else {
+			r.Post("/commit_bundles/unsigned", counter, withTx, withCurrentUser, gunzip, bindJSON(CommitBundle{}), PostCommitBundlesUnsigned)
+		}
+		r.Post("/commit_bundles/signed", counter, withTx, withCurrentUser, gunzip, bindJSON(CommitBundle{}), PostCommitBundlesSigned)
+		r.Post("/commit_bundles/daycare", counter, gunzip, bindJSON(CommitBundle{}), withTx, PostCommitBundlesDaycare)
+		r.Post("/commit_bundles/standby", counter, gunzip, bindJSON(StandbySubmission{}), withTx, PostCommitBundlesStandby)
 	}
 
 	if use_tls {
@@ -527,29 +997,35 @@ func main() {
 		}
 
 		// set up the https server
+		listeners, err := openListeners(tlsAddress)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
 		log.Printf("accepting https connections")
-		server := &http.Server{
-			Addr:    ":https",
-			Handler: m,
-			TLSConfig: &tls.Config{
-				PreferServerCipherSuites: true,
-				MinVersion:               tls.VersionTLS12,
-				GetCertificate:           lem.GetCertificate,
-			},
-			ErrorLog: log.New(&filterWriter{
-				dst: log.Default().Writer(),
-			}, "", log.Lshortfile),
-		}
-		if err := server.ListenAndServeTLS("", ""); err != nil {
-			log.Fatalf("ListenAndServeTLS: %v", err)
+		server := newHTTPServer("", m)
+		server.TLSConfig = &tls.Config{
+			PreferServerCipherSuites: true,
+			MinVersion:               tls.VersionTLS12,
+			GetCertificate:           lem.GetCertificate,
+		}
+		if err := enableHTTP2(server); err != nil {
+			log.Fatalf("configuring HTTP/2: %v", err)
+		}
+		if err := serve(server, listeners, true); err != nil {
+			log.Fatalf("ServeTLS: %v", err)
 		}
 	} else {
 		// run without TLS
 		// note: this will work behind a TLS proxy or for debugging with some calls
 		// but LTI will refuse to connect to an insecure host
-		log.Printf("accepting http connections on %s", nonTLSAddress)
-		if err := http.ListenAndServe(nonTLSAddress, m); err != nil {
-			log.Fatalf("ListenAndServe: %v", err)
+		listeners, err := openListeners(nonTLSAddress)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("accepting http connections")
+		server := newHTTPServer("", m)
+		if err := serve(server, listeners, false); err != nil {
+			log.Fatalf("Serve: %v", err)
 		}
 	}
 }
@@ -565,7 +1041,15 @@ func setupDB(path string) *sql.DB {
 			"&" + "_journal_mode=WAL" +
 			"&" + "_synchronous=FULL" +
 			"&" + "_temp_store=MEMORY"
-	db, err := sql.Open("sqlite3", path+options)
+	if standbyMode() {
+		// a standby only reads from its replica, which something else keeps up to date
+		options =
+			"?" + "mode=ro" +
+				"&" + "_busy_timeout=10000" +
+				"&" + "_cache_size=-20000" +
+				"&" + "_temp_store=MEMORY"
+	}
+	db, err := sql.Open(instrumentedDriverName, path+options)
 	if err != nil {
 		log.Fatalf("error opening database: %v", err)
 	}
@@ -665,6 +1149,9 @@ func unBase64(s string) string {
 type daycares struct {
 	sync.Mutex
 	daycares map[string]*DaycareRegistration
+
+	// when shared, registrations are kept in the database instead of in daycares
+	shared bool
 }
 
 var daycareRegistrations daycares
@@ -673,19 +1160,26 @@ func init() {
 	daycareRegistrations.daycares = make(map[string]*DaycareRegistration)
 }
 
-func (m *daycares) Expire() {
+func (m *daycares) Expire(tx *sql.Tx) error {
 	m.Lock()
 	defer m.Unlock()
 
+	if m.shared {
+		cutoff := time.Now().Add(-2 * daycareRegistrationInterval)
+		_, err := tx.Exec(`DELETE FROM daycare_registrations WHERE time < ?`, cutoff)
+		return err
+	}
+
 	for host, elt := range m.daycares {
 		if time.Since(elt.Time) > 2*daycareRegistrationInterval {
 			log.Printf("daycare registration for %s has expired", host)
 			delete(m.daycares, host)
 		}
 	}
+	return nil
 }
 
-func (m *daycares) Insert(reg *DaycareRegistration) error {
+func (m *daycares) Insert(tx *sql.Tx, reg *DaycareRegistration) error {
 	m.Lock()
 	defer m.Unlock()
 
@@ -705,11 +1199,29 @@ func (m *daycares) Insert(reg *DaycareRegistration) error {
 		return fmt.Errorf("time drift is too great")
 	}
 
+	// only daycares an administrator has vouched for can grade
+	publicKey, err := daycarePublicKey(tx, reg.Hostname)
+	if err != nil {
+		return fmt.Errorf("%v; register it on the TA with: codegrinder daycare-keys add %s %s", err, reg.Hostname, reg.PublicKey)
+	}
+	if publicKey != reg.PublicKey {
+		return fmt.Errorf("daycare %s has key %s, but the key registered for it is %s", reg.Hostname, reg.PublicKey, publicKey)
+	}
+
 	// clean it up a bit
 	sort.Strings(reg.ProblemTypes)
+	sort.Strings(reg.Labels)
 	reg.Time = time.Now()
 	reg.Version = ""
+	reg.PublicKey = ""
 	reg.Signature = ""
+
+	if m.shared {
+		_, err := tx.Exec(`INSERT OR REPLACE INTO daycare_registrations (hostname, problem_types, os, labels, capacity, time) VALUES (?, ?, ?, ?, ?, ?)`,
+			reg.Hostname, string(mustMarshal(reg.ProblemTypes)), reg.OS, string(mustMarshal(reg.Labels)), reg.Capacity, reg.Time)
+		return err
+	}
+
 	if m.daycares[reg.Hostname] == nil {
 		log.Printf("daycare registration for %s added", reg.Hostname)
 	}
@@ -718,43 +1230,70 @@ func (m *daycares) Insert(reg *DaycareRegistration) error {
 	return nil
 }
 
-func (m *daycares) Assign(problemTypes map[string]bool) (string, error) {
+// List returns the current daycare registrations keyed by host name.
+func (m *daycares) List(tx *sql.Tx) (map[string]*DaycareRegistration, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.list(tx)
+}
+
+func (m *daycares) list(tx *sql.Tx) (map[string]*DaycareRegistration, error) {
+	if !m.shared {
+		return m.daycares, nil
+	}
+
+	rows, err := tx.Query(`SELECT hostname, problem_types, os, labels, capacity, time FROM daycare_registrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make(map[string]*DaycareRegistration)
+	for rows.Next() {
+		reg := new(DaycareRegistration)
+		var problemTypes, labels string
+		if err := rows.Scan(&reg.Hostname, &problemTypes, &reg.OS, &labels, &reg.Capacity, &reg.Time); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(problemTypes), &reg.ProblemTypes); err != nil {
+			return nil, fmt.Errorf("decoding problem types for daycare %s: %v", reg.Hostname, err)
+		}
+		if err := json.Unmarshal([]byte(labels), &reg.Labels); err != nil {
+			return nil, fmt.Errorf("decoding labels for daycare %s: %v", reg.Hostname, err)
+		}
+		list[reg.Hostname] = reg
+	}
+	return list, rows.Err()
+}
+
+// Assign picks a daycare host that can run all of the given problem types,
+// choosing randomly among eligible hosts weighted by capacity.
+// If no host is eligible, the error explains which requirement could not be met.
+func (m *daycares) Assign(tx *sql.Tx, problemTypes map[string]*ProblemType) (string, error) {
 	m.Lock()
 	defer m.Unlock()
 
+	daycares, err := m.list(tx)
+	if err != nil {
+		return "", fmt.Errorf("loading daycare registrations: %v", err)
+	}
+
 	// gather the total weights of all of the eligible daycare hosts
 	totalWeight := 0
-	for _, elt := range m.daycares {
-		// does this daycare support all required problem types?
-		supported := true
-		for problemType := range problemTypes {
-			n := sort.SearchStrings(elt.ProblemTypes, problemType)
-			if n >= len(elt.ProblemTypes) || elt.ProblemTypes[n] != problemType {
-				supported = false
-				break
-			}
-		}
-		if supported {
+	for _, elt := range daycares {
+		if elt.canRunAll(problemTypes) {
 			totalWeight += elt.Capacity
 		}
 	}
 	if totalWeight == 0 {
-		return "", fmt.Errorf("no eligible daycare found")
+		return "", noEligibleDaycareError(daycares, problemTypes)
 	}
 
 	// pick a random point in pool of weights
 	point := rand.Intn(totalWeight)
 	skippedWeight := 0
-	for host, elt := range m.daycares {
-		supported := true
-		for problemType := range problemTypes {
-			n := sort.SearchStrings(elt.ProblemTypes, problemType)
-			if n >= len(elt.ProblemTypes) || elt.ProblemTypes[n] != problemType {
-				supported = false
-				break
-			}
-		}
-		if supported {
+	for host, elt := range daycares {
+		if elt.canRunAll(problemTypes) {
 			skippedWeight += elt.Capacity
 		}
 		if point < skippedWeight {
@@ -764,12 +1303,85 @@ func (m *daycares) Assign(problemTypes map[string]bool) (string, error) {
 	return "", fmt.Errorf("failed to find daycare, please report this error")
 }
 
+// noEligibleDaycareError explains why none of the daycares can run the given problem types.
+func noEligibleDaycareError(daycares map[string]*DaycareRegistration, problemTypes map[string]*ProblemType) error {
+	if len(daycares) == 0 {
+		return fmt.Errorf("no daycares are registered")
+	}
+	var names []string
+	for name := range problemTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		problemType := problemTypes[name]
+		supported, matchingOS, labeled := false, false, false
+		for _, elt := range daycares {
+			if elt.supports(name) {
+				supported = true
+				if elt.OS == problemType.OS {
+					matchingOS = true
+				}
+				if elt.canRun(problemType) {
+					labeled = true
+					break
+				}
+			}
+		}
+		if !supported {
+			return fmt.Errorf("no daycare supports problem type %s", name)
+		}
+		if !matchingOS {
+			return fmt.Errorf("no daycare that supports problem type %s runs %s containers", name, problemType.OS)
+		}
+		if !labeled {
+			return fmt.Errorf("no daycare that supports problem type %s has all of the labels it requires: %s",
+				name, strings.Join(problemType.Labels, ", "))
+		}
+	}
+	return fmt.Errorf("no single daycare can run all of the problem types %s", strings.Join(names, ", "))
+}
+
+// supports reports whether the daycare advertises the named problem type.
+func (reg *DaycareRegistration) supports(problemType string) bool {
+	n := sort.SearchStrings(reg.ProblemTypes, problemType)
+	return n < len(reg.ProblemTypes) && reg.ProblemTypes[n] == problemType
+}
+
+// canRun reports whether the daycare supports the problem type,
+// runs containers for its OS, and has every label the problem type requires.
+func (reg *DaycareRegistration) canRun(problemType *ProblemType) bool {
+	if !reg.supports(problemType.Name) || reg.OS != problemType.OS {
+		return false
+	}
+	for _, label := range problemType.Labels {
+		n := sort.SearchStrings(reg.Labels, label)
+		if n >= len(reg.Labels) || reg.Labels[n] != label {
+			return false
+		}
+	}
+	return true
+}
+
+func (reg *DaycareRegistration) canRunAll(problemTypes map[string]*ProblemType) bool {
+	for _, problemType := range problemTypes {
+		if !reg.canRun(problemType) {
+			return false
+		}
+	}
+	return true
+}
+
 type DaycareRegistration struct {
 	Hostname     string    `json:"hostname"`
 	ProblemTypes []string  `json:"problemTypes"`
+	OS           string    `json:"os"`
+	Labels       []string  `json:"labels,omitempty"`
 	Capacity     int       `json:"capacity"`
 	Time         time.Time `json:"time"`
 	Version      string    `json:"version,omitempty"`
+	PublicKey    string    `json:"publicKey,omitempty"`
 	Signature    string    `json:"signature,omitempty"`
 }
 
@@ -782,9 +1394,16 @@ func (reg *DaycareRegistration) ComputeSignature(secret string) string {
 	for n, elt := range reg.ProblemTypes {
 		v.Add(fmt.Sprintf("problemType-%d", n), elt)
 	}
+	v.Add("os", reg.OS)
+	labels := append([]string(nil), reg.Labels...)
+	sort.Strings(labels)
+	for n, elt := range labels {
+		v.Add(fmt.Sprintf("label-%d", n), elt)
+	}
 	v.Add("capacity", strconv.Itoa(reg.Capacity))
 	v.Add("time", reg.Time.Round(time.Second).UTC().Format(time.RFC3339))
 	v.Add("version", reg.Version)
+	v.Add("public_key", reg.PublicKey)
 
 	// compute signature
 	mac := hmac.New(sha256.New, []byte(secret))
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+)
+
+// GradingSession is a grading job running on a daycare.
+// The daycare fills in the job details, and the TA adds the student's name.
+type GradingSession struct {
+	Hostname       string    `json:"hostname"`
+	ContainerID    string    `json:"containerID"`
+	Name           string    `json:"name"`
+	UserID         int64     `json:"userID"`
+	UserName       string    `json:"userName,omitempty"`
+	Email          string    `json:"email,omitempty"`
+	AssignmentID   int64     `json:"assignmentID"`
+	ProblemID      int64     `json:"problemID"`
+	Unique         string    `json:"unique"`
+	Step           int64     `json:"step"`
+	ProblemType    string    `json:"problemType"`
+	Action         string    `json:"action"`
+	StartedAt      time.Time `json:"startedAt"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+
+	nanny *Nanny
+}
+
+// sessionSet is the set of grading jobs running on this daycare, keyed by nanny name.
+type sessionSet struct {
+	sync.Mutex
+	sessions map[string]*GradingSession
+}
+
+var activeSessions = sessionSet{sessions: make(map[string]*GradingSession)}
+
+func (s *sessionSet) add(session *GradingSession) {
+	s.Lock()
+	defer s.Unlock()
+	s.sessions[session.Name] = session
+}
+
+func (s *sessionSet) remove(session *GradingSession) {
+	s.Lock()
+	defer s.Unlock()
+	if s.sessions[session.Name] == session {
+		delete(s.sessions, session.Name)
+	}
+}
+
+// setNanny records the container a session is using, which changes
+// when a job starts over after a container engine restart.
+func (s *sessionSet) setNanny(session *GradingSession, n *Nanny) {
+	s.Lock()
+	defer s.Unlock()
+	session.nanny = n
+	session.ContainerID = n.ID
+}
+
+// current returns the container a session is using right now.
+func (s *sessionSet) current(session *GradingSession) *Nanny {
+	s.Lock()
+	defer s.Unlock()
+	return session.nanny
+}
+
+// list returns a copy of every session, oldest first.
+func (s *sessionSet) list(now time.Time) []*GradingSession {
+	s.Lock()
+	defer s.Unlock()
+	list := []*GradingSession{}
+	for _, session := range s.sessions {
+		elt := *session
+		elt.nanny = nil
+		elt.ElapsedSeconds = now.Sub(elt.StartedAt).Seconds()
+		list = append(list, &elt)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// kill stops the session using the given container.
+func (s *sessionSet) kill(containerID string) error {
+	s.Lock()
+	var found *GradingSession
+	for _, session := range s.sessions {
+		if session.ContainerID == containerID {
+			found = session
+		}
+	}
+	s.Unlock()
+	if found == nil {
+		return fmt.Errorf("no grading session is using container %s", containerID)
+	}
+	return s.stop(found, "stopped by an administrator")
+}
+
+// stop kills the container a session is currently using.
+func (s *sessionSet) stop(session *GradingSession, msg string) error {
+	s.Lock()
+	n := session.nanny
+	s.Unlock()
+	if n == nil {
+		return fmt.Errorf("grading session %s has no container", session.Name)
+	}
+	return n.Kill(msg)
+}
+
+// SessionRequest is sent by the TA to a daycare to list its grading sessions
+// or to kill one of them.
+type SessionRequest struct {
+	Hostname    string    `json:"hostname"`
+	ContainerID string    `json:"containerID,omitempty"`
+	Time        time.Time `json:"time"`
+	Signature   string    `json:"signature,omitempty"`
+}
+
+func (req *SessionRequest) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", req.Hostname)
+	v.Add("container_id", req.ContainerID)
+	v.Add("time", req.Time.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// PostDaycareSessions handles requests to /daycare_sessions on a daycare,
+// returning the grading sessions running on this host. If the request names
+// a container, that session is killed first.
+func PostDaycareSessions(w http.ResponseWriter, req SessionRequest) {
+	sig := req.ComputeSignature(Config.DaycareSecret)
+	if sig != req.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "session request signature mismatch: computed %s but found %s", sig, req.Signature)
+		return
+	}
+	if req.Hostname != Config.Hostname {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "session request is signed for host %s, this is %s", req.Hostname, Config.Hostname)
+		return
+	}
+	drift := time.Since(req.Time)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "session request is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+
+	if req.ContainerID != "" {
+		if err := activeSessions.kill(req.ContainerID); err != nil {
+			loggedHTTPErrorf(w, http.StatusNotFound, "%v", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(activeSessions.list(time.Now())); err != nil {
+		log.Printf("error encoding grading sessions: %v", err)
+	}
+}
+
+// requestDaycareSessions asks a daycare for its grading sessions,
+// killing the one using the given container first (if any).
+func requestDaycareSessions(hostname, containerID string) ([]*GradingSession, error) {
+	req := &SessionRequest{
+		Hostname:    hostname,
+		ContainerID: containerID,
+		Time:        time.Now(),
+	}
+	req.Signature = req.ComputeSignature(Config.DaycareSecret)
+
+	sessions := []*GradingSession{}
+	if err := postToHost(hostname, "/daycare_sessions", req, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// addSessionUsers fills in the names of the students in a list of sessions.
+func addSessionUsers(tx *sql.Tx, sessions []*GradingSession) error {
+	for _, session := range sessions {
+		if err := tx.QueryRow(`SELECT name, email FROM users WHERE id = ?`, session.UserID).
+			Scan(&session.UserName, &session.Email); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGradingSessions handles requests to /grading_sessions,
+// returning the grading jobs running right now on every registered daycare, oldest first.
+// Daycares that cannot be reached are logged and left out.
+func GetGradingSessions(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	if err := daycareRegistrations.Expire(tx); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	daycares, err := daycareRegistrations.List(tx)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// ask all of the daycares at once
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sessions := []*GradingSession{}
+	for hostname := range daycares {
+		wg.Add(1)
+		go func(hostname string) {
+			defer wg.Done()
+			list, err := requestDaycareSessions(hostname, "")
+			if err != nil {
+				log.Printf("error getting grading sessions from %s: %v", hostname, err)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			sessions = append(sessions, list...)
+		}(hostname)
+	}
+	wg.Wait()
+
+	if err := addSessionUsers(tx, sessions); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.Before(sessions[j].StartedAt) })
+	render.JSON(http.StatusOK, sessions)
+}
+
+// DeleteGradingSession handles requests to /grading_sessions/:hostname/:container_id,
+// killing a stuck grading job and returning the sessions still running on that daycare.
+func DeleteGradingSession(w http.ResponseWriter, tx *sql.Tx, currentUser *User, params martini.Params, render render.Render) {
+	hostname, containerID := params["hostname"], params["container_id"]
+
+	// only talk to daycares we know about
+	daycares, err := daycareRegistrations.List(tx)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if daycares[hostname] == nil {
+		loggedHTTPErrorf(w, http.StatusNotFound, "no daycare named %s is registered", hostname)
+		return
+	}
+
+	sessions, err := requestDaycareSessions(hostname, containerID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadGateway, "killing grading session on %s: %v", hostname, err)
+		return
+	}
+	log.Printf("user %d (%s) killed grading session in container %s on %s", currentUser.ID, currentUser.Email, containerID, hostname)
+
+	if err := addSessionUsers(tx, sessions); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, sessions)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/securecookie"
@@ -13,8 +15,14 @@ type CookieSession struct {
 	ExpiresAt time.Time
 	UserID    int64
 	path      string
+
+	// fromHeader is set when the session came from the Authorization header instead of a cookie
+	fromHeader bool
 }
 
+// authorizationScheme marks a session given in the Authorization header.
+const authorizationScheme = "CodeGrinder "
+
 func NewSession(id int64) *CookieSession {
 	now := time.Now()
 	expires := now
@@ -39,21 +47,34 @@ func NewSession(id int64) *CookieSession {
 	}
 }
 
+// errSessionForged is returned by GetSession when the session value was not signed by this server.
+var errSessionForged = errors.New("unable to decode session cookie")
+
 func GetSession(r *http.Request) (*CookieSession, error) {
 	now := time.Now()
 
-	cookie, err := r.Cookie(CookieName)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read session cookie")
+	// grind sends the session in the Authorization header, browsers in a cookie
+	var value string
+	fromHeader := false
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, authorizationScheme) {
+		value = strings.TrimPrefix(header, authorizationScheme)
+		fromHeader = true
+	} else {
+		cookie, err := r.Cookie(CookieName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read session cookie")
+		}
+		value = cookie.Value
 	}
 
 	// decode and verify signature
 	session := new(CookieSession)
 	secure := securecookie.New([]byte(Config.SessionSecret), nil)
 	secure.MaxAge(0)
-	if err = secure.Decode(CookieName, cookie.Value, session); err != nil {
-		return nil, fmt.Errorf("unable to decode session cookie")
+	if err := secure.Decode(CookieName, value, session); err != nil {
+		return nil, errSessionForged
 	}
+	session.fromHeader = fromHeader
 
 	// check expiration
 	if session.ExpiresAt.Before(now) {
@@ -79,26 +100,41 @@ func (session *CookieSession) Save(w http.ResponseWriter) string {
 	}
 
 	cookie := &http.Cookie{
-		Name:    CookieName,
-		Value:   encoded,
-		Path:    session.path,
-		Expires: session.ExpiresAt,
-		MaxAge:  int(time.Until(session.ExpiresAt).Seconds()),
-		Secure:  true,
+		Name:     CookieName,
+		Value:    encoded,
+		Path:     session.path,
+		Expires:  session.ExpiresAt,
+		MaxAge:   int(time.Until(session.ExpiresAt).Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: cookieSameSite(),
 	}
 	http.SetCookie(w, cookie)
+
+	// scripts on our pages read this to send the CSRF token back
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken(session),
+		Path:     session.path,
+		Expires:  session.ExpiresAt,
+		MaxAge:   int(time.Until(session.ExpiresAt).Seconds()),
+		Secure:   true,
+		SameSite: cookieSameSite(),
+	})
 	return fmt.Sprintf("%s=%s", CookieName, encoded)
 }
 
 func (session *CookieSession) Delete(w http.ResponseWriter) {
 	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 	cookie := &http.Cookie{
-		Name:    CookieName,
-		Value:   "deleted",
-		Path:    session.path,
-		Expires: epoch,
-		MaxAge:  -1,
-		Secure:  true,
+		Name:     CookieName,
+		Value:    "deleted",
+		Path:     session.path,
+		Expires:  epoch,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: cookieSameSite(),
 	}
 	http.SetCookie(w, cookie)
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/martini-contrib/render"
+	"github.com/russross/codegrinder/sdk"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// ShadowGrade records the result of grading a commit with a candidate grader image
+// alongside the result the student received from the current image.
+// Shadow results are for administrators only and never affect student scores.
+type ShadowGrade struct {
+	ID               int64       `json:"id" meddler:"id,pk"`
+	Hostname         string      `json:"hostname" meddler:"hostname"`
+	CommitID         int64       `json:"commitID" meddler:"commit_id"`
+	AssignmentID     int64       `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID        int64       `json:"problemID" meddler:"problem_id"`
+	Step             int64       `json:"step" meddler:"step"`
+	ProblemType      string      `json:"problemType" meddler:"problem_type"`
+	Image            string      `json:"image" meddler:"image"`
+	ShadowImage      string      `json:"shadowImage" meddler:"shadow_image"`
+	ReportCard       *ReportCard `json:"reportCard" meddler:"report_card,json"`
+	Score            float64     `json:"score" meddler:"score"`
+	ShadowReportCard *ReportCard `json:"shadowReportCard" meddler:"shadow_report_card,json"`
+	ShadowScore      float64     `json:"shadowScore" meddler:"shadow_score"`
+	CreatedAt        time.Time   `json:"createdAt" meddler:"created_at,localtime"`
+	Signature        string      `json:"signature,omitempty" meddler:"-"`
+}
+
+func (shadow *ShadowGrade) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", shadow.Hostname)
+	v.Add("commit_id", strconv.FormatInt(shadow.CommitID, 10))
+	v.Add("assignment_id", strconv.FormatInt(shadow.AssignmentID, 10))
+	v.Add("problem_id", strconv.FormatInt(shadow.ProblemID, 10))
+	v.Add("step", strconv.FormatInt(shadow.Step, 10))
+	v.Add("problem_type", shadow.ProblemType)
+	v.Add("image", shadow.Image)
+	v.Add("shadow_image", shadow.ShadowImage)
+	if raw, err := json.Marshal(shadow.ReportCard); err == nil {
+		v.Add("report_card", string(raw))
+	}
+	v.Add("score", strconv.FormatFloat(shadow.Score, 'g', -1, 64))
+	if raw, err := json.Marshal(shadow.ShadowReportCard); err == nil {
+		v.Add("shadow_report_card", string(raw))
+	}
+	v.Add("shadow_score", strconv.FormatFloat(shadow.ShadowScore, 'g', -1, 64))
+	v.Add("created_at", shadow.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// shadowGrade runs the grade action for a commit that has already been graded,
+// this time using a candidate image, and reports both results to the TA.
+// It runs on the daycare after the student has received the real result.
+func shadowGrade(bundle *CommitBundle, image string, files, submitted map[string][]byte, secrets map[string]string, action *ProblemTypeAction, args []string, limits *limits) {
+	commit := bundle.Commit
+
+	// shadow containers count against the daycare capacity like any other
+	slot, release := jobQueue.acquire(bundle.ProblemType.Name, false, nil)
+	defer release()
+
+	problemType := *bundle.ProblemType
+	problemType.Image = image
+	nannyName := fmt.Sprintf("shadow-%d", bundle.UserID)
+	n, err := NewNanny(&problemType, bundle.Problem, action.Action, args, limits.inSlot(slot), nannyName)
+	if err != nil {
+		log.Printf("error creating shadow container: %v", err)
+		return
+	}
+	n.Secrets = secrets
+	n.Redactions = newRedactions(secrets, n.home(), nil, nil)
+	defer func() {
+		if err := n.Shutdown("shadow grading finished"); err != nil {
+			log.Printf("shadow nanny shutdown error: %v", err)
+		}
+	}()
+
+	// nobody is listening, so discard the events
+	eventListenerClosed := make(chan struct{})
+	go func() {
+		for range n.Events {
+		}
+		eventListenerClosed <- struct{}{}
+	}()
+
+	if checkBannedUses(n, bundle.Problem, submitted) {
+		// nothing to run
+	} else if err := n.PutFiles(files, 0666); err != nil {
+		n.ReportCard.LogAndFailf("uploading files: %v", err)
+	} else if checkRequirements(n, bundle.Problem, submitted) {
+		// nothing to run
+	} else {
+		runAction(n, action)
+	}
+	close(n.Events)
+	<-eventListenerClosed
+
+	shadow := &ShadowGrade{
+		Hostname:         Config.Hostname,
+		CommitID:         commit.ID,
+		AssignmentID:     commit.AssignmentID,
+		ProblemID:        commit.ProblemID,
+		Step:             commit.Step,
+		ProblemType:      bundle.ProblemType.Name,
+		Image:            bundle.ProblemType.Image,
+		ShadowImage:      image,
+		ReportCard:       commit.ReportCard,
+		Score:            commit.Score,
+		ShadowReportCard: n.ReportCard,
+		ShadowScore:      sdk.Score(n.ReportCard, bundle.ProblemSteps[commit.Step-1].Tests),
+		CreatedAt:        time.Now(),
+	}
+	shadow.Signature = shadow.ComputeSignature(Config.DaycareSecret)
+
+	if err := postToTA("/shadow_grades", shadow, nil); err != nil {
+		log.Printf("error posting shadow grade: %v", err)
+	}
+}
+
+// postToTA sends a JSON-encoded request from the daycare to the TA.
+// If result is not nil, the JSON response is decoded into it.
+func postToTA(path string, elt, result interface{}) error {
+	return postToHost(Config.TAHostname, path, elt, result)
+}
+
+// postToHost sends an object as JSON to another node and decodes the response into result (if not nil).
+func postToHost(hostname, path string, elt, result interface{}) error {
+	return postToHostTimeout(hostname, path, elt, result, 30*time.Second)
+}
+
+// postToHostTimeout is postToHost for requests that may take longer to answer.
+func postToHostTimeout(hostname, path string, elt, result interface{}, timeout time.Duration) error {
+	raw, err := json.Marshal(elt)
+	if err != nil {
+		return fmt.Errorf("json encoding error: %v", err)
+	}
+	url := fmt.Sprintf("https://%s%s", hostname, path)
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Post(url, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status from %s: %v %s", url, res.Status, body)
+	}
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			return fmt.Errorf("decoding response from %s: %v", url, err)
+		}
+	}
+	return nil
+}
+
+// PostShadowGrade handles requests to /shadow_grades,
+// recording a shadow grading result reported by a daycare.
+func PostShadowGrade(w http.ResponseWriter, tx *sql.Tx, shadow ShadowGrade) {
+	sig := shadow.ComputeSignature(Config.DaycareSecret)
+	if sig != shadow.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "shadow grade signature mismatch: computed %s but found %s", sig, shadow.Signature)
+		return
+	}
+	drift := time.Since(shadow.CreatedAt)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "shadow grade is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+
+	shadow.ID = 0
+	shadow.CreatedAt = time.Now()
+	if err := meddler.Insert(tx, "shadow_grades", &shadow); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// ShadowDriftReport summarizes how the results from a candidate image
+// differ from the results of the current image for one problem type.
+type ShadowDriftReport struct {
+	ProblemType  string         `json:"problemType"`
+	ShadowImage  string         `json:"shadowImage"`
+	Total        int            `json:"total"`
+	Agree        int            `json:"agree"`
+	Regressions  int            `json:"regressions"`
+	Improvements int            `json:"improvements"`
+	ScoreChanges int            `json:"scoreChanges"`
+	Differences  []*ShadowGrade `json:"differences"`
+}
+
+// GetShadowGradeDrift handles requests to /shadow_grades/drift,
+// comparing shadow results against the real results.
+// A regression is a commit that passed with the current image but not with the candidate.
+//
+// Parameters problem_type and shadow_image can be used to restrict the report.
+func GetShadowGradeDrift(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where, args := "", []interface{}{}
+	if name := r.FormValue("problem_type"); name != "" {
+		where, args = addWhereEq(where, args, "problem_type", name)
+	}
+	if image := r.FormValue("shadow_image"); image != "" {
+		where, args = addWhereEq(where, args, "shadow_image", image)
+	}
+
+	shadows := []*ShadowGrade{}
+	if err := meddler.QueryAll(tx, &shadows, `SELECT * FROM shadow_grades`+where+` ORDER BY problem_type, shadow_image, id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	reports := []*ShadowDriftReport{}
+	var report *ShadowDriftReport
+	for _, shadow := range shadows {
+		if report == nil || report.ProblemType != shadow.ProblemType || report.ShadowImage != shadow.ShadowImage {
+			report = &ShadowDriftReport{
+				ProblemType: shadow.ProblemType,
+				ShadowImage: shadow.ShadowImage,
+				Differences: []*ShadowGrade{},
+			}
+			reports = append(reports, report)
+		}
+		report.Total++
+
+		passed := shadow.ReportCard != nil && shadow.ReportCard.Passed
+		shadowPassed := shadow.ShadowReportCard != nil && shadow.ShadowReportCard.Passed
+		switch {
+		case passed && !shadowPassed:
+			report.Regressions++
+		case !passed && shadowPassed:
+			report.Improvements++
+		case shadow.Score != shadow.ShadowScore:
+			report.ScoreChanges++
+		default:
+			report.Agree++
+			continue
+		}
+		report.Differences = append(report.Differences, shadow)
+	}
+
+	render.JSON(http.StatusOK, reports)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// shellTimeLimit is how long an instructor's shell in a grading container can stay open.
+const shellTimeLimit = 20 * time.Minute
+
+// shellAction is the interactive action that opens a shell in a grading container.
+// It is never stored with a problem type; the TA adds it to the signed copy of the
+// problem type it hands to an instructor, so students cannot ask for it.
+// It keeps the limits of the grade action except for the time limit.
+func shellAction(problemType *ProblemType) *ProblemTypeAction {
+	action := &ProblemTypeAction{
+		MaxFD:       100,
+		MaxFileSize: 10,
+		MaxMemory:   512,
+		MaxThreads:  100,
+	}
+	if grade := problemType.Actions["grade"]; grade != nil {
+		*action = *grade
+	}
+	action.ProblemType = problemType.Name
+	action.Action = "shell"
+	action.Command = "/bin/sh -i"
+	if problemType.OS == "windows" {
+		action.Command = "cmd.exe"
+	}
+	action.Parser = ""
+	action.Message = "Opening a shell‥"
+	action.Interactive = true
+	action.MaxCPU = int64(shellTimeLimit.Seconds()) / 2
+	action.MaxSession = int64(shellTimeLimit.Seconds())
+	action.MaxTimeout = int64(shellTimeLimit.Seconds())
+	return action
+}
+
+// PostCommitShell handles requests to /commits/:commit_id/shell,
+// returning a signed commit bundle and socket ticket that open an interactive shell
+// in a grading container holding the commit's files and the step's test harness.
+// Only administrators and instructors for the course can open one.
+// The container has no network and is stopped after shellTimeLimit.
+func PostCommitShell(w http.ResponseWriter, tx *sql.Tx, currentUser *User, params martini.Params, render render.Render) {
+	now := time.Now()
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return
+	}
+	commit := new(Commit)
+	if err := meddler.Load(tx, "commits", commit, commitID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := loadCommitBlobs(commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, commit.AssignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, assignment.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, assignment.CourseID)
+			return
+		}
+	}
+
+	// gather the problem, the step with its test files, and the problem type
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, commit.ProblemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	var stepCount int64
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM problem_steps WHERE problem_id = ?`, commit.ProblemID).Scan(&stepCount); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if commit.Step < 1 || commit.Step > stepCount {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "commit has step number %d, but there are %d steps in the problem", commit.Step, stepCount)
+		return
+	}
+	steps := make([]*ProblemStep, stepCount)
+	step := new(ProblemStep)
+	if err := meddler.QueryRow(tx, step, `SELECT * FROM problem_steps WHERE problem_id = ? AND step = ?`, commit.ProblemID, commit.Step); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadStepFiles(step); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	step.Solution = nil
+	steps[commit.Step-1] = step
+	problemType, err := getProblemType(tx, step.ProblemType)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error loading problem type: %v", err)
+		return
+	}
+	if problemType.Actions == nil {
+		problemType.Actions = make(map[string]*ProblemTypeAction)
+	}
+	problemType.Actions["shell"] = shellAction(problemType)
+
+	host, err := daycareRegistrations.Assign(tx, map[string]*ProblemType{problemType.Name: problemType})
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusServiceUnavailable, "unable to open a shell for problem type %s: %v", problemType.Name, err)
+		return
+	}
+
+	// the container is named for the instructor, so it does not replace one the student is using
+	commit.Action = "shell"
+	commit.Note = fmt.Sprintf("shell opened by user %d", currentUser.ID)
+	commit.ReportCard = nil
+	commit.Transcript = []*EventMessage{}
+	commit.UpdatedAt = now
+	typeSig := problemType.ComputeSignature(Config.DaycareSecret)
+	problemSig := problem.ComputeSignature(Config.DaycareSecret, steps)
+	bundle := &CommitBundle{
+		ProblemType:          problemType,
+		ProblemTypeSignature: typeSig,
+		Problem:              problem,
+		ProblemSteps:         steps,
+		ProblemSignature:     problemSig,
+		Hostname:             host,
+		UserID:               currentUser.ID,
+		Commit:               commit,
+		CommitSignature:      commit.ComputeSignature(Config.DaycareSecret, typeSig, problemSig, host, currentUser.ID),
+	}
+	if bundle.Ticket, err = issueSocketTicket(bundle, now.Add(socketTicketLifetime)); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error issuing socket ticket: %v", err)
+		return
+	}
+
+	log.Printf("user %d (%s) is opening a shell for commit %d (assignment %d, %s step %d) on %s",
+		currentUser.ID, currentUser.Email, commit.ID, commit.AssignmentID, problem.Unique, commit.Step, host)
+	render.JSON(http.StatusOK, bundle)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// maxShowcaseLabel is the longest label accepted for a showcase entry, in bytes.
+const maxShowcaseLabel = 100
+
+// ShowcaseConsent records that a student agreed to let their solution to a
+// problem be shown to the class without their name.
+type ShowcaseConsent struct {
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// ShowcaseEntry is a student solution that an instructor published to the class.
+// The files are the ones students edit in the step, and nothing identifies the author.
+type ShowcaseEntry struct {
+	ID          int64             `json:"id" meddler:"id,pk"`
+	CourseID    int64             `json:"courseID" meddler:"course_id"`
+	ProblemID   int64             `json:"problemID" meddler:"problem_id"`
+	CommitID    int64             `json:"commitID,omitempty" meddler:"commit_id"` // only shown to instructors
+	Label       string            `json:"label" meddler:"label"`
+	PublishedBy int64             `json:"-" meddler:"published_by"`
+	CreatedAt   time.Time         `json:"createdAt" meddler:"created_at,localtime"`
+	Step        int64             `json:"step" meddler:"-"`
+	Files       map[string][]byte `json:"files,omitempty" meddler:"-"`
+}
+
+// ShowcaseCandidate is a consenting student's latest graded attempt at a problem,
+// for an instructor deciding what to publish.
+type ShowcaseCandidate struct {
+	AssignmentID int64   `json:"assignmentID"`
+	UserID       int64   `json:"userID"`
+	UserName     string  `json:"userName"`
+	CommitID     int64   `json:"commitID"`
+	Step         int64   `json:"step"`
+	Score        float64 `json:"score"`
+	Published    bool    `json:"published"`
+}
+
+// showcaseOpen reports whether the deadline for an assignment has passed,
+// so its solutions can be shown to the class.
+// Assignments without a due date never open.
+func showcaseOpen(tx *sql.Tx, assignment *Assignment, now time.Time) (bool, error) {
+	if assignment.DueAt == nil {
+		return false, nil
+	}
+	grace, err := deadlineGrace(tx, assignment)
+	if err != nil {
+		return false, err
+	}
+	if now.Before(assignment.DueAt.Add(grace)) {
+		return false, nil
+	}
+	lockAt, err := assignmentLockAt(tx, assignment)
+	if err != nil {
+		return false, err
+	}
+	return lockAt == nil || now.After(lockAt.Add(grace)), nil
+}
+
+// loadStudentAssignmentProblem loads one of the current user's assignments and
+// checks that the problem is part of it.
+func loadStudentAssignmentProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) (*Assignment, int64, bool) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return nil, 0, false
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return nil, 0, false
+	}
+	assignment := new(Assignment)
+	if err := meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE id = ? AND user_id = ?`, assignmentID, currentUser.ID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, 0, false
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM problem_set_problems WHERE problem_set_id = ? AND problem_id = ?`,
+		assignment.ProblemSetID, problemID).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return nil, 0, false
+	}
+	if count == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+		return nil, 0, false
+	}
+	return assignment, problemID, true
+}
+
+// GetAssignmentProblemShowcaseConsent handles requests to /assignments/:assignment_id/problems/:problem_id/showcase_consent,
+// returning the consent if the student has given it.
+func GetAssignmentProblemShowcaseConsent(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment, problemID, ok := loadStudentAssignmentProblem(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	consent := new(ShowcaseConsent)
+	if err := meddler.QueryRow(tx, consent, `SELECT * FROM showcase_consents WHERE assignment_id = ? AND problem_id = ?`, assignment.ID, problemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, consent)
+}
+
+// PutAssignmentProblemShowcaseConsent handles requests to /assignments/:assignment_id/problems/:problem_id/showcase_consent,
+// letting the instructor show the student's solution to the class without their name.
+func PutAssignmentProblemShowcaseConsent(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignment, problemID, ok := loadStudentAssignmentProblem(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	consent := new(ShowcaseConsent)
+	if err := meddler.QueryRow(tx, consent, `SELECT * FROM showcase_consents WHERE assignment_id = ? AND problem_id = ?`, assignment.ID, problemID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		consent = &ShowcaseConsent{
+			AssignmentID: assignment.ID,
+			ProblemID:    problemID,
+			CreatedAt:    time.Now(),
+		}
+		if err := meddler.Insert(tx, "showcase_consents", consent); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	render.JSON(http.StatusOK, consent)
+}
+
+// DeleteAssignmentProblemShowcaseConsent handles requests to /assignments/:assignment_id/problems/:problem_id/showcase_consent,
+// withdrawing consent. Anything already published from this student is hidden again.
+func DeleteAssignmentProblemShowcaseConsent(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	assignment, problemID, ok := loadStudentAssignmentProblem(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM showcase_consents WHERE assignment_id = ? AND problem_id = ?`, assignment.ID, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM showcase_entries WHERE problem_id = ? AND commit_id IN (SELECT id FROM commits WHERE assignment_id = ?)`,
+		problemID, assignment.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// GetCourseShowcaseCandidates handles requests to /courses/:course_id/showcase_candidates,
+// listing the latest graded attempt at a problem from each student who agreed to share it.
+//
+// Parameter problem_id=<...> is required.
+func GetCourseShowcaseCandidates(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	problemID, err := strconv.ParseInt(r.FormValue("problem_id"), 10, 64)
+	if err != nil || problemID < 1 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem_id is required")
+		return
+	}
+
+	rows, err := tx.Query(`SELECT assignments.id, users.id, users.name, commits.id, commits.step, COALESCE(commits.score, 0), `+
+		`EXISTS (SELECT 1 FROM showcase_entries WHERE showcase_entries.commit_id = commits.id) `+
+		`FROM showcase_consents `+
+		`JOIN assignments ON showcase_consents.assignment_id = assignments.id `+
+		`JOIN users ON assignments.user_id = users.id `+
+		`JOIN commits ON commits.id = (SELECT id FROM commits WHERE commits.assignment_id = assignments.id AND commits.problem_id = showcase_consents.problem_id `+
+		`AND commits.action = 'grade' AND NOT commits.practice AND commits.report_card IS NOT NULL `+
+		`ORDER BY commits.step DESC, commits.created_at DESC LIMIT 1) `+
+		`WHERE assignments.course_id = ? AND showcase_consents.problem_id = ? AND NOT assignments.instructor `+
+		`ORDER BY COALESCE(commits.score, 0) DESC, users.name`, courseID, problemID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	candidates := []*ShowcaseCandidate{}
+	for rows.Next() {
+		elt := new(ShowcaseCandidate)
+		if err := rows.Scan(&elt.AssignmentID, &elt.UserID, &elt.UserName, &elt.CommitID, &elt.Step, &elt.Score, &elt.Published); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		candidates = append(candidates, elt)
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, candidates)
+}
+
+// PostCourseShowcase handles requests to /courses/:course_id/showcase,
+// publishing a student's commit to the class.
+// The student must have agreed to share their solution to the problem,
+// and the deadline for their assignment must have passed.
+func PostCourseShowcase(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, entry ShowcaseEntry, render render.Render) {
+	courseID, ok := loadInstructorCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	commit := new(Commit)
+	if err := meddler.Load(tx, "commits", commit, entry.CommitID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, commit.AssignmentID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if assignment.CourseID != courseID {
+		loggedHTTPErrorf(w, http.StatusNotFound, "commit %d is not part of course %d", commit.ID, courseID)
+		return
+	}
+	var consented int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM showcase_consents WHERE assignment_id = ? AND problem_id = ?`,
+		assignment.ID, commit.ProblemID).Scan(&consented); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if consented == 0 {
+		loggedHTTPErrorf(w, http.StatusForbidden, "the student has not agreed to share this solution")
+		return
+	}
+	now := time.Now()
+	open, err := showcaseOpen(tx, assignment, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if !open {
+		loggedHTTPErrorf(w, http.StatusForbidden, "solutions can only be shown after the assignment deadline has passed")
+		return
+	}
+
+	entry.Label = strings.TrimSpace(entry.Label)
+	if len(entry.Label) > maxShowcaseLabel {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "label must be at most %d bytes", maxShowcaseLabel)
+		return
+	}
+	if entry.Label == "" {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM showcase_entries WHERE course_id = ? AND problem_id = ?`,
+			courseID, commit.ProblemID).Scan(&count); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		entry.Label = fmt.Sprintf("Solution %d", count+1)
+	}
+
+	existing := new(ShowcaseEntry)
+	if err := meddler.QueryRow(tx, existing, `SELECT * FROM showcase_entries WHERE commit_id = ?`, commit.ID); err == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "commit %d is already published as showcase entry %d", commit.ID, existing.ID)
+		return
+	} else if err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	published := &ShowcaseEntry{
+		CourseID:    courseID,
+		ProblemID:   commit.ProblemID,
+		CommitID:    commit.ID,
+		Label:       entry.Label,
+		PublishedBy: currentUser.ID,
+		CreatedAt:   now,
+	}
+	if err := meddler.Insert(tx, "showcase_entries", published); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) published commit %d to the showcase for course %d", currentUser.ID, currentUser.Email, commit.ID, courseID)
+	published.Step = commit.Step
+	render.JSON(http.StatusOK, published)
+}
+
+// GetCourseShowcase handles requests to /courses/:course_id/showcase,
+// returning the solutions published to the class.
+// Anyone with an assignment in the course can see them, without the names of the authors.
+//
+// If parameter problem_id=<...> present, results will be filtered by matching problem.
+func GetCourseShowcase(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	instructor := currentUser.Admin
+	if !instructor {
+		if instructor, err = isCourseInstructor(tx, courseID, currentUser.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	if !instructor {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM assignments WHERE course_id = ? AND user_id = ?`, courseID, currentUser.ID).Scan(&count); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if count == 0 {
+			loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+
+	// entries are only shown while the student still consents
+	where := ` WHERE showcase_entries.course_id = ?`
+	args := []interface{}{courseID}
+	if s := r.FormValue("problem_id"); s != "" {
+		problemID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_id: %v", err)
+			return
+		}
+		where += ` AND showcase_entries.problem_id = ?`
+		args = append(args, problemID)
+	}
+	entries := []*ShowcaseEntry{}
+	if err := meddler.QueryAll(tx, &entries, `SELECT showcase_entries.* FROM showcase_entries `+
+		`JOIN commits ON showcase_entries.commit_id = commits.id `+
+		`JOIN showcase_consents ON showcase_consents.assignment_id = commits.assignment_id AND showcase_consents.problem_id = commits.problem_id`+
+		where+` ORDER BY showcase_entries.problem_id, showcase_entries.created_at, showcase_entries.id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		commit := new(Commit)
+		if err := meddler.Load(tx, "commits", commit, entry.CommitID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := loadCommitBlobs(commit); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error loading commit files: %v", err)
+			return
+		}
+		step := new(ProblemStep)
+		if err := meddler.QueryRow(tx, step, `SELECT * FROM problem_steps WHERE problem_id = ? AND step = ?`, commit.ProblemID, commit.Step); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+
+		// only the files students write, so tests and fixtures stay private
+		entry.Step = commit.Step
+		entry.Files = make(map[string][]byte)
+		for name, contents := range commit.Files {
+			if step.Whitelist[name] {
+				entry.Files[name] = contents
+			}
+		}
+		if !instructor {
+			entry.CommitID = 0
+		}
+	}
+	render.JSON(http.StatusOK, entries)
+}
+
+// DeleteShowcaseEntry handles requests to /showcase/:showcase_id,
+// taking a solution out of the showcase.
+func DeleteShowcaseEntry(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	entryID, err := parseID(w, "showcase_id", params["showcase_id"])
+	if err != nil {
+		return
+	}
+	entry := new(ShowcaseEntry)
+	if err := meddler.Load(tx, "showcase_entries", entry, entryID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, entry.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, entry.CourseID)
+			return
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM showcase_entries WHERE id = ?`, entry.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// slot is a place for one container on a daycare. A daycare has Capacity slots,
+// and each one can be pinned to its own CPU cores and given a fixed memory budget
+// so graders running side by side do not disturb each other's timing.
+type slot struct {
+	index  int
+	cpuset string
+	memory int64
+}
+
+// containerSlots holds the slots not currently in use.
+// Taking a slot from it is what limits the number of concurrent containers.
+var containerSlots chan *slot
+
+// newSlots divides the host into the given number of slots. If cpusPerSlot is
+// positive, slot i is pinned to cores i*cpusPerSlot through (i+1)*cpusPerSlot-1,
+// which must all exist on a host with the given number of cores.
+func newSlots(capacity, cpusPerSlot int, memory int64, cores int) (chan *slot, error) {
+	if cpusPerSlot < 0 {
+		return nil, fmt.Errorf("cpusPerSlot cannot be negative")
+	}
+	if memory < 0 {
+		return nil, fmt.Errorf("slotMemory cannot be negative")
+	}
+	if cpusPerSlot > 0 && capacity*cpusPerSlot > cores {
+		return nil, fmt.Errorf("%d slots with %d cores each need %d cores, but this host has %d",
+			capacity, cpusPerSlot, capacity*cpusPerSlot, cores)
+	}
+
+	slots := make(chan *slot, capacity)
+	for i := 0; i < capacity; i++ {
+		s := &slot{index: i, memory: memory}
+		if cpusPerSlot == 1 {
+			s.cpuset = fmt.Sprintf("%d", i)
+		} else if cpusPerSlot > 1 {
+			s.cpuset = fmt.Sprintf("%d-%d", i*cpusPerSlot, (i+1)*cpusPerSlot-1)
+		}
+		slots <- s
+	}
+	if cpusPerSlot > 0 || memory > 0 {
+		log.Printf("running %d container slots with %d cores and %d MB of memory each", capacity, cpusPerSlot, memory)
+	}
+	return slots, nil
+}
+
+// inSlot returns a copy of the limits adjusted to fit in a slot:
+// the container is pinned to the slot's cores and its memory
+// is capped at the slot's budget.
+func (l *limits) inSlot(s *slot) *limits {
+	fit := *l
+	fit.cpuset = s.cpuset
+	if s.memory > 0 && (fit.maxMemory <= 0 || fit.maxMemory > s.memory) {
+		fit.maxMemory = s.memory
+	}
+	return &fit
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+const (
+	// standbyReplayInterval is how often a standby checks for the primary
+	// so it can replay the submissions it has queued.
+	standbyReplayInterval = 30 * time.Second
+
+	// standbyRetry is the wait suggested to clients turned away by a standby.
+	standbyRetry = 10 * time.Minute
+
+	// standbyQueuePath is the route a standby accepts submissions on.
+	standbyQueuePath = "/commit_bundles/unsigned"
+)
+
+// StandbySubmission is a submission a standby queued while the primary was down,
+// sent to the primary once it returns. The bundle is kept exactly as it was
+// queued so the signature covers the same bytes on both ends.
+type StandbySubmission struct {
+	UserID     int64           `json:"userID"`
+	RemoteAddr string          `json:"remoteAddr"`
+	UserAgent  string          `json:"userAgent"`
+	Bundle     json.RawMessage `json:"bundle"`
+	QueuedAt   time.Time       `json:"queuedAt"`
+	SentAt     time.Time       `json:"sentAt"`
+	Signature  string          `json:"signature,omitempty"`
+}
+
+func (sub *StandbySubmission) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("user_id", strconv.FormatInt(sub.UserID, 10))
+	v.Add("remote_addr", sub.RemoteAddr)
+	v.Add("user_agent", sub.UserAgent)
+	v.Add("bundle", string(sub.Bundle))
+	v.Add("queued_at", sub.QueuedAt.Round(time.Second).UTC().Format(time.RFC3339))
+	v.Add("sent_at", sub.SentAt.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// standbyMode reports whether this TA is a read-only standby for another.
+func standbyMode() bool {
+	return Config.StandbyOf != ""
+}
+
+// rejectOnStandby is martini middleware for a standby. Reads are served from
+// the replica, submissions are left for PostCommitBundlesStandbyQueue,
+// and anything else that would change the database is turned away.
+func rejectOnStandby() martini.Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return
+		}
+		if r.Method == "POST" && r.URL.Path == standbyQueuePath {
+			return
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(standbyRetry.Seconds())))
+		loggedHTTPErrorf(w, http.StatusServiceUnavailable, "CodeGrinder is running on its standby server while the main server is down.\n"+
+			"You can view your work, but nothing can be changed right now. Please try again later.")
+	}
+}
+
+// PostCommitBundlesStandbyQueue handles requests to /commit_bundles/unsigned on a standby,
+// saving the submission to the queue to be replayed when the primary returns.
+// The student is told their files were kept, but nothing is graded until then.
+func PostCommitBundlesStandbyQueue(w http.ResponseWriter, r *http.Request, currentUser *User, bundle CommitBundle) {
+	now := time.Now()
+
+	if bundle.Commit == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include a commit object")
+		return
+	}
+	if len(bundle.CommitSignature) != 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include commit signature")
+		return
+	}
+	if bundle.UserID != currentUser.ID {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include user's ID")
+		return
+	}
+
+	sub := &StandbySubmission{
+		UserID:     currentUser.ID,
+		RemoteAddr: clientIP(r),
+		UserAgent:  r.UserAgent(),
+		Bundle:     mustMarshal(&bundle),
+		QueuedAt:   now,
+	}
+	if err := queueStandbySubmission(sub); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error queuing submission: %v", err)
+		return
+	}
+	log.Printf("queued %s step %d for user %d (%s) until the primary returns",
+		bundle.Commit.Action, bundle.Commit.Step, currentUser.ID, currentUser.Email)
+
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(standbyRetry.Seconds())))
+	loggedHTTPErrorf(w, http.StatusServiceUnavailable, "CodeGrinder is running on its standby server while the main server is down.\n"+
+		"Your files were saved as of %s and will be submitted when the main server returns,\n"+
+		"but they have not been graded. Please run this again later to see your grade.",
+		now.Format("Mon Jan 2 3:04 PM MST"))
+}
+
+// queueStandbySubmission writes a submission to the queue directory.
+// It is synced to disk before returning, so a queued submission survives a crash.
+func queueStandbySubmission(sub *StandbySubmission) error {
+	if err := os.MkdirAll(Config.StandbyQueueDir, 0700); err != nil {
+		return err
+	}
+
+	// name files so they sort in the order they were queued
+	name := fmt.Sprintf("%020d-%d.json", sub.QueuedAt.UnixNano(), sub.UserID)
+	tmp, err := ioutil.TempFile(Config.StandbyQueueDir, ".queue-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(mustMarshal(sub)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(Config.StandbyQueueDir, name)); err != nil {
+		return err
+	}
+
+	// make the rename durable, too
+	dir, err := os.Open(Config.StandbyQueueDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// runStandbyReplay watches for the primary to return and replays the queue to it.
+func runStandbyReplay() {
+	for {
+		time.Sleep(standbyReplayInterval)
+		if err := replayStandbyQueue(); err != nil {
+			log.Printf("standby replay: %v", err)
+		}
+	}
+}
+
+// replayStandbyQueue sends queued submissions to the primary, oldest first.
+// It stops at the first one the primary cannot take yet, so the rest wait
+// for the next round. A submission the primary rejects outright is moved
+// to the rejected directory instead of being retried forever.
+func replayStandbyQueue() error {
+	names, err := filepath.Glob(filepath.Join(Config.StandbyQueueDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	replayed := 0
+	for _, name := range names {
+		raw, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sub := new(StandbySubmission)
+		if err := json.Unmarshal(raw, sub); err != nil {
+			log.Printf("standby replay: unable to decode %s: %v", name, err)
+			if err := rejectStandbySubmission(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sub.SentAt = time.Now()
+		sub.Signature = sub.ComputeSignature(Config.DaycareSecret)
+		status, body, err := postStandbySubmission(sub)
+		if err != nil {
+			if replayed > 0 {
+				log.Printf("standby replay: sent %d queued submissions before the primary stopped answering", replayed)
+			}
+			return err
+		}
+		switch {
+		case status == http.StatusOK:
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+			replayed++
+		case status >= 400 && status < 500:
+			log.Printf("standby replay: primary rejected submission by user %d queued at %v: %s %s",
+				sub.UserID, sub.QueuedAt, http.StatusText(status), body)
+			if err := rejectStandbySubmission(name); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("primary returned %s, will try again: %s", http.StatusText(status), body)
+		}
+	}
+	if replayed > 0 {
+		log.Printf("standby replay: sent %d queued submissions to %s", replayed, Config.StandbyOf)
+	}
+	return nil
+}
+
+// rejectStandbySubmission moves a queued submission aside for an administrator to look at.
+func rejectStandbySubmission(name string) error {
+	dir := filepath.Join(Config.StandbyQueueDir, "rejected")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Rename(name, filepath.Join(dir, filepath.Base(name)))
+}
+
+// postStandbySubmission sends a submission to the primary, returning the status and body.
+// An error means the primary could not be reached at all.
+func postStandbySubmission(sub *StandbySubmission) (int, string, error) {
+	url := fmt.Sprintf("https://%s/commit_bundles/standby", Config.StandbyOf)
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Post(url, "application/json", bytes.NewReader(mustMarshal(sub)))
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, strings.TrimSpace(string(body)), nil
+}
+
+// PostCommitBundlesStandby handles requests to /commit_bundles/standby,
+// saving a submission a standby queued while this server was down.
+// The commit is saved as of the time it was queued, so it counts against
+// the deadlines that applied then, but it is not graded; the student's
+// next grind grade picks it up.
+func PostCommitBundlesStandby(w http.ResponseWriter, tx *sql.Tx, sub StandbySubmission, render render.Render) {
+	sig := sub.ComputeSignature(Config.DaycareSecret)
+	if sig != sub.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "standby submission signature mismatch: computed %s but found %s", sig, sub.Signature)
+		return
+	}
+	drift := time.Since(sub.SentAt)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "standby submission is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+	if sub.QueuedAt.After(sub.SentAt) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "standby submission was queued after it was sent")
+		return
+	}
+
+	bundle := CommitBundle{}
+	if err := json.Unmarshal(sub.Bundle, &bundle); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "decoding standby submission: %v", err)
+		return
+	}
+	if bundle.Commit == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include a commit object")
+		return
+	}
+	if len(bundle.CommitSignature) != 0 || len(bundle.Hostname) != 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not be signed")
+		return
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, sub.UserID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	// the student may have saved newer work since the primary returned
+	current := new(Commit)
+	err := meddler.QueryRow(tx, current, `SELECT * FROM commits WHERE assignment_id = ? AND problem_id = ? AND step = ? LIMIT 1`,
+		bundle.Commit.AssignmentID, bundle.Commit.ProblemID, bundle.Commit.Step)
+	if err != nil && err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err == nil && current.UpdatedAt.After(sub.QueuedAt) {
+		loggedHTTPErrorf(w, http.StatusConflict, "commit %d was saved at %v, after this submission was queued at %v",
+			current.ID, current.UpdatedAt, sub.QueuedAt)
+		return
+	}
+
+	log.Printf("saving %s step %d for user %d (%s), queued by a standby at %v",
+		bundle.Commit.Action, bundle.Commit.Step, user.ID, user.Email, sub.QueuedAt)
+
+	// save the files without asking for grading
+	bundle.AllowReuse = false
+	bundle.Commit.Action = ""
+	bundle.Commit.Transcript = []*EventMessage{}
+	bundle.Commit.ReportCard = nil
+	bundle.Commit.Score = 0.0
+	bundle.Commit.CreatedAt = sub.QueuedAt
+	bundle.Commit.UpdatedAt = sub.QueuedAt
+	saveCommitBundleCommon(sub.QueuedAt, w, sub.RemoteAddr, sub.UserAgent, tx, user, bundle, render)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/russross/codegrinder/www"
+)
+
+// hashedAssetPattern matches file names with a content hash in them, such as
+// app.3f9a2b1c.js or app-3f9a2b1c.css, which never change once published.
+var hashedAssetPattern = regexp.MustCompile(`[.-][0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// immutableMaxAge is how long browsers may cache a hashed asset without asking again.
+const immutableMaxAge = 365 * 24 * time.Hour
+
+// layeredFS serves files from the first of its layers that has them.
+type layeredFS []fs.FS
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	var firstErr error
+	for _, layer := range l {
+		file, err := layer.Open(name)
+		if err == nil {
+			return file, nil
+		}
+		if firstErr == nil || !errors.Is(err, fs.ErrNotExist) {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// staticFiles returns the static files to serve: the pages built into the binary
+// backed by staticDir, or only staticDir when staticFromDisk is set for development.
+func staticFiles() fs.FS {
+	disk := os.DirFS(Config.StaticDir)
+	if Config.StaticFromDisk {
+		return disk
+	}
+	return layeredFS{www.Files, disk}
+}
+
+// staticETags holds the ETags of files built into the binary, which have no modification time.
+var staticETags sync.Map
+
+// staticETag returns a strong ETag for the contents of a file,
+// leaving the file positioned at the start.
+func staticETag(name string, file io.ReadSeeker) (string, error) {
+	if tag, ok := staticETags.Load(name); ok {
+		return tag.(string), nil
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum.Sum(nil)[:16]) + `"`
+	staticETags.Store(name, tag)
+	return tag, nil
+}
+
+// openStatic opens a static file by URL path, using index.html for a directory.
+// It returns nil if there is no such file. redirect is set if the path names a
+// directory but lacks the trailing slash.
+func openStatic(fsys fs.FS, urlPath string) (file fs.File, info fs.FileInfo, name string, redirect bool) {
+	name = strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, "", false
+	}
+	info, err = file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, "", false
+	}
+	if info.IsDir() {
+		file.Close()
+		if !strings.HasSuffix(urlPath, "/") {
+			return nil, nil, "", true
+		}
+		name = path.Join(name, "index.html")
+		if file, err = fsys.Open(name); err != nil {
+			return nil, nil, "", false
+		}
+		if info, err = file.Stat(); err != nil || info.IsDir() {
+			file.Close()
+			return nil, nil, "", false
+		}
+	}
+	return file, info, name, false
+}
+
+// serveStaticFile writes a static file with cache headers: hashed assets are
+// cached for good, and everything else is checked with the server each time.
+func serveStaticFile(w http.ResponseWriter, r *http.Request, file fs.File, info fs.FileInfo, name string) {
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		raw, err := io.ReadAll(file)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error reading %s: %v", name, err)
+			return
+		}
+		content = bytes.NewReader(raw)
+	}
+	if hashedAssetPattern.MatchString(path.Base(name)) {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(immutableMaxAge.Seconds()), 10)+", immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if info.ModTime().IsZero() {
+		tag, err := staticETag(name, content)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error reading %s: %v", name, err)
+			return
+		}
+		w.Header().Set("ETag", tag)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// serveStatic returns martini middleware that serves static files,
+// passing requests for anything else on to the router.
+func serveStatic(fsys fs.FS) martini.Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			return
+		}
+		file, info, name, redirect := openStatic(fsys, r.URL.Path)
+		if redirect {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusFound)
+			return
+		}
+		if file == nil {
+			return
+		}
+		defer file.Close()
+		serveStaticFile(w, r, file, info, name)
+	}
+}
+
+// staticFallback returns a router NotFound handler for single-page apps.
+// A browser asking for a page that matches no route or file, such as a deep
+// link into an app's history-based routes, gets the index.html of the nearest
+// directory above it, and the app takes over from there. Requests for files
+// (anything with an extension) and API requests still get a 404.
+func staticFallback(fsys fs.FS) martini.Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != "GET" && r.Method != "HEAD") ||
+			!strings.Contains(r.Header.Get("Accept"), "text/html") ||
+			path.Ext(r.URL.Path) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		for dir := path.Dir(path.Clean("/" + r.URL.Path)); ; dir = path.Dir(dir) {
+			file, info, name, _ := openStatic(fsys, strings.TrimSuffix(dir, "/")+"/")
+			if file != nil {
+				defer file.Close()
+				serveStaticFile(w, r, file, info, name)
+				return
+			}
+			if dir == "/" {
+				break
+			}
+		}
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/martini-contrib/render"
+)
+
+const (
+	// statusWindow is how far back grading and grade posting are measured.
+	statusWindow = time.Hour
+
+	// statusCacheTime is how long a computed status is served before it is recomputed.
+	statusCacheTime = 30 * time.Second
+
+	// statusRateLimit is the number of status requests one address can make per minute.
+	statusRateLimit = 12
+
+	// slowGradingDelay is the median turnaround above which grading is reported as slow.
+	slowGradingDelay = time.Minute
+)
+
+// Service health levels, from best to worst.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// ServiceStatus is the public summary of service health.
+// Values are rounded so the page answers "is it me or the grader?"
+// without exposing details of the deployment.
+type ServiceStatus struct {
+	Status              string    `json:"status"`
+	Grading             string    `json:"grading"`
+	GradingDelaySeconds *int64    `json:"gradingDelaySeconds,omitempty"`
+	GradePosting        string    `json:"gradePosting"`
+	GradePostingPercent *int64    `json:"gradePostingPercent,omitempty"`
+	Daycares            string    `json:"daycares"`
+	Maintenance         string    `json:"maintenance,omitempty"`
+	UpdatedAt           time.Time `json:"updatedAt"`
+}
+
+// healthSample is a single measurement with the time it was taken.
+type healthSample struct {
+	time  time.Time
+	delay time.Duration
+	ok    bool
+}
+
+// serviceHealth collects recent measurements on this TA instance.
+type serviceHealth struct {
+	sync.Mutex
+	gradings []healthSample
+	posts    []healthSample
+
+	cached   *ServiceStatus
+	cachedAt time.Time
+
+	// requests per address in the current minute
+	window  time.Time
+	clients map[string]int
+}
+
+var health serviceHealth
+
+// prune drops samples older than the status window.
+func prune(samples []healthSample, now time.Time) []healthSample {
+	cutoff := now.Add(-statusWindow)
+	i := 0
+	for i < len(samples) && samples[i].time.Before(cutoff) {
+		i++
+	}
+	return samples[i:]
+}
+
+// gradingFinished records the time between a daycare starting to grade a commit
+// and the graded commit reaching the TA, which includes any wait for a container.
+func (h *serviceHealth) gradingFinished(delay time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	h.gradings = append(prune(h.gradings, now), healthSample{time: now, delay: delay})
+}
+
+// gradePosted records whether an attempt to post a grade to the LMS succeeded.
+func (h *serviceHealth) gradePosted(ok bool) {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	h.posts = append(prune(h.posts, now), healthSample{time: now, ok: ok})
+}
+
+// allow reports whether a client address is still within its status request limit,
+// and if not, how long it must wait.
+func (h *serviceHealth) allow(addr string, now time.Time) (bool, time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	window := now.Truncate(time.Minute)
+	if !window.Equal(h.window) {
+		h.window = window
+		h.clients = make(map[string]int)
+	}
+	if h.clients[addr] >= statusRateLimit {
+		return false, window.Add(time.Minute).Sub(now)
+	}
+	h.clients[addr]++
+	return true, 0
+}
+
+// status summarizes the current measurements, using a cached summary if it is recent enough.
+func (h *serviceHealth) status(tx *sql.Tx, now time.Time) (*ServiceStatus, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.cached != nil && now.Sub(h.cachedAt) < statusCacheTime {
+		return h.cached, nil
+	}
+
+	if err := daycareRegistrations.Expire(tx); err != nil {
+		return nil, err
+	}
+	daycares, err := daycareRegistrations.List(tx)
+	if err != nil {
+		return nil, err
+	}
+	status := &ServiceStatus{
+		Daycares:     HealthOK,
+		Grading:      HealthOK,
+		GradePosting: HealthOK,
+		UpdatedAt:    now.Truncate(time.Minute),
+	}
+	if len(daycares) == 0 {
+		status.Daycares = HealthDown
+		status.Grading = HealthDown
+	}
+	maintenance, err := currentMaintenance(tx)
+	if err != nil {
+		return nil, err
+	}
+	if maintenance != nil {
+		status.Maintenance = maintenance.Message
+	}
+
+	// median grading turnaround, to the nearest 10 seconds
+	h.gradings = prune(h.gradings, now)
+	if len(h.gradings) > 0 {
+		delays := make([]time.Duration, len(h.gradings))
+		for i, elt := range h.gradings {
+			delays[i] = elt.delay
+		}
+		sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+		delay := delays[len(delays)/2]
+		seconds := int64(math.Round(delay.Seconds()/10.0)) * 10
+		status.GradingDelaySeconds = &seconds
+		if delay > slowGradingDelay && status.Grading == HealthOK {
+			status.Grading = HealthDegraded
+		}
+	}
+
+	// grade posting success, to the nearest 10 percent
+	h.posts = prune(h.posts, now)
+	if len(h.posts) > 0 {
+		succeeded := 0
+		for _, elt := range h.posts {
+			if elt.ok {
+				succeeded++
+			}
+		}
+		rate := float64(succeeded) / float64(len(h.posts))
+		percent := int64(math.Round(rate*10.0)) * 10
+		status.GradePostingPercent = &percent
+		switch {
+		case rate < 0.5:
+			status.GradePosting = HealthDown
+		case rate < 0.9:
+			status.GradePosting = HealthDegraded
+		}
+	}
+
+	status.Status = HealthOK
+	for _, elt := range []string{status.Daycares, status.Grading, status.GradePosting} {
+		if elt == HealthDown {
+			status.Status = HealthDown
+		} else if elt == HealthDegraded && status.Status == HealthOK {
+			status.Status = HealthDegraded
+		}
+	}
+
+	h.cached, h.cachedAt = status, now
+	return status, nil
+}
+
+// GetStatus handles requests to /status,
+// returning a coarse summary of service health. No login is required,
+// so requests are limited per address and the result is cached briefly.
+func GetStatus(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	now := time.Now()
+	if ok, wait := health.allow(clientIP(r), now); !ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(wait.Seconds()))))
+		loggedHTTPErrorf(w, http.StatusTooManyRequests, "too many status requests; try again in %v", wait.Round(time.Second))
+		return
+	}
+
+	status, err := health.status(tx, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(statusCacheTime.Seconds())))
+	render.JSON(http.StatusOK, status)
+}
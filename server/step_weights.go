@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// StepWeights sets the weights of all of a problem's steps at once.
+// Weights has one entry per step, or is empty to weigh the scored steps
+// equally. The weights are scaled so those of the scored steps add up to
+// Total, which defaults to the number of scored steps. Diagnostic steps
+// must be given zero.
+type StepWeights struct {
+	Weights []float64 `json:"weights"`
+	Total   float64   `json:"total,omitempty"`
+}
+
+// PutProblemStepWeights handles requests to /problems/:problem_id/step_weights,
+// rebalancing the weights of a problem's steps and returning the updated steps.
+// Every student assignment that uses the problem is rescored, and changed grades are posted to the LMS.
+func PutProblemStepWeights(w http.ResponseWriter, tx *sql.Tx, params martini.Params, weights StepWeights, render render.Render) {
+	now := time.Now()
+
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	steps := []*ProblemStep{}
+	if err := meddler.QueryAll(tx, &steps, `SELECT * FROM problem_steps WHERE problem_id = ? ORDER BY step`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if len(steps) == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	// check the new weights
+	if len(weights.Weights) == 0 {
+		for _, step := range steps {
+			if step.Diagnostic {
+				weights.Weights = append(weights.Weights, 0.0)
+			} else {
+				weights.Weights = append(weights.Weights, 1.0)
+			}
+		}
+	}
+	if len(weights.Weights) != len(steps) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem has %d steps, but %d weights were given", len(steps), len(weights.Weights))
+		return
+	}
+	sum, scored := 0.0, 0
+	for i, step := range steps {
+		weight := weights.Weights[i]
+		switch {
+		case math.IsNaN(weight) || math.IsInf(weight, 0) || weight < 0.0:
+			loggedHTTPErrorf(w, http.StatusBadRequest, "weight for step %d must be a positive number", step.Step)
+			return
+		case step.Diagnostic && weight != 0.0:
+			loggedHTTPErrorf(w, http.StatusBadRequest, "step %d is a diagnostic step, so its weight must be zero", step.Step)
+			return
+		case !step.Diagnostic && weight == 0.0:
+			loggedHTTPErrorf(w, http.StatusBadRequest, "weight for step %d must be positive; mark the step as diagnostic if it should not count", step.Step)
+			return
+		}
+		if !step.Diagnostic {
+			sum += weight
+			scored++
+		}
+	}
+	if scored == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem has no scored steps to weigh")
+		return
+	}
+	total := weights.Total
+	if total == 0.0 {
+		total = float64(scored)
+	}
+	if math.IsNaN(total) || math.IsInf(total, 0) || total < 0.0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "total weight must be a positive number")
+		return
+	}
+
+	// save them, scaled to the total
+	for i, step := range steps {
+		step.Weight = weights.Weights[i] * total / sum
+		if _, err := tx.Exec(`UPDATE problem_steps SET weight = ? WHERE problem_id = ? AND step = ?`, step.Weight, problemID, step.Step); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	// the problem has changed, so earlier results are no longer reused
+	if _, err := tx.Exec(`UPDATE problems SET updated_at = ? WHERE id = ?`, now, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// rescore everyone working on the problem
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT assignments.* FROM assignments `+
+		`JOIN problem_set_problems ON assignments.problem_set_id = problem_set_problems.problem_set_id `+
+		`WHERE problem_set_problems.problem_id = ? AND NOT assignments.instructor AND assignments.score IS NOT NULL`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	rescored := 0
+	for _, assignment := range assignments {
+		changed, err := rescoreAssignment(tx, assignment, "step weights", now)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if changed {
+			rescored++
+			go saveGradeWithRetries(assignment, "")
+		}
+	}
+	log.Printf("step weights for problem %d rebalanced to a total of %g, %d grade(s) changed", problemID, total, rescored)
+
+	render.JSON(http.StatusOK, steps)
+}
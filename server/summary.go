@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// AssignmentSummary is where a student stands on one problem of an assignment.
+// Summaries are kept up to date as commits are saved and graded, so dashboards
+// can read one row per student and problem instead of scanning commit history.
+type AssignmentSummary struct {
+	AssignmentID int64      `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64      `json:"problemID" meddler:"problem_id"`
+	UserID       int64      `json:"userID" meddler:"user_id"`
+	StepReached  int64      `json:"stepReached" meddler:"step_reached"`
+	LatestScore  *float64   `json:"latestScore,omitempty" meddler:"latest_score"`
+	Attempts     int64      `json:"attempts" meddler:"attempts"`
+	LastActivity *time.Time `json:"lastActivity,omitempty" meddler:"last_activity,localtime"`
+}
+
+// updateAssignmentSummary recomputes the summary for one problem of an assignment.
+// It must be called in the same transaction as any change to its commits or step scores.
+func updateAssignmentSummary(tx *sql.Tx, assignmentID, problemID int64) error {
+	summary := &AssignmentSummary{AssignmentID: assignmentID, ProblemID: problemID}
+	if err := tx.QueryRow(`SELECT user_id FROM assignments WHERE id = ?`, assignmentID).Scan(&summary.UserID); err != nil {
+		return err
+	}
+
+	err := tx.QueryRow(`SELECT step FROM commits WHERE assignment_id = ? AND problem_id = ? ORDER BY step DESC LIMIT 1`,
+		assignmentID, problemID).Scan(&summary.StepReached)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	default:
+		// the latest step is not always the one touched most recently
+		var updatedAt time.Time
+		if err := tx.QueryRow(`SELECT updated_at FROM commits WHERE assignment_id = ? AND problem_id = ? ORDER BY updated_at DESC LIMIT 1`,
+			assignmentID, problemID).Scan(&updatedAt); err != nil {
+			return err
+		}
+		summary.LastActivity = &updatedAt
+	}
+
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM step_scores WHERE assignment_id = ? AND problem_id = ?`,
+		assignmentID, problemID).Scan(&summary.Attempts); err != nil {
+		return err
+	}
+	var score float64
+	var scoredAt time.Time
+	err = tx.QueryRow(`SELECT score, created_at FROM step_scores WHERE assignment_id = ? AND problem_id = ? `+
+		`ORDER BY created_at DESC, id DESC LIMIT 1`, assignmentID, problemID).Scan(&score, &scoredAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	default:
+		summary.LatestScore = &score
+		if summary.LastActivity == nil || scoredAt.After(*summary.LastActivity) {
+			summary.LastActivity = &scoredAt
+		}
+	}
+
+	if summary.StepReached == 0 && summary.Attempts == 0 {
+		_, err := tx.Exec(`DELETE FROM assignment_summaries WHERE assignment_id = ? AND problem_id = ?`, assignmentID, problemID)
+		return err
+	}
+	if summary.LastActivity != nil {
+		// stored in UTC, as meddler does for localtime fields
+		utc := summary.LastActivity.UTC()
+		summary.LastActivity = &utc
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO assignment_summaries (assignment_id, problem_id, user_id, step_reached, latest_score, attempts, last_activity) `+
+		`VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		summary.AssignmentID, summary.ProblemID, summary.UserID, summary.StepReached, summary.LatestScore, summary.Attempts, summary.LastActivity)
+	return err
+}
+
+// rebuildSummariesCommand recomputes every assignment summary from the commits
+// and step scores, for use after restoring a backup or if summaries drift.
+func rebuildSummariesCommand(args []string) {
+	flags := flag.NewFlagSet("rebuild-summaries", flag.ExitOnError)
+	flags.Parse(args)
+
+	db := setupDB(Config.SQLite3Path)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	type pair struct {
+		assignmentID, problemID int64
+	}
+	rows, err := tx.Query(`SELECT assignment_id, problem_id FROM commits UNION SELECT assignment_id, problem_id FROM step_scores`)
+	if err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	var pairs []pair
+	for rows.Next() {
+		var elt pair
+		if err := rows.Scan(&elt.assignmentID, &elt.problemID); err != nil {
+			log.Fatalf("db error: %v", err)
+		}
+		pairs = append(pairs, elt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM assignment_summaries`); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	for _, elt := range pairs {
+		if err := updateAssignmentSummary(tx, elt.assignmentID, elt.problemID); err != nil {
+			log.Fatalf("assignment %d problem %d: %v", elt.assignmentID, elt.problemID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("db error: %v", err)
+	}
+	log.Printf("rebuilt %d assignment summaries", len(pairs))
+}
+
+// GetCourseSummaries handles requests to /courses/:course_id/summaries,
+// returning where every student in the course stands on every problem they have started.
+//
+// Parameters problem_set_id and section_id restrict the list.
+func GetCourseSummaries(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return
+		}
+	}
+
+	where := ` WHERE assignments.course_id = ? AND NOT assignments.instructor`
+	args := []interface{}{courseID}
+	if s := r.FormValue("problem_set_id"); s != "" {
+		problemSetID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_set_id: %v", err)
+			return
+		}
+		where += ` AND assignments.problem_set_id = ?`
+		args = append(args, problemSetID)
+	}
+	scope, scopeArgs, ok := sectionWhere(w, r, tx, courseID, currentUser)
+	if !ok {
+		return
+	}
+	where += scope
+	args = append(args, scopeArgs...)
+
+	summaries := []*AssignmentSummary{}
+	if err := meddler.QueryAll(tx, &summaries, `SELECT assignment_summaries.* `+
+		`FROM assignment_summaries JOIN assignments ON assignment_summaries.assignment_id = assignments.id`+where+
+		` ORDER BY assignment_summaries.user_id, assignment_summaries.assignment_id, assignment_summaries.problem_id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, summaries)
+}
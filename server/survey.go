@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// maxSurveyComments is the longest free-text response accepted, in bytes.
+const maxSurveyComments = 4000
+
+// problemCompleted reports whether a student has a perfect graded score on the final step of a problem.
+func problemCompleted(tx *sql.Tx, assignmentID, problemID int64) (bool, error) {
+	var last int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(step), 0) FROM problem_steps WHERE problem_id = ?`, problemID).Scan(&last); err != nil {
+		return false, err
+	}
+	best, err := bestStepScores(tx, assignmentID, problemID)
+	if err != nil {
+		return false, err
+	}
+	return last > 0 && best[last] >= 1.0, nil
+}
+
+// surveyAnswered reports whether a student has already responded to the survey for a problem.
+func surveyAnswered(tx *sql.Tx, assignmentID, problemID int64) (bool, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(1) FROM problem_surveys WHERE assignment_id = ? AND problem_id = ?`,
+		assignmentID, problemID).Scan(&count)
+	return count > 0, err
+}
+
+// PostAssignmentProblemSurvey handles requests to /assignments/:assignment_id/problems/:problem_id/survey,
+// recording a student's survey response after they pass the final step of the problem.
+// Each student can respond once per problem.
+func PostAssignmentProblemSurvey(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, survey ProblemSurvey, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE id = ? AND user_id = ?`, assignmentID, currentUser.ID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM problem_set_problems WHERE problem_set_id = ? AND problem_id = ?`,
+		assignment.ProblemSetID, problemID).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if survey.Difficulty < 0 || survey.Difficulty > MaxSurveyDifficulty {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "difficulty must be between 1 and %d", MaxSurveyDifficulty)
+		return
+	}
+	if survey.Minutes < 0 || survey.Minutes > MaxSurveyMinutes {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "minutes must be between 0 and %d", MaxSurveyMinutes)
+		return
+	}
+	survey.Comments = strings.TrimSpace(survey.Comments)
+	if len(survey.Comments) > maxSurveyComments {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "comments must be at most %d bytes", maxSurveyComments)
+		return
+	}
+
+	completed, err := problemCompleted(tx, assignment.ID, problemID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if !completed {
+		loggedHTTPErrorf(w, http.StatusForbidden, "the survey is only available after passing every step of the problem")
+		return
+	}
+	answered, err := surveyAnswered(tx, assignment.ID, problemID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if answered {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "you have already responded to the survey for this problem")
+		return
+	}
+
+	survey.ID = 0
+	survey.AssignmentID = assignment.ID
+	survey.ProblemID = problemID
+	survey.UserID = currentUser.ID
+	survey.CreatedAt = time.Now()
+	if err := meddler.Insert(tx, "problem_surveys", &survey); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &survey)
+}
+
+// GetProblemSurveyResults handles requests to /problems/:problem_id/survey_results,
+// returning the aggregated survey responses for a problem.
+//
+// If parameter course_id=<...> present, results will be filtered by matching course.
+func GetProblemSurveyResults(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	where := ` WHERE problem_surveys.problem_id = ?`
+	args := []interface{}{problem.ID}
+	if s := r.FormValue("course_id"); s != "" {
+		courseID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing course_id: %v", err)
+			return
+		}
+		where += ` AND assignments.course_id = ?`
+		args = append(args, courseID)
+	}
+	surveys := []*ProblemSurvey{}
+	if err := meddler.QueryAll(tx, &surveys, `SELECT problem_surveys.* FROM problem_surveys `+
+		`JOIN assignments ON problem_surveys.assignment_id = assignments.id`+where+
+		` ORDER BY problem_surveys.created_at, problem_surveys.id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	results := &ProblemSurveyResults{
+		ProblemID:        problem.ID,
+		Responses:        int64(len(surveys)),
+		DifficultyCounts: make([]int64, MaxSurveyDifficulty),
+		Comments:         []string{},
+	}
+	var difficulties, difficultyTotal, minutesTotal int64
+	var minutes []int64
+	for _, elt := range surveys {
+		if elt.Difficulty > 0 {
+			results.DifficultyCounts[elt.Difficulty-1]++
+			difficulties++
+			difficultyTotal += elt.Difficulty
+		}
+		if elt.Minutes > 0 {
+			minutes = append(minutes, elt.Minutes)
+			minutesTotal += elt.Minutes
+		}
+		if elt.Comments != "" {
+			results.Comments = append(results.Comments, elt.Comments)
+		}
+	}
+	if difficulties > 0 {
+		results.AverageDifficulty = float64(difficultyTotal) / float64(difficulties)
+	}
+	if len(minutes) > 0 {
+		results.AverageMinutes = float64(minutesTotal) / float64(len(minutes))
+		sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+		results.MedianMinutes = minutes[len(minutes)/2]
+	}
+	render.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// systemdFirstFD is the first file descriptor systemd passes to a socket-activated service.
+const systemdFirstFD = 3
+
+// systemdListeners returns the sockets systemd opened for us, if the service
+// was socket activated, or nil if it was not. The environment variables that
+// pass them are cleared so child processes do not try to use them as well.
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		fd := systemdFirstFD + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("systemd-fd-%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, elt := range listeners {
+				elt.Close()
+			}
+			return nil, fmt.Errorf("using socket %s from systemd: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a status update such as READY=1 to systemd.
+// It does nothing if the service was not started by systemd with notifications enabled.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if strings.HasPrefix(name, "@") {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// systemdWatchdogInterval returns how often systemd expects to hear that we are alive,
+// or zero if the watchdog is not enabled for this process.
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runSystemdWatchdog tells systemd we are alive at half the interval it asked for.
+func runSystemdWatchdog(interval time.Duration) {
+	for {
+		time.Sleep(interval / 2)
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("error notifying systemd watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+const (
+	// terminationGrace is how long processes have to exit after SIGTERM
+	// before they are killed.
+	terminationGrace = 5 * time.Second
+
+	// terminationWait is how long to wait for a command to finish after it has been killed.
+	// The container itself lives this much longer than the time limit plus the grace period,
+	// so a job that reaches its time limit is always stopped here first.
+	terminationWait = 5 * time.Second
+)
+
+// signalStudentProcesses sends a signal to every process the student runs in the container.
+// The container's main process is left alone, so the container stays up
+// and output can still be collected.
+func (n *Nanny) signalStudentProcesses(signal string) error {
+	cmd := exec.Command(containerEngine, "exec", "--user", n.user(), n.ID, "/bin/sh", "-c", "kill -"+signal+" -1")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sending SIG%s: %v: %s", signal, err, output)
+	}
+	return nil
+}
+
+// terminate stops a command that has run past the time limit: its processes get SIGTERM,
+// then SIGKILL if they have not exited after the grace period. Finally, the local
+// container engine client is killed if it is still waiting on output.
+// It returns the result of the command once it has stopped.
+func (n *Nanny) terminate(command *exec.Cmd, done <-chan error) error {
+	if n.OS == "windows" {
+		// windows containers have no signals, so go straight to the last step
+		command.Process.Kill()
+		return <-done
+	}
+
+	if err := n.signalStudentProcesses("TERM"); err != nil {
+		n.Job.logf("%s: %v", n.Name, err)
+	}
+	select {
+	case err := <-done:
+		n.Job.event("killed", "stopped with SIGTERM after the time limit")
+		return err
+	case <-time.After(terminationGrace):
+	}
+
+	if err := n.signalStudentProcesses("KILL"); err != nil {
+		n.Job.logf("%s: %v", n.Name, err)
+	}
+	select {
+	case err := <-done:
+		n.Job.event("killed", "stopped with SIGKILL %v after the time limit", terminationGrace)
+		return err
+	case <-time.After(terminationWait):
+	}
+
+	command.Process.Kill()
+	n.Job.event("killed", "container engine client killed after the time limit")
+	return <-done
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Theme is the branding shown on student-facing pages: a title, a logo,
+// an accent color, and links for the page footer. Named themes in the
+// config file let departments sharing one server brand their own courses,
+// and a course can adjust the theme it uses.
+type Theme struct {
+	Title       string      `json:"title,omitempty"`       // shown in page headers and as the LTI tool name
+	LogoURL     string      `json:"logoURL,omitempty"`     // https URL of an image shown in page headers and as the LTI icon
+	AccentColor string      `json:"accentColor,omitempty"` // #rgb or #rrggbb color for headings and links
+	FooterLinks []ThemeLink `json:"footerLinks,omitempty"` // links shown at the bottom of each page
+}
+
+// ThemeLink is a link in a page footer.
+type ThemeLink struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// CourseTheme picks the theme for a course: one of the named themes in the
+// config file (or the default if Theme is empty), with any other fields set
+// here taking its place.
+type CourseTheme struct {
+	CourseID    int64       `json:"courseID" meddler:"course_id"`
+	Theme       string      `json:"theme" meddler:"theme"`
+	Title       string      `json:"title" meddler:"title"`
+	LogoURL     string      `json:"logoURL" meddler:"logo_url"`
+	AccentColor string      `json:"accentColor" meddler:"accent_color"`
+	FooterLinks []ThemeLink `json:"footerLinks" meddler:"footer_links,json"`
+	CreatedAt   time.Time   `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt   time.Time   `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+const (
+	// defaultAccentColor matches the highlight color of the grind instructions page.
+	defaultAccentColor = "#ba1c21"
+
+	// maxThemeFooterLinks keeps footers to a reasonable size.
+	maxThemeFooterLinks = 10
+)
+
+var themeColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// overlay returns the theme with any fields set in other taking their place.
+func (theme Theme) overlay(other *Theme) Theme {
+	if other.Title != "" {
+		theme.Title = other.Title
+	}
+	if other.LogoURL != "" {
+		theme.LogoURL = other.LogoURL
+	}
+	if other.AccentColor != "" {
+		theme.AccentColor = other.AccentColor
+	}
+	if len(other.FooterLinks) > 0 {
+		theme.FooterLinks = other.FooterLinks
+	}
+	return theme
+}
+
+// Validate checks that the theme is safe to put on a page.
+func (theme *Theme) Validate() error {
+	if len(theme.Title) > 100 {
+		return fmt.Errorf("title must be at most 100 characters")
+	}
+	if theme.LogoURL != "" {
+		if u, err := url.Parse(theme.LogoURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("logo URL must be an https URL, not %q", theme.LogoURL)
+		}
+	}
+	if theme.AccentColor != "" && !themeColorPattern.MatchString(theme.AccentColor) {
+		return fmt.Errorf("accent color must be #rgb or #rrggbb, not %q", theme.AccentColor)
+	}
+	if len(theme.FooterLinks) > maxThemeFooterLinks {
+		return fmt.Errorf("at most %d footer links are allowed", maxThemeFooterLinks)
+	}
+	for _, link := range theme.FooterLinks {
+		if strings.TrimSpace(link.Text) == "" {
+			return fmt.Errorf("footer link to %q has no text", link.URL)
+		}
+		u, err := url.Parse(link.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http" && u.Scheme != "mailto") {
+			return fmt.Errorf("footer link %q must be an http, https, or mailto URL, not %q", link.Text, link.URL)
+		}
+	}
+	return nil
+}
+
+// defaultTheme returns the theme used by pages that do not belong to a course,
+// and by courses that do not pick one.
+func defaultTheme() Theme {
+	theme := Theme{Title: Config.ToolName, AccentColor: defaultAccentColor}
+	if named, present := Config.Themes[""]; present {
+		theme = theme.overlay(&named)
+	}
+	return theme
+}
+
+// namedTheme returns one of the themes in the config file, filled in from
+// the default theme. The empty name gives the default theme.
+func namedTheme(name string) (Theme, bool) {
+	theme := defaultTheme()
+	if name == "" {
+		return theme, true
+	}
+	named, present := Config.Themes[name]
+	if !present {
+		return theme, false
+	}
+	return theme.overlay(&named), true
+}
+
+// themeNames lists the named themes in the config file.
+func themeNames() []string {
+	names := []string{}
+	for name := range Config.Themes {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// courseTheme returns the theme for a course's pages.
+func courseTheme(tx *sql.Tx, courseID int64) (Theme, error) {
+	ct := new(CourseTheme)
+	if err := meddler.QueryRow(tx, ct, `SELECT * FROM course_themes WHERE course_id = ?`, courseID); err != nil {
+		if err == sql.ErrNoRows {
+			return defaultTheme(), nil
+		}
+		return Theme{}, err
+	}
+	return ct.Apply(), nil
+}
+
+// Apply returns the theme the course ends up with.
+func (ct *CourseTheme) Apply() Theme {
+	theme, present := namedTheme(ct.Theme)
+	if !present {
+		log.Printf("course %d uses theme %q, which is not in the config file", ct.CourseID, ct.Theme)
+	}
+	return theme.overlay(&Theme{
+		Title:       ct.Title,
+		LogoURL:     ct.LogoURL,
+		AccentColor: ct.AccentColor,
+		FooterLinks: ct.FooterLinks,
+	})
+}
+
+// GetThemes handles requests to /themes,
+// returning the default theme and the named themes from the config file.
+func GetThemes(render render.Render) {
+	themes := map[string]Theme{"": defaultTheme()}
+	for _, name := range themeNames() {
+		themes[name], _ = namedTheme(name)
+	}
+	render.JSON(http.StatusOK, themes)
+}
+
+// GetCourseTheme handles requests to /courses/:course_id/theme,
+// returning the theme the course's pages use. Anyone in the course can see it.
+//
+// If parameter raw=true present, the course's own settings are returned
+// instead, or a 404 if it has none.
+func GetCourseTheme(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	if !currentUser.Admin {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM assignments WHERE course_id = ? AND user_id = ?`, courseID, currentUser.ID).Scan(&count); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if count == 0 {
+			loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+
+	if r.URL.Query().Get("raw") == "true" {
+		ct := new(CourseTheme)
+		if err := meddler.QueryRow(tx, ct, `SELECT * FROM course_themes WHERE course_id = ?`, courseID); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+		render.JSON(http.StatusOK, ct)
+		return
+	}
+
+	theme, err := courseTheme(tx, courseID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &theme)
+}
+
+// PutCourseTheme handles requests to /courses/:course_id/theme,
+// setting the theme for the course's pages.
+//
+// Theme names one of the themes in the config file, or is empty for the default.
+// The other fields are optional and take the place of the named theme's.
+func PutCourseTheme(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, ct CourseTheme, render render.Render) {
+	now := time.Now()
+
+	courseID, ok := loadGradePolicyCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+	if _, present := namedTheme(ct.Theme); !present {
+		names := themeNames()
+		if len(names) == 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "no named themes are configured")
+		} else {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "unknown theme %q; must be one of %s", ct.Theme, strings.Join(names, ", "))
+		}
+		return
+	}
+	ct.Title = strings.TrimSpace(ct.Title)
+	if ct.FooterLinks == nil {
+		ct.FooterLinks = []ThemeLink{}
+	}
+	own := Theme{Title: ct.Title, LogoURL: ct.LogoURL, AccentColor: ct.AccentColor, FooterLinks: ct.FooterLinks}
+	if err := own.Validate(); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	old := new(CourseTheme)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM course_themes WHERE course_id = ?`, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		ct.CreatedAt = now
+	} else {
+		ct.CreatedAt = old.CreatedAt
+	}
+	ct.CourseID = courseID
+	ct.UpdatedAt = now
+
+	if _, err := tx.Exec(`DELETE FROM course_themes WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "course_themes", &ct); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &ct)
+}
+
+// DeleteCourseTheme handles requests to /courses/:course_id/theme,
+// returning the course to the default theme.
+func DeleteCourseTheme(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	courseID, ok := loadGradePolicyCourse(w, tx, params, currentUser)
+	if !ok {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM course_themes WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+}
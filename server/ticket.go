@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// socketTicketLifetime is how long a client has to open a grading socket
+// after the TA signs its commit.
+const socketTicketLifetime = 2 * time.Minute
+
+// problemTicketLifetime is how long an author has to open the grading socket
+// for each step of a problem. The steps are graded one after another, so the
+// last one may be opened well after the TA signed them all.
+const problemTicketLifetime = 30 * time.Minute
+
+// socketTicket is issued by the TA with a signed commit bundle and presented
+// by the client when it opens a grading socket. It lets the daycare turn away
+// connections the TA did not authorize before reading anything from them,
+// and ties the socket to one student's assignment and step. Each ticket can be used once.
+type socketTicket struct {
+	Hostname     string    `json:"hostname"`
+	ProblemType  string    `json:"problemType"`
+	Action       string    `json:"action"`
+	UserID       int64     `json:"userID"`
+	AssignmentID int64     `json:"assignmentID"`
+	ProblemID    int64     `json:"problemID"`
+	Step         int64     `json:"step"`
+	Expires      time.Time `json:"expires"`
+	Nonce        string    `json:"nonce"`
+}
+
+func ticketMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(Config.DaycareSecret))
+	mac.Write([]byte("socket ticket\n"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// issueSocketTicket returns a ticket to run the bundle's action on its assigned daycare.
+// The ticket must be used before it expires.
+func issueSocketTicket(bundle *CommitBundle, expires time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ticket := &socketTicket{
+		Hostname:     bundle.Hostname,
+		ProblemType:  bundle.ProblemType.Name,
+		Action:       bundle.Commit.Action,
+		UserID:       bundle.UserID,
+		AssignmentID: bundle.Commit.AssignmentID,
+		ProblemID:    bundle.Commit.ProblemID,
+		Step:         bundle.Commit.Step,
+		Expires:      expires,
+		Nonce:        base64.RawURLEncoding.EncodeToString(nonce),
+	}
+	payload, err := json.Marshal(ticket)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(ticketMAC(payload)), nil
+}
+
+// parseSocketTicket checks the signature and expiration of a ticket.
+func parseSocketTicket(s string, now time.Time) (*socketTicket, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed ticket")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket signature: %v", err)
+	}
+	if !hmac.Equal(sig, ticketMAC(payload)) {
+		return nil, fmt.Errorf("ticket signature mismatch")
+	}
+	ticket := new(socketTicket)
+	if err := json.Unmarshal(payload, ticket); err != nil {
+		return nil, fmt.Errorf("malformed ticket: %v", err)
+	}
+	if now.After(ticket.Expires) {
+		return nil, fmt.Errorf("ticket expired %v ago", now.Sub(ticket.Expires).Round(time.Second))
+	}
+	return ticket, nil
+}
+
+// check reports an error if the ticket was not issued for the given request.
+func (ticket *socketTicket) check(problemType, action string) error {
+	if ticket.Hostname != Config.Hostname {
+		return fmt.Errorf("ticket is for host %s, this is %s", ticket.Hostname, Config.Hostname)
+	}
+	if ticket.ProblemType != problemType || ticket.Action != action {
+		return fmt.Errorf("ticket is for %s %s, not %s %s", ticket.ProblemType, ticket.Action, problemType, action)
+	}
+	return nil
+}
+
+// checkBundle reports an error if the bundle is not the one the ticket was issued for.
+func (ticket *socketTicket) checkBundle(bundle *CommitBundle) error {
+	commit := bundle.Commit
+	if bundle.UserID != ticket.UserID || commit.AssignmentID != ticket.AssignmentID ||
+		commit.ProblemID != ticket.ProblemID || commit.Step != ticket.Step {
+		return fmt.Errorf("ticket is for user %d assignment %d problem %d step %d, "+
+			"but the commit is from user %d for assignment %d problem %d step %d",
+			ticket.UserID, ticket.AssignmentID, ticket.ProblemID, ticket.Step,
+			bundle.UserID, commit.AssignmentID, commit.ProblemID, commit.Step)
+	}
+	return nil
+}
+
+// ticketSet remembers tickets that have been used until they expire.
+type ticketSet struct {
+	sync.Mutex
+	used map[string]time.Time
+}
+
+var usedTickets = ticketSet{used: make(map[string]time.Time)}
+
+// claim marks a ticket as used, returning false if it already was.
+func (s *ticketSet) claim(ticket *socketTicket, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	for nonce, expires := range s.used {
+		if now.After(expires) {
+			delete(s.used, nonce)
+		}
+	}
+	if _, used := s.used[ticket.Nonce]; used {
+		return false
+	}
+	s.used[ticket.Nonce] = ticket.Expires
+	return true
+}
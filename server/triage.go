@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Failure labels assigned to graded commits that did not pass.
+const (
+	failureTimeout     = "timeout"
+	failureCompile     = "compile-error"
+	failureCrashed     = "crashed"
+	failureStyleOnly   = "style-only"
+	failureBanned      = "banned"
+	failureMissing     = "missing"
+	failureWrongOutput = "wrong-output"
+	failureOther       = "other"
+)
+
+var failureLabels = []string{failureTimeout, failureCompile, failureCrashed, failureStyleOnly, failureBanned, failureMissing, failureWrongOutput, failureOther}
+
+// compileErrorPattern matches the diagnostics that compilers and interpreters
+// print when the code cannot be built or loaded at all.
+var compileErrorPattern = regexp.MustCompile(`(?m)(^[^\s:]+:\d+(:\d+)?: (fatal )?error:|\bSyntaxError\b|\bIndentationError\b|\bTabError\b|^error(\[E\d+\])?:|\bcannot find symbol\b|\bundefined reference to\b|\bcompilation terminated\b|\bParseError\b)`)
+
+// styleTestPattern matches the names of tests that check style rather than behavior.
+var styleTestPattern = regexp.MustCompile(`(?i)(style|lint|pep8|pycodestyle|flake8|format|checkstyle)`)
+
+// triageCommit classifies why a graded commit failed. It returns an empty
+// string for commits that were not graded or that passed.
+func triageCommit(commit *Commit) string {
+	rc := commit.ReportCard
+	if commit.Action != "grade" || rc == nil || rc.Passed {
+		return ""
+	}
+
+	// gather what the transcript says about how the commands ended
+	var output strings.Builder
+	signaled := false
+	for _, event := range commit.Transcript {
+		switch event.Event {
+		case "error":
+			if strings.Contains(event.Error, "reaching the time limit") {
+				return failureTimeout
+			}
+		case "exit":
+			if event.ExitStatus > 128 {
+				signaled = true
+			}
+		case "stdout", "stderr":
+			output.Write(event.StreamData)
+		}
+	}
+
+	// banned names and missing requirements stop the tests from running at all
+	for _, result := range rc.Results {
+		switch result.Outcome {
+		case "banned":
+			return failureBanned
+		case "missing":
+			return failureMissing
+		}
+	}
+
+	passed, failed, errored, style := 0, 0, 0, 0
+	for _, result := range rc.Results {
+		switch result.Outcome {
+		case "passed":
+			passed++
+			continue
+		case "failed":
+			failed++
+		case "error":
+			errored++
+		default:
+			continue
+		}
+		if styleTestPattern.MatchString(result.Name) {
+			style++
+		}
+	}
+
+	switch {
+	case passed == 0 && compileErrorPattern.MatchString(output.String()):
+		return failureCompile
+	case signaled || errored > 0 || strings.HasPrefix(rc.Note, "Crashed"):
+		return failureCrashed
+	case failed > 0 && style == failed:
+		return failureStyleOnly
+	case failed > 0:
+		return failureWrongOutput
+	default:
+		return failureOther
+	}
+}
+
+// FailedCommit is a summary of a graded commit that did not pass, with its failure label.
+type FailedCommit struct {
+	CommitID     int64     `json:"commitID" meddler:"commit_id"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	CanvasTitle  string    `json:"canvasTitle" meddler:"canvas_title"`
+	UserID       int64     `json:"userID" meddler:"user_id"`
+	UserName     string    `json:"userName" meddler:"user_name"`
+	UserEmail    string    `json:"userEmail" meddler:"user_email"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	FailureLabel string    `json:"failureLabel" meddler:"failure_label"`
+	Score        float64   `json:"score" meddler:"score,zeroisnull"`
+	UpdatedAt    time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// GetCourseFailedCommits handles requests to /courses/:course_id/failed_commits,
+// returning a summary of each student commit in the course whose latest grading failed.
+// Results can be filtered by problem_id, step, label, section_id, and a since/until time range (RFC 3339).
+// TAs assigned to sections only see their own students.
+// Only administrators and instructors of the course may request it.
+func GetCourseFailedCommits(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, courseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an instructor for course %d", currentUser.ID, currentUser.Email, courseID)
+			return
+		}
+	}
+
+	where := ` WHERE assignments.course_id = ? AND commits.failure_label IS NOT NULL`
+	args := []interface{}{courseID}
+	for _, field := range []string{"problem_id", "step"} {
+		s := r.FormValue(field)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s: %v", field, err)
+			return
+		}
+		where += " AND commits." + field + " = ?"
+		args = append(args, n)
+	}
+	if label := r.FormValue("label"); label != "" {
+		known := false
+		for _, elt := range failureLabels {
+			known = known || elt == label
+		}
+		if !known {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "unknown failure label %q; must be one of %s", label, strings.Join(failureLabels, ", "))
+			return
+		}
+		where += " AND commits.failure_label = ?"
+		args = append(args, label)
+	}
+	for _, elt := range []struct{ field, op string }{{"since", ">="}, {"until", "<"}} {
+		s := r.FormValue(elt.field)
+		if s == "" {
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s: %v", elt.field, err)
+			return
+		}
+		where += " AND commits.updated_at " + elt.op + " ?"
+		args = append(args, when.Local())
+	}
+	scope, scopeArgs, ok := sectionWhere(w, r, tx, courseID, currentUser)
+	if !ok {
+		return
+	}
+	where += scope
+	args = append(args, scopeArgs...)
+
+	commits := []*FailedCommit{}
+	if err := meddler.QueryAll(tx, &commits, `SELECT commits.id AS commit_id, commits.assignment_id, assignments.canvas_title, `+
+		`users.id AS user_id, users.name AS user_name, users.email AS user_email, `+
+		`commits.problem_id, commits.step, commits.failure_label, commits.score, commits.updated_at `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`JOIN users ON assignments.user_id = users.id`+where+
+		` ORDER BY commits.updated_at`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, commits)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+const (
+	// tripwireInterval is how often a running container is checked for suspicious activity.
+	tripwireInterval = 5 * time.Second
+
+	// tripwireForkRate is the most new processes per second a container may start.
+	tripwireForkRate = 200
+
+	// tripwireCheckProcesses is about how many processes each check starts in the container.
+	tripwireCheckProcesses = 10
+
+	// containerAlertHistory is the number of alerts returned to administrators.
+	containerAlertHistory = 100
+)
+
+// tripwireScript gathers what the tripwires look at inside a container, in sections
+// separated by @@ lines: the last process ID handed out, the network interfaces,
+// the open sockets, and any sign of a container engine socket. It runs as the
+// student so it can see the file descriptors of the student's processes.
+const tripwireScript = `cat /proc/loadavg; echo @@; ` +
+	`cat /proc/net/dev; echo @@; ` +
+	`cat /proc/net/tcp /proc/net/tcp6 /proc/net/udp /proc/net/udp6 2>/dev/null; echo @@; ` +
+	`ls -l /proc/[0-9]*/fd 2>/dev/null | grep -e docker.sock -e containerd.sock -e podman.sock; ` +
+	`ls -d /var/run/docker.sock /run/docker.sock /run/containerd/containerd.sock /run/podman/podman.sock 2>/dev/null; ` +
+	`true`
+
+// ContainerAlert is reported by a daycare to the TA when a tripwire stops a grading job.
+type ContainerAlert struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	Hostname     string    `json:"hostname" meddler:"hostname"`
+	ContainerID  string    `json:"containerID" meddler:"container_id"`
+	UserID       int64     `json:"userID" meddler:"user_id"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	ProblemType  string    `json:"problemType" meddler:"problem_type"`
+	Action       string    `json:"action" meddler:"action"`
+	Kind         string    `json:"kind" meddler:"kind"`
+	Detail       string    `json:"detail" meddler:"detail"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	Signature    string    `json:"signature,omitempty" meddler:"-"`
+}
+
+func (alert *ContainerAlert) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", alert.Hostname)
+	v.Add("container_id", alert.ContainerID)
+	v.Add("user_id", strconv.FormatInt(alert.UserID, 10))
+	v.Add("assignment_id", strconv.FormatInt(alert.AssignmentID, 10))
+	v.Add("problem_id", strconv.FormatInt(alert.ProblemID, 10))
+	v.Add("step", strconv.FormatInt(alert.Step, 10))
+	v.Add("problem_type", alert.ProblemType)
+	v.Add("action", alert.Action)
+	v.Add("kind", alert.Kind)
+	v.Add("detail", alert.Detail)
+	v.Add("created_at", alert.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// tripwires follows one grading session's containers between checks.
+type tripwires struct {
+	containerID string
+	lastPID     int64
+	lastCheck   time.Time
+}
+
+// check inspects a container and returns the kind and details of anything suspicious.
+func (t *tripwires) check(n *Nanny, now time.Time) (string, string, error) {
+	output, err := exec.Command(containerEngine, "exec", "--user", n.user(), n.ID, "sh", "-c", tripwireScript).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("checking container %s: %v", n.ID, err)
+	}
+	sections := strings.Split(string(output), "@@\n")
+	if len(sections) != 4 {
+		return "", "", fmt.Errorf("checking container %s: found %d sections instead of 4", n.ID, len(sections))
+	}
+
+	// engine sockets
+	if found := strings.TrimSpace(sections[3]); found != "" {
+		return "engine-socket", "container engine socket found: " + strings.SplitN(found, "\n", 2)[0], nil
+	}
+
+	// network interfaces and connections, which should not exist with networking disabled
+	for _, line := range strings.Split(sections[1], "\n") {
+		name := strings.TrimSpace(strings.SplitN(line, ":", 2)[0])
+		if strings.Contains(line, ":") && !strings.Contains(name, "|") && name != "lo" {
+			return "network", fmt.Sprintf("network interface %s is present although networking is disabled", name), nil
+		}
+	}
+	for _, line := range strings.Split(sections[2], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] == "sl" {
+			continue
+		}
+		if remote := strings.SplitN(fields[2], ":", 2)[0]; !localAddress(remote) {
+			return "network", fmt.Sprintf("connection to remote address %s", fields[2]), nil
+		}
+	}
+
+	// fork rate, from the most recent process ID given out in the container
+	loadavg := strings.Fields(sections[0])
+	if len(loadavg) < 5 {
+		return "", "", fmt.Errorf("checking container %s: unexpected loadavg %q", n.ID, sections[0])
+	}
+	pid, err := strconv.ParseInt(loadavg[4], 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("checking container %s: unexpected loadavg %q", n.ID, sections[0])
+	}
+	if t.containerID == n.ID && pid > t.lastPID {
+		rate := float64(pid-t.lastPID-tripwireCheckProcesses) / now.Sub(t.lastCheck).Seconds()
+		if rate > tripwireForkRate {
+			return "fork-rate", fmt.Sprintf("started %.0f processes per second", rate), nil
+		}
+	}
+	t.containerID, t.lastPID, t.lastCheck = n.ID, pid, now
+	return "", "", nil
+}
+
+// localAddress reports whether a hex address from /proc/net is unset or loopback.
+func localAddress(hex string) bool {
+	switch len(hex) {
+	case 8:
+		// IPv4 in host (little-endian) byte order, so the first octet comes last
+		return hex == "00000000" || strings.HasSuffix(hex, "7F")
+	case 32:
+		return hex == "00000000000000000000000000000000" ||
+			hex == "00000000000000000000000001000000" ||
+			(strings.HasPrefix(hex, "0000000000000000FFFF0000") && strings.HasSuffix(hex, "7F"))
+	}
+	return false
+}
+
+// watchTripwires checks a session's container for signs of an escape attempt until stop is closed.
+// A session that trips a wire is stopped and reported to the TA.
+func watchTripwires(session *GradingSession, stop <-chan struct{}) {
+	t := new(tripwires)
+	ticker := time.NewTicker(tripwireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			n := activeSessions.current(session)
+			if n == nil || n.OS == "windows" {
+				continue
+			}
+			kind, detail, err := t.check(n, now)
+			if err != nil {
+				// the container may have just finished
+				n.Job.logf("tripwire: %v", err)
+				continue
+			}
+			if kind == "" {
+				continue
+			}
+			n.Job.event("tripwire", "%s: %s", kind, detail)
+			log.Printf("tripwire: stopping %s (%s) for user %d: %s", session.Name, n.ID, session.UserID, detail)
+			activeSessions.stop(session, "stopped because of suspicious activity ("+detail+")")
+			reportContainerAlert(session, n.ID, kind, detail)
+			return
+		}
+	}
+}
+
+// reportContainerAlert signs an alert and sends it to the TA.
+func reportContainerAlert(session *GradingSession, containerID, kind, detail string) {
+	alert := &ContainerAlert{
+		Hostname:     Config.Hostname,
+		ContainerID:  containerID,
+		UserID:       session.UserID,
+		AssignmentID: session.AssignmentID,
+		ProblemID:    session.ProblemID,
+		Step:         session.Step,
+		ProblemType:  session.ProblemType,
+		Action:       session.Action,
+		Kind:         kind,
+		Detail:       detail,
+		CreatedAt:    time.Now(),
+	}
+	alert.Signature = alert.ComputeSignature(Config.DaycareSecret)
+	go func() {
+		if err := postToTA("/container_alerts", alert, nil); err != nil {
+			log.Printf("error posting container alert: %v", err)
+		}
+	}()
+}
+
+// PostContainerAlert handles requests to /container_alerts,
+// recording a grading job stopped by a tripwire on a daycare.
+func PostContainerAlert(w http.ResponseWriter, tx *sql.Tx, alert ContainerAlert) {
+	sig := alert.ComputeSignature(Config.DaycareSecret)
+	if sig != alert.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "container alert signature mismatch: computed %s but found %s", sig, alert.Signature)
+		return
+	}
+	drift := time.Since(alert.CreatedAt)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "container alert is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+
+	alert.ID = 0
+	alert.CreatedAt = time.Now()
+	if err := meddler.Insert(tx, "container_alerts", &alert); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("ALERT: daycare %s stopped a job for user %d on problem %d step %d: %s: %s",
+		alert.Hostname, alert.UserID, alert.ProblemID, alert.Step, alert.Kind, alert.Detail)
+}
+
+// GetContainerAlerts handles requests to /container_alerts,
+// returning the most recent tripwire alerts from all daycares, newest first.
+func GetContainerAlerts(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	alerts := []*ContainerAlert{}
+	if err := meddler.QueryAll(tx, &alerts, `SELECT * FROM container_alerts ORDER BY id DESC LIMIT ?`, containerAlertHistory); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, alerts)
+}
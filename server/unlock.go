@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// StepUnlock records an instructor letting a student move on to a step
+// without passing the steps before it, e.g., when a grader bug blocked them.
+// Unpassed steps before an unlocked step are left out of the score.
+type StepUnlock struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	UserID       int64     `json:"userID" meddler:"user_id"`
+	Note         string    `json:"note" meddler:"note"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// unlockedStep returns the highest step an instructor has unlocked for a problem in an assignment,
+// or zero if there are no unlocks.
+func unlockedStep(tx *sql.Tx, assignmentID, problemID int64) (int64, error) {
+	var step int64
+	err := tx.QueryRow(`SELECT COALESCE(MAX(step), 0) FROM step_unlocks WHERE assignment_id = ? AND problem_id = ?`,
+		assignmentID, problemID).Scan(&step)
+	return step, err
+}
+
+// GetAssignmentStepUnlocks handles requests to /assignments/:assignment_id/step_unlocks,
+// returning the list of steps unlocked for the assignment.
+// Students can see the unlocks for their own assignments.
+func GetAssignmentStepUnlocks(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if assignment.UserID != currentUser.ID && !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, assignment.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+
+	unlocks := []*StepUnlock{}
+	if err := meddler.QueryAll(tx, &unlocks, `SELECT * FROM step_unlocks WHERE assignment_id = ? ORDER BY problem_id, step`, assignment.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, unlocks)
+}
+
+// PostAssignmentStepUnlock handles requests to /assignments/:assignment_id/step_unlocks,
+// letting the student start the given step of a problem without passing the steps before it.
+// The student is moved to the start of the unlocked step and the assignment score is recomputed.
+// Only instructors of the course can unlock steps.
+func PostAssignmentStepUnlock(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, unlock StepUnlock, render render.Render) {
+	now := time.Now()
+
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !currentUser.Admin {
+		isInstructor, err := isCourseInstructor(tx, assignment.CourseID, currentUser.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !isInstructor {
+			loggedHTTPErrorf(w, http.StatusForbidden, "only an instructor of the course can unlock steps")
+			return
+		}
+	}
+
+	// make sure the step belongs to the assignment
+	problem := new(Problem)
+	if err := meddler.QueryRow(tx, problem, `SELECT problems.* FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = ? AND problems.id = ?`, assignment.ProblemSetID, unlock.ProblemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if unlock.Step < 2 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "step %d cannot be unlocked; only steps after the first can be", unlock.Step)
+		return
+	}
+	step := new(ProblemStep)
+	if err := meddler.QueryRow(tx, step, `SELECT * FROM problem_steps WHERE problem_id = ? AND step = ?`, problem.ID, unlock.Step); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := loadStepFiles(step); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	var latestStep int64
+	if err := tx.QueryRow(`SELECT step FROM commits WHERE assignment_id = ? AND problem_id = ? ORDER BY step DESC LIMIT 1`,
+		assignment.ID, problem.ID).Scan(&latestStep); err != nil && err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if latestStep >= unlock.Step {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "student has already started work on step %d", latestStep)
+		return
+	}
+
+	unlock.ID = 0
+	unlock.AssignmentID = assignment.ID
+	unlock.UserID = currentUser.ID
+	unlock.CreatedAt = now
+	if err := meddler.Insert(tx, "step_unlocks", &unlock); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// start the student on the unlocked step
+	files, err := stepStarterFiles(tx, assignment.ID, step)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	commit := &Commit{
+		AssignmentID: assignment.ID,
+		ProblemID:    problem.ID,
+		Step:         step.Step,
+		Note:         fmt.Sprintf("step %d unlocked by an instructor", step.Step),
+		Files:        files,
+		Transcript:   []*EventMessage{},
+		RemoteAddr:   clientIP(r),
+		UserAgent:    r.UserAgent(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := commit.Normalize(now, step.Whitelist); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	saved, err := storeCommitBlobs(tx, assignment.CourseID, commit)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "commits", saved); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	commit.ID = saved.ID
+	if err := recordCommitHash(tx, commit, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error recording commit hash: %v", err)
+		return
+	}
+	if err := updateAssignmentSummary(tx, commit.AssignmentID, commit.ProblemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error updating assignment summary: %v", err)
+		return
+	}
+	if err := indexCommitFiles(tx, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error indexing commit files: %v", err)
+		return
+	}
+
+	// skipped steps no longer count against the student
+	changed, err := rescoreAssignment(tx, assignment, "unlock", now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if changed {
+		report := fmt.Sprintf("<h1>Step %d of problem %s was unlocked by an instructor</h1>\n<p>%s</p>\n",
+			step.Step, html.EscapeString(problem.Unique), html.EscapeString(unlock.Note))
+		go saveGradeWithRetries(assignment, report)
+	}
+	log.Printf("user %d (%s) unlocked assignment %d problem %d step %d",
+		currentUser.ID, currentUser.Email, assignment.ID, problem.ID, step.Step)
+
+	render.JSON(http.StatusOK, &unlock)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// GradingUsage records the resources consumed by one container run on a daycare.
+// MemorySeconds is the peak memory use in megabytes multiplied by the wall-clock run time.
+type GradingUsage struct {
+	ID            int64     `json:"id" meddler:"id,pk"`
+	Hostname      string    `json:"hostname" meddler:"hostname"`
+	CourseID      int64     `json:"courseID" meddler:"course_id"`
+	AssignmentID  int64     `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID     int64     `json:"problemID" meddler:"problem_id"`
+	Step          int64     `json:"step" meddler:"step"`
+	ProblemType   string    `json:"problemType" meddler:"problem_type"`
+	Action        string    `json:"action" meddler:"action"`
+	CPUSeconds    float64   `json:"cpuSeconds" meddler:"cpu_seconds"`
+	MemorySeconds float64   `json:"memorySeconds" meddler:"memory_seconds"`
+	WallSeconds   float64   `json:"wallSeconds" meddler:"wall_seconds"`
+	CreatedAt     time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	Signature     string    `json:"signature,omitempty" meddler:"-"`
+}
+
+func (usage *GradingUsage) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("hostname", usage.Hostname)
+	v.Add("assignment_id", strconv.FormatInt(usage.AssignmentID, 10))
+	v.Add("problem_id", strconv.FormatInt(usage.ProblemID, 10))
+	v.Add("step", strconv.FormatInt(usage.Step, 10))
+	v.Add("problem_type", usage.ProblemType)
+	v.Add("action", usage.Action)
+	v.Add("cpu_seconds", strconv.FormatFloat(usage.CPUSeconds, 'g', -1, 64))
+	v.Add("memory_seconds", strconv.FormatFloat(usage.MemorySeconds, 'g', -1, 64))
+	v.Add("wall_seconds", strconv.FormatFloat(usage.WallSeconds, 'g', -1, 64))
+	v.Add("created_at", usage.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// CourseQuota limits the grading resources a course may use each calendar month.
+// A zero limit means that resource is not limited.
+type CourseQuota struct {
+	CourseID      int64     `json:"courseID" meddler:"course_id"`
+	MaxCPUSeconds float64   `json:"maxCPUSeconds" meddler:"max_cpu_seconds"`
+	MaxJobs       int64     `json:"maxJobs" meddler:"max_jobs"`
+	CreatedAt     time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt     time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// UsageSummary totals grading usage for one course and problem.
+type UsageSummary struct {
+	CourseID      int64   `json:"courseID" meddler:"course_id"`
+	ProblemID     int64   `json:"problemID" meddler:"problem_id"`
+	Jobs          int64   `json:"jobs" meddler:"jobs"`
+	CPUSeconds    float64 `json:"cpuSeconds" meddler:"cpu_seconds"`
+	MemorySeconds float64 `json:"memorySeconds" meddler:"memory_seconds"`
+	WallSeconds   float64 `json:"wallSeconds" meddler:"wall_seconds"`
+}
+
+// Usage reports the CPU time and peak memory (in bytes) used so far by the container.
+// It reads the container's cgroup accounting, trying cgroup v2 files before v1.
+func (n *Nanny) Usage() (cpu time.Duration, memory int64, err error) {
+	if n.OS == "windows" {
+		return 0, 0, fmt.Errorf("usage is not measured for windows containers")
+	}
+	read := func(names ...string) (string, error) {
+		for _, name := range names {
+			out, err := exec.Command(containerEngine, "exec", n.ID, "cat", name).Output()
+			if err == nil {
+				return strings.TrimSpace(string(out)), nil
+			}
+		}
+		return "", fmt.Errorf("none of %s found in container %s", strings.Join(names, ", "), n.Name)
+	}
+
+	stat, err := read("/sys/fs/cgroup/cpu.stat", "/sys/fs/cgroup/cpuacct/cpuacct.usage")
+	if err != nil {
+		return 0, 0, err
+	}
+	if fields := strings.Fields(stat); len(fields) == 1 {
+		// cgroup v1 reports nanoseconds
+		nanos, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("parsing cpu usage %q: %v", stat, err)
+		}
+		cpu = time.Duration(nanos)
+	} else {
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == "usage_usec" {
+				micros, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return 0, 0, fmt.Errorf("parsing cpu usage %q: %v", fields[i+1], err)
+				}
+				cpu = time.Duration(micros) * time.Microsecond
+			}
+		}
+	}
+
+	peak, err := read("/sys/fs/cgroup/memory.peak", "/sys/fs/cgroup/memory/memory.max_usage_in_bytes")
+	if err != nil {
+		return 0, 0, err
+	}
+	if memory, err = strconv.ParseInt(peak, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("parsing memory usage %q: %v", peak, err)
+	}
+	return cpu, memory, nil
+}
+
+// reportUsage measures the resources used by a container and reports them to the TA.
+// It must be called before the container is shut down.
+func reportUsage(n *Nanny, commit *Commit, problemType, action string) {
+	cpu, memory, err := n.Usage()
+	if err != nil {
+		log.Printf("error measuring container usage: %v", err)
+		return
+	}
+	wall := time.Since(n.Start).Seconds()
+	usage := &GradingUsage{
+		Hostname:      Config.Hostname,
+		AssignmentID:  commit.AssignmentID,
+		ProblemID:     commit.ProblemID,
+		Step:          commit.Step,
+		ProblemType:   problemType,
+		Action:        action,
+		CPUSeconds:    cpu.Seconds(),
+		MemorySeconds: float64(memory) / (1024 * 1024) * wall,
+		WallSeconds:   wall,
+		CreatedAt:     time.Now(),
+	}
+	usage.Signature = usage.ComputeSignature(Config.DaycareSecret)
+
+	go func() {
+		if err := postToTA("/grading_usage", usage, nil); err != nil {
+			log.Printf("error posting grading usage: %v", err)
+		}
+	}()
+}
+
+// checkCourseQuota explains why a course cannot run more grading jobs this month,
+// or returns "" if it is within its quota.
+func checkCourseQuota(tx *sql.Tx, courseID int64, now time.Time) (string, error) {
+	quota := new(CourseQuota)
+	if err := meddler.QueryRow(tx, quota, `SELECT * FROM course_quotas WHERE course_id = ?`, courseID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	var jobs int64
+	var cpuSeconds float64
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	if err := tx.QueryRow(`SELECT COUNT(1), COALESCE(SUM(cpu_seconds), 0.0) FROM grading_usage WHERE course_id = ? AND created_at >= ?`,
+		courseID, start).Scan(&jobs, &cpuSeconds); err != nil {
+		return "", err
+	}
+	if quota.MaxJobs > 0 && jobs >= quota.MaxJobs {
+		return fmt.Sprintf("this course has used all %d of its grading jobs for the month", quota.MaxJobs), nil
+	}
+	if quota.MaxCPUSeconds > 0 && cpuSeconds >= quota.MaxCPUSeconds {
+		return fmt.Sprintf("this course has used all %g of its grading CPU seconds for the month", quota.MaxCPUSeconds), nil
+	}
+	return "", nil
+}
+
+// PostGradingUsage handles requests to /grading_usage,
+// recording container usage reported by a daycare.
+func PostGradingUsage(w http.ResponseWriter, tx *sql.Tx, usage GradingUsage) {
+	sig := usage.ComputeSignature(Config.DaycareSecret)
+	if sig != usage.Signature {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grading usage signature mismatch: computed %s but found %s", sig, usage.Signature)
+		return
+	}
+	drift := time.Since(usage.CreatedAt)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grading usage is %v old, cannot be more than %v", drift, MaxDaycareRequestAge)
+		return
+	}
+
+	// attribute the usage to the course the assignment belongs to
+	if err := tx.QueryRow(`SELECT course_id FROM assignments WHERE id = ?`, usage.AssignmentID).Scan(&usage.CourseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	usage.ID = 0
+	usage.CreatedAt = time.Now()
+	if err := meddler.Insert(tx, "grading_usage", &usage); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// GetGradingUsageReport handles requests to /grading_usage/report,
+// returning usage totals grouped by course and problem.
+//
+// If parameter course_id=<...> present, results will be filtered by matching course.
+// If parameters since=<...> or until=<...> are present (RFC 3339 format),
+// only usage recorded in that time range is included.
+func GetGradingUsageReport(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := ""
+	args := []interface{}{}
+	if s := r.FormValue("course_id"); s != "" {
+		courseID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing course_id: %v", err)
+			return
+		}
+		where, args = addWhereEq(where, args, "course_id", courseID)
+	}
+	for _, elt := range []struct{ field, op string }{{"since", ">="}, {"until", "<"}} {
+		s := r.FormValue(elt.field)
+		if s == "" {
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s: %v", elt.field, err)
+			return
+		}
+		if where == "" {
+			where = " WHERE"
+		} else {
+			where += " AND"
+		}
+		where += " created_at " + elt.op + " ?"
+		args = append(args, when.Local())
+	}
+
+	summaries := []*UsageSummary{}
+	if err := meddler.QueryAll(tx, &summaries, `SELECT course_id, problem_id, COUNT(1) AS jobs, `+
+		`SUM(cpu_seconds) AS cpu_seconds, SUM(memory_seconds) AS memory_seconds, SUM(wall_seconds) AS wall_seconds `+
+		`FROM grading_usage`+where+` GROUP BY course_id, problem_id ORDER BY course_id, problem_id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, summaries)
+}
+
+// GetCourseQuota handles requests to /courses/:course_id/quota,
+// returning the grading quota for the course.
+func GetCourseQuota(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	quota := new(CourseQuota)
+	if err := meddler.QueryRow(tx, quota, `SELECT * FROM course_quotas WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, quota)
+}
+
+// PutCourseQuota handles requests to /courses/:course_id/quota,
+// setting the monthly grading quota for the course.
+func PutCourseQuota(w http.ResponseWriter, tx *sql.Tx, params martini.Params, quota CourseQuota, render render.Render) {
+	now := time.Now()
+
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	if quota.MaxCPUSeconds < 0 || quota.MaxJobs < 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "quota limits cannot be negative")
+		return
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	old := new(CourseQuota)
+	if err := meddler.QueryRow(tx, old, `SELECT * FROM course_quotas WHERE course_id = ?`, courseID); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		quota.CreatedAt = now
+	} else {
+		quota.CreatedAt = old.CreatedAt
+	}
+	quota.CourseID = courseID
+	quota.UpdatedAt = now
+
+	if _, err := tx.Exec(`DELETE FROM course_quotas WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "course_quotas", &quota); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &quota)
+}
+
+// DeleteCourseQuota handles requests to /courses/:course_id/quota,
+// removing the grading quota for the course.
+func DeleteCourseQuota(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(`DELETE FROM course_quotas WHERE course_id = ?`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
@@ -167,14 +168,18 @@ func GetUserMe(w http.ResponseWriter, tx *sql.Tx, currentUser *User, render rend
 //
 // Parameter key=<...> must be present, and must be a valid session key that was issued
 // within the last 5 minutes. The key is deleted after its first use.
-func GetUserSession(w http.ResponseWriter, r *http.Request, render render.Render) {
+func GetUserSession(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
 	key := r.FormValue("key")
 	if key == "" {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "missing key= parameter")
 		return
 	}
-	userID, err := loginRecords.Get(key)
+	if throttleAuth(w, r, "") {
+		return
+	}
+	userID, err := loginRecords.Get(tx, key)
 	if err != nil {
+		recordAuthFailure(r, "login", "", err.Error())
 		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
 		return
 	}
@@ -333,6 +338,20 @@ func GetUserAssignments(w http.ResponseWriter, tx *sql.Tx, params martini.Params
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if userID == currentUser.ID {
+		if err := attachAnnouncements(tx, currentUser.ID, assignments...); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := attachDeadlines(tx, assignments...); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := attachOrders(tx, assignments...); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
 
 	render.JSON(http.StatusOK, assignments)
 }
@@ -399,6 +418,18 @@ func GetAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cur
 		loggedHTTPDBNotFoundError(w, err)
 		return
 	}
+	if err := attachAnnouncements(tx, currentUser.ID, assignment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := attachDeadlines(tx, assignment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := attachOrders(tx, assignment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, assignment)
 }
@@ -445,6 +476,10 @@ func GetAssignmentProblemCommitLast(w http.ResponseWriter, tx *sql.Tx, params ma
 		loggedHTTPDBNotFoundError(w, err)
 		return
 	}
+	if err := loadCommitBlobs(commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, commit)
 }
@@ -481,6 +516,41 @@ func GetAssignmentProblemStepCommitLast(w http.ResponseWriter, tx *sql.Tx, param
 		loggedHTTPDBNotFoundError(w, err)
 		return
 	}
+	if err := loadCommitBlobs(commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, commit)
+}
+
+// GetCommit handles requests to /commits/:commit_id,
+// returning a single commit with its files.
+func GetCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return
+	}
+
+	commit := new(Commit)
+
+	if currentUser.Admin {
+		err = meddler.Load(tx, "commits", commit, commitID)
+	} else {
+		err = meddler.QueryRow(tx, commit, `SELECT commits.* `+
+			`FROM commits JOIN user_assignments ON commits.assignment_id = user_assignments.assignment_id `+
+			`WHERE commits.id = ? AND user_assignments.user_id = ?`,
+			commitID, currentUser.ID)
+	}
+
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := loadCommitBlobs(commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, commit)
 }
@@ -493,16 +563,27 @@ func DeleteCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
 		return
 	}
 
+	var assignmentID, problemID int64
+	if err := tx.QueryRow(`SELECT assignment_id, problem_id FROM commits WHERE id = ?`, commitID).Scan(&assignmentID, &problemID); err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 	if _, err = tx.Exec(`DELETE FROM commits WHERE id = ?`, commitID); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err := updateAssignmentSummary(tx, assignmentID, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error updating assignment summary: %v", err)
+		return
+	}
 }
 
 // PostCommitBundlesUnsigned handles requests to /commit_bundles/unsigned,
 // saving a new commit (or updating the most recent one), gathering the problem data,
 // signing everything, and returning it in a form ready to send to the daycare.
-func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+func PostCommitBundlesUnsigned(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
 	now := time.Now()
 
 	if bundle.Commit == nil {
@@ -526,13 +607,13 @@ func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *U
 	bundle.Commit.Score = 0.0
 	bundle.Commit.CreatedAt = now
 	bundle.Commit.UpdatedAt = now
-	saveCommitBundleCommon(now, w, tx, currentUser, bundle, render)
+	saveCommitBundleCommon(now, w, clientIP(r), r.UserAgent(), tx, currentUser, bundle, render)
 }
 
 // PostCommitBundlesSigned handles requests to /commit_bundles/signed,
 // saving a new commit (or updating the most recent one), gathering the problem data,
 // verifying signatures, and posting a grade (if appropriate).
-func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+func PostCommitBundlesSigned(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
 	now := time.Now()
 
 	if bundle.Commit == nil {
@@ -543,10 +624,33 @@ func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include commit signature")
 		return
 	}
-	saveCommitBundleCommon(now, w, tx, currentUser, bundle, render)
+	saveCommitBundleCommon(now, w, clientIP(r), r.UserAgent(), tx, currentUser, bundle, render)
 }
 
-func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+// PostCommitBundlesDaycare handles requests to /commit_bundles/daycare,
+// saving a graded commit for a student whose client went away before the daycare finished.
+// The commit keeps the address and user agent it was submitted from.
+func PostCommitBundlesDaycare(w http.ResponseWriter, tx *sql.Tx, bundle CommitBundle, render render.Render) {
+	now := time.Now()
+
+	if bundle.Commit == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include a commit object")
+		return
+	}
+	if len(bundle.CommitSignature) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include commit signature")
+		return
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, bundle.UserID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	log.Printf("daycare %s is saving a graded commit for user %d (%s), whose client went away", bundle.Hostname, user.ID, user.Email)
+	saveCommitBundleCommon(now, w, bundle.Commit.RemoteAddr, bundle.Commit.UserAgent, tx, user, bundle, render)
+}
+
+func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, remoteAddr, userAgent string, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
 	if bundle.ProblemType != nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include a problem type object")
 		return
@@ -594,29 +698,20 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		return
 	}
 
-	// assignment cannot be past the lock date:
-	// * a student's lock at deadline is normally honored if present
-	// * however, if there is no course-wide lock at (attached to an instructor),
-	//   the student lock at is ignored on the assumption that the deadline was lifted course wide
-	// * if the student does not have an individual deadline but there is a course-wide deadline,
-	//   it is observed on the assumption that a deadline was imposed after the student started work
-	// to decide if a submission is past the deadline:
-	// * if there is no course-wide lock at, accept
-	// * else if the student has a lock at:
-	//     * if it is in the past, reject
-	//     * else accept
-	// * else if the course-wide lock at has passed, reject
-	// * else accept
-	var courseWideLockAt time.Time
-	err = tx.QueryRow(`SELECT lock_at FROM assignments WHERE instructor AND lti_id = ? AND lock_at IS NOT NULL ORDER BY lock_at DESC LIMIT 1`,
-		assignment.LtiID).Scan(&courseWideLockAt)
-	if err != nil && err != sql.ErrNoRows {
+	// assignment cannot be past the lock date (see assignmentLockAt for which one applies);
+	// the grace period absorbs clock skew between students and the server
+	lockAt, err := assignmentLockAt(tx, assignment)
+	if err != nil {
 		loggedHTTPDBNotFoundError(w, err)
 		return
-	} else if err == nil {
-		// there is a course-wide deadline, should we reject?
-		if (assignment.LockAt != nil && now.After(*assignment.LockAt)) ||
-			(assignment.LockAt == nil && now.After(courseWideLockAt)) {
+	}
+	if lockAt != nil {
+		grace, err := deadlineGrace(tx, assignment)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if now.After(lockAt.Add(grace)) {
 			course := new(Course)
 			err = meddler.Load(tx, "courses", course, assignment.CourseID)
 			if err != nil {
@@ -631,6 +726,45 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		}
 	}
 
+	// a course that has used up its grading quota cannot request more daycare time,
+	// but students can still save their work
+	if bundle.CommitSignature == "" && commit.Action != "" && !isInstructor {
+		exceeded, err := checkCourseQuota(tx, assignment.CourseID, now)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if exceeded != "" {
+			loggedHTTPErrorf(w, http.StatusForbidden, "%s", exceeded)
+			return
+		}
+	}
+
+	// practice checks are only available if the instructor allows them
+	if commit.Practice && !isInstructor {
+		allowed, err := practiceAllowed(tx, assignment)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !allowed {
+			loggedHTTPErrorf(w, http.StatusForbidden, "practice checks are not enabled for this assignment")
+			return
+		}
+	}
+
+	// some courses hold back assignments until their prerequisites are finished
+	if bundle.CommitSignature == "" && !isInstructor {
+		if err := attachOrders(tx, assignment); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if assignment.Order != nil && assignment.Order.Locked {
+			loggedHTTPErrorf(w, http.StatusForbidden, "this assignment is locked until you finish: %s", strings.Join(assignment.Order.Unmet, ", "))
+			return
+		}
+	}
+
 	// get the problem
 	problem := new(Problem)
 	if err = meddler.QueryRow(tx, problem, `SELECT * FROM problems WHERE id = ?`, commit.ProblemID); err != nil {
@@ -664,6 +798,10 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err = loadStepFiles(&step); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
 
 	// filter out solution
 	step.Solution = nil
@@ -680,8 +818,22 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 	}
 
 	// reject commit if a previous step remains incomplete
+	// (steps before one an instructor has unlocked do not count)
+	unlocked, err := unlockedStep(tx, commit.AssignmentID, commit.ProblemID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	best, err := bestStepScores(tx, commit.AssignmentID, commit.ProblemID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 	scores := assignment.RawScores[problem.Unique]
 	for i := 0; i < int(commit.Step)-1; i++ {
+		if int64(i+1) < unlocked || best[int64(i+1)] == 1.0 {
+			continue
+		}
 		if i >= len(scores) || scores[i] != 1.0 {
 			loggedHTTPErrorf(w, http.StatusBadRequest, "commit is for step %d, but user has not passed step %d", commit.Step, i+1)
 			return
@@ -700,12 +852,38 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		return
 	}
 
+	// reject graded submissions once the attempts for a step are used up
+	if step.MaxAttempts > 0 && !isInstructor && commit.Action == "grade" && !commit.Practice {
+		used, err := countStepAttempts(tx, commit.AssignmentID, commit.ProblemID, commit.Step)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if used >= step.MaxAttempts {
+			loggedHTTPErrorf(w, http.StatusForbidden, "all %d graded attempts for step %d have been used", step.MaxAttempts, commit.Step)
+			return
+		}
+	}
+
 	// validate commit
 	if err := commit.Normalize(now, step.Whitelist); err != nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
 		return
 	}
 
+	// record where the submission came from and flag it if it is outside the allowed networks
+	commit.RemoteAddr = remoteAddr
+	commit.UserAgent = userAgent
+	commit.Client, commit.ClientVersion = parseClient(userAgent)
+	if commit.OffSite, err = isOffSite(tx, assignment, commit.RemoteAddr); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if commit.OffSite && !isInstructor {
+		log.Printf("commit for assignment %d by user %d (%s) submitted from %s, which is outside the allowed networks",
+			assignment.ID, currentUser.ID, currentUser.Email, commit.RemoteAddr)
+	}
+
 	// update an existing commit if it exists
 	// note: this used to include AND action IS NULL AND updated_at > now.Add(-OpenCommitTimeout)
 	openCommit := new(Commit)
@@ -721,6 +899,45 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		commit.CreatedAt = openCommit.CreatedAt
 	}
 
+	// a resubmission of the same files gets the result it got last time
+	if bundle.CommitSignature == "" && bundle.AllowReuse && !isInstructor {
+		previous, err := reusableGrading(tx, problem, commit, openCommit)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error checking for an earlier result: %v", err)
+			return
+		}
+		if previous != nil {
+			log.Printf("reusing the result of commit %d for user %s (%d), who resubmitted the same files for %s step %d",
+				previous.ID, currentUser.Name, currentUser.ID, problem.Note, commit.Step)
+			reused := &CommitBundle{
+				ProblemType:  problemType,
+				Problem:      problem,
+				ProblemSteps: steps,
+				UserID:       bundle.UserID,
+				Commit:       previous,
+				Reused:       true,
+			}
+			if step.MaxAttempts > 0 {
+				used, err := countStepAttempts(tx, commit.AssignmentID, commit.ProblemID, commit.Step)
+				if err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+					return
+				}
+				remaining := step.MaxAttempts - used
+				if remaining < 0 {
+					remaining = 0
+				}
+				reused.AttemptsRemaining = &remaining
+			}
+			if reused.Deadline, err = newDeadline(tx, assignment, now); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			render.JSON(http.StatusOK, reused)
+			return
+		}
+	}
+
 	// sign the problem and the commit
 	typeSig := problemType.ComputeSignature(Config.DaycareSecret)
 	problemSig := problem.ComputeSignature(Config.DaycareSecret, steps)
@@ -740,6 +957,22 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 			loggedHTTPErrorf(w, http.StatusBadRequest, "commit signature has expired")
 			return
 		}
+		if commit.ReportCard != nil {
+			if err := verifyReportCard(tx, commit, bundle.ReportCardSignature, typeSig, problemSig, bundle.Hostname, bundle.UserID); err != nil {
+				loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+		}
+		if commit.Action == "grade" {
+			health.gradingFinished(age)
+		}
+	}
+
+	// label why a graded commit failed; only a daycare's verdict counts
+	commit.FailureLabel = ""
+	commit.Feedback = ""
+	if bundle.CommitSignature != "" {
+		commit.FailureLabel = triageCommit(commit)
 	}
 
 	// save the commit
@@ -751,10 +984,28 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 	if isInstructor {
 		log.Printf("instructor is testing student code, skipping save step")
 	} else {
-		if err := meddler.Save(tx, "commits", commit); err != nil {
+		saved, err := storeCommitBlobs(tx, assignment.CourseID, commit)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		if err := meddler.Save(tx, "commits", saved); err != nil {
 			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 			return
 		}
+		commit.ID = saved.ID
+		if err := recordCommitHash(tx, commit, now); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error recording commit hash: %v", err)
+			return
+		}
+		if err := updateAssignmentSummary(tx, commit.AssignmentID, commit.ProblemID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error updating assignment summary: %v", err)
+			return
+		}
+		if err := indexCommitFiles(tx, commit); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error indexing commit files: %v", err)
+			return
+		}
 
 		// save an updated timestamp on the assignment if it would otherwise not be updated
 		if commit.ReportCard == nil {
@@ -769,10 +1020,14 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 
 	// assign a daycare host if needed
 	if bundle.Hostname == "" {
-		typeSet := map[string]bool{problemType.Name: true}
+		typeSet := map[string]*ProblemType{problemType.Name: problemType}
 
-		host, err := daycareRegistrations.Assign(typeSet)
-		if err != nil {
+		host, err := daycareRegistrations.Assign(tx, typeSet)
+		if err != nil && action != "" {
+			// fail now instead of handing the client a bundle it cannot grade
+			loggedHTTPErrorf(w, http.StatusServiceUnavailable, "unable to run %s for problem type %s: %v", action, problemType.Name, err)
+			return
+		} else if err != nil {
 			log.Printf("error assigning a daycare for this commit: %v", err)
 		} else {
 			bundle.Hostname = host
@@ -793,24 +1048,39 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		CommitSignature:      commitSig,
 	}
 
-	// save the grade update
-	if !isInstructor && signed.Commit.ReportCard != nil {
-		assignment.SetMinorScore(problem.Unique, int(signed.Commit.Step-1), signed.Commit.ReportCard.ComputeScore())
-
-		// get the weight of each step in the problem and problem in the set
-		majorWeights, minorWeights, err := GetProblemWeights(tx, assignment)
+	// a commit headed for a daycare needs a ticket to open the socket
+	if bundle.CommitSignature == "" && action != "" && signed.Hostname != "" {
+		ticket, err := issueSocketTicket(signed, now.Add(socketTicketLifetime))
 		if err != nil {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error issuing socket ticket: %v", err)
 			return
 		}
+		signed.Ticket = ticket
+	}
 
-		// compute an overall score
-		score, err := assignment.ComputeScore(majorWeights, minorWeights)
-		if err != nil {
+	// save the grade update (practice checks and diagnostic steps never count)
+	if !isInstructor && signed.Commit.ReportCard != nil && !signed.Commit.Practice && !step.Diagnostic {
+		stepScore := signed.Commit.ReportCard.ComputeScore(step.Tests)
+		assignment.SetMinorScore(problem.Unique, int(signed.Commit.Step-1), stepScore)
+		if err := recordStepScore(tx, signed.Commit, stepScore, now); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := updateAssignmentSummary(tx, signed.Commit.AssignmentID, signed.Commit.ProblemID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error updating assignment summary: %v", err)
+			return
+		}
+
+		// compute an overall score, unless no step carries any weight
+		explanation, err := explainAssignmentScore(tx, assignment)
+		nothingToScore := err == ErrNothingToScore
+		if err != nil && !nothingToScore {
 			loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
 			return
 		}
-		assignment.Score = score
+		if !nothingToScore {
+			assignment.Score = explanation.Score
+		}
 
 		// save the updates to the assignment
 		assignment.UpdatedAt = now
@@ -819,68 +1089,55 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 			return
 		}
 
-		// post grade to LMS using LTI
-		var transcript bytes.Buffer
-		if err := signed.Commit.DumpTranscript(&transcript); err != nil {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "error writing transcript: %v", err)
-			return
-		}
-
-		// record the grading transcript
-		var report bytes.Buffer
-		if len(majorWeights) > 1 && len(signed.ProblemSteps) > 1 {
-			fmt.Fprintf(&report, "<h1>Grading transcript for problem %s step %d</h1>\n", signed.Problem.Unique, signed.Commit.Step)
-		} else if len(majorWeights) > 1 {
-			fmt.Fprintf(&report, "<h1>Grading transcript for problem %s</h1>\n", signed.Problem.Unique)
-		} else if len(signed.ProblemSteps) > 1 {
-			fmt.Fprintf(&report, "<h1>Grading transcript for step %d</h1>\n", signed.Commit.Step)
+		if nothingToScore {
+			log.Printf("no step of assignment %d carries any weight, so no grade is posted", assignment.ID)
 		} else {
-			fmt.Fprintf(&report, "<h1>Grading transcript</h1>\n")
-		}
-		fmt.Fprintf(&report, "%s\n", ANSIToHTMLPre(transcript.String()))
+			// keep a record of how the grade was worked out
+			if err := recordGradeExplanation(tx, explanation, "graded", now); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
 
-		// add all of the student files
-		var names []string
-		for name := range signed.Commit.Files {
-			names = append(names, name)
-		}
-		sort.Strings(names)
-		for _, name := range names {
-			contents := signed.Commit.Files[name]
-			if utf8.Valid(contents) {
-				fmt.Fprintf(&report, "<h1>File: <code>%s</code></h1>\n<pre><code>%s</code></pre>\n",
-					html.EscapeString(name), html.EscapeString(string(contents)))
+			// post grade to LMS using LTI
+			var transcript bytes.Buffer
+			if err := signed.Commit.DumpTranscript(&transcript); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "error writing transcript: %v", err)
+				return
+			}
+
+			// record the grading transcript
+			var report bytes.Buffer
+			if len(explanation.Explanation.Problems) > 1 && len(signed.ProblemSteps) > 1 {
+				fmt.Fprintf(&report, "<h1>Grading transcript for problem %s step %d</h1>\n", signed.Problem.Unique, signed.Commit.Step)
+			} else if len(explanation.Explanation.Problems) > 1 {
+				fmt.Fprintf(&report, "<h1>Grading transcript for problem %s</h1>\n", signed.Problem.Unique)
+			} else if len(signed.ProblemSteps) > 1 {
+				fmt.Fprintf(&report, "<h1>Grading transcript for step %d</h1>\n", signed.Commit.Step)
 			} else {
-				fmt.Fprintf(&report, "<h1>File: <code>%s</code> (binary contents)</h1>\n", html.EscapeString(name))
+				fmt.Fprintf(&report, "<h1>Grading transcript</h1>\n")
 			}
-		}
+			fmt.Fprintf(&report, "%s\n", ANSIToHTMLPre(transcript.String()))
 
-		// send grade to the LMS in a goroutine
-		// so we can wrap up the transaction and return to the user
-		go func(asst *Assignment, msg string) {
-			// try up to 10 times before giving up
-			tries := 10
-			minSleepTime := 10 * time.Second
-			maxSleepTime := 5 * time.Minute
-			sleepTime := minSleepTime
-			for i := 0; i < tries; i++ {
-				err := saveGrade(asst, msg)
-				if err == nil {
-					return
-				}
-				log.Printf("error posting grade back to LMS (attempt %d/%d): %v", i+1, tries, err)
-				if i+1 < 10 {
-					log.Printf("  will try again in %v", sleepTime)
-					time.Sleep(sleepTime)
-					sleepTime *= 2
-					if sleepTime > maxSleepTime {
-						sleepTime = maxSleepTime
-					}
+			// add all of the student files
+			var names []string
+			for name := range signed.Commit.Files {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				contents := signed.Commit.Files[name]
+				if utf8.Valid(contents) {
+					fmt.Fprintf(&report, "<h1>File: <code>%s</code></h1>\n<pre><code>%s</code></pre>\n",
+						html.EscapeString(name), html.EscapeString(string(contents)))
 				} else {
-					log.Printf("  giving up")
+					fmt.Fprintf(&report, "<h1>File: <code>%s</code> (binary contents)</h1>\n", html.EscapeString(name))
 				}
 			}
-		}(assignment, report.String())
+
+			// send grade to the LMS in a goroutine
+			// so we can wrap up the transaction and return to the user
+			go saveGradeWithRetries(assignment, report.String())
+		}
 	}
 
 	note := ""
@@ -898,6 +1155,58 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 			currentUser.Name, currentUser.ID, bundle.Commit.Action, problem.Note, bundle.Commit.Step, note)
 	}
 
+	// a student who keeps failing the same way may have earned a hint
+	if !isInstructor && bundle.CommitSignature != "" && signed.Commit.Action == "grade" && signed.Commit.ReportCard != nil {
+		hints, err := revealHints(tx, signed.Commit, now)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		signed.Hints = hints
+	}
+
+	// ask the outside feedback service about it if the course opted in
+	if !isInstructor && bundle.CommitSignature != "" && signed.Commit.Action == "grade" && signed.Commit.ReportCard != nil {
+		pending, err := requestFeedback(tx, assignment, problem, &step, signed.Commit, now)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		signed.FeedbackPending = pending
+	}
+
+	if step.MaxAttempts > 0 && !isInstructor {
+		used, err := countStepAttempts(tx, commit.AssignmentID, commit.ProblemID, commit.Step)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		remaining := step.MaxAttempts - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		signed.AttemptsRemaining = &remaining
+	}
+
+	// offer the completion survey once the final step is passed
+	if !isInstructor && signed.Commit.ReportCard != nil && !signed.Commit.Practice &&
+		signed.Commit.ReportCard.Passed && signed.Commit.Score == 1.0 && int(signed.Commit.Step) == len(signed.ProblemSteps) {
+		answered, err := surveyAnswered(tx, commit.AssignmentID, commit.ProblemID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		signed.SurveyRequested = !answered
+	}
+
+	// let the client count down from the server's clock
+	deadline, err := newDeadline(tx, assignment, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	signed.Deadline = deadline
+
 	render.JSON(http.StatusOK, &signed)
 }
 
@@ -929,6 +1238,31 @@ func GetProblemWeights(tx *sql.Tx, assignment *Assignment) (majorWeights map[str
 			return nil, nil, fmt.Errorf("step weights do not line up when computing score")
 		}
 	}
+
+	// steps skipped by an instructor unlock do not count unless the student passed them anyway
+	rows, err := tx.Query(`SELECT problems.unique_id, MAX(step_unlocks.step) `+
+		`FROM step_unlocks JOIN problems ON step_unlocks.problem_id = problems.id `+
+		`WHERE step_unlocks.assignment_id = ? GROUP BY problems.unique_id`, assignment.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var unique string
+		var unlocked int64
+		if err := rows.Scan(&unique, &unlocked); err != nil {
+			return nil, nil, fmt.Errorf("db error: %v", err)
+		}
+		scores := assignment.RawScores[unique]
+		for i := range minorWeights[unique] {
+			if int64(i+1) < unlocked && (i >= len(scores) || scores[i] != 1.0) {
+				minorWeights[unique][i] = 0.0
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
 	return majorWeights, minorWeights, nil
 }
 
@@ -940,31 +1274,78 @@ type loginRecord struct {
 type logins struct {
 	sync.Mutex
 	logins map[string]*loginRecord
+
+	// when shared, records are kept in the database instead of in logins
+	shared bool
+
+	// when set, records are kept in redis instead
+	redis *redisClient
 }
 
+// redisLoginPrefix is prepended to login keys stored in redis.
+const redisLoginPrefix = "codegrinder:login:"
+
 var loginRecords logins
 
 func init() {
 	loginRecords.logins = make(map[string]*loginRecord)
 }
 
-func (l *logins) expire() {
+func (l *logins) expire(tx *sql.Tx) error {
 	now := time.Now()
+	if l.redis != nil {
+		// redis expires keys on its own
+		return nil
+	}
+	if l.shared {
+		_, err := tx.Exec(`DELETE FROM login_records WHERE created_at <= ?`, now.Add(-loginRecordTimeout))
+		return err
+	}
 	for key, elt := range l.logins {
 		if now.Sub(elt.time) >= loginRecordTimeout {
 			delete(l.logins, key)
 		}
 	}
+	return nil
 }
 
-func (l *logins) Insert(userID int64) string {
+func (l *logins) Insert(tx *sql.Tx, userID int64) (string, error) {
 	l.Lock()
 	defer l.Unlock()
 
+	if l.redis != nil {
+		for {
+			key := makeLoginKey()
+			reply, err := l.redis.Do("SET", redisLoginPrefix+key, strconv.FormatInt(userID, 10),
+				"EX", strconv.Itoa(int(loginRecordTimeout.Seconds())), "NX")
+			if err != nil {
+				return "", err
+			}
+			if reply != nil {
+				// a nil reply means the key was already taken
+				return key, nil
+			}
+		}
+	}
+
+	if err := l.expire(tx); err != nil {
+		return "", err
+	}
+
 	key := ""
 	for {
 		key = makeLoginKey()
-		if _, exists := l.logins[key]; !exists {
+		exists := false
+		if l.shared {
+			var count int
+			if err := tx.QueryRow(`SELECT COUNT(1) FROM login_records WHERE login_key = ?`, key).Scan(&count); err != nil {
+				return "", err
+			}
+			exists = count > 0
+		} else {
+			_, exists = l.logins[key]
+		}
+		if !exists {
 			break
 		}
 	}
@@ -974,21 +1355,56 @@ func (l *logins) Insert(userID int64) string {
 		time:   time.Now(),
 	}
 
-	l.logins[key] = elt
-	l.expire()
+	if l.shared {
+		if _, err := tx.Exec(`INSERT INTO login_records (login_key, user_id, created_at) VALUES (?, ?, ?)`, key, elt.userID, elt.time); err != nil {
+			return "", err
+		}
+	} else {
+		l.logins[key] = elt
+	}
 
-	return key
+	return key, nil
 }
 
-func (l *logins) Get(key string) (int64, error) {
+func (l *logins) Get(tx *sql.Tx, key string) (int64, error) {
 	l.Lock()
 	defer l.Unlock()
 
-	l.expire()
+	notFound := fmt.Errorf("session %q not found: key expires after 5 minutes and can only be used once", key)
+
+	if l.redis != nil {
+		reply, err := l.redis.Do("GETDEL", redisLoginPrefix+key)
+		if err != nil {
+			return 0, err
+		}
+		s, ok := reply.(string)
+		if !ok {
+			return 0, notFound
+		}
+		return strconv.ParseInt(s, 10, 64)
+	}
+
+	if err := l.expire(tx); err != nil {
+		return 0, err
+	}
+
+	if l.shared {
+		var userID int64
+		if err := tx.QueryRow(`SELECT user_id FROM login_records WHERE login_key = ?`, key).Scan(&userID); err != nil {
+			if err == sql.ErrNoRows {
+				return 0, notFound
+			}
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM login_records WHERE login_key = ?`, key); err != nil {
+			return 0, err
+		}
+		return userID, nil
+	}
 
 	elt, exists := l.logins[key]
 	if !exists {
-		return 0, fmt.Errorf("session %q not found: key expires after 5 minutes and can only be used once", key)
+		return 0, notFound
 	}
 
 	delete(l.logins, key)
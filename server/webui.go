@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// staticRoot is the static file tree being served, set when the server starts.
+var staticRoot fs.FS
+
+// webUIFrontendInstalled reports whether a separate web frontend has been
+// installed. Until one is, web launches land on the built-in pages instead.
+func webUIFrontendInstalled() bool {
+	if staticRoot == nil {
+		return false
+	}
+	_, err := fs.Stat(staticRoot, "web/index.html")
+	return err == nil
+}
+
+// webUIPages are the minimal pages served by the server itself, so a bare
+// deployment is usable before any frontend is installed.
+var webUIPages = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"percent": func(score float64) string { return fmt.Sprintf("%.0f%%", score*100.0) },
+	"when": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format("Mon Jan 2, 2006 3:04 PM MST")
+	},
+}).Parse(`{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - {{.Theme.Title}}</title>
+<style>
+body { font-family: "Lato", "Helvetica Neue", Helvetica, Arial, sans-serif; color: #333; max-width: 56em; margin: 1em auto; padding: 0 1em; }
+header { border-bottom: 3px solid {{.Theme.AccentColor}}; padding-bottom: 0.5em; display: flex; align-items: center; gap: 1em; }
+header img { max-height: 3em; }
+header .brand { font-size: 120%; font-weight: bold; color: {{.Theme.AccentColor}}; }
+h1, h2 { color: {{.Theme.AccentColor}}; }
+a { color: {{.Theme.AccentColor}}; }
+footer { border-top: 1px solid #aaa; margin-top: 2em; padding-top: 0.5em; font-size: 90%; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+pre, input.url { font-family: monospace; background: #f6f6f6; border: 1px solid #aaa; border-radius: 5px; padding: 0.5em; }
+input.url { width: 100%; box-sizing: border-box; padding: 0.2em; }
+.muted { color: #777; font-size: 90%; }
+</style>
+</head>
+<body>
+<header>{{if .Theme.LogoURL}}<img src="{{.Theme.LogoURL}}" alt="">{{end}}<span class="brand">{{.Theme.Title}}</span>
+<nav><a href="/ui/assignments">Assignments</a> &middot; <a href="/ui/problem_sets">Problem sets</a></nav></header>
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "footer"}}{{if .Theme.FooterLinks}}<footer>{{range $i, $link := .Theme.FooterLinks}}{{if $i}} &middot; {{end}}<a href="{{$link.URL}}">{{$link.Text}}</a>{{end}}</footer>
+{{end}}</body>
+</html>
+{{end}}
+
+{{define "assignments"}}{{template "header" .}}
+{{if .Assignments}}<table>
+<tr><th>Assignment</th><th>Course</th><th>Due</th><th>Score</th></tr>
+{{range .Assignments}}<tr><td><a href="/ui/assignments/{{.Assignment.ID}}">{{.Assignment.CanvasTitle}}</a></td><td>{{.Course.Name}}</td><td>{{when .Assignment.DueAt}}</td><td>{{percent .Assignment.Score}}</td></tr>
+{{end}}</table>
+{{else}}<p>You have no assignments yet. Open one from your course in Canvas to get started.</p>
+{{end}}{{template "footer" .}}{{end}}
+
+{{define "assignment"}}{{template "header" .}}
+<p>{{.Course.Name}}{{if .Course.Label}} ({{.Course.Label}}){{end}} &middot; problem set {{.ProblemSet.Unique}} &middot; assignment {{.Assignment.ID}}</p>
+<table>
+{{if .Assignment.UnlockAt}}<tr><th>Opens</th><td>{{when .Assignment.UnlockAt}}</td></tr>
+{{end}}{{if .Assignment.DueAt}}<tr><th>Due</th><td>{{when .Assignment.DueAt}}{{if .GraceMinutes}} <span class="muted">({{.GraceMinutes}} minute grace period)</span>{{end}}</td></tr>
+{{end}}{{if .Assignment.LockAt}}<tr><th>Closes</th><td>{{when .Assignment.LockAt}}</td></tr>
+{{end}}<tr><th>Score</th><td>{{percent .Assignment.Score}}</td></tr>
+</table>
+<h2>Problems</h2>
+<table>
+<tr><th>Problem</th><th>Weight</th><th>Step scores</th></tr>
+{{range .Problems}}<tr><td>{{.Problem.Note}}<br><span class="muted">{{.Problem.Unique}}</span></td><td>{{.Weight}}</td><td>{{range .Steps}}{{percent .}} {{else}}<span class="muted">not started</span>{{end}}</td></tr>
+{{end}}</table>
+<h2>Working on this assignment</h2>
+<p>You work on CodeGrinder assignments with the <tt>grind</tt> command-line tool. To install it on Linux or macOS:</p>
+<pre>curl -s https://{{.Hostname}}/install-grind.sh | sudo sh</pre>
+{{if .Session}}<p>Then log in (you normally only need to do this once per semester):</p>
+<pre>grind login {{.Hostname}} {{.Session}}</pre>
+{{else}}<p>If you have not logged in with <tt>grind</tt> yet, open this assignment from Canvas again to get a login code.</p>
+{{end}}<p>Download the assignment, then use <tt>grind grade</tt> in its directory to submit your work:</p>
+<pre>grind get {{.Assignment.ID}}</pre>
+{{template "footer" .}}{{end}}
+
+{{define "problemSets"}}{{template "header" .}}
+<form method="GET" action="/ui/problem_sets">
+<input name="search" value="{{.Search}}" size="40" placeholder="Search by name, unique ID, or tag">
+<button type="submit">Search</button>
+</form>
+<p>To add a problem set to a Canvas course, add this server as an external tool using
+<a href="https://{{.Hostname}}/lti/config.xml">https://{{.Hostname}}/lti/config.xml</a>,
+then create an external tool assignment using one of the launch URLs below.</p>
+{{if .ProblemSets}}<table>
+<tr><th>Problem set</th><th>Launch URLs</th></tr>
+{{range .ProblemSets}}<tr><td>{{.Note}}<br><span class="muted">{{.Unique}}{{range .Tags}} &middot; {{.}}{{end}}</span></td>
+<td>command line: <input class="url" readonly onclick="this.select()" value="https://{{$.Hostname}}/lti/problem_sets/cli/{{.Unique}}"><br>
+web: <input class="url" readonly onclick="this.select()" value="https://{{$.Hostname}}/lti/problem_sets/web/{{.Unique}}"></td></tr>
+{{end}}</table>
+{{else}}<p>No problem sets found.</p>
+{{end}}{{template "footer" .}}{{end}}
+`))
+
+type webUIAssignment struct {
+	Assignment *Assignment
+	Course     *Course
+}
+
+type webUIProblem struct {
+	Problem *Problem
+	Weight  float64
+	Steps   []float64
+}
+
+// renderWebUI writes one of the built-in pages.
+func renderWebUI(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := webUIPages.ExecuteTemplate(&buf, name, data); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "rendering %s page: %v", name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+// webUIAssignmentURL is where a launch sends students when there is no web frontend to send them to.
+func webUIAssignmentURL(assignmentID int64, session string) string {
+	return fmt.Sprintf("/ui/assignments/%d?session=%s", assignmentID, url.QueryEscape(session))
+}
+
+// GetWebUIAssignments handles requests to /ui/assignments,
+// listing the current user's assignments with their scores.
+func GetWebUIAssignments(w http.ResponseWriter, tx *sql.Tx, currentUser *User) {
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments WHERE user_id = ? ORDER BY course_id, id`, currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	courses := make(map[int64]*Course)
+	list := []*webUIAssignment{}
+	for _, asst := range assignments {
+		course, exists := courses[asst.CourseID]
+		if !exists {
+			course = new(Course)
+			if err := meddler.Load(tx, "courses", course, asst.CourseID); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			courses[asst.CourseID] = course
+		}
+		list = append(list, &webUIAssignment{Assignment: asst, Course: course})
+	}
+	renderWebUI(w, "assignments", map[string]interface{}{
+		"Title":       "Your assignments",
+		"Theme":       defaultTheme(),
+		"Assignments": list,
+	})
+}
+
+// GetWebUIAssignment handles requests to /ui/assignments/:assignment_id,
+// returning a status page for one assignment with its deadlines and the
+// score for every step, plus instructions for working on it with grind.
+//
+// If parameter session=<...> present, the grind login command is included.
+func GetWebUIAssignment(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if currentUser.Admin {
+		err = meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE id = ?`, assignmentID)
+	} else {
+		err = meddler.QueryRow(tx, assignment, `SELECT assignments.* `+
+			`FROM assignments JOIN user_assignments ON assignments.id = user_assignments.assignment_id `+
+			`WHERE assignments.id = ? AND user_assignments.user_id = ?`,
+			assignmentID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := attachDeadlines(tx, assignment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, assignment.CourseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	problemSet := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", problemSet, assignment.ProblemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	problemSetProblems := []*ProblemSetProblem{}
+	if err := meddler.QueryAll(tx, &problemSetProblems, `SELECT * FROM problem_set_problems WHERE problem_set_id = ? ORDER BY problem_id`, problemSet.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	problems := []*webUIProblem{}
+	for _, elt := range problemSetProblems {
+		problem := new(Problem)
+		if err := meddler.Load(tx, "problems", problem, elt.ProblemID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		problems = append(problems, &webUIProblem{
+			Problem: problem,
+			Weight:  elt.Weight,
+			Steps:   assignment.RawScores[problem.Unique],
+		})
+	}
+
+	theme, err := courseTheme(tx, course.ID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	var graceMinutes int64
+	if assignment.Deadline != nil {
+		graceMinutes = assignment.Deadline.GraceMinutes
+	}
+	renderWebUI(w, "assignment", map[string]interface{}{
+		"Title":        assignment.CanvasTitle,
+		"Theme":        theme,
+		"Assignment":   assignment,
+		"Course":       course,
+		"ProblemSet":   problemSet,
+		"Problems":     problems,
+		"GraceMinutes": graceMinutes,
+		"Hostname":     Config.Hostname,
+		"Session":      r.URL.Query().Get("session"),
+	})
+}
+
+// GetWebUIProblemSets handles requests to /ui/problem_sets,
+// returning a picker that lists problem sets with the LTI launch URLs
+// an instructor pastes into Canvas to assign them. Authors and
+// administrators see every problem set, and others see those they
+// have been assigned.
+//
+// If parameter search=<...> present, only matching problem sets are listed.
+func GetWebUIProblemSets(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User) {
+	search := strings.TrimSpace(r.URL.Query().Get("search"))
+	where, args := "", []interface{}{}
+	for _, term := range strings.Fields(search) {
+		where, args = addWhereLike(where, args, "problem_set_search_fields.search_text", term)
+	}
+
+	query := `SELECT problem_sets.* FROM problem_sets`
+	if !currentUser.Admin && !currentUser.Author {
+		query += ` JOIN user_problem_sets ON problem_sets.id = user_problem_sets.problem_set_id`
+		where, args = addWhereEq(where, args, "user_problem_sets.user_id", currentUser.ID)
+	}
+	if search != "" {
+		query += ` JOIN problem_set_search_fields ON problem_sets.id = problem_set_search_fields.problem_set_id`
+	}
+	query += where + ` ORDER BY problem_sets.unique_id`
+
+	problemSets := []*ProblemSet{}
+	if err := meddler.QueryAll(tx, &problemSets, query, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	renderWebUI(w, "problemSets", map[string]interface{}{
+		"Title":       "Problem sets",
+		"Theme":       defaultTheme(),
+		"ProblemSets": problemSets,
+		"Search":      search,
+		"Hostname":    Config.Hostname,
+	})
+}
@@ -0,0 +1,22 @@
+#!/bin/sh
+
+set -e
+
+# create the database the first time the TA starts
+if [ "$1" = "-ta" ] && [ ! -f "$CODEGRINDERROOT"/db/codegrinder.db ]; then
+    mkdir -p "$CODEGRINDERROOT"/db
+    sqlite3 "$CODEGRINDERROOT"/db/codegrinder.db < "$CODEGRINDERROOT"/setup/schema.sql
+    sqlite3 "$CODEGRINDERROOT"/db/codegrinder.db < "$CODEGRINDERROOT"/setup/problemtypes.sql
+fi
+
+# the TA only accepts grades from daycares whose keys are registered
+if [ "$1" = "-ta" ] && [ -n "$DAYCARE_PUBLIC_KEY" ]; then
+    codegrinder daycare-keys add "$DAYCARE_HOSTNAME" "$DAYCARE_PUBLIC_KEY"
+fi
+
+# wait for the proxy to create its certificate authority, which every node must trust
+while [ ! -f "$SSL_CERT_FILE" ]; do
+    sleep 1
+done
+
+exec codegrinder "$@"
@@ -1,6 +1,8 @@
 CREATE TABLE problem_types (
     name                    text NOT NULL,
     image                   text NOT NULL,
+    os                      text NOT NULL DEFAULT 'linux' CHECK(os IN ('linux', 'windows')),
+    labels                  text NOT NULL DEFAULT '[]',
 
     PRIMARY KEY (name)
 );
@@ -9,7 +11,7 @@ CREATE TABLE problem_type_actions (
     problem_type            text NOT NULL,
     action                  text NOT NULL,
     command                 text NOT NULL,
-    parser                  text CHECK(parser IS NULL OR parser IN ('xunit', 'check')),
+    parser                  text CHECK(parser IS NULL OR parser IN ('xunit', 'check', 'inout')),
     message                 text NOT NULL,
     interactive             boolean NOT NULL,
 
@@ -31,6 +33,9 @@ CREATE TABLE problems (
     note                    text NOT NULL,
     tags                    text NOT NULL,
     options                 text NOT NULL,
+    estimated_minutes       integer NOT NULL DEFAULT 0,
+    difficulty              integer NOT NULL DEFAULT 0,
+    prerequisites           text NOT NULL DEFAULT '[]',
     created_at              datetime NOT NULL,
     updated_at              datetime NOT NULL
 );
@@ -42,8 +47,13 @@ CREATE TABLE problem_steps (
     problem_type            text NOT NULL,
     note                    text NOT NULL,
     instructions            text NOT NULL,
+    localized_instructions  text NOT NULL DEFAULT '{}',
     weight                  real NOT NULL,
+    max_attempts            integer NOT NULL DEFAULT 0,
+    diagnostic              boolean NOT NULL DEFAULT 0,
+    tests                   text NOT NULL DEFAULT '{}',
     files                   text NOT NULL,
+    files_blob              text,
     whitelist               text NOT NULL,
     solution                text NOT NULL,
 
@@ -53,6 +63,19 @@ CREATE TABLE problem_steps (
 );
 CREATE INDEX problem_steps_problem_type ON problem_steps (problem_type);
 
+CREATE TABLE problem_hints (
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    position                integer NOT NULL,
+    test                    text,
+    pattern                 text,
+    after_failures          integer NOT NULL,
+    hint                    text NOT NULL,
+
+    PRIMARY KEY (problem_id, step, position),
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
 CREATE TABLE problem_sets (
     id                      integer PRIMARY KEY,
     unique_id               text NOT NULL,
@@ -74,6 +97,37 @@ CREATE TABLE problem_set_problems (
 );
 CREATE INDEX problem_set_problems_problem_id ON problem_set_problems (problem_id);
 
+CREATE TABLE problem_set_canaries (
+    id                      integer PRIMARY KEY,
+    problem_set_id          integer NOT NULL,
+    candidate_problem_set_id integer NOT NULL,
+    percent                 integer NOT NULL CHECK(percent >= 0 AND percent <= 100),
+    section_ids             text NOT NULL,
+    promoted                boolean NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (candidate_problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX problem_set_canaries_problem_set_id ON problem_set_canaries (problem_set_id);
+
+CREATE TABLE availability_windows (
+    id                      integer PRIMARY KEY,
+    problem_id              integer,
+    course_id               integer,
+    open_at                 datetime,
+    close_at                datetime,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    CHECK (problem_id IS NOT NULL OR course_id IS NOT NULL),
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX availability_windows_problem_id ON availability_windows (problem_id);
+CREATE INDEX availability_windows_course_id ON availability_windows (course_id);
+
 CREATE TABLE courses (
     id                      integer PRIMARY KEY,
     name                    text NOT NULL,
@@ -96,6 +150,7 @@ CREATE TABLE users (
     canvas_id               integer NOT NULL,
     author                  boolean NOT NULL,
     admin                   boolean NOT NULL,
+    locale                  text NOT NULL DEFAULT '',
     created_at              datetime NOT NULL,
     updated_at              datetime NOT NULL,
     last_signed_in_at       datetime NOT NULL
@@ -148,9 +203,19 @@ CREATE TABLE commits (
     action                  text,
     note                    text,
     files                   text NOT NULL,
+    files_blob              text,
     transcript              text NOT NULL,
+    transcript_blob         text,
     report_card             text NOT NULL,
     score                   real,
+    remote_addr             text,
+    user_agent              text,
+    client                  text,
+    client_version          text,
+    off_site                boolean NOT NULL DEFAULT 0,
+    practice                boolean NOT NULL DEFAULT 0,
+    failure_label           text,
+    feedback                text,
     created_at              datetime NOT NULL,
     updated_at              datetime NOT NULL,
 
@@ -159,6 +224,156 @@ CREATE TABLE commits (
 );
 CREATE UNIQUE INDEX commits_unique_assignment_problem_step ON commits (assignment_id, problem_id, step);
 CREATE INDEX commits_problem_id_step ON commits (problem_id, step);
+CREATE INDEX commits_failure_label_updated_at ON commits (failure_label, updated_at);
+
+-- the files of each commit, indexed for instructor searches
+CREATE TABLE submission_files (
+    id                      integer PRIMARY KEY,
+    commit_id               integer NOT NULL,
+    name                    text NOT NULL,
+
+    FOREIGN KEY (commit_id) REFERENCES commits (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX submission_files_commit_id ON submission_files (commit_id);
+CREATE VIRTUAL TABLE submission_search USING fts4 (contents);
+CREATE TRIGGER submission_files_delete AFTER DELETE ON submission_files BEGIN
+    DELETE FROM submission_search WHERE docid = old.id;
+END;
+
+CREATE TABLE commit_resets (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    commit_id               integer NOT NULL,
+    user_id                 integer NOT NULL,
+    files                   text NOT NULL,
+    files_blob              text,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX commit_resets_assignment_id ON commit_resets (assignment_id);
+
+CREATE TABLE step_unlocks (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    user_id                 integer NOT NULL,
+    note                    text NOT NULL,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX step_unlocks_assignment_id ON step_unlocks (assignment_id);
+
+CREATE TABLE step_scores (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    score                   real NOT NULL,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX step_scores_assignment_id ON step_scores (assignment_id);
+
+CREATE TABLE assignment_summaries (
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    user_id                 integer NOT NULL,
+    step_reached            integer NOT NULL,
+    latest_score            real,
+    attempts                integer NOT NULL,
+    last_activity           datetime,
+
+    PRIMARY KEY (assignment_id, problem_id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE hint_progress (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    position                integer NOT NULL,
+    failures                integer NOT NULL,
+    revealed_at             datetime,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX hint_progress_unique_assignment_hint ON hint_progress (assignment_id, problem_id, step, position);
+CREATE INDEX hint_progress_problem_id_step ON hint_progress (problem_id, step);
+
+CREATE TABLE commit_hashes (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    commit_id               integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    hash                    text NOT NULL,
+    previous_hash           text NOT NULL,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX commit_hashes_assignment_id ON commit_hashes (assignment_id);
+CREATE INDEX commit_hashes_commit_id ON commit_hashes (commit_id);
+
+CREATE TABLE ip_allowlists (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    lti_id                  text NOT NULL,
+    networks                text NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX ip_allowlists_lti_id ON ip_allowlists (lti_id);
+
+CREATE TABLE score_policies (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    lti_id                  text NOT NULL,
+    policy                  text NOT NULL CHECK (policy IN ('latest', 'best', 'deadline')),
+    practice                boolean NOT NULL DEFAULT 0,
+    grace_minutes           integer CHECK (grace_minutes >= 0),
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX score_policies_lti_id ON score_policies (lti_id);
+
+CREATE TABLE sections (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    name                    text NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX sections_unique_course_id_name ON sections (course_id, name);
+
+CREATE TABLE section_members (
+    section_id              integer NOT NULL,
+    user_id                 integer NOT NULL,
+    role                    text NOT NULL CHECK (role IN ('ta', 'student')),
+    created_at              datetime NOT NULL,
+
+    PRIMARY KEY (section_id, user_id),
+    FOREIGN KEY (section_id) REFERENCES sections (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX section_members_user_id ON section_members (user_id);
 
 CREATE VIEW assts AS
     SELECT
@@ -213,6 +428,13 @@ CREATE VIEW user_users AS
     JOIN assignments ON courses.id = assignments.course_id
     JOIN users ON assignments.user_id = users.id
     WHERE instructors_assignments.instructor
+    AND (assignments.instructor
+        OR NOT EXISTS (SELECT 1 FROM section_members JOIN sections ON section_members.section_id = sections.id
+            WHERE sections.course_id = courses.id AND section_members.user_id = instructors.id AND section_members.role = 'ta')
+        OR EXISTS (SELECT 1 FROM section_members AS tas JOIN sections ON tas.section_id = sections.id
+            JOIN section_members AS students ON tas.section_id = students.section_id
+            WHERE sections.course_id = courses.id AND tas.user_id = instructors.id AND tas.role = 'ta'
+            AND students.user_id = assignments.user_id AND students.role = 'student'))
     UNION
     SELECT id as user_id, id AS other_user_id
     FROM users;
@@ -224,6 +446,13 @@ CREATE VIEW user_assignments AS
     JOIN courses ON instructors_assignments.course_id = courses.id
     JOIN assignments ON courses.id = assignments.course_id
     WHERE instructors_assignments.instructor
+    AND (assignments.instructor
+        OR NOT EXISTS (SELECT 1 FROM section_members JOIN sections ON section_members.section_id = sections.id
+            WHERE sections.course_id = courses.id AND section_members.user_id = instructors.id AND section_members.role = 'ta')
+        OR EXISTS (SELECT 1 FROM section_members AS tas JOIN sections ON tas.section_id = sections.id
+            JOIN section_members AS students ON tas.section_id = students.section_id
+            WHERE sections.course_id = courses.id AND tas.user_id = instructors.id AND tas.role = 'ta'
+            AND students.user_id = assignments.user_id AND students.role = 'student'))
     UNION
     SELECT user_id, id as assignment_id
     FROM assignments;
@@ -301,3 +530,489 @@ CREATE TABLE responses (
 );
 CREATE UNIQUE INDEX responses_assignment_id_question_id ON responses (assignment_id, question_id);
 CREATE INDEX responses_question_id ON responses (question_id);
+
+CREATE TABLE shadow_grades (
+    id                      integer PRIMARY KEY,
+    hostname                text NOT NULL,
+    commit_id               integer NOT NULL,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    problem_type            text NOT NULL,
+    image                   text NOT NULL,
+    shadow_image            text NOT NULL,
+    report_card             text,
+    score                   real NOT NULL,
+    shadow_report_card      text,
+    shadow_score            real NOT NULL,
+    created_at              datetime NOT NULL
+);
+CREATE INDEX shadow_grades_problem_type_shadow_image ON shadow_grades (problem_type, shadow_image);
+
+CREATE TABLE grading_usage (
+    id                      integer PRIMARY KEY,
+    hostname                text NOT NULL,
+    course_id               integer NOT NULL,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    problem_type            text NOT NULL,
+    action                  text NOT NULL,
+    cpu_seconds             real NOT NULL,
+    memory_seconds          real NOT NULL,
+    wall_seconds            real NOT NULL,
+    created_at              datetime NOT NULL
+);
+CREATE INDEX grading_usage_course_id_created_at ON grading_usage (course_id, created_at);
+
+CREATE TABLE nanny_logs (
+    id                      integer PRIMARY KEY,
+    hostname                text NOT NULL,
+    commit_id               integer NOT NULL,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    problem_type            text NOT NULL,
+    action                  text NOT NULL,
+    events                  text NOT NULL,
+    log                     text NOT NULL,
+    created_at              datetime NOT NULL
+);
+CREATE INDEX nanny_logs_assignment_id_problem_id_step ON nanny_logs (assignment_id, problem_id, step);
+CREATE INDEX nanny_logs_commit_id ON nanny_logs (commit_id);
+
+CREATE TABLE container_alerts (
+    id                      integer PRIMARY KEY,
+    hostname                text NOT NULL,
+    container_id            text NOT NULL,
+    user_id                 integer NOT NULL,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    problem_type            text NOT NULL,
+    action                  text NOT NULL,
+    kind                    text NOT NULL,
+    detail                  text NOT NULL,
+    created_at              datetime NOT NULL
+);
+
+CREATE TABLE grading_records (
+    id                      integer PRIMARY KEY,
+    hostname                text NOT NULL,
+    commit_id               integer NOT NULL,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    unique_id               text NOT NULL,
+    step                    integer NOT NULL,
+    problem_type            text NOT NULL,
+    os                      text NOT NULL,
+    action                  text NOT NULL,
+    action_spec             text NOT NULL,
+    image                   text NOT NULL,
+    image_digest            text NOT NULL,
+    seed                    integer NOT NULL,
+    args                    text NOT NULL,
+    env                     text NOT NULL,
+    secret_names            text NOT NULL,
+    options                 text NOT NULL,
+    tests                   text NOT NULL DEFAULT '{}',
+    files                   text NOT NULL,
+    instructor_files        text NOT NULL,
+    report_card             text,
+    score                   real NOT NULL,
+    created_at              datetime NOT NULL,
+    residency               text
+);
+CREATE INDEX grading_records_assignment_id_problem_id_step ON grading_records (assignment_id, problem_id, step);
+
+CREATE TABLE grading_files (
+    hash                    text PRIMARY KEY,
+    contents                blob NOT NULL
+);
+
+CREATE TABLE course_quotas (
+    course_id               integer NOT NULL,
+    max_cpu_seconds         real NOT NULL,
+    max_jobs                integer NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    PRIMARY KEY (course_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE maintenance (
+    id                      integer PRIMARY KEY,
+    message                 text NOT NULL,
+    retry_at                datetime,
+    user_id                 integer NOT NULL,
+    created_at              datetime NOT NULL
+);
+
+CREATE TABLE problem_surveys (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    user_id                 integer NOT NULL,
+    difficulty              integer NOT NULL,
+    minutes                 integer NOT NULL,
+    comments                text NOT NULL,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX problem_surveys_assignment_id_problem_id ON problem_surveys (assignment_id, problem_id);
+CREATE INDEX problem_surveys_problem_id ON problem_surveys (problem_id);
+
+CREATE TABLE announcements (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    user_id                 integer NOT NULL,
+    message                 text NOT NULL,
+    expires_at              datetime,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX announcements_course_id ON announcements (course_id);
+
+CREATE TABLE announcement_reads (
+    announcement_id         integer NOT NULL,
+    user_id                 integer NOT NULL,
+    read_at                 datetime NOT NULL,
+
+    PRIMARY KEY (announcement_id, user_id),
+    FOREIGN KEY (announcement_id) REFERENCES announcements (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE grade_policies (
+    course_id               integer NOT NULL,
+    decimal_places          integer NOT NULL,
+    rounding                text NOT NULL CHECK (rounding IN ('round', 'floor', 'ceiling')),
+    minimum_score           real NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    PRIMARY KEY (course_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE failure_explanations (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    signature               text NOT NULL,
+    explanation             text NOT NULL,
+    author_id               integer NOT NULL,
+    approved_by             integer,
+    approved_at             datetime,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX failure_explanations_problem_id_step_signature ON failure_explanations (problem_id, step, signature);
+CREATE INDEX failure_explanations_course_id ON failure_explanations (course_id);
+
+CREATE TABLE feedback_settings (
+    course_id               integer NOT NULL,
+    enabled_by              integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    PRIMARY KEY (course_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE activity_pings (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX activity_pings_assignment_id_problem_id_step ON activity_pings (assignment_id, problem_id, step, created_at);
+
+CREATE TABLE prerequisite_locks (
+    course_id               integer NOT NULL,
+    enabled_by              integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    PRIMARY KEY (course_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE time_sharing_settings (
+    course_id               integer NOT NULL,
+    enabled_by              integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    PRIMARY KEY (course_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE feedback_records (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    assignment_id           integer NOT NULL,
+    commit_id               integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    provider                text NOT NULL,
+    request                 text NOT NULL,
+    feedback                text,
+    error                   text,
+    created_at              datetime NOT NULL,
+    finished_at             datetime,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX feedback_records_course_id_created_at ON feedback_records (course_id, created_at);
+
+CREATE TABLE research_tokens (
+    id                      integer PRIMARY KEY,
+    name                    text NOT NULL,
+    token_hash              text NOT NULL,
+    created_by              integer NOT NULL,
+    created_at              datetime NOT NULL,
+    last_used_at            datetime
+);
+CREATE UNIQUE INDEX research_tokens_token_hash ON research_tokens (token_hash);
+
+CREATE TABLE research_consents (
+    course_id               integer PRIMARY KEY,
+    consent_by              integer NOT NULL,
+    consent_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE login_records (
+    login_key               text NOT NULL,
+    user_id                 integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    PRIMARY KEY (login_key)
+);
+
+CREATE TABLE daycare_registrations (
+    hostname                text NOT NULL,
+    problem_types           text NOT NULL,
+    os                      text NOT NULL,
+    labels                  text NOT NULL,
+    capacity                integer NOT NULL,
+    time                    datetime NOT NULL,
+
+    PRIMARY KEY (hostname)
+);
+
+CREATE TABLE grade_postings (
+    assignment_id           integer NOT NULL,
+    score                   real NOT NULL,
+    posted_at               datetime NOT NULL,
+
+    PRIMARY KEY (assignment_id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE grade_sync_runs (
+    id                      integer PRIMARY KEY,
+    checked                 integer NOT NULL,
+    reposted                integer NOT NULL,
+    failed                  integer NOT NULL,
+    discrepancies           text NOT NULL,
+    started_at              datetime NOT NULL,
+    finished_at             datetime
+);
+CREATE INDEX grade_sync_runs_started_at ON grade_sync_runs (started_at);
+
+CREATE TABLE leases (
+    name                    text NOT NULL,
+    holder                  text NOT NULL,
+    expires_at              datetime NOT NULL,
+
+    PRIMARY KEY (name)
+);
+
+CREATE TABLE problem_secrets (
+    id                      integer PRIMARY KEY,
+    problem_type            text NOT NULL,
+    problem_id              integer,
+    name                    text NOT NULL,
+    encrypted_value         text NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (problem_type) REFERENCES problem_types (name) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX problem_secrets_scope_name ON problem_secrets (problem_type, COALESCE(problem_id, 0), name);
+
+CREATE TABLE showcase_consents (
+    assignment_id           integer NOT NULL,
+    problem_id              integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    PRIMARY KEY (assignment_id, problem_id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE showcase_entries (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    problem_id              integer NOT NULL,
+    commit_id               integer NOT NULL,
+    label                   text NOT NULL,
+    published_by            integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (commit_id) REFERENCES commits (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX showcase_entries_course_id ON showcase_entries (course_id, problem_id);
+CREATE UNIQUE INDEX showcase_entries_commit_id ON showcase_entries (commit_id);
+
+CREATE TABLE integrity_flags (
+    id                      integer PRIMARY KEY,
+    course_id               integer NOT NULL,
+    kind                    text NOT NULL,
+    assignment_id           integer NOT NULL,
+    user_id                 integer NOT NULL,
+    problem_id              integer NOT NULL,
+    step                    integer NOT NULL,
+    commit_id               integer,
+    other_assignment_id     integer NOT NULL DEFAULT 0,
+    other_user_id           integer,
+    other_commit_id         integer,
+    detail                  text NOT NULL,
+    status                  text NOT NULL,
+    note                    text NOT NULL,
+    reviewed_by             integer,
+    reviewed_at             datetime,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX integrity_flags_course_id ON integrity_flags (course_id, status);
+CREATE UNIQUE INDEX integrity_flags_kind_assignment_id ON integrity_flags (kind, assignment_id, problem_id, step, other_assignment_id);
+
+CREATE TABLE course_residencies (
+    course_id               integer PRIMARY KEY,
+    residency               text NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE course_themes (
+    course_id               integer PRIMARY KEY,
+    theme                   text NOT NULL,
+    title                   text NOT NULL,
+    logo_url                text NOT NULL,
+    accent_color            text NOT NULL,
+    footer_links            text NOT NULL,
+    created_at              datetime NOT NULL,
+    updated_at              datetime NOT NULL,
+
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE image_builds (
+    problem_type            text NOT NULL,
+    digest                  text NOT NULL,
+    image                   text NOT NULL,
+    image_id                text NOT NULL,
+    pushed                  boolean NOT NULL,
+    built_at                datetime NOT NULL,
+
+    PRIMARY KEY (problem_type, digest),
+    FOREIGN KEY (problem_type) REFERENCES problem_types (name) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX image_builds_image ON image_builds (image);
+
+CREATE TABLE problem_confirmations (
+    id                      integer PRIMARY KEY,
+    problem_id              integer NOT NULL,
+    problem_updated_at      datetime NOT NULL,
+    problem_type            text NOT NULL,
+    image                   text NOT NULL,
+    digest                  text NOT NULL,
+    user_id                 integer NOT NULL,
+    confirmed_at            datetime NOT NULL,
+
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (problem_type) REFERENCES problem_types (name) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX problem_confirmations_problem_id ON problem_confirmations (problem_id, confirmed_at);
+
+CREATE TABLE daycare_keys (
+    hostname                text NOT NULL,
+    public_key              text NOT NULL,
+    created_at              datetime NOT NULL,
+
+    PRIMARY KEY (hostname)
+);
+
+CREATE TABLE grade_explanations (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    reason                  text NOT NULL,
+    score_policy            text NOT NULL,
+    explanation             text NOT NULL,
+    computed_score          real NOT NULL,
+    grade_policy            text,
+    score                   real NOT NULL,
+    created_at              datetime NOT NULL,
+    posted_at               datetime,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX grade_explanations_assignment_id ON grade_explanations (assignment_id, id);
+
+CREATE TABLE grade_targets (
+    id                      integer PRIMARY KEY,
+    assignment_id           integer NOT NULL,
+    grade_id                text NOT NULL,
+    outcome_url             text NOT NULL,
+    outcome_ext_accepted    text NOT NULL,
+    consumer_key            text NOT NULL,
+    status                  text NOT NULL,
+    error                   text NOT NULL,
+    posted_score            real,
+    posted_at               datetime,
+    attempted_at            datetime,
+    created_at              datetime NOT NULL,
+    launched_at             datetime NOT NULL,
+
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX grade_targets_assignment_id ON grade_targets (assignment_id, grade_id);
+
+CREATE TABLE role_changes (
+    id                      integer PRIMARY KEY,
+    user_id                 integer NOT NULL,
+    course_id               integer NOT NULL,
+    assignment_id           integer NOT NULL,
+    change                  text NOT NULL CHECK (change IN ('promoted', 'demoted')),
+    old_roles               text NOT NULL,
+    new_roles               text NOT NULL,
+    revoked_assignments     integer NOT NULL,
+    revoked_sections        integer NOT NULL,
+    created_at              datetime NOT NULL,
+
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX role_changes_course_id ON role_changes (course_id, created_at);
@@ -23,6 +23,7 @@ import tkinter.messagebox
 import tkinter.simpledialog
 import tkinter.ttk
 from typing import List, Dict, Tuple, Optional, Any
+import urllib.parse
 import websocket
 
 #
@@ -236,6 +237,7 @@ def _codegrinder_run_tests_handler() -> None:
     try:
         thonny.get_workbench().get_editor_notebook().save_all_named_editors()
         (filename, dotfile, problemSetDir, problemDir) = get_codegrinder_project_info()
+        send_activity_ping(dotfile, problemDir)
 
         # run the commands
         cmd_line = '%cd ' + shlex.quote(problemDir) + '\n'
@@ -292,11 +294,18 @@ def _codegrinder_download_handler() -> None:
         courses: Dict[int, Course] = {}
 
         downloads: List[str] = []
+        held: List[str] = []
+        assignments.sort(key=lambda elt: (elt.courseID, elt.order.position if elt.order is not None else 0))
         for assignment in assignments:
             # ignore quizzes
             if assignment.problemSetID <= 0:
                 continue
 
+            # skip assignments waiting on prerequisites
+            if assignment.order is not None and assignment.order.locked:
+                held.append(f'{assignment.canvasTitle} (finish {", ".join(assignment.order.unmet or [])} first)')
+                continue
+
             # get the course
             if assignment.courseID not in courses:
                 courses[assignment.courseID] = must_get_object(f'/courses/{assignment.courseID}', None, Course)
@@ -307,6 +316,12 @@ def _codegrinder_download_handler() -> None:
             if problemDir is not None:
                 downloads.append(problemDir)
 
+        if len(held) > 0:
+            tkinter.messagebox.showinfo('Some assignments are locked',
+                'These assignments will be available once you finish the problems they depend on:\n\n' +
+                '\n'.join(held),
+                master=thonny.get_workbench())
+
         if len(downloads) == 0:
             tkinter.messagebox.showinfo('No new assignments found',
                 'You must click on each assignment in Canvas once ' +
@@ -516,30 +531,37 @@ def _codegrinder_grade_handler() -> None:
         unsigned = {
             'userID': user.id,
             'commit': commit.to_dict(),
+            'allowReuse': True,
         }
 
         # send the commit bundle to the server
         signed = must_post_commit_bundle('/commit_bundles/unsigned', None, unsigned)
-        if not signed.hostname:
-            raise DialogException('Server error',
-                'The server was unable to find a suitable grader for this problem type.\n\n' +
-                'Please try again later or contact your instructor for help.')
-
-        # send it to the daycare for grading
-        # with a progress spinner popup
-        bar = Progress(thonny.get_workbench().winfo_toplevel())
-        graded = must_confirm_commit_bundle(signed, None, bar)
-        bar.stop()
-
-        # save the commit with report card
-        toSave = {
-            'hostname':         graded.hostname,
-            'userID':           graded.userID,
-            'commit':           graded.commit.to_dict(),
-            'commitSignature':  graded.commitSignature,
-        }
-        saved = must_post_commit_bundle('/commit_bundles/signed', None, toSave)
-        commit = saved.commit
+        if signed.reused:
+            # nothing changed since the last graded attempt,
+            # so the server sent back that result
+            commit = signed.commit
+        else:
+            if not signed.hostname:
+                raise DialogException('Server error',
+                    'The server was unable to find a suitable grader for this problem type.\n\n' +
+                    'Please try again later or contact your instructor for help.')
+
+            # send it to the daycare for grading
+            # with a progress spinner popup
+            bar = Progress(thonny.get_workbench().winfo_toplevel())
+            graded = must_confirm_commit_bundle(signed, None, bar)
+            bar.stop()
+
+            # save the commit with report card
+            toSave = {
+                'hostname':         graded.hostname,
+                'userID':           graded.userID,
+                'commit':           graded.commit.to_dict(),
+                'commitSignature':  graded.commitSignature,
+                'reportCardSignature': graded.reportCardSignature,
+            }
+            saved = must_post_commit_bundle('/commit_bundles/signed', None, toSave)
+            commit = saved.commit
 
         shell = thonny.get_workbench().get_view('ShellView')
         shell.clear_shell()
@@ -716,6 +738,13 @@ class User(DataClassJsonMixin):
     updatedAt:          str
     lastSignedInAt:     str
 
+@dataclass
+class AssignmentOrder(DataClassJsonMixin):
+    position:       int = 0
+    prerequisites:  Optional[List[str]] = None
+    unmet:          Optional[List[str]] = None
+    locked:         bool = False
+
 @dataclass
 class Assignment(DataClassJsonMixin):
     id:             int
@@ -734,6 +763,7 @@ class Assignment(DataClassJsonMixin):
     lockAt:         Optional[str] = None
     createdAt:      str = ''
     updatedAt:      str = ''
+    order:          Optional[AssignmentOrder] = None
 
 @dataclass
 class ReportCardResult(DataClassJsonMixin):
@@ -787,6 +817,9 @@ class CommitBundle(DataClassJsonMixin):
     userID:                 int
     commit:                 Commit
     commitSignature:        str
+    reportCardSignature:    str = ''
+    ticket:                 str = ''
+    reused:                 bool = False
 
 
 # constants
@@ -934,7 +967,7 @@ def do_request(path: str, params: Optional[Dict[str, Any]], method: str, upload:
         headers['Content-Encoding'] = 'gzip'
         data = upload.encode('utf-8')
 
-    resp = requests.request(method, url, params=params, data=data, cookies={ck: cv})
+    resp = requests.request(method, url, params=params, data=data, headers={'Authorization': 'CodeGrinder ' + cv})
 
     if notfoundokay and resp.status_code == 404:
         return None
@@ -1220,8 +1253,10 @@ def gather_student(now: datetime.datetime, startDir: str) -> Tuple[ProblemType,
 
 def must_confirm_commit_bundle(bundle: CommitBundle, args: Optional[List[str]], bar: Progress) -> CommitBundle:
     # create a websocket connection to the server
+    # the ticket from the TA is what lets the daycare accept the connection
     url = 'wss://' + bundle.hostname + urlPrefix + '/sockets/' + \
-        bundle.problemType.name + '/' + bundle.commit.action
+        bundle.problemType.name + '/' + bundle.commit.action + \
+        '?ticket=' + urllib.parse.quote(bundle.ticket, safe='')
     certs = certifi.where()
     socket = websocket.create_connection(url, sslopt={'ca_certs': certs})
 
@@ -1285,6 +1320,24 @@ def get_codegrinder_project_info() -> Tuple[str, DotFile, str, str]:
 
     return (os.path.basename(filename), dotfile, problemSetDir, problemDir)
 
+def send_activity_ping(dotfile: DotFile, problemDir: str) -> None:
+    # tell the server the student is working on this step so it can
+    # estimate time on task; this is best effort and never bothers the student
+    if len(dotfile.problems) == 1:
+        info = next(iter(dotfile.problems.values()))
+    else:
+        info = dotfile.problems.get(os.path.basename(problemDir))
+    if not info:
+        return
+    try:
+        must_load_config()
+        path = f'/assignments/{dotfile.assignmentID}/problems/{info.id}/steps/{info.step}/activity'
+        url = f'https://{CONFIG.host}{urlPrefix}{path}'
+        (ck, cv) = CONFIG.cookie.split('=', 1)
+        requests.post(url, headers={'Authorization': 'CodeGrinder ' + cv}, timeout=5)
+    except Exception:
+        pass
+
 def find_dot_file(startDir: str) -> Tuple[DotFile, str, str]:
     isAbs = False
     problemSetDir, problemDir = startDir, ''
@@ -17,6 +17,10 @@ type ProblemBundle struct {
 	UserID                int64                   `json:"userID"`
 	Commits               []*Commit               `json:"commits"`
 	CommitSignatures      []string                `json:"commitSignatures,omitempty"`
+	ReportCardSignatures  []string                `json:"reportCardSignatures,omitempty"`
+	Tickets               []string                `json:"tickets,omitempty"` // one per commit, to open its grading socket
+	ProblemHints          []*ProblemHint          `json:"problemHints,omitempty"`
+	Warnings              []string                `json:"warnings,omitempty"` // about how the confirmed steps are scored, set by the server
 }
 
 type CommitBundle struct {
@@ -30,6 +34,15 @@ type CommitBundle struct {
 	UserID               int64          `json:"userID"`
 	Commit               *Commit        `json:"commit"`
 	CommitSignature      string         `json:"commitSignature,omitempty"`
+	ReportCardSignature  string         `json:"reportCardSignature,omitempty"` // from the daycare's own key, see Commit.SignReportCard
+	Ticket               string         `json:"ticket,omitempty"`
+	AttemptsRemaining    *int64         `json:"attemptsRemaining,omitempty"`
+	SurveyRequested      bool           `json:"surveyRequested,omitempty"`
+	Hints                []*ProblemHint `json:"hints,omitempty"`
+	FeedbackPending      bool           `json:"feedbackPending,omitempty"`
+	Deadline             *Deadline      `json:"deadline,omitempty"`
+	AllowReuse           bool           `json:"allowReuse,omitempty"` // client can accept a reused result instead of a daycare
+	Reused               bool           `json:"reused,omitempty"`     // result is from an earlier submission of the same files
 }
 
 // MaxDaycareRequestAge is the maximum age of a daycare-signed commit to be saved.
@@ -42,8 +55,13 @@ type DaycareRequest struct {
 	CommitBundle *CommitBundle `json:"commitBundle,omitempty"`
 	Stdin        []byte        `json:"stdin,omitempty"`
 	CloseStdin   bool          `json:"closeStdin,omitempty"`
+	Heartbeat    bool          `json:"heartbeat,omitempty"`
 }
 
+// DaycareHeartbeatInterval is how often a client tells the daycare it is still there.
+// A daycare stops the work of a client it has not heard from for a few intervals.
+const DaycareHeartbeatInterval = 10 * time.Second
+
 // DaycareResponse represents a single response from the daycare back to a client.
 // These objects are streamed across a websockets connection.
 type DaycareResponse struct {
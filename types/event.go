@@ -23,6 +23,8 @@ type ReportCard struct {
 //	failed
 //	error
 //	skipped
+//	banned (the code uses something the problem does not allow)
+//	missing (the code lacks something the problem requires)
 //
 // Details: a multi-line message that should
 //
@@ -58,6 +60,10 @@ type EventMessage struct {
 	Error       string            `json:"error,omitempty"`
 	ReportCard  *ReportCard       `json:"reportCard,omitempty"`
 	Files       map[string][]byte `json:"files,omitempty"`
+
+	// a queued event gives the job's place in line for a grader and the estimated wait
+	QueuePosition int   `json:"queuePosition,omitempty"`
+	QueueSeconds  int64 `json:"queueSeconds,omitempty"`
 }
 
 func (e *EventMessage) String() string {
@@ -72,6 +78,8 @@ func (e *EventMessage) String() string {
 		return fmt.Sprintf("event: %s", e.Event)
 	case "error":
 		return fmt.Sprintf("event: error %s", e.Error)
+	case "queued":
+		return fmt.Sprintf("event: queued position=%d seconds=%d", e.QueuePosition, e.QueueSeconds)
 	case "reportcard":
 		return fmt.Sprintf("event: reportcard passed=%v %s in %v",
 			e.ReportCard.Passed,
@@ -104,6 +112,12 @@ func (e *EventMessage) Dump() string {
 		return string(e.StreamData)
 	case "error":
 		return fmt.Sprintf("Error: %s\r\n", e.Error)
+	case "queued":
+		if e.QueueSeconds < 1 {
+			return fmt.Sprintf("Waiting for a grader: number %d in line\r\n", e.QueuePosition)
+		}
+		return fmt.Sprintf("Waiting for a grader: number %d in line, about %v to go\r\n",
+			e.QueuePosition, time.Duration(e.QueueSeconds)*time.Second)
 	default:
 		return ""
 	}
@@ -151,6 +165,30 @@ func (elt *ReportCard) AddFailedResult(name, details, context string) *ReportCar
 	return r
 }
 
+func (elt *ReportCard) AddBannedResult(name, details, context string) *ReportCardResult {
+	elt.Passed = false
+	r := &ReportCardResult{
+		Name:    name,
+		Outcome: "banned",
+		Details: details,
+		Context: context,
+	}
+	elt.Results = append(elt.Results, r)
+	return r
+}
+
+func (elt *ReportCard) AddMissingResult(name, details, context string) *ReportCardResult {
+	elt.Passed = false
+	r := &ReportCardResult{
+		Name:    name,
+		Outcome: "missing",
+		Details: details,
+		Context: context,
+	}
+	elt.Results = append(elt.Results, r)
+	return r
+}
+
 func (elt *ReportCard) AddPassedResult(name, details string) *ReportCardResult {
 	r := &ReportCardResult{
 		Name:    name,
@@ -161,19 +199,41 @@ func (elt *ReportCard) AddPassedResult(name, details string) *ReportCardResult {
 	return r
 }
 
-func (elt *ReportCard) ComputeScore() float64 {
-	if len(elt.Results) == 0 {
-		return 0.0
-	}
-	passed := 0
+// WeighResults adds up the weight of the results that passed and of all
+// the results, using the test weights for the step. It also reports
+// whether any required test did not pass.
+func (elt *ReportCard) WeighResults(tests map[string]*StepTest) (passed, total float64, requiredFailed bool) {
 	for _, result := range elt.Results {
+		test := tests[result.Name]
+		if test == nil {
+			if _, name, found := strings.Cut(result.Name, " -> "); found {
+				test = tests[name]
+			}
+		}
+		weight := 1.0
+		if test != nil && test.Weight > 0 {
+			weight = test.Weight
+		}
+		total += weight
 		if result.Outcome == "passed" {
-			passed++
+			passed += weight
+		} else if test != nil && test.Required {
+			requiredFailed = true
 		}
 	}
-	score := float64(passed) / float64(len(elt.Results))
+	return passed, total, requiredFailed
+}
+
+// ComputeScore computes the score for a step on a scale of 0.0 to 1.0,
+// weighing the results by the step's test weights (which may be nil).
+func (elt *ReportCard) ComputeScore(tests map[string]*StepTest) float64 {
+	passed, total, requiredFailed := elt.WeighResults(tests)
+	if total == 0 || requiredFailed {
+		return 0.0
+	}
+	score := passed / total
 	if !elt.Passed && score >= 1.0 {
-		score = float64(passed) / float64(len(elt.Results)+1)
+		score = passed / (total + 1)
 	}
 	return score
 }
@@ -0,0 +1,151 @@
+package types
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The inout parser runs an action's command once for each test case and compares
+// what it prints with the expected output. A test case named NAME has its input
+// in tests/NAME.in and its expected output in tests/NAME.out.
+//
+// Before they are compared, both outputs are normalized. By default line endings
+// are made consistent and newlines at the end are ignored. More can be turned on
+// for every test in tests/normalize or for one test in tests/NAME.normalize, each
+// holding a list of these words:
+//
+//	trailing-space    ignore spaces and tabs at the ends of lines
+//	ignore-case       ignore the difference between upper and lower case
+//	exact             turn off the defaults
+//
+// along with the number tolerances understood by Tolerances.Set, such as
+// float=0.001 or abs@2=0.5. The words in tests/NAME.normalize are added to
+// those in tests/normalize.
+const (
+	InOutTestDir       = "tests"
+	InOutNormalizeFile = "normalize"
+)
+
+// maxInOutDiffLines is how many differing lines are described in a failed test.
+const maxInOutDiffLines = 5
+
+// InOutNormalization is how output is cleaned up before it is compared.
+type InOutNormalization struct {
+	lineEndings   bool
+	finalNewlines bool
+	trailingSpace bool
+	ignoreCase    bool
+	numbers       Tolerances
+}
+
+// DefaultInOutNormalization returns the normalization used when no normalize files say otherwise.
+func DefaultInOutNormalization() *InOutNormalization {
+	return &InOutNormalization{lineEndings: true, finalNewlines: true}
+}
+
+// Clone returns a copy that can be changed without changing the original.
+func (norm *InOutNormalization) Clone() *InOutNormalization {
+	elt := *norm
+	elt.numbers.PerValue = make(map[int]Tolerance)
+	for position, tol := range norm.numbers.PerValue {
+		elt.numbers.PerValue[position] = tol
+	}
+	return &elt
+}
+
+// Parse adds the words in a normalize file to the normalization.
+func (norm *InOutNormalization) Parse(contents string) error {
+	for _, word := range strings.FieldsFunc(contents, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' }) {
+		switch word {
+		case "exact":
+			norm.lineEndings, norm.finalNewlines = false, false
+		case "line-endings":
+			norm.lineEndings = true
+		case "final-newlines":
+			norm.finalNewlines = true
+		case "trailing-space":
+			norm.trailingSpace = true
+		case "ignore-case":
+			norm.ignoreCase = true
+		default:
+			if err := norm.numbers.Set(word); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lines returns output normalized and split into lines.
+func (norm *InOutNormalization) lines(output []byte) []string {
+	s := string(output)
+	if norm.lineEndings {
+		s = strings.ReplaceAll(s, "\r\n", "\n")
+		s = strings.ReplaceAll(s, "\r", "\n")
+	}
+	if norm.finalNewlines {
+		s = strings.TrimRight(s, "\n")
+	}
+	if norm.ignoreCase {
+		s = strings.ToLower(s)
+	}
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(s, "\n")
+	if norm.trailingSpace {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+	}
+	return lines
+}
+
+// Diff compares expected and actual output and describes the differences,
+// returning an empty string if they match.
+func (norm *InOutNormalization) Diff(expected, actual []byte) string {
+	want, got := norm.lines(expected), norm.lines(actual)
+	var report strings.Builder
+	count, position := 0, 0
+	for i := 0; i < len(want) || i < len(got); i++ {
+		first := position
+		if i < len(want) {
+			position += len(NumberPattern.FindAllStringIndex(want[i], -1))
+		}
+		switch {
+		case i >= len(got):
+			if count < maxInOutDiffLines {
+				fmt.Fprintf(&report, "line %d: expected %q but the output ended\n", i+1, want[i])
+			}
+		case i >= len(want):
+			if count < maxInOutDiffLines {
+				fmt.Fprintf(&report, "line %d: expected the output to end but got %q\n", i+1, got[i])
+			}
+		case !norm.numbers.MatchNumbers(want[i], got[i], first):
+			if count < maxInOutDiffLines {
+				fmt.Fprintf(&report, "line %d: expected %q but got %q\n", i+1, want[i], got[i])
+			}
+		default:
+			continue
+		}
+		count++
+	}
+	if count > maxInOutDiffLines {
+		fmt.Fprintf(&report, "...and %d more lines differ\n", count-maxInOutDiffLines)
+	}
+	return report.String()
+}
+
+// InOutTestNames returns the names of the inout test cases among files, in order.
+func InOutTestNames(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		if path.Dir(name) == InOutTestDir && path.Ext(name) == ".in" {
+			names = append(names, strings.TrimSuffix(path.Base(name), ".in"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -7,7 +7,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"math"
 	"net/url"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -23,9 +25,15 @@ import (
 var BeginningOfTime = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
 
 // ProblemType defines one type of problem.
+// OS is the operating system its container image runs ("linux" or "windows"),
+// and only daycare hosts running that OS will be asked to run it.
+// Labels lists capabilities (such as "gpu") that a daycare host must
+// advertise before it will be asked to run problems of this type.
 type ProblemType struct {
 	Name    string                        `json:"name" meddler:"name"`
 	Image   string                        `json:"image" meddler:"image"`
+	OS      string                        `json:"os" meddler:"os"`
+	Labels  []string                      `json:"labels,omitempty" meddler:"labels,json"`
 	Files   map[string][]byte             `json:"files" meddler:"-"`
 	Actions map[string]*ProblemTypeAction `json:"actions" meddler:"-"`
 }
@@ -50,13 +58,16 @@ type ProblemTypeAction struct {
 }
 
 type Problem struct {
-	ID        int64     `json:"id" meddler:"id,pk"`
-	Unique    string    `json:"unique" meddler:"unique_id"`
-	Note      string    `json:"note" meddler:"note"`
-	Tags      []string  `json:"tags" meddler:"tags,json"`
-	Options   []string  `json:"options" meddler:"options,json"`
-	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
-	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+	ID               int64     `json:"id" meddler:"id,pk"`
+	Unique           string    `json:"unique" meddler:"unique_id"`
+	Note             string    `json:"note" meddler:"note"`
+	Tags             []string  `json:"tags" meddler:"tags,json"`
+	Options          []string  `json:"options" meddler:"options,json"`
+	EstimatedMinutes int64     `json:"estimatedMinutes,omitempty" meddler:"estimated_minutes"` // zero if not estimated
+	Difficulty       int64     `json:"difficulty,omitempty" meddler:"difficulty"`              // 1 (easy) to 5 (hard), zero if not rated
+	Prerequisites    []string  `json:"prerequisites,omitempty" meddler:"prerequisites,json"`   // unique IDs of problems to finish first
+	CreatedAt        time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt        time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
 }
 
 // ProblemStep represents a single step of a problem.
@@ -64,15 +75,120 @@ type Problem struct {
 // possibly overwriting existing content. The subdirectory contents of Files
 // replace all subdirectory contents in the problem from earlier steps.
 type ProblemStep struct {
-	ProblemID    int64             `json:"problemID" meddler:"problem_id"`
-	Step         int64             `json:"step" meddler:"step"` // note: one-based
-	ProblemType  string            `json:"problemType" meddler:"problem_type"`
-	Note         string            `json:"note" meddler:"note"`
-	Instructions string            `json:"instructions" meddler:"instructions"`
-	Weight       float64           `json:"weight" meddler:"weight"`
-	Files        map[string][]byte `json:"files" meddler:"files,json"`
-	Whitelist    map[string]bool   `json:"whitelist" meddler:"whitelist,json"`
-	Solution     map[string][]byte `json:"solution,omitempty" meddler:"solution,json"`
+	ProblemID    int64                `json:"problemID" meddler:"problem_id"`
+	Step         int64                `json:"step" meddler:"step"` // note: one-based
+	ProblemType  string               `json:"problemType" meddler:"problem_type"`
+	Note         string               `json:"note" meddler:"note"`
+	Instructions string               `json:"instructions" meddler:"instructions"`
+	Localized    map[string]string    `json:"localized,omitempty" meddler:"localized_instructions,json"` // instructions in other languages, keyed by locale
+	Weight       float64              `json:"weight" meddler:"weight"`
+	MaxAttempts  int64                `json:"maxAttempts,omitempty" meddler:"max_attempts"` // zero for unlimited
+	Diagnostic   bool                 `json:"diagnostic,omitempty" meddler:"diagnostic"`    // graded and recorded, but never counts toward the score or goes to the LMS
+	Tests        map[string]*StepTest `json:"tests,omitempty" meddler:"tests,json"`
+	Files        map[string][]byte    `json:"files" meddler:"files,json"`
+	FilesBlob    string               `json:"-" meddler:"files_blob,zeroisnull"`
+	Whitelist    map[string]bool      `json:"whitelist" meddler:"whitelist,json"`
+	Solution     map[string][]byte    `json:"solution,omitempty" meddler:"solution,json"`
+}
+
+// StepTest changes how one test case counts toward the score for a step.
+// It is matched with a report card result by name, and a result named
+// "Class -> test" also matches a StepTest named test. Weight is relative
+// to the other tests in the step, with zero counting as 1. If a required
+// test does not pass, the step scores zero. The names of hidden tests are
+// not shown to students before they submit.
+type StepTest struct {
+	Weight   float64 `json:"weight,omitempty"`
+	Required bool    `json:"required,omitempty"`
+	Hidden   bool    `json:"hidden,omitempty"`
+}
+
+// ProblemHint is advice for a step that is revealed to a student who keeps
+// failing it the same way. A hint is triggered by a failing test (Test), by a
+// regular expression matched against the report card and output (Pattern),
+// or by both, and is revealed once it has been triggered After times.
+type ProblemHint struct {
+	ProblemID int64  `json:"problemID" meddler:"problem_id"`
+	Step      int64  `json:"step" meddler:"step"`         // note: one-based
+	Position  int64  `json:"position" meddler:"position"` // note: one-based
+	Test      string `json:"test,omitempty" meddler:"test,zeroisnull"`
+	Pattern   string `json:"pattern,omitempty" meddler:"pattern,zeroisnull"`
+	After     int64  `json:"after" meddler:"after_failures"`
+	Text      string `json:"text" meddler:"hint"`
+}
+
+// PastExplanation is what a student sees of an approved explanation.
+// It says nothing about whose commit prompted it or who wrote it.
+type PastExplanation struct {
+	Signature   string `json:"signature" meddler:"signature"`
+	Explanation string `json:"explanation" meddler:"explanation"`
+}
+
+// StepRubric shows a student how a step will be scored before they submit.
+// Tests lists the tests the author gave a weight or marked as required,
+// except for hidden tests, which are only counted. Any other test counts
+// with a weight of 1. StyleWeight is the weight of the listed and hidden
+// tests that check style rather than behavior.
+type StepRubric struct {
+	ProblemID      int64         `json:"problemID"`
+	Step           int64         `json:"step"`
+	Weight         float64       `json:"weight"`
+	MaxAttempts    int64         `json:"maxAttempts,omitempty"`
+	Diagnostic     bool          `json:"diagnostic,omitempty"`
+	Tests          []*RubricTest `json:"tests"`
+	StyleWeight    float64       `json:"styleWeight"`
+	HiddenTests    int64         `json:"hiddenTests"`
+	HiddenWeight   float64       `json:"hiddenWeight"`
+	HiddenRequired int64         `json:"hiddenRequired"`
+}
+
+// RubricTest is one visible test in a StepRubric.
+type RubricTest struct {
+	Name     string  `json:"name"`
+	Weight   float64 `json:"weight"`
+	Required bool    `json:"required,omitempty"`
+	Style    bool    `json:"style,omitempty"`
+}
+
+// StepAttempts reports how many graded attempts a student has used on a step.
+// MaxAttempts and Remaining are zero for steps with no limit.
+type StepAttempts struct {
+	MaxAttempts int64 `json:"maxAttempts"`
+	Used        int64 `json:"used"`
+	Remaining   int64 `json:"remaining"`
+}
+
+// ProblemSurvey is a student's response to the optional survey offered
+// after passing the final step of a problem. Difficulty runs from 1 (easy)
+// to 5 (hard). Zero values mean the question was skipped.
+type ProblemSurvey struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	UserID       int64     `json:"userID" meddler:"user_id"`
+	Difficulty   int64     `json:"difficulty,omitempty" meddler:"difficulty"`
+	Minutes      int64     `json:"minutes,omitempty" meddler:"minutes"`
+	Comments     string    `json:"comments,omitempty" meddler:"comments"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// MaxSurveyDifficulty is the hardest rating a survey response can give.
+const MaxSurveyDifficulty = 5
+
+// MaxSurveyMinutes caps the reported time spent so one typo does not skew the averages.
+const MaxSurveyMinutes = 100 * 60
+
+// ProblemSurveyResults summarizes the survey responses for a problem.
+// Averages only include responses that answered the question.
+// Comments are listed without the students who wrote them.
+type ProblemSurveyResults struct {
+	ProblemID         int64    `json:"problemID"`
+	Responses         int64    `json:"responses"`
+	DifficultyCounts  []int64  `json:"difficultyCounts"`
+	AverageDifficulty float64  `json:"averageDifficulty"`
+	AverageMinutes    float64  `json:"averageMinutes"`
+	MedianMinutes     int64    `json:"medianMinutes"`
+	Comments          []string `json:"comments"`
 }
 
 type ProblemSet struct {
@@ -84,6 +200,46 @@ type ProblemSet struct {
 	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
 }
 
+// ProblemSetCanary sends a share of new assignment launches for a problem set
+// to a candidate problem set so the two can be compared before the candidate
+// replaces it for everyone. Students in the listed sections always get the candidate.
+type ProblemSetCanary struct {
+	ID                    int64     `json:"id" meddler:"id,pk"`
+	ProblemSetID          int64     `json:"problemSetID" meddler:"problem_set_id"`
+	CandidateProblemSetID int64     `json:"candidateProblemSetID" meddler:"candidate_problem_set_id"`
+	Percent               int64     `json:"percent" meddler:"percent"`
+	SectionIDs            []int64   `json:"sectionIDs" meddler:"section_ids,json"`
+	Promoted              bool      `json:"promoted" meddler:"promoted"`
+	CreatedAt             time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt             time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// AvailabilityWindow limits when students can launch problems.
+// A window with only ProblemID applies to that problem in every course,
+// a window with only CourseID applies to every problem in that course,
+// and a window with both applies to that problem in that course.
+// A missing OpenAt or CloseAt leaves that end of the window unbounded.
+type AvailabilityWindow struct {
+	ID        int64      `json:"id" meddler:"id,pk"`
+	ProblemID int64      `json:"problemID,omitempty" meddler:"problem_id,zeroisnull"`
+	CourseID  int64      `json:"courseID,omitempty" meddler:"course_id,zeroisnull"`
+	OpenAt    *time.Time `json:"openAt" meddler:"open_at,localtime"`
+	CloseAt   *time.Time `json:"closeAt" meddler:"close_at,localtime"`
+	CreatedAt time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt time.Time  `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// IsOpen reports whether the window is open at the given time.
+func (window *AvailabilityWindow) IsOpen(now time.Time) bool {
+	if window.OpenAt != nil && now.Before(*window.OpenAt) {
+		return false
+	}
+	if window.CloseAt != nil && !now.Before(*window.CloseAt) {
+		return false
+	}
+	return true
+}
+
 type ProblemSetProblem struct {
 	ProblemSetID int64   `json:"problemSetID,omitempty" meddler:"problem_set_id"`
 	ProblemID    int64   `json:"problemID" meddler:"problem_id"`
@@ -125,6 +281,30 @@ func (problem *Problem) Normalize(now time.Time, steps []*ProblemStep) error {
 	}
 	sort.Strings(problem.Tags)
 
+	// check the author's estimates
+	if problem.EstimatedMinutes < 0 {
+		return fmt.Errorf("estimated minutes cannot be negative")
+	}
+	if problem.Difficulty < 0 || problem.Difficulty > MaxSurveyDifficulty {
+		return fmt.Errorf("difficulty must be between 1 and %d", MaxSurveyDifficulty)
+	}
+
+	// check prerequisites
+	seen := make(map[string]bool)
+	var prerequisites []string
+	for _, unique := range problem.Prerequisites {
+		unique = strings.TrimSpace(unique)
+		if unique == problem.Unique {
+			return fmt.Errorf("problem cannot be its own prerequisite")
+		}
+		if unique != "" && !seen[unique] {
+			seen[unique] = true
+			prerequisites = append(prerequisites, unique)
+		}
+	}
+	sort.Strings(prerequisites)
+	problem.Prerequisites = prerequisites
+
 	// check steps and make sure whitelists never drop names
 	if len(steps) == 0 {
 		return fmt.Errorf("problem must have at least one step")
@@ -174,6 +354,10 @@ func (problemType *ProblemType) ComputeSignature(secret string) string {
 	// gather all relevant fields
 	v.Add("name", problemType.Name)
 	v.Add("image", problemType.Image)
+	v.Add("os", problemType.OS)
+	for n, label := range problemType.Labels {
+		v.Add(fmt.Sprintf("label-%d", n), label)
+	}
 	for name, contents := range problemType.Files {
 		v.Add(fmt.Sprintf("file-%s", name), string(contents))
 	}
@@ -208,6 +392,15 @@ func (problem *Problem) ComputeSignature(secret string, steps []*ProblemStep) st
 	v.Add("note", problem.Note)
 	v["tags"] = problem.Tags
 	v["options"] = problem.Options
+	if problem.EstimatedMinutes > 0 {
+		v.Add("estimatedMinutes", strconv.FormatInt(problem.EstimatedMinutes, 10))
+	}
+	if problem.Difficulty > 0 {
+		v.Add("difficulty", strconv.FormatInt(problem.Difficulty, 10))
+	}
+	if len(problem.Prerequisites) > 0 {
+		v["prerequisites"] = problem.Prerequisites
+	}
 	v.Add("createdAt", problem.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
 	v.Add("updatedAt", problem.UpdatedAt.Round(time.Second).UTC().Format(time.RFC3339))
 	for n, step := range steps {
@@ -218,6 +411,17 @@ func (problem *Problem) ComputeSignature(secret string, steps []*ProblemStep) st
 		v.Add(fmt.Sprintf("step-%d-problem-type", step.Step), step.ProblemType)
 		v.Add(fmt.Sprintf("step-%d-note", step.Step), step.Note)
 		v.Add(fmt.Sprintf("step-%d-weight", step.Step), strconv.FormatFloat(step.Weight, 'g', -1, 64))
+		if step.MaxAttempts > 0 {
+			v.Add(fmt.Sprintf("step-%d-max-attempts", step.Step), strconv.FormatInt(step.MaxAttempts, 10))
+		}
+		if step.Diagnostic {
+			v.Add(fmt.Sprintf("step-%d-diagnostic", step.Step), "true")
+		}
+		for name, test := range step.Tests {
+			v.Add(fmt.Sprintf("step-%d-test-%s-weight", step.Step, name), strconv.FormatFloat(test.Weight, 'g', -1, 64))
+			v.Add(fmt.Sprintf("step-%d-test-%s-required", step.Step, name), strconv.FormatBool(test.Required))
+			v.Add(fmt.Sprintf("step-%d-test-%s-hidden", step.Step, name), strconv.FormatBool(test.Hidden))
+		}
 		for name, contents := range step.Files {
 			v.Add(fmt.Sprintf("step-%d-file-%s", step.Step, name), string(contents))
 		}
@@ -249,15 +453,32 @@ func (step *ProblemStep) Normalize(n int64) error {
 	if step.Note == "" {
 		return fmt.Errorf("missing note for step %d", n+1)
 	}
-	instructions, err := step.BuildInstructions()
+	instructions, localized, err := step.BuildInstructions()
 	if err != nil {
 		return fmt.Errorf("error building instructions for step %d: %v", n, err)
 	}
 	step.Instructions = instructions
-	if step.Weight <= 0.0 {
+	step.Localized = localized
+	if math.IsNaN(step.Weight) || math.IsInf(step.Weight, 0) || step.Weight < 0.0 {
+		return fmt.Errorf("weight for step %d must be a positive number", n)
+	}
+	if step.Diagnostic {
+		// diagnostic steps (environment checks, surveys) never count
+		if step.Weight > 0.0 {
+			return fmt.Errorf("step %d is a diagnostic step, so it cannot have a weight", n)
+		}
+	} else if step.Weight == 0.0 {
 		// default to 1.0
 		step.Weight = 1.0
 	}
+	if step.MaxAttempts < 0 {
+		return fmt.Errorf("maximum attempts for step %d cannot be negative", n)
+	}
+	for name, test := range step.Tests {
+		if test == nil || test.Weight < 0 {
+			return fmt.Errorf("test %q in step %d cannot have a negative weight", name, n)
+		}
+	}
 	clean := make(map[string][]byte)
 	for name, contents := range step.Files {
 		dir := filepath.Dir(filepath.FromSlash(name))
@@ -279,9 +500,43 @@ func (step *ProblemStep) Normalize(n int64) error {
 	return nil
 }
 
+// ScoringWarnings looks at the report card for a step's solution and
+// describes anything about how the step is scored that is probably not
+// what the author intended.
+func (step *ProblemStep) ScoringWarnings(rc *ReportCard) []string {
+	var warnings []string
+	if rc == nil || step.Diagnostic {
+		return warnings
+	}
+	if len(rc.Results) == 0 {
+		warnings = append(warnings, fmt.Sprintf("step %d reports no test results, so it can only score 0 or 1", step.Step))
+	}
+	used := make(map[string]bool)
+	for _, result := range rc.Results {
+		used[result.Name] = true
+		if _, name, found := strings.Cut(result.Name, " -> "); found {
+			used[name] = true
+		}
+	}
+	var unused []string
+	for name := range step.Tests {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	for _, name := range unused {
+		warnings = append(warnings, fmt.Sprintf("test %q in step %d matches no result from the solution, so its settings have no effect", name, step.Step))
+	}
+	return warnings
+}
+
 // buildInstructions builds the instructions for a problem step as a single
-// html document. Markdown is processed and images are inlined.
-func (step *ProblemStep) BuildInstructions() (string, error) {
+// html document, along with a version for each locale that has its own
+// doc/doc.LOCALE.md or doc/doc.LOCALE.html file. Markdown is processed,
+// images are inlined, and links to other files in doc are left alone so
+// they work next to doc/index.html.
+func (step *ProblemStep) BuildInstructions() (string, map[string]string, error) {
 	// get a list of all files in the doc directory
 	used := make(map[string]bool)
 	for name := range step.Files {
@@ -290,9 +545,59 @@ func (step *ProblemStep) BuildInstructions() (string, error) {
 		}
 	}
 
+	instructions, err := step.renderInstructions("doc", used)
+	if err != nil {
+		return "", nil, err
+	}
+	if instructions == "" {
+		return "", nil, loggedErrorf("no documentation found: checked doc/doc.html and doc/doc.md")
+	}
+
+	// look for translations
+	var localized map[string]string
+	for name := range used {
+		base := filepath.Base(name)
+		if !strings.HasPrefix(base, "doc.") || (!strings.HasSuffix(base, ".md") && !strings.HasSuffix(base, ".html")) {
+			continue
+		}
+		stem := strings.TrimSuffix(base, filepath.Ext(base))
+		if stem == "doc" {
+			continue
+		}
+		locale := NormalizeLocale(strings.TrimPrefix(stem, "doc."))
+		if locale == "" {
+			return "", nil, loggedErrorf("%s does not name a valid locale (try doc.es.md or doc.pt-br.md)", name)
+		}
+		if _, present := localized[locale]; present {
+			continue
+		}
+		elt, err := step.renderInstructions(strings.TrimSuffix(base, filepath.Ext(base)), used)
+		if err != nil {
+			return "", nil, err
+		}
+		if localized == nil {
+			localized = make(map[string]string)
+		}
+		localized[locale] = elt
+	}
+
+	// warn about unused files in doc
+	for name, u := range used {
+		if !u {
+			log.Printf("Warning: %s was not used in the instructions", name)
+		}
+	}
+
+	return instructions, localized, nil
+}
+
+// renderInstructions renders one version of the instructions from
+// doc/STEM.html or doc/STEM.md, marking the doc files it uses.
+// It returns an empty string if neither file exists.
+func (step *ProblemStep) renderInstructions(stem string, used map[string]bool) (string, error) {
 	var justHTML []byte
-	dochtml := filepath.Join("doc", "doc.html")
-	docmd := filepath.Join("doc", "doc.md")
+	dochtml := filepath.Join("doc", stem+".html")
+	docmd := filepath.Join("doc", stem+".md")
 	if data, ok := step.Files[dochtml]; ok {
 		justHTML = data
 		used[dochtml] = true
@@ -313,18 +618,18 @@ func (step *ProblemStep) BuildInstructions() (string, error) {
 			blackfriday.WithRenderer(renderer))
 		used[docmd] = true
 	} else {
-		return "", loggedErrorf("no documentation found: checked doc/doc.html and doc/doc.md")
+		return "", nil
 	}
 
 	// make sure it is well-formed utf8
 	if !utf8.Valid(justHTML) {
-		return "", loggedErrorf("doc.{html,md} is not valid utf8")
+		return "", loggedErrorf("%s.{html,md} is not valid utf8", stem)
 	}
 
 	// parse the html
 	doc, err := html.Parse(bytes.NewReader(justHTML))
 	if err != nil {
-		log.Printf("Error parsing doc.html: %v", err)
+		log.Printf("Error parsing %s: %v", stem, err)
 		return "", err
 	}
 	if doc == nil {
@@ -368,6 +673,23 @@ func (step *ProblemStep) BuildInstructions() (string, error) {
 				}
 			}
 		}
+		if n.Type == html.ElementNode && n.Data == "a" {
+			for _, a := range n.Attr {
+				if a.Key != "href" {
+					continue
+				}
+				attachment, ok := AttachmentName(a.Val)
+				if !ok {
+					continue
+				}
+				name := filepath.Join("doc", filepath.FromSlash(attachment))
+				if _, present := step.Files[name]; present {
+					used[name] = true
+				} else {
+					log.Printf("Warning: link found, but attachment file not found: %s", a.Val)
+				}
+			}
+		}
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
 			if err := walk(c); err != nil {
 				return err
@@ -378,13 +700,7 @@ func (step *ProblemStep) BuildInstructions() (string, error) {
 	if err = walk(doc); err != nil {
 		return "", err
 	}
-
-	// warn about unused files in doc
-	for name, u := range used {
-		if !u {
-			log.Printf("Warning: %s was not used in the instructions", name)
-		}
-	}
+	SanitizeHTML(doc)
 
 	// re-render it
 	var buf bytes.Buffer
@@ -448,6 +764,215 @@ func fixNewLines(s []byte) []byte {
 	return bytes.Replace(s, []byte("\r\n"), []byte("\n"), -1)
 }
 
+// NormalizeLocale puts a locale tag like "es_MX" or "pt-BR" in the form
+// used for instruction translations ("es-mx", "pt-br").
+// It returns an empty string if the tag is not a plausible locale.
+func NormalizeLocale(tag string) string {
+	tag = strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+	if i := strings.IndexAny(tag, ".@"); i >= 0 {
+		// drop encodings and modifiers, as in es_MX.UTF-8
+		tag = tag[:i]
+	}
+	parts := strings.Split(tag, "-")
+	if len(parts[0]) < 2 || len(parts[0]) > 3 {
+		return ""
+	}
+	for i, part := range parts {
+		if part == "" || len(part) > 8 {
+			return ""
+		}
+		for _, ch := range part {
+			if !(ch >= 'a' && ch <= 'z') && !(i > 0 && ch >= '0' && ch <= '9') {
+				return ""
+			}
+		}
+	}
+	return tag
+}
+
+// Localize replaces the instructions with the best translation for a
+// locale. A locale matches a translation for the same language if there is
+// none for its region, so "es-mx" falls back to "es" and then to any other
+// Spanish version. If nothing matches, the default instructions are kept.
+func (step *ProblemStep) Localize(locale string) {
+	locale = NormalizeLocale(locale)
+	if locale == "" || len(step.Localized) == 0 {
+		return
+	}
+	if elt, present := step.Localized[locale]; present {
+		step.Instructions = elt
+		return
+	}
+	language := strings.Split(locale, "-")[0]
+	if elt, present := step.Localized[language]; present {
+		step.Instructions = elt
+		return
+	}
+	var keys []string
+	for key := range step.Localized {
+		if strings.HasPrefix(key, language+"-") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		step.Instructions = step.Localized[keys[0]]
+	}
+}
+
+// allowedElements are the elements kept in instructions. Anything else is
+// removed, keeping its contents unless it is listed in droppedElements.
+// html, head, and body are kept because html.Parse adds them to every document.
+var allowedElements = map[string]bool{
+	"html": true, "head": true, "body": true,
+	"a": true, "abbr": true, "b": true, "blockquote": true, "br": true,
+	"caption": true, "cite": true, "code": true, "col": true, "colgroup": true,
+	"dd": true, "del": true, "details": true, "dfn": true, "div": true,
+	"dl": true, "dt": true, "em": true, "figcaption": true, "figure": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"hr": true, "i": true, "img": true, "ins": true, "kbd": true, "li": true,
+	"mark": true, "ol": true, "p": true, "pre": true, "q": true, "s": true,
+	"samp": true, "small": true, "span": true, "strike": true, "strong": true,
+	"sub": true, "summary": true, "sup": true, "table": true, "tbody": true,
+	"td": true, "tfoot": true, "th": true, "thead": true, "tr": true,
+	"tt": true, "u": true, "ul": true, "var": true,
+}
+
+// droppedElements are removed from instructions along with everything inside them.
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "template": true, "noscript": true,
+	"iframe": true, "frame": true, "frameset": true, "object": true,
+	"embed": true, "applet": true, "svg": true, "math": true,
+	"title": true, "textarea": true, "select": true, "xmp": true,
+	"noembed": true, "noframes": true, "plaintext": true,
+}
+
+// allowedAttributes are the attributes kept on each element, in addition to
+// those in allowedAttributes["*"], which any allowed element may have.
+var allowedAttributes = map[string]map[string]bool{
+	"*":          {"class": true, "id": true, "title": true, "lang": true, "dir": true},
+	"a":          {"href": true, "name": true},
+	"blockquote": {"cite": true},
+	"col":        {"span": true},
+	"colgroup":   {"span": true},
+	"del":        {"cite": true, "datetime": true},
+	"details":    {"open": true},
+	"img":        {"src": true, "alt": true, "width": true, "height": true},
+	"ins":        {"cite": true, "datetime": true},
+	"li":         {"value": true},
+	"ol":         {"start": true, "type": true, "reversed": true},
+	"q":          {"cite": true},
+	"td":         {"align": true, "colspan": true, "rowspan": true},
+	"th":         {"align": true, "colspan": true, "rowspan": true, "scope": true},
+}
+
+// urlAttributes are the attributes whose values are URLs.
+// They are only kept if the URL is relative or uses an allowed scheme.
+var urlAttributes = map[string]bool{"href": true, "src": true, "cite": true}
+
+// allowedSchemes are the URL schemes allowed in links.
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// SanitizeHTML reduces a parsed html document to the elements, attributes,
+// and URL schemes that instructions need, so nothing in it can run code in
+// a student's browser. Images may also use data:image/ URLs, which is how
+// images from the doc directory are embedded.
+func SanitizeHTML(n *html.Node) {
+	var next *html.Node
+	for c := n.FirstChild; c != nil; c = next {
+		next = c.NextSibling
+		switch c.Type {
+		case html.ElementNode:
+			if c.Namespace != "" || droppedElements[c.Data] {
+				n.RemoveChild(c)
+				continue
+			}
+			SanitizeHTML(c)
+			if !allowedElements[c.Data] {
+				// keep what was inside it
+				for c.FirstChild != nil {
+					child := c.FirstChild
+					c.RemoveChild(child)
+					n.InsertBefore(child, c)
+				}
+				n.RemoveChild(c)
+			}
+		case html.TextNode:
+		default:
+			// comments and doctypes
+			n.RemoveChild(c)
+		}
+	}
+	if n.Type != html.ElementNode {
+		return
+	}
+	var attrs []html.Attribute
+	for _, a := range n.Attr {
+		if a.Namespace != "" {
+			continue
+		}
+		key := strings.ToLower(a.Key)
+		if !allowedAttributes["*"][key] && !allowedAttributes[n.Data][key] {
+			continue
+		}
+		if urlAttributes[key] && !safeURL(a.Val, n.Data == "img" && key == "src") {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+// SanitizeInstructions applies SanitizeHTML to stored instructions, which may
+// have been saved under older, looser rules.
+func SanitizeInstructions(instructions string) string {
+	doc, err := html.Parse(strings.NewReader(instructions))
+	if err != nil {
+		return ""
+	}
+	SanitizeHTML(doc)
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// safeURL checks that a URL is relative or uses an allowed scheme.
+// If image is true, data:image/ URLs are also allowed.
+func safeURL(val string, image bool) bool {
+	// browsers ignore whitespace and control characters in a scheme
+	val = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, val)
+	colon := strings.IndexByte(val, ':')
+	if colon < 0 || strings.ContainsAny(val[:colon], "/?#") {
+		return true
+	}
+	scheme := strings.ToLower(val[:colon])
+	if allowedSchemes[scheme] {
+		return true
+	}
+	return image && scheme == "data" && strings.HasPrefix(strings.ToLower(val[colon+1:]), "image/")
+}
+
+// AttachmentName checks if a link in the instructions refers to another
+// file in the doc directory, and if so returns its name relative to doc.
+func AttachmentName(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	name := path.Clean(u.Path)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
 func loggedErrorf(f string, params ...interface{}) error {
 	log.Print(logPrefix() + fmt.Sprintf(f, params...))
 	return fmt.Errorf(f, params...)
@@ -0,0 +1,165 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Tolerance says how far a number may be from its expected value and still match.
+// A number matches if it is within Abs of the expected value, or within Rel times
+// the size of the expected value. The zero Tolerance only accepts an exact match.
+//
+// Infinities only match infinities of the same sign. NaN never matches anything,
+// not even NaN, unless NaN is set, in which case any NaN matches any other.
+type Tolerance struct {
+	Abs float64 `json:"abs,omitempty"`
+	Rel float64 `json:"rel,omitempty"`
+	NaN bool    `json:"nan,omitempty"`
+}
+
+// Match reports whether got is close enough to want.
+func (tol Tolerance) Match(want, got float64) bool {
+	switch {
+	case math.IsNaN(want) || math.IsNaN(got):
+		return tol.NaN && math.IsNaN(want) && math.IsNaN(got)
+	case math.IsInf(want, 0) || math.IsInf(got, 0):
+		return want == got
+	}
+	diff := math.Abs(want - got)
+	return diff <= tol.Abs || diff <= tol.Rel*math.Abs(want)
+}
+
+// IsExact reports whether the tolerance only accepts exact matches.
+func (tol Tolerance) IsExact() bool {
+	return tol.Abs == 0 && tol.Rel == 0 && !tol.NaN
+}
+
+// NumberPattern finds the numbers in program output, including inf, infinity, and nan
+// in any case and with an optional sign.
+var NumberPattern = regexp.MustCompile(`(?i)[-+]?(?:\d+\.?\d*|\.\d+)(?:e[-+]?\d+)?|[-+]?\b(?:inf(?:inity)?|nan)\b`)
+
+// Tolerances gives a tolerance for each number in an output, counting from zero.
+// Numbers without a tolerance of their own use Default.
+type Tolerances struct {
+	Default  Tolerance         `json:"default"`
+	PerValue map[int]Tolerance `json:"perValue,omitempty"`
+}
+
+// For returns the tolerance for the number at the given position.
+func (tols *Tolerances) For(position int) Tolerance {
+	if tol, present := tols.PerValue[position]; present {
+		return tol
+	}
+	return tols.Default
+}
+
+// IsExact reports whether every number must match exactly.
+func (tols *Tolerances) IsExact() bool {
+	if !tols.Default.IsExact() {
+		return false
+	}
+	for _, tol := range tols.PerValue {
+		if !tol.IsExact() {
+			return false
+		}
+	}
+	return true
+}
+
+// Set changes a tolerance from a setting in test-case metadata:
+//
+//	abs=1e-6      accept numbers within 1e-6 of the expected value
+//	rel=1e-9      accept numbers within 1e-9 times the size of the expected value
+//	float=1e-6    either of the above, whichever is looser
+//	nan           let NaN match NaN
+//	abs@3=0.5     a setting with @N applies only to the Nth number (counting from one)
+//
+// A number with settings of its own starts with the defaults in effect at the
+// time of its first setting.
+func (tols *Tolerances) Set(setting string) error {
+	key, value, hasValue := strings.Cut(setting, "=")
+	tol := &tols.Default
+	if name, at, found := strings.Cut(key, "@"); found {
+		n, err := strconv.Atoi(at)
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad number position in %q", setting)
+		}
+		if tols.PerValue == nil {
+			tols.PerValue = make(map[int]Tolerance)
+		}
+		elt, present := tols.PerValue[n-1]
+		if !present {
+			elt = tols.Default
+		}
+		defer func() { tols.PerValue[n-1] = elt }()
+		key, tol = name, &elt
+	}
+
+	if key == "nan" {
+		if hasValue {
+			return fmt.Errorf("nan does not take a value")
+		}
+		tol.NaN = true
+		return nil
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil || amount < 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return fmt.Errorf("bad tolerance %q", setting)
+	}
+	switch key {
+	case "abs":
+		tol.Abs = amount
+	case "rel":
+		tol.Rel = amount
+	case "float":
+		tol.Abs, tol.Rel = amount, amount
+	default:
+		return fmt.Errorf("unknown tolerance %q", setting)
+	}
+	return nil
+}
+
+// MatchNumbers compares a line of expected output with the line actually printed.
+// The text around the numbers must be the same, and each number must be within
+// its tolerance. first is the position of the line's first number in the whole output.
+func (tols *Tolerances) MatchNumbers(want, got string, first int) bool {
+	if want == got {
+		return true
+	}
+	if tols.IsExact() {
+		return false
+	}
+	wantNumbers := NumberPattern.FindAllString(want, -1)
+	gotNumbers := NumberPattern.FindAllString(got, -1)
+	if len(wantNumbers) != len(gotNumbers) ||
+		NumberPattern.ReplaceAllString(want, "#") != NumberPattern.ReplaceAllString(got, "#") {
+		return false
+	}
+	for i := range wantNumbers {
+		a, errA := parseNumber(wantNumbers[i])
+		b, errB := parseNumber(gotNumbers[i])
+		if errA != nil || errB != nil {
+			// too large to parse, so compare the text
+			if wantNumbers[i] != gotNumbers[i] {
+				return false
+			}
+			continue
+		}
+		if !tols.For(first+i).Match(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNumber parses a number found by NumberPattern. Unlike strconv.ParseFloat,
+// it accepts a sign on nan, which C libraries print as -nan.
+func parseNumber(s string) (float64, error) {
+	if strings.EqualFold(strings.TrimLeft(s, "+-"), "nan") {
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -2,12 +2,15 @@ package types
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/url"
 	"sort"
 	"strconv"
@@ -45,6 +48,7 @@ type User struct {
 	CanvasID       int64     `json:"canvasID" meddler:"canvas_id"`
 	Author         bool      `json:"author" meddler:"author"`
 	Admin          bool      `json:"admin" meddler:"admin"`
+	Locale         string    `json:"locale,omitempty" meddler:"locale"` // from the LMS, e.g., "es-mx"
 	CreatedAt      time.Time `json:"createdAt" meddler:"created_at,localtime"`
 	UpdatedAt      time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
 	LastSignedInAt time.Time `json:"lastSignedInAt" meddler:"last_signed_in_at,localtime"`
@@ -76,22 +80,166 @@ type Assignment struct {
 	LockAt             *time.Time           `json:"lockAt" meddler:"lock_at,localtime"`
 	CreatedAt          time.Time            `json:"createdAt" meddler:"created_at,localtime"`
 	UpdatedAt          time.Time            `json:"updatedAt" meddler:"updated_at,localtime"`
+	Announcements      []*Announcement      `json:"announcements,omitempty" meddler:"-"`
+	Deadline           *Deadline            `json:"deadline,omitempty" meddler:"-"`
+	Order              *AssignmentOrder     `json:"order,omitempty" meddler:"-"`
+}
+
+// BulkAssignment asks for a problem set to be assigned to everyone in a course.
+// Title defaults to the problem set's note. The dates are optional.
+type BulkAssignment struct {
+	ProblemSetID int64      `json:"problemSetID"`
+	Title        string     `json:"title"`
+	UnlockAt     *time.Time `json:"unlockAt"`
+	DueAt        *time.Time `json:"dueAt"`
+	LockAt       *time.Time `json:"lockAt"`
+}
+
+// BulkAssignmentResult reports what a bulk assignment did. Running the same
+// request again updates the title and dates instead of making new assignments.
+type BulkAssignmentResult struct {
+	LtiID       string        `json:"ltiID"`
+	Created     int           `json:"created"`
+	Updated     int           `json:"updated"`
+	Unchanged   int           `json:"unchanged"`
+	Assignments []*Assignment `json:"assignments"`
+}
+
+// AssignmentOrder places an assignment in the recommended order for working
+// through a course, based on the prerequisites of its problems. Position counts
+// from 1 among the student's assignments in the course. Prerequisites lists the
+// problems from other assignments in the course that should be finished first,
+// and Unmet those the student has not finished yet. A locked assignment cannot be
+// worked on until they are, which only happens in courses that enforce prerequisites.
+type AssignmentOrder struct {
+	Position      int      `json:"position"`
+	Prerequisites []string `json:"prerequisites,omitempty"`
+	Unmet         []string `json:"unmet,omitempty"`
+	Locked        bool     `json:"locked,omitempty"`
+}
+
+// Deadline is the server's view of an assignment's deadlines, stamped with the
+// server's clock. Clients should count down from ServerTime rather than their own
+// clock. LockAt is the lock date the server enforces, and GraceMinutes is how long
+// past the due and lock dates work is still accepted as on time. The signature lets
+// the server confirm later that it issued the deadline, e.g., in a dispute.
+type Deadline struct {
+	AssignmentID int64      `json:"assignmentID"`
+	ServerTime   time.Time  `json:"serverTime"`
+	DueAt        *time.Time `json:"dueAt,omitempty"`
+	LockAt       *time.Time `json:"lockAt,omitempty"`
+	GraceMinutes int64      `json:"graceMinutes"`
+	Signature    string     `json:"signature"`
+}
+
+func (deadline *Deadline) ComputeSignature(secret string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("assignment_id", strconv.FormatInt(deadline.AssignmentID, 10))
+	v.Add("server_time", deadline.ServerTime.UTC().Format(time.RFC3339Nano))
+	if deadline.DueAt != nil {
+		v.Add("due_at", deadline.DueAt.UTC().Format(time.RFC3339))
+	}
+	if deadline.LockAt != nil {
+		v.Add("lock_at", deadline.LockAt.UTC().Format(time.RFC3339))
+	}
+	v.Add("grace_minutes", strconv.FormatInt(deadline.GraceMinutes, 10))
+
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(encode(v))
+	sum := mac.Sum(nil)
+	return base64.StdEncoding.EncodeToString(sum)
 }
 
 // Commit defines an attempt at solving one step of a Problem.
 type Commit struct {
-	ID           int64             `json:"id" meddler:"id,pk"`
-	AssignmentID int64             `json:"assignmentID" meddler:"assignment_id"`
-	ProblemID    int64             `json:"problemID" meddler:"problem_id"`
-	Step         int64             `json:"step" meddler:"step"` // note: one-based
-	Action       string            `json:"action" meddler:"action,zeroisnull"`
-	Note         string            `json:"note" meddler:"note,zeroisnull"`
-	Files        map[string][]byte `json:"files" meddler:"files,json"`
-	Transcript   []*EventMessage   `json:"transcript,omitempty" meddler:"transcript,json"`
-	ReportCard   *ReportCard       `json:"reportCard" meddler:"report_card,json"`
-	Score        float64           `json:"score" meddler:"score,zeroisnull"`
-	CreatedAt    time.Time         `json:"createdAt" meddler:"created_at,localtime"`
-	UpdatedAt    time.Time         `json:"updatedAt" meddler:"updated_at,localtime"`
+	ID             int64             `json:"id" meddler:"id,pk"`
+	AssignmentID   int64             `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID      int64             `json:"problemID" meddler:"problem_id"`
+	Step           int64             `json:"step" meddler:"step"` // note: one-based
+	Action         string            `json:"action" meddler:"action,zeroisnull"`
+	Note           string            `json:"note" meddler:"note,zeroisnull"`
+	Files          map[string][]byte `json:"files" meddler:"files,json"`
+	FilesBlob      string            `json:"-" meddler:"files_blob,zeroisnull"`
+	Transcript     []*EventMessage   `json:"transcript,omitempty" meddler:"transcript,json"`
+	TranscriptBlob string            `json:"-" meddler:"transcript_blob,zeroisnull"`
+	ReportCard     *ReportCard       `json:"reportCard" meddler:"report_card,json"`
+	Score          float64           `json:"score" meddler:"score,zeroisnull"`
+	RemoteAddr     string            `json:"remoteAddr,omitempty" meddler:"remote_addr,zeroisnull"`
+	UserAgent      string            `json:"userAgent,omitempty" meddler:"user_agent,zeroisnull"`
+	Client         string            `json:"client,omitempty" meddler:"client,zeroisnull"`
+	ClientVersion  string            `json:"clientVersion,omitempty" meddler:"client_version,zeroisnull"`
+	OffSite        bool              `json:"offSite,omitempty" meddler:"off_site"`
+	Practice       bool              `json:"practice,omitempty" meddler:"practice"`
+	FailureLabel   string            `json:"failureLabel,omitempty" meddler:"failure_label,zeroisnull"`
+	Feedback       string            `json:"feedback,omitempty" meddler:"feedback,zeroisnull"`
+	CreatedAt      time.Time         `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt      time.Time         `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// Announcement is a notice from an instructor to every student in a course,
+// e.g., that the tests for a step were fixed. Students see each announcement
+// until they have read it or it expires.
+type Announcement struct {
+	ID        int64      `json:"id" meddler:"id,pk"`
+	CourseID  int64      `json:"courseID" meddler:"course_id"`
+	UserID    int64      `json:"userID" meddler:"user_id"`
+	Message   string     `json:"message" meddler:"message"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" meddler:"expires_at,localtime"`
+	CreatedAt time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	Read      bool       `json:"read" meddler:"-"`
+	ReadCount int64      `json:"readCount,omitempty" meddler:"-"`
+}
+
+// IPAllowlist restricts where submissions for an assignment are expected to come from.
+// It applies to every student assignment sharing the same LTI resource link.
+// Commits submitted from outside the listed networks are flagged as off site.
+type IPAllowlist struct {
+	ID        int64     `json:"id" meddler:"id,pk"`
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	LtiID     string    `json:"ltiID" meddler:"lti_id"`
+	Networks  []string  `json:"networks" meddler:"networks,json"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// ScorePolicy chooses which graded commit counts for each step of an assignment.
+// Like an IPAllowlist, it applies to every student assignment sharing the same LTI resource link.
+// Policy is one of ScoreLatest (the default), ScoreBest, or ScoreBeforeDeadline.
+// If Practice is set, students can also submit practice checks, which are
+// graded but never scored. GraceMinutes extends the due and lock dates to allow
+// for clock skew; if it is nil, the site-wide default applies.
+type ScorePolicy struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	CourseID     int64     `json:"courseID" meddler:"course_id"`
+	LtiID        string    `json:"ltiID" meddler:"lti_id"`
+	Policy       string    `json:"policy" meddler:"policy"`
+	Practice     bool      `json:"practice" meddler:"practice"`
+	GraceMinutes *int64    `json:"graceMinutes,omitempty" meddler:"grace_minutes"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt    time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+const (
+	ScoreLatest         = "latest"
+	ScoreBest           = "best"
+	ScoreBeforeDeadline = "deadline"
+)
+
+// CommitHash is one link in the tamper-evidence chain for an assignment.
+// A new link is recorded every time a commit is saved, and each link
+// includes the hash of the link before it.
+type CommitHash struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	CommitID     int64     `json:"commitID" meddler:"commit_id"`
+	ProblemID    int64     `json:"problemID" meddler:"problem_id"`
+	Step         int64     `json:"step" meddler:"step"`
+	Hash         string    `json:"hash" meddler:"hash"`
+	PreviousHash string    `json:"previousHash" meddler:"previous_hash"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
 }
 
 // isInstructorRole returns true if the given LTI Roles field indicates this
@@ -115,34 +263,143 @@ func (assignment *Assignment) SetMinorScore(major string, minor int, score float
 	assignment.RawScores[major] = scores
 }
 
+// ErrNothingToScore is returned by ComputeScore when no step of an assignment
+// carries any weight, so there is no score to record or send to the LMS.
+var ErrNothingToScore = errors.New("no step in the assignment counts toward its score")
+
+// ScoreExplanation shows the arithmetic behind an assignment's score.
+type ScoreExplanation struct {
+	Problems     []*ProblemScoreExplanation `json:"problems"`
+	EqualWeights bool                       `json:"equalWeights,omitempty"` // every problem that counts has zero weight, so they count equally
+	Score        float64                    `json:"score"`
+}
+
+// ProblemScoreExplanation is one problem's part of a ScoreExplanation.
+// Its score is the weighted average of its step scores. A problem whose
+// steps all have zero weight is not counted.
+type ProblemScoreExplanation struct {
+	Unique  string                  `json:"unique"`
+	Weight  float64                 `json:"weight"`
+	Steps   []*StepScoreExplanation `json:"steps"`
+	Score   float64                 `json:"score"`
+	Counted bool                    `json:"counted"`
+}
+
+// StepScoreExplanation is one step's part of a ProblemScoreExplanation.
+type StepScoreExplanation struct {
+	Step   int64   `json:"step"`
+	Weight float64 `json:"weight"`
+	Score  float64 `json:"score"`
+}
+
+// ComputeScore combines the raw step scores into an overall score.
+// See ExplainScore for how.
 func (assignment *Assignment) ComputeScore(majorWeights map[string]float64, minorWeights map[string][]float64) (float64, error) {
-	// compute an overall score
-	majorWeightSum, majorScoreSum := 0.0, 0.0
-	for unique, majorWeight := range majorWeights {
+	explanation, err := assignment.ExplainScore(majorWeights, minorWeights)
+	if err != nil {
+		return 0.0, err
+	}
+	return explanation.Score, nil
+}
+
+// ExplainScore combines the raw step scores into an overall score, keeping
+// each part of the computation. Each problem's score is the weighted
+// average of its steps, and the overall score is the weighted average of
+// the problems. A problem whose steps all have zero weight does not count.
+// If every problem that does count has zero weight, they count equally.
+// Weights cannot be negative. If nothing counts, the explanation is
+// returned along with ErrNothingToScore.
+func (assignment *Assignment) ExplainScore(majorWeights map[string]float64, minorWeights map[string][]float64) (*ScoreExplanation, error) {
+	// visit the problems in a fixed order so the sums always come out the same
+	var uniques []string
+	for unique := range majorWeights {
+		uniques = append(uniques, unique)
+	}
+	sort.Strings(uniques)
+
+	// compute the score of each problem
+	explanation := &ScoreExplanation{Problems: []*ProblemScoreExplanation{}}
+	var counted []*ProblemScoreExplanation
+	for _, unique := range uniques {
+		majorWeight := majorWeights[unique]
+		if math.IsNaN(majorWeight) || math.IsInf(majorWeight, 0) || majorWeight < 0.0 {
+			return nil, fmt.Errorf("problem %s has an invalid weight of %v", unique, majorWeight)
+		}
+		problem := &ProblemScoreExplanation{Unique: unique, Weight: majorWeight, Steps: []*StepScoreExplanation{}}
+		explanation.Problems = append(explanation.Problems, problem)
 		scores := assignment.RawScores[unique]
 		minorWeightSum, minorScoreSum := 0.0, 0.0
 		for i, minorWeight := range minorWeights[unique] {
-			minorWeightSum += minorWeight
+			if math.IsNaN(minorWeight) || math.IsInf(minorWeight, 0) || minorWeight < 0.0 {
+				return nil, fmt.Errorf("step %d of problem %s has an invalid weight of %v", i+1, unique, minorWeight)
+			}
+			step := &StepScoreExplanation{Step: int64(i + 1), Weight: minorWeight}
 			if i < len(scores) {
-				minorScoreSum += scores[i] * minorWeight
+				step.Score = scores[i]
 			}
+			problem.Steps = append(problem.Steps, step)
+			minorWeightSum += minorWeight
+			minorScoreSum += step.Score * minorWeight
 		}
 		if minorWeightSum == 0.0 {
-			// no questions/steps, so just skip this group
+			// no questions/steps that count, so just skip this group
 			continue
 		}
-		majorWeightSum += majorWeight
-		minorScoreSum /= minorWeightSum
-		majorScoreSum += minorScoreSum * majorWeight
+		problem.Score = minorScoreSum / minorWeightSum
+		problem.Counted = true
+		counted = append(counted, problem)
+	}
+	if len(counted) == 0 {
+		// nothing available to grade, probably empty quizzes or diagnostic steps
+		return explanation, ErrNothingToScore
+	}
+
+	majorWeightSum, majorScoreSum := 0.0, 0.0
+	for _, problem := range counted {
+		majorWeightSum += problem.Weight
+		majorScoreSum += problem.Score * problem.Weight
 	}
 	if majorWeightSum == 0.0 {
-		// nothing available to grade, probably empty quizzes
-		return 0.0, nil
+		// every problem that counts has zero weight, so weigh them equally
+		explanation.EqualWeights = true
+		majorScoreSum = 0.0
+		for _, problem := range counted {
+			majorScoreSum += problem.Score
+		}
+		explanation.Score = majorScoreSum / float64(len(counted))
+		return explanation, nil
 	}
-	return majorScoreSum / majorWeightSum, nil
+	explanation.Score = majorScoreSum / majorWeightSum
+	return explanation, nil
 }
 
 func (commit *Commit) ComputeSignature(secret, problemTypeSignature, problemSignature, daycareHost string, userID int64) string {
+	// compute signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(commit.signedData(problemTypeSignature, problemSignature, daycareHost, userID))
+	sum := mac.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(sum)
+	return sig
+}
+
+// SignReportCard signs a graded commit with a daycare's own key, covering the
+// same fields as the commit signature. Unlike the commit signature, this
+// cannot be produced by anyone who only knows the shared daycare secret.
+func (commit *Commit) SignReportCard(key ed25519.PrivateKey, problemTypeSignature, problemSignature, daycareHost string, userID int64) string {
+	sum := ed25519.Sign(key, commit.signedData(problemTypeSignature, problemSignature, daycareHost, userID))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// VerifyReportCard checks a signature from SignReportCard against the daycare's public key.
+func (commit *Commit) VerifyReportCard(publicKey ed25519.PublicKey, signature, problemTypeSignature, problemSignature, daycareHost string, userID int64) bool {
+	sum, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, commit.signedData(problemTypeSignature, problemSignature, daycareHost, userID), sum)
+}
+
+func (commit *Commit) signedData(problemTypeSignature, problemSignature, daycareHost string, userID int64) []byte {
 	v := make(url.Values)
 
 	// gather all relevant fields
@@ -152,6 +409,9 @@ func (commit *Commit) ComputeSignature(secret, problemTypeSignature, problemSign
 	v.Add("step", strconv.FormatInt(commit.Step, 10))
 	v.Add("action", commit.Action)
 	v.Add("note", commit.Note)
+	if commit.Practice {
+		v.Add("practice", "true")
+	}
 	for name, contents := range commit.Files {
 		v.Add(fmt.Sprintf("file-%s", name), string(contents))
 	}
@@ -181,13 +441,53 @@ func (commit *Commit) ComputeSignature(secret, problemTypeSignature, problemSign
 	v.Add("daycare_host", daycareHost)
 	v.Add("user_id", strconv.FormatInt(userID, 10))
 
-	// compute signature
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write(encode(v))
-	sum := mac.Sum(nil)
-	sig := base64.StdEncoding.EncodeToString(sum)
-	//log.Printf("commit signature: %s data: %s", sig, encode(v))
-	return sig
+	return encode(v)
+}
+
+// ComputeHash returns a hash of the commit contents and report card chained
+// to the hash of the previous commit saved for the same assignment.
+func (commit *Commit) ComputeHash(previous string) string {
+	v := make(url.Values)
+
+	// gather all relevant fields
+	v.Add("id", strconv.FormatInt(commit.ID, 10))
+	v.Add("assignment_id", strconv.FormatInt(commit.AssignmentID, 10))
+	v.Add("problem_id", strconv.FormatInt(commit.ProblemID, 10))
+	v.Add("step", strconv.FormatInt(commit.Step, 10))
+	v.Add("action", commit.Action)
+	v.Add("note", commit.Note)
+	for name, contents := range commit.Files {
+		v.Add(fmt.Sprintf("file-%s", name), string(contents))
+	}
+	if commit.ReportCard != nil {
+		v.Add("reportcard-passed", strconv.FormatBool(commit.ReportCard.Passed))
+		v.Add("reportcard-note", commit.ReportCard.Note)
+		v.Add("reportcard-duration", commit.ReportCard.Duration.String())
+		for n, result := range commit.ReportCard.Results {
+			v.Add(fmt.Sprintf("reportcard-%d-name", n), result.Name)
+			v.Add(fmt.Sprintf("reportcard-%d-outcome", n), result.Outcome)
+			if result.Details != "" {
+				v.Add(fmt.Sprintf("reportcard-%d-details", n), result.Details)
+			}
+			if result.Context != "" {
+				v.Add(fmt.Sprintf("reportcard-%d-context", n), result.Context)
+			}
+		}
+	}
+	v.Add("score", strconv.FormatFloat(commit.Score, 'g', -1, 64))
+	v.Add("created_at", commit.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+	v.Add("updated_at", commit.UpdatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+	v.Add("remote_addr", commit.RemoteAddr)
+	v.Add("user_agent", commit.UserAgent)
+	v.Add("off_site", strconv.FormatBool(commit.OffSite))
+	if commit.Practice {
+		v.Add("practice", "true")
+	}
+	v.Add("previous", previous)
+
+	// compute hash
+	sum := sha256.Sum256(encode(v))
+	return base64.StdEncoding.EncodeToString(sum[:])
 }
 
 func (commit *Commit) Normalize(now time.Time, whitelist map[string]bool) error {
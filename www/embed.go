@@ -0,0 +1,12 @@
+// Package www holds the static pages the TA serves, built into the server
+// binary so a deployment does not depend on copying them into place.
+// The grind binaries that all.sh puts next to them are not included;
+// the TA serves those from its www directory on disk.
+package www
+
+import "embed"
+
+// Files are the pages built into the server. Add new pages here as well as to this directory.
+//
+//go:embed cli install-grind.sh
+var Files embed.FS